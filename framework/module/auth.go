@@ -18,7 +18,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package module
 
-import "errors"
+import (
+	"errors"
+	"net"
+)
 
 // ErrUnknownCredentials should be returned by auth. provider if supplied
 // credentials are valid for it but are not recognized (e.g. not found in
@@ -33,6 +36,17 @@ type PlainAuth interface {
 	AuthPlain(username, password string) error
 }
 
+// ProtocolPlainAuth is implemented by PlainAuth modules that accept some
+// credentials only for certain protocols or client addresses.
+//
+// protocol is "imap" or "smtp" (see audit.ProtocolIMAP) or empty if it is
+// not known, in which case only credentials valid for all protocols should
+// be accepted. remoteAddr is nil if the client address is not known.
+type ProtocolPlainAuth interface {
+	PlainAuth
+	AuthPlainProtocol(username, password, protocol string, remoteAddr net.Addr) error
+}
+
 // PlainUserDB is a local credentials store that can be managed using maddy command
 // utility.
 type PlainUserDB interface {
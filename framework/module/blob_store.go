@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 )
 
 type Blob interface {
@@ -44,3 +45,14 @@ type BlobStore interface {
 	// Delete removes a set of keys from store. Non-existent keys are ignored.
 	Delete(ctx context.Context, keys []string) error
 }
+
+// BlobLister is implemented by BlobStore implementations that can enumerate
+// stored objects, e.g. to find objects that are no longer used.
+type BlobLister interface {
+	// List calls fn for each stored object. modTime is the time the object
+	// was written.
+	//
+	// Iteration stops if fn returns an error, the error is returned from
+	// List.
+	List(ctx context.Context, fn func(key string, modTime time.Time) error) error
+}
@@ -63,6 +63,16 @@ type EarlyCheck interface {
 	CheckConnection(ctx context.Context, state *ConnState) error
 }
 
+// AuthFailureCheck is an optional module interface that can be implemented
+// by module implementing Check.
+//
+// AuthFailed is called after each failed authentication attempt on the
+// connection. If it returns an error, it is sent to the client instead of the
+// usual authentication failure reply.
+type AuthFailureCheck interface {
+	AuthFailed(ctx context.Context, state *ConnState) error
+}
+
 type CheckState interface {
 	// CheckConnection is executed once when client sends a new message.
 	CheckConnection(ctx context.Context) CheckResult
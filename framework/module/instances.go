@@ -66,6 +66,18 @@ func HasInstance(name string) bool {
 	return ok
 }
 
+// InitializedInstances returns all module instances that were initialized
+// using GetInstance.
+func InitializedInstances() []Module {
+	mods := make([]Module, 0, len(Initialized))
+	for name := range Initialized {
+		if inst, ok := instances[name]; ok {
+			mods = append(mods, inst.mod)
+		}
+	}
+	return mods
+}
+
 // GetInstance returns module instance from global registry, initializing it if
 // necessary.
 //
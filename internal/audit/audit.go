@@ -0,0 +1,117 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package audit implements the audit module that stores authentication
+// attempts, account changes and admin commands in an SQL database.
+//
+// Other modules report events using Record and the helpers below. Events
+// are discarded if the audit module is not configured.
+package audit
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	mdb "github.com/themadorg/madmail/internal/db"
+)
+
+// Event types.
+const (
+	TypeAuth            = "auth"
+	TypeAccountCreate   = "account_create"
+	TypeAccountDelete   = "account_delete"
+	TypeAccountPassword = "account_password"
+	TypeAccountEnable   = "account_enable"
+	TypeAccountDisable  = "account_disable"
+	TypeAccountAppPass  = "account_app_password"
+	TypeAccountTOTP     = "account_totp"
+	TypeAdminCommand    = "admin_command"
+)
+
+// Protocols.
+const (
+	ProtocolSMTP  = "smtp"
+	ProtocolIMAP  = "imap"
+	ProtocolAdmin = "admin"
+)
+
+// current is the initialized audit module, if any.
+var current atomic.Pointer[Log]
+
+// Enabled reports whether recorded events are stored.
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+// Record stores the event. It never blocks, the event is dropped if the
+// audit module cannot keep up.
+func Record(ev mdb.AuditEvent) {
+	l := current.Load()
+	if l == nil {
+		return
+	}
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = time.Now().UTC()
+	}
+	l.record(ev)
+}
+
+// remoteIP returns the IP address of addr without the port.
+func remoteIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case nil:
+		return ""
+	case *net.TCPAddr:
+		return addr.IP.String()
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+		return host
+	}
+}
+
+// Auth records the result of the authentication attempt.
+func Auth(protocol, username string, remoteAddr net.Addr, err error) {
+	ev := mdb.AuditEvent{
+		Type:     TypeAuth,
+		Account:  username,
+		RemoteIP: remoteIP(remoteAddr),
+		Protocol: protocol,
+		Success:  err == nil,
+	}
+	if err != nil {
+		ev.Detail = err.Error()
+	}
+	Record(ev)
+}
+
+// Account records the account change of typ, e.g. TypeAccountCreate.
+func Account(typ, account string, err error) {
+	ev := mdb.AuditEvent{
+		Type:    typ,
+		Account: account,
+		Success: err == nil,
+	}
+	if err != nil {
+		ev.Detail = err.Error()
+	}
+	Record(ev)
+}
@@ -0,0 +1,291 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package audit
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/log"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm"
+)
+
+// ModName is the name of the audit module. The module is not referenced by
+// other configuration blocks, so it is initialized explicitly at startup.
+const ModName = "audit"
+
+// writeBatchSize is the maximum number of events inserted at once.
+const writeBatchSize = 100
+
+var droppedEvents = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "audit",
+		Name:      "dropped_events",
+		Help:      "Audit events dropped because the write queue was full",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(droppedEvents)
+}
+
+var migrations = []mdb.Migration{
+	{
+		ID: "20261014_audit",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.AuditEvent{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.AuditEvent{})
+		},
+	},
+}
+
+type Log struct {
+	instName string
+	log      log.Logger
+
+	db              *gorm.DB
+	retention       time.Duration
+	cleanupInterval time.Duration
+
+	queue chan mdb.AuditEvent
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Log{
+		instName: instName,
+		log:      log.Logger{Name: ModName},
+	}, nil
+}
+
+func (l *Log) Name() string {
+	return ModName
+}
+
+func (l *Log) InstanceName() string {
+	return l.instName
+}
+
+func (l *Log) Init(cfg *config.Map) error {
+	var (
+		driver        string
+		dsn           mdb.DSN
+		dbOpts        mdb.Options
+		retentionDays int
+		queueSize     int
+	)
+	cfg.Bool("debug", true, false, &l.log.Debug)
+	mdb.DriverDirective(cfg, "driver", true, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", true, nil, &dsn)
+	mdb.Directives(cfg, &dbOpts)
+	cfg.Int("retention_days", false, false, 90, &retentionDays)
+	cfg.Duration("cleanup_interval", false, false, time.Hour, &l.cleanupInterval)
+	cfg.Int("queue_size", false, false, 1024, &queueSize)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if retentionDays < 0 || l.cleanupInterval <= 0 || queueSize < 1 {
+		return config.NodeErr(cfg.Block, "retention_days should not be negative, cleanup_interval and queue_size should be positive")
+	}
+	l.retention = time.Duration(retentionDays) * 24 * time.Hour
+
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "%v", err)
+	}
+	dbOpts.Log = l.log
+	dbOpts.MetricsName = l.instName
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	if err := mdb.Migrate(db, migrations); err != nil {
+		return fmt.Errorf("%s: %w", ModName, err)
+	}
+	l.db = db
+
+	// Management commands write events synchronously, the process exits
+	// right after the command.
+	if !module.NoRun {
+		l.queue = make(chan mdb.AuditEvent, queueSize)
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+		go l.writeLoop()
+	}
+	current.Store(l)
+	return nil
+}
+
+func (l *Log) record(ev mdb.AuditEvent) {
+	if l.queue == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		l.write(ctx, []mdb.AuditEvent{ev})
+		return
+	}
+
+	select {
+	case l.queue <- ev:
+	default:
+		droppedEvents.Inc()
+	}
+}
+
+func (l *Log) write(ctx context.Context, events []mdb.AuditEvent) {
+	if err := l.db.WithContext(ctx).CreateInBatches(events, writeBatchSize).Error; err != nil {
+		l.log.Error("failed to store audit events", err, "count", len(events))
+	}
+}
+
+// writeLoop stores queued events and removes expired ones.
+func (l *Log) writeLoop() {
+	defer close(l.done)
+	defer func() {
+		if err := recover(); err != nil {
+			l.log.Printf("panic during audit log write: %v\n%s", err, debug.Stack())
+		}
+	}()
+
+	t := time.NewTicker(l.cleanupInterval)
+	defer t.Stop()
+
+	batch := make([]mdb.AuditEvent, 0, writeBatchSize)
+	// flush writes ev and events queued after it.
+	flush := func(ev mdb.AuditEvent) {
+		batch = append(batch[:0], ev)
+	collect:
+		for len(batch) < writeBatchSize {
+			select {
+			case ev := <-l.queue:
+				batch = append(batch, ev)
+			default:
+				break collect
+			}
+		}
+		l.write(context.Background(), batch)
+	}
+
+	for {
+		select {
+		case ev := <-l.queue:
+			flush(ev)
+		case <-t.C:
+			if l.retention == 0 {
+				continue
+			}
+			n, err := l.cleanup(context.Background())
+			if err != nil {
+				l.log.Error("cleanup failed", err)
+				continue
+			}
+			l.log.Debugf("removed %d expired events", n)
+		case <-l.stop:
+			for {
+				select {
+				case ev := <-l.queue:
+					flush(ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// cleanup removes events older than retention_days.
+func (l *Log) cleanup(ctx context.Context) (int64, error) {
+	res := l.db.WithContext(ctx).
+		Where("created_at < ?", time.Now().UTC().Add(-l.retention)).
+		Delete(&mdb.AuditEvent{})
+	return res.RowsAffected, res.Error
+}
+
+func (l *Log) Close() error {
+	if l.db == nil {
+		return nil
+	}
+	current.CompareAndSwap(l, nil)
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	return mdb.Close(ctx, l.db)
+}
+
+// GORM implements mdb.Provider.
+func (l *Log) GORM() *gorm.DB {
+	return l.db
+}
+
+// CheckHealth implements module.HealthChecker.
+func (l *Log) CheckHealth(ctx context.Context) error {
+	return mdb.Ping(ctx, l.db)
+}
+
+// Filter selects events returned by Query. Zero fields are not checked.
+type Filter struct {
+	Account string
+	Type    string
+	Since   time.Time
+	Until   time.Time
+	// Limit is the maximum number of events returned, the most recent
+	// ones are returned first.
+	Limit int
+}
+
+// Query returns stored events matching the filter, newest first.
+func (l *Log) Query(ctx context.Context, f Filter) ([]mdb.AuditEvent, error) {
+	q := l.db.WithContext(ctx).Order("created_at DESC").Order("id DESC")
+	if f.Account != "" {
+		q = q.Where("account = ?", f.Account)
+	}
+	if f.Type != "" {
+		q = q.Where("type = ?", f.Type)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("created_at >= ?", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("created_at < ?", f.Until.UTC())
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+
+	var events []mdb.AuditEvent
+	err := q.Find(&events).Error
+	return events, err
+}
+
+func init() {
+	module.Register(ModName, New)
+	mdb.RegisterMigrations(ModName, migrations)
+}
@@ -0,0 +1,165 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package audit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+// testLog returns the initialized audit log, events are written in
+// background if async is set.
+func testLog(t *testing.T, async bool) *Log {
+	t.Helper()
+
+	db, err := mdb.NewWithContext(context.Background(), "sqlite3",
+		[]string{filepath.Join(t.TempDir(), "audit.db")}, mdb.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mdb.Migrate(db, migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &Log{
+		log:             testutils.Logger(t, ModName),
+		db:              db,
+		retention:       24 * time.Hour,
+		cleanupInterval: time.Hour,
+	}
+	if async {
+		l.queue = make(chan mdb.AuditEvent, 16)
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+		go l.writeLoop()
+	}
+	current.Store(l)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestRecord(t *testing.T) {
+	l := testLog(t, false)
+	ctx := context.Background()
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242}
+	Auth(ProtocolIMAP, "user@example.org", addr, nil)
+	Auth(ProtocolSMTP, "user@example.org", addr, errors.New("invalid credentials"))
+	Account(TypeAccountCreate, "other@example.org", nil)
+
+	events, err := l.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	if events[0].Type != TypeAccountCreate || events[0].Account != "other@example.org" || !events[0].Success {
+		t.Errorf("wrong newest event: %+v", events[0])
+	}
+	failed := events[1]
+	if failed.Type != TypeAuth || failed.Success || failed.Protocol != ProtocolSMTP ||
+		failed.RemoteIP != "192.0.2.1" || failed.Detail != "invalid credentials" {
+		t.Errorf("wrong failed auth event: %+v", failed)
+	}
+
+	events, err = l.Query(ctx, Filter{Account: "user@example.org", Type: TypeAuth, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Protocol != ProtocolSMTP {
+		t.Errorf("wrong filtered events: %+v", events)
+	}
+	events, err = l.Query(ctx, Filter{Since: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no events, got %+v", events)
+	}
+}
+
+func TestRecord_NotConfigured(t *testing.T) {
+	current.Store(nil)
+	if Enabled() {
+		t.Fatal("audit log is enabled")
+	}
+	// Should not panic.
+	Account(TypeAccountDelete, "user@example.org", nil)
+}
+
+func TestRecord_Async(t *testing.T) {
+	l := testLog(t, true)
+
+	for i := 0; i < 10; i++ {
+		Account(TypeAccountPassword, "user@example.org", nil)
+	}
+	// Queued events are stored before the write loop stops.
+	close(l.stop)
+	<-l.done
+	l.stop = nil
+
+	var count int64
+	if err := l.db.Model(&mdb.AuditEvent{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Fatalf("expected 10 events, got %d", count)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if Enabled() {
+		t.Fatal("audit log is enabled after Close")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	l := testLog(t, false)
+	ctx := context.Background()
+
+	Record(mdb.AuditEvent{Type: TypeAuth, Account: "old@example.org", CreatedAt: time.Now().UTC().Add(-48 * time.Hour)})
+	Record(mdb.AuditEvent{Type: TypeAuth, Account: "new@example.org"})
+
+	n, err := l.cleanup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 removed event, got %d", n)
+	}
+	events, err := l.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Account != "new@example.org" {
+		t.Fatalf("wrong remaining events: %+v", events)
+	}
+}
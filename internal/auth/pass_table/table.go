@@ -27,6 +27,7 @@ import (
 	modconfig "github.com/themadorg/madmail/framework/config/module"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
 	"github.com/themadorg/madmail/internal/auth"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/text/secure/precis"
@@ -181,7 +182,9 @@ func (a *Auth) CreateUserIfNotExists(username, password string) error {
 	return nil
 }
 
-func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts HashOpts) error {
+func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts HashOpts) (err error) {
+	defer func() { audit.Account(audit.TypeAccountCreate, username, err) }()
+
 	tbl, ok := a.table.(module.MutableTable)
 	if !ok {
 		return fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
@@ -216,7 +219,9 @@ func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts H
 	return nil
 }
 
-func (a *Auth) SetUserPassword(username, password string) error {
+func (a *Auth) SetUserPassword(username, password string) (err error) {
+	defer func() { audit.Account(audit.TypeAccountPassword, username, err) }()
+
 	tbl, ok := a.table.(module.MutableTable)
 	if !ok {
 		return fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
@@ -242,7 +247,9 @@ func (a *Auth) SetUserPassword(username, password string) error {
 	return nil
 }
 
-func (a *Auth) DeleteUser(username string) error {
+func (a *Auth) DeleteUser(username string) (err error) {
+	defer func() { audit.Account(audit.TypeAccountDelete, username, err) }()
+
 	tbl, ok := a.table.(module.MutableTable)
 	if !ok {
 		return fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
@@ -29,6 +29,7 @@ import (
 	modconfig "github.com/themadorg/madmail/framework/config/module"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
 	"github.com/themadorg/madmail/internal/auth/sasllogin"
 	"github.com/themadorg/madmail/internal/authz"
 )
@@ -51,6 +52,11 @@ type SASLAuth struct {
 	OnlyFirstID bool
 	EnableLogin bool
 
+	// Protocol is recorded in the audit log for authentication attempts
+	// made using CreateSASL, see audit.Auth. It is also passed to providers
+	// implementing module.ProtocolPlainAuth.
+	Protocol string
+
 	AuthMap       module.Table
 	AuthNormalize authz.NormalizeFunc
 
@@ -99,6 +105,12 @@ func (s *SASLAuth) usernameForAuth(ctx context.Context, saslUsername string) (st
 }
 
 func (s *SASLAuth) AuthPlain(username, password string) error {
+	return s.AuthPlainFrom(username, password, nil)
+}
+
+// AuthPlainFrom is AuthPlain for a client connected from remoteAddr. The
+// address is passed to providers implementing module.ProtocolPlainAuth.
+func (s *SASLAuth) AuthPlainFrom(username, password string, remoteAddr net.Addr) error {
 	if len(s.Plain) == 0 {
 		return ErrUnsupportedMech
 	}
@@ -114,7 +126,11 @@ func (s *SASLAuth) AuthPlain(username, password string) error {
 			"mapped_username", mappedUsername, "original_username", username,
 			"module", p)
 
-		lastErr = p.AuthPlain(mappedUsername, password)
+		if pp, ok := p.(module.ProtocolPlainAuth); ok {
+			lastErr = pp.AuthPlainProtocol(mappedUsername, password, s.Protocol, remoteAddr)
+		} else {
+			lastErr = p.AuthPlain(mappedUsername, password)
+		}
 		if lastErr == nil {
 			return nil
 		}
@@ -143,7 +159,8 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				return ErrInvalidAuthCred
 			}
 
-			err := s.AuthPlain(username, password)
+			err := s.AuthPlainFrom(username, password, remoteAddr)
+			audit.Auth(s.Protocol, username, remoteAddr, err)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
 				return ErrInvalidAuthCred
@@ -165,7 +182,8 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				return err
 			}
 
-			err = s.AuthPlain(username, password)
+			err = s.AuthPlainFrom(username, password, remoteAddr)
+			audit.Auth(s.Protocol, username, remoteAddr, err)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
 				return ErrInvalidAuthCred
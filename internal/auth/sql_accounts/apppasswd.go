@@ -0,0 +1,180 @@
+package sql_accounts
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
+	"github.com/themadorg/madmail/internal/auth/pass_table"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm"
+)
+
+// Scopes of app passwords. An app password without a scope can be used for
+// both IMAP and message submission.
+const (
+	ScopeAny        = ""
+	ScopeIMAP       = "imap"
+	ScopeSubmission = "submission"
+)
+
+// scopeProtocols maps app password scopes to SASLAuth.Protocol values.
+var scopeProtocols = map[string]string{
+	ScopeIMAP:       audit.ProtocolIMAP,
+	ScopeSubmission: audit.ProtocolSMTP,
+}
+
+// appPasswordLen is the length of generated app passwords, the first
+// appPasswordPrefixLen characters are stored as AppPassword.Prefix.
+const (
+	appPasswordLen       = 28
+	appPasswordPrefixLen = 8
+)
+
+// lastUsedInterval limits how often AppPassword.LastUsedAt is updated so
+// that each login does not cause a write.
+const lastUsedInterval = time.Hour
+
+// ErrNoSuchAppPassword is returned by RevokeAppPassword for unknown or
+// already revoked app passwords.
+var ErrNoSuchAppPassword = errors.New("no such app password")
+
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// randomToken returns a random lowercase base32 string.
+func randomToken(length int) (string, error) {
+	// 5 bits per character.
+	buf := make([]byte, (length*5+7)/8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return strings.ToLower(tokenEncoding.EncodeToString(buf))[:length], nil
+}
+
+// CreateAppPassword generates an app password for the account. The returned
+// password is not stored and cannot be retrieved later.
+func (a *Auth) CreateAppPassword(username, label, scope string) (id uint, password string, err error) {
+	defer func() { audit.Account(audit.TypeAccountAppPass, username, err) }()
+
+	if _, ok := scopeProtocols[scope]; !ok && scope != ScopeAny {
+		return 0, "", fmt.Errorf("%s: create app password %s: unknown scope: %s", modName, username, scope)
+	}
+	acct, err := a.findAccount(context.TODO(), username)
+	if err != nil {
+		return 0, "", fmt.Errorf("%s: create app password %s: %w", modName, username, err)
+	}
+
+	password, err = randomToken(appPasswordLen)
+	if err != nil {
+		return 0, "", fmt.Errorf("%s: create app password %s: %w", modName, username, err)
+	}
+	hash, err := pass_table.HashCompute[pass_table.HashBcrypt](a.hashOpts, password)
+	if err != nil {
+		return 0, "", fmt.Errorf("%s: create app password %s: hash generation: %w", modName, username, err)
+	}
+
+	appPass := mdb.AppPassword{
+		AccountID: acct.ID,
+		Label:     label,
+		Prefix:    password[:appPasswordPrefixLen],
+		Hash:      hash,
+		Scope:     scope,
+	}
+	if err := a.db.Create(&appPass).Error; err != nil {
+		return 0, "", fmt.Errorf("%s: create app password %s: %w", modName, username, err)
+	}
+	return appPass.ID, password, nil
+}
+
+// ListAppPasswords returns app passwords of the account, including revoked
+// ones.
+func (a *Auth) ListAppPasswords(username string) ([]mdb.AppPassword, error) {
+	acct, err := a.findAccount(context.TODO(), username)
+	if err != nil {
+		return nil, fmt.Errorf("%s: list app passwords %s: %w", modName, username, err)
+	}
+	var appPasses []mdb.AppPassword
+	if err := a.db.Where("account_id = ?", acct.ID).Order("id").Find(&appPasses).Error; err != nil {
+		return nil, fmt.Errorf("%s: list app passwords %s: %w", modName, username, err)
+	}
+	return appPasses, nil
+}
+
+// RevokeAppPassword revokes the app password of the account. Revoked app
+// passwords are kept so that they are shown by ListAppPasswords.
+func (a *Auth) RevokeAppPassword(username string, id uint) (err error) {
+	defer func() { audit.Account(audit.TypeAccountAppPass, username, err) }()
+
+	acct, err := a.findAccount(context.TODO(), username)
+	if err != nil {
+		return fmt.Errorf("%s: revoke app password %s: %w", modName, username, err)
+	}
+	res := a.db.Model(&mdb.AppPassword{}).
+		Where("id = ? AND account_id = ? AND revoked = ?", id, acct.ID, false).
+		Update("revoked", true)
+	if res.Error != nil {
+		return fmt.Errorf("%s: revoke app password %s: %w", modName, username, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%s: revoke app password %s: %w", modName, username, ErrNoSuchAppPassword)
+	}
+	return nil
+}
+
+// checkAppPassword returns nil if password is an app password of the
+// account that is usable for protocol.
+//
+// The app password is found by its prefix and exactly one hash is verified,
+// the dummy one if there is no match, so that the response time does not
+// depend on the number of app passwords.
+func (a *Auth) checkAppPassword(acct *mdb.Account, username, password, protocol string) error {
+	var appPass mdb.AppPassword
+	found := false
+	if len(password) == appPasswordLen {
+		err := a.primary(context.TODO()).
+			Where("account_id = ? AND prefix = ? AND revoked = ?", acct.ID, password[:appPasswordPrefixLen], false).
+			Take(&appPass).Error
+		switch {
+		case err == nil:
+			found = true
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return err
+		}
+	}
+	hash := a.dummyAppPassHash
+	if found {
+		hash = appPass.Hash
+	}
+	if pass_table.HashVerify[pass_table.HashBcrypt](password, hash) != nil || !found {
+		return module.ErrUnknownCredentials
+	}
+
+	if appPass.Scope != ScopeAny && scopeProtocols[appPass.Scope] != protocol {
+		a.Log.Msg("app password used outside of its scope", "username", username,
+			"app_password", appPass.ID, "scope", appPass.Scope, "protocol", protocol)
+		return fmt.Errorf("%w: app password %d is limited to %s", module.ErrUnknownCredentials, appPass.ID, appPass.Scope)
+	}
+
+	now := time.Now()
+	if appPass.LastUsedAt == nil || now.Sub(*appPass.LastUsedAt) >= lastUsedInterval {
+		err := a.db.Model(&mdb.AppPassword{}).
+			Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", appPass.ID, now.Add(-lastUsedInterval)).
+			Update("last_used_at", now).Error
+		if err != nil {
+			a.Log.Error("failed to update app password last use time", err, "username", username,
+				"app_password", appPass.ID)
+		}
+	}
+	return nil
+}
+
+// deleteAppPasswords removes app passwords of the deleted account.
+func deleteAppPasswords(tx *gorm.DB, accountID uint) error {
+	return tx.Where("account_id = ?", accountID).Delete(&mdb.AppPassword{}).Error
+}
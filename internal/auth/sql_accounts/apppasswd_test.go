@@ -0,0 +1,166 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package sql_accounts
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
+	"github.com/themadorg/madmail/internal/auth/pass_table"
+	mdb "github.com/themadorg/madmail/internal/db"
+)
+
+func TestAuth_AppPasswords(t *testing.T) {
+	a := testAuth(t)
+
+	if err := a.CreateUser("user@example.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	_, anyPass, err := a.CreateAppPassword("user@example.org", "phone", ScopeAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imapID, imapPass, err := a.CreateAppPassword("User@example.org", "laptop", ScopeIMAP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imapPass) < 16 || imapPass == anyPass {
+		t.Fatalf("weak app passwords generated: %q, %q", anyPass, imapPass)
+	}
+	if _, _, err := a.CreateAppPassword("user@example.org", "x", "pop3"); err == nil {
+		t.Error("unknown scope accepted")
+	}
+	if _, _, err := a.CreateAppPassword("nobody@example.org", "x", ScopeAny); !errors.Is(err, ErrNoSuchAccount) {
+		t.Error("expected ErrNoSuchAccount, got", err)
+	}
+
+	check := func(pass, protocol string, ok bool) {
+		t.Helper()
+
+		err := a.AuthPlainProtocol("user@example.org", pass, protocol, nil)
+		if (err == nil) != ok {
+			t.Errorf("%s: ok=%v, err: %v", protocol, ok, err)
+		}
+		if err != nil && !errors.Is(err, module.ErrUnknownCredentials) {
+			t.Errorf("%s: unexpected error: %v", protocol, err)
+		}
+	}
+
+	check("password", audit.ProtocolSMTP, true)
+	check(anyPass, audit.ProtocolSMTP, true)
+	check(anyPass, "", true)
+	check(imapPass, audit.ProtocolIMAP, true)
+	check(imapPass, audit.ProtocolSMTP, false)
+	check(imapPass, "", false)
+
+	appPasses, err := a.ListAppPasswords("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(appPasses) != 2 {
+		t.Fatalf("expected 2 app passwords, got %d", len(appPasses))
+	}
+	used := appPasses[1].LastUsedAt
+	if appPasses[1].Label != "laptop" || appPasses[1].Scope != ScopeIMAP || used == nil {
+		t.Fatalf("wrong app password: %+v", appPasses[1])
+	}
+
+	// Last use time is not updated more often than once per hour.
+	check(imapPass, audit.ProtocolIMAP, true)
+	appPasses, err = a.ListAppPasswords("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !appPasses[1].LastUsedAt.Equal(*used) {
+		t.Errorf("last use time updated: %v, was %v", appPasses[1].LastUsedAt, used)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := a.db.Model(&mdb.AppPassword{}).Where("id = ?", imapID).Update("last_used_at", old).Error; err != nil {
+		t.Fatal(err)
+	}
+	check(imapPass, audit.ProtocolIMAP, true)
+	appPasses, err = a.ListAppPasswords("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !appPasses[1].LastUsedAt.After(old.Add(time.Hour)) {
+		t.Errorf("last use time not updated: %v", appPasses[1].LastUsedAt)
+	}
+
+	if err := a.RevokeAppPassword("user@example.org", imapID); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RevokeAppPassword("user@example.org", imapID); !errors.Is(err, ErrNoSuchAppPassword) {
+		t.Error("expected ErrNoSuchAppPassword, got", err)
+	}
+	check(imapPass, audit.ProtocolIMAP, false)
+	check(anyPass, audit.ProtocolIMAP, true)
+
+	if err := a.SetUserEnabled("user@example.org", false); err != nil {
+		t.Fatal(err)
+	}
+	check(anyPass, audit.ProtocolIMAP, false)
+
+	if err := a.DeleteUser("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	if err := a.db.Model(&mdb.AppPassword{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d app passwords left after the account is deleted", count)
+	}
+}
+
+func TestAuth_AppPasswordsSingleHash(t *testing.T) {
+	a := testAuth(t)
+
+	if err := a.CreateUser("user@example.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	var appPass string
+	for _, label := range []string{"a", "b", "c"} {
+		var err error
+		if _, appPass, err = a.CreateAppPassword("user@example.org", label, ScopeAny); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acct, err := a.findAccount(context.Background(), "user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verify := pass_table.HashVerify[pass_table.HashBcrypt]
+	t.Cleanup(func() { pass_table.HashVerify[pass_table.HashBcrypt] = verify })
+	verified := 0
+	pass_table.HashVerify[pass_table.HashBcrypt] = func(pass, hash string) error {
+		verified++
+		return verify(pass, hash)
+	}
+
+	for _, c := range []struct {
+		pass string
+		ok   bool
+	}{
+		{appPass, true},
+		{appPass[:appPasswordPrefixLen] + strings.Repeat("a", appPasswordLen-appPasswordPrefixLen), false},
+		{strings.Repeat("a", appPasswordLen), false},
+		{"short", false},
+	} {
+		verified = 0
+		err := a.checkAppPassword(acct, "user@example.org", c.pass, audit.ProtocolIMAP)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: ok=%v, err: %v", c.pass, c.ok, err)
+		}
+		if verified != 1 {
+			t.Errorf("%s: %d hashes verified", c.pass, verified)
+		}
+	}
+}
@@ -0,0 +1,570 @@
+// Package sql_accounts implements auth.sql, an authentication provider that
+// keeps accounts and password hashes in an SQL database.
+package sql_accounts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/themadorg/madmail/framework/address"
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/log"
+	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
+	"github.com/themadorg/madmail/internal/auth/pass_table"
+	"github.com/themadorg/madmail/internal/authz"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+const modName = "auth.sql"
+
+// ErrAccountExists is returned by CreateUser if the account already exists.
+var ErrAccountExists = errors.New("account already exists")
+
+// ErrNoSuchAccount is returned by management functions for unknown
+// accounts.
+var ErrNoSuchAccount = errors.New("no such account")
+
+// migrations create the accounts, app_passwords and TOTP tables, see
+// mdb.Migrate.
+//
+// Each migration declares the models it needs as they were when it was
+// released, the mdb models may have gained fields since then. GORM derives
+// the table and index names from the type names, so they match mdb.
+var migrations = []mdb.Migration{
+	{
+		ID: "20261014_auth_sql_accounts",
+		Up: func(tx *gorm.DB) error {
+			type Account struct {
+				ID           uint   `gorm:"primaryKey"`
+				Username     string `gorm:"size:255;not null;index:,unique,composite:username_domain"`
+				Domain       string `gorm:"size:255;not null;index:,unique,composite:username_domain"`
+				PasswordHash string `gorm:"not null"`
+				Algorithm    string `gorm:"size:32;not null"`
+				Enabled      bool   `gorm:"not null"`
+				CreatedAt    time.Time
+				UpdatedAt    time.Time
+			}
+			return tx.Migrator().CreateTable(&Account{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(mdb.TableName(tx, "accounts"))
+		},
+	},
+	{
+		ID: "20261014_auth_sql_app_passwords",
+		Up: func(tx *gorm.DB) error {
+			type AppPassword struct {
+				ID         uint   `gorm:"primaryKey"`
+				AccountID  uint   `gorm:"not null;index"`
+				Label      string `gorm:"size:255;not null"`
+				Hash       string `gorm:"not null"`
+				Scope      string `gorm:"size:16;not null;default:''"`
+				Revoked    bool   `gorm:"not null;default:false"`
+				LastUsedAt *time.Time
+				CreatedAt  time.Time
+			}
+			return tx.Migrator().CreateTable(&AppPassword{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(mdb.TableName(tx, "app_passwords"))
+		},
+	},
+	{
+		ID: "20261014_auth_sql_totp",
+		Up: func(tx *gorm.DB) error {
+			type TOTPSecret struct {
+				ID          uint   `gorm:"primaryKey"`
+				AccountID   uint   `gorm:"not null;uniqueIndex"`
+				Secret      string `gorm:"not null"`
+				Digits      int    `gorm:"not null"`
+				Period      int    `gorm:"not null"`
+				Mode        string `gorm:"size:16;not null"`
+				Enabled     bool   `gorm:"not null;default:false"`
+				ConfirmedAt *time.Time
+				LastCounter int64 `gorm:"not null;default:0"`
+				CreatedAt   time.Time
+			}
+			type TOTPRecoveryCode struct {
+				ID        uint   `gorm:"primaryKey"`
+				AccountID uint   `gorm:"not null;index"`
+				Hash      string `gorm:"not null"`
+				UsedAt    *time.Time
+			}
+			return tx.Migrator().CreateTable(&TOTPSecret{}, &TOTPRecoveryCode{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(mdb.TableName(tx, "totp_recovery_codes"), mdb.TableName(tx, "totp_secrets"))
+		},
+	},
+	{
+		ID: "20261015_auth_sql_totp_pending",
+		Up: func(tx *gorm.DB) error {
+			type TOTPSecret struct {
+				PendingSecret string
+				PendingMode   string `gorm:"size:16"`
+			}
+			type TOTPRecoveryCode struct {
+				Pending bool `gorm:"not null;default:false"`
+			}
+			m := tx.Migrator()
+			for _, c := range []struct {
+				model interface{}
+				field string
+			}{
+				{&TOTPSecret{}, "PendingSecret"},
+				{&TOTPSecret{}, "PendingMode"},
+				{&TOTPRecoveryCode{}, "Pending"},
+			} {
+				if err := m.AddColumn(c.model, c.field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			type TOTPSecret struct {
+				PendingSecret string
+				PendingMode   string
+			}
+			type TOTPRecoveryCode struct {
+				Pending bool
+			}
+			m := tx.Migrator()
+			if err := m.DropColumn(&TOTPRecoveryCode{}, "Pending"); err != nil {
+				return err
+			}
+			if err := m.DropColumn(&TOTPSecret{}, "PendingMode"); err != nil {
+				return err
+			}
+			return m.DropColumn(&TOTPSecret{}, "PendingSecret")
+		},
+	},
+	{
+		// App passwords created before are revoked, they have no prefix to
+		// be found by.
+		ID: "20261015_auth_sql_app_password_prefix",
+		Up: func(tx *gorm.DB) error {
+			type AppPassword struct {
+				Prefix  string `gorm:"size:16;not null;default:''"`
+				Revoked bool
+			}
+			if err := tx.Migrator().AddColumn(&AppPassword{}, "Prefix"); err != nil {
+				return err
+			}
+			return tx.Model(&AppPassword{}).Where("prefix = ?", "").Update("revoked", true).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			type AppPassword struct {
+				Prefix string
+			}
+			return tx.Migrator().DropColumn(&AppPassword{}, "Prefix")
+		},
+	},
+}
+
+type Auth struct {
+	instName string
+	db       *gorm.DB
+
+	normalize func(string) (string, error)
+	hashAlgo  string
+	hashOpts  pass_table.HashOpts
+
+	totpIssuer      string
+	trustedNetworks []net.IPNet
+
+	// dummyHash is verified for unknown users so that the response time
+	// does not reveal whether the account exists. dummyAppPassHash is the
+	// same for unknown app passwords.
+	dummyHash        string
+	dummyAppPassHash string
+
+	Log log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("auth.sql: inline arguments are not used")
+	}
+	return &Auth{
+		instName: instName,
+		Log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (a *Auth) Name() string {
+	return modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	var (
+		driver    string
+		dsn       mdb.DSN
+		dbOpts    mdb.Options
+		normalize string
+		threads   uint32
+		trusted   []string
+	)
+	cfg.Bool("debug", true, false, &a.Log.Debug)
+	mdb.DriverDirective(cfg, "driver", true, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", true, nil, &dsn)
+	mdb.Directives(cfg, &dbOpts)
+	cfg.String("auth_normalize", false, false, "precis_casefold_email", &normalize)
+	cfg.Enum("hash", false, false, []string{pass_table.HashBcrypt, pass_table.HashArgon2}, pass_table.HashBcrypt, &a.hashAlgo)
+	cfg.Int("bcrypt_cost", false, false, bcrypt.DefaultCost, &a.hashOpts.BcryptCost)
+	cfg.UInt32("argon2_time", false, false, 2, &a.hashOpts.Argon2Time)
+	cfg.UInt32("argon2_memory", false, false, 1024, &a.hashOpts.Argon2Memory)
+	cfg.UInt32("argon2_threads", false, false, 1, &threads)
+	cfg.String("totp_issuer", false, false, "maddy", &a.totpIssuer)
+	cfg.StringList("totp_trusted_networks", false, false, []string{"127.0.0.0/8", "::1/128"}, &trusted)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if threads == 0 || threads > 255 {
+		return fmt.Errorf("%s: argon2_threads must be between 1 and 255", modName)
+	}
+	a.hashOpts.Argon2Threads = uint8(threads)
+
+	for _, network := range trusted {
+		// Plain IP addresses are accepted too.
+		if !strings.Contains(network, "/") {
+			if strings.Contains(network, ":") {
+				network += "/128"
+			} else {
+				network += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return fmt.Errorf("%s: invalid totp_trusted_networks value: %w", modName, err)
+		}
+		a.trustedNetworks = append(a.trustedNetworks, *ipNet)
+	}
+
+	normFunc, ok := authz.NormalizeFuncs[normalize]
+	if !ok {
+		return fmt.Errorf("%s: unknown normalization function: %s", modName, normalize)
+	}
+	a.normalize = normFunc
+
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return err
+	}
+	dbOpts.Log = a.Log
+	dbOpts.MetricsName = a.instName
+	gdb, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return err
+	}
+	return a.init(gdb)
+}
+
+func (a *Auth) init(gdb *gorm.DB) error {
+	if a.hashAlgo == pass_table.HashBcrypt &&
+		(a.hashOpts.BcryptCost < bcrypt.MinCost || a.hashOpts.BcryptCost > bcrypt.MaxCost) {
+		return fmt.Errorf("%s: bcrypt_cost must be between %d and %d", modName, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	if err := mdb.Migrate(gdb, migrations); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	a.db = gdb
+
+	dummy, err := pass_table.HashCompute[a.hashAlgo](a.hashOpts, "dummy password")
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	a.dummyHash = dummy
+	dummy, err = pass_table.HashCompute[pass_table.HashBcrypt](a.hashOpts, "dummy password")
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	a.dummyAppPassHash = dummy
+	return nil
+}
+
+// splitUsername normalizes username and splits it into the local part and
+// domain used as the account key. Domain is empty for usernames without @.
+func (a *Auth) splitUsername(username string) (localpart, domain string, err error) {
+	norm, err := a.normalize(username)
+	if err != nil {
+		return "", "", err
+	}
+	if !strings.Contains(norm, "@") {
+		return norm, "", nil
+	}
+	return address.Split(norm)
+}
+
+// primary returns a.db with reads sent to the primary database even if
+// replica_dsn is configured. Credentials and TOTP state are checked using
+// it, a lagging replica could accept a revoked app password or a reused
+// code.
+func (a *Auth) primary(ctx context.Context) *gorm.DB {
+	return a.db.WithContext(ctx).Clauses(dbresolver.Write)
+}
+
+func (a *Auth) findAccount(ctx context.Context, username string) (*mdb.Account, error) {
+	localpart, domain, err := a.splitUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	var acct mdb.Account
+	err = a.primary(ctx).Where("username = ? AND domain = ?", localpart, domain).Take(&acct).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoSuchAccount
+		}
+		return nil, err
+	}
+	return &acct, nil
+}
+
+// Lookup implements module.Table. It returns an empty string for existing
+// enabled accounts.
+func (a *Auth) Lookup(ctx context.Context, username string) (string, bool, error) {
+	acct, err := a.findAccount(ctx, username)
+	if err != nil {
+		if errors.Is(err, ErrNoSuchAccount) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return "", acct.Enabled, nil
+}
+
+func (a *Auth) AuthPlain(username, password string) error {
+	return a.AuthPlainProtocol(username, password, "", nil)
+}
+
+// AuthPlainProtocol implements module.ProtocolPlainAuth. In addition to the
+// account password, app passwords with a scope matching protocol are
+// accepted. If TOTP is enabled for the account, the code (or a recovery
+// code) should be appended to the account password as "password:code".
+// App passwords do not require the code.
+func (a *Auth) AuthPlainProtocol(username, password, protocol string, remoteAddr net.Addr) error {
+	acct, err := a.findAccount(context.TODO(), username)
+	if err != nil {
+		if errors.Is(err, ErrNoSuchAccount) {
+			// Take the same time as for an existing account.
+			pass_table.HashVerify[a.hashAlgo](password, a.dummyHash)
+			return module.ErrUnknownCredentials
+		}
+		return err
+	}
+
+	hashVerify := pass_table.HashVerify[acct.Algorithm]
+	if hashVerify == nil {
+		return fmt.Errorf("%s: auth plain %s: unknown hash: %s", modName, username, acct.Algorithm)
+	}
+	verifyErr := hashVerify(password, acct.PasswordHash)
+
+	if !acct.Enabled {
+		a.Log.Msg("authentication attempt for a disabled account", "username", username)
+		return module.ErrUnknownCredentials
+	}
+
+	secret, err := a.enabledTOTP(acct.ID)
+	if err != nil {
+		return fmt.Errorf("%s: auth plain %s: %w", modName, username, err)
+	}
+	if verifyErr == nil {
+		if secret == nil || !a.totpRequired(secret, remoteAddr) {
+			return nil
+		}
+		a.Log.Msg("TOTP code is required", "username", username, "src_ip", remoteAddr)
+		return fmt.Errorf("%w: TOTP code is required", module.ErrUnknownCredentials)
+	}
+	if secret != nil {
+		if pass, code, ok := splitTOTPCode(password); ok && hashVerify(pass, acct.PasswordHash) == nil {
+			return a.checkSecondFactor(acct, secret, username, code)
+		}
+	}
+	if err := a.checkAppPassword(acct, username, password, protocol); err != module.ErrUnknownCredentials {
+		return err
+	}
+	a.Log.DebugMsg("password mismatch", "username", username, "reason", verifyErr)
+	return module.ErrUnknownCredentials
+}
+
+func (a *Auth) hash(password string) (string, error) {
+	return pass_table.HashCompute[a.hashAlgo](a.hashOpts, password)
+}
+
+// ListUsers returns the addresses of all accounts, including disabled ones.
+func (a *Auth) ListUsers() ([]string, error) {
+	var accts []mdb.Account
+	if err := a.db.Order("domain, username").Find(&accts).Error; err != nil {
+		return nil, fmt.Errorf("%s: list users: %w", modName, err)
+	}
+	users := make([]string, 0, len(accts))
+	for _, acct := range accts {
+		if acct.Domain == "" {
+			users = append(users, acct.Username)
+			continue
+		}
+		users = append(users, acct.Username+"@"+acct.Domain)
+	}
+	return users, nil
+}
+
+// CreateUser creates an enabled account with the password hashed using the
+// configured algorithm.
+func (a *Auth) CreateUser(username, password string) (err error) {
+	defer func() { audit.Account(audit.TypeAccountCreate, username, err) }()
+
+	localpart, domain, err := a.splitUsername(username)
+	if err != nil {
+		return fmt.Errorf("%s: create user %s (raw): %w", modName, username, err)
+	}
+	hash, err := a.hash(password)
+	if err != nil {
+		return fmt.Errorf("%s: create user %s: hash generation: %w", modName, username, err)
+	}
+
+	acct := mdb.Account{
+		Username:     localpart,
+		Domain:       domain,
+		PasswordHash: hash,
+		Algorithm:    a.hashAlgo,
+		Enabled:      true,
+	}
+	_, err = mdb.WithTx(context.TODO(), a.db, func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&mdb.Account{}).Where("username = ? AND domain = ?", localpart, domain).Count(&count).Error; err != nil {
+			return err
+		}
+		if count != 0 {
+			return ErrAccountExists
+		}
+		return tx.Create(&acct).Error
+	}, mdb.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("%s: create user %s: %w", modName, username, err)
+	}
+	return nil
+}
+
+// update applies values to the account of username.
+func (a *Auth) update(username string, values map[string]interface{}) error {
+	localpart, domain, err := a.splitUsername(username)
+	if err != nil {
+		return err
+	}
+	res := a.db.Model(&mdb.Account{}).Where("username = ? AND domain = ?", localpart, domain).Updates(values)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNoSuchAccount
+	}
+	return nil
+}
+
+// SetUserPassword replaces the password of the account, hashing it using
+// the configured algorithm.
+func (a *Auth) SetUserPassword(username, password string) (err error) {
+	defer func() { audit.Account(audit.TypeAccountPassword, username, err) }()
+
+	hash, err := a.hash(password)
+	if err != nil {
+		return fmt.Errorf("%s: set password %s: hash generation: %w", modName, username, err)
+	}
+	if err := a.update(username, map[string]interface{}{
+		"password_hash": hash,
+		"algorithm":     a.hashAlgo,
+	}); err != nil {
+		return fmt.Errorf("%s: set password %s: %w", modName, username, err)
+	}
+	return nil
+}
+
+// SetUserEnabled enables or disables the account. Disabled accounts cannot
+// authenticate but are kept in the database.
+func (a *Auth) SetUserEnabled(username string, enabled bool) (err error) {
+	defer func() {
+		typ := audit.TypeAccountDisable
+		if enabled {
+			typ = audit.TypeAccountEnable
+		}
+		audit.Account(typ, username, err)
+	}()
+
+	if err := a.update(username, map[string]interface{}{"enabled": enabled}); err != nil {
+		return fmt.Errorf("%s: set enabled %s: %w", modName, username, err)
+	}
+	return nil
+}
+
+// UserEnabled reports whether the account is enabled.
+func (a *Auth) UserEnabled(username string) (bool, error) {
+	acct, err := a.findAccount(context.TODO(), username)
+	if err != nil {
+		return false, fmt.Errorf("%s: user enabled %s: %w", modName, username, err)
+	}
+	return acct.Enabled, nil
+}
+
+func (a *Auth) DeleteUser(username string) (err error) {
+	defer func() { audit.Account(audit.TypeAccountDelete, username, err) }()
+
+	localpart, domain, err := a.splitUsername(username)
+	if err != nil {
+		return fmt.Errorf("%s: del user %s (raw): %w", modName, username, err)
+	}
+	_, err = mdb.WithTx(context.TODO(), a.db, func(tx *gorm.DB) error {
+		var acct mdb.Account
+		err := tx.Where("username = ? AND domain = ?", localpart, domain).Take(&acct).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNoSuchAccount
+			}
+			return err
+		}
+		if err := deleteAppPasswords(tx, acct.ID); err != nil {
+			return err
+		}
+		if err := deleteTOTP(tx, acct.ID); err != nil {
+			return err
+		}
+		return tx.Delete(&acct).Error
+	}, mdb.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("%s: del user %s: %w", modName, username, err)
+	}
+	return nil
+}
+
+// CheckHealth implements module.HealthChecker.
+func (a *Auth) CheckHealth(ctx context.Context) error {
+	return mdb.Ping(ctx, a.db)
+}
+
+// GORM implements mdb.Provider.
+func (a *Auth) GORM() *gorm.DB {
+	return a.db
+}
+
+func (a *Auth) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	return mdb.Close(ctx, a.db)
+}
+
+func init() {
+	module.Register(modName, New)
+	mdb.RegisterMigrations(modName, migrations)
+}
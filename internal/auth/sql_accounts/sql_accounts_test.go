@@ -0,0 +1,185 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package sql_accounts
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/gorm"
+)
+
+func testAuth(t *testing.T, extra ...config.Node) *Auth {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children := append([]config.Node{
+		{Name: "driver", Args: []string{"sqlite3"}},
+		{Name: "dsn", Args: []string{filepath.Join(testutils.Dir(t), "accounts.db")}},
+		{Name: "bcrypt_cost", Args: []string{"4"}},
+	}, extra...)
+	if err := mod.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.Log = testutils.Logger(t, modName)
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestAuth_AuthPlain(t *testing.T) {
+	a := testAuth(t)
+
+	if err := a.CreateUser("User@Example.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CreateUser("user@example.org", "password"); !errors.Is(err, ErrAccountExists) {
+		t.Fatal("expected ErrAccountExists for a duplicate account, got", err)
+	}
+
+	check := func(user, pass string, ok bool) {
+		t.Helper()
+
+		err := a.AuthPlain(user, pass)
+		if (err == nil) != ok {
+			t.Errorf("%s: ok=%v, err: %v", user, ok, err)
+		}
+		if err != nil && !errors.Is(err, module.ErrUnknownCredentials) {
+			t.Errorf("%s: unexpected error: %v", user, err)
+		}
+	}
+
+	check("user@example.org", "password", true)
+	check("USER@example.org", "password", true)
+	check("user@example.org", "different-password", false)
+	check("nobody@example.org", "password", false)
+
+	if err := a.SetUserPassword("user@example.org", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	check("user@example.org", "password", false)
+	check("user@example.org", "new-password", true)
+
+	if err := a.SetUserEnabled("user@example.org", false); err != nil {
+		t.Fatal(err)
+	}
+	check("user@example.org", "new-password", false)
+	if _, ok, err := a.Lookup(context.Background(), "user@example.org"); err != nil || ok {
+		t.Errorf("Lookup for a disabled account: ok=%v, err=%v", ok, err)
+	}
+	if enabled, err := a.UserEnabled("user@example.org"); err != nil || enabled {
+		t.Errorf("UserEnabled for a disabled account: %v, err=%v", enabled, err)
+	}
+	if err := a.SetUserEnabled("user@example.org", true); err != nil {
+		t.Fatal(err)
+	}
+	check("user@example.org", "new-password", true)
+
+	if err := a.SetUserPassword("nobody@example.org", "password"); !errors.Is(err, ErrNoSuchAccount) {
+		t.Error("expected ErrNoSuchAccount, got", err)
+	}
+}
+
+func TestAuth_Argon2(t *testing.T) {
+	a := testAuth(t, config.Node{Name: "hash", Args: []string{"argon2"}})
+
+	if err := a.CreateUser("user@example.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	// Accounts keep their algorithm if the configured one changes.
+	a.hashAlgo = "bcrypt"
+	if err := a.CreateUser("other@example.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"user@example.org", "other@example.org"} {
+		if err := a.AuthPlain(user, "password"); err != nil {
+			t.Errorf("%s: %v", user, err)
+		}
+		if err := a.AuthPlain(user, "different-password"); err == nil {
+			t.Errorf("%s: wrong password accepted", user)
+		}
+	}
+}
+
+func TestAuth_DeleteUser(t *testing.T) {
+	a := testAuth(t)
+
+	for _, user := range []string{"b@example.org", "a@example.org", "a@example.com"} {
+		if err := a.CreateUser(user, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, err := a.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a@example.com", "a@example.org", "b@example.org"}; !reflect.DeepEqual(users, want) {
+		t.Errorf("ListUsers: want %v, got %v", want, users)
+	}
+
+	if err := a.DeleteUser("a@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DeleteUser("a@example.org"); !errors.Is(err, ErrNoSuchAccount) {
+		t.Error("expected ErrNoSuchAccount, got", err)
+	}
+	if err := a.AuthPlain("a@example.org", "password"); err == nil {
+		t.Error("deleted account can authenticate")
+	}
+}
+
+func TestMigrations_Upgrade(t *testing.T) {
+	gdb, err := mdb.New("sqlite3", []string{filepath.Join(testutils.Dir(t), "accounts.db")}, mdb.Options{TablePrefix: "madmail_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mdb.Close(context.Background(), gdb) })
+
+	// Database created before TOTP re-enrollment and app password prefixes
+	// were supported.
+	if _, err := mdb.MigrateTo(gdb, migrations, "20261014_auth_sql_totp"); err != nil {
+		t.Fatal(err)
+	}
+	if gdb.Migrator().HasColumn(&mdb.TOTPSecret{}, "PendingSecret") {
+		t.Fatal("pending_secret is created by the initial TOTP migration")
+	}
+	legacy := map[string]interface{}{"account_id": 1, "label": "phone", "hash": "x", "scope": "", "revoked": false}
+	if err := gdb.Table("madmail_app_passwords").Create(legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := mdb.Migrate(gdb, migrations); err != nil {
+		t.Fatal(err)
+	}
+	var appPass mdb.AppPassword
+	if err := gdb.Take(&appPass).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !appPass.Revoked {
+		t.Error("app password without a prefix is not revoked")
+	}
+
+	// Migrations must produce the current models.
+	for _, model := range []interface{}{&mdb.Account{}, &mdb.AppPassword{}, &mdb.TOTPSecret{}, &mdb.TOTPRecoveryCode{}} {
+		stmt := &gorm.Statement{DB: gdb}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		for _, column := range stmt.Schema.DBNames {
+			if !gdb.Migrator().HasColumn(model, column) {
+				t.Errorf("%s.%s is not created by migrations", stmt.Schema.Table, column)
+			}
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package sql_accounts
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
+	"github.com/themadorg/madmail/internal/auth/pass_table"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm"
+)
+
+// TOTP modes, see mdb.TOTPSecret.
+const (
+	TOTPModeAlways    = "always"
+	TOTPModeUntrusted = "untrusted"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSecretLen is the length of the base32-encoded secret, 160 bits as
+	// recommended by RFC 4226.
+	totpSecretLen = 32
+
+	recoveryCodeCount = 10
+	recoveryCodeLen   = 12
+)
+
+var (
+	// ErrNoTOTP is returned by TOTP management functions for accounts
+	// without TOTP enrollment.
+	ErrNoTOTP = errors.New("TOTP is not enrolled")
+
+	// ErrInvalidTOTPCode is returned by ConfirmTOTP for wrong or reused
+	// codes.
+	ErrInvalidTOTPCode = errors.New("invalid TOTP code")
+)
+
+// TOTPEnrollment is the result of EnrollTOTP. It is not stored in plain text
+// and cannot be retrieved later.
+type TOTPEnrollment struct {
+	// Secret is the base32-encoded shared secret.
+	Secret string
+	// URI is the otpauth:// URI of the secret, usually shown as a QR code.
+	URI string
+	// RecoveryCodes can be used once each instead of a TOTP code.
+	RecoveryCodes []string
+}
+
+// hotp computes the HOTP value as defined by RFC 4226.
+func hotp(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+func validTOTPMode(mode string) bool {
+	return mode == TOTPModeAlways || mode == TOTPModeUntrusted
+}
+
+// EnrollTOTP generates a TOTP secret and recovery codes for the account.
+// Codes are not required until the enrollment is confirmed using
+// ConfirmTOTP. If TOTP is already enabled, the existing secret and recovery
+// codes are used until then.
+func (a *Auth) EnrollTOTP(username, mode string) (enrollment TOTPEnrollment, err error) {
+	defer func() { audit.Account(audit.TypeAccountTOTP, username, err) }()
+
+	if !validTOTPMode(mode) {
+		return TOTPEnrollment{}, fmt.Errorf("%s: enroll TOTP %s: unknown mode: %s", modName, username, mode)
+	}
+	if !mdb.EncryptionKeysSet() {
+		return TOTPEnrollment{}, fmt.Errorf("%s: enroll TOTP %s: db_encryption_key is required to store TOTP secrets", modName, username)
+	}
+	acct, err := a.findAccount(context.TODO(), username)
+	if err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("%s: enroll TOTP %s: %w", modName, username, err)
+	}
+
+	secret, err := randomToken(totpSecretLen)
+	if err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("%s: enroll TOTP %s: %w", modName, username, err)
+	}
+	secret = strings.ToUpper(secret)
+
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]mdb.TOTPRecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		code, err := randomToken(recoveryCodeLen)
+		if err != nil {
+			return TOTPEnrollment{}, fmt.Errorf("%s: enroll TOTP %s: %w", modName, username, err)
+		}
+		hash, err := pass_table.HashCompute[pass_table.HashBcrypt](a.hashOpts, code)
+		if err != nil {
+			return TOTPEnrollment{}, fmt.Errorf("%s: enroll TOTP %s: hash generation: %w", modName, username, err)
+		}
+		codes[i] = code[:recoveryCodeLen/2] + "-" + code[recoveryCodeLen/2:]
+		rows[i] = mdb.TOTPRecoveryCode{AccountID: acct.ID, Hash: hash}
+	}
+
+	_, err = mdb.WithTx(context.TODO(), a.db, func(tx *gorm.DB) error {
+		var current mdb.TOTPSecret
+		err := tx.Select("id", "enabled").Where("account_id = ?", acct.ID).Take(&current).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err == nil && current.Enabled {
+			if err := tx.Where("account_id = ? AND pending = ?", acct.ID, true).Delete(&mdb.TOTPRecoveryCode{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&current).Select("PendingSecret", "PendingMode").Updates(&mdb.TOTPSecret{
+				PendingSecret: secret,
+				PendingMode:   mode,
+			}).Error; err != nil {
+				return err
+			}
+			for i := range rows {
+				rows[i].Pending = true
+			}
+			return tx.Create(&rows).Error
+		}
+
+		if err := deleteTOTP(tx, acct.ID); err != nil {
+			return err
+		}
+		if err := tx.Create(&mdb.TOTPSecret{
+			AccountID: acct.ID,
+			Secret:    secret,
+			Digits:    totpDigits,
+			Period:    totpPeriod,
+			Mode:      mode,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	}, mdb.TxOptions{})
+	if err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("%s: enroll TOTP %s: %w", modName, username, err)
+	}
+
+	issuer := a.totpIssuer
+	uriValues := url.Values{}
+	uriValues.Set("secret", secret)
+	uriValues.Set("issuer", issuer)
+	uriValues.Set("digits", strconv.Itoa(totpDigits))
+	uriValues.Set("period", strconv.Itoa(totpPeriod))
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + username,
+		RawQuery: uriValues.Encode(),
+	}
+	return TOTPEnrollment{
+		Secret:        secret,
+		URI:           uri.String(),
+		RecoveryCodes: codes,
+	}, nil
+}
+
+func (a *Auth) findTOTP(acctID uint) (*mdb.TOTPSecret, error) {
+	var secret mdb.TOTPSecret
+	if err := a.primary(context.TODO()).Where("account_id = ?", acctID).Take(&secret).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNoTOTP
+		}
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// ConfirmTOTP enables TOTP for the account if code is valid for the secret
+// generated by EnrollTOTP. If TOTP is already enabled, the new secret and
+// recovery codes replace the existing ones.
+func (a *Auth) ConfirmTOTP(username, code string) (err error) {
+	defer func() { audit.Account(audit.TypeAccountTOTP, username, err) }()
+
+	acct, err := a.findAccount(context.TODO(), username)
+	if err != nil {
+		return fmt.Errorf("%s: confirm TOTP %s: %w", modName, username, err)
+	}
+	secret, err := a.findTOTP(acct.ID)
+	if err != nil {
+		return fmt.Errorf("%s: confirm TOTP %s: %w", modName, username, err)
+	}
+	if secret.PendingSecret != "" {
+		if err := a.confirmPendingTOTP(secret, code); err != nil {
+			return fmt.Errorf("%s: confirm TOTP %s: %w", modName, username, err)
+		}
+		return nil
+	}
+	if err := a.checkTOTPCode(secret, code); err != nil {
+		return fmt.Errorf("%s: confirm TOTP %s: %w", modName, username, err)
+	}
+	now := time.Now()
+	if err := a.db.Model(secret).Updates(map[string]interface{}{
+		"enabled":      true,
+		"confirmed_at": &now,
+	}).Error; err != nil {
+		return fmt.Errorf("%s: confirm TOTP %s: %w", modName, username, err)
+	}
+	return nil
+}
+
+// confirmPendingTOTP replaces the secret and recovery codes of the account
+// with pending ones if code is valid for the pending secret.
+func (a *Auth) confirmPendingTOTP(secret *mdb.TOTPSecret, code string) error {
+	counter, err := matchTOTPCode(&mdb.TOTPSecret{
+		Secret: secret.PendingSecret,
+		Digits: secret.Digits,
+		Period: secret.Period,
+	}, code)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = mdb.WithTx(context.TODO(), a.db, func(tx *gorm.DB) error {
+		if err := tx.Model(secret).
+			Select("Secret", "Mode", "ConfirmedAt", "LastCounter", "PendingSecret", "PendingMode").
+			Updates(&mdb.TOTPSecret{
+				Secret:      secret.PendingSecret,
+				Mode:        secret.PendingMode,
+				ConfirmedAt: &now,
+				LastCounter: counter,
+			}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("account_id = ? AND pending = ?", secret.AccountID, false).Delete(&mdb.TOTPRecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&mdb.TOTPRecoveryCode{}).Where("account_id = ?", secret.AccountID).Update("pending", false).Error
+	}, mdb.TxOptions{})
+	return err
+}
+
+// SetTOTPMode changes when the TOTP code is required for the account.
+func (a *Auth) SetTOTPMode(username, mode string) (err error) {
+	defer func() { audit.Account(audit.TypeAccountTOTP, username, err) }()
+
+	if !validTOTPMode(mode) {
+		return fmt.Errorf("%s: set TOTP mode %s: unknown mode: %s", modName, username, mode)
+	}
+	acct, err := a.findAccount(context.TODO(), username)
+	if err != nil {
+		return fmt.Errorf("%s: set TOTP mode %s: %w", modName, username, err)
+	}
+	res := a.db.Model(&mdb.TOTPSecret{}).Where("account_id = ?", acct.ID).Update("mode", mode)
+	if res.Error != nil {
+		return fmt.Errorf("%s: set TOTP mode %s: %w", modName, username, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%s: set TOTP mode %s: %w", modName, username, ErrNoTOTP)
+	}
+	return nil
+}
+
+// DisableTOTP removes the TOTP secret and recovery codes of the account.
+func (a *Auth) DisableTOTP(username string) (err error) {
+	defer func() { audit.Account(audit.TypeAccountTOTP, username, err) }()
+
+	acct, err := a.findAccount(context.TODO(), username)
+	if err != nil {
+		return fmt.Errorf("%s: disable TOTP %s: %w", modName, username, err)
+	}
+	if _, err := a.findTOTP(acct.ID); err != nil {
+		return fmt.Errorf("%s: disable TOTP %s: %w", modName, username, err)
+	}
+	_, err = mdb.WithTx(context.TODO(), a.db, func(tx *gorm.DB) error {
+		return deleteTOTP(tx, acct.ID)
+	}, mdb.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("%s: disable TOTP %s: %w", modName, username, err)
+	}
+	return nil
+}
+
+// matchTOTPCode returns the time step code is generated for. Codes for the
+// current and adjacent time steps that are later than the last accepted one
+// are accepted.
+func matchTOTPCode(secret *mdb.TOTPSecret, code string) (int64, error) {
+	key, err := tokenEncoding.DecodeString(secret.Secret)
+	if err != nil {
+		return 0, fmt.Errorf("malformed TOTP secret: %w", err)
+	}
+
+	current := time.Now().Unix() / int64(secret.Period)
+	for counter := current - 1; counter <= current+1; counter++ {
+		if counter <= secret.LastCounter {
+			continue
+		}
+		expected := hotp(key, uint64(counter), secret.Digits)
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+			return counter, nil
+		}
+	}
+	return 0, ErrInvalidTOTPCode
+}
+
+// checkTOTPCode checks the code using matchTOTPCode and records its time
+// step as the last accepted one.
+func (a *Auth) checkTOTPCode(secret *mdb.TOTPSecret, code string) error {
+	counter, err := matchTOTPCode(secret, code)
+	if err != nil {
+		return err
+	}
+
+	// The update fails if the code was accepted concurrently.
+	res := a.db.Model(&mdb.TOTPSecret{}).
+		Where("id = ? AND last_counter < ?", secret.ID, counter).
+		Update("last_counter", counter)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidTOTPCode
+	}
+	secret.LastCounter = counter
+	return nil
+}
+
+// useRecoveryCode marks the matching unused recovery code of the account as
+// used.
+func (a *Auth) useRecoveryCode(acctID uint, code string) error {
+	code = strings.ToLower(strings.ReplaceAll(code, "-", ""))
+
+	var rows []mdb.TOTPRecoveryCode
+	err := a.primary(context.TODO()).Where("account_id = ? AND used_at IS NULL AND pending = ?", acctID, false).Find(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if pass_table.HashVerify[pass_table.HashBcrypt](code, row.Hash) != nil {
+			continue
+		}
+		res := a.db.Model(&mdb.TOTPRecoveryCode{}).
+			Where("id = ? AND used_at IS NULL", row.ID).
+			Update("used_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			break
+		}
+		return nil
+	}
+	return ErrInvalidTOTPCode
+}
+
+// totpRequired reports whether the code should be supplied by the client
+// connected from remoteAddr.
+func (a *Auth) totpRequired(secret *mdb.TOTPSecret, remoteAddr net.Addr) bool {
+	if secret.Mode != TOTPModeUntrusted {
+		return true
+	}
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, network := range a.trustedNetworks {
+		if network.Contains(tcpAddr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// enabledTOTP returns the confirmed TOTP secret of the account or nil if
+// TOTP is not used.
+func (a *Auth) enabledTOTP(acctID uint) (*mdb.TOTPSecret, error) {
+	secret, err := a.findTOTP(acctID)
+	if err != nil {
+		if errors.Is(err, ErrNoTOTP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !secret.Enabled {
+		return nil, nil
+	}
+	return secret, nil
+}
+
+// checkSecondFactor verifies the TOTP or recovery code appended to the
+// account password.
+func (a *Auth) checkSecondFactor(acct *mdb.Account, secret *mdb.TOTPSecret, username, code string) error {
+	isTOTP := len(code) == secret.Digits
+	for _, ch := range code {
+		if ch < '0' || ch > '9' {
+			isTOTP = false
+		}
+	}
+
+	var err error
+	if isTOTP {
+		err = a.checkTOTPCode(secret, code)
+	} else {
+		err = a.useRecoveryCode(acct.ID, code)
+		if err == nil {
+			a.Log.Msg("recovery code used", "username", username)
+		}
+	}
+	if errors.Is(err, ErrInvalidTOTPCode) {
+		a.Log.Msg("invalid TOTP code", "username", username)
+		return fmt.Errorf("%w: invalid TOTP code", module.ErrUnknownCredentials)
+	}
+	return err
+}
+
+// splitTOTPCode splits the "password:code" string.
+func splitTOTPCode(password string) (pass, code string, ok bool) {
+	i := strings.LastIndexByte(password, ':')
+	if i == -1 || i == len(password)-1 {
+		return "", "", false
+	}
+	return password[:i], password[i+1:], true
+}
+
+// deleteTOTP removes the TOTP secret and recovery codes of the account.
+func deleteTOTP(tx *gorm.DB, acctID uint) error {
+	if err := tx.Where("account_id = ?", acctID).Delete(&mdb.TOTPRecoveryCode{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("account_id = ?", acctID).Delete(&mdb.TOTPSecret{}).Error
+}
@@ -0,0 +1,186 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package sql_accounts
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themadorg/madmail/internal/audit"
+	mdb "github.com/themadorg/madmail/internal/db"
+)
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226, Appendix D.
+	key := []byte("12345678901234567890")
+	for counter, want := range []string{"755224", "287082", "359152", "969429"} {
+		if got := hotp(key, uint64(counter), 6); got != want {
+			t.Errorf("counter %d: want %s, got %s", counter, want, got)
+		}
+	}
+	// RFC 6238, Appendix B.
+	if got := hotp(key, 59/30, 8); got != "94287082" {
+		t.Errorf("want 94287082, got %s", got)
+	}
+}
+
+func TestAuth_TOTP(t *testing.T) {
+	if err := mdb.SetEncryptionKeys(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mdb.SetEncryptionKeys() })
+	a := testAuth(t)
+
+	if err := a.CreateUser("user@example.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	enrollment, err := a.EnrollTOTP("user@example.org", TOTPModeAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enrollment.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(enrollment.RecoveryCodes))
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/maddy:user@example.org?") ||
+		!strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Errorf("wrong URI: %s", enrollment.URI)
+	}
+	key, err := tokenEncoding.DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := func(offset int64) string {
+		return hotp(key, uint64(time.Now().Unix()/totpPeriod+offset), totpDigits)
+	}
+
+	check := func(pass string, remoteAddr net.Addr, ok bool) {
+		t.Helper()
+
+		err := a.AuthPlainProtocol("user@example.org", pass, audit.ProtocolIMAP, remoteAddr)
+		if (err == nil) != ok {
+			t.Errorf("%s: ok=%v, err: %v", pass, ok, err)
+		}
+	}
+
+	// Not required until confirmed.
+	check("password", nil, true)
+	if err := a.ConfirmTOTP("user@example.org", "000000"+code(0)); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatal("expected ErrInvalidTOTPCode, got", err)
+	}
+	if err := a.ConfirmTOTP("user@example.org", code(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	check("password", nil, false)
+	check("password:"+code(0), nil, false) // used for confirmation
+	check("password:"+code(1), nil, true)
+	check("password:"+code(1), nil, false) // replay
+	check("wrong:"+code(1), nil, false)
+
+	recovery := enrollment.RecoveryCodes[0]
+	check("password:"+strings.ToUpper(recovery), nil, true)
+	check("password:"+recovery, nil, false)
+	check("password:"+enrollment.RecoveryCodes[1], nil, true)
+
+	_, appPass, err := a.CreateAppPassword("user@example.org", "phone", ScopeAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(appPass, nil, true)
+
+	if err := a.SetTOTPMode("user@example.org", TOTPModeUntrusted); err != nil {
+		t.Fatal(err)
+	}
+	check("password", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}, true)
+	check("password", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242}, false)
+	check("password", nil, false)
+
+	if err := a.DisableTOTP("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DisableTOTP("user@example.org"); !errors.Is(err, ErrNoTOTP) {
+		t.Error("expected ErrNoTOTP, got", err)
+	}
+	check("password", nil, true)
+	check("password:"+enrollment.RecoveryCodes[2], nil, false)
+}
+
+func TestAuth_TOTPReenroll(t *testing.T) {
+	if err := mdb.SetEncryptionKeys(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mdb.SetEncryptionKeys() })
+	a := testAuth(t)
+
+	if err := a.CreateUser("user@example.org", "password"); err != nil {
+		t.Fatal(err)
+	}
+	enroll := func() (TOTPEnrollment, func(offset int64) string) {
+		t.Helper()
+		enrollment, err := a.EnrollTOTP("user@example.org", TOTPModeAlways)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := tokenEncoding.DecodeString(enrollment.Secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enrollment, func(offset int64) string {
+			return hotp(key, uint64(time.Now().Unix()/totpPeriod+offset), totpDigits)
+		}
+	}
+	check := func(pass string, ok bool) {
+		t.Helper()
+		err := a.AuthPlainProtocol("user@example.org", pass, audit.ProtocolIMAP, nil)
+		if (err == nil) != ok {
+			t.Errorf("%s: ok=%v, err: %v", pass, ok, err)
+		}
+	}
+
+	storedTOTP := func() (stored struct{ Secret, PendingSecret string }) {
+		t.Helper()
+		if err := a.db.Table("totp_secrets").Select("secret", "pending_secret").Take(&stored).Error; err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+
+	oldEnrollment, oldCode := enroll()
+	if err := a.ConfirmTOTP("user@example.org", oldCode(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old secret and recovery codes are used until the new one is
+	// confirmed.
+	newEnrollment, newCode := enroll()
+	if stored := storedTOTP(); !strings.HasPrefix(stored.PendingSecret, "v1:") {
+		t.Errorf("pending secret is not encrypted: %+v", stored)
+	}
+	check("password", false)
+	check("password:"+oldCode(1), true)
+	check("password:"+oldEnrollment.RecoveryCodes[0], true)
+	check("password:"+newEnrollment.RecoveryCodes[0], false)
+
+	// Enrolling again replaces the pending secret.
+	newEnrollment, newCode = enroll()
+	if err := a.ConfirmTOTP("user@example.org", oldCode(-1)); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatal("expected ErrInvalidTOTPCode, got", err)
+	}
+	if err := a.ConfirmTOTP("user@example.org", newCode(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	check("password:"+newCode(0), false) // used for confirmation
+	check("password:"+newCode(1), true)
+	check("password:"+oldEnrollment.RecoveryCodes[1], false)
+	check("password:"+newEnrollment.RecoveryCodes[0], true)
+
+	if stored := storedTOTP(); stored.PendingSecret != "" || !strings.HasPrefix(stored.Secret, "v1:") {
+		t.Errorf("unexpected stored secrets: %+v", stored)
+	}
+}
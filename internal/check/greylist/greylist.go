@@ -0,0 +1,487 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package greylist implements the check.greylist module that temporarily
+// rejects the first delivery attempt of each (client network, sender,
+// recipient) triplet. Legitimate mail servers retry the delivery while most
+// spam software does not.
+//
+// Triplets are stored in an SQL database, see mdb.GreylistEntry, so that
+// several servers can share them.
+package greylist
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-message/textproto"
+	"github.com/themadorg/madmail/framework/address"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/dns"
+	"github.com/themadorg/madmail/framework/exterrors"
+	"github.com/themadorg/madmail/framework/log"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/target"
+	"gorm.io/gorm"
+)
+
+const modName = "check.greylist"
+
+var migrations = []mdb.Migration{
+	{
+		ID: "20261014_check_greylist",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.GreylistEntry{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.GreylistEntry{})
+		},
+	},
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+	resolver dns.Resolver
+
+	db *gorm.DB
+
+	// Retries are accepted minDelay after the first attempt. Triplets that
+	// are not retried within retryWindow are removed.
+	minDelay    time.Duration
+	retryWindow time.Duration
+
+	// Clients with at least whitelistPasses accepted retries are not
+	// greylisted. Triplets are removed retention after they were seen last
+	// time.
+	whitelistPasses int
+	retention       time.Duration
+
+	ipv4Prefix int
+	ipv6Prefix int
+
+	exemptAuth      bool
+	exemptNetworks  []net.IPNet
+	spfKnownSenders bool
+
+	cleanupInterval time.Duration
+	stopCleanup     chan struct{}
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		driver         string
+		dsn            mdb.DSN
+		dbOpts         mdb.Options
+		exemptNetworks []string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	mdb.DriverDirective(cfg, "driver", true, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", true, nil, &dsn)
+	mdb.Directives(cfg, &dbOpts)
+	cfg.Duration("min_delay", false, false, 5*time.Minute, &c.minDelay)
+	cfg.Duration("retry_window", false, false, 24*time.Hour, &c.retryWindow)
+	cfg.Int("whitelist_passes", false, false, 5, &c.whitelistPasses)
+	cfg.Duration("retention", false, false, 36*24*time.Hour, &c.retention)
+	cfg.Int("ipv4_prefix", false, false, 24, &c.ipv4Prefix)
+	cfg.Int("ipv6_prefix", false, false, 64, &c.ipv6Prefix)
+	cfg.Bool("exempt_authenticated", false, true, &c.exemptAuth)
+	cfg.StringList("exempt_networks", false, false, []string{"127.0.0.0/8", "::1/128"}, &exemptNetworks)
+	cfg.Bool("spf_known_senders", false, false, &c.spfKnownSenders)
+	cfg.Duration("cleanup_interval", false, false, time.Hour, &c.cleanupInterval)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.minDelay <= 0 || c.retryWindow <= c.minDelay {
+		return config.NodeErr(cfg.Block, "min_delay should be positive and less than retry_window")
+	}
+	if c.retention <= 0 || c.cleanupInterval <= 0 {
+		return config.NodeErr(cfg.Block, "retention and cleanup_interval should be positive")
+	}
+	if c.ipv4Prefix < 0 || c.ipv4Prefix > 32 || c.ipv6Prefix < 0 || c.ipv6Prefix > 128 {
+		return config.NodeErr(cfg.Block, "invalid ipv4_prefix or ipv6_prefix")
+	}
+	for _, network := range exemptNetworks {
+		// Plain IP addresses are accepted too.
+		if !strings.Contains(network, "/") {
+			if strings.Contains(network, ":") {
+				network += "/128"
+			} else {
+				network += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "invalid exempt_networks value: %v", err)
+		}
+		c.exemptNetworks = append(c.exemptNetworks, *ipNet)
+	}
+
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "%v", err)
+	}
+	dbOpts.Log = c.log
+	dbOpts.MetricsName = c.instName
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	if err := mdb.Migrate(db, migrations); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	c.db = db
+
+	if !module.NoRun {
+		c.stopCleanup = make(chan struct{})
+		go c.cleanupLoop()
+	}
+	return nil
+}
+
+// cleanup removes triplets that were not retried within retry_window and
+// triplets not seen for longer than retention.
+func (c *Check) cleanup(ctx context.Context) (int64, error) {
+	now := time.Now().UTC()
+	res := c.db.WithContext(ctx).
+		Where("(passes = ? AND first_seen < ?) OR last_seen < ?", 0, now.Add(-c.retryWindow), now.Add(-c.retention)).
+		Delete(&mdb.GreylistEntry{})
+	return res.RowsAffected, res.Error
+}
+
+func (c *Check) cleanupLoop() {
+	defer func() {
+		if err := recover(); err != nil {
+			c.log.Printf("panic during greylist cleanup: %v\n%s", err, debug.Stack())
+		}
+	}()
+
+	t := time.NewTicker(c.cleanupInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			n, err := c.cleanup(context.Background())
+			if err != nil {
+				c.log.Error("cleanup failed", err)
+				continue
+			}
+			c.log.Debugf("removed %d expired triplets", n)
+		case <-c.stopCleanup:
+			c.stopCleanup <- struct{}{}
+			return
+		}
+	}
+}
+
+func (c *Check) Close() error {
+	if c.db == nil {
+		return nil
+	}
+	if c.stopCleanup != nil {
+		c.stopCleanup <- struct{}{}
+		<-c.stopCleanup
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	return mdb.Close(ctx, c.db)
+}
+
+// CheckHealth implements module.HealthChecker.
+func (c *Check) CheckHealth(ctx context.Context) error {
+	return mdb.Ping(ctx, c.db)
+}
+
+// GORM implements mdb.Provider.
+func (c *Check) GORM() *gorm.DB {
+	return c.db
+}
+
+// network returns the network of the client IP used in triplets.
+func (c *Check) network(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ipNet := net.IPNet{IP: ip4, Mask: net.CIDRMask(c.ipv4Prefix, 32)}
+		ipNet.IP = ipNet.IP.Mask(ipNet.Mask)
+		return ipNet.String()
+	}
+	ipNet := net.IPNet{IP: ip, Mask: net.CIDRMask(c.ipv6Prefix, 128)}
+	ipNet.IP = ipNet.IP.Mask(ipNet.Mask)
+	return ipNet.String()
+}
+
+func normalize(addr string) string {
+	norm, err := address.ForLookup(addr)
+	if err != nil {
+		return strings.ToLower(addr)
+	}
+	return norm
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	ip       net.IP
+	network  string
+	mailFrom string
+	exempt   bool
+
+	// Computed once per message when needed.
+	whitelisted *bool
+	spfPassed   *bool
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	s := &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}
+
+	switch {
+	case msgMeta.Conn == nil:
+		s.log.Debugf("locally generated message, not greylisting")
+		s.exempt = true
+	case c.exemptAuth && msgMeta.Conn.AuthUser != "":
+		s.log.Debugf("authenticated sender, not greylisting")
+		s.exempt = true
+	default:
+		tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+		if !ok {
+			s.log.Debugf("non-TCP/IP source, not greylisting")
+			s.exempt = true
+			break
+		}
+		s.ip = tcpAddr.IP
+		for _, ipNet := range c.exemptNetworks {
+			if ipNet.Contains(s.ip) {
+				s.log.Debugf("client in exempt_networks, not greylisting")
+				s.exempt = true
+				break
+			}
+		}
+		s.network = c.network(s.ip)
+	}
+	return s, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	s.mailFrom = normalize(addr)
+	return module.CheckResult{}
+}
+
+// isWhitelisted reports whether the client network has enough accepted
+// retries to not be greylisted anymore.
+func (s *state) isWhitelisted(ctx context.Context) (bool, error) {
+	if s.c.whitelistPasses <= 0 {
+		return false, nil
+	}
+	if s.whitelisted != nil {
+		return *s.whitelisted, nil
+	}
+
+	var passes int64
+	err := s.c.db.WithContext(ctx).Model(&mdb.GreylistEntry{}).
+		Where("network = ? AND last_seen >= ?", s.network, time.Now().UTC().Add(-s.c.retention)).
+		Select("COALESCE(SUM(passes), 0)").
+		Scan(&passes).Error
+	if err != nil {
+		return false, err
+	}
+	whitelisted := passes >= int64(s.c.whitelistPasses)
+	s.whitelisted = &whitelisted
+	return whitelisted, nil
+}
+
+// isKnownSPFSender reports whether the sender address passed greylisting
+// from any network before and the client is authorized to use it by SPF.
+func (s *state) isKnownSPFSender(ctx context.Context) (bool, error) {
+	if !s.c.spfKnownSenders || s.mailFrom == "" {
+		return false, nil
+	}
+	if s.spfPassed != nil {
+		return *s.spfPassed, nil
+	}
+
+	var count int64
+	err := s.c.db.WithContext(ctx).Model(&mdb.GreylistEntry{}).
+		Where("mail_from = ? AND passes > ? AND last_seen >= ?", s.mailFrom, 0, time.Now().UTC().Add(-s.c.retention)).
+		Limit(1).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	passed := false
+	if count != 0 {
+		res, err := spf.CheckHostWithSender(s.ip, dns.FQDN(s.msgMeta.Conn.Hostname), s.mailFrom,
+			spf.WithContext(ctx), spf.WithResolver(s.c.resolver))
+		s.log.Debugf("spf result: %s (%v)", res, err)
+		passed = res == spf.Pass
+	}
+	s.spfPassed = &passed
+	return passed, nil
+}
+
+// recordPass records an accepted message without the greylisting delay.
+func (s *state) recordPass(ctx context.Context, rcpt string, now time.Time) error {
+	_, err := mdb.Upsert(ctx, s.c.db, &mdb.GreylistEntry{
+		Network:   s.network,
+		MailFrom:  s.mailFrom,
+		RcptTo:    rcpt,
+		FirstSeen: now,
+		LastSeen:  now,
+		Passes:    1,
+	}, []string{"network", "mail_from", "rcpt_to"}, map[string]interface{}{
+		"last_seen": now,
+		"passes":    gorm.Expr("passes + 1"),
+	})
+	return err
+}
+
+// greylist records the attempt and reports whether it should be accepted.
+//
+// The triplet is inserted or updated using a single upsert, so concurrent
+// attempts of the same triplet are counted correctly.
+func (s *state) greylist(ctx context.Context, rcpt string, now time.Time) (bool, error) {
+	cutoff := now.Add(-s.c.minDelay)
+	inserted, err := mdb.Upsert(ctx, s.c.db, &mdb.GreylistEntry{
+		Network:   s.network,
+		MailFrom:  s.mailFrom,
+		RcptTo:    rcpt,
+		FirstSeen: now,
+		LastSeen:  now,
+	}, []string{"network", "mail_from", "rcpt_to"}, map[string]interface{}{
+		"last_seen": now,
+		"passes":    gorm.Expr("CASE WHEN first_seen <= ? THEN passes + 1 ELSE passes END", cutoff),
+	})
+	if err != nil || inserted {
+		return false, err
+	}
+
+	var entry mdb.GreylistEntry
+	err = s.c.db.WithContext(ctx).
+		Where("network = ? AND mail_from = ? AND rcpt_to = ?", s.network, s.mailFrom, rcpt).
+		Take(&entry).Error
+	if err != nil {
+		return false, err
+	}
+	return !entry.FirstSeen.After(cutoff), nil
+}
+
+func (s *state) checkRcpt(ctx context.Context, rcpt string) (bool, error) {
+	now := time.Now().UTC()
+
+	whitelisted, err := s.isWhitelisted(ctx)
+	if err != nil {
+		return false, err
+	}
+	if whitelisted {
+		s.log.Debugf("client network is whitelisted")
+		return true, s.recordPass(ctx, rcpt, now)
+	}
+
+	ok, err := s.greylist(ctx, rcpt, now)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	known, err := s.isKnownSPFSender(ctx)
+	if err != nil {
+		return false, err
+	}
+	if known {
+		s.log.Debugf("known sender with SPF pass")
+		return true, s.recordPass(ctx, rcpt, now)
+	}
+	return false, nil
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	defer trace.StartRegion(ctx, "check.greylist/CheckRcpt").End()
+
+	if s.exempt {
+		return module.CheckResult{}
+	}
+
+	ok, err := s.checkRcpt(ctx, normalize(addr))
+	if err != nil {
+		// Greylisting is not worth rejecting messages because of a
+		// database outage.
+		s.log.Error("greylist lookup failed, accepting", err, "rcpt", addr)
+		return module.CheckResult{}
+	}
+	if ok {
+		return module.CheckResult{}
+	}
+
+	s.log.Msg("greylisted", "rcpt", addr, "network", s.network)
+	return module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         450,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Greylisted, please try again later",
+			CheckName:    modName,
+		},
+	}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+	mdb.RegisterMigrations(modName, migrations)
+}
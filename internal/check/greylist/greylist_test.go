@@ -0,0 +1,219 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package greylist
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/exterrors"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func newTestCheck(t *testing.T, extra ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+
+	err = c.Init(config.NewMap(nil, config.Node{
+		Children: append([]config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(t.TempDir(), "greylist.db")}},
+		}, extra...),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func checkMsg(t *testing.T, c *Check, conn *module.ConnState, from, rcpt string) module.CheckResult {
+	t.Helper()
+
+	ctx := context.Background()
+	state, err := c.CheckStateForMsg(ctx, &module.MsgMetadata{Conn: conn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	if res := state.CheckSender(ctx, from); res.Reject {
+		t.Fatalf("unexpected sender result: %+v", res)
+	}
+	return state.CheckRcpt(ctx, rcpt)
+}
+
+func testConn(ip string) *module.ConnState {
+	return &module.ConnState{
+		Hostname:   "mx.example.org",
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+	}
+}
+
+// backdate makes all recorded attempts look older by d.
+func backdate(t *testing.T, c *Check, d time.Duration) {
+	t.Helper()
+	var entries []mdb.GreylistEntry
+	if err := c.db.Find(&entries).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		err := c.db.Model(&entry).Updates(map[string]interface{}{
+			"first_seen": entry.FirstSeen.Add(-d),
+			"last_seen":  entry.LastSeen.Add(-d),
+		}).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectGreylisted(t *testing.T, res module.CheckResult) {
+	t.Helper()
+	if !res.Reject {
+		t.Fatal("message is not greylisted")
+	}
+	smtpErr, ok := res.Reason.(*exterrors.SMTPError)
+	if !ok || smtpErr.Code != 450 || smtpErr.EnhancedCode != (exterrors.EnhancedCode{4, 7, 1}) {
+		t.Fatalf("wrong reason: %+v", res.Reason)
+	}
+}
+
+func expectAccepted(t *testing.T, res module.CheckResult) {
+	t.Helper()
+	if res.Reject {
+		t.Fatalf("message is greylisted: %+v", res.Reason)
+	}
+}
+
+func TestGreylist(t *testing.T) {
+	c := newTestCheck(t)
+
+	expectGreylisted(t, checkMsg(t, c, testConn("192.0.2.1"), "sender@example.org", "rcpt@example.com"))
+	// Retried too early.
+	expectGreylisted(t, checkMsg(t, c, testConn("192.0.2.1"), "sender@example.org", "rcpt@example.com"))
+
+	backdate(t, c, 10*time.Minute)
+	// Retries may come from another address in the same network.
+	expectAccepted(t, checkMsg(t, c, testConn("192.0.2.200"), "Sender@Example.org", "rcpt@example.com"))
+	expectAccepted(t, checkMsg(t, c, testConn("192.0.2.1"), "sender@example.org", "rcpt@example.com"))
+
+	// Another triplet.
+	expectGreylisted(t, checkMsg(t, c, testConn("192.0.2.1"), "sender@example.org", "rcpt2@example.com"))
+	expectGreylisted(t, checkMsg(t, c, testConn("198.51.100.1"), "sender@example.org", "rcpt@example.com"))
+
+	var entry mdb.GreylistEntry
+	err := c.db.Where("network = ? AND mail_from = ? AND rcpt_to = ?", "192.0.2.0/24", "sender@example.org", "rcpt@example.com").
+		Take(&entry).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Passes != 2 {
+		t.Fatalf("wrong passes count: %d", entry.Passes)
+	}
+}
+
+func TestGreylist_Whitelist(t *testing.T) {
+	c := newTestCheck(t, config.Node{Name: "whitelist_passes", Args: []string{"2"}})
+
+	expectGreylisted(t, checkMsg(t, c, testConn("2001:db8::1"), "sender@example.org", "rcpt@example.com"))
+	backdate(t, c, 10*time.Minute)
+	expectAccepted(t, checkMsg(t, c, testConn("2001:db8::2"), "sender@example.org", "rcpt@example.com"))
+	expectGreylisted(t, checkMsg(t, c, testConn("2001:db8::1"), "other@example.org", "rcpt@example.com"))
+	expectAccepted(t, checkMsg(t, c, testConn("2001:db8::1"), "sender@example.org", "rcpt@example.com"))
+
+	// The network has two passes now.
+	expectAccepted(t, checkMsg(t, c, testConn("2001:db8::1"), "third@example.org", "rcpt@example.com"))
+	expectGreylisted(t, checkMsg(t, c, testConn("2001:db8:1::1"), "third@example.org", "rcpt@example.com"))
+}
+
+func TestGreylist_Exemptions(t *testing.T) {
+	c := newTestCheck(t, config.Node{Name: "exempt_networks", Args: []string{"203.0.113.0/24", "198.51.100.7"}})
+
+	expectAccepted(t, checkMsg(t, c, testConn("203.0.113.5"), "sender@example.org", "rcpt@example.com"))
+	expectAccepted(t, checkMsg(t, c, testConn("198.51.100.7"), "sender@example.org", "rcpt@example.com"))
+	expectGreylisted(t, checkMsg(t, c, testConn("198.51.100.8"), "sender@example.org", "rcpt@example.com"))
+
+	conn := testConn("192.0.2.1")
+	conn.AuthUser = "sender@example.org"
+	expectAccepted(t, checkMsg(t, c, conn, "sender@example.org", "rcpt@example.com"))
+
+	// Locally generated messages.
+	expectAccepted(t, checkMsg(t, c, nil, "sender@example.org", "rcpt@example.com"))
+}
+
+func TestGreylist_SPFKnownSender(t *testing.T) {
+	c := newTestCheck(t, config.Node{Name: "spf_known_senders", Args: []string{"yes"}})
+	c.resolver = &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"example.org.": {TXT: []string{"v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/24 -all"}},
+	}}
+
+	// Unknown sender.
+	expectGreylisted(t, checkMsg(t, c, testConn("192.0.2.1"), "sender@example.org", "rcpt@example.com"))
+	backdate(t, c, 10*time.Minute)
+	expectAccepted(t, checkMsg(t, c, testConn("192.0.2.1"), "sender@example.org", "rcpt@example.com"))
+
+	// Known sender delivering from another authorized network.
+	expectAccepted(t, checkMsg(t, c, testConn("198.51.100.1"), "sender@example.org", "rcpt@example.com"))
+	// Not authorized by SPF.
+	expectGreylisted(t, checkMsg(t, c, testConn("203.0.113.1"), "sender@example.org", "rcpt@example.com"))
+}
+
+func TestGreylist_Cleanup(t *testing.T) {
+	c := newTestCheck(t)
+
+	expectGreylisted(t, checkMsg(t, c, testConn("192.0.2.1"), "sender@example.org", "rcpt@example.com"))
+	expectGreylisted(t, checkMsg(t, c, testConn("192.0.2.1"), "sender@example.org", "rcpt2@example.com"))
+	backdate(t, c, 10*time.Minute)
+	expectAccepted(t, checkMsg(t, c, testConn("192.0.2.1"), "sender@example.org", "rcpt@example.com"))
+
+	// The second triplet was never retried.
+	backdate(t, c, 25*time.Hour)
+	n, err := c.cleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 removed triplet, got %d", n)
+	}
+
+	backdate(t, c, 40*24*time.Hour)
+	n, err = c.cleanup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 removed triplet, got %d", n)
+	}
+}
@@ -0,0 +1,588 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package rate_limit implements the check.rate_limit module that limits the
+// rate of connections, failed authentication attempts and messages per
+// client IP, authenticated user and sender domain.
+//
+// Unlike the limits module, counters are stored in an SQL database, see
+// mdb.RateLimitCounter, so they survive restarts and are shared by all
+// servers using the same database.
+package rate_limit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/themadorg/madmail/framework/address"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/exterrors"
+	"github.com/themadorg/madmail/framework/log"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/target"
+	"gorm.io/gorm"
+)
+
+const modName = "check.rate_limit"
+
+// Event kinds.
+const (
+	kindConnections  = "connections"
+	kindAuthFailures = "auth_failures"
+	kindMessages     = "messages"
+)
+
+// Dimensions events are counted by.
+const (
+	dimIP           = "ip"
+	dimUser         = "user"
+	dimSenderDomain = "sender_domain"
+)
+
+// validDimensions lists dimensions known at the time each kind of event
+// happens.
+var validDimensions = map[string][]string{
+	kindConnections:  {dimIP},
+	kindAuthFailures: {dimIP},
+	kindMessages:     {dimIP, dimUser, dimSenderDomain},
+}
+
+var migrations = []mdb.Migration{
+	{
+		ID: "20261014_check_rate_limit",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.RateLimitCounter{}, &mdb.RateLimitOverride{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.RateLimitCounter{}, &mdb.RateLimitOverride{})
+		},
+	},
+}
+
+// limit allows at most max events of kind per window for each value of
+// dimension.
+type limit struct {
+	kind      string
+	dimension string
+	max       int64
+	window    time.Duration
+}
+
+type overrideKey struct {
+	kind      string
+	dimension string
+	value     string
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	db     *gorm.DB
+	limits []limit
+
+	overridesLck sync.RWMutex
+	overrides    map[overrideKey]int64
+
+	refreshInterval time.Duration
+	cleanupInterval time.Duration
+	stopBackground  chan struct{}
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName:  instName,
+		log:       log.Logger{Name: modName},
+		overrides: map[overrideKey]int64{},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		driver string
+		dsn    mdb.DSN
+		dbOpts mdb.Options
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	mdb.DriverDirective(cfg, "driver", true, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", true, nil, &dsn)
+	mdb.Directives(cfg, &dbOpts)
+	cfg.Duration("refresh_interval", false, false, time.Minute, &c.refreshInterval)
+	cfg.Duration("cleanup_interval", false, false, 10*time.Minute, &c.cleanupInterval)
+	cfg.AllowUnknown()
+	unknown, err := cfg.Process()
+	if err != nil {
+		return err
+	}
+	if c.refreshInterval <= 0 || c.cleanupInterval <= 0 {
+		return config.NodeErr(cfg.Block, "refresh_interval and cleanup_interval should be positive")
+	}
+
+	for _, node := range unknown {
+		l, err := parseLimit(node)
+		if err != nil {
+			return err
+		}
+		c.limits = append(c.limits, l)
+	}
+
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "%v", err)
+	}
+	dbOpts.Log = c.log
+	dbOpts.MetricsName = c.instName
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	if err := mdb.Migrate(db, migrations); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	c.db = db
+
+	if err := c.refreshOverrides(context.Background()); err != nil {
+		return err
+	}
+	if !module.NoRun {
+		c.stopBackground = make(chan struct{})
+		go c.backgroundLoop()
+	}
+	return nil
+}
+
+// parseLimit parses the limit directive:
+//
+//	KIND DIMENSION MAX WINDOW
+func parseLimit(node config.Node) (limit, error) {
+	dims, ok := validDimensions[node.Name]
+	if !ok {
+		return limit{}, config.NodeErr(node, "unknown directive")
+	}
+	if len(node.Args) != 3 {
+		return limit{}, config.NodeErr(node, "expected 3 arguments: dimension, max. count and window")
+	}
+
+	l := limit{kind: node.Name, dimension: node.Args[0]}
+	validDim := false
+	for _, dim := range dims {
+		if dim == l.dimension {
+			validDim = true
+		}
+	}
+	if !validDim {
+		return limit{}, config.NodeErr(node, "%s can be limited only per %v", l.kind, dims)
+	}
+
+	max, err := strconv.ParseInt(node.Args[1], 10, 64)
+	if err != nil || max < 1 {
+		return limit{}, config.NodeErr(node, "invalid max. count: %v", node.Args[1])
+	}
+	l.max = max
+	l.window, err = time.ParseDuration(node.Args[2])
+	if err != nil {
+		return limit{}, config.NodeErr(node, "%v", err)
+	}
+	if l.window < time.Second {
+		return limit{}, config.NodeErr(node, "window should be at least 1s")
+	}
+	return l, nil
+}
+
+func (c *Check) refreshOverrides(ctx context.Context) error {
+	var rows []mdb.RateLimitOverride
+	if err := c.db.WithContext(ctx).Find(&rows).Error; err != nil {
+		return fmt.Errorf("%s: load overrides: %w", modName, err)
+	}
+	overrides := make(map[overrideKey]int64, len(rows))
+	for _, row := range rows {
+		overrides[overrideKey{kind: row.Kind, dimension: row.Dimension, value: row.Value}] = row.MaxCount
+	}
+
+	c.overridesLck.Lock()
+	c.overrides = overrides
+	c.overridesLck.Unlock()
+	return nil
+}
+
+// cleanup removes buckets that are not used to estimate counts anymore.
+func (c *Check) cleanup(ctx context.Context) (int64, error) {
+	now := time.Now().UTC()
+	var (
+		removed   int64
+		maxWindow time.Duration
+	)
+	for _, l := range c.limits {
+		res := c.db.WithContext(ctx).
+			Where("window_seconds = ? AND bucket_start < ?", int64(l.window/time.Second), now.Add(-2*l.window)).
+			Delete(&mdb.RateLimitCounter{})
+		if res.Error != nil {
+			return removed, res.Error
+		}
+		removed += res.RowsAffected
+		if l.window > maxWindow {
+			maxWindow = l.window
+		}
+	}
+	if maxWindow == 0 {
+		return removed, nil
+	}
+
+	// Buckets of limits that are not configured anymore.
+	res := c.db.WithContext(ctx).
+		Where("bucket_start < ?", now.Add(-2*maxWindow)).
+		Delete(&mdb.RateLimitCounter{})
+	return removed + res.RowsAffected, res.Error
+}
+
+func (c *Check) backgroundLoop() {
+	defer func() {
+		if err := recover(); err != nil {
+			c.log.Printf("panic during rate limit cleanup: %v\n%s", err, debug.Stack())
+		}
+	}()
+
+	refresh := time.NewTicker(c.refreshInterval)
+	defer refresh.Stop()
+	cleanup := time.NewTicker(c.cleanupInterval)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-refresh.C:
+			if err := c.refreshOverrides(context.Background()); err != nil {
+				c.log.Error("overrides refresh failed, using previously loaded overrides", err)
+			}
+		case <-cleanup.C:
+			n, err := c.cleanup(context.Background())
+			if err != nil {
+				c.log.Error("cleanup failed", err)
+				continue
+			}
+			c.log.Debugf("removed %d expired buckets", n)
+		case <-c.stopBackground:
+			c.stopBackground <- struct{}{}
+			return
+		}
+	}
+}
+
+func (c *Check) Close() error {
+	if c.db == nil {
+		return nil
+	}
+	if c.stopBackground != nil {
+		c.stopBackground <- struct{}{}
+		<-c.stopBackground
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	return mdb.Close(ctx, c.db)
+}
+
+// CheckHealth implements module.HealthChecker.
+func (c *Check) CheckHealth(ctx context.Context) error {
+	return mdb.Ping(ctx, c.db)
+}
+
+// GORM implements mdb.Provider.
+func (c *Check) GORM() *gorm.DB {
+	return c.db
+}
+
+// maxFor returns the max. count of the limit for the value. ok is false if
+// the value is not limited.
+func (c *Check) maxFor(l limit, value string) (max int64, ok bool) {
+	c.overridesLck.RLock()
+	defer c.overridesLck.RUnlock()
+
+	override, found := c.overrides[overrideKey{kind: l.kind, dimension: l.dimension, value: value}]
+	if !found {
+		override, found = c.overrides[overrideKey{dimension: l.dimension, value: value}]
+	}
+	if !found {
+		return l.max, true
+	}
+	return override, override != 0
+}
+
+// bucketStart returns the start of the fixed bucket of the window containing
+// now.
+func bucketStart(now time.Time, window time.Duration) time.Time {
+	return now.Truncate(window)
+}
+
+// record counts the event for the value using a single upsert.
+func (c *Check) record(ctx context.Context, l limit, value string, now time.Time) error {
+	_, err := mdb.IncrementOnConflict(ctx, c.db, &mdb.RateLimitCounter{
+		Kind:          l.kind,
+		Dimension:     l.dimension,
+		Value:         value,
+		WindowSeconds: int64(l.window / time.Second),
+		BucketStart:   bucketStart(now, l.window),
+		Count:         1,
+	}, []string{"kind", "dimension", "value", "window_seconds", "bucket_start"}, "count", 1)
+	return err
+}
+
+// estimate returns the approximate count of events for the value within the
+// window ending now.
+//
+// The sliding window is approximated using two fixed buckets: the count of
+// the current bucket plus the count of the previous one weighted by the part
+// of the window that overlaps it.
+func (c *Check) estimate(ctx context.Context, l limit, value string, now time.Time) (float64, error) {
+	cur := bucketStart(now, l.window)
+	prev := cur.Add(-l.window)
+
+	var rows []mdb.RateLimitCounter
+	err := c.db.WithContext(ctx).
+		Where("kind = ? AND dimension = ? AND value = ? AND window_seconds = ? AND bucket_start >= ?",
+			l.kind, l.dimension, value, int64(l.window/time.Second), prev).
+		Find(&rows).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var curCount, prevCount int64
+	for _, row := range rows {
+		if row.BucketStart.Before(cur) {
+			prevCount += row.Count
+		} else {
+			curCount += row.Count
+		}
+	}
+	overlap := 1 - float64(now.Sub(cur))/float64(l.window)
+	return float64(curCount) + float64(prevCount)*overlap, nil
+}
+
+// errExceeded is returned by check if the limit is exceeded.
+var errExceeded = errors.New("rate limit exceeded")
+
+// check records the event if doRecord is set and returns errExceeded if more
+// than max events (or max events, if the event was not recorded) happened
+// within the window for any of the values of limits of kind.
+func (c *Check) check(ctx context.Context, kind string, values map[string]string, doRecord bool) error {
+	now := time.Now().UTC()
+	for _, l := range c.limits {
+		if l.kind != kind {
+			continue
+		}
+		value := values[l.dimension]
+		if value == "" {
+			continue
+		}
+		max, ok := c.maxFor(l, value)
+		if !ok {
+			continue
+		}
+
+		if doRecord {
+			if err := c.record(ctx, l, value, now); err != nil {
+				return err
+			}
+		} else {
+			// The event would be the next one.
+			max--
+		}
+		count, err := c.estimate(ctx, l, value, now)
+		if err != nil {
+			return err
+		}
+		if count > float64(max) {
+			c.log.Msg("rate limit exceeded", "kind", l.kind, l.dimension, value,
+				"count", int64(count), "window", l.window)
+			return errExceeded
+		}
+	}
+	return nil
+}
+
+func (c *Check) hasLimits(kind string) bool {
+	for _, l := range c.limits {
+		if l.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(state *module.ConnState) string {
+	tcpAddr, ok := state.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return tcpAddr.IP.String()
+}
+
+// CheckConnection implements module.EarlyCheck.
+//
+// It counts the connection and rejects it if the client IP has too many
+// connections or failed authentication attempts.
+func (c *Check) CheckConnection(ctx context.Context, state *module.ConnState) error {
+	values := map[string]string{dimIP: remoteIP(state)}
+	if values[dimIP] == "" {
+		return nil
+	}
+
+	// Early checks are also run before AUTH, count the connection only once.
+	if state.ModData.Get(c, true) == nil && c.hasLimits(kindConnections) {
+		state.ModData.Set(c, true, true)
+		err := c.check(ctx, kindConnections, values, true)
+		if errors.Is(err, errExceeded) {
+			return &exterrors.SMTPError{
+				Code:         421,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Too many connections, try again later",
+				CheckName:    modName,
+			}
+		}
+		if err != nil {
+			c.log.Error("rate limit check failed, accepting", err, "src_ip", values[dimIP])
+		}
+	}
+
+	return c.checkAuthFailures(ctx, values, false)
+}
+
+// AuthFailed implements module.AuthFailureCheck.
+func (c *Check) AuthFailed(ctx context.Context, state *module.ConnState) error {
+	values := map[string]string{dimIP: remoteIP(state)}
+	if values[dimIP] == "" {
+		return nil
+	}
+	return c.checkAuthFailures(ctx, values, true)
+}
+
+func (c *Check) checkAuthFailures(ctx context.Context, values map[string]string, doRecord bool) error {
+	if !c.hasLimits(kindAuthFailures) {
+		return nil
+	}
+	err := c.check(ctx, kindAuthFailures, values, doRecord)
+	if errors.Is(err, errExceeded) {
+		return &exterrors.SMTPError{
+			Code:         421,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Too many failed authentication attempts, try again later",
+			CheckName:    modName,
+		}
+	}
+	if err != nil {
+		c.log.Error("rate limit check failed, accepting", err, "src_ip", values[dimIP])
+	}
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	values map[string]string
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	if s.msgMeta.Conn == nil || !s.c.hasLimits(kindMessages) {
+		return module.CheckResult{}
+	}
+
+	s.values = map[string]string{
+		dimIP:   remoteIP(s.msgMeta.Conn),
+		dimUser: s.msgMeta.Conn.AuthUser,
+	}
+	if _, domain, err := address.Split(addr); err == nil {
+		s.values[dimSenderDomain] = domain
+	}
+
+	err := s.c.check(ctx, kindMessages, s.values, false)
+	if errors.Is(err, errExceeded) {
+		return module.CheckResult{
+			Reject: true,
+			Reason: &exterrors.SMTPError{
+				Code:         450,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Message rate limit exceeded, try again later",
+				CheckName:    modName,
+			},
+		}
+	}
+	if err != nil {
+		s.log.Error("rate limit check failed, accepting", err)
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// CheckBody counts the message. Limits are enforced at MAIL FROM, so the
+// message body is not received if the client exceeded them.
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	if s.values == nil {
+		return module.CheckResult{}
+	}
+	now := time.Now().UTC()
+	for _, l := range s.c.limits {
+		if l.kind != kindMessages || s.values[l.dimension] == "" {
+			continue
+		}
+		if err := s.c.record(ctx, l, s.values[l.dimension], now); err != nil {
+			s.log.Error("failed to count the message", err)
+		}
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+	mdb.RegisterMigrations(modName, migrations)
+}
@@ -0,0 +1,304 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rate_limit
+
+import (
+	"context"
+	"math"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/exterrors"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func newTestCheck(t *testing.T, dbPath string, limits ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	c.log = testutils.Logger(t, modName)
+
+	err = c.Init(config.NewMap(nil, config.Node{
+		Children: append([]config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{dbPath}},
+		}, limits...),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func limitNode(kind, dim, max, window string) config.Node {
+	return config.Node{Name: kind, Args: []string{dim, max, window}}
+}
+
+func testConn(ip string) *module.ConnState {
+	return &module.ConnState{
+		Hostname:   "mx.example.org",
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+	}
+}
+
+func expectCode(t *testing.T, err error, code int) {
+	t.Helper()
+	smtpErr, ok := err.(*exterrors.SMTPError)
+	if !ok || smtpErr.Code != code {
+		t.Fatalf("expected %d error, got %v", code, err)
+	}
+}
+
+// sendMsg runs the message checks and returns the MAIL FROM result.
+func sendMsg(t *testing.T, c *Check, conn *module.ConnState, from string) module.CheckResult {
+	t.Helper()
+
+	ctx := context.Background()
+	state, err := c.CheckStateForMsg(ctx, &module.MsgMetadata{Conn: conn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	res := state.CheckSender(ctx, from)
+	if res.Reject {
+		return res
+	}
+	if res := state.CheckRcpt(ctx, "rcpt@example.com"); res.Reject {
+		t.Fatalf("unexpected rcpt result: %+v", res)
+	}
+	if res := state.CheckBody(ctx, textproto.Header{}, buffer.MemoryBuffer{}); res.Reject {
+		t.Fatalf("unexpected body result: %+v", res)
+	}
+	return res
+}
+
+func TestRateLimit_Connections(t *testing.T) {
+	c := newTestCheck(t, filepath.Join(t.TempDir(), "rl.db"), limitNode("connections", "ip", "2", "1h"))
+	ctx := context.Background()
+
+	conn := testConn("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		// The same connection is counted once.
+		if err := c.CheckConnection(ctx, conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.CheckConnection(ctx, testConn("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	expectCode(t, c.CheckConnection(ctx, testConn("192.0.2.1")), 421)
+
+	if err := c.CheckConnection(ctx, testConn("192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimit_AuthFailures(t *testing.T) {
+	c := newTestCheck(t, filepath.Join(t.TempDir(), "rl.db"), limitNode("auth_failures", "ip", "2", "1h"))
+	ctx := context.Background()
+
+	conn := testConn("192.0.2.1")
+	for i := 0; i < 2; i++ {
+		if err := c.AuthFailed(ctx, conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectCode(t, c.AuthFailed(ctx, conn), 421)
+
+	// New connections are rejected as well.
+	expectCode(t, c.CheckConnection(ctx, testConn("192.0.2.1")), 421)
+	if err := c.CheckConnection(ctx, testConn("192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimit_Messages(t *testing.T) {
+	c := newTestCheck(t, filepath.Join(t.TempDir(), "rl.db"),
+		limitNode("messages", "sender_domain", "2", "1h"),
+		limitNode("messages", "user", "3", "1h"))
+
+	for i := 0; i < 2; i++ {
+		if res := sendMsg(t, c, testConn("192.0.2.1"), "sender@example.org"); res.Reject {
+			t.Fatalf("message %d rejected: %v", i, res.Reason)
+		}
+	}
+	res := sendMsg(t, c, testConn("192.0.2.2"), "other@example.org")
+	if !res.Reject {
+		t.Fatal("message is not rejected")
+	}
+	expectCode(t, res.Reason, 450)
+
+	// Null sender is not limited per domain.
+	if res := sendMsg(t, c, testConn("192.0.2.1"), ""); res.Reject {
+		t.Fatal(res.Reason)
+	}
+
+	conn := testConn("192.0.2.1")
+	conn.AuthUser = "user@example.net"
+	for _, from := range []string{"a@example.net", "b@example.com", "c@example.info"} {
+		if res := sendMsg(t, c, conn, from); res.Reject {
+			t.Fatalf("message from %s rejected: %v", from, res.Reason)
+		}
+	}
+	if res := sendMsg(t, c, conn, "d@example.biz"); !res.Reject {
+		t.Fatal("message is not rejected")
+	}
+
+	// Locally generated messages.
+	if res := sendMsg(t, c, nil, "sender@example.org"); res.Reject {
+		t.Fatal(res.Reason)
+	}
+}
+
+func TestRateLimit_Overrides(t *testing.T) {
+	c := newTestCheck(t, filepath.Join(t.TempDir(), "rl.db"),
+		limitNode("connections", "ip", "1", "1h"),
+		limitNode("auth_failures", "ip", "1", "1h"))
+	ctx := context.Background()
+
+	overrides := []mdb.RateLimitOverride{
+		{Kind: "connections", Dimension: "ip", Value: "192.0.2.1", MaxCount: 3},
+		{Dimension: "ip", Value: "192.0.2.2"},
+	}
+	if err := c.db.Create(&overrides).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := c.refreshOverrides(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := c.CheckConnection(ctx, testConn("192.0.2.1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectCode(t, c.CheckConnection(ctx, testConn("192.0.2.1")), 421)
+
+	// Not limited at all.
+	for i := 0; i < 5; i++ {
+		if err := c.CheckConnection(ctx, testConn("192.0.2.2")); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.AuthFailed(ctx, testConn("192.0.2.2")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRateLimit_Estimate(t *testing.T) {
+	c := newTestCheck(t, filepath.Join(t.TempDir(), "rl.db"), limitNode("messages", "ip", "10", "1h"))
+	ctx := context.Background()
+	l := c.limits[0]
+
+	now := time.Date(2026, 10, 14, 12, 15, 0, 0, time.UTC)
+	for i := 0; i < 8; i++ {
+		if err := c.record(ctx, l, "192.0.2.1", now.Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.record(ctx, l, "192.0.2.1", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stale bucket.
+	if err := c.record(ctx, l, "192.0.2.1", now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows int64
+	if err := c.db.Model(&mdb.RateLimitCounter{}).Count(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rows != 3 {
+		t.Fatalf("expected one row per bucket, got %d", rows)
+	}
+
+	// 2 + 8 * 3/4
+	count, err := c.estimate(ctx, l, "192.0.2.1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(count-8) > 0.001 {
+		t.Fatalf("wrong estimate: %v", count)
+	}
+}
+
+func TestRateLimit_Shared(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "rl.db")
+	c1 := newTestCheck(t, dbPath, limitNode("auth_failures", "ip", "3", "1h"))
+	c2 := newTestCheck(t, dbPath, limitNode("auth_failures", "ip", "3", "1h"))
+	ctx := context.Background()
+
+	conn := testConn("192.0.2.1")
+	for _, c := range []*Check{c1, c2, c1} {
+		if err := c.AuthFailed(ctx, conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectCode(t, c2.AuthFailed(ctx, conn), 421)
+	expectCode(t, c1.CheckConnection(ctx, testConn("192.0.2.1")), 421)
+}
+
+func TestRateLimit_Cleanup(t *testing.T) {
+	c := newTestCheck(t, filepath.Join(t.TempDir(), "rl.db"),
+		limitNode("connections", "ip", "10", "1m"),
+		limitNode("messages", "ip", "10", "1h"))
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	for _, l := range c.limits {
+		for _, t0 := range []time.Time{now, now.Add(-l.window), now.Add(-3 * l.window)} {
+			if err := c.record(ctx, l, "192.0.2.1", t0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	n, err := c.cleanup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 removed buckets, got %d", n)
+	}
+
+	var rows int64
+	if err := c.db.Model(&mdb.RateLimitCounter{}).Count(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rows != 4 {
+		t.Fatalf("expected 4 buckets left, got %d", rows)
+	}
+}
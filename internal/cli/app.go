@@ -89,6 +89,38 @@ func AddSubcommand(cmd *cli.Command) {
 	}
 }
 
+// ActionHook is called after a subcommand action completes with the error
+// returned by it.
+type ActionHook func(c *cli.Context, err error)
+
+var (
+	actionHooks    []ActionHook
+	actionsWrapped bool
+)
+
+// AddActionHook installs the hook to be called after each subcommand.
+func AddActionHook(h ActionHook) {
+	actionHooks = append(actionHooks, h)
+}
+
+// wrapActions makes subcommand actions call installed hooks.
+func wrapActions(cmds []*cli.Command) {
+	for _, cmd := range cmds {
+		wrapActions(cmd.Subcommands)
+		if cmd.Action == nil {
+			continue
+		}
+		action := cmd.Action
+		cmd.Action = func(c *cli.Context) error {
+			err := action(c)
+			for _, h := range actionHooks {
+				h(c, err)
+			}
+			return err
+		}
+	}
+}
+
 // RunWithoutExit is like Run but returns exit code instead of calling os.Exit
 // To be used in maddy.cover.
 func RunWithoutExit() int {
@@ -106,6 +138,10 @@ func RunWithoutExit() int {
 
 func Run() {
 	mapStdlibFlags(app)
+	if !actionsWrapped {
+		wrapActions(app.Commands)
+		actionsWrapped = true
+	}
 
 	// Actual entry point is registered in maddy.go.
 
@@ -0,0 +1,381 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/hooks"
+	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/auth"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	clitools2 "github.com/themadorg/madmail/internal/cli/clitools"
+	"github.com/themadorg/madmail/internal/storage/imapsql"
+	"github.com/urfave/cli/v2"
+)
+
+// accountsFlags returns the flags selecting the blocks used by accounts
+// subcommands followed by extra.
+func accountsFlags(extra ...cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:    "cfg-block",
+			Usage:   "Storage configuration block to use",
+			EnvVars: []string{"MADDY_CFGBLOCK"},
+			Value:   "local_mailboxes",
+		},
+		&cli.StringFlag{
+			Name:    "auth-block",
+			Usage:   "Credentials store configuration block to use, empty to manage IMAP accounts only",
+			EnvVars: []string{"MADDY_AUTHBLOCK"},
+			Value:   "local_authdb",
+		},
+	}, extra...)
+}
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "accounts",
+			Usage: "Accounts management",
+			Description: `These subcommands manage accounts consisting of credentials stored in
+the block specified by --auth-block (local_authdb by default) and the IMAP
+account in the storage specified by --cfg-block (local_mailboxes by default).
+
+Only storage.imapsql is supported as the storage.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:      "create",
+					Usage:     "Create an account",
+					ArgsUsage: "USERNAME",
+					Description: `Create the credentials and the IMAP account. The password is read from
+the terminal unless --password-file is specified, it is hashed as configured
+for the credentials store.
+`,
+					Flags: accountsFlags(
+						&cli.PathFlag{
+							Name:  "password-file",
+							Usage: "Read the password from the first line of the file",
+						},
+						&cli.StringFlag{
+							Name:  "quota",
+							Usage: "Storage limit, e.g. 1G, instead of the default one",
+						},
+						&cli.BoolFlag{
+							Name:  "default-folders",
+							Usage: "Create Sent, Drafts, Trash and Junk folders",
+						},
+					),
+					Action: withAccounts(accountsCreate),
+				},
+				{
+					Name:      "delete",
+					Usage:     "Delete an account",
+					ArgsUsage: "USERNAME",
+					Flags: accountsFlags(
+						&cli.BoolFlag{
+							Name:  "force",
+							Usage: "Delete the account even if it has messages",
+						},
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					),
+					Action: withAccounts(accountsDelete),
+				},
+				{
+					Name:      "disable",
+					Usage:     "Disable logins to the account, messages are kept",
+					ArgsUsage: "USERNAME",
+					Flags:     accountsFlags(),
+					Action: withAccounts(func(store *imapsql.Storage, creds module.PlainUserDB, ctx *cli.Context) error {
+						return accountsSetEnabled(creds, ctx, false)
+					}),
+				},
+				{
+					Name:      "enable",
+					Usage:     "Enable a disabled account",
+					ArgsUsage: "USERNAME",
+					Flags:     accountsFlags(),
+					Action: withAccounts(func(store *imapsql.Storage, creds module.PlainUserDB, ctx *cli.Context) error {
+						return accountsSetEnabled(creds, ctx, true)
+					}),
+				},
+				{
+					Name:      "set-quota",
+					Usage:     "Set the storage limit of an account",
+					ArgsUsage: "USERNAME LIMIT",
+					Flags:     accountsFlags(),
+					Action:    withAccounts(accountsSetQuota),
+				},
+				{
+					Name:      "passwd",
+					Usage:     "Change the password of an account",
+					ArgsUsage: "USERNAME",
+					Flags: accountsFlags(
+						&cli.PathFlag{
+							Name:  "password-file",
+							Usage: "Read the password from the first line of the file",
+						},
+					),
+					Action: withAccounts(accountsPasswd),
+				},
+				{
+					Name:  "list",
+					Usage: "List accounts",
+					Flags: accountsFlags(
+						&cli.StringFlag{
+							Name:  "domain",
+							Usage: "List only accounts in the domain",
+						},
+						&cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print accounts as a JSON array",
+						},
+					),
+					Action: withAccounts(accountsList),
+				},
+			},
+		})
+}
+
+// withAccounts initializes the storage and the credentials store specified
+// by --cfg-block and --auth-block and calls fn. creds is nil if
+// --auth-block is empty.
+func withAccounts(fn func(store *imapsql.Storage, creds module.PlainUserDB, ctx *cli.Context) error) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		// registerModules changes the working directory to the state
+		// directory.
+		if path := ctx.Path("password-file"); path != "" {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			if err := ctx.Set("password-file", abs); err != nil {
+				return err
+			}
+		}
+
+		globals, mods, err := registerModules(ctx)
+		if err != nil {
+			return err
+		}
+		defer hooks.RunHooks(hooks.EventShutdown)
+
+		cfgBlock, authBlock := ctx.String("cfg-block"), ctx.String("auth-block")
+		for _, name := range []string{cfgBlock, authBlock} {
+			if name != "" && !module.HasInstance(name) {
+				return cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", name), 2)
+			}
+		}
+		if err := initAuditLog(globals, mods, ""); err != nil {
+			return err
+		}
+
+		inst, err := module.GetInstance(cfgBlock)
+		if err != nil {
+			return fmt.Errorf("Error: module initialization failed: %w", err)
+		}
+		store, ok := inst.(*imapsql.Storage)
+		if !ok {
+			return cli.Exit(fmt.Sprintf("Error: configuration block %s is not storage.imapsql", cfgBlock), 2)
+		}
+
+		var creds module.PlainUserDB
+		if authBlock != "" {
+			inst, err := module.GetInstance(authBlock)
+			if err != nil {
+				return fmt.Errorf("Error: module initialization failed: %w", err)
+			}
+			creds, ok = inst.(module.PlainUserDB)
+			if !ok {
+				return cli.Exit(fmt.Sprintf("Error: configuration block %s is not a local credentials store", authBlock), 2)
+			}
+		}
+
+		return fn(store, creds, ctx)
+	}
+}
+
+func accountsUsername(ctx *cli.Context) (string, error) {
+	username := auth.NormalizeUsername(ctx.Args().First())
+	if username == "" {
+		return "", cli.Exit("Error: USERNAME is required", 2)
+	}
+	return username, nil
+}
+
+// readAccountPassword reads the password from --password-file or the
+// terminal.
+func readAccountPassword(ctx *cli.Context, prompt string) (string, error) {
+	path := ctx.Path("password-file")
+	if path == "" {
+		return clitools2.ReadPassword(prompt)
+	}
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return "", cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+	pass := strings.SplitN(string(blob), "\n", 2)[0]
+	pass = strings.TrimSuffix(pass, "\r")
+	if pass == "" {
+		return "", cli.Exit(fmt.Sprintf("Error: %s does not contain a password", path), 2)
+	}
+	return pass, nil
+}
+
+func accountsCreate(store *imapsql.Storage, creds module.PlainUserDB, ctx *cli.Context) error {
+	username, err := accountsUsername(ctx)
+	if err != nil {
+		return err
+	}
+	opts := imapsql.AccountOptions{DefaultFolders: ctx.Bool("default-folders")}
+	if ctx.IsSet("quota") {
+		quota, err := config.ParseDataSize(ctx.String("quota"))
+		if err != nil || quota <= 0 {
+			return cli.Exit("Error: quota should be a positive size, e.g. 1G", 2)
+		}
+		opts.Quota = int64(quota)
+	}
+
+	var pass string
+	if creds != nil {
+		pass, err = readAccountPassword(ctx, "Enter password for new user")
+		if err != nil {
+			return err
+		}
+	}
+	return store.CreateAccount(creds, username, pass, opts)
+}
+
+func accountsDelete(store *imapsql.Storage, creds module.PlainUserDB, ctx *cli.Context) error {
+	username, err := accountsUsername(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools2.Confirmation("Are you sure you want to delete this user account?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	err = store.DeleteAccount(creds, username, ctx.Bool("force"))
+	if errors.Is(err, imapsql.ErrAccountNotEmpty) {
+		return cli.Exit(fmt.Sprintf("Error: %v, use --force to delete it with messages", err), 2)
+	}
+	return err
+}
+
+func accountsSetEnabled(creds module.PlainUserDB, ctx *cli.Context, enabled bool) error {
+	username, err := accountsUsername(ctx)
+	if err != nil {
+		return err
+	}
+	if creds == nil {
+		return cli.Exit("Error: --auth-block is required", 2)
+	}
+
+	err = imapsql.SetAccountEnabled(creds, username, enabled)
+	if errors.Is(err, imapsql.ErrDisableNotSupported) {
+		return cli.Exit(fmt.Sprintf("Error: %s: %v", ctx.String("auth-block"), err), 2)
+	}
+	return err
+}
+
+func accountsSetQuota(store *imapsql.Storage, _ module.PlainUserDB, ctx *cli.Context) error {
+	username, err := accountsUsername(ctx)
+	if err != nil {
+		return err
+	}
+	limit, err := config.ParseDataSize(ctx.Args().Get(1))
+	if err != nil || limit <= 0 {
+		return cli.Exit("Error: LIMIT should be a positive size, e.g. 1G", 2)
+	}
+
+	// SetQuota creates the quota record for unknown accounts.
+	if _, err := store.GetIMAPAcct(username); err != nil {
+		return err
+	}
+	return store.SetQuota(username, int64(limit))
+}
+
+func accountsPasswd(_ *imapsql.Storage, creds module.PlainUserDB, ctx *cli.Context) error {
+	username, err := accountsUsername(ctx)
+	if err != nil {
+		return err
+	}
+	if creds == nil {
+		return cli.Exit("Error: --auth-block is required", 2)
+	}
+
+	pass, err := readAccountPassword(ctx, "Enter new password")
+	if err != nil {
+		return err
+	}
+	return creds.SetUserPassword(username, pass)
+}
+
+func accountsList(store *imapsql.Storage, creds module.PlainUserDB, ctx *cli.Context) error {
+	accts, err := store.ListAccounts(creds, ctx.String("domain"))
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(accts)
+	}
+
+	if len(accts) == 0 {
+		fmt.Fprintln(os.Stderr, "No accounts.")
+		return nil
+	}
+	fmt.Printf("%-40s %-14s %-15s %-15s %s\n", "User", "Status", "Usage", "Limit", "Messages")
+	for _, acct := range accts {
+		status := "enabled"
+		switch {
+		case !acct.HasCredentials && creds != nil:
+			status = "no credentials"
+		case !acct.HasMailbox:
+			status = "no mailbox"
+		case acct.Enabled != nil && !*acct.Enabled:
+			status = "disabled"
+		}
+		limit := "unlimited"
+		if acct.QuotaMax > 0 {
+			limit = formatBytes(acct.QuotaMax)
+		}
+		if acct.QuotaDefault {
+			limit += " (default)"
+		}
+		fmt.Printf("%-40s %-14s %-15s %-15s %d\n", acct.Username, status, formatBytes(acct.QuotaUsed), limit, acct.Messages)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/internal/auth/sql_accounts"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "local_authdb",
+	}
+
+	appPassCmd := func(name, usage, argsUsage string, flags []cli.Flag, action func(a *sql_accounts.Auth, ctx *cli.Context) error) *cli.Command {
+		return &cli.Command{
+			Name:      name,
+			Usage:     usage,
+			ArgsUsage: argsUsage,
+			Flags:     append([]cli.Flag{cfgBlockFlag}, flags...),
+			Action: func(ctx *cli.Context) error {
+				a, err := openSQLAccounts(ctx)
+				if err != nil {
+					return err
+				}
+				defer closeIfNeeded(a)
+				return action(a, ctx)
+			},
+		}
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "app-passwords",
+			Usage: "Application-specific passwords management",
+			Description: `These subcommands manage app passwords of accounts stored by auth.sql
+defined in a top-level configuration block of maddy.conf,
+e.g. 'auth.sql local_authdb { ... }'. By default, the local_authdb block is
+used, this can be changed using --cfg-block flag.
+
+App passwords can be used instead of the account password. They are generated
+by the server and shown only once, when created.
+`,
+			Subcommands: []*cli.Command{
+				appPassCmd("create", "Generate an app password for the account", "USERNAME LABEL", []cli.Flag{
+					&cli.StringFlag{
+						Name:  "scope",
+						Usage: "Allow the password only for 'imap' or 'submission'",
+					},
+				}, appPassCreate),
+				appPassCmd("list", "List app passwords of the account", "USERNAME", nil, appPassList),
+				appPassCmd("revoke", "Revoke the app password", "USERNAME ID", nil, appPassRevoke),
+			},
+		})
+}
+
+func openSQLAccounts(ctx *cli.Context) (*sql_accounts.Auth, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	a, ok := mod.Instance.(*sql_accounts.Auth)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not auth.sql", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return a, nil
+}
+
+func appPassErr(err error, username string) error {
+	switch {
+	case errors.Is(err, sql_accounts.ErrNoSuchAccount):
+		return cli.Exit(fmt.Sprintf("Error: no such account: %s", username), 2)
+	case errors.Is(err, sql_accounts.ErrNoSuchAppPassword):
+		return cli.Exit("Error: no such app password", 2)
+	}
+	return err
+}
+
+func appPassCreate(a *sql_accounts.Auth, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	label := ctx.Args().Get(1)
+	if label == "" {
+		return cli.Exit("Error: LABEL is required", 2)
+	}
+	scope := ctx.String("scope")
+	switch scope {
+	case sql_accounts.ScopeAny, sql_accounts.ScopeIMAP, sql_accounts.ScopeSubmission:
+	default:
+		return cli.Exit("Error: --scope should be 'imap' or 'submission'", 2)
+	}
+
+	id, password, err := a.CreateAppPassword(username, label, scope)
+	if err != nil {
+		return appPassErr(err, username)
+	}
+	fmt.Println("ID:", id)
+	fmt.Println("Password:", password)
+	fmt.Println()
+	fmt.Println("The password is not stored and will not be shown again.")
+	return nil
+}
+
+func appPassList(a *sql_accounts.Auth, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	appPasses, err := a.ListAppPasswords(username)
+	if err != nil {
+		return appPassErr(err, username)
+	}
+	if len(appPasses) == 0 {
+		fmt.Println("No app passwords.")
+		return nil
+	}
+	for _, appPass := range appPasses {
+		scope := appPass.Scope
+		if scope == sql_accounts.ScopeAny {
+			scope = "any"
+		}
+		status := "active"
+		if appPass.Revoked {
+			status = "revoked"
+		}
+		lastUsed := "never"
+		if appPass.LastUsedAt != nil {
+			lastUsed = appPass.LastUsedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t%s\n", appPass.ID, appPass.Label, scope, status, lastUsed)
+	}
+	return nil
+}
+
+func appPassRevoke(a *sql_accounts.Auth, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	id, err := strconv.ParseUint(ctx.Args().Get(1), 10, 0)
+	if err != nil {
+		return cli.Exit("Error: ID should be a number shown by 'app-passwords list'", 2)
+	}
+
+	return appPassErr(a.RevokeAppPassword(username, uint(id)), username)
+}
@@ -0,0 +1,193 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "audit",
+			Usage: "Audit log inspection",
+			Description: `These subcommands show events stored by the audit module defined in a
+top-level configuration block of maddy.conf, e.g. 'audit { ... }'. By default,
+the audit block is used, this can be changed using --cfg-block flag.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List recorded events, most recent first",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   audit.ModName,
+						},
+						&cli.StringFlag{
+							Name:  "account",
+							Usage: "Show only events of the account",
+						},
+						&cli.StringFlag{
+							Name:  "type",
+							Usage: "Show only events of the type (auth, account_create, account_delete, account_password, account_enable, account_disable, admin_command)",
+						},
+						&cli.TimestampFlag{
+							Name:   "since",
+							Usage:  "Show only events recorded at or after the time (RFC 3339)",
+							Layout: time.RFC3339,
+						},
+						&cli.TimestampFlag{
+							Name:   "until",
+							Usage:  "Show only events recorded before the time (RFC 3339)",
+							Layout: time.RFC3339,
+						},
+						&cli.IntFlag{
+							Name:  "limit",
+							Usage: "Show at most N events, 0 to show all",
+							Value: 50,
+						},
+					},
+					Action: auditList,
+				},
+			},
+		})
+
+	maddycli.AddActionHook(recordAdminCommand)
+}
+
+// redactedArgsCommands are recorded without arguments, they identify
+// accounts that should not be left in the audit log.
+var redactedArgsCommands = map[string]bool{
+	"purge-account": true,
+}
+
+// recordAdminCommand stores the executed management command in the audit
+// log. Only positional arguments are recorded since flags can contain
+// passwords.
+func recordAdminCommand(ctx *cli.Context, err error) {
+	if !module.NoRun || !audit.Enabled() {
+		return
+	}
+
+	redacted := redactedArgsCommands[ctx.Command.FullName()]
+	args := ctx.Args().Slice()
+	if redacted {
+		args = nil
+	}
+	detail := strings.Join(append([]string{ctx.Command.FullName()}, args...), " ")
+	if err != nil {
+		if redacted {
+			detail += ": failed"
+		} else {
+			detail += ": " + err.Error()
+		}
+	}
+	audit.Record(mdb.AuditEvent{
+		Type:     audit.TypeAdminCommand,
+		Account:  osUsername(),
+		Protocol: audit.ProtocolAdmin,
+		Success:  err == nil,
+		Detail:   detail,
+	})
+}
+
+func osUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+func openAuditLog(ctx *cli.Context) (*audit.Log, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l, ok := mod.Instance.(*audit.Log)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not an audit log", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return l, nil
+}
+
+func auditList(ctx *cli.Context) error {
+	l, err := openAuditLog(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeIfNeeded(l)
+
+	f := audit.Filter{
+		Account: ctx.String("account"),
+		Type:    ctx.String("type"),
+		Limit:   ctx.Int("limit"),
+	}
+	if t := ctx.Timestamp("since"); t != nil {
+		f.Since = *t
+	}
+	if t := ctx.Timestamp("until"); t != nil {
+		f.Until = *t
+	}
+
+	events, err := l.Query(context.Background(), f)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		fmt.Println("No events.")
+		return nil
+	}
+	for _, ev := range events {
+		result := "ok"
+		if !ev.Success {
+			result = "failed"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\t%s\n", ev.CreatedAt.Format(time.RFC3339), ev.Type, result,
+			orDash(ev.Account), orDash(ev.Protocol), orDash(ev.RemoteIP), ev.Detail)
+	}
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
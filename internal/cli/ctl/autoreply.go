@@ -0,0 +1,228 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/themadorg/madmail/framework/config"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/target/autoreply"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "autoreply",
+	}
+
+	replyCmd := func(name, usage, argsUsage string, flags []cli.Flag, action func(t *autoreply.Target, ctx *cli.Context) error) *cli.Command {
+		return &cli.Command{
+			Name:      name,
+			Usage:     usage,
+			ArgsUsage: argsUsage,
+			Flags:     append([]cli.Flag{cfgBlockFlag}, flags...),
+			Action: func(ctx *cli.Context) error {
+				t, err := openAutoreply(ctx)
+				if err != nil {
+					return err
+				}
+				defer closeIfNeeded(t)
+				return action(t, ctx)
+			},
+		}
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "autoreply",
+			Usage: "Vacation auto-replies management",
+			Description: `These subcommands manage auto-replies stored in the database by
+target.autoreply defined in a top-level configuration block of maddy.conf,
+e.g. 'target.autoreply autoreply { ... }'. By default, the autoreply block is
+used, this can be changed using --cfg-block flag.
+
+Changes take effect for the next delivered message.
+`,
+			Subcommands: []*cli.Command{
+				replyCmd("list", "List auto-replies", "", nil, autoreplyList),
+				replyCmd("get", "Print the auto-reply of the account", "ACCOUNT", nil, autoreplyGet),
+				replyCmd("set", "Create or replace the auto-reply, reading its text from FILE or stdin", "ACCOUNT [FILE]", []cli.Flag{
+					&cli.StringFlag{
+						Name:  "subject",
+						Usage: "Subject of the reply, 'Auto: ' and the original subject if not set",
+					},
+					&cli.TimestampFlag{
+						Name:   "start",
+						Usage:  "Do not reply before the time (RFC 3339)",
+						Layout: time.RFC3339,
+					},
+					&cli.TimestampFlag{
+						Name:   "end",
+						Usage:  "Do not reply after the time (RFC 3339)",
+						Layout: time.RFC3339,
+					},
+					&cli.BoolFlag{
+						Name:  "disabled",
+						Usage: "Store the auto-reply without enabling it",
+					},
+				}, autoreplySet),
+				replyCmd("enable", "Enable the auto-reply", "ACCOUNT", nil, autoreplyEnable),
+				replyCmd("disable", "Disable the auto-reply", "ACCOUNT", nil, autoreplyDisable),
+				replyCmd("delete", "Remove the auto-reply and the list of correspondents that got it", "ACCOUNT", nil, autoreplyDelete),
+			},
+		})
+}
+
+func openAutoreply(ctx *cli.Context) (*autoreply.Target, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := mod.Instance.(*autoreply.Target)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not target.autoreply", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return t, nil
+}
+
+func autoreplyAccount(ctx *cli.Context) (string, error) {
+	account := ctx.Args().First()
+	if account == "" {
+		return "", cli.Exit("Error: ACCOUNT is required", 2)
+	}
+	return account, nil
+}
+
+func autoreplyErr(err error, account string) error {
+	if errors.Is(err, autoreply.ErrNoSuchAutoreply) {
+		return cli.Exit(fmt.Sprintf("Error: %s has no auto-reply", account), 2)
+	}
+	return err
+}
+
+func formatReplyTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func autoreplyList(t *autoreply.Target, ctx *cli.Context) error {
+	replies, err := t.List(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(replies) == 0 {
+		fmt.Println("No auto-replies.")
+		return nil
+	}
+	for _, r := range replies {
+		status := "disabled"
+		if r.Enabled {
+			status = "enabled"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", r.Account, status, formatReplyTime(r.StartAt), formatReplyTime(r.EndAt))
+	}
+	return nil
+}
+
+func autoreplyGet(t *autoreply.Target, ctx *cli.Context) error {
+	account, err := autoreplyAccount(ctx)
+	if err != nil {
+		return err
+	}
+
+	r, err := t.Get(context.Background(), account)
+	if err != nil {
+		return autoreplyErr(err, account)
+	}
+	fmt.Println("Enabled:", r.Enabled)
+	fmt.Println("Start:", formatReplyTime(r.StartAt))
+	fmt.Println("End:", formatReplyTime(r.EndAt))
+	fmt.Println("Subject:", r.Subject)
+	fmt.Println()
+	fmt.Println(r.Body)
+	return nil
+}
+
+func autoreplySet(t *autoreply.Target, ctx *cli.Context) error {
+	account, err := autoreplyAccount(ctx)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	if path := ctx.Args().Get(1); path != "" {
+		body, err = os.ReadFile(path)
+	} else {
+		body, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	return t.Set(context.Background(), mdb.Autoreply{
+		Account: account,
+		Enabled: !ctx.Bool("disabled"),
+		Subject: ctx.String("subject"),
+		Body:    string(body),
+		StartAt: ctx.Timestamp("start"),
+		EndAt:   ctx.Timestamp("end"),
+	})
+}
+
+func autoreplyEnable(t *autoreply.Target, ctx *cli.Context) error {
+	account, err := autoreplyAccount(ctx)
+	if err != nil {
+		return err
+	}
+	return autoreplyErr(t.SetEnabled(context.Background(), account, true), account)
+}
+
+func autoreplyDisable(t *autoreply.Target, ctx *cli.Context) error {
+	account, err := autoreplyAccount(ctx)
+	if err != nil {
+		return err
+	}
+	return autoreplyErr(t.SetEnabled(context.Background(), account, false), account)
+}
+
+func autoreplyDelete(t *autoreply.Target, ctx *cli.Context) error {
+	account, err := autoreplyAccount(ctx)
+	if err != nil {
+		return err
+	}
+	return autoreplyErr(t.Delete(context.Background(), account), account)
+}
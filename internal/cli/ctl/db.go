@@ -0,0 +1,379 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	maddy "github.com/themadorg/madmail"
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/hooks"
+	"github.com/themadorg/madmail/framework/log"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	clitools2 "github.com/themadorg/madmail/internal/cli/clitools"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "db",
+			Usage: "SQL database management",
+			Description: `These subcommands operate on the database used by a module defined
+in a top-level configuration block of maddy.conf. By default, the
+local_mailboxes block is used, this can be changed using --cfg-block flag.
+
+status, migrate and rollback operate on all blocks with schema migrations
+unless --cfg-block is specified. They read the database configuration from
+the block without initializing the module, so the server can be stopped.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "status",
+					Usage: "List applied and pending schema migrations",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+						},
+					},
+					Action: dbStatus,
+				},
+				{
+					Name:  "migrate",
+					Usage: "Apply pending schema migrations",
+					Description: `Apply migrations that are not applied yet. The server applies them on
+start too, this command allows doing that in advance. It is required for
+blocks configured with auto_migrate off.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+						},
+						&cli.StringFlag{
+							Name:  "to",
+							Usage: "Stop after the migration with the specified ID is applied, requires --cfg-block",
+						},
+					},
+					Action: dbMigrate,
+				},
+				{
+					Name:  "rollback",
+					Usage: "Revert applied schema migrations",
+					Description: `Revert the last applied migrations of the module. Reverting a migration
+usually removes data stored in tables it created.
+
+The server applies the reverted migrations again on start, this command is
+intended to be used before downgrading to a version without them.
+Nothing is reverted if any of the migrations cannot be reverted.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:     "cfg-block",
+							Usage:    "Module configuration block to use",
+							EnvVars:  []string{"MADDY_CFGBLOCK"},
+							Required: true,
+						},
+						&cli.IntFlag{
+							Name:  "steps",
+							Usage: "Number of migrations to revert",
+							Value: 1,
+						},
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					},
+					Action: dbRollback,
+				},
+				{
+					Name:  "backup",
+					Usage: "Write a consistent copy of the SQLite database",
+					Description: `Copy the SQLite database to PATH using the online backup API.
+The server does not need to be stopped.
+
+Only the sqlite3 driver is supported, use native tooling such as pg_dump or
+mysqldump for other databases.
+`,
+					ArgsUsage: "PATH",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.BoolFlag{
+							Name:  "force",
+							Usage: "Overwrite PATH if it exists",
+						},
+						&cli.BoolFlag{
+							Name:    "quiet",
+							Aliases: []string{"q"},
+							Usage:   "Do not report progress",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						p, err := openDBProvider(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(p)
+						return dbBackup(p, ctx)
+					},
+				},
+			},
+		})
+}
+
+func dbBackup(p mdb.Provider, ctx *cli.Context) error {
+	path := ctx.Args().First()
+	if path == "" {
+		return cli.Exit("Error: PATH is required", 2)
+	}
+
+	// Interrupted backup does not leave a partial file behind.
+	bgCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	opts := mdb.BackupOptions{Force: ctx.Bool("force")}
+	if !ctx.Bool("quiet") {
+		lastPercent := -1
+		opts.Progress = func(copied, total int) {
+			percent := 100
+			if total != 0 {
+				percent = copied * 100 / total
+			}
+			if percent != lastPercent {
+				fmt.Fprintf(os.Stderr, "\rCopied %d%% (%d/%d pages)", percent, copied, total)
+				lastPercent = percent
+			}
+		}
+	}
+	err := mdb.Backup(bgCtx, p.GORM(), path, opts)
+	if opts.Progress != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		if errors.Is(err, mdb.ErrBackupNotSupported) || errors.Is(err, os.ErrExist) {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+		}
+		return err
+	}
+
+	fmt.Printf("Database backup written to %s.\n", path)
+	return nil
+}
+
+// migrationBlock is a configuration block of a module with schema
+// migrations.
+type migrationBlock struct {
+	name       string
+	db         *gorm.DB
+	migrations []mdb.Migration
+}
+
+// openMigrationBlocks opens databases of the blocks with registered schema
+// migrations, or only of the block specified using --cfg-block.
+//
+// Modules are not initialized since that applies migrations. Driver, DSN and
+// connection directives are read using the same functions modules use, so
+// env: and file: references are resolved the same way.
+func openMigrationBlocks(ctx *cli.Context) ([]migrationBlock, error) {
+	globals, mods, err := registerModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cfgBlock := ctx.String("cfg-block")
+	var blocks []migrationBlock
+	for _, m := range mods {
+		name := m.Instance.InstanceName()
+		if cfgBlock != "" && name != cfgBlock {
+			continue
+		}
+		migrations, ok := mdb.RegisteredMigrations(m.Instance.Name())
+		if !ok {
+			if cfgBlock != "" {
+				return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s does not use schema migrations", cfgBlock), 2)
+			}
+			continue
+		}
+		gdb, err := openBlockDB(globals, m)
+		if err != nil {
+			closeMigrationBlocks(blocks)
+			return nil, fmt.Errorf("Error: %s: %w", name, err)
+		}
+		if gdb == nil {
+			if cfgBlock != "" {
+				return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s does not use an SQL database", cfgBlock), 2)
+			}
+			continue
+		}
+		blocks = append(blocks, migrationBlock{name: name, db: gdb, migrations: migrations})
+	}
+	if cfgBlock != "" && len(blocks) == 0 {
+		return nil, cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", cfgBlock), 2)
+	}
+	return blocks, nil
+}
+
+// openBlockDB opens the database configured using the driver and dsn
+// directives of the block. nil is returned if driver is not set.
+func openBlockDB(globals map[string]interface{}, m maddy.ModInfo) (*gorm.DB, error) {
+	var (
+		driver string
+		dsn    mdb.DSN
+		opts   mdb.Options
+	)
+	cfg := config.NewMap(globals, m.Cfg)
+	cfg.AllowUnknown()
+	mdb.DriverDirective(cfg, "driver", false, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", false, nil, &dsn)
+	mdb.Directives(cfg, &opts)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+	if driver == "" {
+		return nil, nil
+	}
+
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return nil, err
+	}
+	opts.Log = log.Logger{Name: m.Instance.Name()}
+	return mdb.New(driver, dsnParts, opts)
+}
+
+func closeMigrationBlocks(blocks []migrationBlock) {
+	for _, b := range blocks {
+		ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+		mdb.Close(ctx, b.db)
+		cancel()
+	}
+}
+
+func dbStatus(ctx *cli.Context) error {
+	blocks, err := openMigrationBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+	defer closeMigrationBlocks(blocks)
+
+	for _, b := range blocks {
+		applied, pending, err := mdb.MigrationStatus(b.db, b.migrations)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %s: %v", b.name, err), 1)
+		}
+		appliedAt := make(map[string]time.Time, len(applied))
+		for _, a := range applied {
+			appliedAt[a.ID] = a.AppliedAt
+		}
+		isPending := make(map[string]bool, len(pending))
+		for _, m := range pending {
+			isPending[m.ID] = true
+		}
+
+		for _, m := range b.migrations {
+			if isPending[m.ID] {
+				fmt.Printf("%s\t%s\tpending\n", b.name, m.ID)
+				continue
+			}
+			fmt.Printf("%s\t%s\tapplied %s\n", b.name, m.ID, appliedAt[m.ID].Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func dbMigrate(ctx *cli.Context) error {
+	target := ctx.String("to")
+	if target != "" && ctx.String("cfg-block") == "" {
+		return cli.Exit("Error: --to requires --cfg-block", 2)
+	}
+
+	blocks, err := openMigrationBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+	defer closeMigrationBlocks(blocks)
+
+	total := 0
+	for _, b := range blocks {
+		applied, err := mdb.MigrateTo(b.db, b.migrations, target)
+		for _, id := range applied {
+			fmt.Printf("%s\t%s\tapplied\n", b.name, id)
+		}
+		total += len(applied)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %s: %v", b.name, err), 1)
+		}
+	}
+	if total == 0 {
+		fmt.Println("No pending migrations.")
+	}
+	return nil
+}
+
+func dbRollback(ctx *cli.Context) error {
+	steps := ctx.Int("steps")
+	if steps <= 0 {
+		return cli.Exit("Error: --steps should be positive", 2)
+	}
+
+	blocks, err := openMigrationBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+	defer closeMigrationBlocks(blocks)
+	b := blocks[0]
+
+	if !ctx.Bool("yes") {
+		msg := fmt.Sprintf("Revert the last %d migration(s) of %s? Data stored in the affected tables may be lost", steps, b.name)
+		if !clitools2.Confirmation(msg, false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	reverted, err := mdb.Rollback(b.db, b.migrations, steps)
+	for _, id := range reverted {
+		fmt.Printf("%s\t%s\treverted\n", b.name, id)
+	}
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %s: %v", b.name, err), 1)
+	}
+	if len(reverted) == 0 {
+		fmt.Println("No applied migrations.")
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/themadorg/madmail/framework/config"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	"github.com/themadorg/madmail/internal/modify/dkim"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "dkim",
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "dkim",
+			Usage: "DKIM signing keys management",
+			Description: `These subcommands manage DKIM keys stored in the database by
+modify.dkim defined in a top-level configuration block of maddy.conf, e.g.
+'modify.dkim dkim { ... }'. By default, the dkim block is used, this can be
+changed using --cfg-block flag.
+
+To replace the key of a domain, generate a new key using 'rotate', publish
+the printed DNS record and, once it propagates, switch signing to it using
+'activate'.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List stored keys",
+					Flags: []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						m, err := openDKIM(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(m)
+						return dkimList(m)
+					},
+				},
+				{
+					Name:      "rotate",
+					Usage:     "Generate a new inactive key for the domain",
+					ArgsUsage: "DOMAIN",
+					Flags: []cli.Flag{
+						cfgBlockFlag,
+						&cli.StringFlag{
+							Name:  "algo",
+							Usage: "Key algorithm: ed25519, rsa2048 or rsa4096",
+							Value: "rsa2048",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						m, err := openDKIM(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(m)
+						return dkimRotate(m, ctx)
+					},
+				},
+				{
+					Name:      "activate",
+					Usage:     "Use the key for signing messages",
+					ArgsUsage: "DOMAIN SELECTOR",
+					Description: `Switch signing for DOMAIN to the key with SELECTOR. The
+previously active key is retired and removed after key_grace_period.
+Running servers pick up the change within key_refresh_interval.
+`,
+					Flags: []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						m, err := openDKIM(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(m)
+						return dkimActivate(m, ctx)
+					},
+				},
+			},
+		})
+}
+
+func openDKIM(ctx *cli.Context) (*dkim.Modifier, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := mod.Instance.(*dkim.Modifier)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not modify.dkim", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+	if m.GORM() == nil {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s does not store keys in a database", ctx.String("cfg-block")), 2)
+	}
+
+	return m, nil
+}
+
+// txtStrings splits the record into quoted strings of at most 255
+// characters, as required for TXT records.
+func txtStrings(record string) string {
+	var parts []string
+	for len(record) > 255 {
+		parts = append(parts, `"`+record[:255]+`"`)
+		record = record[255:]
+	}
+	parts = append(parts, `"`+record+`"`)
+	return strings.Join(parts, " ")
+}
+
+func dkimList(m *dkim.Modifier) error {
+	keys, err := m.Keys(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		fmt.Println("No keys.")
+		return nil
+	}
+	for _, key := range keys {
+		status := "inactive"
+		switch {
+		case key.Active:
+			status = "active"
+		case key.RetiredAt != nil:
+			status = "retired, removed after " + key.RetiredAt.Add(m.GracePeriod()).Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", key.Domain, key.Selector, key.Algorithm,
+			key.CreatedAt.Format(time.RFC3339), status)
+	}
+	return nil
+}
+
+func dkimRotate(m *dkim.Modifier, ctx *cli.Context) error {
+	domain := ctx.Args().First()
+	if domain == "" {
+		return cli.Exit("Error: DOMAIN is required", 2)
+	}
+	algo := ctx.String("algo")
+	switch algo {
+	case "ed25519", "rsa2048", "rsa4096":
+	default:
+		return cli.Exit("Error: unknown key algorithm: "+algo, 2)
+	}
+
+	selector, record, err := m.RotateKey(context.Background(), domain, algo)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Generated a new %s key with selector %s. Publish the following DNS record:\n\n", algo, selector)
+	fmt.Printf("%s._domainkey.%s. TXT %s\n\n", selector, domain, txtStrings(record))
+	fmt.Printf("Then activate the key using:\n\n")
+	fmt.Printf("maddy dkim activate --cfg-block %s %s %s\n", ctx.String("cfg-block"), domain, selector)
+	return nil
+}
+
+func dkimActivate(m *dkim.Modifier, ctx *cli.Context) error {
+	domain := ctx.Args().First()
+	if domain == "" {
+		return cli.Exit("Error: DOMAIN is required", 2)
+	}
+	selector := ctx.Args().Get(1)
+	if selector == "" {
+		return cli.Exit("Error: SELECTOR is required", 2)
+	}
+
+	retired, err := m.ActivateKey(context.Background(), domain, selector)
+	if err != nil {
+		if errors.Is(err, dkim.ErrNoSuchKey) {
+			return cli.Exit(fmt.Sprintf("Error: no key with selector %s for %s", selector, domain), 2)
+		}
+		return err
+	}
+
+	fmt.Printf("Messages for %s are now signed using selector %s.\n", domain, selector)
+	for _, old := range retired {
+		fmt.Printf("Key %s is retired, remove the DNS record for %s._domainkey.%s after %s.\n",
+			old, old, domain, time.Now().Add(m.GracePeriod()).Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/themadorg/madmail/framework/config"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/table"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "domains",
+	}
+	settingsFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "catch-all",
+			Usage: "Deliver mail for unknown addresses of the domain to ADDRESS",
+		},
+		&cli.BoolFlag{
+			Name:  "no-catch-all",
+			Usage: "Remove the catch-all destination",
+		},
+		&cli.StringFlag{
+			Name:  "dkim-selector",
+			Usage: "Sign messages from the domain using the DKIM key with the selector instead of the active one",
+		},
+		&cli.StringFlag{
+			Name:  "default-quota",
+			Usage: "Storage quota for accounts created in the domain (e.g. 1G), 0 to use the storage default",
+		},
+	}
+
+	domainCmd := func(name, usage, argsUsage string, flags []cli.Flag, action func(s *table.SQLDomains, ctx *cli.Context) error) *cli.Command {
+		return &cli.Command{
+			Name:      name,
+			Usage:     usage,
+			ArgsUsage: argsUsage,
+			Flags:     append([]cli.Flag{cfgBlockFlag}, flags...),
+			Action: func(ctx *cli.Context) error {
+				s, err := openDomains(ctx)
+				if err != nil {
+					return err
+				}
+				defer closeIfNeeded(s)
+				return action(s, ctx)
+			},
+		}
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "domains",
+			Usage: "Hosted domains management",
+			Description: `These subcommands manage domains stored in the database by
+table.sql_domains defined in a top-level configuration block of maddy.conf,
+e.g. 'table.sql_domains domains { ... }'. By default, the domains block is
+used, this can be changed using --cfg-block flag.
+
+Running instances apply changes after cache_ttl.
+`,
+			Subcommands: []*cli.Command{
+				domainCmd("list", "List domains", "", nil, domainsList),
+				domainCmd("create", "Add the domain", "DOMAIN", append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "disabled",
+						Usage: "Add the domain without accepting mail for it",
+					},
+				}, settingsFlags...), domainsCreate),
+				domainCmd("update", "Change settings of the domain", "DOMAIN", settingsFlags, domainsUpdate),
+				domainCmd("enable", "Accept mail for the domain", "DOMAIN", nil, domainsEnable),
+				domainCmd("disable", "Reject mail for the domain, keeping its settings", "DOMAIN", nil, domainsDisable),
+			},
+		})
+}
+
+func openDomains(ctx *cli.Context) (*table.SQLDomains, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := mod.Instance.(*table.SQLDomains)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not table.sql_domains", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return s, nil
+}
+
+func domainsErr(err error, name string) error {
+	switch {
+	case errors.Is(err, table.ErrNoSuchDomain):
+		return cli.Exit(fmt.Sprintf("Error: no such domain: %s", name), 2)
+	case errors.Is(err, table.ErrDomainExists):
+		return cli.Exit(fmt.Sprintf("Error: domain already exists: %s", name), 2)
+	}
+	return err
+}
+
+func domainsName(ctx *cli.Context) (string, error) {
+	name := ctx.Args().First()
+	if name == "" {
+		return "", cli.Exit("Error: DOMAIN is required", 2)
+	}
+	return name, nil
+}
+
+// applyDomainFlags sets the domain settings specified using flags.
+func applyDomainFlags(d *mdb.Domain, ctx *cli.Context) error {
+	if ctx.IsSet("catch-all") {
+		catchAll := ctx.String("catch-all")
+		d.CatchAll = &catchAll
+	}
+	if ctx.Bool("no-catch-all") {
+		d.CatchAll = nil
+	}
+	if ctx.IsSet("dkim-selector") {
+		d.DKIMSelector = ctx.String("dkim-selector")
+	}
+	if ctx.IsSet("default-quota") {
+		quota, err := config.ParseDataSize(ctx.String("default-quota"))
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: invalid --default-quota value: %v", err), 2)
+		}
+		d.DefaultQuota = int64(quota)
+	}
+	return nil
+}
+
+func domainsList(s *table.SQLDomains, ctx *cli.Context) error {
+	domains, err := s.ListDomains()
+	if err != nil {
+		return err
+	}
+	if len(domains) == 0 {
+		fmt.Println("No domains.")
+		return nil
+	}
+	for _, d := range domains {
+		status := "disabled"
+		if d.Enabled {
+			status = "enabled"
+		}
+		catchAll := "-"
+		if d.CatchAll != nil {
+			catchAll = *d.CatchAll
+		}
+		selector := d.DKIMSelector
+		if selector == "" {
+			selector = "-"
+		}
+		fmt.Printf("%s\t%s\tcatch-all=%s\tdkim-selector=%s\tdefault-quota=%d\n", d.Name, status, catchAll, selector, d.DefaultQuota)
+	}
+	return nil
+}
+
+func domainsCreate(s *table.SQLDomains, ctx *cli.Context) error {
+	name, err := domainsName(ctx)
+	if err != nil {
+		return err
+	}
+	d := mdb.Domain{Name: name, Enabled: !ctx.Bool("disabled")}
+	if err := applyDomainFlags(&d, ctx); err != nil {
+		return err
+	}
+	return domainsErr(s.CreateDomain(d), name)
+}
+
+// updateDomain applies fn to the current settings of the domain.
+func updateDomain(s *table.SQLDomains, ctx *cli.Context, fn func(d *mdb.Domain) error) error {
+	name, err := domainsName(ctx)
+	if err != nil {
+		return err
+	}
+	d, ok, err := s.Domain(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return domainsErr(table.ErrNoSuchDomain, name)
+	}
+	if err := fn(&d); err != nil {
+		return err
+	}
+	return domainsErr(s.UpdateDomain(d), name)
+}
+
+func domainsUpdate(s *table.SQLDomains, ctx *cli.Context) error {
+	return updateDomain(s, ctx, func(d *mdb.Domain) error {
+		return applyDomainFlags(d, ctx)
+	})
+}
+
+func domainsEnable(s *table.SQLDomains, ctx *cli.Context) error {
+	return updateDomain(s, ctx, func(d *mdb.Domain) error {
+		d.Enabled = true
+		return nil
+	})
+}
+
+func domainsDisable(s *table.SQLDomains, ctx *cli.Context) error {
+	name, err := domainsName(ctx)
+	if err != nil {
+		return err
+	}
+	return domainsErr(s.DisableDomain(name), name)
+}
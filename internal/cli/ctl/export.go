@@ -0,0 +1,216 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	maddy "github.com/themadorg/madmail"
+	"github.com/themadorg/madmail/framework/hooks"
+	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
+	"github.com/themadorg/madmail/internal/auth"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/storage/imapsql"
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "export",
+			Usage: "Write a portable backup of accounts",
+			Description: `Write messages of the account stored in the block specified by --cfg-block
+(local_mailboxes by default) to the directory specified by --out, together
+with manifest.json describing mailboxes, the quota, aliases pointing to the
+account, Sieve scripts and the autoreply. Credentials are not exported.
+
+Mailboxes are written as mbox files or as directories with a .eml file per
+message, see --format. Messages are read from a single database snapshot
+where the driver allows it. The manifest contains a SHA-256 checksum of each
+mailbox, use "import backup --verify" to check the backup later.
+
+With --all, backups of all accounts are written to subdirectories of --out
+named after the accounts.
+
+Use "import backup" to restore the backup.
+`,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "cfg-block",
+					Usage:   "Module configuration block to use",
+					EnvVars: []string{"MADDY_CFGBLOCK"},
+					Value:   "local_mailboxes",
+				},
+				&cli.StringFlag{
+					Name:  "account",
+					Usage: "Account to export",
+				},
+				&cli.BoolFlag{
+					Name:  "all",
+					Usage: "Export all accounts",
+				},
+				&cli.PathFlag{
+					Name:     "out",
+					Usage:    "Write the backup to `DIR`",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "format",
+					Usage: "Mailbox format: mbox or eml",
+					Value: imapsql.BackupFormatMbox,
+				},
+			},
+			Action: exportAccounts,
+		})
+}
+
+// openBackupStorage initializes the storage block specified by --cfg-block
+// and returns it together with databases of other modules that may store
+// account settings, see mdb.ExportAccountSettings.
+func openBackupStorage(ctx *cli.Context) (*imapsql.Storage, []*gorm.DB, error) {
+	globals, mods, err := registerModules(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfgBlock := ctx.String("cfg-block")
+	if !module.HasInstance(cfgBlock) {
+		return nil, nil, cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", cfgBlock), 2)
+	}
+	if err := initAuditLog(globals, mods, cfgBlock); err != nil {
+		return nil, nil, err
+	}
+	inst, err := module.GetInstance(cfgBlock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+	store, ok := inst.(*imapsql.Storage)
+	if !ok {
+		return nil, nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not storage.imapsql", cfgBlock), 2)
+	}
+
+	dbs, err := settingsDatabases(mods, cfgBlock, store)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, dbs, nil
+}
+
+// settingsDatabases returns the database of the storage and distinct
+// databases of other modules, skipping the audit log.
+func settingsDatabases(mods []maddy.ModInfo, cfgBlock string, store *imapsql.Storage) ([]*gorm.DB, error) {
+	dbs := []*gorm.DB{store.GORM()}
+	for _, m := range mods {
+		name := m.Instance.InstanceName()
+		if name == cfgBlock || m.Instance.Name() == audit.ModName {
+			continue
+		}
+		if _, ok := m.Instance.(mdb.Provider); !ok {
+			continue
+		}
+		inst, err := module.GetInstance(name)
+		if err != nil {
+			return nil, fmt.Errorf("Error: %s initialization failed: %w", name, err)
+		}
+		gdb := inst.(mdb.Provider).GORM()
+		if gdb == nil || containsDB(dbs, gdb) {
+			continue
+		}
+		dbs = append(dbs, gdb)
+	}
+	return dbs, nil
+}
+
+func exportAccounts(ctx *cli.Context) error {
+	username := auth.NormalizeUsername(ctx.String("account"))
+	all := ctx.Bool("all")
+	if (username == "") == !all {
+		return cli.Exit("Error: exactly one of --account and --all is required", 2)
+	}
+	format := ctx.String("format")
+	if format != imapsql.BackupFormatMbox && format != imapsql.BackupFormatEML {
+		return cli.Exit(fmt.Sprintf("Error: unknown format: %s", format), 2)
+	}
+	// Resolved before openBackupStorage changes the working directory to
+	// the state directory.
+	out, err := filepath.Abs(ctx.Path("out"))
+	if err != nil {
+		return err
+	}
+
+	store, dbs, err := openBackupStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+
+	type target struct {
+		username, dir string
+	}
+	targets := []target{{username, out}}
+	if all {
+		accts, err := store.ListIMAPAccts()
+		if err != nil {
+			return err
+		}
+		targets = targets[:0]
+		for _, acct := range accts {
+			targets = append(targets, target{acct, filepath.Join(out, acct)})
+		}
+	}
+
+	bgCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	for _, t := range targets {
+		var settings mdb.AccountSettings
+		for _, gdb := range dbs {
+			s, err := mdb.ExportAccountSettings(bgCtx, gdb, t.username)
+			if err != nil {
+				return cli.Exit(fmt.Sprintf("Error: %s: %v", t.username, err), 1)
+			}
+			settings.Merge(s)
+		}
+
+		manifest, err := store.ExportAccount(bgCtx, t.username, t.dir, imapsql.ExportOptions{
+			Format:   format,
+			Settings: settings,
+		})
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return cli.Exit("Interrupted, the backup is incomplete", 1)
+			}
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 1)
+		}
+		for _, mbox := range manifest.Mailboxes {
+			fmt.Printf("%s\t%s\t%d messages\t%s\tsha256:%s\n",
+				t.username, mbox.Name, mbox.Messages, formatBytes(mbox.Size), mbox.SHA256)
+		}
+		fmt.Printf("%s\tbackup written to %s\n", t.username, t.dir)
+	}
+	return nil
+}
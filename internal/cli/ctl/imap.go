@@ -293,6 +293,62 @@ func init() {
 					return msgsRemove(be, ctx)
 				},
 			},
+			{
+				Name:  "restore",
+				Usage: "Restore expunged messages of the account",
+				Description: `Move messages expunged less than expunge_retention ago back to their
+mailboxes. Restored messages get new UIDs. Messages of removed mailboxes can
+not be restored.
+`,
+				ArgsUsage: "USERNAME",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "cfg-block",
+						Usage:   "Module configuration block to use",
+						EnvVars: []string{"MADDY_CFGBLOCK"},
+						Value:   "local_mailboxes",
+					},
+					&cli.TimestampFlag{
+						Name:   "since",
+						Usage:  "Restore only messages expunged at or after the time (RFC 3339)",
+						Layout: time.RFC3339,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					be, err := openStorage(ctx)
+					if err != nil {
+						return err
+					}
+					defer closeIfNeeded(be)
+					return msgsRestore(be, ctx)
+				},
+			},
+			{
+				Name:      "purge",
+				Usage:     "Permanently remove expunged messages of the mailbox",
+				ArgsUsage: "USERNAME MAILBOX",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "cfg-block",
+						Usage:   "Module configuration block to use",
+						EnvVars: []string{"MADDY_CFGBLOCK"},
+						Value:   "local_mailboxes",
+					},
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "Don't ask for confirmation",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					be, err := openStorage(ctx)
+					if err != nil {
+						return err
+					}
+					defer closeIfNeeded(be)
+					return msgsPurge(be, ctx)
+				},
+			},
 			{
 				Name:        "copy",
 				Usage:       "Copy messages between mailboxes",
@@ -630,6 +686,65 @@ func msgsRemove(be module.Storage, ctx *cli.Context) error {
 	return mboxB.DelMessages(ctx.Bool("uid"), seq)
 }
 
+type softDeleteStorage interface {
+	RestoreExpunged(username string, since time.Time) (int, error)
+	PurgeMailbox(username, mailbox string) (int, error)
+}
+
+func msgsRestore(be module.Storage, ctx *cli.Context) error {
+	username := auth.NormalizeUsername(ctx.Args().First())
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	sds, ok := be.(softDeleteStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support restoring messages", 2)
+	}
+
+	var since time.Time
+	if t := ctx.Timestamp("since"); t != nil {
+		since = *t
+	}
+	restored, err := sds.RestoreExpunged(username, since)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %d messages.\n", restored)
+	return nil
+}
+
+func msgsPurge(be module.Storage, ctx *cli.Context) error {
+	username := auth.NormalizeUsername(ctx.Args().First())
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return cli.Exit("Error: MAILBOX is required", 2)
+	}
+
+	sds, ok := be.(softDeleteStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support purging messages", 2)
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools2.Confirmation("Expunged messages will be removed permanently, continue?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	purged, err := sds.PurgeMailbox(username, name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %d messages.\n", purged)
+	return nil
+}
+
 func msgsCopy(be module.Storage, ctx *cli.Context) error {
 	username := auth.NormalizeUsername(ctx.Args().First())
 	if username == "" {
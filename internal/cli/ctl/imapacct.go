@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -262,6 +263,51 @@ or other buffering takes effect.`,
 								return imapAcctQuotaSetDefault(be, ctx)
 							},
 						},
+						{
+							Name:      "set-messages",
+							Usage:     "Set a new limit on the number of messages",
+							ArgsUsage: "USERNAME LIMIT",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return imapAcctQuotaSetMessages(be, ctx)
+							},
+						},
+						{
+							Name:      "recalc",
+							Usage:     "Rebuild usage counters from stored messages",
+							ArgsUsage: "[USERNAME]",
+							Description: `Usage counters are updated as messages are added and removed.
+Recalculate them if the messages were changed directly in the database.
+Counters of all accounts are rebuilt if USERNAME is not specified.`,
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return imapAcctQuotaRecalc(be, ctx)
+							},
+						},
 					},
 				},
 				{
@@ -366,6 +412,30 @@ or other buffering takes effect.`,
 						return imapAcctPruneUnread(be, ctx)
 					},
 				},
+				{
+					Name:      "reindex",
+					Usage:     "Rebuild the full-text search index",
+					ArgsUsage: "[USERNAME]",
+					Description: `Index messages for IMAP SEARCH, e.g. the ones stored before
+full_text_search was enabled. Messages of all accounts are indexed if USERNAME
+is not specified.`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctReindex(be, ctx)
+					},
+				},
 				{
 					Name:  "stat",
 					Usage: "Show storage statistics",
@@ -625,6 +695,89 @@ func imapAcctQuotaGet(be module.Storage, ctx *cli.Context) error {
 		fmt.Println("Quota limit:  None")
 	}
 
+	if mqs, ok := be.(messageQuotaStorage); ok {
+		usedMsgs, maxMsgs, err := mqs.GetMessageQuota(rawUsername)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Messages:     %d\n", usedMsgs)
+		if maxMsgs > 0 {
+			fmt.Printf("Message limit: %d\n", maxMsgs)
+		} else {
+			fmt.Println("Message limit: None")
+		}
+	}
+
+	return nil
+}
+
+// messageQuotaStorage is implemented by storage backends that support
+// message count limits and rebuilding usage counters.
+type messageQuotaStorage interface {
+	GetMessageQuota(username string) (used, max int64, err error)
+	SetMessageQuota(username string, max int64) error
+	RecalculateQuota(username string) error
+}
+
+func imapAcctQuotaSetMessages(be module.Storage, ctx *cli.Context) error {
+	mqs, ok := be.(messageQuotaStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support message count limits", 2)
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	limitStr := ctx.Args().Get(1)
+	if limitStr == "" {
+		return cli.Exit("Error: LIMIT is required", 2)
+	}
+	limit, err := strconv.ParseInt(limitStr, 10, 64)
+	if err != nil || limit < 0 {
+		return cli.Exit("Error: LIMIT should be a non-negative number", 2)
+	}
+
+	return mqs.SetMessageQuota(username, limit)
+}
+
+func imapAcctQuotaRecalc(be module.Storage, ctx *cli.Context) error {
+	mqs, ok := be.(messageQuotaStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support usage recalculation", 2)
+	}
+
+	rawUsername := ctx.Args().First()
+	err := mqs.RecalculateQuota(rawUsername)
+	if err != nil && rawUsername != "" && !strings.Contains(rawUsername, "[") {
+		// try normalized
+		err = mqs.RecalculateQuota(auth.NormalizeUsername(rawUsername))
+	}
+	return err
+}
+
+// searchIndexStorage is implemented by storage backends that maintain a
+// full-text search index.
+type searchIndexStorage interface {
+	ReindexSearch(username string) (int, error)
+}
+
+func imapAcctReindex(be module.Storage, ctx *cli.Context) error {
+	sis, ok := be.(searchIndexStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support full-text search", 2)
+	}
+
+	rawUsername := ctx.Args().First()
+	indexed, err := sis.ReindexSearch(rawUsername)
+	if err != nil && rawUsername != "" && !strings.Contains(rawUsername, "[") {
+		// try normalized
+		indexed, err = sis.ReindexSearch(auth.NormalizeUsername(rawUsername))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Indexed %d messages.\n", indexed)
 	return nil
 }
 
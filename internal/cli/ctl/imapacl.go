@@ -0,0 +1,151 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"os"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/auth"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	aclCmd := func(name, usage, argsUsage string, action func(aclStorage, *cli.Context) error) *cli.Command {
+		return &cli.Command{
+			Name:      name,
+			Usage:     usage,
+			ArgsUsage: argsUsage,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "cfg-block",
+					Usage:   "Module configuration block to use",
+					EnvVars: []string{"MADDY_CFGBLOCK"},
+					Value:   "local_mailboxes",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				be, err := openStorage(ctx)
+				if err != nil {
+					return err
+				}
+				defer closeIfNeeded(be)
+				as, ok := be.(aclStorage)
+				if !ok {
+					return cli.Exit("Error: storage backend does not support mailbox ACLs", 2)
+				}
+				return action(as, ctx)
+			},
+		}
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "imap-acl",
+			Usage: "IMAP mailbox access control lists management",
+			Description: `Mailboxes shared with other users are listed for them in the shared
+namespace (see shared_namespace directive of imapsql).
+
+Rights are specified using RFC 4314 letters:
+  l - see the mailbox in LIST   r - open the mailbox and read messages
+  s - change \Seen flag         w - change flags other than \Seen and \Deleted
+  i - add messages              p - (not used)
+  k - (not used)                x - (not used)
+  t - change \Deleted flag      e - expunge messages
+
+Grantee is a username or "anyone".`,
+			Subcommands: []*cli.Command{
+				aclCmd("list", "Show ACL of the mailbox", "USERNAME MAILBOX", aclList),
+				aclCmd("grant", "Give rights for the mailbox", "USERNAME MAILBOX GRANTEE RIGHTS", aclGrant),
+				aclCmd("revoke", "Take rights for the mailbox, all rights are taken if RIGHTS is not specified",
+					"USERNAME MAILBOX GRANTEE [RIGHTS]", aclRevoke),
+			},
+		})
+}
+
+type aclStorage interface {
+	module.Storage
+	GrantACL(username, mailbox, grantee, rights string) error
+	RevokeACL(username, mailbox, grantee, rights string) error
+	ListACL(username, mailbox string) ([]imapsql.ACLEntry, error)
+}
+
+func aclArgs(ctx *cli.Context, withGrantee bool) (username, mailbox, grantee string, err error) {
+	username = auth.NormalizeUsername(ctx.Args().Get(0))
+	if username == "" {
+		return "", "", "", cli.Exit("Error: USERNAME is required", 2)
+	}
+	mailbox = ctx.Args().Get(1)
+	if mailbox == "" {
+		return "", "", "", cli.Exit("Error: MAILBOX is required", 2)
+	}
+	if !withGrantee {
+		return username, mailbox, "", nil
+	}
+	grantee = ctx.Args().Get(2)
+	if grantee == "" {
+		return "", "", "", cli.Exit("Error: GRANTEE is required", 2)
+	}
+	if grantee != imapsql.AnyoneGrantee {
+		grantee = auth.NormalizeUsername(grantee)
+	}
+	return username, mailbox, grantee, nil
+}
+
+func aclList(as aclStorage, ctx *cli.Context) error {
+	username, mailbox, _, err := aclArgs(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	entries, err := as.ListACL(username, mailbox)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "Mailbox is not shared.")
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s\t%s\n", entry.Grantee, entry.Rights)
+	}
+	return nil
+}
+
+func aclGrant(as aclStorage, ctx *cli.Context) error {
+	username, mailbox, grantee, err := aclArgs(ctx, true)
+	if err != nil {
+		return err
+	}
+	rights := ctx.Args().Get(3)
+	if rights == "" {
+		return cli.Exit("Error: RIGHTS is required", 2)
+	}
+	return as.GrantACL(username, mailbox, grantee, rights)
+}
+
+func aclRevoke(as aclStorage, ctx *cli.Context) error {
+	username, mailbox, grantee, err := aclArgs(ctx, true)
+	if err != nil {
+		return err
+	}
+	return as.RevokeACL(username, mailbox, grantee, ctx.Args().Get(3))
+}
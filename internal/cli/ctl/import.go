@@ -0,0 +1,375 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/themadorg/madmail/framework/hooks"
+	"github.com/themadorg/madmail/internal/auth"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/storage/imapsql"
+	"github.com/themadorg/madmail/internal/updatepipe"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "import",
+			Usage: "Import messages from other mail servers",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "maildir",
+					Usage: "Import messages from Maildir++ directories",
+					Description: `Import messages from the Maildir++ directory PATH, as used by Dovecot and
+Courier, into the existing account USERNAME. Folders are created as needed,
+message flags and delivery times are preserved. The account quota is
+enforced.
+
+If --mapping is specified, PATH is a directory containing Maildirs of
+multiple accounts and FILE lists them, one "DIR USERNAME" pair per line.
+DIR is relative to PATH. Empty lines and lines starting with # are ignored.
+
+Imported messages are recorded in the storage database, the import can be
+interrupted and run again, already imported messages are skipped.
+`,
+					ArgsUsage: "PATH [USERNAME]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.PathFlag{
+							Name:  "mapping",
+							Usage: "Read the list of Maildirs and accounts from `FILE`",
+						},
+						&cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Only report what would be imported",
+						},
+					},
+					Action: importMaildir,
+				},
+				{
+					Name:  "backup",
+					Usage: "Restore backups written by the export command",
+					Description: `Restore the backup stored in DIR into the existing account USERNAME,
+which defaults to the account the backup was made for. If DIR contains
+backups of multiple accounts written using "export --all", each is restored
+into the account it was made for.
+
+Mailboxes, messages with their flags and dates, the quota, aliases pointing
+to the account, Sieve scripts and the autoreply are restored. Checksums of
+mailboxes are verified before restoring them.
+
+--on-conflict selects how existing items are handled:
+  skip       Keep existing settings, do not restore mailboxes that exist
+             and have messages (default).
+  merge      Keep existing settings, restore messages into existing
+             mailboxes skipping ones restored earlier.
+  overwrite  Replace existing settings, remove messages from existing
+             mailboxes before restoring them.
+
+An interrupted restore can be continued using --on-conflict merge.
+`,
+					ArgsUsage: "DIR [USERNAME]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:  "on-conflict",
+							Usage: "Handling of existing items: skip, merge or overwrite",
+							Value: string(mdb.ConflictSkip),
+						},
+						&cli.BoolFlag{
+							Name:  "verify",
+							Usage: "Only verify checksums, do not restore anything",
+						},
+					},
+					Action: importBackup,
+				},
+			},
+		})
+}
+
+// maildirAccount is a Maildir directory to import into the account.
+type maildirAccount struct {
+	dir      string
+	username string
+}
+
+// readMaildirMapping reads the --mapping file. Directories are resolved
+// relative to root.
+func readMaildirMapping(path, root string) ([]maildirAccount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var accts []maildirAccount
+	scnr := bufio.NewScanner(f)
+	lineNum := 0
+	for scnr.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected DIR USERNAME", path, lineNum)
+		}
+		accts = append(accts, maildirAccount{
+			dir:      filepath.Join(root, fields[0]),
+			username: auth.NormalizeUsername(fields[1]),
+		})
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	return accts, nil
+}
+
+func importMaildir(ctx *cli.Context) error {
+	if ctx.Args().First() == "" {
+		return cli.Exit("Error: PATH is required", 2)
+	}
+	// Paths are resolved before openStorage changes the working directory
+	// to the state directory.
+	root, err := filepath.Abs(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+
+	var accts []maildirAccount
+	if mapping := ctx.Path("mapping"); mapping != "" {
+		if ctx.NArg() > 1 {
+			return cli.Exit("Error: USERNAME cannot be used with --mapping", 2)
+		}
+		accts, err = readMaildirMapping(mapping, root)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+		}
+	} else {
+		username := auth.NormalizeUsername(ctx.Args().Get(1))
+		if username == "" {
+			return cli.Exit("Error: USERNAME is required", 2)
+		}
+		accts = []maildirAccount{{dir: root, username: username}}
+	}
+
+	be, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeIfNeeded(be)
+	store, ok := be.(*imapsql.Storage)
+	if !ok {
+		return cli.Exit(fmt.Sprintf("Error: configuration block %s is not storage.imapsql", ctx.String("cfg-block")), 2)
+	}
+
+	bgCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	opts := imapsql.MaildirImportOptions{DryRun: ctx.Bool("dry-run")}
+	failed := false
+	for _, acct := range accts {
+		results, err := store.ImportMaildir(bgCtx, acct.username, acct.dir, opts)
+		for _, res := range results {
+			fmt.Printf("%s\t%s\timported %d, skipped %d, errors %d\n",
+				acct.username, res.Mailbox, res.Imported, res.Skipped, len(res.Errors))
+			for _, err := range res.Errors {
+				fmt.Fprintf(os.Stderr, "%s\t%s\t%v\n", acct.username, res.Mailbox, err)
+			}
+			if len(res.Errors) != 0 {
+				failed = true
+			}
+		}
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return cli.Exit("Interrupted, run the command again to continue", 1)
+			}
+			fmt.Fprintf(os.Stderr, "%s\t%v\n", acct.username, err)
+			failed = true
+		}
+	}
+	if opts.DryRun {
+		fmt.Println("Dry run, nothing was imported.")
+	}
+	if failed {
+		return cli.Exit("Error: import is incomplete, see the errors above", 1)
+	}
+	return nil
+}
+
+// backupDir is a backup to restore into the account.
+type backupDir struct {
+	dir      string
+	manifest *imapsql.BackupManifest
+	username string
+}
+
+// findBackups returns the backup stored in dir or backups stored in its
+// subdirectories.
+func findBackups(dir, username string) ([]backupDir, error) {
+	manifest, err := imapsql.ReadBackupManifest(dir)
+	if err == nil {
+		if username == "" {
+			username = manifest.Account
+		}
+		return []backupDir{{dir, manifest, username}}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if username != "" {
+		return nil, fmt.Errorf("%s: no %s, USERNAME can be used only with a single backup", dir, imapsql.BackupManifestName)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []backupDir
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		sub := filepath.Join(dir, entry.Name())
+		manifest, err := imapsql.ReadBackupManifest(sub)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sub, err)
+		}
+		backups = append(backups, backupDir{sub, manifest, manifest.Account})
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("%s: no backups found", dir)
+	}
+	return backups, nil
+}
+
+func verifyBackups(backups []backupDir) error {
+	failed := false
+	for _, b := range backups {
+		for _, mbox := range b.manifest.Mailboxes {
+			status := "OK"
+			if err := imapsql.VerifyBackupMailbox(b.dir, b.manifest.Format, mbox); err != nil {
+				status = err.Error()
+				failed = true
+			}
+			fmt.Printf("%s\t%s\t%s\n", b.manifest.Account, mbox.Name, status)
+		}
+	}
+	if failed {
+		return cli.Exit("Error: the backup is damaged", 1)
+	}
+	return nil
+}
+
+func importBackup(ctx *cli.Context) error {
+	if ctx.Args().First() == "" {
+		return cli.Exit("Error: DIR is required", 2)
+	}
+	policy, err := mdb.ParseConflictPolicy(ctx.String("on-conflict"))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+	// Resolved before openBackupStorage changes the working directory to
+	// the state directory.
+	dir, err := filepath.Abs(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	backups, err := findBackups(dir, auth.NormalizeUsername(ctx.Args().Get(1)))
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+	if ctx.Bool("verify") {
+		return verifyBackups(backups)
+	}
+
+	store, dbs, err := openBackupStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+	if err := store.EnableUpdatePipe(updatepipe.ModePush); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "Failed to initialize update pipe, clients will not see restored messages until they reconnect: %v\n", err)
+	}
+
+	bgCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	failed := false
+	for _, b := range backups {
+		results, err := store.RestoreAccount(bgCtx, b.username, b.dir, b.manifest, imapsql.RestoreOptions{Policy: policy})
+		for _, res := range results {
+			fmt.Printf("%s\t%s\trestored %d, skipped %d, errors %d\n",
+				b.username, res.Mailbox, res.Restored, res.Skipped, len(res.Errors))
+			for _, err := range res.Errors {
+				fmt.Fprintf(os.Stderr, "%s\t%s\t%v\n", b.username, res.Mailbox, err)
+			}
+			if len(res.Errors) != 0 {
+				failed = true
+			}
+		}
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return cli.Exit("Interrupted, run the command again with --on-conflict merge to continue", 1)
+			}
+			fmt.Fprintf(os.Stderr, "%s\t%v\n", b.username, err)
+			failed = true
+			continue
+		}
+
+		restored := 0
+		for _, gdb := range dbs {
+			n, err := mdb.RestoreAccountSettings(bgCtx, gdb, b.username, b.manifest.Settings, policy)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\t%v\n", b.username, err)
+				failed = true
+			}
+			restored += n
+		}
+		fmt.Printf("%s\tsettings\trestored %d\n", b.username, restored)
+	}
+	if failed {
+		return cli.Exit("Error: restore is incomplete, see the errors above", 1)
+	}
+	return nil
+}
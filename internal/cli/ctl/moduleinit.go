@@ -29,6 +29,8 @@ import (
 	"github.com/themadorg/madmail/framework/config"
 	"github.com/themadorg/madmail/framework/hooks"
 	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
+	mdb "github.com/themadorg/madmail/internal/db"
 	"github.com/themadorg/madmail/internal/target/queue"
 	"github.com/themadorg/madmail/internal/updatepipe"
 	"github.com/urfave/cli/v2"
@@ -40,7 +42,9 @@ func closeIfNeeded(i interface{}) {
 	}
 }
 
-func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo, error) {
+// registerModules reads the configuration file and registers all module
+// instances defined in it without initializing them.
+func registerModules(ctx *cli.Context) (map[string]interface{}, []maddy.ModInfo, error) {
 	cfgPath := ctx.String("config")
 	if cfgPath == "" {
 		return nil, nil, cli.Exit("Error: config is required", 2)
@@ -69,6 +73,14 @@ func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo
 	if err != nil {
 		return nil, nil, err
 	}
+	return globals, mods, nil
+}
+
+func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo, error) {
+	globals, mods, err := registerModules(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer hooks.RunHooks(hooks.EventShutdown)
 
 	cfgBlock := ctx.String("cfg-block")
@@ -86,9 +98,30 @@ func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo
 		return nil, nil, cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", cfgBlock), 2)
 	}
 
+	if err := initAuditLog(globals, mods, cfgBlock); err != nil {
+		return nil, nil, err
+	}
+
 	return globals, &mod, nil
 }
 
+// initAuditLog initializes the audit log, if configured, so management
+// commands and account changes made by them are recorded.
+//
+// The module is not closed, events are written synchronously when
+// module.NoRun is set.
+func initAuditLog(globals map[string]interface{}, mods []maddy.ModInfo, cfgBlock string) error {
+	for _, m := range mods {
+		if m.Instance.Name() != audit.ModName || m.Instance.InstanceName() == cfgBlock {
+			continue
+		}
+		if err := m.Instance.Init(config.NewMap(globals, m.Cfg)); err != nil {
+			return fmt.Errorf("Error: audit log initialization failed: %w", err)
+		}
+	}
+	return nil
+}
+
 func openStorage(ctx *cli.Context) (module.Storage, error) {
 	globals, mod, err := getCfgBlockModule(ctx)
 	if err != nil {
@@ -149,3 +182,21 @@ func openQueueTarget(ctx *cli.Context) (*queue.Queue, error) {
 
 	return q, nil
 }
+
+func openDBProvider(ctx *cli.Context) (mdb.Provider, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, ok := mod.Instance.(mdb.Provider)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s does not use an SQL database", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return provider, nil
+}
@@ -0,0 +1,228 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/themadorg/madmail/framework/module"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "msg-store",
+			Usage: "Message bodies store management",
+			Description: `These subcommands operate on the store used for message bodies
+(msg_store) by the storage backend defined in a top-level configuration block
+of maddy.conf. By default, the local_mailboxes block is used, this can be
+changed using --cfg-block flag.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "gc",
+					Usage: "Remove message bodies that are not used by any message",
+					Description: `Bodies are written to the store before the message is added to the
+database. If the server crashes in between, the body is left in the store.
+This command removes such bodies, it is also run periodically by the
+server, see msg_store_gc_interval.
+
+Bodies written less than --min-age ago are kept since they can belong to
+messages that are being delivered.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.DurationFlag{
+							Name:  "min-age",
+							Usage: "Keep bodies written less than this time ago",
+							Value: time.Hour,
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return msgStoreGC(be, ctx)
+					},
+				},
+				{
+					Name:      "migrate",
+					Usage:     "Copy message bodies to a different store",
+					ArgsUsage: "BLOCK",
+					Description: `Copy bodies of all messages to the blob store defined in the top-level
+configuration block BLOCK, e.g.
+
+    storage.blob.s3 new_store {
+        ...
+    }
+
+Then change msg_store to &BLOCK and restart the server. The server should be
+stopped during migration, otherwise messages delivered meanwhile are not
+copied. Migration can be restarted if interrupted, bodies that were already
+copied are overwritten.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.BoolFlag{
+							Name:    "quiet",
+							Aliases: []string{"q"},
+							Usage:   "Do not report progress",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return msgStoreMigrate(be, ctx)
+					},
+				},
+				{
+					Name:  "dedup-stats",
+					Usage: "Show the space saved by message bodies deduplication",
+					Description: `With deduplicate enabled, a message delivered to multiple local
+recipients or delivered multiple times is stored once. This command shows
+the number of stored bodies and the space they would take otherwise.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return msgStoreDedupStats(be)
+					},
+				},
+			},
+		})
+}
+
+type gcStorage interface {
+	CollectGarbage(minAge time.Duration) (int, error)
+}
+
+type migratableStorage interface {
+	MigrateBodies(dst module.BlobStore, progress func(done, total int)) (copied, missing int, err error)
+}
+
+type dedupStatsStorage interface {
+	DedupStats() (imapsql.DedupStats, error)
+}
+
+func msgStoreGC(be module.Storage, ctx *cli.Context) error {
+	gcs, ok := be.(gcStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support garbage collection", 2)
+	}
+
+	removed, err := gcs.CollectGarbage(ctx.Duration("min-age"))
+	if err != nil {
+		if errors.Is(err, imapsql.ErrNotListable) {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+		}
+		return err
+	}
+
+	fmt.Printf("Removed %d unused bodies.\n", removed)
+	return nil
+}
+
+func msgStoreMigrate(be module.Storage, ctx *cli.Context) error {
+	ms, ok := be.(migratableStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support message bodies migration", 2)
+	}
+
+	blockName := ctx.Args().First()
+	if blockName == "" {
+		return cli.Exit("Error: BLOCK is required", 2)
+	}
+	mod, err := module.GetInstance(blockName)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+	}
+	dst, ok := mod.(module.BlobStore)
+	if !ok {
+		return cli.Exit(fmt.Sprintf("Error: configuration block %s is not a blob store", blockName), 2)
+	}
+
+	var progress func(done, total int)
+	if !ctx.Bool("quiet") {
+		progress = func(done, total int) {
+			fmt.Fprintf(os.Stderr, "\rCopied %d/%d bodies", done, total)
+		}
+	}
+	copied, missing, err := ms.MigrateBodies(dst, progress)
+	if progress != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Copied %d bodies to %s.\n", copied, blockName)
+	if missing != 0 {
+		fmt.Printf("%d bodies were missing from the current store and were skipped.\n", missing)
+	}
+	return nil
+}
+
+func msgStoreDedupStats(be module.Storage) error {
+	ds, ok := be.(dedupStatsStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support deduplication", 2)
+	}
+
+	stats, err := ds.DedupStats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Shared bodies: %d\n", stats.Bodies)
+	fmt.Printf("Stored: %d bytes\n", stats.StoredBytes)
+	fmt.Printf("Saved: %d bytes\n", stats.SavedBytes())
+	return nil
+}
@@ -0,0 +1,276 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+
+	"github.com/themadorg/madmail/framework/hooks"
+	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
+	"github.com/themadorg/madmail/internal/auth"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	clitools2 "github.com/themadorg/madmail/internal/cli/clitools"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "purge-account",
+			Usage: "Remove all data of the account",
+			Description: `Remove the account from the storage block specified by --cfg-block
+(local_mailboxes by default) together with its messages and everything that
+references the address in databases of other modules: credentials, app
+passwords, aliases, Sieve scripts, autoreplies, queued outbound messages,
+suppressions, greylisting and rate limiting entries.
+
+Audit events of the account are kept until the audit log retention removes
+them, but the address and remote IPs are replaced. Use --delete-audit-events
+to remove them instead. The command itself is recorded in the audit log
+without the address.
+
+Use --dry-run to see the number of rows that would be changed.
+`,
+			ArgsUsage: "ADDRESS",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "cfg-block",
+					Usage:   "Module configuration block to use",
+					EnvVars: []string{"MADDY_CFGBLOCK"},
+					Value:   "local_mailboxes",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only count the rows that would be removed or anonymized",
+				},
+				&cli.BoolFlag{
+					Name:  "delete-audit-events",
+					Usage: "Remove audit events of the account instead of anonymizing them",
+				},
+				&cli.IntFlag{
+					Name:  "batch-size",
+					Usage: "Remove at most N rows in one transaction",
+					Value: mdb.DefaultPurgeBatchSize,
+				},
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "Don't ask for confirmation",
+				},
+			},
+			Action: purgeAccount,
+		})
+}
+
+type accountPurger interface {
+	PurgeAccount(ctx context.Context, username string, opts mdb.PurgeOptions) (mdb.PurgeReport, error)
+}
+
+// purgeSource is the part of the purge done for one module.
+type purgeSource struct {
+	instName string
+	report   mdb.PurgeReport
+}
+
+func purgeAccount(ctx *cli.Context) error {
+	username := auth.NormalizeUsername(ctx.Args().First())
+	if username == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+	opts := mdb.PurgeOptions{
+		DryRun:            ctx.Bool("dry-run"),
+		DeleteAuditEvents: ctx.Bool("delete-audit-events"),
+		BatchSize:         ctx.Int("batch-size"),
+	}
+
+	globals, mods, err := registerModules(ctx)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+
+	cfgBlock := ctx.String("cfg-block")
+	if !module.HasInstance(cfgBlock) {
+		return cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", cfgBlock), 2)
+	}
+	// The audit log is initialized separately so that it is not closed
+	// before the command is recorded.
+	if err := initAuditLog(globals, mods, cfgBlock); err != nil {
+		return err
+	}
+	storage, err := module.GetInstance(cfgBlock)
+	if err != nil {
+		return fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+	purger, ok := storage.(accountPurger)
+	if !ok {
+		return cli.Exit(fmt.Sprintf("Error: configuration block %s does not support purging accounts", cfgBlock), 2)
+	}
+
+	if !opts.DryRun && !ctx.Bool("yes") {
+		if !clitools2.Confirmation(fmt.Sprintf("All data of %s will be removed permanently, continue?", username), false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	bgCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var (
+		sources []purgeSource
+		dbs     []*gorm.DB
+	)
+	printReport := func() {
+		printPurgeReport(sources, opts.DryRun)
+	}
+
+	// Credentials stored using the PlainUserDB interface, e.g. by
+	// auth.pass_table, are not known to mdb.PurgeAccount. They are
+	// removed first since the removal is recorded in the audit log, the
+	// events are anonymized later.
+	for _, m := range mods {
+		name := m.Instance.InstanceName()
+		if name == cfgBlock {
+			continue
+		}
+		if _, ok := m.Instance.(module.PlainUserDB); !ok {
+			continue
+		}
+		inst, err := module.GetInstance(name)
+		if err != nil {
+			printReport()
+			return fmt.Errorf("Error: %s initialization failed: %w", name, err)
+		}
+		n, err := purgeCredentials(inst.(module.PlainUserDB), username, opts.DryRun)
+		sources = append(sources, purgeSource{name, mdb.PurgeReport{"credentials": n}})
+		if err != nil {
+			printReport()
+			return fmt.Errorf("Error: %s: %w", name, err)
+		}
+	}
+
+	report, err := purger.PurgeAccount(bgCtx, username, opts)
+	sources = append(sources, purgeSource{cfgBlock, report})
+	if err != nil {
+		printReport()
+		return err
+	}
+	if p, ok := storage.(mdb.Provider); ok && p.GORM() != nil {
+		dbs = append(dbs, p.GORM())
+	}
+
+	for _, m := range mods {
+		name := m.Instance.InstanceName()
+		if name == cfgBlock {
+			continue
+		}
+		if _, ok := m.Instance.(mdb.Provider); !ok {
+			continue
+		}
+		inst := m.Instance
+		if inst.Name() != audit.ModName {
+			inst, err = module.GetInstance(name)
+			if err != nil {
+				printReport()
+				return fmt.Errorf("Error: %s initialization failed: %w", name, err)
+			}
+		}
+		gdb := inst.(mdb.Provider).GORM()
+		if gdb == nil || containsDB(dbs, gdb) {
+			continue
+		}
+		dbs = append(dbs, gdb)
+
+		report, err := mdb.PurgeAccount(bgCtx, gdb, username, opts)
+		sources = append(sources, purgeSource{name, report})
+		if err != nil {
+			printReport()
+			return fmt.Errorf("Error: %s: %w", name, err)
+		}
+	}
+
+	printReport()
+	return nil
+}
+
+func purgeCredentials(db module.PlainUserDB, username string, dryRun bool) (int64, error) {
+	users, err := db.ListUsers()
+	if err != nil {
+		return 0, err
+	}
+	found := false
+	for _, u := range users {
+		if u == username {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, nil
+	}
+	if dryRun {
+		return 1, nil
+	}
+	if err := db.DeleteUser(username); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func containsDB(dbs []*gorm.DB, gdb *gorm.DB) bool {
+	for _, other := range dbs {
+		if mdb.SameDatabase(other, gdb) {
+			return true
+		}
+	}
+	return false
+}
+
+func printPurgeReport(sources []purgeSource, dryRun bool) {
+	if dryRun {
+		fmt.Println("Rows to be removed or anonymized:")
+	} else {
+		fmt.Println("Removed or anonymized rows:")
+	}
+	empty := true
+	for _, src := range sources {
+		tables := make([]string, 0, len(src.report))
+		for table, n := range src.report {
+			if n != 0 {
+				tables = append(tables, table)
+			}
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			fmt.Printf("%s\t%s\t%d\n", src.instName, table, src.report[table])
+			empty = false
+		}
+	}
+	if empty {
+		fmt.Println("(none)")
+	}
+}
@@ -19,7 +19,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package ctl
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	maddycli "github.com/themadorg/madmail/internal/cli"
 	"github.com/themadorg/madmail/internal/target/queue"
@@ -27,6 +29,13 @@ import (
 )
 
 func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "remote_queue",
+	}
+
 	maddycli.AddSubcommand(
 		&cli.Command{
 			Name:  "queue",
@@ -37,12 +46,7 @@ func init() {
 					Usage:     "Delete messages from queue for a user",
 					ArgsUsage: "USERNAME",
 					Flags: []cli.Flag{
-						&cli.StringFlag{
-							Name:    "cfg-block",
-							Usage:   "Module configuration block to use",
-							EnvVars: []string{"MADDY_CFGBLOCK"},
-							Value:   "remote_queue",
-						},
+						cfgBlockFlag,
 						&cli.BoolFlag{
 							Name:  "sender",
 							Usage: "Purge messages from this sender",
@@ -59,9 +63,61 @@ func init() {
 						if err != nil {
 							return err
 						}
+						defer closeIfNeeded(q)
 						return queuePurge(q, ctx)
 					},
 				},
+				{
+					Name:  "list",
+					Usage: "List queued messages",
+					Flags: []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueueTarget(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(q)
+						return queueList(q)
+					},
+				},
+				{
+					Name:      "show",
+					Usage:     "Show delivery status of a queued message",
+					ArgsUsage: "ID",
+					Flags:     []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueueTarget(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(q)
+						return queueShow(q, ctx)
+					},
+				},
+				{
+					Name:      "retry",
+					Usage:     "Attempt delivery of a queued message now",
+					ArgsUsage: "ID",
+					Description: `Schedule the message with ID for delivery now. Running servers
+attempt it within poll_interval. This is supported only for the queue stored
+in a database.
+`,
+					Flags: []cli.Flag{
+						cfgBlockFlag,
+						&cli.BoolFlag{
+							Name:  "all",
+							Usage: "Retry all queued messages",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						q, err := openQueueTarget(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(q)
+						return queueRetry(q, ctx)
+					},
+				},
 			},
 		})
 }
@@ -92,3 +148,77 @@ func queuePurge(q *queue.Queue, ctx *cli.Context) error {
 	fmt.Printf("Purged %d messages for %s from queue.\n", total, username)
 	return nil
 }
+
+func queueList(q *queue.Queue) error {
+	entries, err := q.Entries()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("Queue is empty.")
+		return nil
+	}
+	for _, entry := range entries {
+		pending := 0
+		for _, rcpt := range entry.Rcpts {
+			if rcpt.Status == "pending" {
+				pending++
+			}
+		}
+		fmt.Printf("%s\t%s\t%d pending\t%d attempts\tnext %s\n", entry.ID, entry.From,
+			pending, entry.Attempts, entry.NextAttempt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func queueShow(q *queue.Queue, ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return cli.Exit("Error: ID is required", 2)
+	}
+
+	entry, err := q.Entry(id)
+	if err != nil {
+		if errors.Is(err, queue.ErrNoSuchEntry) {
+			return cli.Exit("Error: no such message in queue: "+id, 2)
+		}
+		return err
+	}
+
+	fmt.Println("ID:", entry.ID)
+	fmt.Println("From:", entry.From)
+	fmt.Println("Queued:", entry.Created.Format(time.RFC3339))
+	if !entry.LastAttempt.IsZero() {
+		fmt.Println("Last attempt:", entry.LastAttempt.Format(time.RFC3339))
+	}
+	fmt.Println("Next attempt:", entry.NextAttempt.Format(time.RFC3339))
+	if entry.ClaimedBy != "" {
+		fmt.Println("Claimed by:", entry.ClaimedBy)
+	}
+	fmt.Println()
+	for _, rcpt := range entry.Rcpts {
+		fmt.Printf("%s\t%s\t%d attempts\t%s\n", rcpt.Rcpt, rcpt.Status, rcpt.Attempts, rcpt.LastError)
+	}
+	return nil
+}
+
+func queueRetry(q *queue.Queue, ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" && !ctx.Bool("all") {
+		return cli.Exit("Error: ID or --all is required", 2)
+	}
+
+	n, err := q.Retry(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, queue.ErrNoSuchEntry):
+			return cli.Exit("Error: no such message in queue: "+id, 2)
+		case errors.Is(err, queue.ErrNotSupported):
+			return cli.Exit("Error: retry is supported only for the queue stored in a database", 2)
+		}
+		return err
+	}
+
+	fmt.Printf("Scheduled %d messages for delivery.\n", n)
+	return nil
+}
@@ -0,0 +1,259 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/themadorg/madmail/framework/address"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	clitools2 "github.com/themadorg/madmail/internal/cli/clitools"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/target/remote"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "outbound_delivery",
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "routes",
+			Usage: "Outbound routing rules management",
+			Description: `These subcommands manage rules target.remote uses to relay messages via
+smarthosts, stored in the database of target.remote defined in a top-level
+configuration block of maddy.conf, e.g. 'target.remote outbound_delivery
+{ ... }'. By default, the outbound_delivery block is used, this can be
+changed using --cfg-block flag.
+
+For each recipient domain, the matching rule with the highest priority is
+used. Without a matching rule messages are delivered to the MX of the
+domain. The server picks up the changes once routing_cache_ttl passes.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List routing rules, the ones evaluated first go first",
+					Flags: []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						rt, err := openRemote(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(rt)
+						return routesList(rt)
+					},
+				},
+				{
+					Name:  "add",
+					Usage: "Add a routing rule",
+					Description: `PATTERN is a domain, "*.domain" to match its subdomains or "*" to match
+any domain. With --smarthost, matching messages are relayed via the
+specified server, otherwise they are delivered to the MX of the recipient
+domain, e.g. to exclude a domain from a wildcard rule with a lower
+priority.
+
+If --username is set, the password is read from stdin unless --password is
+used. Passwords are stored encrypted, db_encryption_key should be
+configured.
+`,
+					ArgsUsage: "PATTERN",
+					Flags: []cli.Flag{
+						cfgBlockFlag,
+						&cli.StringFlag{
+							Name:  "match",
+							Usage: "Match the recipient domain (rcpt_domain) or the sender domain (sender_domain)",
+							Value: remote.MatchRcptDomain,
+						},
+						&cli.StringFlag{
+							Name:  "smarthost",
+							Usage: "Relay messages via `HOST:PORT`",
+						},
+						&cli.StringFlag{
+							Name:  "username",
+							Usage: "Authenticate to the smarthost as `USERNAME`",
+						},
+						&cli.StringFlag{
+							Name:  "password",
+							Usage: "Use `PASSWORD` instead of reading password from stdin.\n\t\tWARNING: Provided only for debugging convenience. Don't leave your passwords in shell history!",
+						},
+						&cli.BoolFlag{
+							Name:  "require-tls",
+							Usage: "Refuse to relay messages if TLS cannot be used with the smarthost",
+						},
+						&cli.IntFlag{
+							Name:  "priority",
+							Usage: "Rules with higher priority are evaluated first",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						rt, err := openRemote(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(rt)
+						return routesAdd(rt, ctx)
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove a routing rule",
+					ArgsUsage: "ID",
+					Flags:     []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						rt, err := openRemote(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(rt)
+						return routesRemove(rt, ctx)
+					},
+				},
+				{
+					Name:      "test",
+					Usage:     "Show which rule applies to messages sent to the address and why",
+					ArgsUsage: "ADDRESS",
+					Flags: []cli.Flag{
+						cfgBlockFlag,
+						&cli.StringFlag{
+							Name:  "from",
+							Usage: "Sender `ADDRESS`, used for sender_domain rules",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						rt, err := openRemote(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(rt)
+						return routesTest(rt, ctx)
+					},
+				},
+			},
+		})
+}
+
+func routesList(rt *remote.Target) error {
+	rules, err := rt.Routes(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		fmt.Println("No routing rules.")
+		return nil
+	}
+	for _, r := range rules {
+		fmt.Printf("#%d\t%d\t%s\t%s\t%s\n", r.ID, r.Priority, r.MatchType, r.Pattern, routeTarget(r))
+	}
+	return nil
+}
+
+// routeTarget returns the human-readable description of the rule action.
+func routeTarget(r mdb.RoutingRule) string {
+	if r.Action != remote.RouteSmarthost {
+		return "direct"
+	}
+	desc := "smarthost " + r.Smarthost
+	if r.AuthUsername != "" {
+		desc += " as " + r.AuthUsername
+	}
+	if r.RequireTLS {
+		desc += " (TLS required)"
+	}
+	return desc
+}
+
+func routesAdd(rt *remote.Target, ctx *cli.Context) error {
+	pattern := ctx.Args().First()
+	if pattern == "" {
+		return cli.Exit("Error: PATTERN is required", 2)
+	}
+
+	rule := mdb.RoutingRule{
+		MatchType:    ctx.String("match"),
+		Pattern:      pattern,
+		Action:       remote.RouteDirect,
+		Smarthost:    ctx.String("smarthost"),
+		AuthUsername: ctx.String("username"),
+		RequireTLS:   ctx.Bool("require-tls"),
+		Priority:     ctx.Int("priority"),
+	}
+	if rule.Smarthost != "" {
+		rule.Action = remote.RouteSmarthost
+	}
+	if ctx.IsSet("password") {
+		rule.AuthPassword = ctx.String("password")
+	} else if rule.AuthUsername != "" {
+		var err error
+		rule.AuthPassword, err = clitools2.ReadPassword("Enter smarthost password")
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := rt.AddRoute(context.Background(), &rule); err != nil {
+		return cli.Exit("Error: "+err.Error(), 2)
+	}
+	fmt.Printf("Added rule #%d.\n", rule.ID)
+	return nil
+}
+
+func routesRemove(rt *remote.Target, ctx *cli.Context) error {
+	id, err := strconv.ParseUint(ctx.Args().First(), 10, 0)
+	if err != nil {
+		return cli.Exit("Error: ID is required", 2)
+	}
+
+	err = rt.RemoveRoute(context.Background(), uint(id))
+	if errors.Is(err, remote.ErrNoSuchRoute) {
+		return cli.Exit(fmt.Sprintf("Error: there is no rule #%d", id), 2)
+	}
+	return err
+}
+
+func routesTest(rt *remote.Target, ctx *cli.Context) error {
+	rcpt := ctx.Args().First()
+	if rcpt == "" {
+		return cli.Exit("Error: ADDRESS is required", 2)
+	}
+	_, domain, err := address.Split(rcpt)
+	if err != nil || domain == "" {
+		return cli.Exit(fmt.Sprintf("Error: invalid address %s", rcpt), 2)
+	}
+
+	d, err := rt.ResolveRoute(context.Background(), ctx.String("from"), domain)
+	if err != nil {
+		return err
+	}
+	if d.Rule == nil {
+		fmt.Println("Route: direct")
+	} else {
+		fmt.Printf("Route: %s (rule #%d)\n", routeTarget(*d.Rule), d.Rule.ID)
+	}
+	fmt.Println("Reason:", d.Reason())
+	return nil
+}
@@ -30,6 +30,7 @@ import (
 	maddy "github.com/themadorg/madmail"
 	parser "github.com/themadorg/madmail/framework/cfgparser"
 	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/log"
 	maddycli "github.com/themadorg/madmail/internal/cli"
 	mdb "github.com/themadorg/madmail/internal/db"
 	"github.com/urfave/cli/v2"
@@ -174,7 +175,9 @@ func openSharingGORM(ctx *cli.Context) (*gorm.DB, error) {
 		dsn = []string{filepath.Join(config.StateDirectory, "sharing.db")}
 	}
 
-	db, err := mdb.New(driver, dsn, ctx.Bool("debug"))
+	db, err := mdb.New(driver, dsn, mdb.Options{
+		Log: log.Logger{Name: "sharing", Debug: ctx.Bool("debug")},
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to open sharing GORM DB: %v", err)
 	}
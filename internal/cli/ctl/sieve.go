@@ -0,0 +1,215 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/internal/auth"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	"github.com/themadorg/madmail/internal/imap_filter/sieve"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "sieve",
+	}
+
+	scriptCmd := func(name, usage, argsUsage string, action func(f *sieve.Filter, ctx *cli.Context) error) *cli.Command {
+		return &cli.Command{
+			Name:      name,
+			Usage:     usage,
+			ArgsUsage: argsUsage,
+			Flags:     []cli.Flag{cfgBlockFlag},
+			Action: func(ctx *cli.Context) error {
+				f, err := openSieve(ctx)
+				if err != nil {
+					return err
+				}
+				defer closeIfNeeded(f)
+				return action(f, ctx)
+			},
+		}
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "sieve",
+			Usage: "Sieve filtering scripts management",
+			Description: `These subcommands manage Sieve scripts stored in the database by
+imap.filter.sieve defined in a top-level configuration block of maddy.conf,
+e.g. 'imap.filter.sieve sieve { ... }'. By default, the sieve block is used,
+this can be changed using --cfg-block flag.
+
+Each account can have multiple scripts, at most one of them is active and is
+used to filter delivered messages.
+`,
+			Subcommands: []*cli.Command{
+				scriptCmd("list", "List scripts of the account", "ACCOUNT", sieveList),
+				scriptCmd("get", "Print the script", "ACCOUNT NAME", sieveGet),
+				scriptCmd("put", "Create or replace the script, reading it from FILE or stdin", "ACCOUNT NAME [FILE]", sievePut),
+				scriptCmd("activate", "Use the script for filtering, deactivating other scripts", "ACCOUNT NAME", sieveActivate),
+				scriptCmd("deactivate", "Disable filtering for the account", "ACCOUNT", sieveDeactivate),
+				scriptCmd("delete", "Remove the inactive script", "ACCOUNT NAME", sieveDelete),
+			},
+		})
+}
+
+func openSieve(ctx *cli.Context) (*sieve.Filter, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := mod.Instance.(*sieve.Filter)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not imap.filter.sieve", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return f, nil
+}
+
+// sieveArgs returns the normalized account name and the script name, if
+// withName is set.
+func sieveArgs(ctx *cli.Context, withName bool) (string, string, error) {
+	account := ctx.Args().First()
+	if account == "" {
+		return "", "", cli.Exit("Error: ACCOUNT is required", 2)
+	}
+	if !withName {
+		return auth.NormalizeUsername(account), "", nil
+	}
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return "", "", cli.Exit("Error: NAME is required", 2)
+	}
+	return auth.NormalizeUsername(account), name, nil
+}
+
+func sieveScriptErr(err error, name string) error {
+	if errors.Is(err, sieve.ErrNoSuchScript) {
+		return cli.Exit(fmt.Sprintf("Error: no script named %s", name), 2)
+	}
+	return err
+}
+
+func sieveList(f *sieve.Filter, ctx *cli.Context) error {
+	account, _, err := sieveArgs(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	scripts, err := f.List(context.Background(), account)
+	if err != nil {
+		return err
+	}
+	if len(scripts) == 0 {
+		fmt.Println("No scripts.")
+		return nil
+	}
+	for _, s := range scripts {
+		status := ""
+		if s.Active {
+			status = "active"
+		}
+		fmt.Printf("%s\t%s\t%s\n", s.Name, s.UpdatedAt.Format(time.RFC3339), status)
+	}
+	return nil
+}
+
+func sieveGet(f *sieve.Filter, ctx *cli.Context) error {
+	account, name, err := sieveArgs(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	script, err := f.Get(context.Background(), account, name)
+	if err != nil {
+		return sieveScriptErr(err, name)
+	}
+	fmt.Print(script.Content)
+	return nil
+}
+
+func sievePut(f *sieve.Filter, ctx *cli.Context) error {
+	account, name, err := sieveArgs(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	var content []byte
+	if path := ctx.Args().Get(2); path != "" {
+		content, err = os.ReadFile(path)
+	} else {
+		content, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = f.Put(context.Background(), account, name, string(content))
+	var scriptErr *sieve.ScriptError
+	if errors.As(err, &scriptErr) {
+		return cli.Exit(fmt.Sprintf("Error: invalid script: %v", scriptErr), 2)
+	}
+	return err
+}
+
+func sieveActivate(f *sieve.Filter, ctx *cli.Context) error {
+	account, name, err := sieveArgs(ctx, true)
+	if err != nil {
+		return err
+	}
+	return sieveScriptErr(f.Activate(context.Background(), account, name), name)
+}
+
+func sieveDeactivate(f *sieve.Filter, ctx *cli.Context) error {
+	account, _, err := sieveArgs(ctx, false)
+	if err != nil {
+		return err
+	}
+	return f.Activate(context.Background(), account, "")
+}
+
+func sieveDelete(f *sieve.Filter, ctx *cli.Context) error {
+	account, name, err := sieveArgs(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	err = f.Delete(context.Background(), account, name)
+	if errors.Is(err, sieve.ErrScriptActive) {
+		return cli.Exit(fmt.Sprintf("Error: script %s is active, deactivate it first", name), 2)
+	}
+	return sieveScriptErr(err, name)
+}
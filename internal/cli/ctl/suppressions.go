@@ -0,0 +1,174 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/themadorg/madmail/framework/config"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	"github.com/themadorg/madmail/internal/target/remote"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "outbound_delivery",
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "suppressions",
+			Usage: "Outbound delivery suppression list management",
+			Description: `These subcommands manage recipients target.remote refuses to deliver
+to, stored in the database of target.remote defined in a top-level
+configuration block of maddy.conf, e.g. 'target.remote outbound_delivery
+{ ... }'. By default, the outbound_delivery block is used, this can be
+changed using --cfg-block flag.
+
+Recipients are suppressed automatically when a remote server rejects them
+with a permanent error (if suppress_bounces is enabled). A domain can be
+suppressed to refuse delivery to all its addresses.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List suppressed addresses and domains",
+					Flags: []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						rt, err := openRemote(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(rt)
+						return suppressionsList(rt)
+					},
+				},
+				{
+					Name:      "add",
+					Usage:     "Suppress delivery to the address or domain",
+					ArgsUsage: "ADDRESS|DOMAIN",
+					Flags: []cli.Flag{
+						cfgBlockFlag,
+						&cli.StringFlag{
+							Name:  "reason",
+							Usage: "Reason reported for skipped recipients",
+						},
+						&cli.DurationFlag{
+							Name:  "ttl",
+							Usage: "Remove the suppression after the specified duration, 0 to keep it forever",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						rt, err := openRemote(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(rt)
+						return suppressionsAdd(rt, ctx)
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "Allow delivery to the address or domain again",
+					ArgsUsage: "ADDRESS|DOMAIN",
+					Flags:     []cli.Flag{cfgBlockFlag},
+					Action: func(ctx *cli.Context) error {
+						rt, err := openRemote(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(rt)
+						return suppressionsRemove(rt, ctx)
+					},
+				},
+			},
+		})
+}
+
+func openRemote(ctx *cli.Context) (*remote.Target, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rt, ok := mod.Instance.(*remote.Target)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not target.remote", ctx.String("cfg-block")), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+	if rt.GORM() == nil {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s does not use a database", ctx.String("cfg-block")), 2)
+	}
+
+	return rt, nil
+}
+
+func suppressionsList(rt *remote.Target) error {
+	list, err := rt.Suppressions(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Println("No suppressions.")
+		return nil
+	}
+	for _, s := range list {
+		expires := "never"
+		if s.ExpiresAt != nil {
+			expires = s.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", s.Address, s.CreatedAt.Format(time.RFC3339), expires, s.BounceCode, s.Reason)
+	}
+	return nil
+}
+
+func suppressionsAdd(rt *remote.Target, ctx *cli.Context) error {
+	value := ctx.Args().First()
+	if value == "" {
+		return cli.Exit("Error: ADDRESS or DOMAIN is required", 2)
+	}
+	if ctx.Duration("ttl") < 0 {
+		return cli.Exit("Error: ttl should not be negative", 2)
+	}
+
+	return rt.Suppress(context.Background(), value, ctx.String("reason"), "", ctx.Duration("ttl"))
+}
+
+func suppressionsRemove(rt *remote.Target, ctx *cli.Context) error {
+	value := ctx.Args().First()
+	if value == "" {
+		return cli.Exit("Error: ADDRESS or DOMAIN is required", 2)
+	}
+
+	err := rt.Unsuppress(context.Background(), value)
+	if errors.Is(err, remote.ErrNoSuchSuppression) {
+		return cli.Exit(fmt.Sprintf("Error: %s is not suppressed", value), 2)
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/themadorg/madmail/internal/auth/sql_accounts"
+	maddycli "github.com/themadorg/madmail/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	cfgBlockFlag := &cli.StringFlag{
+		Name:    "cfg-block",
+		Usage:   "Module configuration block to use",
+		EnvVars: []string{"MADDY_CFGBLOCK"},
+		Value:   "local_authdb",
+	}
+
+	totpCmd := func(name, usage, argsUsage string, flags []cli.Flag, action func(a *sql_accounts.Auth, ctx *cli.Context) error) *cli.Command {
+		return &cli.Command{
+			Name:      name,
+			Usage:     usage,
+			ArgsUsage: argsUsage,
+			Flags:     append([]cli.Flag{cfgBlockFlag}, flags...),
+			Action: func(ctx *cli.Context) error {
+				a, err := openSQLAccounts(ctx)
+				if err != nil {
+					return err
+				}
+				defer closeIfNeeded(a)
+				return action(a, ctx)
+			},
+		}
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "totp",
+			Usage: "TOTP two-factor authentication management",
+			Description: `These subcommands manage TOTP secrets of accounts stored by auth.sql
+defined in a top-level configuration block of maddy.conf,
+e.g. 'auth.sql local_authdb { ... }'. By default, the local_authdb block is
+used, this can be changed using --cfg-block flag.
+
+Once enabled, clients should append the code to the password:
+"password:123456". db_encryption_key should be configured.
+`,
+			Subcommands: []*cli.Command{
+				totpCmd("enroll", "Generate a TOTP secret and recovery codes for the account", "USERNAME", []cli.Flag{
+					&cli.StringFlag{
+						Name:  "mode",
+						Usage: "Require the code 'always' or only for clients outside of trusted networks ('untrusted')",
+						Value: sql_accounts.TOTPModeAlways,
+					},
+				}, totpEnroll),
+				totpCmd("confirm", "Enable TOTP using a code generated from the new secret", "USERNAME CODE", nil, totpConfirm),
+				totpCmd("mode", "Change when the code is required", "USERNAME always|untrusted", nil, totpMode),
+				totpCmd("disable", "Remove the TOTP secret and recovery codes of the account", "USERNAME", nil, totpDisable),
+			},
+		})
+}
+
+func totpErr(err error, username string) error {
+	switch {
+	case errors.Is(err, sql_accounts.ErrNoSuchAccount):
+		return cli.Exit(fmt.Sprintf("Error: no such account: %s", username), 2)
+	case errors.Is(err, sql_accounts.ErrNoTOTP):
+		return cli.Exit(fmt.Sprintf("Error: TOTP is not enrolled for %s", username), 2)
+	case errors.Is(err, sql_accounts.ErrInvalidTOTPCode):
+		return cli.Exit("Error: invalid code", 2)
+	}
+	return err
+}
+
+func totpUsername(ctx *cli.Context) (string, error) {
+	username := ctx.Args().First()
+	if username == "" {
+		return "", cli.Exit("Error: USERNAME is required", 2)
+	}
+	return username, nil
+}
+
+func totpEnroll(a *sql_accounts.Auth, ctx *cli.Context) error {
+	username, err := totpUsername(ctx)
+	if err != nil {
+		return err
+	}
+
+	enrollment, err := a.EnrollTOTP(username, ctx.String("mode"))
+	if err != nil {
+		return totpErr(err, username)
+	}
+	fmt.Println("Secret:", enrollment.Secret)
+	fmt.Println("URI:", enrollment.URI)
+	fmt.Println()
+	fmt.Println("Recovery codes:")
+	for _, code := range enrollment.RecoveryCodes {
+		fmt.Println(code)
+	}
+	fmt.Println()
+	fmt.Println("The secret and the codes will not be shown again.")
+	fmt.Println("Run 'maddy totp confirm' with a generated code to enable TOTP.")
+	return nil
+}
+
+func totpConfirm(a *sql_accounts.Auth, ctx *cli.Context) error {
+	username, err := totpUsername(ctx)
+	if err != nil {
+		return err
+	}
+	code := ctx.Args().Get(1)
+	if code == "" {
+		return cli.Exit("Error: CODE is required", 2)
+	}
+	return totpErr(a.ConfirmTOTP(username, code), username)
+}
+
+func totpMode(a *sql_accounts.Auth, ctx *cli.Context) error {
+	username, err := totpUsername(ctx)
+	if err != nil {
+		return err
+	}
+	mode := ctx.Args().Get(1)
+	if mode != sql_accounts.TOTPModeAlways && mode != sql_accounts.TOTPModeUntrusted {
+		return cli.Exit("Error: mode should be 'always' or 'untrusted'", 2)
+	}
+	return totpErr(a.SetTOTPMode(username, mode), username)
+}
+
+func totpDisable(a *sql_accounts.Auth, ctx *cli.Context) error {
+	username, err := totpUsername(ctx)
+	if err != nil {
+		return err
+	}
+	return totpErr(a.DisableTOTP(username), username)
+}
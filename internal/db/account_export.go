@@ -0,0 +1,270 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/themadorg/madmail/framework/address"
+	"gorm.io/gorm"
+)
+
+// ConflictPolicy selects how restoring a backup handles items that already
+// exist in the account.
+type ConflictPolicy string
+
+const (
+	// ConflictSkip leaves existing items unchanged. Mailboxes that exist
+	// are not restored.
+	ConflictSkip ConflictPolicy = "skip"
+
+	// ConflictOverwrite replaces existing items. Existing mailboxes are
+	// emptied before messages are restored into them.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+
+	// ConflictMerge leaves existing settings unchanged, but restores
+	// messages into existing mailboxes, skipping the ones restored earlier.
+	ConflictMerge ConflictPolicy = "merge"
+)
+
+// ParseConflictPolicy parses the name of the ConflictPolicy.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case ConflictSkip, ConflictOverwrite, ConflictMerge:
+		return p, nil
+	}
+	return "", fmt.Errorf("db: unknown conflict policy: %s", s)
+}
+
+// AccountSettings are the per-account settings stored by modules other
+// than the storage: aliases pointing to the account, Sieve scripts and the
+// autoreply. It is a part of the account backup and is stable when encoded
+// as JSON.
+type AccountSettings struct {
+	Aliases      []AliasSettings       `json:"aliases,omitempty"`
+	SieveScripts []SieveScriptSettings `json:"sieve_scripts,omitempty"`
+	Autoreply    *AutoreplySettings    `json:"autoreply,omitempty"`
+}
+
+// AliasSettings is an alias delivering to the account. Address is
+// "*@domain" for a catch-all alias.
+type AliasSettings struct {
+	Address  string `json:"address"`
+	Priority int    `json:"priority"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// SieveScriptSettings is a Sieve script of the account, at most one script
+// is Active.
+type SieveScriptSettings struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Active  bool   `json:"active"`
+}
+
+// AutoreplySettings is the autoreply of the account, see Autoreply.
+type AutoreplySettings struct {
+	Enabled bool       `json:"enabled"`
+	Subject string     `json:"subject"`
+	Body    string     `json:"body"`
+	StartAt *time.Time `json:"start_at,omitempty"`
+	EndAt   *time.Time `json:"end_at,omitempty"`
+}
+
+// Merge adds settings from other to s. It is used to combine settings read
+// from databases of multiple modules.
+func (s *AccountSettings) Merge(other AccountSettings) {
+	s.Aliases = append(s.Aliases, other.Aliases...)
+	s.SieveScripts = append(s.SieveScripts, other.SieveScripts...)
+	if other.Autoreply != nil {
+		s.Autoreply = other.Autoreply
+	}
+}
+
+// ExportAccountSettings reads the settings of the account with the
+// normalized address addr from gdb. Tables that do not exist in gdb are
+// skipped, as in PurgeAccount.
+func ExportAccountSettings(ctx context.Context, gdb *gorm.DB, addr string) (AccountSettings, error) {
+	var settings AccountSettings
+	q := gdb.WithContext(ctx)
+
+	if q.Migrator().HasTable(&Alias{}) {
+		var aliases []Alias
+		if err := q.Where("destination = ?", addr).Order("domain, source, priority").Find(&aliases).Error; err != nil {
+			return settings, fmt.Errorf("db: export account settings: %w", err)
+		}
+		for _, a := range aliases {
+			settings.Aliases = append(settings.Aliases, AliasSettings{
+				Address:  a.Source + "@" + a.Domain,
+				Priority: a.Priority,
+				Enabled:  a.Enabled,
+			})
+		}
+	}
+
+	if q.Migrator().HasTable(&SieveScript{}) {
+		var scripts []SieveScript
+		if err := q.Where("account = ?", addr).Order("name").Find(&scripts).Error; err != nil {
+			return settings, fmt.Errorf("db: export account settings: %w", err)
+		}
+		for _, s := range scripts {
+			settings.SieveScripts = append(settings.SieveScripts, SieveScriptSettings{
+				Name:    s.Name,
+				Content: s.Content,
+				Active:  s.Active,
+			})
+		}
+	}
+
+	if q.Migrator().HasTable(&Autoreply{}) {
+		var reply Autoreply
+		err := q.Where("account = ?", addr).First(&reply).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return settings, fmt.Errorf("db: export account settings: %w", err)
+		}
+		if err == nil {
+			settings.Autoreply = &AutoreplySettings{
+				Enabled: reply.Enabled,
+				Subject: reply.Subject,
+				Body:    reply.Body,
+				StartAt: reply.StartAt,
+				EndAt:   reply.EndAt,
+			}
+		}
+	}
+
+	return settings, nil
+}
+
+// RestoreAccountSettings writes settings of the account with the
+// normalized address addr to the tables of gdb that exist, in a single
+// transaction. Settings are restored for the account they are passed for,
+// so a backup can be restored into a different account.
+//
+// Aliases are matched by the address and Sieve scripts by the name. Unless
+// policy is ConflictOverwrite, existing aliases, scripts and the autoreply
+// are kept and restored scripts are not activated if another script is
+// active. The number of restored items is returned.
+func RestoreAccountSettings(ctx context.Context, gdb *gorm.DB, addr string, settings AccountSettings, policy ConflictPolicy) (int, error) {
+	restored := 0
+	err := gdb.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		restored = 0
+
+		if tx.Migrator().HasTable(&Alias{}) {
+			for _, a := range settings.Aliases {
+				n, err := restoreAlias(tx, addr, a, policy)
+				if err != nil {
+					return err
+				}
+				restored += n
+			}
+		}
+
+		if tx.Migrator().HasTable(&SieveScript{}) {
+			for _, s := range settings.SieveScripts {
+				n, err := restoreSieveScript(tx, addr, s, policy)
+				if err != nil {
+					return err
+				}
+				restored += n
+			}
+		}
+
+		if settings.Autoreply != nil && tx.Migrator().HasTable(&Autoreply{}) {
+			n, err := restoreAutoreply(tx, addr, *settings.Autoreply, policy)
+			if err != nil {
+				return err
+			}
+			restored += n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("db: restore account settings: %w", err)
+	}
+	return restored, nil
+}
+
+func restoreAlias(tx *gorm.DB, addr string, a AliasSettings, policy ConflictPolicy) (int, error) {
+	source, domain, err := address.Split(a.Address)
+	if err != nil {
+		return 0, fmt.Errorf("alias %s: %w", a.Address, err)
+	}
+	domain = strings.ToLower(domain)
+
+	var existing Alias
+	err = tx.Where("source = ? AND domain = ? AND destination = ?", source, domain, addr).First(&existing).Error
+	switch {
+	case err == nil:
+		if policy != ConflictOverwrite {
+			return 0, nil
+		}
+		existing.Priority = a.Priority
+		existing.Enabled = a.Enabled
+		return 1, tx.Save(&existing).Error
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return 1, tx.Create(&Alias{
+			Source:      source,
+			Domain:      domain,
+			Destination: addr,
+			Priority:    a.Priority,
+			Enabled:     a.Enabled,
+		}).Error
+	default:
+		return 0, err
+	}
+}
+
+func restoreSieveScript(tx *gorm.DB, addr string, s SieveScriptSettings, policy ConflictPolicy) (int, error) {
+	var existing SieveScript
+	err := tx.Where("account = ? AND name = ?", addr, s.Name).First(&existing).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+	if err == nil && policy != ConflictOverwrite {
+		return 0, nil
+	}
+
+	active := s.Active
+	if active {
+		if policy == ConflictOverwrite {
+			err = tx.Model(&SieveScript{}).Where("account = ? AND name <> ?", addr, s.Name).Update("active", false).Error
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			var count int64
+			if err := tx.Model(&SieveScript{}).Where("account = ? AND active = ?", addr, true).Count(&count).Error; err != nil {
+				return 0, err
+			}
+			active = count == 0
+		}
+	}
+
+	existing.Account = addr
+	existing.Name = s.Name
+	existing.Content = s.Content
+	existing.Active = active
+	return 1, tx.Save(&existing).Error
+}
+
+func restoreAutoreply(tx *gorm.DB, addr string, r AutoreplySettings, policy ConflictPolicy) (int, error) {
+	var existing Autoreply
+	err := tx.Where("account = ?", addr).First(&existing).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+	if err == nil && policy != ConflictOverwrite {
+		return 0, nil
+	}
+
+	existing.Account = addr
+	existing.Enabled = r.Enabled
+	existing.Subject = r.Subject
+	existing.Body = r.Body
+	existing.StartAt = r.StartAt
+	existing.EndAt = r.EndAt
+	return 1, tx.Save(&existing).Error
+}
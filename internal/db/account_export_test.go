@@ -0,0 +1,98 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestAccountSettingsRestore(t *testing.T) {
+	gdb := openTestDB(t)
+	models := []interface{}{&Alias{}, &SieveScript{}, &Autoreply{}}
+	if err := gdb.Migrator().DropTable(models...); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+
+	const addr = "user@example.org"
+	rows := []interface{}{
+		&Alias{Source: "postmaster", Domain: "example.org", Destination: addr, Enabled: true},
+		&Alias{Source: "*", Domain: "example.org", Destination: addr, Priority: 1, Enabled: true},
+		&Alias{Source: "info", Domain: "example.org", Destination: "other@example.org", Enabled: true},
+		&SieveScript{Account: addr, Name: "main", Content: "keep;", Active: true},
+		&SieveScript{Account: addr, Name: "spare", Content: "discard;"},
+		&Autoreply{Account: addr, Enabled: true, Subject: "Away", Body: "Back soon"},
+	}
+	for _, row := range rows {
+		if err := gdb.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	settings, err := ExportAccountSettings(ctx, gdb, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAliases := []AliasSettings{
+		{Address: "*@example.org", Priority: 1, Enabled: true},
+		{Address: "postmaster@example.org", Enabled: true},
+	}
+	if !reflect.DeepEqual(settings.Aliases, wantAliases) {
+		t.Errorf("unexpected aliases: %+v", settings.Aliases)
+	}
+	if len(settings.SieveScripts) != 2 || !settings.SieveScripts[0].Active || settings.Autoreply == nil {
+		t.Fatalf("unexpected settings: %+v", settings)
+	}
+
+	// Restore into another account that has its own active script.
+	const dst = "new@example.org"
+	if err := gdb.Create(&SieveScript{Account: dst, Name: "main", Content: "stop;", Active: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+	n, err := RestoreAccountSettings(ctx, gdb, dst, settings, ConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("expected 4 restored items, got %d", n)
+	}
+	restored, err := ExportAccountSettings(ctx, gdb, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.Aliases, wantAliases) {
+		t.Errorf("unexpected restored aliases: %+v", restored.Aliases)
+	}
+	want := []SieveScriptSettings{{Name: "main", Content: "stop;", Active: true}, {Name: "spare", Content: "discard;"}}
+	if !reflect.DeepEqual(restored.SieveScripts, want) {
+		t.Errorf("unexpected scripts after skip: %+v", restored.SieveScripts)
+	}
+
+	n, err = RestoreAccountSettings(ctx, gdb, dst, settings, ConflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("expected 5 restored items, got %d", n)
+	}
+	restored, err = ExportAccountSettings(ctx, gdb, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.SieveScripts, settings.SieveScripts) {
+		t.Errorf("unexpected scripts after overwrite: %+v", restored.SieveScripts)
+	}
+	if !reflect.DeepEqual(restored.Autoreply, settings.Autoreply) {
+		t.Errorf("unexpected autoreply: %+v", restored.Autoreply)
+	}
+
+	if _, err := ParseConflictPolicy("replace"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gorm.io/gorm"
+)
+
+// ErrBackupNotSupported is returned by Backup for databases other than
+// SQLite.
+var ErrBackupNotSupported = errors.New("online backup is supported only for SQLite, use native tooling (e.g. pg_dump or mysqldump) instead")
+
+// BackupOptions controls Backup behavior, the zero value is usable.
+type BackupOptions struct {
+	// Force allows Backup to replace an existing file.
+	Force bool
+
+	// Progress, if set, is called after each copied chunk of the database
+	// with the number of pages copied so far and the total number of pages.
+	Progress func(copied, total int)
+}
+
+// Backup writes a consistent snapshot of the SQLite database used by gdb
+// to path. The database remains usable while the backup is in progress.
+//
+// The snapshot is written to a temporary file in the same directory that is
+// renamed to path once complete, so path never contains a partial backup.
+// If path exists, ErrExist is returned unless opts.Force is set.
+func Backup(ctx context.Context, gdb *gorm.DB, path string, opts BackupOptions) error {
+	if !isSQLite(gdb.Dialector.Name()) {
+		return ErrBackupNotSupported
+	}
+	if !opts.Force {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("db: backup: %s: %w, use force to overwrite", path, os.ErrExist)
+		}
+	}
+
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("db: backup: %w", err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	if err := sqliteBackup(ctx, sqlDB, tmpPath, opts.Progress); err != nil {
+		return fmt.Errorf("db: backup: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("db: backup: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !cgo || nosqlite3
+// +build !cgo nosqlite3
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+func sqliteBackup(context.Context, *sql.DB, string, func(copied, total int)) error {
+	return errors.New("madmail is built without SQLite support")
+}
@@ -0,0 +1,101 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// backupStepPages is the number of pages copied by a single backup step.
+var backupStepPages = 1024
+
+const (
+	// backupBusyDelay is the wait before retrying a step that failed because
+	// the destination is locked.
+	backupBusyDelay = 10 * time.Millisecond
+)
+
+// sqliteBackup copies the database to dest using the SQLite online backup
+// API.
+func sqliteBackup(ctx context.Context, sqlDB *sql.DB, dest string, progress func(copied, total int)) error {
+	srcConn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	// The backup is restarted if the source database changes between steps.
+	// Keep a read transaction open instead so that all steps copy the same
+	// snapshot. In WAL mode this does not block writers.
+	if _, err := srcConn.ExecContext(ctx, "BEGIN"); err != nil {
+		return err
+	}
+	defer srcConn.ExecContext(context.Background(), "ROLLBACK")
+	if _, err := srcConn.ExecContext(ctx, "SELECT count(*) FROM sqlite_master"); err != nil {
+		return err
+	}
+
+	destDB, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			destSQLite, ok := destRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected driver connection type: %T", destRaw)
+			}
+			srcSQLite, ok := srcRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected driver connection type: %T", srcRaw)
+			}
+
+			b, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+			lastCopied := -1
+			for {
+				done, err := b.Step(backupStepPages)
+				if err != nil {
+					b.Finish()
+					return err
+				}
+				total := b.PageCount()
+				copied := total - b.Remaining()
+				if progress != nil {
+					progress(copied, total)
+				}
+				if done {
+					return b.Finish()
+				}
+
+				// Step makes no progress while the destination is locked.
+				delay := time.Duration(0)
+				if copied == lastCopied {
+					delay = backupBusyDelay
+				}
+				lastCopied = copied
+				select {
+				case <-ctx.Done():
+					b.Finish()
+					return ctx.Err()
+				case <-time.After(delay):
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,111 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestBackup(t *testing.T) {
+	dir := testutils.Dir(t)
+	gdb, err := New("sqlite3", []string{filepath.Join(dir, "test.db")}, Options{
+		Log:          testutils.Logger(t, "db"),
+		MaxOpenConns: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := gdb.DB()
+		sqlDB.Close()
+	})
+
+	if err := gdb.AutoMigrate(&driverTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		rec := driverTestRecord{Name: strconv.Itoa(i), Body: string(make([]byte, 4096))}
+		if err := gdb.Create(&rec).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(pages int) { backupStepPages = pages }(backupStepPages)
+	backupStepPages = 16
+
+	out := filepath.Join(dir, "backup.db")
+	calls, lastCopied, lastTotal := 0, 0, 0
+	err = Backup(context.Background(), gdb, out, BackupOptions{
+		Progress: func(copied, total int) {
+			calls++
+			lastCopied, lastTotal = copied, total
+			if calls == 1 {
+				// Written while the backup is in progress, not included in it.
+				if err := gdb.Create(&driverTestRecord{Name: "late"}).Error; err != nil {
+					t.Error(err)
+				}
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls < 2 || lastCopied != lastTotal {
+		t.Errorf("unexpected progress reports: calls=%d copied=%d total=%d", calls, lastCopied, lastTotal)
+	}
+
+	backup, err := New("sqlite3", []string{out}, Options{Log: testutils.Logger(t, "db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	if err := backup.Model(&driverTestRecord{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 200 {
+		t.Errorf("expected 200 records in the backup, got %d", count)
+	}
+	sqlDB, _ := backup.DB()
+	sqlDB.Close()
+
+	if err := Backup(context.Background(), gdb, out, BackupOptions{}); !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected ErrExist for an existing file, got %v", err)
+	}
+	if err := Backup(context.Background(), gdb, out, BackupOptions{Force: true}); err != nil {
+		t.Errorf("forced backup failed: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == ".tmp" {
+			t.Errorf("temporary file left behind: %s", e.Name())
+		}
+	}
+}
+
+func TestBackup_NotSupported(t *testing.T) {
+	gdb, err := gorm.Open(postgres.Open("host=localhost port=1"), &gorm.Config{DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(testutils.Dir(t), "backup.db")
+	if err := Backup(context.Background(), gdb, out, BackupOptions{}); !errors.Is(err, ErrBackupNotSupported) {
+		t.Errorf("expected ErrBackupNotSupported, got %v", err)
+	}
+	if _, err := os.Stat(out); !errors.Is(err, os.ErrNotExist) {
+		t.Error("file is created for an unsupported database")
+	}
+}
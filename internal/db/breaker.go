@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/themadorg/madmail/framework/exterrors"
+	"gorm.io/gorm"
+)
+
+// Circuit breaker defaults used when the corresponding Options field is
+// zero.
+const (
+	DefaultBreakerThreshold     = 5
+	DefaultBreakerProbeInterval = 5 * time.Second
+)
+
+// ErrCircuitOpen is returned for queries while the circuit breaker of the
+// database is open, i.e. the database was found to be unreachable and was
+// not reachable again yet. It is a temporary error.
+var ErrCircuitOpen = exterrors.WithTemporary(errors.New("database is unavailable (circuit breaker is open)"), true)
+
+// breaker fails queries immediately after threshold consecutive connection
+// errors instead of letting each of them wait for the network timeout.
+// Once open, the database is probed in background until it responds.
+type breaker struct {
+	threshold     int32
+	probeInterval time.Duration
+
+	failures atomic.Int32
+	open     atomic.Bool
+	trips    atomic.Uint64
+
+	lock    sync.Mutex
+	lastErr error
+}
+
+func newBreaker(opts Options) *breaker {
+	if opts.BreakerThreshold < 0 {
+		return nil
+	}
+	b := &breaker{
+		threshold:     int32(opts.BreakerThreshold),
+		probeInterval: opts.BreakerProbeInterval,
+	}
+	if b.threshold == 0 {
+		b.threshold = DefaultBreakerThreshold
+	}
+	if b.probeInterval <= 0 {
+		b.probeInterval = DefaultBreakerProbeInterval
+	}
+	return b
+}
+
+func (b *breaker) isOpen() bool {
+	return b != nil && b.open.Load()
+}
+
+func (b *breaker) err() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.lastErr
+}
+
+// useBreaker registers callbacks rejecting queries while the breaker is
+// open and counting connection errors.
+func useBreaker(gdb *gorm.DB, sqlDB *sql.DB, st *poolState) error {
+	if st.breaker == nil {
+		return nil
+	}
+	return registerCallbacks(gdb, "madmail:breaker", func(db *gorm.DB) {
+		if st.breaker.isOpen() {
+			db.AddError(ErrCircuitOpen)
+		}
+	}, func(string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			if errors.Is(db.Error, ErrCircuitOpen) || errors.Is(db.Error, ErrClosing) {
+				return
+			}
+			st.reportResult(sqlDB, db.Error)
+		}
+	})
+}
+
+// reportResult updates the breaker state after an operation. Only
+// connection errors count as failures, any other result (including
+// query-level errors) shows that the database is reachable.
+func (st *poolState) reportResult(sqlDB *sql.DB, err error) bool {
+	b := st.breaker
+	if err == nil || !isConnectionError(err) {
+		if b != nil {
+			b.failures.Store(0)
+		}
+		return false
+	}
+	if b == nil {
+		return true
+	}
+
+	if b.failures.Add(1) < b.threshold || !b.open.CompareAndSwap(false, true) {
+		return true
+	}
+	b.lock.Lock()
+	b.lastErr = err
+	b.lock.Unlock()
+	b.trips.Add(1)
+	st.log.Error("database is unreachable, rejecting queries until it recovers", err, "failures", b.threshold)
+	go st.probe(sqlDB)
+	return true
+}
+
+// probe checks the database every probeInterval and closes the breaker once
+// it responds. It stops if the pool is closed.
+func (st *poolState) probe(sqlDB *sql.DB) {
+	b := st.breaker
+	ticker := time.NewTicker(b.probeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if st.closing.Load() {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), HealthCheckTimeout)
+		err := checkConn(ctx, sqlDB)
+		cancel()
+		if err != nil {
+			b.lock.Lock()
+			b.lastErr = err
+			b.lock.Unlock()
+			continue
+		}
+
+		b.failures.Store(0)
+		b.open.Store(false)
+		st.log.Msg("database is reachable again, accepting queries")
+		return
+	}
+}
+
+// CheckAvailable returns ErrCircuitOpen if the circuit breaker of gdb is
+// open. It allows callers to fail early, e.g. before accepting a message
+// that would not be stored anyway.
+func CheckAvailable(gdb *gorm.DB) error {
+	if gdb == nil {
+		return nil
+	}
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		return err
+	}
+	if st, ok := poolStates.Load(sqlDB); ok && st.(*poolState).breaker.isOpen() {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// ReportResult records the result of an operation on the database of gdb
+// done without GORM, e.g. by a library that uses its own connection to the
+// same database, so that its connection errors count towards opening the
+// circuit breaker. It reports whether err is a connection error.
+func ReportResult(gdb *gorm.DB, err error) bool {
+	if gdb == nil {
+		return err != nil && isConnectionError(err)
+	}
+	if sqlDB, dbErr := gdb.DB(); dbErr == nil {
+		if st, ok := poolStates.Load(sqlDB); ok {
+			return st.(*poolState).reportResult(sqlDB, err)
+		}
+	}
+	return err != nil && isConnectionError(err)
+}
@@ -0,0 +1,125 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/themadorg/madmail/framework/exterrors"
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/gorm"
+)
+
+func TestBreaker(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+		Log:                  testutils.Logger(t, "db"),
+		BreakerThreshold:     3,
+		BreakerProbeInterval: 50 * time.Millisecond,
+		Metrics:              m,
+		MetricsName:          "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Close(context.Background(), gdb) })
+
+	if err := gdb.AutoMigrate(&driverTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Create(&driverTestRecord{Name: "a"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	connErr := fmt.Errorf("dial tcp: %w", syscall.ECONNREFUSED)
+	ReportResult(gdb, connErr)
+	ReportResult(gdb, connErr)
+	// Query-level errors show that the database is reachable.
+	if err := gdb.Create(&driverTestRecord{Name: "a"}).Error; err == nil {
+		t.Fatal("expected a constraint violation")
+	}
+	ReportResult(gdb, connErr)
+	if err := CheckAvailable(gdb); err != nil {
+		t.Fatal("breaker is opened by non-consecutive errors:", err)
+	}
+	ReportResult(gdb, connErr)
+	if !ReportResult(gdb, connErr) {
+		t.Error("ReportResult does not recognize a connection error")
+	}
+
+	if err := CheckAvailable(gdb); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatal("expected ErrCircuitOpen after consecutive connection errors, got", err)
+	}
+	var rec driverTestRecord
+	err = gdb.First(&rec).Error
+	if !errors.Is(err, ErrCircuitOpen) || !exterrors.IsTemporary(err) {
+		t.Errorf("expected temporary ErrCircuitOpen for a query, got %v", err)
+	}
+	if _, err := WithTx(context.Background(), gdb, func(tx *gorm.DB) error { return nil }, TxOptions{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen for a transaction, got %v", err)
+	}
+	err = Ping(context.Background(), gdb)
+	if !errors.Is(err, ErrCircuitOpen) || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("expected ErrCircuitOpen with the last error from Ping, got %v", err)
+	}
+	expected := `
+# HELP maddy_db_circuit_breaker_open Whether queries are rejected because the database is unreachable
+# TYPE maddy_db_circuit_breaker_open gauge
+maddy_db_circuit_breaker_open{db="test"} 1
+`
+	if err := testutil.CollectAndCompare(m.pools, strings.NewReader(expected), "maddy_db_circuit_breaker_open"); err != nil {
+		t.Error(err)
+	}
+
+	// The database is actually reachable, so the probe closes the breaker.
+	deadline := time.Now().Add(5 * time.Second)
+	for CheckAvailable(gdb) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("breaker is not closed by the probe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := gdb.First(&rec).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	for _, err := range []error{
+		syscall.ECONNREFUSED,
+		fmt.Errorf("read: %w", syscall.ECONNRESET),
+		&pgconn.PgError{Code: "57P01"},
+		&pgconn.PgError{Code: "08006"},
+	} {
+		if !isConnectionError(err) {
+			t.Errorf("%v is not recognized as a connection error", err)
+		}
+	}
+	for _, err := range []error{
+		context.DeadlineExceeded,
+		context.Canceled,
+		&pgconn.PgError{Code: "23505"},  // unique_violation
+		&pgconn.PgError{Code: "42601"},  // syntax_error
+		&mysql.MySQLError{Number: 1062}, // ER_DUP_ENTRY
+		errors.New("UNIQUE constraint failed: records.name"),
+	} {
+		if isConnectionError(err) {
+			t.Errorf("%v is recognized as a connection error", err)
+		}
+	}
+}
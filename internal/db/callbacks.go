@@ -0,0 +1,38 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// registerCallbacks registers before and after around every GORM operation
+// of gdb. after is called with the operation name: create, query, update,
+// delete or raw, it may be nil. prefix makes callback names unique.
+func registerCallbacks(gdb *gorm.DB, prefix string, before func(*gorm.DB), after func(op string) func(*gorm.DB)) error {
+	cb := gdb.Callback()
+	errs := []error{
+		cb.Create().Before("gorm:create").Register(prefix+"_before_create", before),
+		cb.Query().Before("gorm:query").Register(prefix+"_before_query", before),
+		// Row is used by Scan, Pluck-like helpers and Raw(...).Row().
+		cb.Row().Before("gorm:row").Register(prefix+"_before_row", before),
+		cb.Update().Before("gorm:update").Register(prefix+"_before_update", before),
+		cb.Delete().Before("gorm:delete").Register(prefix+"_before_delete", before),
+		cb.Raw().Before("gorm:raw").Register(prefix+"_before_raw", before),
+	}
+	if after != nil {
+		errs = append(errs,
+			cb.Create().After("gorm:create").Register(prefix+"_after_create", after("create")),
+			cb.Query().After("gorm:query").Register(prefix+"_after_query", after("query")),
+			cb.Row().After("gorm:row").Register(prefix+"_after_row", after("query")),
+			cb.Update().After("gorm:update").Register(prefix+"_after_update", after("update")),
+			cb.Delete().After("gorm:delete").Register(prefix+"_after_delete", after("delete")),
+			cb.Raw().After("gorm:raw").Register(prefix+"_after_raw", after("raw")),
+		)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to register %s callbacks: %w", prefix, err)
+	}
+	return nil
+}
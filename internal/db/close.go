@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DefaultCloseTimeout is the time CloseAll is given during server shutdown
+// to wait for connections in use.
+const DefaultCloseTimeout = 10 * time.Second
+
+const closePollInterval = 50 * time.Millisecond
+
+// ErrClosing is returned for queries started after Close was called.
+var ErrClosing = errors.New("database is being closed")
+
+// rejectWhenClosing registers callbacks failing queries started outside of
+// a transaction once Close is called for the pool. Queries inside a
+// transaction are allowed so that it can be completed.
+func rejectWhenClosing(gdb *gorm.DB, st *poolState) error {
+	return registerCallbacks(gdb, "madmail:closing", func(db *gorm.DB) {
+		if !st.closing.Load() {
+			return
+		}
+		// Create, update and delete are wrapped into a transaction by GORM
+		// itself, it is not a transaction in progress.
+		_, inTx := db.Statement.ConnPool.(gorm.TxCommitter)
+		if _, implicit := db.InstanceGet("gorm:started_transaction"); !inTx || implicit {
+			db.AddError(ErrClosing)
+		}
+	}, nil)
+}
+
+// Close shuts down the connection pool of gdb, including replica pools.
+//
+// New queries outside of transactions fail with ErrClosing, then Close waits
+// until all connections in use are returned to the pool or ctx is done and
+// closes the pool. Connections still in use when ctx is done are abandoned:
+// they are closed when returned and in-progress transactions are rolled
+// back by the server.
+func Close(ctx context.Context, gdb *gorm.DB) error {
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		return err
+	}
+	return closePool(ctx, sqlDB)
+}
+
+// CloseAll closes all connection pools opened using NewWithContext that
+// were not closed yet, see Close. Pools are closed in parallel.
+func CloseAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	poolStates.Range(func(key, value interface{}) bool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sqlDB, st := key.(*sql.DB), value.(*poolState)
+			if err := closePool(ctx, sqlDB); err != nil {
+				st.log.Error("failed to close database", err)
+			}
+		}()
+		return true
+	})
+	wg.Wait()
+}
+
+// isClosing reports whether Close was called for the pool.
+func isClosing(sqlDB *sql.DB) bool {
+	st, ok := poolStates.Load(sqlDB)
+	return ok && st.(*poolState).closing.Load()
+}
+
+func closePool(ctx context.Context, sqlDB *sql.DB) error {
+	st := stateFor(sqlDB)
+	if st.closing.Swap(true) {
+		// Already closed or being closed.
+		return nil
+	}
+	defer poolStates.Delete(sqlDB)
+	if st.maintenance != nil {
+		st.maintenance.close()
+	}
+
+	pools := append([]*sql.DB{sqlDB}, st.replicas...)
+	inUse := func() int {
+		n := 0
+		for _, p := range pools {
+			n += p.Stats().InUse
+		}
+		return n
+	}
+
+	ticker := time.NewTicker(closePollInterval)
+	defer ticker.Stop()
+wait:
+	for inUse() != 0 {
+		select {
+		case <-ctx.Done():
+			break wait
+		case <-ticker.C:
+		}
+	}
+	if n := inUse(); n != 0 {
+		st.log.Msg("abandoning database connections still in use", "in_use", n)
+	}
+
+	var errs []error
+	for _, p := range pools {
+		errs = append(errs, p.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,109 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/gorm"
+)
+
+func openCloseTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+		Log: testutils.Logger(t, "db"),
+		// Allow a query outside of the transaction below.
+		MaxOpenConns: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gdb
+}
+
+func TestClose_Drain(t *testing.T) {
+	gdb := openCloseTestDB(t)
+	if err := gdb.AutoMigrate(&driverTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := gdb.Begin()
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- Close(context.Background(), gdb)
+	}()
+
+	// Wait for Close to start draining.
+	sqlDB, _ := gdb.DB()
+	for !isClosing(sqlDB) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := gdb.Create(&driverTestRecord{Name: "new"}).Error; !errors.Is(err, ErrClosing) {
+		t.Errorf("expected ErrClosing for a new query, got %v", err)
+	}
+	if _, err := WithTx(context.Background(), gdb, func(*gorm.DB) error { return nil }, TxOptions{}); !errors.Is(err, ErrClosing) {
+		t.Errorf("expected ErrClosing for a new transaction, got %v", err)
+	}
+
+	select {
+	case err := <-closed:
+		t.Fatal("Close returned while the connection was in use:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The transaction in progress can be completed.
+	if err := tx.Create(&driverTestRecord{Name: "in-tx"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return after the connection was released")
+	}
+	if err := sqlDB.Ping(); err == nil {
+		t.Error("pool is not closed")
+	}
+}
+
+func TestClose_Deadline(t *testing.T) {
+	gdb := openCloseTestDB(t)
+
+	tx := gdb.Begin()
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	defer tx.Rollback()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := Close(ctx, gdb); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("Close returned before the deadline")
+	}
+
+	sqlDB, _ := gdb.DB()
+	if err := sqlDB.Ping(); err == nil {
+		t.Error("pool is not closed after the deadline")
+	}
+}
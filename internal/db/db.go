@@ -1,35 +1,509 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
-	"strings"
+	"time"
 
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/log"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
+	"gorm.io/driver/sqlserver"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 )
 
+// Connection pool defaults used when the corresponding Options field is
+// zero (see also DefaultSQLiteMaxOpenConns). They keep a busy server from
+// holding hundreds of idle connections open while still allowing enough
+// parallelism for SMTP and IMAP sessions.
+const (
+	DefaultMaxOpenConns    = 25
+	DefaultMaxIdleConns    = 5
+	DefaultConnMaxLifetime = 30 * time.Minute
+	DefaultConnMaxIdleTime = 5 * time.Minute
+)
+
+// Defaults for the connect_attempts and connect_timeout directives. Zero
+// values in Options mean a single attempt without retries.
+const (
+	DefaultConnectAttempts   = 5
+	DefaultConnectMaxElapsed = 30 * time.Second
+)
+
+// DefaultPingTimeout is the default value of the ping_timeout directive.
+const DefaultPingTimeout = 10 * time.Second
+
+// prepareStmtCacheSize limits the number of statements cached per pool if
+// Options.PrepareStmt is set. Queries with IN lists of different lengths
+// are different statements, so the cache would grow without bound.
+const prepareStmtCacheSize = 512
+
+const (
+	initialConnectBackoff = 500 * time.Millisecond
+	maxConnectBackoff     = 10 * time.Second
+)
+
+// Options controls how New opens the database and configures the
+// underlying *sql.DB connection pool.
+//
+// Zero values of the pool fields select the Default* constants. Negative
+// values are passed to database/sql as is, so e.g. MaxOpenConns -1 removes
+// the limit and MaxIdleConns -1 disables idle connection retention.
+type Options struct {
+	// Log receives query logs (see QueryLogger) and connection retry
+	// messages.
+	Log log.Logger
+	// SlowQueryThreshold is the duration after which a query is logged as
+	// slow even if debug logging is disabled. Zero selects
+	// DefaultSlowQueryThreshold, negative values disable slow query logging.
+	SlowQueryThreshold time.Duration
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// ConnectAttempts is the maximum number of attempts NewWithContext makes
+	// to open and ping the database. Values below 2 disable retries.
+	ConnectAttempts int
+	// ConnectMaxElapsed bounds the total time spent retrying. Zero means no
+	// bound other than ConnectAttempts and the context deadline.
+	ConnectMaxElapsed time.Duration
+	// PingTimeout bounds each attempt to ping the database. A database that
+	// does not respond in time is retried the same way as a refused
+	// connection. Zero selects DefaultPingTimeout, negative values disable
+	// the timeout.
+	PingTimeout time.Duration
+
+	// ManualMigrations makes Migrate verify that all migrations are already
+	// applied instead of applying them, see CheckSchema.
+	ManualMigrations bool
+
+	// PrepareStmt caches prepared statements for all queries, so they are
+	// parsed by the server only once per connection. It does not work with
+	// connection poolers that do not keep server connections assigned to
+	// clients, such as pgbouncer in transaction mode.
+	PrepareStmt bool
+	// SkipDefaultTransaction disables the transaction GORM wraps every
+	// create, update and delete in. Writes consisting of several
+	// statements, e.g. of associations, are then not atomic.
+	SkipDefaultTransaction bool
+	// CreateBatchSize splits creation of a slice of rows into multi-row
+	// INSERT statements of at most that many rows. Zero inserts all rows
+	// using a single statement.
+	CreateBatchSize int
+
+	// SQLite-specific settings, applied to every connection. Empty values
+	// select the DefaultSQLite* constants. SQLiteBusyTimeout is in
+	// milliseconds, -1 disables waiting for locks.
+	SQLiteJournalMode string
+	SQLiteSynchronous string
+	SQLiteForeignKeys string
+	SQLiteBusyTimeout int
+
+	// SQLiteMaintenanceInterval is how often the WAL of a SQLite database
+	// is checkpointed, free pages are released and ANALYZE is run. Zero
+	// disables maintenance. SQLiteMaintenanceWindow restricts it to a time
+	// of day. Databases are created with auto_vacuum=INCREMENTAL if
+	// maintenance is enabled.
+	SQLiteMaintenanceInterval time.Duration
+	SQLiteMaintenanceWindow   MaintenanceWindow
+
+	// TLS files used to connect to MySQL and PostgreSQL. For MySQL a TLS
+	// profile is registered and added to the DSN, for PostgreSQL the files
+	// are added as sslrootcert, sslcert and sslkey DSN parameters.
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// FailoverHosts are host[:port] addresses of servers tried in order
+	// after the hosts of the DSN if they are not available, e.g. a standby
+	// that is promoted when the primary fails. For PostgreSQL, hosts can
+	// also be listed in the DSN, e.g. "host=db1,db2". The host that was
+	// connected to last is tried first. Not supported for sqlite and
+	// sqlserver.
+	FailoverHosts []string
+	// TargetSessionAttrs is SessionAny (the default) or SessionReadWrite
+	// to skip servers that are in read-only mode, such as a standby.
+	TargetSessionAttrs string
+
+	// ReplicaDSNs lists read replicas of the primary database. Reads outside
+	// of transactions are distributed between them, falling back to the
+	// primary if no replica is reachable or a read fails with a connection
+	// error. Use dbresolver.Write for reads that must see the latest writes.
+	// Not supported for sqlite.
+	ReplicaDSNs [][]string
+
+	// Metrics, if set, collects query and connection pool metrics of the
+	// database. MetricsName is used as the "db" label value, Log.Name is
+	// used if it is empty.
+	Metrics     *Metrics
+	MetricsName string
+
+	// TracerProvider, if set, is used to create an OpenTelemetry span for
+	// every query. Spans are children of the context passed to
+	// gorm.DB.WithContext.
+	TracerProvider trace.TracerProvider
+
+	// TablePrefix is prepended to the names of all tables created for
+	// models, see TableName for tables referenced by name.
+	TablePrefix string
+
+	// BreakerThreshold is the number of consecutive connection errors after
+	// which queries fail with ErrCircuitOpen without contacting the
+	// database, until a background check every BreakerProbeInterval
+	// succeeds. Zero values select the DefaultBreaker* constants, negative
+	// BreakerThreshold disables the circuit breaker.
+	BreakerThreshold     int
+	BreakerProbeInterval time.Duration
+}
+
+// Provider is implemented by modules that store data in a database opened
+// using NewWithContext. It is used by management commands that operate on
+// the database of the module.
+type Provider interface {
+	GORM() *gorm.DB
+}
+
+// SameDatabase reports whether a and b were opened by NewWithContext for the
+// same database and table prefix, e.g. by modules configured with the same
+// dsn. It is used to avoid processing the tables of a shared database
+// several times.
+func SameDatabase(a, b *gorm.DB) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	sqlA, errA := a.DB()
+	sqlB, errB := b.DB()
+	if errA != nil || errB != nil {
+		return false
+	}
+	if sqlA == sqlB {
+		return true
+	}
+	stA, stB := stateFor(sqlA), stateFor(sqlB)
+	return stA.database != "" && stA.database == stB.database
+}
+
+// Directives registers database configuration directives on cfg, storing
+// the values into opts:
+//
+//	max_open_conns, max_idle_conns, conn_max_lifetime, conn_max_idle_time,
+//	connect_attempts, connect_timeout, ping_timeout, auto_migrate,
+//	prepared_statements, skip_default_transaction, create_batch_size,
+//	failover_hosts, target_session_attrs, slow_query_threshold, replica_dsn,
+//	metrics, tls_ca_file, tls_cert_file, tls_key_file, table_prefix,
+//	circuit_breaker_threshold, circuit_breaker_probe_interval,
+//	sqlite3_journal_mode, sqlite3_synchronous, sqlite3_busy_timeout,
+//	sqlite3_foreign_keys, sqlite3_maintenance_interval,
+//	sqlite3_maintenance_window
+func Directives(cfg *config.Map, opts *Options) {
+	// Zero selects the driver-specific default.
+	cfg.Int("max_open_conns", false, false, 0, &opts.MaxOpenConns)
+	cfg.Int("max_idle_conns", false, false, DefaultMaxIdleConns, &opts.MaxIdleConns)
+	cfg.Duration("conn_max_lifetime", false, false, DefaultConnMaxLifetime, &opts.ConnMaxLifetime)
+	cfg.Duration("conn_max_idle_time", false, false, DefaultConnMaxIdleTime, &opts.ConnMaxIdleTime)
+	cfg.Int("connect_attempts", false, false, DefaultConnectAttempts, &opts.ConnectAttempts)
+	cfg.Duration("connect_timeout", false, false, DefaultConnectMaxElapsed, &opts.ConnectMaxElapsed)
+	cfg.Duration("ping_timeout", false, false, DefaultPingTimeout, &opts.PingTimeout)
+	cfg.Custom("auto_migrate", false, false, func() (interface{}, error) {
+		return false, nil
+	}, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "expected exactly 1 argument")
+		}
+		enabled, err := config.ParseBool(node.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		return !enabled, nil
+	}, &opts.ManualMigrations)
+	cfg.Bool("prepared_statements", false, false, &opts.PrepareStmt)
+	cfg.Bool("skip_default_transaction", false, false, &opts.SkipDefaultTransaction)
+	cfg.Int("create_batch_size", false, false, 0, &opts.CreateBatchSize)
+	cfg.Duration("slow_query_threshold", false, false, DefaultSlowQueryThreshold, &opts.SlowQueryThreshold)
+	cfg.StringList("failover_hosts", false, false, nil, &opts.FailoverHosts)
+	cfg.Enum("target_session_attrs", false, false, []string{SessionAny, SessionReadWrite}, SessionAny, &opts.TargetSessionAttrs)
+	cfg.Callback("replica_dsn", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "expected at least 1 argument")
+		}
+		opts.ReplicaDSNs = append(opts.ReplicaDSNs, node.Args)
+		return nil
+	})
+	cfg.String("tls_ca_file", false, false, "", &opts.TLSCAFile)
+	cfg.String("tls_cert_file", false, false, "", &opts.TLSCertFile)
+	cfg.String("tls_key_file", false, false, "", &opts.TLSKeyFile)
+	cfg.String("table_prefix", false, false, "", &opts.TablePrefix)
+	cfg.Int("circuit_breaker_threshold", false, false, 0, &opts.BreakerThreshold)
+	cfg.Duration("circuit_breaker_probe_interval", false, false, 0, &opts.BreakerProbeInterval)
+	cfg.Custom("metrics", false, false, func() (interface{}, error) {
+		return (*Metrics)(nil), nil
+	}, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "expected exactly 1 argument")
+		}
+		enabled, err := config.ParseBool(node.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		if !enabled {
+			return (*Metrics)(nil), nil
+		}
+		m, err := DefaultMetrics()
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		return m, nil
+	}, &opts.Metrics)
+	sqliteDirectives(cfg, opts)
+}
+
+func (opts Options) withDefaults(driver string) Options {
+	if opts.MaxOpenConns == 0 {
+		opts.MaxOpenConns = DefaultMaxOpenConns
+		if isSQLite(driver) {
+			opts.MaxOpenConns = DefaultSQLiteMaxOpenConns
+		}
+	}
+	if opts.MaxIdleConns == 0 {
+		opts.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if opts.ConnMaxLifetime == 0 {
+		opts.ConnMaxLifetime = DefaultConnMaxLifetime
+	}
+	if opts.ConnMaxIdleTime == 0 {
+		opts.ConnMaxIdleTime = DefaultConnMaxIdleTime
+	}
+	if opts.SlowQueryThreshold == 0 {
+		opts.SlowQueryThreshold = DefaultSlowQueryThreshold
+	}
+	if opts.PingTimeout == 0 {
+		opts.PingTimeout = DefaultPingTimeout
+	}
+	if opts.SQLiteJournalMode == "" {
+		opts.SQLiteJournalMode = DefaultSQLiteJournalMode
+	}
+	if opts.SQLiteSynchronous == "" {
+		opts.SQLiteSynchronous = DefaultSQLiteSynchronous
+	}
+	if opts.SQLiteForeignKeys == "" {
+		opts.SQLiteForeignKeys = DefaultSQLiteForeignKeys
+	}
+	if opts.SQLiteBusyTimeout == 0 {
+		opts.SQLiteBusyTimeout = DefaultSQLiteBusyTimeout
+	}
+	return opts
+}
+
 // New initializes a GORM database connection based on the driver and DSN.
-func New(driver string, dsn []string, debug bool) (*gorm.DB, error) {
-	dsnStr := strings.Join(dsn, " ")
+//
+// It makes a single connection attempt, use NewWithContext to wait for a
+// database that is still starting up.
+func New(driver string, dsn []string, opts Options) (*gorm.DB, error) {
+	opts.ConnectAttempts = 1
+	opts.ConnectMaxElapsed = 0
+	return NewWithContext(context.Background(), driver, dsn, opts)
+}
 
-	var dialector gorm.Dialector
+// NewWithContext initializes a GORM database connection and verifies it
+// using Ping, unless SkipStartupCheck is set. Some drivers do not connect
+// until the first query, so without the check a wrong DSN is only noticed
+// when the database is used.
+//
+// Transient failures (connection refused, database starting up, etc.) are
+// retried with exponential backoff as configured by opts.ConnectAttempts
+// and opts.ConnectMaxElapsed until ctx is cancelled. Permanent failures,
+// such as an authentication error, are returned immediately.
+func NewWithContext(ctx context.Context, driver string, dsn []string, opts Options) (*gorm.DB, error) {
+	driver = NormalizeDriver(driver)
+	// Validate the driver name once, before any connection attempts.
+	if _, err := newDialector(driver, ""); err != nil {
+		return nil, err
+	}
+	if len(opts.ReplicaDSNs) != 0 && isSQLite(driver) {
+		return nil, fmt.Errorf("replica_dsn is not supported for the %s driver", driver)
+	}
+	if err := validateTablePrefix(opts.TablePrefix); err != nil {
+		return nil, err
+	}
+
+	var db *gorm.DB
+	err := retryConnect(ctx, driver, opts, "database is not available, retrying", func() error {
+		// Secrets are resolved again on each attempt so that rotated
+		// credentials are picked up.
+		dsnStr, err := BuildDSN(driver, dsn)
+		if err != nil {
+			return permanentError{err}
+		}
+		if err := validateDSN(driver, dsnStr); err != nil {
+			return permanentError{err}
+		}
+		dsnStr, err = ConfigureTLS(driver, dsnStr, opts)
+		if err != nil {
+			return permanentError{err}
+		}
+		db, err = open(ctx, driver, dsnStr, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// permanentError and retryableError wrap errors that retryConnect should
+// return immediately or retry, regardless of their type.
+type (
+	permanentError struct{ error }
+	retryableError struct{ error }
+)
+
+func (e permanentError) Unwrap() error { return e.error }
+func (e retryableError) Unwrap() error { return e.error }
+
+// RetryConnect calls fn until it succeeds, retrying transient connection
+// errors the same way NewWithContext does. It is used for databases opened
+// by other libraries, such as go-imap-sql.
+func RetryConnect(ctx context.Context, driver string, opts Options, fn func() error) error {
+	return retryConnect(ctx, NormalizeDriver(driver), opts, "database is not available, retrying", fn)
+}
+
+// EffectivePingTimeout returns the ping timeout used for opts, zero if the
+// timeout is disabled.
+func (opts Options) EffectivePingTimeout() time.Duration {
+	switch {
+	case opts.PingTimeout == 0:
+		return DefaultPingTimeout
+	case opts.PingTimeout < 0:
+		return 0
+	}
+	return opts.PingTimeout
+}
+
+// retryConnect calls fn until it succeeds, retrying transient errors (see
+// isTransientConnectError) with exponential backoff as configured by
+// opts.ConnectAttempts and opts.ConnectMaxElapsed until ctx is cancelled.
+// msg is logged before each retry.
+func retryConnect(ctx context.Context, driver string, opts Options, msg string, fn func() error) error {
+	var deadline time.Time
+	if opts.ConnectMaxElapsed > 0 {
+		deadline = time.Now().Add(opts.ConnectMaxElapsed)
+	}
+
+	backoff := initialConnectBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		var (
+			perm  permanentError
+			retry retryableError
+		)
+		if errors.As(err, &perm) {
+			return perm.error
+		}
+		if errors.As(err, &retry) {
+			err = retry.error
+		} else if !isTransientConnectError(err) {
+			return err
+		}
+
+		if attempt >= opts.ConnectAttempts {
+			return err
+		}
+		if !deadline.IsZero() && time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("%w (giving up after %d attempts)", err, attempt)
+		}
+
+		opts.Log.Msg(msg, "driver", driver,
+			"attempt", attempt, "retry_in", backoff, "reason", err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+func newDialector(driver, dsnStr string) (gorm.Dialector, error) {
 	switch driver {
 	case "sqlite3", "sqlite":
-		dialector = sqlite.Open(dsnStr)
+		return sqlite.Open(dsnStr), nil
 	case "postgres":
-		dialector = postgres.Open(dsnStr)
+		return postgres.Open(dsnStr), nil
 	case "mysql":
-		dialector = mysql.Open(dsnStr)
+		return mysql.Open(dsnStr), nil
+	case "sqlserver", "mssql":
+		return sqlserver.Open(dsnStr), nil
 	default:
-		return nil, fmt.Errorf("unsupported database driver: %s", driver)
+		return nil, unsupportedDriverError(driver)
+	}
+}
+
+// ConfigurePool applies the connection pool settings of opts to sqlDB. It is
+// used for pools opened by other libraries, such as go-imap-sql, so that
+// they follow the same max_open_conns and related directives.
+func ConfigurePool(sqlDB *sql.DB, driver string, opts Options) {
+	configurePool(sqlDB, opts.withDefaults(NormalizeDriver(driver)))
+}
+
+func configurePool(sqlDB *sql.DB, opts Options) {
+	sqlDB.SetMaxOpenConns(opts.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(opts.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+}
+
+func open(ctx context.Context, driver, dsnStr string, opts Options) (*gorm.DB, error) {
+	opts = opts.withDefaults(driver)
+
+	database := dsnStr
+	if isSQLite(driver) {
+		dsnStr = addSQLiteParams(dsnStr, opts)
+	}
+	failover, err := newFailoverConnector(driver, dsnStr, opts)
+	if err != nil {
+		return nil, err
+	}
+	var dialector gorm.Dialector
+	if failover != nil {
+		dialector = newFailoverDialector(driver, failover)
+	} else {
+		dialector, err = newDialector(driver, dsnStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	slowThreshold := opts.SlowQueryThreshold
+	if slowThreshold < 0 {
+		slowThreshold = 0
 	}
+	gormCfg := &gorm.Config{
+		Logger: NewQueryLogger(opts.Log, slowThreshold),
+		// Ping is done below using the context.
+		DisableAutomaticPing: true,
+		NamingStrategy:       namingStrategy(opts),
 
-	gormCfg := &gorm.Config{}
-	if !debug {
-		gormCfg.Logger = logger.Default.LogMode(logger.Silent)
+		PrepareStmt:            opts.PrepareStmt,
+		PrepareStmtMaxSize:     prepareStmtCacheSize,
+		SkipDefaultTransaction: opts.SkipDefaultTransaction,
+		CreateBatchSize:        opts.CreateBatchSize,
 	}
 
 	db, err := gorm.Open(dialector, gormCfg)
@@ -37,5 +511,74 @@ func New(driver string, dsn []string, debug bool) (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to access connection pool: %w", err)
+	}
+
+	configurePool(sqlDB, opts)
+
+	if !SkipStartupCheck {
+		if err := pingWithTimeout(ctx, sqlDB, opts.PingTimeout); err != nil {
+			sqlDB.Close()
+			return nil, fmt.Errorf("failed to connect to database: %w", err)
+		}
+		markConnected(sqlDB)
+	}
+	st := stateFor(sqlDB)
+	// fail closes the pool and drops its state so CloseAll does not see it.
+	fail := func(err error) (*gorm.DB, error) {
+		sqlDB.Close()
+		poolStates.Delete(sqlDB)
+		return nil, err
+	}
+	st.connectOpts = opts
+	st.failover = failover
+	st.log = opts.Log
+	st.database = driver + " " + database + " " + opts.TablePrefix
+	st.breaker = newBreaker(opts)
+	if err := rejectWhenClosing(db, st); err != nil {
+		return fail(err)
+	}
+	if err := useBreaker(db, sqlDB, st); err != nil {
+		return fail(err)
+	}
+
+	if len(opts.ReplicaDSNs) != 0 {
+		if err := useReplicas(db, sqlDB, driver, opts.ReplicaDSNs, opts); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := useTracing(db, opts.TracerProvider); err != nil {
+		return fail(err)
+	}
+
+	metricsName := opts.MetricsName
+	if metricsName == "" {
+		metricsName = opts.Log.Name
+	}
+	if opts.Metrics != nil {
+		if err := opts.Metrics.Instrument(db, metricsName); err != nil {
+			return fail(err)
+		}
+	}
+	if st.breaker != nil {
+		// The breaker state is exported even without 'metrics yes' so that
+		// database outages can be alerted on.
+		m := opts.Metrics
+		if m == nil {
+			m, err = DefaultMetrics()
+			if err != nil {
+				return fail(err)
+			}
+		}
+		m.pools.addBreaker(metricsName, st.breaker)
+	}
+
+	if isSQLite(driver) {
+		st.maintenance = startSQLiteMaintenance(sqlDB, opts)
+	}
+
 	return db, nil
 }
@@ -0,0 +1,140 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func TestNew_PoolOptions(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sqlDB, err := gdb.DB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sqlDB.Close()
+
+		if got := sqlDB.Stats().MaxOpenConnections; got != DefaultSQLiteMaxOpenConns {
+			t.Errorf("MaxOpenConnections = %d, want %d", got, DefaultSQLiteMaxOpenConns)
+		}
+	})
+	t.Run("custom", func(t *testing.T) {
+		gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+			MaxOpenConns: 3,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sqlDB, err := gdb.DB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sqlDB.Close()
+
+		if got := sqlDB.Stats().MaxOpenConnections; got != 3 {
+			t.Errorf("MaxOpenConnections = %d, want 3", got)
+		}
+	})
+	t.Run("unlimited", func(t *testing.T) {
+		gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+			MaxOpenConns: -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sqlDB, err := gdb.DB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sqlDB.Close()
+
+		if got := sqlDB.Stats().MaxOpenConnections; got != 0 {
+			t.Errorf("MaxOpenConnections = %d, want 0 (unlimited)", got)
+		}
+	})
+}
+
+func TestNew_UnsupportedDriver(t *testing.T) {
+	_, err := New("oracle", []string{"whatever"}, Options{})
+	if err == nil {
+		t.Fatal("expected an error for unsupported driver")
+	}
+}
+
+func TestNewWithContext_PermanentErrorNotRetried(t *testing.T) {
+	// Pointing SQLite at a directory fails on ping with a non-transient error.
+	dir := testutils.Dir(t)
+	start := time.Now()
+	_, err := NewWithContext(context.Background(), "sqlite3", []string{dir}, Options{
+		ConnectAttempts:   5,
+		ConnectMaxElapsed: time.Minute,
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > initialConnectBackoff {
+		t.Errorf("permanent error was retried (took %v)", elapsed)
+	}
+}
+
+func TestNewWithContext_SkipStartupCheck(t *testing.T) {
+	// Nothing listens on port 1, the PostgreSQL driver does not connect
+	// until the first query.
+	dsn := []string{"host=127.0.0.1 port=1 user=maddy dbname=maddy sslmode=disable"}
+	if _, err := New("postgres", dsn, Options{}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	SkipStartupCheck = true
+	defer func() { SkipStartupCheck = false }()
+	gdb, err := New("postgres", dsn, Options{})
+	if err != nil {
+		t.Fatal("unexpected error with SkipStartupCheck:", err)
+	}
+	defer Close(context.Background(), gdb)
+	if err := Ping(context.Background(), gdb); err == nil {
+		t.Error("expected Ping to fail")
+	}
+}
+
+func TestNewWithContext_PingTimeout(t *testing.T) {
+	// The server accepts connections but never responds.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	start := time.Now()
+	_, err = New("postgres", []string{fmt.Sprintf("host=127.0.0.1 port=%d user=maddy dbname=maddy sslmode=disable", port)}, Options{
+		PingTimeout: 200 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ping timeout is not applied (took %v)", elapsed)
+	}
+}
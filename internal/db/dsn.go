@@ -0,0 +1,246 @@
+package db
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/themadorg/madmail/framework/config"
+)
+
+// DSN is the value of the dsn directive, see DSNDirective.
+//
+// Either Args or Params is set. Args are the directive arguments in the
+// driver-specific DSN format, Params are connection parameters from the
+// block form that are rendered into the driver format by Parts.
+type DSN struct {
+	Args   []string
+	Params map[string]string
+}
+
+// Empty reports whether the DSN was not specified.
+func (d DSN) Empty() bool {
+	return len(d.Args) == 0 && len(d.Params) == 0
+}
+
+// Parts returns the DSN as the list of arguments accepted by BuildDSN and
+// NewWithContext.
+func (d DSN) Parts(driver string) ([]string, error) {
+	if len(d.Params) == 0 {
+		return d.Args, nil
+	}
+	params, err := resolveParamSecrets(driver, d.Params)
+	if err != nil {
+		return nil, err
+	}
+	dsn, err := FormatDSN(driver, params)
+	if err != nil {
+		return nil, err
+	}
+	return []string{dsn}, nil
+}
+
+// DSNDirective registers the directive that specifies the database to
+// connect to. It accepts either the DSN in the driver-specific format:
+//
+//	dsn "host=localhost user=maddy dbname=maddy"
+//
+// or a block with connection parameters, which is converted into the
+// correct DSN format for the driver with all values escaped as necessary:
+//
+//	dsn {
+//	    host localhost
+//	    user maddy
+//	    password "it's a secret"
+//	    dbname maddy
+//	}
+//
+// See FormatDSN for the list of recognized parameters.
+func DSNDirective(cfg *config.Map, name string, required bool, defaultArgs []string, store *DSN) {
+	cfg.Custom(name, false, required, func() (interface{}, error) {
+		return DSN{Args: defaultArgs}, nil
+	}, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Children) == 0 {
+			if len(node.Args) == 0 {
+				return nil, config.NodeErr(node, "expected at least 1 argument")
+			}
+			return DSN{Args: node.Args}, nil
+		}
+
+		if len(node.Args) != 0 {
+			return nil, config.NodeErr(node, "expected either arguments or a block, not both")
+		}
+		params := make(map[string]string, len(node.Children))
+		for _, child := range node.Children {
+			if len(child.Args) != 1 || len(child.Children) != 0 {
+				return nil, config.NodeErr(child, "expected exactly 1 argument")
+			}
+			if _, ok := params[child.Name]; ok {
+				return nil, config.NodeErr(child, "duplicate parameter: %s", child.Name)
+			}
+			params[child.Name] = child.Args[0]
+		}
+		return DSN{Params: params}, nil
+	}, store)
+}
+
+// BuildDSN converts the dsn directive arguments into the DSN string passed
+// to the driver.
+//
+// env:NAME and file:PATH arguments are replaced with the value of the
+// environment variable or the file contents. For PostgreSQL, a key=value
+// argument may use a reference as the value, e.g. password=env:DB_PASSWORD.
+// file: is not recognized for SQLite since it is used by URI filenames.
+//
+// Only PostgreSQL keyword/value DSNs (joined with spaces) and ADO-style SQL
+// Server connection strings (joined with semicolons) may be split into
+// multiple arguments. MySQL and SQLite DSNs are opaque strings and must be
+// specified as a single argument, so that a path containing a space or a
+// DSN that was accidentally split is not silently changed.
+func BuildDSN(driver string, dsn []string) (string, error) {
+	driver = NormalizeDriver(driver)
+	if len(dsn) == 0 {
+		return "", fmt.Errorf("%s: dsn is empty", driver)
+	}
+	dsn, err := resolveDSNSecrets(driver, dsn)
+	if err != nil {
+		return "", err
+	}
+
+	switch driver {
+	case "postgres":
+		return strings.Join(dsn, " "), nil
+	case "sqlserver", "mssql":
+		// A single argument (e.g. a sqlserver:// URL) is used as is.
+		return strings.Join(dsn, ";"), nil
+	default:
+		if len(dsn) != 1 {
+			return "", fmt.Errorf("%s: dsn must be a single argument, got %d (quote it if it contains spaces)", driver, len(dsn))
+		}
+		return dsn[0], nil
+	}
+}
+
+// sortedQuery encodes params as URL query in the key order so the result is
+// deterministic.
+func sortedQuery(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		if b.Len() != 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(url.QueryEscape(k))
+		b.WriteByte('=')
+		b.WriteString(url.QueryEscape(params[k]))
+	}
+	return b.String()
+}
+
+// FormatDSN renders connection parameters into the DSN format of the
+// driver.
+//
+// Recognized parameters are:
+//
+//   - host, port, user, password, dbname for postgres, mysql and sqlserver.
+//     host starting with a slash is a Unix socket path.
+//   - path for sqlite3.
+//
+// All other parameters are passed to the driver as DSN options (e.g.
+// sslmode for postgres, parseTime for mysql, _busy_timeout for sqlite3).
+//
+// Values are used as is, DSN.Parts resolves env: and file: references
+// before calling FormatDSN.
+func FormatDSN(driver string, params map[string]string) (string, error) {
+	driver = NormalizeDriver(driver)
+	rest := make(map[string]string, len(params))
+	for k, v := range params {
+		rest[k] = v
+	}
+	take := func(key string) string {
+		v := rest[key]
+		delete(rest, key)
+		return v
+	}
+
+	switch driver {
+	case "postgres":
+		host, port, user, password, dbname := take("host"), take("port"), take("user"), take("password"), take("dbname")
+		u := url.URL{Scheme: "postgres", Path: "/" + dbname}
+		if strings.HasPrefix(host, "/") {
+			rest["host"] = host
+			if port != "" {
+				rest["port"] = port
+			}
+		} else if port != "" {
+			u.Host = net.JoinHostPort(host, port)
+		} else {
+			u.Host = host
+		}
+		if user != "" {
+			u.User = url.UserPassword(user, password)
+		} else if password != "" {
+			rest["password"] = password
+		}
+		u.RawQuery = sortedQuery(rest)
+		return u.String(), nil
+	case "mysql":
+		cfg := mysql.NewConfig()
+		cfg.User = take("user")
+		cfg.Passwd = take("password")
+		cfg.DBName = take("dbname")
+		host, port := take("host"), take("port")
+		if strings.HasPrefix(host, "/") {
+			cfg.Net = "unix"
+			cfg.Addr = host
+		} else if host != "" || port != "" {
+			if host == "" {
+				host = "127.0.0.1"
+			}
+			if port == "" {
+				port = "3306"
+			}
+			cfg.Net = "tcp"
+			cfg.Addr = net.JoinHostPort(host, port)
+		}
+		if len(rest) != 0 {
+			cfg.Params = rest
+		}
+		return cfg.FormatDSN(), nil
+	case "sqlserver", "mssql":
+		host, port, user, password, dbname := take("host"), take("port"), take("user"), take("password"), take("dbname")
+		u := url.URL{Scheme: "sqlserver", Host: host}
+		if port != "" {
+			u.Host = net.JoinHostPort(host, port)
+		}
+		if user != "" {
+			u.User = url.UserPassword(user, password)
+		}
+		if dbname != "" {
+			rest["database"] = dbname
+		}
+		u.RawQuery = sortedQuery(rest)
+		return u.String(), nil
+	case "sqlite3", "sqlite":
+		path := take("path")
+		if path == "" {
+			return "", fmt.Errorf("%s: path parameter is required", driver)
+		}
+		// Characters that have a special meaning in SQLite URI filenames.
+		path = strings.NewReplacer("%", "%25", "?", "%3F", "#", "%23").Replace(path)
+		if len(rest) == 0 {
+			return "file:" + path, nil
+		}
+		return "file:" + path + "?" + sortedQuery(rest), nil
+	default:
+		return "", unsupportedDriverError(driver)
+	}
+}
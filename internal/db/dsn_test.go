@@ -0,0 +1,167 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/themadorg/madmail/framework/config"
+)
+
+func TestBuildDSN(t *testing.T) {
+	for _, c := range []struct {
+		driver string
+		dsn    []string
+		want   string
+		errStr string
+	}{
+		{driver: "sqlite3", dsn: []string{"/var/lib/maddy/my data/imapsql.db"}, want: "/var/lib/maddy/my data/imapsql.db"},
+		{driver: "sqlite3", dsn: []string{"/var/lib/maddy/my", "data.db"}, errStr: "sqlite3: dsn must be a single argument"},
+		{driver: "mysql", dsn: []string{"maddy:pass@tcp(db:3306)/maddy?parseTime=true&charset=utf8mb4"}, want: "maddy:pass@tcp(db:3306)/maddy?parseTime=true&charset=utf8mb4"},
+		{driver: "mysql", dsn: []string{"maddy:pass@tcp(db:3306)/maddy", "?parseTime=true"}, errStr: "mysql: dsn must be a single argument"},
+		{driver: "postgres", dsn: []string{"host=db", "user=maddy", "dbname=maddy"}, want: "host=db user=maddy dbname=maddy"},
+		{driver: "postgres", dsn: []string{"postgres://maddy@db/maddy"}, want: "postgres://maddy@db/maddy"},
+		{driver: "sqlserver", dsn: []string{"server=db", "user id=sa"}, want: "server=db;user id=sa"},
+		{driver: "postgres", dsn: nil, errStr: "postgres: dsn is empty"},
+	} {
+		got, err := BuildDSN(c.driver, c.dsn)
+		if c.errStr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.errStr) {
+				t.Errorf("BuildDSN(%s, %q): expected error %q, got %v", c.driver, c.dsn, c.errStr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("BuildDSN(%s, %q): unexpected error %v", c.driver, c.dsn, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("BuildDSN(%s, %q) = %q, want %q", c.driver, c.dsn, got, c.want)
+		}
+	}
+}
+
+func TestFormatDSN_Postgres(t *testing.T) {
+	dsn, err := FormatDSN("postgres", map[string]string{
+		"host":     "db.example.org",
+		"port":     "5433",
+		"user":     "maddy",
+		"password": `it's a "secret" @/?`,
+		"dbname":   "mail db",
+		"sslmode":  "verify-full",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("generated DSN %q is not valid: %v", dsn, err)
+	}
+	if cfg.Host != "db.example.org" || cfg.Port != 5433 || cfg.User != "maddy" ||
+		cfg.Password != `it's a "secret" @/?` || cfg.Database != "mail db" {
+		t.Errorf("DSN %q parsed into unexpected config: %+v", dsn, cfg)
+	}
+	if cfg.TLSConfig == nil {
+		t.Error("sslmode is not passed through")
+	}
+
+	dsn, err = FormatDSN("postgres", map[string]string{"host": "/run/postgresql", "dbname": "maddy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = pgconn.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("generated DSN %q is not valid: %v", dsn, err)
+	}
+	if cfg.Host != "/run/postgresql" || cfg.Database != "maddy" {
+		t.Errorf("DSN %q parsed into unexpected config: %+v", dsn, cfg)
+	}
+}
+
+func TestFormatDSN_MySQL(t *testing.T) {
+	dsn, err := FormatDSN("mysql", map[string]string{
+		"host":      "db",
+		"user":      "maddy",
+		"password":  "p@ss/word)",
+		"dbname":    "maddy",
+		"parseTime": "true",
+		"charset":   "utf8mb4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("generated DSN %q is not valid: %v", dsn, err)
+	}
+	if cfg.Net != "tcp" || cfg.Addr != "db:3306" || cfg.User != "maddy" || cfg.Passwd != "p@ss/word)" ||
+		cfg.DBName != "maddy" || !cfg.ParseTime {
+		t.Errorf("DSN %q parsed into unexpected config: %+v", dsn, cfg)
+	}
+	if cfg.Params["charset"] != "utf8mb4" {
+		t.Errorf("charset is not passed through: %v", cfg.Params)
+	}
+}
+
+func TestFormatDSN_SQLite(t *testing.T) {
+	dsn, err := FormatDSN("sqlite3", map[string]string{
+		"path":          "/var/lib/maddy/my data/100%?.db",
+		"_busy_timeout": "1000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "file:/var/lib/maddy/my data/100%25%3F.db?_busy_timeout=1000"; dsn != want {
+		t.Errorf("got %q, want %q", dsn, want)
+	}
+
+	if _, err := FormatDSN("sqlite3", map[string]string{"_busy_timeout": "1000"}); err == nil {
+		t.Error("expected an error for missing path")
+	}
+}
+
+func TestDSNDirective(t *testing.T) {
+	parse := func(node config.Node) (DSN, error) {
+		var dsn DSN
+		m := config.NewMap(nil, config.Node{Children: []config.Node{node}})
+		DSNDirective(m, "dsn", true, nil, &dsn)
+		_, err := m.Process()
+		return dsn, err
+	}
+
+	dsn, err := parse(config.Node{Name: "dsn", Args: []string{"host=db", "dbname=maddy"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dsn, DSN{Args: []string{"host=db", "dbname=maddy"}}) {
+		t.Errorf("unexpected DSN: %+v", dsn)
+	}
+
+	dsn, err = parse(config.Node{Name: "dsn", Children: []config.Node{
+		{Name: "path", Args: []string{"/tmp/with space.db"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := dsn.Parts("sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parts, []string{"file:/tmp/with space.db"}) {
+		t.Errorf("unexpected DSN parts: %q", parts)
+	}
+
+	for _, node := range []config.Node{
+		{Name: "dsn"},
+		{Name: "dsn", Args: []string{"a"}, Children: []config.Node{{Name: "path", Args: []string{"b"}}}},
+		{Name: "dsn", Children: []config.Node{{Name: "path"}}},
+		{Name: "dsn", Children: []config.Node{{Name: "path", Args: []string{"a"}}, {Name: "path", Args: []string{"b"}}}},
+	} {
+		if _, err := parse(node); err == nil {
+			t.Errorf("expected an error for %+v", node)
+		}
+	}
+}
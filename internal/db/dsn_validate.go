@@ -0,0 +1,428 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/themadorg/madmail/framework/config"
+)
+
+// driverAliases are the names commonly used for the supported drivers.
+var driverAliases = map[string]string{
+	"postgresql": "postgres",
+	"pgx":        "postgres",
+	"pg":         "postgres",
+	"mariadb":    "mysql",
+}
+
+// NormalizeDriver returns the driver name used by this package for the
+// commonly used alias, e.g. "postgres" for "postgresql", other names are
+// returned as is.
+func NormalizeDriver(driver string) string {
+	if name, ok := driverAliases[strings.ToLower(driver)]; ok {
+		return name
+	}
+	return driver
+}
+
+func unsupportedDriverError(driver string) error {
+	return fmt.Errorf("unsupported database driver: %s (supported: sqlite3, postgres, mysql, sqlserver)", driver)
+}
+
+// DriverDirective registers the directive that specifies the database
+// driver. Aliases are normalized using NormalizeDriver and unsupported
+// drivers are rejected when the configuration is parsed. Empty value is
+// allowed and means that no driver is configured.
+func DriverDirective(cfg *config.Map, name string, required bool, defaultValue string, store *string) {
+	cfg.Custom(name, false, required, func() (interface{}, error) {
+		return defaultValue, nil
+	}, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "expected exactly 1 argument")
+		}
+		driver := NormalizeDriver(node.Args[0])
+		if _, err := newDialector(driver, ""); err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		return driver, nil
+	}, store)
+}
+
+// validateDSN checks dsnStr (as returned by BuildDSN) for mistakes that
+// would otherwise be reported by the driver with a confusing error or not
+// be reported until the database is used. Returned errors never include
+// the password.
+func validateDSN(driver, dsnStr string) error {
+	switch driver {
+	case "sqlite3", "sqlite":
+		return validateSQLiteDSN(driver, dsnStr)
+	case "postgres":
+		return validatePostgresDSN(dsnStr)
+	case "mysql":
+		return validateMySQLDSN(dsnStr)
+	}
+	return nil
+}
+
+func validateSQLiteDSN(driver, dsnStr string) error {
+	path, rawQuery, _ := strings.Cut(dsnStr, "?")
+	if strings.HasPrefix(path, "file:") {
+		path = strings.TrimPrefix(path, "file:")
+		if unescaped, err := url.PathUnescape(path); err == nil {
+			path = unescaped
+		}
+	}
+	query, _ := url.ParseQuery(rawQuery)
+	if path == "" || strings.HasPrefix(path, ":memory:") || query.Get("mode") == "memory" {
+		return nil
+	}
+	readOnly := query.Get("mode") == "ro" || query.Get("immutable") == "1"
+
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && info.IsDir():
+		return fmt.Errorf("%s: %s is a directory, dsn should be the path of the database file (e.g. %s)",
+			driver, path, filepath.Join(path, "maddy.db"))
+	case err == nil:
+		if readOnly {
+			return nil
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("%s: database file %s is not writable: %v", driver, path, pathErrorReason(err))
+		}
+		f.Close()
+	case !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR):
+		return fmt.Errorf("%s: cannot access %s: %v", driver, path, pathErrorReason(err))
+	}
+
+	// SQLite creates the database file and its journal next to it.
+	dir := filepath.Dir(path)
+	info, err = os.Stat(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("%s: directory %s does not exist", driver, dir)
+	case err != nil:
+		return fmt.Errorf("%s: cannot access directory %s: %v", driver, dir, pathErrorReason(err))
+	case !info.IsDir():
+		return fmt.Errorf("%s: %s is not a directory", driver, dir)
+	}
+	if readOnly {
+		return nil
+	}
+	probe, err := os.CreateTemp(dir, ".maddy-write-check-*")
+	if err != nil {
+		return fmt.Errorf("%s: directory %s is not writable: %v", driver, dir, pathErrorReason(err))
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
+
+// pathErrorReason strips the operation and path from *os.PathError, they
+// are already included in the messages above.
+func pathErrorReason(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+// postgresParams are the connection parameters recognized by libpq and
+// pgx.
+var postgresParams = map[string]bool{
+	"host": true, "hostaddr": true, "port": true, "dbname": true, "user": true,
+	"password": true, "passfile": true, "channel_binding": true,
+	"connect_timeout": true, "client_encoding": true, "options": true,
+	"application_name": true, "fallback_application_name": true,
+	"keepalives": true, "keepalives_idle": true, "keepalives_interval": true,
+	"keepalives_count": true, "tcp_user_timeout": true, "replication": true,
+	"gssencmode": true, "sslmode": true, "requiressl": true,
+	"sslcompression": true, "sslcert": true, "sslkey": true,
+	"sslpassword": true, "sslrootcert": true, "sslcrl": true, "sslcrldir": true,
+	"sslsni": true, "sslnegotiation": true, "requirepeer": true,
+	"require_auth": true, "ssl_min_protocol_version": true,
+	"ssl_max_protocol_version": true, "krbsrvname": true, "gsslib": true,
+	"gssdelegation": true, "service": true, "servicefile": true,
+	"target_session_attrs": true, "load_balance_hosts": true,
+	"statement_cache_capacity": true, "description_cache_capacity": true,
+	"default_query_exec_mode": true, "min_read_buffer_size": true,
+}
+
+// postgresRuntimeParams are commonly used server settings. pgx sends
+// unrecognized parameters to the server as run-time settings, so they are
+// not rejected, but only reported if they look like a misspelled
+// connection parameter or one of these settings.
+var postgresRuntimeParams = []string{
+	"search_path", "timezone", "datestyle", "statement_timeout",
+	"lock_timeout", "idle_in_transaction_session_timeout",
+	"default_transaction_isolation", "work_mem",
+}
+
+// checkPostgresParam reports parameter names that are likely misspelled.
+func checkPostgresParam(key string) error {
+	if postgresParams[key] {
+		return nil
+	}
+	for _, known := range postgresRuntimeParams {
+		if strings.EqualFold(key, known) {
+			return nil
+		}
+	}
+	// Short names are more likely to be close to a known one by chance.
+	maxDist := 2
+	if len(key) < 5 {
+		maxDist = 1
+	}
+	best, bestDist := "", maxDist+1
+	for known := range postgresParams {
+		if d := editDistance(key, known); d < bestDist || (d == bestDist && known < best) {
+			best, bestDist = known, d
+		}
+	}
+	for _, known := range postgresRuntimeParams {
+		if d := editDistance(strings.ToLower(key), known); d < bestDist || (d == bestDist && known < best) {
+			best, bestDist = known, d
+		}
+	}
+	if best != "" {
+		return fmt.Errorf("postgres: unknown dsn parameter %q, did you mean %q?", key, best)
+	}
+	return nil
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func validatePostgresDSN(dsnStr string) error {
+	var params map[string]string
+	if strings.HasPrefix(dsnStr, "postgres://") || strings.HasPrefix(dsnStr, "postgresql://") {
+		u, err := url.Parse(dsnStr)
+		if err != nil {
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				// url.Error includes the URL with the password.
+				err = urlErr.Err
+			}
+			return fmt.Errorf("postgres: invalid dsn URL: %v", err)
+		}
+		query, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			return fmt.Errorf("postgres: invalid dsn URL: malformed query")
+		}
+		params = make(map[string]string, len(query)+2)
+		for k, v := range query {
+			params[k] = v[0]
+		}
+		if u.Host != "" {
+			params["host"] = u.Host
+		}
+		if dbname := strings.TrimPrefix(u.Path, "/"); dbname != "" {
+			params["dbname"] = dbname
+		}
+	} else {
+		var err error
+		params, err = parsePostgresKeywords(dsnStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	for key := range params {
+		if err := checkPostgresParam(key); err != nil {
+			return err
+		}
+	}
+	if params["host"] == "" && params["hostaddr"] == "" && params["service"] == "" {
+		return errors.New("postgres: dsn has no host, use host=localhost or the Unix socket directory, e.g. host=/run/postgresql")
+	}
+	if params["dbname"] == "" && params["service"] == "" {
+		return errors.New("postgres: dsn has no dbname")
+	}
+	return nil
+}
+
+// parsePostgresKeywords parses the keyword/value connection string, e.g.
+// "host=localhost dbname='my db'", using the libpq quoting rules.
+func parsePostgresKeywords(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+	i := 0
+	for {
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i == len(s) {
+			return params, nil
+		}
+
+		start := i
+		for i < len(s) && s[i] != '=' && !isSpace(s[i]) {
+			i++
+		}
+		key := s[start:i]
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i == len(s) || s[i] != '=' {
+			return nil, fmt.Errorf("postgres: invalid dsn: missing \"=\" after %q", key)
+		}
+		if key == "" {
+			return nil, errors.New("postgres: invalid dsn: missing parameter name before \"=\"")
+		}
+		i++
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+
+		var val strings.Builder
+		if i < len(s) && s[i] == '\'' {
+			i++
+			closed := false
+			for i < len(s) {
+				if s[i] == '\\' && i+1 < len(s) {
+					val.WriteByte(s[i+1])
+					i += 2
+					continue
+				}
+				if s[i] == '\'' {
+					closed = true
+					i++
+					break
+				}
+				val.WriteByte(s[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("postgres: invalid dsn: unterminated quoted value of %q", key)
+			}
+		} else {
+			for i < len(s) && !isSpace(s[i]) {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				val.WriteByte(s[i])
+				i++
+			}
+		}
+		if _, ok := params[key]; ok {
+			return nil, fmt.Errorf("postgres: invalid dsn: duplicate parameter %q", key)
+		}
+		params[key] = val.String()
+	}
+}
+
+func validateMySQLDSN(dsnStr string) error {
+	_, err := mysql.ParseDSN(dsnStr)
+	if err == nil {
+		return nil
+	}
+
+	// Locate the parts the same way as ParseDSN:
+	// [user[:password]@][net[(addr)]]/dbname[?param1=value1&paramN=valueN]
+	slash := strings.LastIndexByte(dsnStr, '/')
+	at := strings.LastIndexByte(dsnStr, '@')
+	if at > slash {
+		// Either there is no slash after the address or the password
+		// contains a slash, so everything up to the last @ may be a
+		// part of the password.
+		slash = -1
+		err = errors.New("missing the slash separating the database name")
+	} else if slash != -1 {
+		at = strings.LastIndexByte(dsnStr[:slash], '@')
+	}
+	passStart, passEnd := -1, -1
+	if at != -1 {
+		if colon := strings.IndexByte(dsnStr[:at], ':'); colon != -1 {
+			passStart, passEnd = colon+1, at
+		}
+	}
+
+	hlStart, hlEnd := -1, -1
+	if slash != -1 {
+		query := strings.IndexByte(dsnStr[slash:], '?')
+		if query != -1 {
+			query += slash
+		}
+		switch {
+		case query != -1 && mysqlParamError(dsnStr[query+1:], &hlStart, &hlEnd):
+			hlStart += query + 1
+			hlEnd += query + 1
+		case strings.HasPrefix(err.Error(), "invalid dbname"):
+			hlStart, hlEnd = slash+1, len(dsnStr)
+			if query != -1 {
+				hlEnd = query
+			}
+		default:
+			hlStart, hlEnd = at+1, slash
+		}
+	}
+
+	if hlStart == hlEnd {
+		hlStart, hlEnd = -1, -1
+	}
+	var b strings.Builder
+	for i := 0; i <= len(dsnStr); i++ {
+		if i == hlEnd {
+			b.WriteString("<<")
+		}
+		if i == hlStart {
+			b.WriteString(">>")
+		}
+		if i == len(dsnStr) {
+			break
+		}
+		if i == passStart {
+			b.WriteString("***")
+			i = passEnd - 1
+			continue
+		}
+		b.WriteByte(dsnStr[i])
+	}
+	// ParseDSN does not include the password in its errors, except for
+	// the dbname if the slash is in the password.
+	msg := strings.TrimPrefix(err.Error(), "invalid DSN: ")
+	if passStart != -1 && passEnd > passStart {
+		msg = strings.ReplaceAll(msg, dsnStr[passStart:passEnd], "***")
+	}
+	return fmt.Errorf("mysql: invalid dsn %q: %s", b.String(), msg)
+}
+
+// mysqlParamError finds the first parameter in the query part of the MySQL
+// DSN that ParseDSN rejects and stores its position to start and end.
+func mysqlParamError(query string, start, end *int) bool {
+	offset := 0
+	for _, param := range strings.Split(query, "&") {
+		if _, err := mysql.ParseDSN("/?" + param); err != nil {
+			*start, *end = offset, offset+len(param)
+			return true
+		}
+		offset += len(param) + 1
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/themadorg/madmail/framework/config"
+)
+
+func TestNormalizeDriver(t *testing.T) {
+	for in, want := range map[string]string{
+		"postgresql": "postgres",
+		"PostgreSQL": "postgres",
+		"pgx":        "postgres",
+		"mariadb":    "mysql",
+		"sqlite3":    "sqlite3",
+		"oracle":     "oracle",
+	} {
+		if got := NormalizeDriver(in); got != want {
+			t.Errorf("NormalizeDriver(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDriverDirective(t *testing.T) {
+	for _, c := range []struct {
+		args   []string
+		want   string
+		errStr string
+	}{
+		{args: []string{"postgresql"}, want: "postgres"},
+		{args: []string{"mariadb"}, want: "mysql"},
+		{args: nil, want: "sqlite3"},
+		{args: []string{"oracle"}, errStr: "unsupported database driver: oracle (supported: sqlite3, postgres, mysql, sqlserver)"},
+	} {
+		var nodes []config.Node
+		if c.args != nil {
+			nodes = []config.Node{{Name: "driver", Args: c.args}}
+		}
+		var driver string
+		m := config.NewMap(nil, config.Node{Children: nodes})
+		DriverDirective(m, "driver", false, "sqlite3", &driver)
+		_, err := m.Process()
+		if c.errStr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.errStr) {
+				t.Errorf("%v: expected error %q, got %v", c.args, c.errStr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if driver != c.want {
+			t.Errorf("%v: expected %q, got %q", c.args, c.want, driver)
+		}
+	}
+}
+
+func TestValidateDSN(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	const password = "s3cret"
+	for _, c := range []struct {
+		driver string
+		dsn    string
+		errStr string
+	}{
+		{"sqlite3", filepath.Join(dir, "maddy.db"), ""},
+		{"sqlite3", "file:" + filepath.Join(dir, "maddy.db") + "?_busy_timeout=5000", ""},
+		{"sqlite3", "file::memory:?cache=shared", ""},
+		{"sqlite3", "file:test.db?mode=memory&cache=shared", ""},
+		{"sqlite3", dir, "sqlite3: " + dir + " is a directory, dsn should be the path of the database file (e.g. " + filepath.Join(dir, "maddy.db") + ")"},
+		{"sqlite3", filepath.Join(dir, "missing", "maddy.db"), "sqlite3: directory " + filepath.Join(dir, "missing") + " does not exist"},
+		{"sqlite3", "file:" + filepath.Join(file, "maddy.db"), "sqlite3: " + file + " is not a directory"},
+
+		{"postgres", "host=localhost user=maddy password=" + password + " dbname=maddy sslmode=disable", ""},
+		{"postgres", "host = /run/postgresql dbname = 'my db' TimeZone=UTC search_path=maddy", ""},
+		{"postgres", "postgres://maddy:" + password + "@localhost/maddy?sslmode=disable", ""},
+		{"postgres", "postgres://maddy:" + password + "@/maddy?host=/run/postgresql", ""},
+		{"postgres", "host=localhost user=maddy password='" + password + " dbname=maddy", `postgres: invalid dsn: unterminated quoted value of "password"`},
+		{"postgres", "host=localhost user maddy", `postgres: invalid dsn: missing "=" after "user"`},
+		{"postgres", "host=localhost =maddy", `postgres: invalid dsn: missing parameter name before "="`},
+		{"postgres", "host=localhost dbname=a dbname=b", `postgres: invalid dsn: duplicate parameter "dbname"`},
+		{"postgres", "host=localhost user=maddy password=" + password + " dbnmae=maddy", `postgres: unknown dsn parameter "dbnmae", did you mean "dbname"?`},
+		{"postgres", "host=localhost dbname=maddy sslmod=disable", `postgres: unknown dsn parameter "sslmod", did you mean "sslmode"?`},
+		{"postgres", "host=localhost dbname=maddy timezon=UTC", `postgres: unknown dsn parameter "timezon", did you mean "timezone"?`},
+		{"postgres", "user=maddy password=" + password + " dbname=maddy", "postgres: dsn has no host, use host=localhost or the Unix socket directory, e.g. host=/run/postgresql"},
+		{"postgres", "host=localhost user=maddy password=" + password, "postgres: dsn has no dbname"},
+		{"postgres", "postgres://maddy:" + password + "@localhost:abc/maddy", `postgres: invalid dsn URL: invalid port ":abc" after host`},
+		{"postgres", "postgres://maddy:" + password + "@localhost/maddy?sslmdoe=disable", `postgres: unknown dsn parameter "sslmdoe", did you mean "sslmode"?`},
+		{"postgres", "postgresql://maddy:" + password + "@localhost", "postgres: dsn has no dbname"},
+
+		{"mysql", "maddy:" + password + "@tcp(localhost:3306)/maddy?parseTime=true", ""},
+		{"mysql", "maddy:" + password + "@tcp(localhost:3306/maddy", `mysql: invalid dsn "maddy:***@>>tcp(localhost:3306<</maddy": network address not terminated (missing closing brace)`},
+		{"mysql", "maddy:" + password + "@tcp(localhost:3306)/maddy?parseTime=maybe&charset=utf8mb4", `mysql: invalid dsn "maddy:***@tcp(localhost:3306)/maddy?>>parseTime=maybe<<&charset=utf8mb4": invalid bool value: maybe`},
+		{"mysql", "maddy:" + password + "@tcp(localhost:3306)/maddy?charset=utf8&tls=bogus", `mysql: invalid dsn "maddy:***@tcp(localhost:3306)/maddy?charset=utf8&>>tls=bogus<<": invalid value / unknown config name: bogus`},
+		{"mysql", "maddy:" + password + "@tcp(localhost:3306)/maddy?timeout=abc", `mysql: invalid dsn "maddy:***@tcp(localhost:3306)/maddy?>>timeout=abc<<": time: invalid duration "abc"`},
+		{"mysql", "maddy:" + password + "@tcp(localhost:3306)/ma%zzddy", `mysql: invalid dsn "maddy:***@tcp(localhost:3306)/>>ma%zzddy<<": invalid dbname "ma%zzddy": invalid URL escape "%zz"`},
+		{"mysql", "maddy:" + password + "@localhost", `mysql: invalid dsn "maddy:***@localhost": missing the slash separating the database name`},
+		{"mysql", "maddy:p@ss/" + password + "@localhost", `mysql: invalid dsn "maddy:***@localhost": missing the slash separating the database name`},
+	} {
+		err := validateDSN(c.driver, c.dsn)
+		if c.errStr == "" {
+			if err != nil {
+				t.Errorf("%s %q: unexpected error: %v", c.driver, c.dsn, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s %q: expected error %q", c.driver, c.dsn, c.errStr)
+			continue
+		}
+		if err.Error() != c.errStr {
+			t.Errorf("%s %q:\nexpected: %s\ngot:      %v", c.driver, c.dsn, c.errStr, err)
+		}
+		if strings.Contains(err.Error(), password) {
+			t.Errorf("%s %q: error includes the password: %v", c.driver, c.dsn, err)
+		}
+	}
+}
+
+func TestValidateDSN_SQLiteNotWritable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0o700)
+
+	want := "sqlite3: directory " + dir + " is not writable: permission denied"
+	if err := validateDSN("sqlite3", filepath.Join(dir, "maddy.db")); err == nil || err.Error() != want {
+		t.Errorf("expected %q, got %v", want, err)
+	}
+	if err := validateDSN("sqlite3", "file:"+filepath.Join(dir, "maddy.db")+"?mode=ro"); err != nil {
+		t.Errorf("unexpected error for a read-only database: %v", err)
+	}
+}
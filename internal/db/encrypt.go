@@ -0,0 +1,295 @@
+package db
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/themadorg/madmail/framework/config"
+	"gorm.io/gorm/schema"
+)
+
+// EncryptedSerializer is the name of the GORM serializer that encrypts
+// field values using AES-256-GCM. Models opt in using the field tag:
+//
+//	PrivateKey string `gorm:"serializer:encrypted"`
+//
+// Only string and []byte fields are supported. The stored value is
+// "v1:<key id>:<base64 nonce and ciphertext>", the key id identifies the
+// key used so that values written before the key was rotated can still be
+// decrypted, see SetEncryptionKeys and ReencryptAll.
+//
+// The ciphertext is different each time the value is written, so encrypted
+// columns cannot be used in WHERE conditions, unique indexes or joins.
+// Empty values are stored as is.
+const EncryptedSerializer = "encrypted"
+
+const (
+	encryptionKeySize = 32
+	encryptedPrefix   = "v1:"
+)
+
+var (
+	// ErrEncryptionKeyNotSet is returned when an encrypted field is read or
+	// written but no key is configured.
+	ErrEncryptionKeyNotSet = errors.New("encryption key is not configured")
+
+	// ErrUnknownEncryptionKey is returned when the value is encrypted using
+	// a key that is not configured, e.g. the previous key was removed from
+	// the configuration before ReencryptAll was run.
+	ErrUnknownEncryptionKey = errors.New("value is encrypted with an unknown key")
+
+	// ErrDecryptionFailed is returned when the stored value is not correctly
+	// encrypted or was modified.
+	ErrDecryptionFailed = errors.New("failed to decrypt value")
+)
+
+func init() {
+	schema.RegisterSerializer(EncryptedSerializer, encryptedSerializer{})
+}
+
+// keyring is the set of configured keys, the first one is used for
+// encryption.
+type keyring struct {
+	ids   []string
+	aeads map[string]cipher.AEAD
+}
+
+var defaultKeyring atomic.Pointer[keyring]
+
+func encryptionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func newKeyring(keys ...[]byte) (*keyring, error) {
+	if len(keys) == 0 {
+		return nil, ErrEncryptionKeyNotSet
+	}
+	kr := &keyring{aeads: make(map[string]cipher.AEAD, len(keys))}
+	for _, key := range keys {
+		if len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("db: encryption key must be %d bytes, got %d", encryptionKeySize, len(key))
+		}
+		id := encryptionKeyID(key)
+		if _, ok := kr.aeads[id]; ok {
+			continue
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.ids = append(kr.ids, id)
+		kr.aeads[id] = aead
+	}
+	return kr, nil
+}
+
+// SetEncryptionKeys sets the keys used by EncryptedSerializer. The first key
+// is used to encrypt new values, all keys are accepted for decryption.
+//
+// Keys must be 32 bytes long. Calling SetEncryptionKeys without arguments
+// removes all keys.
+func SetEncryptionKeys(keys ...[]byte) error {
+	if len(keys) == 0 {
+		defaultKeyring.Store(nil)
+		return nil
+	}
+	kr, err := newKeyring(keys...)
+	if err != nil {
+		return err
+	}
+	defaultKeyring.Store(kr)
+	return nil
+}
+
+// EncryptionKeysSet reports whether keys for EncryptedSerializer are
+// configured using SetEncryptionKeys.
+func EncryptionKeysSet() bool {
+	return defaultKeyring.Load() != nil
+}
+
+type keyringCtxKey struct{}
+
+// keyringFrom returns the keyring set for the query context by ReencryptAll
+// or the one set using SetEncryptionKeys.
+func keyringFrom(ctx context.Context) (*keyring, error) {
+	if kr, ok := ctx.Value(keyringCtxKey{}).(*keyring); ok {
+		return kr, nil
+	}
+	if kr := defaultKeyring.Load(); kr != nil {
+		return kr, nil
+	}
+	return nil, ErrEncryptionKeyNotSet
+}
+
+func (kr *keyring) encrypt(plaintext []byte) (string, error) {
+	id := kr.ids[0]
+	aead := kr.aeads[id]
+
+	buf := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	buf = aead.Seal(buf, buf, plaintext, nil)
+	return encryptedPrefix + id + ":" + base64.RawStdEncoding.EncodeToString(buf), nil
+}
+
+func (kr *keyring) decrypt(value string) ([]byte, error) {
+	rest, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported format", ErrDecryptionFailed)
+	}
+	id, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported format", ErrDecryptionFailed)
+	}
+	aead, ok := kr.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w (key id %s)", ErrUnknownEncryptionKey, id)
+	}
+	blob, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(blob) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: malformed ciphertext", ErrDecryptionFailed)
+	}
+	plaintext, err := aead.Open(nil, blob[:aead.NonceSize()], blob[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: authentication failed", ErrDecryptionFailed)
+	}
+	return plaintext, nil
+}
+
+type encryptedSerializer struct{}
+
+func (encryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var stored string
+	switch v := dbValue.(type) {
+	case nil:
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return fmt.Errorf("db: %s: unsupported database type %T for encrypted field", field.Name, dbValue)
+	}
+
+	var plaintext []byte
+	if stored != "" {
+		kr, err := keyringFrom(ctx)
+		if err != nil {
+			return fmt.Errorf("db: %s: %w", field.Name, err)
+		}
+		plaintext, err = kr.decrypt(stored)
+		if err != nil {
+			return fmt.Errorf("db: %s: %w", field.Name, err)
+		}
+	}
+
+	fieldValue := reflect.New(field.FieldType).Elem()
+	switch field.FieldType.Kind() {
+	case reflect.String:
+		fieldValue.SetString(string(plaintext))
+	case reflect.Slice:
+		if field.FieldType.Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("db: %s: encrypted field must be a string or []byte", field.Name)
+		}
+		fieldValue.SetBytes(plaintext)
+	default:
+		return fmt.Errorf("db: %s: encrypted field must be a string or []byte", field.Name)
+	}
+	field.ReflectValueOf(ctx, dst).Set(fieldValue)
+	return nil
+}
+
+func (encryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	var plaintext []byte
+	switch v := fieldValue.(type) {
+	case string:
+		plaintext = []byte(v)
+	case []byte:
+		plaintext = v
+	default:
+		return nil, fmt.Errorf("db: %s: encrypted field must be a string or []byte, got %T", field.Name, fieldValue)
+	}
+	if len(plaintext) == 0 {
+		return "", nil
+	}
+
+	kr, err := keyringFrom(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db: %s: %w", field.Name, err)
+	}
+	return kr.encrypt(plaintext)
+}
+
+// LoadEncryptionKey reads the 32-byte key referenced by env:NAME or
+// file:PATH. The file may contain the raw key, the environment variable and
+// the file may also contain it encoded using hex or base64.
+func LoadEncryptionKey(ref string) ([]byte, error) {
+	var blob []byte
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		blob = []byte(v)
+	case strings.HasPrefix(ref, "file:"):
+		var err error
+		blob, err = os.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key: %w", err)
+		}
+		if len(blob) == encryptionKeySize {
+			return blob, nil
+		}
+	default:
+		return nil, errors.New("encryption key must be specified as env:NAME or file:PATH")
+	}
+
+	encoded := strings.TrimSpace(string(blob))
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key must be %d bytes, raw or encoded using hex or base64", encryptionKeySize)
+}
+
+// EncryptionKeysDirective parses the db_encryption_key directive:
+//
+//	db_encryption_key file:/etc/maddy/db.key [env:OLD_KEY...]
+//
+// The first key is used for encryption, others are previous keys that are
+// only used to decrypt values not yet processed by ReencryptAll. The stored
+// value is [][]byte to be passed to SetEncryptionKeys.
+func EncryptionKeysDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "expected at least 1 argument")
+	}
+	keys := make([][]byte, 0, len(node.Args))
+	for _, ref := range node.Args {
+		key, err := LoadEncryptionKey(ref)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultReencryptBatchSize is the number of rows ReencryptAll processes in
+// a single transaction if batchSize is not positive.
+const DefaultReencryptBatchSize = 100
+
+// ReencryptAll rewrites encrypted fields (see EncryptedSerializer) of all
+// rows of the model using newKey. oldKeys are the keys that may have been
+// used for the existing values, keys set using SetEncryptionKeys are
+// also accepted.
+//
+// Rows are processed in primary key order, batchSize rows per transaction,
+// so the operation can be interrupted and restarted. The model must have a
+// single-column primary key. The number of rows processed is returned.
+//
+// ReencryptAll does not change the keys used by the process, call
+// SetEncryptionKeys with newKey as the first key after it succeeds.
+func ReencryptAll(ctx context.Context, gdb *gorm.DB, model interface{}, newKey []byte, oldKeys [][]byte, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultReencryptBatchSize
+	}
+
+	kr, err := newKeyring(append([][]byte{newKey}, oldKeys...)...)
+	if err != nil {
+		return 0, err
+	}
+	if current := defaultKeyring.Load(); current != nil {
+		for _, id := range current.ids {
+			if _, ok := kr.aeads[id]; !ok {
+				kr.ids = append(kr.ids, id)
+				kr.aeads[id] = current.aeads[id]
+			}
+		}
+	}
+	ctx = context.WithValue(ctx, keyringCtxKey{}, kr)
+
+	stmt := &gorm.Statement{DB: gdb}
+	if err := stmt.Parse(model); err != nil {
+		return 0, fmt.Errorf("db: reencrypt: %w", err)
+	}
+	sch := stmt.Schema
+	if len(sch.PrimaryFields) != 1 {
+		return 0, fmt.Errorf("db: reencrypt: %s: model must have a single-column primary key", sch.Table)
+	}
+	pk := sch.PrimaryFields[0]
+
+	var columns []string
+	for _, f := range sch.Fields {
+		if f.Serializer != nil && f.TagSettings["SERIALIZER"] == EncryptedSerializer {
+			columns = append(columns, f.DBName)
+		}
+	}
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("db: reencrypt: %s: model has no encrypted fields", sch.Table)
+	}
+
+	sliceType := reflect.SliceOf(reflect.PointerTo(sch.ModelType))
+	var (
+		total   int
+		lastKey interface{}
+	)
+	for {
+		var processed int
+		err := gdb.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			rows := reflect.New(sliceType)
+			q := tx.Model(model).Order(clause.OrderByColumn{Column: clause.Column{Name: pk.DBName}}).Limit(batchSize)
+			if lastKey != nil {
+				q = q.Where(clause.Gt{Column: clause.Column{Name: pk.DBName}, Value: lastKey})
+			}
+			if err := q.Find(rows.Interface()).Error; err != nil {
+				return err
+			}
+
+			rows = rows.Elem()
+			for i := 0; i < rows.Len(); i++ {
+				row := rows.Index(i).Interface()
+				if err := tx.Model(row).Select(columns).Updates(row).Error; err != nil {
+					return err
+				}
+			}
+			processed = rows.Len()
+			if processed != 0 {
+				key, _ := pk.ValueOf(ctx, rows.Index(processed-1).Elem())
+				lastKey = key
+			}
+			return nil
+		})
+		if err != nil {
+			if errors.Is(err, ErrUnknownEncryptionKey) {
+				return total, fmt.Errorf("db: reencrypt: %s: %w, add the key to oldKeys", sch.Table, err)
+			}
+			return total, fmt.Errorf("db: reencrypt: %s: %w", sch.Table, err)
+		}
+		total += processed
+		if processed < batchSize {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,177 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/themadorg/madmail/framework/config"
+)
+
+type encryptedTestRecord struct {
+	ID     int64
+	Name   string
+	Secret string `gorm:"serializer:encrypted"`
+	Blob   []byte `gorm:"serializer:encrypted"`
+}
+
+func testEncryptionKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, encryptionKeySize)
+}
+
+func setTestEncryptionKeys(t *testing.T, keys ...[]byte) {
+	t.Helper()
+	if err := SetEncryptionKeys(keys...); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetEncryptionKeys() })
+}
+
+func TestEncryptedSerializer(t *testing.T) {
+	gdb := openTestDB(t)
+	setTestEncryptionKeys(t, testEncryptionKey(1))
+
+	if err := gdb.Migrator().DropTable(&encryptedTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.AutoMigrate(&encryptedTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := encryptedTestRecord{Name: "dkim", Secret: "private key", Blob: []byte{0, 1, 2}}
+	if err := gdb.Create(&rec).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var stored string
+	if err := gdb.Raw("SELECT secret FROM encrypted_test_records WHERE id = ?", rec.ID).Scan(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, encryptedPrefix) || strings.Contains(stored, "private key") {
+		t.Fatalf("value is not encrypted: %q", stored)
+	}
+
+	var got encryptedTestRecord
+	if err := gdb.First(&got, rec.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got.Secret != "private key" || !bytes.Equal(got.Blob, []byte{0, 1, 2}) {
+		t.Errorf("unexpected decrypted values: %+v", got)
+	}
+
+	// Wrong key.
+	setTestEncryptionKeys(t, testEncryptionKey(2))
+	err := gdb.First(&got, rec.ID).Error
+	if !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Errorf("expected ErrUnknownEncryptionKey, got %v", err)
+	}
+
+	// Tampered value.
+	setTestEncryptionKeys(t, testEncryptionKey(1))
+	tampered := stored[:len(stored)-2] + "AA"
+	if tampered == stored {
+		tampered = stored[:len(stored)-2] + "BB"
+	}
+	if err := gdb.Exec("UPDATE encrypted_test_records SET secret = ? WHERE id = ?", tampered, rec.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	err = gdb.First(&got, rec.ID).Error
+	if !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected ErrDecryptionFailed, got %v", err)
+	}
+
+	SetEncryptionKeys()
+	if err := gdb.Create(&encryptedTestRecord{Secret: "x"}).Error; !errors.Is(err, ErrEncryptionKeyNotSet) {
+		t.Errorf("expected ErrEncryptionKeyNotSet, got %v", err)
+	}
+}
+
+func TestReencryptAll(t *testing.T) {
+	gdb := openTestDB(t)
+	oldKey, newKey := testEncryptionKey(1), testEncryptionKey(2)
+	setTestEncryptionKeys(t, oldKey)
+
+	if err := gdb.Migrator().DropTable(&encryptedTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.AutoMigrate(&encryptedTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := gdb.Create(&encryptedTestRecord{Name: "rec", Secret: "secret", Blob: []byte("blob")}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := ReencryptAll(context.Background(), gdb, &encryptedTestRecord{}, newKey, nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Errorf("expected 7 rows to be processed, got %d", n)
+	}
+
+	// Only the new key is needed now.
+	setTestEncryptionKeys(t, newKey)
+	var recs []encryptedTestRecord
+	if err := gdb.Find(&recs).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if rec.Secret != "secret" || string(rec.Blob) != "blob" || rec.Name != "rec" {
+			t.Errorf("unexpected record after re-encryption: %+v", rec)
+		}
+	}
+
+	// Old key is no longer known.
+	SetEncryptionKeys()
+	if _, err := ReencryptAll(context.Background(), gdb, &encryptedTestRecord{}, testEncryptionKey(3), [][]byte{oldKey}, 3); !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Errorf("expected ErrUnknownEncryptionKey, got %v", err)
+	}
+}
+
+func TestEncryptionKeysDirective(t *testing.T) {
+	key := testEncryptionKey(7)
+	dir := t.TempDir()
+	rawFile := filepath.Join(dir, "raw.key")
+	if err := os.WriteFile(rawFile, key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hexFile := filepath.Join(dir, "hex.key")
+	if err := os.WriteFile(hexFile, []byte(hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MADMAIL_TEST_DB_KEY", "BwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwc=")
+
+	val, err := EncryptionKeysDirective(nil, config.Node{
+		Name: "db_encryption_key",
+		Args: []string{"file:" + rawFile, "file:" + hexFile, "env:MADMAIL_TEST_DB_KEY"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := val.([][]byte)
+	for i, k := range keys {
+		if !bytes.Equal(k, key) {
+			t.Errorf("key %d was not loaded correctly: %x", i, k)
+		}
+	}
+
+	for _, arg := range []string{"inline-key", "env:MADMAIL_TEST_MISSING", "file:" + filepath.Join(dir, "missing")} {
+		if _, err := EncryptionKeysDirective(nil, config.Node{Name: "db_encryption_key", Args: []string{arg}}); err == nil {
+			t.Errorf("expected an error for %s", arg)
+		}
+	}
+	t.Setenv("MADMAIL_TEST_DB_KEY", "c2hvcnQ=")
+	if _, err := EncryptionKeysDirective(nil, config.Node{Name: "db_encryption_key", Args: []string{"env:MADMAIL_TEST_DB_KEY"}}); err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
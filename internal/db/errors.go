@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+	mssql "github.com/microsoft/go-mssqldb"
+)
+
+// isConnectionError reports whether err, returned by a query, means that
+// the database is not reachable, as opposed to errors caused by the query
+// itself (constraint violations, syntax errors, etc.).
+func isConnectionError(err error) bool {
+	// Context errors implement net.Error but are caused by the caller.
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if code, ok := pgErrorCode(err); ok {
+		switch code {
+		case "57P01", // admin_shutdown: the server is stopped, e.g. on failover
+			"57P02": // crash_shutdown
+			return true
+		}
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case 1927: // ER_CONNECTION_KILLED
+			return true
+		}
+	}
+	return isTransientConnectError(err)
+}
+
+// pgErrorCode returns the SQLSTATE code of err returned by pgx or by lib/pq,
+// which is used by go-imap-sql.
+func pgErrorCode(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code, true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code), true
+	}
+	return "", false
+}
+
+// isTransientConnectError reports whether err, returned while opening or
+// pinging the database, is likely to go away by itself (e.g. the server
+// is still starting up) and so the attempt is worth retrying.
+func isTransientConnectError(err error) bool {
+	if code, ok := pgErrorCode(err); ok {
+		switch code {
+		case "57P03", // cannot_connect_now: "the database system is starting up"
+			"53300",                                     // too_many_connections
+			"08000", "08001", "08003", "08004", "08006": // connection exceptions
+			return true
+		}
+		// Authentication failures, unknown database, etc.
+		return false
+	}
+
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case 1040, // ER_CON_COUNT_ERROR: too many connections
+			1053: // ER_SERVER_SHUTDOWN
+			return true
+		}
+		// Access denied, unknown database, etc.
+		return false
+	}
+
+	var msErr mssql.Error
+	if errors.As(err, &msErr) {
+		switch msErr.Number {
+		case 18401, // login failed: server is in script upgrade mode
+			40197, 40501, 40613, // Azure SQL: service busy or unavailable
+			49918, 49919, 49920: // Azure SQL: not enough resources
+			return true
+		}
+		// Login failed, cannot open database, etc.
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return true
+	}
+
+	// Dial failures, timeouts and DNS lookup failures (the database host name
+	// may not be resolvable until its container is started).
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// Some errors lose their type information on the way up.
+	msg := err.Error()
+	return strings.Contains(msg, "connection refused") ||
+		strings.Contains(msg, "the database system is starting up")
+}
@@ -0,0 +1,15 @@
+//go:build !cgo || nosqlite3
+// +build !cgo nosqlite3
+
+package db
+
+import "strings"
+
+// isSQLiteBusyError reports whether err is SQLITE_BUSY or SQLITE_LOCKED.
+// The error type is not available without cgo, so the message is checked.
+func isSQLiteBusyError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") ||
+		strings.Contains(msg, "database table is locked") ||
+		strings.Contains(msg, "SQLITE_BUSY")
+}
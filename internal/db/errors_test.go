@@ -0,0 +1,44 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+func TestIsTransientConnectError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", fmt.Errorf("failed to connect to database: %w", refused), true},
+		{"dns lookup", &net.DNSError{Err: "no such host", Name: "postgres", IsNotFound: true}, true},
+		{"pg starting up", &pgconn.PgError{Code: "57P03", Message: "the database system is starting up"}, true},
+		{"pg bad password", &pgconn.PgError{Code: "28P01", Message: "password authentication failed"}, false},
+		{"pg unknown database", &pgconn.PgError{Code: "3D000", Message: "database \"x\" does not exist"}, false},
+		{"pq starting up", fmt.Errorf("NewBackend (schemaVersion): %w", &pq.Error{Code: "57P03"}), true},
+		{"pq bad password", &pq.Error{Code: "28P01"}, false},
+		{"mysql too many connections", &mysql.MySQLError{Number: 1040}, true},
+		{"mysql access denied", &mysql.MySQLError{Number: 1045}, false},
+		{"mysql invalid conn", mysql.ErrInvalidConn, true},
+		{"untyped starting up", errors.New("FATAL: the database system is starting up"), true},
+		{"unsupported driver", errors.New("unsupported database driver: oracle"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isTransientConnectError(c.err); got != c.want {
+				t.Errorf("isTransientConnectError(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
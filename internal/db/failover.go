@@ -0,0 +1,331 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/themadorg/madmail/framework/log"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// Values of Options.TargetSessionAttrs.
+const (
+	SessionAny       = "any"
+	SessionReadWrite = "read-write"
+)
+
+// errReadOnlyHost is reported for a host rejected because of
+// Options.TargetSessionAttrs.
+var errReadOnlyHost = errors.New("server is read-only")
+
+// failoverHost is a single database server of the failover list.
+type failoverHost struct {
+	// addr is host:port (or the socket path) used in logs, errors and
+	// metrics.
+	addr      string
+	connector driver.Connector
+}
+
+// failoverConnector opens connections to the first available host of the
+// list, starting with the host the last connection was opened to. Hosts
+// are tried in order, wrapping around, so when the active host goes down
+// new connections are opened to the next one that works.
+type failoverConnector struct {
+	driver    driver.Driver
+	hosts     []failoverHost
+	readWrite bool
+	log       log.Logger
+
+	active    atomic.Int32
+	failovers atomic.Int64
+
+	// pool is the database using the connector, its idle connections to
+	// the previous host are closed on failover.
+	pool         atomic.Pointer[sql.DB]
+	maxIdleConns int
+}
+
+func (c *failoverConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func (c *failoverConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	start := int(c.active.Load())
+	errs := make([]error, 0, len(c.hosts))
+	for i := range c.hosts {
+		idx := (start + i) % len(c.hosts)
+		host := c.hosts[idx]
+
+		conn, err := host.connector.Connect(ctx)
+		if err == nil && c.readWrite {
+			if err = checkWritable(ctx, conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			if idx != start && c.active.CompareAndSwap(int32(start), int32(idx)) {
+				c.switched(start, idx)
+			}
+			return conn, nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", host.addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, &failoverError{errs: errs}
+}
+
+func (c *failoverConnector) switched(from, to int) {
+	c.failovers.Add(1)
+	c.log.Msg("database failover", "from", c.hosts[from].addr, "to", c.hosts[to].addr)
+
+	// Connections to the previous host would be used for reads and writes
+	// until they fail, e.g. if it is still reachable but no longer the
+	// primary.
+	if pool := c.pool.Load(); pool != nil {
+		pool.SetMaxIdleConns(0)
+		pool.SetMaxIdleConns(c.maxIdleConns)
+	}
+}
+
+func (c *failoverConnector) activeHost() string {
+	return c.hosts[c.active.Load()].addr
+}
+
+// failoverError is returned if no host of the list is available. It
+// unwraps to the errors of all hosts so isTransientConnectError can
+// classify it.
+type failoverError struct {
+	errs []error
+}
+
+func (e *failoverError) Error() string {
+	msgs := make([]string, 0, len(e.errs))
+	for _, err := range e.errs {
+		msgs = append(msgs, err.Error())
+	}
+	return "no database host is available: " + strings.Join(msgs, "; ")
+}
+
+func (e *failoverError) Unwrap() []error {
+	return e.errs
+}
+
+// checkWritable returns errReadOnlyHost if conn is connected to a standby
+// or a server in read-only mode.
+func checkWritable(ctx context.Context, conn driver.Conn) error {
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return errors.New("driver does not support queries on raw connections")
+	}
+
+	var query string
+	switch conn.(type) {
+	case *stdlib.Conn:
+		query = "SHOW transaction_read_only"
+	default:
+		query = "SELECT @@global.read_only"
+	}
+	rows, err := queryer.QueryContext(ctx, query, nil)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, len(rows.Columns()))
+	if err := rows.Next(dest); err != nil {
+		return err
+	}
+
+	var value string
+	switch v := dest[0].(type) {
+	case []byte:
+		value = string(v)
+	case string:
+		value = v
+	case int64:
+		value = strconv.FormatInt(v, 10)
+	default:
+		return fmt.Errorf("unexpected read-only status: %v", v)
+	}
+	switch strings.ToLower(value) {
+	case "on", "1":
+		return errReadOnlyHost
+	case "off", "0":
+		return nil
+	}
+	return fmt.Errorf("unexpected read-only status: %s", value)
+}
+
+// newFailoverConnector returns the connector for the hosts listed in
+// dsnStr and opts.FailoverHosts, or nil if there is only one host.
+func newFailoverConnector(driverName, dsnStr string, opts Options) (*failoverConnector, error) {
+	var (
+		hosts []failoverHost
+		drv   driver.Driver
+		err   error
+	)
+	switch driverName {
+	case "postgres":
+		hosts, err = postgresFailoverHosts(dsnStr, opts.FailoverHosts)
+		drv = stdlib.GetDefaultDriver()
+	case "mysql":
+		hosts, err = mysqlFailoverHosts(dsnStr, opts.FailoverHosts)
+		drv = &gomysql.MySQLDriver{}
+	default:
+		if len(opts.FailoverHosts) != 0 {
+			return nil, fmt.Errorf("failover_hosts is not supported for the %s driver", driverName)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) < 2 && opts.TargetSessionAttrs != SessionReadWrite {
+		return nil, nil
+	}
+	return &failoverConnector{
+		driver:       drv,
+		hosts:        hosts,
+		readWrite:    opts.TargetSessionAttrs == SessionReadWrite,
+		log:          opts.Log,
+		maxIdleConns: opts.MaxIdleConns,
+	}, nil
+}
+
+// newFailoverDialector returns the dialector using the connection pool
+// that opens connections using c.
+func newFailoverDialector(driverName string, c *failoverConnector) gorm.Dialector {
+	pool := sql.OpenDB(c)
+	c.pool.Store(pool)
+	if driverName == "mysql" {
+		return mysql.New(mysql.Config{Conn: pool})
+	}
+	return postgres.New(postgres.Config{Conn: pool})
+}
+
+// postgresFailoverHosts returns the hosts listed in the DSN, e.g.
+// "host=db1,db2 port=5432,5433", followed by extra hosts. Each host keeps
+// the pgx fallbacks for its address, e.g. the non-TLS attempt for
+// sslmode=prefer.
+func postgresFailoverHosts(dsnStr string, extra []string) ([]failoverHost, error) {
+	cfg, err := pgx.ParseConfig(dsnStr)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []failoverHost
+	add := func(cfg *pgx.ConnConfig) {
+		addr := net.JoinHostPort(cfg.Host, strconv.Itoa(int(cfg.Port)))
+		if strings.HasPrefix(cfg.Host, "/") {
+			addr = cfg.Host
+		}
+		hosts = append(hosts, failoverHost{addr: addr, connector: stdlib.GetConnector(*cfg)})
+	}
+
+	// The first entry is stored in the config itself, fallbacks for the
+	// same address follow it.
+	entries := append([]*pgconn.FallbackConfig{{Host: cfg.Host, Port: cfg.Port, TLSConfig: cfg.TLSConfig}}, cfg.Fallbacks...)
+	for i := 0; i < len(entries); {
+		j := i + 1
+		for j < len(entries) && entries[j].Host == entries[i].Host && entries[j].Port == entries[i].Port {
+			j++
+		}
+		hostCfg := cfg.Copy()
+		hostCfg.Host, hostCfg.Port, hostCfg.TLSConfig = entries[i].Host, entries[i].Port, entries[i].TLSConfig
+		hostCfg.Fallbacks = append([]*pgconn.FallbackConfig(nil), entries[i+1:j]...)
+		add(hostCfg)
+		i = j
+	}
+
+	for _, hostport := range extra {
+		host, port, err := splitHostPort(hostport, strconv.Itoa(int(cfg.Port)))
+		if err != nil {
+			return nil, err
+		}
+		hostCfg, err := pgx.ParseConfig(postgresDSNForHost(dsnStr, host, port))
+		if err != nil {
+			return nil, err
+		}
+		add(hostCfg)
+	}
+	return hosts, nil
+}
+
+// postgresDSNForHost returns dsnStr changed to connect to host and port
+// instead of the hosts it specifies.
+func postgresDSNForHost(dsnStr, host, port string) string {
+	if u, err := url.Parse(dsnStr); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		query := u.Query()
+		query.Del("host")
+		query.Del("port")
+		u.RawQuery = query.Encode()
+		u.Host = net.JoinHostPort(host, port)
+		return u.String()
+	}
+	// Later keywords override earlier ones.
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	return dsnStr + " host='" + quote.Replace(host) + "' port='" + port + "'"
+}
+
+// mysqlFailoverHosts returns the address of the DSN followed by extra
+// hosts, all using the other DSN settings.
+func mysqlFailoverHosts(dsnStr string, extra []string) ([]failoverHost, error) {
+	cfg, err := gomysql.ParseDSN(dsnStr)
+	if err != nil {
+		return nil, err
+	}
+
+	primaryHost, _, _ := net.SplitHostPort(cfg.Addr)
+	configs := []*gomysql.Config{cfg}
+	for _, hostport := range extra {
+		host, port, err := splitHostPort(hostport, "3306")
+		if err != nil {
+			return nil, err
+		}
+		hostCfg := cfg.Clone()
+		hostCfg.Net = "tcp"
+		hostCfg.Addr = net.JoinHostPort(host, port)
+		if hostCfg.TLS != nil && hostCfg.TLS.ServerName == primaryHost {
+			hostCfg.TLS.ServerName = host
+		}
+		configs = append(configs, hostCfg)
+	}
+
+	hosts := make([]failoverHost, 0, len(configs))
+	for _, c := range configs {
+		connector, err := gomysql.NewConnector(c)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, failoverHost{addr: c.Addr, connector: connector})
+	}
+	return hosts, nil
+}
+
+func splitHostPort(hostport, defaultPort string) (host, port string, err error) {
+	if !strings.Contains(hostport, ":") || strings.HasPrefix(hostport, "/") ||
+		(strings.HasPrefix(hostport, "[") && strings.HasSuffix(hostport, "]")) {
+		return strings.Trim(hostport, "[]"), defaultPort, nil
+	}
+	host, port, err = net.SplitHostPort(hostport)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid failover host %q: %w", hostport, err)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/themadorg/madmail/framework/log"
+)
+
+type failoverTestConn struct {
+	readOnly string
+	closed   bool
+}
+
+func (c *failoverTestConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+func (c *failoverTestConn) Close() error              { c.closed = true; return nil }
+func (c *failoverTestConn) Begin() (driver.Tx, error) { return nil, errors.New("not implemented") }
+
+func (c *failoverTestConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return &failoverTestRows{value: c.readOnly}, nil
+}
+
+type failoverTestRows struct {
+	value string
+	done  bool
+}
+
+func (r *failoverTestRows) Columns() []string { return []string{"read_only"} }
+func (r *failoverTestRows) Close() error      { return nil }
+
+func (r *failoverTestRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = []byte(r.value)
+	return nil
+}
+
+type failoverTestConnector struct {
+	err      error
+	readOnly string
+	calls    int
+	conns    []*failoverTestConn
+}
+
+func (c *failoverTestConnector) Connect(context.Context) (driver.Conn, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	conn := &failoverTestConn{readOnly: c.readOnly}
+	c.conns = append(c.conns, conn)
+	return conn, nil
+}
+
+func (c *failoverTestConnector) Driver() driver.Driver { return nil }
+
+func TestFailoverConnector(t *testing.T) {
+	hosts := []*failoverTestConnector{{readOnly: "off"}, {readOnly: "off"}, {readOnly: "on"}}
+	c := &failoverConnector{log: log.Logger{Name: "db"}}
+	for i, h := range hosts {
+		c.hosts = append(c.hosts, failoverHost{addr: []string{"db1:5432", "db2:5432", "db3:5432"}[i], connector: h})
+	}
+
+	connect := func(wantHost string) {
+		t.Helper()
+		if _, err := c.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.activeHost(); got != wantHost {
+			t.Errorf("expected active host %s, got %s", wantHost, got)
+		}
+	}
+
+	connect("db1:5432")
+	hosts[0].err = syscall.ECONNREFUSED
+	connect("db2:5432")
+	if c.failovers.Load() != 1 {
+		t.Errorf("expected 1 failover, got %d", c.failovers.Load())
+	}
+
+	// The host connected to last is tried first even if the previous one
+	// is back.
+	hosts[0].err = nil
+	calls := hosts[0].calls
+	connect("db2:5432")
+	if hosts[0].calls != calls {
+		t.Error("the first host was tried before the active one")
+	}
+
+	// Hosts are tried in order, wrapping around.
+	hosts[1].err = syscall.ECONNREFUSED
+	connect("db3:5432")
+	hosts[2].err = syscall.ECONNREFUSED
+	connect("db1:5432")
+
+	hosts[0].err = syscall.ECONNREFUSED
+	_, err := c.Connect(context.Background())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if want := "no database host is available: db1:5432: connection refused; db2:5432: connection refused; db3:5432: connection refused"; err.Error() != want {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !isTransientConnectError(err) {
+		t.Error("failure of all hosts is not considered transient")
+	}
+}
+
+func TestFailoverConnector_ReadWrite(t *testing.T) {
+	standby := &failoverTestConnector{readOnly: "on"}
+	primary := &failoverTestConnector{readOnly: "0"}
+	c := &failoverConnector{
+		log:       log.Logger{Name: "db"},
+		readWrite: true,
+		hosts: []failoverHost{
+			{addr: "db1:3306", connector: standby},
+			{addr: "db2:3306", connector: primary},
+		},
+	}
+	if _, err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.activeHost() != "db2:3306" {
+		t.Errorf("read-only host was used")
+	}
+	if len(standby.conns) != 1 || !standby.conns[0].closed {
+		t.Error("connection to the read-only host was not closed")
+	}
+
+	primary.readOnly = "1"
+	_, err := c.Connect(context.Background())
+	if !errors.Is(err, errReadOnlyHost) {
+		t.Errorf("expected errReadOnlyHost, got %v", err)
+	}
+}
+
+func TestFailoverHosts(t *testing.T) {
+	for _, c := range []struct {
+		driver string
+		dsn    string
+		extra  []string
+		want   []string
+	}{
+		{"postgres", "host=db1 dbname=maddy sslmode=disable", nil, []string{"db1:5432"}},
+		{"postgres", "host=db1,db2 port=5432,5433 dbname=maddy sslmode=prefer", nil, []string{"db1:5432", "db2:5433"}},
+		{"postgres", "host=/run/postgresql,db2 dbname=maddy sslmode=disable", []string{"db3:6432", "[::1]"}, []string{"/run/postgresql", "db2:5432", "db3:6432", "[::1]:5432"}},
+		{"postgres", "postgres://maddy@db1/maddy?sslmode=disable", []string{"db2"}, []string{"db1:5432", "db2:5432"}},
+		{"mysql", "maddy:secret@tcp(db1)/maddy", []string{"db2", "db3:3307"}, []string{"db1:3306", "db2:3306", "db3:3307"}},
+	} {
+		var (
+			hosts []failoverHost
+			err   error
+		)
+		if c.driver == "postgres" {
+			hosts, err = postgresFailoverHosts(c.dsn, c.extra)
+		} else {
+			hosts, err = mysqlFailoverHosts(c.dsn, c.extra)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.dsn, err)
+			continue
+		}
+		addrs := make([]string, 0, len(hosts))
+		for _, h := range hosts {
+			addrs = append(addrs, h.addr)
+		}
+		if strings.Join(addrs, " ") != strings.Join(c.want, " ") {
+			t.Errorf("%s: expected %v, got %v", c.dsn, c.want, addrs)
+		}
+	}
+}
+
+func TestPostgresDSNForHost(t *testing.T) {
+	for _, c := range []struct {
+		dsn, want string
+	}{
+		{"host=db1 dbname=maddy", "host=db1 dbname=maddy host='db2' port='5433'"},
+		{"postgres://maddy@db1:5432/maddy?host=db1&sslmode=disable", "postgres://maddy@db2:5433/maddy?sslmode=disable"},
+	} {
+		if got := postgresDSNForHost(c.dsn, "db2", "5433"); got != c.want {
+			t.Errorf("%s: expected %q, got %q", c.dsn, c.want, got)
+		}
+	}
+}
+
+func TestNewWithContext_Failover(t *testing.T) {
+	// Nothing listens on ports 1 and 2.
+	_, err := New("postgres", []string{"host=127.0.0.1,127.0.0.1 port=1,2 user=maddy dbname=maddy sslmode=disable"}, Options{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "127.0.0.1:1: ") || !strings.Contains(err.Error(), "127.0.0.1:2: ") {
+		t.Errorf("error does not mention all hosts: %v", err)
+	}
+
+	_, err = New("sqlite3", []string{":memory:"}, Options{FailoverHosts: []string{"db2"}})
+	if err == nil || !strings.Contains(err.Error(), "failover_hosts is not supported for the sqlite3 driver") {
+		t.Errorf("expected an error for sqlite3, got %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/gorm"
+)
+
+// appendBenchRecord resembles the rows written during delivery: a short
+// key, a few integers and a timestamp.
+type appendBenchRecord struct {
+	ID        uint `gorm:"primaryKey"`
+	Mailbox   string
+	UID       int64
+	Size      int64
+	Flags     string
+	CreatedAt time.Time
+}
+
+func TestNew_GORMOptions(t *testing.T) {
+	gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+		PrepareStmt:            true,
+		SkipDefaultTransaction: true,
+		CreateBatchSize:        2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+
+	if !gdb.PrepareStmt || !gdb.SkipDefaultTransaction || gdb.CreateBatchSize != 2 {
+		t.Errorf("options are not applied: %+v", gdb.Config)
+	}
+	if err := gdb.AutoMigrate(&appendBenchRecord{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var statements int
+	if err := gdb.Callback().Create().After("gorm:create").Register("test:count", func(*gorm.DB) {
+		statements++
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]appendBenchRecord, 5)
+	if err := gdb.Create(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if statements != 3 {
+		t.Errorf("expected 3 INSERT statements, got %d", statements)
+	}
+
+	var count int64
+	if err := gdb.Model(&appendBenchRecord{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("expected 5 rows, got %d", count)
+	}
+}
+
+// benchDatabases returns the databases to benchmark: a temporary SQLite
+// database and, if set, the one specified using -db.testdriver and
+// -db.testdsn, e.g.
+//
+//	go test ./internal/db -run - -bench Append -db.testdriver postgres -db.testdsn 'host=localhost dbname=maddy_test sslmode=disable'
+func benchDatabases(b *testing.B) map[string][]string {
+	dbs := map[string][]string{
+		"sqlite3": {"sqlite3", filepath.Join(b.TempDir(), "bench.db")},
+	}
+	if testDriver != "" {
+		dbs[testDriver] = []string{testDriver, testDSN}
+	}
+	return dbs
+}
+
+func openBenchDB(b *testing.B, driver, dsn string, opts Options) *gorm.DB {
+	b.Helper()
+	gdb, err := New(driver, []string{dsn}, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := gdb.Migrator().DropTable(&appendBenchRecord{}); err != nil {
+		b.Fatal(err)
+	}
+	if err := gdb.AutoMigrate(&appendBenchRecord{}); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		gdb.Migrator().DropTable(&appendBenchRecord{})
+		sqlDB, _ := gdb.DB()
+		sqlDB.Close()
+	})
+	return gdb
+}
+
+// BenchmarkAppend measures single-row inserts, as done for every delivered
+// message, with the statement cache and implicit transactions toggled.
+//
+// Measured on SQLite (1 vCPU VM, local disk): default 97µs/op,
+// prepare_stmt 96µs/op, skip_default_transaction 46µs/op, both 42µs/op.
+// The statement cache matters more for PostgreSQL, where parsing and
+// planning happen on the server and every statement is a round trip.
+func BenchmarkAppend(b *testing.B) {
+	variants := []struct {
+		name string
+		opts Options
+	}{
+		{"default", Options{}},
+		{"prepare_stmt", Options{PrepareStmt: true}},
+		{"skip_default_transaction", Options{SkipDefaultTransaction: true}},
+		{"both", Options{PrepareStmt: true, SkipDefaultTransaction: true}},
+	}
+	for name, db := range benchDatabases(b) {
+		for _, v := range variants {
+			b.Run(name+"/"+v.name, func(b *testing.B) {
+				gdb := openBenchDB(b, db[0], db[1], v.opts)
+				now := time.Now()
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					err := gdb.Create(&appendBenchRecord{
+						Mailbox:   "INBOX",
+						UID:       int64(i),
+						Size:      4096,
+						Flags:     `\Recent`,
+						CreatedAt: now,
+					}).Error
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkAppendBulk measures inserting 1000 rows at once, as done for
+// queue recipients of a message with many recipients or bulk imports,
+// comparing a loop of single-row inserts in a transaction with Create of
+// the whole slice split by create_batch_size.
+//
+// Measured on SQLite (same machine as above): per_row 45ms/op,
+// create_batch_size 50 8.8ms/op, create_batch_size 500 9.5ms/op.
+func BenchmarkAppendBulk(b *testing.B) {
+	const rowCount = 1000
+	rows := func(start int) []appendBenchRecord {
+		now := time.Now()
+		rows := make([]appendBenchRecord, rowCount)
+		for i := range rows {
+			rows[i] = appendBenchRecord{Mailbox: "INBOX", UID: int64(start + i), Size: 4096, CreatedAt: now}
+		}
+		return rows
+	}
+
+	for name, db := range benchDatabases(b) {
+		b.Run(name+"/per_row", func(b *testing.B) {
+			gdb := openBenchDB(b, db[0], db[1], Options{})
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				batch := rows(i * rowCount)
+				err := gdb.Transaction(func(tx *gorm.DB) error {
+					for j := range batch {
+						if err := tx.Create(&batch[j]).Error; err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		for _, size := range []int{50, 500} {
+			b.Run(fmt.Sprintf("%s/create_batch_size_%d", name, size), func(b *testing.B) {
+				gdb := openBenchDB(b, db[0], db[1], Options{CreateBatchSize: size})
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					batch := rows(i * rowCount)
+					if err := gdb.Create(&batch).Error; err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestUnwrapPool(t *testing.T) {
+	gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{PrepareStmt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(context.Background(), gdb)
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gdb.ConnPool.(*gorm.PreparedStmtDB); !ok {
+		t.Fatalf("pool is not wrapped: %T", gdb.ConnPool)
+	}
+	if got := unwrapPool(gdb.ConnPool); got != sqlDB {
+		t.Errorf("unwrapPool returned %p, want %p", got, sqlDB)
+	}
+	if got := unwrapPool(sqlDB); got != sqlDB {
+		t.Errorf("unwrapPool(*sql.DB) returned %p, want %p", got, sqlDB)
+	}
+	if got := unwrapPool(&fakePool{}); got != nil {
+		t.Errorf("unwrapPool(fakePool) = %p, want nil", got)
+	}
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/themadorg/madmail/framework/log"
+	"golang.org/x/sync/singleflight"
+	"gorm.io/gorm"
+)
+
+// HealthCheckTimeout bounds the time Ping waits for the database.
+const HealthCheckTimeout = 2 * time.Second
+
+var (
+	// ErrNeverConnected is reported by Ping if no connection to the database
+	// was ever established.
+	ErrNeverConnected = errors.New("database was never connected")
+	// ErrConnectionLost is reported by Ping if the database was reachable
+	// before but is not anymore.
+	ErrConnectionLost = errors.New("database connection lost")
+)
+
+// HealthError is returned by Ping. Reason is ErrNeverConnected,
+// ErrConnectionLost or ErrCircuitOpen, Err is the underlying failure. Both can
+// be matched using errors.Is.
+//
+// Host is the active host if failover between multiple hosts is
+// configured, see ActiveHost.
+type HealthError struct {
+	Reason error
+	Err    error
+	Host   string
+}
+
+func (e *HealthError) Error() string {
+	if e.Host != "" {
+		return fmt.Sprintf("%v (host %s): %v", e.Reason, e.Host, e.Err)
+	}
+	return fmt.Sprintf("%v: %v", e.Reason, e.Err)
+}
+
+func (e *HealthError) Unwrap() []error {
+	return []error{e.Reason, e.Err}
+}
+
+// poolState is the state kept for each connection pool opened by
+// NewWithContext.
+type poolState struct {
+	connected atomic.Bool
+	checks    singleflight.Group
+
+	// Set by open before the pool is used.
+	log      log.Logger
+	replicas []*sql.DB
+
+	// database identifies the database and table prefix, see
+	// SameDatabase.
+	database string
+
+	// closing is set by Close, see rejectWhenClosing.
+	closing atomic.Bool
+
+	// breaker is nil if the circuit breaker is disabled.
+	breaker *breaker
+
+	// failover is nil unless multiple hosts are configured, see
+	// Options.FailoverHosts.
+	failover *failoverConnector
+
+	// maintenance is nil unless the database is SQLite with maintenance
+	// enabled, see Options.SQLiteMaintenanceInterval.
+	maintenance *sqliteMaintenance
+
+	// connectOpts are the options the pool was opened with, used by
+	// Migrate to retry the schema check.
+	connectOpts Options
+}
+
+var poolStates sync.Map // *sql.DB -> *poolState
+
+func stateFor(sqlDB *sql.DB) *poolState {
+	st, _ := poolStates.LoadOrStore(sqlDB, &poolState{})
+	return st.(*poolState)
+}
+
+func markConnected(sqlDB *sql.DB) {
+	stateFor(sqlDB).connected.Store(true)
+}
+
+// Ping checks that the database is reachable and able to execute queries.
+//
+// Concurrent calls for the same database share a single check so a hanging
+// database server does not cause blocked goroutines to pile up. Ping
+// returns when ctx is done or HealthCheckTimeout passes, whichever comes
+// first.
+func Ping(ctx context.Context, gdb *gorm.DB) error {
+	if gdb == nil {
+		return &HealthError{Reason: ErrNeverConnected, Err: errors.New("database is not initialized")}
+	}
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		return &HealthError{Reason: ErrNeverConnected, Err: err}
+	}
+	return pingDB(ctx, sqlDB)
+}
+
+// ActiveHost returns the address of the server new connections of gdb are
+// opened to first, or an empty string if gdb was not opened with multiple
+// hosts, see Options.FailoverHosts.
+func ActiveHost(gdb *gorm.DB) string {
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		return ""
+	}
+	if st, ok := poolStates.Load(sqlDB); ok && st.(*poolState).failover != nil {
+		return st.(*poolState).failover.activeHost()
+	}
+	return ""
+}
+
+func pingDB(ctx context.Context, sqlDB *sql.DB) error {
+	st := stateFor(sqlDB)
+	// The database is already being probed in background.
+	if st.breaker.isOpen() {
+		return &HealthError{Reason: ErrCircuitOpen, Err: st.breaker.err()}
+	}
+
+	resCh := st.checks.DoChan("ping", func() (interface{}, error) {
+		// Not bound to the caller context since the result is shared with
+		// other callers.
+		checkCtx, cancel := context.WithTimeout(context.Background(), HealthCheckTimeout)
+		defer cancel()
+		return nil, checkConn(checkCtx, sqlDB)
+	})
+
+	var err error
+	select {
+	case res := <-resCh:
+		err = res.Err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		reason := ErrConnectionLost
+		if !st.connected.Load() {
+			reason = ErrNeverConnected
+		}
+		herr := &HealthError{Reason: reason, Err: err}
+		if st.failover != nil {
+			herr.Host = st.failover.activeHost()
+		}
+		return herr
+	}
+	st.connected.Store(true)
+	return nil
+}
+
+func checkConn(ctx context.Context, sqlDB *sql.DB) error {
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return err
+	}
+	var one int
+	return sqlDB.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
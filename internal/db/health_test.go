@@ -0,0 +1,118 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hangDriver blocks in Open until release is closed, imitating a database
+// server that accepts TCP connections but never responds.
+type hangDriver struct {
+	opens   int32
+	release chan struct{}
+}
+
+func (d *hangDriver) Open(string) (driver.Conn, error) {
+	atomic.AddInt32(&d.opens, 1)
+	<-d.release
+	return nil, errors.New("connection refused")
+}
+
+var hangDrivers int32
+
+func openHangDB(t *testing.T) (*sql.DB, *hangDriver) {
+	t.Helper()
+	drv := &hangDriver{release: make(chan struct{})}
+	name := fmt.Sprintf("db-test-hang-%d", atomic.AddInt32(&hangDrivers, 1))
+	sql.Register(name, drv)
+	sqlDB, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		close(drv.release)
+		sqlDB.Close()
+	})
+	return sqlDB, drv
+}
+
+func TestPing_OK(t *testing.T) {
+	gdb := openTestDB(t)
+	if err := Ping(context.Background(), gdb); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestPing_ConnectionLost(t *testing.T) {
+	gdb := openTestDB(t)
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+
+	err = Ping(context.Background(), gdb)
+	var healthErr *HealthError
+	if !errors.As(err, &healthErr) {
+		t.Fatalf("expected HealthError, got %v", err)
+	}
+	if !errors.Is(err, ErrConnectionLost) || errors.Is(err, ErrNeverConnected) {
+		t.Fatal("expected ErrConnectionLost, got", err)
+	}
+}
+
+func TestPing_NeverConnected(t *testing.T) {
+	if err := Ping(context.Background(), nil); !errors.Is(err, ErrNeverConnected) {
+		t.Fatal("expected ErrNeverConnected for nil DB, got", err)
+	}
+
+	sqlDB, _ := openHangDB(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := pingDB(ctx, sqlDB)
+	if !errors.Is(err, ErrNeverConnected) {
+		t.Fatal("expected ErrNeverConnected, got", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected the underlying error to be DeadlineExceeded, got", err)
+	}
+}
+
+func TestPing_HangingDatabase(t *testing.T) {
+	sqlDB, drv := openHangDB(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	const callers = 50
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pingDB(ctx, sqlDB); err == nil {
+				t.Error("expected an error")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Ping did not respect context deadline, took %v", elapsed)
+	}
+	// All concurrent callers should share a single connection attempt.
+	if opens := atomic.LoadInt32(&drv.opens); opens != 1 {
+		t.Errorf("expected 1 connection attempt, got %d", opens)
+	}
+}
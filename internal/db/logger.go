@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/themadorg/madmail/framework/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// DefaultSlowQueryThreshold is used when Options.SlowQueryThreshold is zero.
+const DefaultSlowQueryThreshold = 200 * time.Millisecond
+
+// QueryLogger implements gorm/logger.Interface on top of log.Logger.
+//
+// Every query is logged as a debug message if Log.Debug is set. Failed
+// queries and queries that took longer than SlowThreshold are logged
+// regardless of the debug flag, but with the parameters left out unless
+// Log.Debug is set since they may contain addresses or password hashes.
+type QueryLogger struct {
+	Log log.Logger
+
+	// SlowThreshold is the duration after which the query is reported as
+	// slow. Zero disables slow query reporting.
+	SlowThreshold time.Duration
+
+	// IgnoreRecordNotFoundError suppresses logging of ErrRecordNotFound,
+	// which is returned by routine lookups of non-existent rows.
+	IgnoreRecordNotFoundError bool
+
+	level logger.LogLevel
+}
+
+// NewQueryLogger creates a QueryLogger that writes to l.
+func NewQueryLogger(l log.Logger, slowThreshold time.Duration) *QueryLogger {
+	level := logger.Warn
+	if l.Debug {
+		level = logger.Info
+	}
+	return &QueryLogger{
+		Log:                       l,
+		SlowThreshold:             slowThreshold,
+		IgnoreRecordNotFoundError: true,
+		level:                     level,
+	}
+}
+
+func (ql *QueryLogger) LogMode(level logger.LogLevel) logger.Interface {
+	newLogger := *ql
+	newLogger.level = level
+	if level >= logger.Info {
+		// Explicitly requested (e.g. via gorm.DB.Debug), do not require
+		// the debug flag to be set too.
+		newLogger.Log.Debug = true
+	}
+	return &newLogger
+}
+
+func (ql *QueryLogger) Info(_ context.Context, msg string, data ...interface{}) {
+	if ql.level >= logger.Info {
+		ql.Log.Debugf(msg, data...)
+	}
+}
+
+func (ql *QueryLogger) Warn(_ context.Context, msg string, data ...interface{}) {
+	if ql.level >= logger.Warn {
+		ql.Log.Printf(msg, data...)
+	}
+}
+
+func (ql *QueryLogger) Error(_ context.Context, msg string, data ...interface{}) {
+	if ql.level >= logger.Error {
+		ql.Log.Printf(msg, data...)
+	}
+}
+
+// ParamsFilter implements gorm.ParamsFilter. Without parameters GORM logs
+// the statement with placeholders.
+func (ql *QueryLogger) ParamsFilter(_ context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	if ql.Log.Debug {
+		return sql, params
+	}
+	return sql, nil
+}
+
+func (ql *QueryLogger) Trace(_ context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if ql.level <= logger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && ql.level >= logger.Error && !(ql.IgnoreRecordNotFoundError && errors.Is(err, logger.ErrRecordNotFound)):
+		sql, rows := fc()
+		ql.Log.Error("query failed", err, "query", sql, "duration", elapsed, "rows", rows)
+	case ql.SlowThreshold > 0 && elapsed > ql.SlowThreshold && ql.level >= logger.Warn:
+		sql, rows := fc()
+		ql.Log.Msg("slow query", "query", sql, "duration", elapsed, "rows", rows,
+			"threshold", ql.SlowThreshold)
+	case ql.level >= logger.Info:
+		sql, rows := fc()
+		ql.Log.DebugMsg("query", "query", sql, "duration", elapsed, "rows", rows)
+	}
+}
+
+var (
+	_ logger.Interface  = &QueryLogger{}
+	_ gorm.ParamsFilter = &QueryLogger{}
+)
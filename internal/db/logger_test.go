@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themadorg/madmail/framework/log"
+	"gorm.io/gorm/logger"
+)
+
+func captureLogger(debug bool) (log.Logger, *[]string) {
+	var msgs []string
+	return log.Logger{
+		Name:  "db",
+		Debug: debug,
+		Out: log.FuncOutput(func(_ time.Time, _ bool, msg string) {
+			msgs = append(msgs, msg)
+		}, func() error { return nil }),
+	}, &msgs
+}
+
+func TestQueryLogger_Trace(t *testing.T) {
+	query := func() (string, int64) { return "SELECT 1", 1 }
+
+	cases := []struct {
+		name    string
+		debug   bool
+		elapsed time.Duration
+		err     error
+		want    string // substring of the single expected message, empty for none
+	}{
+		{"fast query, no debug", false, 0, nil, ""},
+		{"fast query, debug", true, 0, nil, "db: query\t"},
+		{"slow query, no debug", false, time.Second, nil, "db: slow query\t"},
+		{"error", false, 0, errors.New("boom"), "db: query failed\t"},
+		{"record not found", false, 0, logger.ErrRecordNotFound, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l, msgs := captureLogger(c.debug)
+			ql := NewQueryLogger(l, 200*time.Millisecond)
+			ql.Trace(context.Background(), time.Now().Add(-c.elapsed), query, c.err)
+
+			if c.want == "" {
+				if len(*msgs) != 0 {
+					t.Fatalf("expected no messages, got %v", *msgs)
+				}
+				return
+			}
+			if len(*msgs) != 1 {
+				t.Fatalf("expected 1 message, got %v", *msgs)
+			}
+			if !strings.HasPrefix((*msgs)[0], c.want) {
+				t.Errorf("message %q does not start with %q", (*msgs)[0], c.want)
+			}
+			if !strings.Contains((*msgs)[0], `"query":"SELECT 1"`) {
+				t.Errorf("message %q does not contain the query", (*msgs)[0])
+			}
+		})
+	}
+}
+
+func TestQueryLogger_ExplicitDebugMode(t *testing.T) {
+	l, msgs := captureLogger(false)
+	ql := NewQueryLogger(l, 0).LogMode(logger.Info)
+	ql.Trace(context.Background(), time.Now(), func() (string, int64) { return "SELECT 1", 1 }, nil)
+	if len(*msgs) != 1 {
+		t.Fatalf("expected 1 message, got %v", *msgs)
+	}
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+const metricsStartKey = "madmail:metrics_start"
+
+// Metrics collects query and connection pool metrics of instrumented
+// databases.
+//
+// A single Metrics instance is shared by all databases registered on the
+// same prometheus.Registerer, individual databases are distinguished by the
+// "db" label.
+type Metrics struct {
+	queryDuration *prometheus.HistogramVec
+	queryErrors   *prometheus.CounterVec
+	pools         *poolCollector
+}
+
+// NewMetrics creates Metrics and registers its collectors on reg.
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		queryDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "maddy",
+				Subsystem: "db",
+				Name:      "query_duration_seconds",
+				Help:      "Time spent executing database queries",
+				Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+			},
+			[]string{"db", "operation", "table"},
+		),
+		queryErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "maddy",
+				Subsystem: "db",
+				Name:      "query_errors_total",
+				Help:      "Database queries that failed",
+			},
+			[]string{"db", "operation", "table"},
+		),
+		pools: newPoolCollector(),
+	}
+	for _, c := range []prometheus.Collector{m.queryDuration, m.queryErrors, m.pools} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+var (
+	defaultMetrics     *Metrics
+	defaultMetricsErr  error
+	defaultMetricsOnce sync.Once
+)
+
+// DefaultMetrics returns the Metrics instance registered on
+// prometheus.DefaultRegisterer, which is served by the openmetrics endpoint.
+func DefaultMetrics() (*Metrics, error) {
+	defaultMetricsOnce.Do(func() {
+		defaultMetrics, defaultMetricsErr = NewMetrics(prometheus.DefaultRegisterer)
+	})
+	return defaultMetrics, defaultMetricsErr
+}
+
+// Instrument registers GORM callbacks recording query metrics for gdb and
+// starts exporting its connection pool statistics. name is used as the
+// value of the "db" label. Instrumenting another database with the same
+// name replaces the previous one in pool statistics.
+func (m *Metrics) Instrument(gdb *gorm.DB, name string) error {
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		return err
+	}
+
+	after := func(op string) func(*gorm.DB) {
+		return m.metricsAfter(name, op)
+	}
+	if err := registerCallbacks(gdb, "madmail:metrics", metricsBefore, after); err != nil {
+		return err
+	}
+
+	m.pools.add(name, sqlDB)
+	return nil
+}
+
+// metricsBefore stores the query start time in Statement.Settings directly
+// instead of using InstanceSet, which formats the key with fmt.Sprintf on
+// every call.
+func metricsBefore(db *gorm.DB) {
+	db.Statement.Settings.Store(metricsStartKey, time.Now())
+}
+
+func (m *Metrics) metricsAfter(name, op string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		v, ok := db.Statement.Settings.Load(metricsStartKey)
+		if !ok {
+			return
+		}
+		start := v.(time.Time)
+
+		table := db.Statement.Table
+		m.queryDuration.WithLabelValues(name, op, table).Observe(time.Since(start).Seconds())
+		if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			m.queryErrors.WithLabelValues(name, op, table).Inc()
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolCollector exports sql.DBStats of registered databases and the state
+// of circuit breakers, which are registered separately since they are
+// exported even if query metrics are disabled.
+type poolCollector struct {
+	openConns    *prometheus.Desc
+	inUseConns   *prometheus.Desc
+	idleConns    *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+	breakerOpen  *prometheus.Desc
+	breakerTrips *prometheus.Desc
+	activeHost   *prometheus.Desc
+	failovers    *prometheus.Desc
+	maintenance  *prometheus.Desc
+
+	lock     sync.Mutex
+	dbs      map[string]*sql.DB
+	breakers map[string]*breaker
+}
+
+func newPoolCollector() *poolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("maddy", "db", name), help, []string{"db"}, nil)
+	}
+	return &poolCollector{
+		openConns:    desc("open_connections", "Established connections both in use and idle"),
+		inUseConns:   desc("in_use_connections", "Connections currently in use"),
+		idleConns:    desc("idle_connections", "Idle connections"),
+		waitCount:    desc("wait_count_total", "Times a query had to wait for a free connection"),
+		waitDuration: desc("wait_duration_seconds_total", "Total time spent waiting for a free connection"),
+		breakerOpen:  desc("circuit_breaker_open", "Whether queries are rejected because the database is unreachable"),
+		breakerTrips: desc("circuit_breaker_trips_total", "Times the circuit breaker was opened"),
+		activeHost: prometheus.NewDesc(prometheus.BuildFQName("maddy", "db", "active_host"),
+			"Whether new connections are opened to the host first, for databases with multiple hosts", []string{"db", "host"}, nil),
+		failovers: desc("failovers_total", "Times new connections were opened to another host because the active one failed"),
+		maintenance: prometheus.NewDesc(prometheus.BuildFQName("maddy", "db", "sqlite_maintenance_last_run_timestamp_seconds"),
+			"Time a SQLite maintenance task last completed successfully at", []string{"db", "task"}, nil),
+		dbs:      make(map[string]*sql.DB),
+		breakers: make(map[string]*breaker),
+	}
+}
+
+func (c *poolCollector) add(name string, db *sql.DB) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dbs[name] = db
+}
+
+func (c *poolCollector) addBreaker(name string, b *breaker) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.breakers[name] = b
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.openConns
+	ch <- c.inUseConns
+	ch <- c.idleConns
+	ch <- c.waitCount
+	ch <- c.waitDuration
+	ch <- c.breakerOpen
+	ch <- c.breakerTrips
+	ch <- c.activeHost
+	ch <- c.failovers
+	ch <- c.maintenance
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for name, db := range c.dbs {
+		stats := db.Stats()
+		ch <- prometheus.MustNewConstMetric(c.openConns, prometheus.GaugeValue, float64(stats.OpenConnections), name)
+		ch <- prometheus.MustNewConstMetric(c.inUseConns, prometheus.GaugeValue, float64(stats.InUse), name)
+		ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stats.Idle), name)
+		ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount), name)
+		ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds(), name)
+
+		if st, ok := poolStates.Load(db); ok && st.(*poolState).failover != nil {
+			f := st.(*poolState).failover
+			active := f.active.Load()
+			for i, host := range f.hosts {
+				value := 0.0
+				if int32(i) == active {
+					value = 1
+				}
+				ch <- prometheus.MustNewConstMetric(c.activeHost, prometheus.GaugeValue, value, name, host.addr)
+			}
+			ch <- prometheus.MustNewConstMetric(c.failovers, prometheus.CounterValue, float64(f.failovers.Load()), name)
+		}
+		if st, ok := poolStates.Load(db); ok && st.(*poolState).maintenance != nil {
+			if run := st.(*poolState).maintenance.run.Load(); run != nil {
+				for task, t := range run.lastRuns() {
+					ch <- prometheus.MustNewConstMetric(c.maintenance, prometheus.GaugeValue, float64(t.Unix()), name, task)
+				}
+			}
+		}
+	}
+
+	for name, b := range c.breakers {
+		open := 0.0
+		if b.isOpen() {
+			open = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.breakerOpen, prometheus.GaugeValue, open, name)
+		ch <- prometheus.MustNewConstMetric(c.breakerTrips, prometheus.CounterValue, float64(b.trips.Load()), name)
+	}
+}
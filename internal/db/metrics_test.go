@@ -0,0 +1,220 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/gorm"
+)
+
+type metricsTestRecord struct {
+	ID   int
+	Name string
+}
+
+func gatherMetrics(t testing.TB, reg prometheus.Gatherer) map[string]*dto.MetricFamily {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string]*dto.MetricFamily, len(families))
+	for _, f := range families {
+		res[f.GetName()] = f
+	}
+	return res
+}
+
+// labelsMatch reports whether m has all labels from want.
+func labelsMatch(m *dto.Metric, want map[string]string) bool {
+	matched := 0
+	for _, l := range m.GetLabel() {
+		if v, ok := want[l.GetName()]; ok {
+			if v != l.GetValue() {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(want)
+}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewMetrics(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+		Log:         testutils.Logger(t, "db"),
+		Metrics:     m,
+		MetricsName: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		sqlDB, _ := gdb.DB()
+		sqlDB.Close()
+	}()
+
+	if err := gdb.AutoMigrate(&metricsTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Create(&metricsTestRecord{ID: 1, Name: "a"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	var rec metricsTestRecord
+	if err := gdb.First(&rec, 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Model(&rec).Update("name", "b").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Delete(&rec).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Exec("DELETE FROM metrics_test_records").Error; err != nil {
+		t.Fatal(err)
+	}
+	// Not found is not an error for metrics purposes.
+	gdb.First(&rec, 1)
+	gdb.Exec("SELECT * FROM nonexistent")
+
+	families := gatherMetrics(t, reg)
+
+	durations := families["maddy_db_query_duration_seconds"]
+	if durations == nil {
+		t.Fatal("no query duration metrics")
+	}
+	for _, op := range []string{"create", "query", "update", "delete"} {
+		found := false
+		for _, metric := range durations.GetMetric() {
+			if labelsMatch(metric, map[string]string{"db": "test", "operation": op, "table": "metrics_test_records"}) {
+				found = metric.GetHistogram().GetSampleCount() > 0
+			}
+		}
+		if !found {
+			t.Errorf("no duration samples for %s", op)
+		}
+	}
+
+	errs := families["maddy_db_query_errors_total"]
+	if errs == nil || len(errs.GetMetric()) != 1 {
+		t.Fatalf("expected a single error metric, got %v", errs)
+	}
+	if !labelsMatch(errs.GetMetric()[0], map[string]string{"db": "test", "operation": "raw"}) ||
+		errs.GetMetric()[0].GetCounter().GetValue() != 1 {
+		t.Errorf("unexpected error metric: %v", errs.GetMetric()[0])
+	}
+
+	open := families["maddy_db_open_connections"]
+	if open == nil || len(open.GetMetric()) != 1 || open.GetMetric()[0].GetGauge().GetValue() != 1 {
+		t.Errorf("unexpected open connections metric: %v", open)
+	}
+	for _, name := range []string{"maddy_db_in_use_connections", "maddy_db_idle_connections", "maddy_db_wait_count_total", "maddy_db_wait_duration_seconds_total"} {
+		if families[name] == nil {
+			t.Errorf("%s is not exported", name)
+		}
+	}
+}
+
+func TestMetrics_BreakerOnly(t *testing.T) {
+	gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+		Log:         testutils.Logger(t, "db"),
+		MetricsName: "breaker_only",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		sqlDB, _ := gdb.DB()
+		sqlDB.Close()
+	}()
+
+	families := gatherMetrics(t, prometheus.DefaultGatherer)
+	for _, name := range []string{"maddy_db_circuit_breaker_open", "maddy_db_circuit_breaker_trips_total"} {
+		found := false
+		for _, metric := range families[name].GetMetric() {
+			if labelsMatch(metric, map[string]string{"db": "breaker_only"}) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s is not exported", name)
+		}
+	}
+	for _, metric := range families["maddy_db_open_connections"].GetMetric() {
+		if labelsMatch(metric, map[string]string{"db": "breaker_only"}) {
+			t.Error("pool statistics are exported without metrics enabled")
+		}
+	}
+}
+
+// BenchmarkMetrics compares query latency with and without metrics
+// callbacks to show their per-query overhead. Compare ns/op of the
+// "instrumented" run to the "plain" one.
+func BenchmarkMetrics(b *testing.B) {
+	run := func(b *testing.B, m *Metrics) {
+		gdb, err := New("sqlite3", []string{filepath.Join(b.TempDir(), "bench.db")}, Options{
+			Metrics:     m,
+			MetricsName: "bench",
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer func() {
+			sqlDB, _ := gdb.DB()
+			sqlDB.Close()
+		}()
+		if err := gdb.AutoMigrate(&metricsTestRecord{}); err != nil {
+			b.Fatal(err)
+		}
+		if err := gdb.Create(&metricsTestRecord{ID: 1, Name: "a"}).Error; err != nil {
+			b.Fatal(err)
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		var rec metricsTestRecord
+		for i := 0; i < b.N; i++ {
+			if err := gdb.First(&rec, 1).Error; err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("plain", func(b *testing.B) {
+		run(b, nil)
+	})
+	b.Run("instrumented", func(b *testing.B) {
+		m, err := NewMetrics(prometheus.NewRegistry())
+		if err != nil {
+			b.Fatal(err)
+		}
+		run(b, m)
+	})
+	b.Run("callbacks", func(b *testing.B) {
+		// Callback cost alone, without the query itself.
+		m, err := NewMetrics(prometheus.NewRegistry())
+		if err != nil {
+			b.Fatal(err)
+		}
+		after := m.metricsAfter("bench", "query")
+		db := &gorm.DB{Statement: &gorm.Statement{Table: "metrics_test_records"}}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			metricsBefore(db)
+			after(db)
+		}
+	})
+}
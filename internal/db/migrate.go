@@ -0,0 +1,355 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"gorm.io/plugin/dbresolver"
+)
+
+const (
+	// MigrationsTable is the name of the table that records applied
+	// migrations.
+	MigrationsTable = "schema_migrations"
+
+	migrationLockTimeout = time.Minute
+	migrationLockPoll    = 500 * time.Millisecond
+)
+
+// Migration is a single versioned schema change.
+//
+// Migrations are identified by ID and applied in the order they are passed
+// to Migrate. IDs must never change once released, a common convention is
+// to prefix them with the date, e.g. "20240101_create_quotas".
+type Migration struct {
+	ID string
+
+	// Up applies the change. It is run inside a transaction if the database
+	// supports transactional DDL.
+	Up func(tx *gorm.DB) error
+
+	// Down reverts the change. It may be nil if the migration cannot be
+	// reverted.
+	Down func(tx *gorm.DB) error
+}
+
+// AppliedMigration is a row of the schema_migrations table.
+type AppliedMigration struct {
+	ID        string    `gorm:"primaryKey;size:191"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// TableName implements schema.TablerWithNamer so that
+// Options.TablePrefix is applied.
+func (AppliedMigration) TableName(namer schema.Namer) string {
+	return tablePrefix(namer) + MigrationsTable
+}
+
+// transactionalDDL reports whether schema changes can be rolled back as a
+// part of a transaction. MySQL implicitly commits on most DDL statements.
+func transactionalDDL(gdb *gorm.DB) bool {
+	return gdb.Dialector.Name() != "mysql"
+}
+
+func validateMigrations(migrations []Migration) error {
+	seen := make(map[string]bool, len(migrations))
+	for i, m := range migrations {
+		if m.ID == "" {
+			return fmt.Errorf("migration #%d has empty ID", i)
+		}
+		if seen[m.ID] {
+			return fmt.Errorf("duplicate migration ID: %s", m.ID)
+		}
+		if m.Up == nil {
+			return fmt.Errorf("migration %s has no Up function", m.ID)
+		}
+		seen[m.ID] = true
+	}
+	return nil
+}
+
+// Migrate applies migrations that are not recorded in the schema_migrations
+// table yet, in the order they are listed.
+//
+// Each migration is applied in its own transaction (on databases that
+// support transactional DDL) together with the schema_migrations record, so
+// a failed migration leaves no trace and is retried on the next start.
+//
+// Concurrently started server instances sharing the database are
+// serialized using a lock: an advisory lock on PostgreSQL and MySQL, an
+// application lock on SQL Server and a lock table on SQLite.
+//
+// If the database was opened with Options.ManualMigrations, nothing is
+// applied. Instead, Migrate waits for the migrations to be applied using
+// "maddy db migrate", retrying CheckSchema the same way NewWithContext
+// retries connecting, and returns *SchemaError if they are not.
+func Migrate(gdb *gorm.DB, migrations []Migration) error {
+	if sqlDB, err := gdb.DB(); err == nil {
+		if st := stateFor(sqlDB); st.connectOpts.ManualMigrations {
+			if SkipStartupCheck {
+				return nil
+			}
+			if err := validateMigrations(migrations); err != nil {
+				return err
+			}
+			return waitForSchema(gdb, st, migrations)
+		}
+	}
+	_, err := MigrateTo(gdb, migrations, "")
+	return err
+}
+
+// MigrateTo is like Migrate but stops after the migration with the target
+// ID is applied. Empty target applies all migrations.
+//
+// IDs of the migrations applied successfully are returned even if an error
+// is returned.
+func MigrateTo(gdb *gorm.DB, migrations []Migration, target string) ([]string, error) {
+	if err := validateMigrations(migrations); err != nil {
+		return nil, err
+	}
+	if target != "" && indexOfMigration(migrations, target) == -1 {
+		return nil, fmt.Errorf("unknown migration: %s", target)
+	}
+
+	unlock, err := lockMigrations(gdb)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := gdb.AutoMigrate(&AppliedMigration{}); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", MigrationsTable, err)
+	}
+
+	applied, err := appliedMigrations(gdb)
+	if err != nil {
+		return nil, err
+	}
+
+	if target != "" {
+		migrations = migrations[:indexOfMigration(migrations, target)+1]
+	}
+	var done []string
+	for _, m := range pendingMigrations(applied, migrations) {
+		if err := applyMigration(gdb, m); err != nil {
+			return done, fmt.Errorf("migration %s failed: %w", m.ID, err)
+		}
+		done = append(done, m.ID)
+	}
+	return done, nil
+}
+
+// Rollback reverts the last steps applied migrations from the list, in
+// reverse order, using their Down functions. Applied migrations that are
+// not in the list, e.g. migrations of other modules sharing the database,
+// are not considered.
+//
+// Nothing is reverted if any of the selected migrations has no Down
+// function. IDs of the migrations reverted successfully are returned even
+// if an error is returned.
+func Rollback(gdb *gorm.DB, migrations []Migration, steps int) ([]string, error) {
+	if err := validateMigrations(migrations); err != nil {
+		return nil, err
+	}
+	if steps <= 0 {
+		return nil, fmt.Errorf("number of migrations to revert should be positive")
+	}
+	if !gdb.Migrator().HasTable(&AppliedMigration{}) {
+		return nil, nil
+	}
+
+	unlock, err := lockMigrations(gdb)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := appliedMigrations(gdb)
+	if err != nil {
+		return nil, err
+	}
+	appliedSet := make(map[string]bool, len(applied))
+	for _, a := range applied {
+		appliedSet[a.ID] = true
+	}
+
+	var revert []Migration
+	for i := len(migrations) - 1; i >= 0 && len(revert) < steps; i-- {
+		if appliedSet[migrations[i].ID] {
+			revert = append(revert, migrations[i])
+		}
+	}
+	for _, m := range revert {
+		if m.Down == nil {
+			return nil, fmt.Errorf("migration %s cannot be reverted: it has no Down function", m.ID)
+		}
+	}
+
+	var done []string
+	for _, m := range revert {
+		if err := revertMigration(gdb, m); err != nil {
+			return done, fmt.Errorf("rollback of migration %s failed: %w", m.ID, err)
+		}
+		done = append(done, m.ID)
+	}
+	return done, nil
+}
+
+func indexOfMigration(migrations []Migration, id string) int {
+	for i, m := range migrations {
+		if m.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func applyMigration(gdb *gorm.DB, m Migration) error {
+	record := func(tx *gorm.DB) error {
+		return tx.Create(&AppliedMigration{ID: m.ID, AppliedAt: time.Now().UTC()}).Error
+	}
+
+	if !transactionalDDL(gdb) {
+		if err := m.Up(gdb); err != nil {
+			return err
+		}
+		return record(gdb)
+	}
+	return gdb.Transaction(func(tx *gorm.DB) error {
+		if err := m.Up(tx); err != nil {
+			return err
+		}
+		return record(tx)
+	})
+}
+
+func revertMigration(gdb *gorm.DB, m Migration) error {
+	unrecord := func(tx *gorm.DB) error {
+		return tx.Where("id = ?", m.ID).Delete(&AppliedMigration{}).Error
+	}
+
+	if !transactionalDDL(gdb) {
+		if err := m.Down(gdb); err != nil {
+			return err
+		}
+		return unrecord(gdb)
+	}
+	return gdb.Transaction(func(tx *gorm.DB) error {
+		if err := m.Down(tx); err != nil {
+			return err
+		}
+		return unrecord(tx)
+	})
+}
+
+// appliedMigrations returns all rows of the schema_migrations table ordered
+// by ID.
+func appliedMigrations(gdb *gorm.DB) ([]AppliedMigration, error) {
+	var rows []AppliedMigration
+	// Replicas may lag behind, always read from the primary.
+	if err := gdb.Clauses(dbresolver.Write).Order("id").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", MigrationsTable, err)
+	}
+	return rows, nil
+}
+
+func pendingMigrations(applied []AppliedMigration, migrations []Migration) []Migration {
+	appliedSet := make(map[string]bool, len(applied))
+	for _, a := range applied {
+		appliedSet[a.ID] = true
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if !appliedSet[m.ID] {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// MigrationStatus returns migrations recorded as applied (ordered by ID),
+// and migrations from the list that are not applied yet (in the list
+// order).
+//
+// Applied may include IDs that are not in migrations, e.g. if the database
+// was used by a newer server version.
+func MigrationStatus(gdb *gorm.DB, migrations []Migration) (applied []AppliedMigration, pending []Migration, err error) {
+	if err := validateMigrations(migrations); err != nil {
+		return nil, nil, err
+	}
+
+	if !gdb.Migrator().HasTable(&AppliedMigration{}) {
+		return nil, migrations, nil
+	}
+
+	applied, err = appliedMigrations(gdb)
+	if err != nil {
+		return nil, nil, err
+	}
+	return applied, pendingMigrations(applied, migrations), nil
+}
+
+// lockMigrations acquires the migration lock, waiting up to
+// migrationLockTimeout for other instances to release it.
+func lockMigrations(gdb *gorm.DB) (unlock func(), err error) {
+	ctx := gdb.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, migrationLockTimeout)
+	defer cancel()
+
+	var l migrationLock
+	switch gdb.Dialector.Name() {
+	case "sqlite":
+		l = &tableLock{db: gdb, table: TableName(gdb, migrationLockTable)}
+	case "postgres", "mysql", "sqlserver":
+		sqlDB, err := gdb.DB()
+		if err != nil {
+			return nil, err
+		}
+		if err := requireSpareConn(sqlDB); err != nil {
+			return nil, err
+		}
+		// Session-level locks are held by a connection, keep it out of
+		// the pool until the lock is released.
+		conn, err := sqlDB.Conn(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		// Instances using different table prefixes have separate
+		// migration tables and do not need to wait for each other.
+		l = &sessionLock{dialect: gdb.Dialector.Name(), conn: conn, name: "madmail." + TableName(gdb, MigrationsTable)}
+	default:
+		return nil, fmt.Errorf("migrations are not supported for %s", gdb.Dialector.Name())
+	}
+
+	for {
+		ok, err := l.tryLock(ctx)
+		if err != nil {
+			l.close()
+			return nil, fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		if ok {
+			return func() {
+				l.unlock()
+				l.close()
+			}, nil
+		}
+
+		select {
+		case <-time.After(migrationLockPoll):
+		case <-ctx.Done():
+			l.close()
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, fmt.Errorf("timed out waiting for migration lock held by another instance")
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
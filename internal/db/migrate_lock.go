@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	migrationLockTable = "schema_migrations_lock"
+
+	// migrationLockStale is the age after which the SQLite lock table entry
+	// is considered to be left by a crashed process and is removed.
+	migrationLockStale = 10 * time.Minute
+
+	migrationUnlockTimeout = 5 * time.Second
+)
+
+type migrationLock interface {
+	// tryLock attempts to acquire the lock without waiting. It returns false
+	// if the lock is held by somebody else.
+	tryLock(ctx context.Context) (bool, error)
+	unlock()
+	close()
+}
+
+// sessionLock uses locks tied to the database session (connection), which
+// are released by the server automatically if the process dies.
+type sessionLock struct {
+	dialect string
+	conn    *sql.Conn
+	name    string
+}
+
+func (l *sessionLock) tryLock(ctx context.Context) (bool, error) {
+	var query string
+	switch l.dialect {
+	case "postgres":
+		query = `SELECT CASE WHEN pg_try_advisory_lock(hashtext($1)) THEN 1 ELSE 0 END`
+	case "mysql":
+		query = `SELECT GET_LOCK(?, 0)`
+	case "sqlserver":
+		query = `DECLARE @r int;
+EXEC @r = sp_getapplock @Resource = @p1, @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = 0;
+SELECT @r`
+	}
+
+	var res sql.NullInt64
+	if err := l.conn.QueryRowContext(ctx, query, l.name).Scan(&res); err != nil {
+		return false, err
+	}
+	if l.dialect == "sqlserver" {
+		// 0 and 1 mean success, negative values mean timeout or error.
+		return res.Valid && res.Int64 >= 0, nil
+	}
+	return res.Valid && res.Int64 == 1, nil
+}
+
+func (l *sessionLock) unlock() {
+	var query string
+	switch l.dialect {
+	case "postgres":
+		query = `SELECT pg_advisory_unlock(hashtext($1))`
+	case "mysql":
+		query = `SELECT RELEASE_LOCK(?)`
+	case "sqlserver":
+		query = `EXEC sp_releaseapplock @Resource = @p1, @LockOwner = 'Session'`
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrationUnlockTimeout)
+	defer cancel()
+	if _, err := l.conn.ExecContext(ctx, query, l.name); err != nil {
+		// Make sure the connection is not returned to the pool still holding
+		// the lock.
+		_ = l.conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+}
+
+func (l *sessionLock) close() {
+	l.conn.Close()
+}
+
+// tableLock is used for SQLite, which has no locks that outlive a
+// transaction. The lock is a row in the schema_migrations_lock table.
+type tableLock struct {
+	db     *gorm.DB
+	table  string
+	holder string
+}
+
+func (l *tableLock) tryLock(ctx context.Context) (bool, error) {
+	tx := l.db.WithContext(ctx)
+	if l.holder == "" {
+		host, _ := os.Hostname()
+		l.holder = fmt.Sprintf("%s:%d", host, os.Getpid())
+
+		err := tx.Exec(`CREATE TABLE IF NOT EXISTS ` + l.table + ` (
+			id INTEGER PRIMARY KEY,
+			holder TEXT NOT NULL,
+			locked_at INTEGER NOT NULL
+		)`).Error
+		if err != nil {
+			return false, err
+		}
+	}
+
+	now := time.Now()
+	res := tx.Exec(`INSERT OR IGNORE INTO `+l.table+` (id, holder, locked_at) VALUES (1, ?, ?)`,
+		l.holder, now.Unix())
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 1 {
+		return true, nil
+	}
+
+	// Remove the lock left by a process that crashed during migration, it
+	// will be acquired on the next attempt.
+	err := tx.Exec(`DELETE FROM `+l.table+` WHERE id = 1 AND locked_at < ?`,
+		now.Add(-migrationLockStale).Unix()).Error
+	return false, err
+}
+
+func (l *tableLock) unlock() {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationUnlockTimeout)
+	defer cancel()
+	l.db.WithContext(ctx).Exec(`DELETE FROM `+l.table+` WHERE id = 1 AND holder = ?`, l.holder)
+}
+
+func (l *tableLock) close() {}
+
+// requireSpareConn checks that the pool allows a connection for migrations
+// in addition to the one holding the session-level lock, otherwise
+// migrations would wait for the lock connection forever.
+func requireSpareConn(sqlDB *sql.DB) error {
+	if sqlDB.Stats().MaxOpenConnections == 1 {
+		return errors.New("max_open_conns should be at least 2 to apply schema migrations")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package db
+
+import "sync"
+
+var (
+	registeredMigrations     = make(map[string][]Migration)
+	registeredMigrationsLock sync.RWMutex
+)
+
+// RegisterMigrations makes migrations applied by the module with the
+// specified name available to the "db" management commands, which open
+// the database without initializing the module.
+//
+// modName must be unique. RegisterMigrations panics if migrations for the
+// module are already registered. It should be called from func init() of
+// the module package, next to module.Register.
+func RegisterMigrations(modName string, migrations []Migration) {
+	registeredMigrationsLock.Lock()
+	defer registeredMigrationsLock.Unlock()
+
+	if _, ok := registeredMigrations[modName]; ok {
+		panic("RegisterMigrations: migrations are already registered for module: " + modName)
+	}
+	if err := validateMigrations(migrations); err != nil {
+		panic("RegisterMigrations: " + modName + ": " + err.Error())
+	}
+	registeredMigrations[modName] = migrations
+}
+
+// RegisteredMigrations returns migrations registered for the module using
+// RegisterMigrations.
+func RegisteredMigrations(modName string) ([]Migration, bool) {
+	registeredMigrationsLock.RLock()
+	defer registeredMigrationsLock.RUnlock()
+
+	migrations, ok := registeredMigrations[modName]
+	return migrations, ok
+}
@@ -0,0 +1,333 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/gorm"
+)
+
+type migrateTestA struct {
+	ID   int
+	Name string
+}
+
+type migrateTestB struct {
+	ID int
+}
+
+func testMigrations(calls *int32) []Migration {
+	return []Migration{
+		{
+			ID: "001_a",
+			Up: func(tx *gorm.DB) error {
+				atomic.AddInt32(calls, 1)
+				return tx.Migrator().CreateTable(&migrateTestA{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&migrateTestA{})
+			},
+		},
+		{
+			ID: "002_b",
+			Up: func(tx *gorm.DB) error {
+				atomic.AddInt32(calls, 1)
+				return tx.Migrator().CreateTable(&migrateTestB{})
+			},
+		},
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	gdb := openTestDB(t)
+	var calls int32
+	migrations := testMigrations(&calls)
+
+	applied, pending, err := MigrationStatus(gdb, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 || len(pending) != 2 {
+		t.Fatalf("unexpected status before Migrate: applied=%v pending=%d", applied, len(pending))
+	}
+
+	if err := Migrate(gdb, migrations[:1]); err != nil {
+		t.Fatal(err)
+	}
+	applied, pending, err = MigrationStatus(gdb, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0].ID != "001_a" || applied[0].AppliedAt.IsZero() {
+		t.Fatalf("unexpected applied list: %v", applied)
+	}
+	if len(pending) != 1 || pending[0].ID != "002_b" {
+		t.Fatalf("unexpected pending list: %v", pending)
+	}
+
+	if err := Migrate(gdb, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(gdb, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected each migration to be applied once, got %d calls", calls)
+	}
+	if !gdb.Migrator().HasTable(&migrateTestB{}) {
+		t.Error("migration 002_b was not applied")
+	}
+	if gdb.Migrator().HasTable(migrationLockTable) {
+		var count int64
+		gdb.Table(migrationLockTable).Count(&count)
+		if count != 0 {
+			t.Error("migration lock was not released")
+		}
+	}
+}
+
+func TestMigrate_Failed(t *testing.T) {
+	gdb := openTestDB(t)
+
+	errFail := errors.New("fail")
+	migrations := []Migration{{
+		ID: "001_fail",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().CreateTable(&migrateTestA{}); err != nil {
+				return err
+			}
+			return errFail
+		},
+	}}
+	if err := Migrate(gdb, migrations); !errors.Is(err, errFail) {
+		t.Fatal("expected migration error, got", err)
+	}
+	if gdb.Migrator().HasTable(&migrateTestA{}) {
+		t.Error("failed migration was not rolled back")
+	}
+	_, pending, err := MigrationStatus(gdb, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Error("failed migration is recorded as applied")
+	}
+}
+
+func TestMigrate_Manual(t *testing.T) {
+	gdb, err := NewWithContext(context.Background(), "sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+		Log:              testutils.Logger(t, "db"),
+		ConnectAttempts:  2,
+		ManualMigrations: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Close(context.Background(), gdb) })
+	var calls int32
+	migrations := testMigrations(&calls)
+
+	var schemaErr *SchemaError
+	if err := Migrate(gdb, migrations); !errors.As(err, &schemaErr) {
+		t.Fatal("expected schema error, got", err)
+	}
+	if schemaErr.Version != 0 || schemaErr.Required != 2 || calls != 0 {
+		t.Errorf("unexpected error: %v (%d calls)", schemaErr, calls)
+	}
+
+	if _, err := MigrateTo(gdb, migrations, "001_a"); err != nil {
+		t.Fatal(err)
+	}
+	err = Migrate(gdb, migrations)
+	if !errors.As(err, &schemaErr) || schemaErr.Version != 1 || !strings.Contains(err.Error(), "run maddy db migrate") {
+		t.Fatal("expected schema error, got", err)
+	}
+
+	SkipStartupCheck = true
+	err = Migrate(gdb, migrations)
+	SkipStartupCheck = false
+	if err != nil {
+		t.Fatal("schema was checked with SkipStartupCheck:", err)
+	}
+
+	if _, err := MigrateTo(gdb, migrations, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(gdb, migrations); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateTo(t *testing.T) {
+	gdb := openTestDB(t)
+	var calls int32
+	migrations := testMigrations(&calls)
+
+	if _, err := MigrateTo(gdb, migrations, "003_unknown"); err == nil {
+		t.Fatal("expected an error for an unknown target")
+	}
+	applied, err := MigrateTo(gdb, migrations, "001_a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0] != "001_a" {
+		t.Fatalf("unexpected applied list: %v", applied)
+	}
+	if gdb.Migrator().HasTable(&migrateTestB{}) {
+		t.Error("migration after the target was applied")
+	}
+	applied, err = MigrateTo(gdb, migrations, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0] != "002_b" {
+		t.Fatalf("unexpected applied list: %v", applied)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	gdb := openTestDB(t)
+	var calls int32
+	migrations := testMigrations(&calls)
+
+	if err := Migrate(gdb, migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	// 002_b has no Down function.
+	if _, err := Rollback(gdb, migrations, 2); err == nil {
+		t.Fatal("expected an error for an irreversible migration")
+	}
+	if !gdb.Migrator().HasTable(&migrateTestA{}) {
+		t.Error("migration was reverted despite the error")
+	}
+
+	reverted, err := Rollback(gdb, migrations[:1], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != 1 || reverted[0] != "001_a" {
+		t.Fatalf("unexpected reverted list: %v", reverted)
+	}
+	if gdb.Migrator().HasTable(&migrateTestA{}) {
+		t.Error("migration 001_a was not reverted")
+	}
+	_, pending, err := MigrationStatus(gdb, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].ID != "001_a" {
+		t.Fatalf("unexpected pending list: %v", pending)
+	}
+
+	reverted, err = Rollback(gdb, migrations[:1], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != 0 {
+		t.Errorf("unexpected reverted list: %v", reverted)
+	}
+}
+
+func TestMigrate_Invalid(t *testing.T) {
+	gdb := openTestDB(t)
+	noop := func(*gorm.DB) error { return nil }
+
+	for _, migrations := range [][]Migration{
+		{{ID: "", Up: noop}},
+		{{ID: "a", Up: noop}, {ID: "a", Up: noop}},
+		{{ID: "a"}},
+	} {
+		if err := Migrate(gdb, migrations); err == nil {
+			t.Errorf("expected an error for %v", migrations)
+		}
+	}
+}
+
+func TestMigrate_Concurrent(t *testing.T) {
+	path := filepath.Join(testutils.Dir(t), "test.db")
+
+	var calls int32
+	migrations := testMigrations(&calls)
+	// Make the first migration slow enough for the instances to overlap.
+	up := migrations[0].Up
+	migrations[0].Up = func(tx *gorm.DB) error {
+		time.Sleep(100 * time.Millisecond)
+		return up(tx)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		// Separate handles imitate separate server processes.
+		gdb, err := New("sqlite3", []string{path}, Options{Log: testutils.Logger(t, "db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if sqlDB, err := gdb.DB(); err == nil {
+				sqlDB.Close()
+			}
+		})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := Migrate(gdb, migrations); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 2 {
+		t.Errorf("expected each migration to be applied once, got %d calls", calls)
+	}
+}
+
+func TestMigrate_StaleLock(t *testing.T) {
+	gdb := openTestDB(t)
+
+	l := &tableLock{db: gdb, table: migrationLockTable}
+	if ok, err := l.tryLock(gdb.Statement.Context); err != nil || !ok {
+		t.Fatal("failed to acquire lock:", ok, err)
+	}
+	// Pretend the holder crashed long ago.
+	err := gdb.Exec(`UPDATE `+migrationLockTable+` SET holder = 'crashed', locked_at = ?`,
+		time.Now().Add(-2*migrationLockStale).Unix()).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+	if err := Migrate(gdb, testMigrations(&calls)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected migrations to be applied, got %d calls", calls)
+	}
+}
+
+func TestRequireSpareConn(t *testing.T) {
+	sqlDB, err := openTestDB(t).DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	if err := requireSpareConn(sqlDB); err == nil {
+		t.Error("expected an error for a single connection pool")
+	}
+	sqlDB.SetMaxOpenConns(2)
+	if err := requireSpareConn(sqlDB); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
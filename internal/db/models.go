@@ -5,9 +5,13 @@ import (
 )
 
 // Quota represents the quotas table.
+//
+// MaxStorage and MaxMessages limit the total size and count of messages
+// stored for the account, zero means no limit.
 type Quota struct {
 	Username     string `gorm:"primaryKey"`
 	MaxStorage   int64
+	MaxMessages  int64
 	CreatedAt    int64
 	FirstLoginAt int64
 }
@@ -25,3 +29,373 @@ type TableEntry struct {
 	Key   string `gorm:"primaryKey"`
 	Value string `gorm:"not null"`
 }
+
+// Account represents the accounts table used by auth.sql.
+//
+// Username is the normalized local part of the address, PasswordHash is
+// interpreted according to Algorithm and includes the hash parameters.
+type Account struct {
+	ID           uint   `gorm:"primaryKey"`
+	Username     string `gorm:"size:255;not null;index:,unique,composite:username_domain"`
+	Domain       string `gorm:"size:255;not null;index:,unique,composite:username_domain"`
+	PasswordHash string `gorm:"not null"`
+	Algorithm    string `gorm:"size:32;not null"`
+	Enabled      bool   `gorm:"not null"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// AppPassword represents the app_passwords table used by auth.sql.
+//
+// Hash is the bcrypt hash of a generated token that can be used instead of
+// the account password. Prefix is the beginning of the token, it is stored
+// in clear text so that the hash of only one row is checked at login. Scope
+// limits the token to "imap" or "submission", empty Scope allows both.
+// LastUsedAt is updated at most once per hour.
+type AppPassword struct {
+	ID         uint   `gorm:"primaryKey"`
+	AccountID  uint   `gorm:"not null;index"`
+	Label      string `gorm:"size:255;not null"`
+	Prefix     string `gorm:"size:16;not null;default:''"`
+	Hash       string `gorm:"not null"`
+	Scope      string `gorm:"size:16;not null;default:''"`
+	Revoked    bool   `gorm:"not null;default:false"`
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// TOTPSecret represents the totp_secrets table used by auth.sql for
+// two-factor authentication.
+//
+// Secret is the base32-encoded shared secret, encrypted using
+// db_encryption_key. Codes are checked only once Enabled is set by
+// confirming the enrollment. Mode is "always" or "untrusted" (the code is
+// required only for clients outside of trusted networks). LastCounter is the
+// time step of the last accepted code, codes for it and earlier steps are
+// rejected.
+//
+// PendingSecret and PendingMode are set if the account is enrolled again
+// while TOTP is enabled. They replace Secret and Mode once confirmed, the
+// old secret is used until then.
+type TOTPSecret struct {
+	ID            uint   `gorm:"primaryKey"`
+	AccountID     uint   `gorm:"not null;uniqueIndex"`
+	Secret        string `gorm:"serializer:encrypted;not null"`
+	Digits        int    `gorm:"not null"`
+	Period        int    `gorm:"not null"`
+	Mode          string `gorm:"size:16;not null"`
+	Enabled       bool   `gorm:"not null;default:false"`
+	ConfirmedAt   *time.Time
+	LastCounter   int64  `gorm:"not null;default:0"`
+	PendingSecret string `gorm:"serializer:encrypted"`
+	PendingMode   string `gorm:"size:16"`
+	CreatedAt     time.Time
+}
+
+// TOTPRecoveryCode represents the totp_recovery_codes table used by
+// auth.sql. Hash is the bcrypt hash of a single-use code generated at TOTP
+// enrollment, UsedAt is set once it is used. Pending codes belong to
+// TOTPSecret.PendingSecret and cannot be used until it is confirmed.
+type TOTPRecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	AccountID uint   `gorm:"not null;index"`
+	Hash      string `gorm:"not null"`
+	Pending   bool   `gorm:"not null;default:false"`
+	UsedAt    *time.Time
+}
+
+// Alias represents the aliases table used by table.sql_aliases.
+//
+// Source is the local part of the aliased address or "*" for a catch-all
+// alias of the domain. Several rows with the same source fan out the message
+// to all destinations, ordered by Priority.
+type Alias struct {
+	ID          uint   `gorm:"primaryKey"`
+	Source      string `gorm:"size:255;not null;index:idx_aliases_source,composite:source_domain"`
+	Domain      string `gorm:"size:255;not null;index:idx_aliases_source,composite:source_domain"`
+	Destination string `gorm:"size:255;not null"`
+	Priority    int    `gorm:"not null;default:0"`
+	Enabled     bool   `gorm:"not null;default:true"`
+}
+
+// Domain represents the domains table used by table.sql_domains.
+//
+// Mail is accepted only for enabled domains. CatchAll is the destination for
+// addresses of the domain that have no mailbox or alias. DKIMSelector
+// selects the dkim_keys row used to sign messages from the domain instead of
+// the active one. DefaultQuota is the storage quota in bytes for accounts
+// created in the domain, zero means the storage default.
+type Domain struct {
+	ID           uint    `gorm:"primaryKey"`
+	Name         string  `gorm:"size:255;not null;uniqueIndex"`
+	Enabled      bool    `gorm:"not null"`
+	CatchAll     *string `gorm:"size:320"`
+	DKIMSelector string  `gorm:"size:63;not null;default:''"`
+	DefaultQuota int64   `gorm:"not null;default:0"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// DKIMKey represents the dkim_keys table used by modify.dkim.
+//
+// PrivateKey is the PKCS #8 PEM-encoded key, it is encrypted using
+// db_encryption_key. Algorithm is the newkey_algo value the key was
+// generated with. At most one key of the domain is active. RetiredAt is set
+// when the key is replaced by a newer one, the key is removed after a grace
+// period.
+type DKIMKey struct {
+	ID         uint   `gorm:"primaryKey"`
+	Domain     string `gorm:"size:255;not null;index:,unique,composite:domain_selector"`
+	Selector   string `gorm:"size:63;not null;index:,unique,composite:domain_selector"`
+	PrivateKey string `gorm:"serializer:encrypted;not null"`
+	Algorithm  string `gorm:"size:16;not null"`
+	Active     bool   `gorm:"not null;default:false"`
+	CreatedAt  time.Time
+	RetiredAt  *time.Time
+}
+
+// QueueEntry represents the queue_entries table used by target.queue with
+// a database. An entry is a message waiting for delivery, claimed by one
+// server at a time.
+//
+// ClaimedBy and ClaimedUntil are set while a server is delivering the
+// message. Entries whose claim expired are claimed again, e.g. if the
+// server crashed during the delivery.
+type QueueEntry struct {
+	ID            string    `gorm:"primaryKey;size:128"`
+	Queue         string    `gorm:"size:128;not null;index:idx_queue_entries_due,priority:1"`
+	MailFrom      string    `gorm:"size:320;not null"`
+	MsgMeta       []byte    `gorm:"not null"`
+	NextAttemptAt time.Time `gorm:"not null;index:idx_queue_entries_due,priority:2"`
+	Attempts      int       `gorm:"not null;default:0"`
+	CreatedAt     time.Time
+	LastAttemptAt *time.Time
+	ClaimedBy     string `gorm:"size:128;not null;default:''"`
+	ClaimedUntil  *time.Time
+}
+
+// QueueRecipient represents the queue_recipients table, the delivery status
+// of each recipient of a QueueEntry.
+//
+// Status is "pending", "delivered" or "failed". LastError, LastErrorCode
+// and LastErrorEnhanced describe the last failed attempt and are used in
+// bounce messages.
+type QueueRecipient struct {
+	ID                uint   `gorm:"primaryKey"`
+	EntryID           string `gorm:"size:128;not null;index"`
+	Rcpt              string `gorm:"size:320;not null"`
+	Status            string `gorm:"size:16;not null"`
+	Attempts          int    `gorm:"not null;default:0"`
+	LastError         string
+	LastErrorCode     int
+	LastErrorEnhanced string `gorm:"size:16"`
+	UpdatedAt         time.Time
+}
+
+// QueueBody represents the queue_bodies table, the message of a QueueEntry.
+//
+// The body is stored in QueueBodyChunk rows, Body is set only for entries
+// queued by older versions.
+type QueueBody struct {
+	EntryID string `gorm:"primaryKey;size:128"`
+	Header  []byte `gorm:"not null"`
+	Body    []byte `gorm:"not null"`
+}
+
+// QueueBodyChunk represents the queue_body_chunks table. Message bodies are
+// split into chunks numbered by Seq from zero so that they are written and
+// read without keeping the whole message in memory.
+type QueueBodyChunk struct {
+	EntryID string `gorm:"primaryKey;size:128"`
+	Seq     int    `gorm:"primaryKey;autoIncrement:false"`
+	Data    []byte `gorm:"not null"`
+}
+
+// GreylistEntry represents the greylist_entries table used by check.greylist.
+//
+// Network is the client network (/24 for IPv4, /64 for IPv6 by default) in
+// CIDR notation, MailFrom and RcptTo are normalized addresses. Passes counts
+// attempts accepted after the greylisting delay; triplets that were never
+// retried have Passes = 0.
+type GreylistEntry struct {
+	ID        uint      `gorm:"primaryKey"`
+	Network   string    `gorm:"size:64;not null;index:,unique,composite:triplet"`
+	MailFrom  string    `gorm:"size:320;not null;index:,unique,composite:triplet;index"`
+	RcptTo    string    `gorm:"size:320;not null;index:,unique,composite:triplet"`
+	FirstSeen time.Time `gorm:"not null"`
+	LastSeen  time.Time `gorm:"not null;index"`
+	Passes    int       `gorm:"not null;default:0"`
+}
+
+// RateLimitCounter represents the rate_limit_counters table used by
+// check.rate_limit. Each row counts events of Kind ("connections",
+// "auth_failures" or "messages") for the Value of Dimension ("ip", "user" or
+// "sender_domain") in the bucket of WindowSeconds starting at BucketStart.
+type RateLimitCounter struct {
+	ID            uint      `gorm:"primaryKey"`
+	Kind          string    `gorm:"size:32;not null;index:,unique,composite:counter"`
+	Dimension     string    `gorm:"size:16;not null;index:,unique,composite:counter"`
+	Value         string    `gorm:"size:320;not null;index:,unique,composite:counter"`
+	WindowSeconds int64     `gorm:"not null;index:,unique,composite:counter"`
+	BucketStart   time.Time `gorm:"not null;index:,unique,composite:counter;index"`
+	Count         int64     `gorm:"not null;default:0"`
+}
+
+// RateLimitOverride represents the rate_limit_overrides table used by
+// check.rate_limit to change limits for specific values of a dimension,
+// e.g. the IP address of a trusted client.
+//
+// Kind is the event kind the override applies to, empty for all kinds.
+// MaxCount replaces the configured limits, 0 disables limits for the value.
+type RateLimitOverride struct {
+	ID        uint   `gorm:"primaryKey"`
+	Kind      string `gorm:"size:32;not null;default:'';index:,unique,composite:override"`
+	Dimension string `gorm:"size:16;not null;index:,unique,composite:override"`
+	Value     string `gorm:"size:320;not null;index:,unique,composite:override"`
+	MaxCount  int64  `gorm:"not null;default:0"`
+	Comment   string
+	CreatedAt time.Time
+}
+
+// Suppression represents the suppressions table used by target.remote to
+// refuse delivery to addresses that hard-bounced before.
+//
+// Address is either a normalized address or a domain, in which case
+// all addresses of the domain are suppressed. BounceCode is the SMTP
+// reply code of the bounce that created the entry, if any. Entries with
+// ExpiresAt in the past are ignored.
+type Suppression struct {
+	ID         uint   `gorm:"primaryKey"`
+	Address    string `gorm:"size:320;not null;uniqueIndex"`
+	Reason     string
+	BounceCode string `gorm:"size:32"`
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time `gorm:"index"`
+}
+
+// RoutingRule represents the routing_rules table used by target.remote to
+// choose how messages are relayed.
+//
+// MatchType is "rcpt_domain" or "sender_domain", Pattern is a normalized
+// domain, "*.domain" to match its subdomains or "*" to match any domain.
+// Action is "direct" for delivery to the MX of the recipient domain or
+// "smarthost" to relay via Smarthost (host:port), authenticating as
+// AuthUsername if it is set. AuthPassword is encrypted using
+// db_encryption_key. The matching rule with the highest Priority is used,
+// the oldest one if there are several.
+type RoutingRule struct {
+	ID           uint   `gorm:"primaryKey"`
+	MatchType    string `gorm:"size:16;not null"`
+	Pattern      string `gorm:"size:255;not null"`
+	Action       string `gorm:"size:16;not null"`
+	Smarthost    string `gorm:"size:255"`
+	AuthUsername string `gorm:"size:255"`
+	AuthPassword string `gorm:"serializer:encrypted"`
+	RequireTLS   bool   `gorm:"not null;default:false"`
+	Priority     int    `gorm:"not null;default:0;index"`
+	CreatedAt    time.Time
+}
+
+// SieveScript represents the sieve_scripts table used by imap.filter.sieve.
+// At most one script per account is Active.
+type SieveScript struct {
+	ID        uint   `gorm:"primaryKey"`
+	Account   string `gorm:"size:255;not null;index:,unique,composite:script"`
+	Name      string `gorm:"size:255;not null;index:,unique,composite:script"`
+	Content   string `gorm:"not null"`
+	Active    bool   `gorm:"not null;default:false;index"`
+	UpdatedAt time.Time
+}
+
+// ImportedMessage represents the imported_messages table used by
+// storage.imapsql to skip messages imported from a Maildir or restored
+// from a backup by an earlier run. Hash is the hex-encoded SHA-256 of the
+// message.
+type ImportedMessage struct {
+	ID         uint      `gorm:"primaryKey"`
+	Account    string    `gorm:"size:255;not null;index:,unique,composite:imported"`
+	Mailbox    string    `gorm:"size:255;not null;index:,unique,composite:imported"`
+	Hash       string    `gorm:"size:64;not null;index:,unique,composite:imported"`
+	ImportedAt time.Time `gorm:"not null"`
+}
+
+// MailboxChange represents the mailbox_changes table used by
+// storage.imapsql to deliver IMAP updates to other server instances sharing
+// the database. Seq increases monotonically. Type is "new", "flags",
+// "expunge" or "destroyed", UIDs is the affected UID set in IMAP syntax and
+// Flags is the space-separated new flag list of a "flags" change. Origin
+// identifies the instance that made the change.
+type MailboxChange struct {
+	Seq       uint64 `gorm:"primaryKey;autoIncrement"`
+	Account   string `gorm:"size:255;not null"`
+	Mailbox   string `gorm:"size:255;not null"`
+	MailboxID uint64 `gorm:"not null"`
+	UIDNext   uint32 `gorm:"column:uidnext;not null"`
+	Type      string `gorm:"size:16;not null"`
+	UIDs      string `gorm:"column:uids"`
+	Flags     string
+	Origin    string    `gorm:"size:64;not null"`
+	CreatedAt time.Time `gorm:"not null;index"`
+}
+
+// Autoreply represents the autoreplies table used by target.autoreply.
+// The reply is sent only if Enabled and the current time is within
+// [StartAt, EndAt), nil bounds are not checked.
+type Autoreply struct {
+	ID        uint   `gorm:"primaryKey"`
+	Account   string `gorm:"size:255;not null;uniqueIndex"`
+	Enabled   bool   `gorm:"not null;default:false"`
+	Subject   string
+	Body      string `gorm:"not null"`
+	StartAt   *time.Time
+	EndAt     *time.Time
+	UpdatedAt time.Time
+}
+
+// AutoreplyLog represents the autoreply_logs table used by target.autoreply
+// to remember when the reply was last sent to the correspondent.
+type AutoreplyLog struct {
+	ID            uint      `gorm:"primaryKey"`
+	Account       string    `gorm:"size:255;not null;index:,unique,composite:reply"`
+	Correspondent string    `gorm:"size:320;not null;index:,unique,composite:reply"`
+	LastReplyAt   time.Time `gorm:"not null;index"`
+}
+
+// ACMEEntry represents the acme_entries table used by tls.loader.acme to
+// share issued certificates, their keys and ACME account data between
+// servers. Name is the certmagic storage key, Value is encrypted using
+// db_encryption_key.
+type ACMEEntry struct {
+	ID        uint   `gorm:"primaryKey"`
+	Name      string `gorm:"size:512;not null;uniqueIndex"`
+	Value     string `gorm:"serializer:encrypted;not null"`
+	UpdatedAt time.Time
+}
+
+// ACMELock represents the acme_locks table used by tls.loader.acme so that
+// only one server obtains or renews the certificate at a time. Owner is a
+// random token of the holder, locks are considered abandoned after
+// ExpiresAt.
+type ACMELock struct {
+	ID        uint      `gorm:"primaryKey"`
+	Name      string    `gorm:"size:512;not null;uniqueIndex"`
+	Owner     string    `gorm:"size:64;not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// AuditEvent represents the audit_events table written by the audit module.
+//
+// Account is the account the event is about, for admin commands it is the
+// local user that ran the command. Protocol is "smtp", "imap", "admin" or
+// empty if the event is not tied to a protocol, e.g. an account created
+// by the registration API.
+type AuditEvent struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"not null;index"`
+	Type      string    `gorm:"size:32;not null;index"`
+	Account   string    `gorm:"size:320;not null;default:'';index"`
+	RemoteIP  string    `gorm:"size:64;not null;default:''"`
+	Protocol  string    `gorm:"size:16;not null;default:''"`
+	Success   bool      `gorm:"not null"`
+	Detail    string
+}
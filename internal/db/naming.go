@@ -0,0 +1,44 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+var tablePrefixRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateTablePrefix checks that the prefix can be used in raw SQL
+// without quoting.
+func validateTablePrefix(prefix string) error {
+	if prefix != "" && !tablePrefixRe.MatchString(prefix) {
+		return fmt.Errorf("table_prefix must consist of letters, digits and underscores: %q", prefix)
+	}
+	return nil
+}
+
+func namingStrategy(opts Options) schema.Namer {
+	// IdentifierMaxLength is the GORM default.
+	return schema.NamingStrategy{TablePrefix: opts.TablePrefix, IdentifierMaxLength: 64}
+}
+
+func tablePrefix(namer schema.Namer) string {
+	switch ns := namer.(type) {
+	case schema.NamingStrategy:
+		return ns.TablePrefix
+	case *schema.NamingStrategy:
+		return ns.TablePrefix
+	}
+	return ""
+}
+
+// TableName returns the table name with Options.TablePrefix applied.
+//
+// Models get the prefix from the GORM naming strategy, TableName should be
+// used for tables referenced in raw SQL or using gorm.DB.Table, which
+// bypass it.
+func TableName(gdb *gorm.DB, name string) string {
+	return tablePrefix(gdb.NamingStrategy) + name
+}
@@ -0,0 +1,61 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func TestTablePrefix(t *testing.T) {
+	gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+		Log:         testutils.Logger(t, "db"),
+		TablePrefix: "madmail_",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sqlDB, _ := gdb.DB()
+		sqlDB.Close()
+	})
+
+	if err := gdb.AutoMigrate(&Quota{}); err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	if err := Migrate(gdb, testMigrations(&calls)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"madmail_quota", "madmail_schema_migrations", "madmail_migrate_test_as"} {
+		if !gdb.Migrator().HasTable(table) {
+			t.Errorf("table %s is not created", table)
+		}
+	}
+	if gdb.Migrator().HasTable("quota") {
+		t.Error("unprefixed table is created")
+	}
+	if name := TableName(gdb, "msgs"); name != "madmail_msgs" {
+		t.Errorf("TableName returned %s", name)
+	}
+
+	if name := TableName(openTestDB(t), "msgs"); name != "msgs" {
+		t.Errorf("TableName without a prefix returned %s", name)
+	}
+}
+
+func TestTablePrefix_Invalid(t *testing.T) {
+	for _, prefix := range []string{"1abc", "a-b", "a b", "a;DROP TABLE users;"} {
+		_, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+			Log:         testutils.Logger(t, "db"),
+			TablePrefix: prefix,
+		})
+		if err == nil {
+			t.Errorf("expected an error for prefix %q", prefix)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/themadorg/madmail/framework/address"
+	"gorm.io/gorm"
+)
+
+// DefaultPurgeBatchSize is the number of rows PurgeAccount removes in a
+// single transaction if PurgeOptions.BatchSize is not positive.
+const DefaultPurgeBatchSize = 500
+
+// PurgedPlaceholder replaces the account name in anonymized audit events.
+const PurgedPlaceholder = "[purged]"
+
+// PurgeOptions controls PurgeAccount, the zero value is usable.
+type PurgeOptions struct {
+	// DryRun makes PurgeAccount only count the rows it would change.
+	DryRun bool
+
+	// DeleteAuditEvents makes PurgeAccount delete audit events of the
+	// account. By default they are kept for retention_days of the audit
+	// module with the account name and details mentioning the address
+	// replaced by PurgedPlaceholder and the remote IP removed.
+	DeleteAuditEvents bool
+
+	BatchSize int
+}
+
+// PurgeReport is the number of removed or anonymized rows for each table.
+// Tables without matching rows are omitted.
+type PurgeReport map[string]int64
+
+// Add adds n rows to the count of the table.
+func (r PurgeReport) Add(table string, n int64) {
+	if n != 0 {
+		r[table] += n
+	}
+}
+
+// Merge adds counts from other to r.
+func (r PurgeReport) Merge(other PurgeReport) {
+	for table, n := range other {
+		r.Add(table, n)
+	}
+}
+
+// purgeStep selects rows of model referencing the account. Rows of children
+// with column set to the primary key of the selected rows are removed in the
+// same transaction. If anonymize is set, rows are updated using it instead
+// of being removed and it should make them no longer match.
+type purgeStep struct {
+	model     interface{}
+	where     func(q *gorm.DB) *gorm.DB
+	children  []purgeChild
+	anonymize map[string]interface{}
+}
+
+type purgeChild struct {
+	model  interface{}
+	column string
+}
+
+// PurgeAccount removes rows of all models of this package that reference
+// the account with the normalized address addr from gdb: the auth.sql
+// account and its app passwords and TOTP secrets, quota settings, aliases
+// pointing to the address or defined for it, Sieve scripts, message import
+// records, autoreplies, queued messages sent by the account, suppressions,
+// greylisting and rate limit entries. Audit events are anonymized, see
+// PurgeOptions.DeleteAuditEvents. Tables that do not exist in gdb are
+// skipped, so it can be called for the database of any module.
+//
+// Rows are removed in dependency order, at most BatchSize parent rows per
+// transaction. If PurgeAccount fails, the counts of the committed batches
+// are returned along with the error and it can be run again.
+//
+// Messages stored by storage.imapsql are not removed, see
+// imapsql.Storage.PurgeAccount.
+func PurgeAccount(ctx context.Context, gdb *gorm.DB, addr string, opts PurgeOptions) (PurgeReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultPurgeBatchSize
+	}
+
+	localpart, domain := addr, ""
+	if strings.Contains(addr, "@") {
+		var err error
+		localpart, domain, err = address.Split(addr)
+		if err != nil {
+			return nil, fmt.Errorf("db: purge account: %w", err)
+		}
+	}
+
+	detailPattern := "%" + escapeLike(addr) + "%"
+	auditStep := purgeStep{
+		model: &AuditEvent{},
+		where: func(q *gorm.DB) *gorm.DB {
+			return q.Where("account = ? OR detail LIKE ? ESCAPE '!'", addr, detailPattern)
+		},
+	}
+	if !opts.DeleteAuditEvents {
+		// MySQL evaluates assignments in order using the updated values,
+		// so remote_ip is cleared for already replaced accounts too.
+		auditStep.anonymize = map[string]interface{}{
+			"account":   gorm.Expr("CASE WHEN account = ? THEN ? ELSE account END", addr, PurgedPlaceholder),
+			"remote_ip": gorm.Expr("CASE WHEN account = ? OR account = ? THEN '' ELSE remote_ip END", addr, PurgedPlaceholder),
+			"detail":    gorm.Expr("CASE WHEN detail LIKE ? ESCAPE '!' THEN ? ELSE detail END", detailPattern, PurgedPlaceholder),
+		}
+	}
+
+	steps := []purgeStep{
+		{
+			model: &Account{},
+			where: func(q *gorm.DB) *gorm.DB {
+				return q.Where("username = ? AND domain = ?", localpart, domain)
+			},
+			children: []purgeChild{
+				{&AppPassword{}, "account_id"},
+				{&TOTPRecoveryCode{}, "account_id"},
+				{&TOTPSecret{}, "account_id"},
+			},
+		},
+		{
+			model: &Quota{},
+			where: func(q *gorm.DB) *gorm.DB { return q.Where("username = ?", addr) },
+		},
+		{
+			model: &Alias{},
+			where: func(q *gorm.DB) *gorm.DB {
+				return q.Where("destination = ? OR (source = ? AND domain = ?)", addr, localpart, domain)
+			},
+		},
+		{
+			model: &SieveScript{},
+			where: func(q *gorm.DB) *gorm.DB { return q.Where("account = ?", addr) },
+		},
+		{
+			model: &ImportedMessage{},
+			where: func(q *gorm.DB) *gorm.DB { return q.Where("account = ?", addr) },
+		},
+		{
+			model: &AutoreplyLog{},
+			where: func(q *gorm.DB) *gorm.DB { return q.Where("account = ? OR correspondent = ?", addr, addr) },
+		},
+		{
+			model: &Autoreply{},
+			where: func(q *gorm.DB) *gorm.DB { return q.Where("account = ?", addr) },
+		},
+		{
+			// Pending outbound messages of the account are cancelled.
+			model: &QueueEntry{},
+			where: func(q *gorm.DB) *gorm.DB { return q.Where("mail_from = ?", addr) },
+			children: []purgeChild{
+				{&QueueBody{}, "entry_id"},
+				{&QueueBodyChunk{}, "entry_id"},
+				{&QueueRecipient{}, "entry_id"},
+			},
+		},
+		{
+			model: &Suppression{},
+			where: func(q *gorm.DB) *gorm.DB { return q.Where("address = ?", addr) },
+		},
+		{
+			model: &GreylistEntry{},
+			where: func(q *gorm.DB) *gorm.DB { return q.Where("mail_from = ? OR rcpt_to = ?", addr, addr) },
+		},
+		{
+			model: &RateLimitCounter{},
+			where: func(q *gorm.DB) *gorm.DB { return q.Where("dimension = ? AND value = ?", "user", addr) },
+		},
+		{
+			model: &RateLimitOverride{},
+			where: func(q *gorm.DB) *gorm.DB { return q.Where("dimension = ? AND value = ?", "user", addr) },
+		},
+		auditStep,
+	}
+
+	report := make(PurgeReport)
+	for _, step := range steps {
+		if err := purgeRows(ctx, gdb, step, opts, report); err != nil {
+			return report, fmt.Errorf("db: purge account: %w", err)
+		}
+	}
+	return report, nil
+}
+
+// escapeLike escapes s for use in a LIKE pattern with '!' as the escape
+// character.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+func parseModel(gdb *gorm.DB, model interface{}) (table string, pk string, pkType reflect.Type, err error) {
+	stmt := &gorm.Statement{DB: gdb}
+	if err := stmt.Parse(model); err != nil {
+		return "", "", nil, err
+	}
+	if len(stmt.Schema.PrimaryFields) != 1 {
+		return "", "", nil, fmt.Errorf("%s: model must have a single-column primary key", stmt.Schema.Table)
+	}
+	field := stmt.Schema.PrimaryFields[0]
+	return stmt.Schema.Table, field.DBName, field.FieldType, nil
+}
+
+func purgeRows(ctx context.Context, gdb *gorm.DB, step purgeStep, opts PurgeOptions, report PurgeReport) error {
+	gdb = gdb.WithContext(ctx)
+	if !gdb.Migrator().HasTable(step.model) {
+		return nil
+	}
+	table, pk, pkType, err := parseModel(gdb, step.model)
+	if err != nil {
+		return err
+	}
+	childTables := make([]string, len(step.children))
+	for i, child := range step.children {
+		// Children are deleted by the parent key, their own primary key
+		// does not matter.
+		stmt := &gorm.Statement{DB: gdb}
+		if err := stmt.Parse(child.model); err != nil {
+			return err
+		}
+		childTables[i] = stmt.Schema.Table
+	}
+
+	if opts.DryRun {
+		var count int64
+		if err := step.where(gdb.Model(step.model)).Count(&count).Error; err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+		report.Add(table, count)
+		for i, child := range step.children {
+			if !gdb.Migrator().HasTable(child.model) {
+				continue
+			}
+			parents := step.where(gdb.Model(step.model).Select(pk))
+			if err := gdb.Model(child.model).Where(child.column+" IN (?)", parents).Count(&count).Error; err != nil {
+				return fmt.Errorf("%s: %w", childTables[i], err)
+			}
+			report.Add(childTables[i], count)
+		}
+		return nil
+	}
+
+	for {
+		var batch PurgeReport
+		var found int
+		_, err := WithTx(ctx, gdb, func(tx *gorm.DB) error {
+			batch = make(PurgeReport)
+			keys := reflect.New(reflect.SliceOf(pkType))
+			if err := step.where(tx.Model(step.model)).Limit(opts.BatchSize).Pluck(pk, keys.Interface()).Error; err != nil {
+				return err
+			}
+			found = keys.Elem().Len()
+			if found == 0 {
+				return nil
+			}
+			ids := keys.Elem().Interface()
+
+			for i, child := range step.children {
+				if !tx.Migrator().HasTable(child.model) {
+					continue
+				}
+				res := tx.Where(child.column+" IN ?", ids).Delete(child.model)
+				if res.Error != nil {
+					return fmt.Errorf("%s: %w", childTables[i], res.Error)
+				}
+				batch.Add(childTables[i], res.RowsAffected)
+			}
+
+			var res *gorm.DB
+			if step.anonymize != nil {
+				res = tx.Model(step.model).Where(pk+" IN ?", ids).Updates(step.anonymize)
+			} else {
+				res = tx.Where(pk+" IN ?", ids).Delete(step.model)
+			}
+			if res.Error != nil {
+				return fmt.Errorf("%s: %w", table, res.Error)
+			}
+			batch.Add(table, res.RowsAffected)
+			return nil
+		}, TxOptions{})
+		if err != nil {
+			return err
+		}
+		report.Merge(batch)
+		if found < opts.BatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,126 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPurgeAccount(t *testing.T) {
+	gdb := openTestDB(t)
+	models := []interface{}{&Account{}, &AppPassword{}, &TOTPSecret{}, &Alias{},
+		&QueueEntry{}, &QueueRecipient{}, &QueueBody{}, &QueueBodyChunk{}, &AuditEvent{}}
+	if err := gdb.Migrator().DropTable(models...); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+
+	const addr = "user@example.org"
+	now := time.Now()
+	acct := Account{Username: "user", Domain: "example.org", PasswordHash: "x", Algorithm: "bcrypt", Enabled: true}
+	other := Account{Username: "other", Domain: "example.org", PasswordHash: "x", Algorithm: "bcrypt", Enabled: true}
+	for _, row := range []interface{}{&acct, &other} {
+		if err := gdb.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows := []interface{}{
+		&AppPassword{AccountID: acct.ID, Label: "a", Hash: "x"},
+		&AppPassword{AccountID: acct.ID, Label: "b", Hash: "x"},
+		&AppPassword{AccountID: other.ID, Label: "c", Hash: "x"},
+		&Alias{Source: "postmaster", Domain: "example.org", Destination: addr},
+		&Alias{Source: "user", Domain: "example.org", Destination: "other@example.org"},
+		&Alias{Source: "info", Domain: "example.org", Destination: "other@example.org"},
+		&QueueEntry{ID: "1", Queue: "remote", MailFrom: addr, MsgMeta: []byte("{}"), NextAttemptAt: now},
+		&QueueRecipient{EntryID: "1", Rcpt: "rcpt@example.com", Status: "pending"},
+		&QueueBody{EntryID: "1", Header: []byte("h"), Body: []byte{}},
+		&QueueBodyChunk{EntryID: "1", Seq: 0, Data: []byte("b")},
+		&QueueEntry{ID: "2", Queue: "remote", MailFrom: "other@example.org", MsgMeta: []byte("{}"), NextAttemptAt: now},
+		&AuditEvent{CreatedAt: now, Type: "auth", Account: addr, RemoteIP: "192.0.2.1", Success: true},
+		&AuditEvent{CreatedAt: now, Type: "admin_command", Account: "root", Detail: "creds create " + addr, Success: true},
+		&AuditEvent{CreatedAt: now, Type: "auth", Account: "other@example.org", RemoteIP: "192.0.2.2", Success: true},
+	}
+	for _, row := range rows {
+		if err := gdb.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := PurgeReport{
+		"accounts":          1,
+		"app_passwords":     2,
+		"aliases":           2,
+		"queue_entries":     1,
+		"queue_recipients":  1,
+		"queue_bodies":      1,
+		"queue_body_chunks": 1,
+		"audit_events":      2,
+	}
+	ctx := context.Background()
+	report, err := PurgeAccount(ctx, gdb, addr, PurgeOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("dry run: got %v, want %v", report, want)
+	}
+	var count int64
+	gdb.Model(&AppPassword{}).Count(&count)
+	if count != 3 {
+		t.Fatalf("dry run removed rows")
+	}
+
+	report, err = PurgeAccount(ctx, gdb, addr, PurgeOptions{BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("got %v, want %v", report, want)
+	}
+
+	checkCount := func(model interface{}, want int64) {
+		t.Helper()
+		var count int64
+		if err := gdb.Model(model).Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if count != want {
+			t.Errorf("%T: %d rows left, want %d", model, count, want)
+		}
+	}
+	checkCount(&Account{}, 1)
+	checkCount(&AppPassword{}, 1)
+	checkCount(&Alias{}, 1)
+	checkCount(&QueueEntry{}, 1)
+	checkCount(&QueueRecipient{}, 0)
+	checkCount(&QueueBodyChunk{}, 0)
+	checkCount(&AuditEvent{}, 3)
+
+	var events []AuditEvent
+	if err := gdb.Order("id").Find(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	if events[0].Account != PurgedPlaceholder || events[0].RemoteIP != "" {
+		t.Errorf("event of the account is not anonymized: %+v", events[0])
+	}
+	if events[1].Account != "root" || events[1].Detail != PurgedPlaceholder {
+		t.Errorf("event mentioning the account is not anonymized: %+v", events[1])
+	}
+	if events[2].Account != "other@example.org" || events[2].RemoteIP != "192.0.2.2" {
+		t.Errorf("unrelated event is changed: %+v", events[2])
+	}
+
+	report, err = PurgeAccount(ctx, gdb, addr, PurgeOptions{DeleteAuditEvents: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 0 {
+		t.Errorf("second purge changed rows: %v", report)
+	}
+}
@@ -0,0 +1,279 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/themadorg/madmail/framework/log"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlserver"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+const (
+	replicaCheckInterval = 10 * time.Second
+	replicaCheckTimeout  = 2 * time.Second
+)
+
+// useReplicas registers dbresolver on db so that reads outside of
+// transactions are distributed between replicas. Writes, locking reads and
+// everything inside a transaction use the primary connection.
+func useReplicas(db *gorm.DB, primary *sql.DB, driver string, replicaDSNs [][]string, opts Options) error {
+	var primaryDialector gorm.Dialector
+	switch driver {
+	case "postgres":
+		primaryDialector = postgres.New(postgres.Config{Conn: primary})
+	case "mysql":
+		primaryDialector = mysql.New(mysql.Config{Conn: primary})
+	case "sqlserver", "mssql":
+		primaryDialector = sqlserver.New(sqlserver.Config{Conn: primary})
+	default:
+		return fmt.Errorf("replica_dsn is not supported for the %s driver", driver)
+	}
+
+	replicas := make([]gorm.Dialector, 0, len(replicaDSNs)+1)
+	for _, dsn := range replicaDSNs {
+		dsnStr, err := BuildDSN(driver, dsn)
+		if err != nil {
+			return err
+		}
+		dsnStr, err = ConfigureTLS(driver, dsnStr, opts)
+		if err != nil {
+			return err
+		}
+		d, err := newDialector(driver, dsnStr)
+		if err != nil {
+			return err
+		}
+		replicas = append(replicas, d)
+	}
+	// The primary goes last, replicaPolicy uses it only when no replica is
+	// available. It also makes sure the policy is consulted even when there
+	// is only one replica.
+	replicas = append(replicas, primaryDialector)
+
+	policy := &replicaPolicy{
+		log:         opts.Log,
+		prepareStmt: opts.PrepareStmt,
+		health:      make(map[gorm.ConnPool]*replicaHealth),
+		prepared:    make(map[gorm.ConnPool]*gorm.PreparedStmtDB),
+	}
+	resolver := dbresolver.Register(dbresolver.Config{
+		Replicas: replicas,
+		Policy:   policy,
+	}).
+		SetMaxOpenConns(opts.MaxOpenConns).
+		SetMaxIdleConns(opts.MaxIdleConns).
+		SetConnMaxLifetime(opts.ConnMaxLifetime).
+		SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+	if err := db.Use(resolver); err != nil {
+		return fmt.Errorf("failed to register replicas: %w", err)
+	}
+
+	// Check replicas once now so that reads are not sent to a replica that
+	// is down right from the start. Replica pools are also recorded so that
+	// Close can drain them.
+	st := stateFor(primary)
+	return resolver.Call(func(pool gorm.ConnPool) error {
+		sqlDB := unwrapPool(pool)
+		if sqlDB == primary {
+			return nil
+		}
+		if sqlDB != nil {
+			st.replicas = append(st.replicas, sqlDB)
+		}
+		policy.check(pool)
+		return nil
+	})
+}
+
+// unwrapPool returns the *sql.DB behind the pool, which is wrapped into
+// gorm.PreparedStmtDB if prepared_statements is enabled.
+func unwrapPool(pool gorm.ConnPool) *sql.DB {
+	switch p := pool.(type) {
+	case *sql.DB:
+		return p
+	case gorm.GetDBConnector:
+		sqlDB, err := p.GetDBConn()
+		if err != nil {
+			return nil
+		}
+		return sqlDB
+	}
+	return nil
+}
+
+type replicaHealth struct {
+	healthy   bool
+	checkedAt time.Time
+	checking  bool
+}
+
+// replicaPolicy implements dbresolver.Policy.
+//
+// It picks replicas in round-robin order, skipping ones that failed the
+// last health check. The last pool in the list is the primary and is used
+// only if no replica is healthy. Health checks are done in the background
+// no more often than replicaCheckInterval.
+//
+// Queries failing on a replica with a connection error are retried on the
+// primary, see fallbackPool.
+type replicaPolicy struct {
+	next        uint64
+	log         log.Logger
+	prepareStmt bool
+
+	lock     sync.Mutex
+	health   map[gorm.ConnPool]*replicaHealth
+	prepared map[gorm.ConnPool]*gorm.PreparedStmtDB
+}
+
+func (p *replicaPolicy) Resolve(pools []gorm.ConnPool) gorm.ConnPool {
+	replicas, primary := pools[:len(pools)-1], pools[len(pools)-1]
+	if len(replicas) == 0 {
+		return primary
+	}
+
+	start := atomic.AddUint64(&p.next, 1)
+	for i := range replicas {
+		pool := replicas[(start+uint64(i))%uint64(len(replicas))]
+		if p.healthy(pool) {
+			return &fallbackPool{
+				policy:  p,
+				key:     pool,
+				replica: p.withPrepared(pool),
+				primary: p.withPrepared(primary),
+			}
+		}
+	}
+	return primary
+}
+
+// withPrepared wraps pool into gorm.PreparedStmtDB if prepared_statements is
+// enabled. dbresolver does it only for the pools returned by Resolve as is.
+func (p *replicaPolicy) withPrepared(pool gorm.ConnPool) gorm.ConnPool {
+	if !p.prepareStmt {
+		return pool
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	prepared, ok := p.prepared[pool]
+	if !ok {
+		prepared = gorm.NewPreparedStmtDB(pool, prepareStmtCacheSize, 0)
+		p.prepared[pool] = prepared
+	}
+	return prepared
+}
+
+func (p *replicaPolicy) healthy(pool gorm.ConnPool) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	h, ok := p.health[pool]
+	if !ok {
+		// Not checked yet, assume it is fine and check in background.
+		h = &replicaHealth{healthy: true}
+		p.health[pool] = h
+	}
+	if !h.checking && time.Since(h.checkedAt) > replicaCheckInterval {
+		h.checking = true
+		go p.check(pool)
+	}
+	return h.healthy
+}
+
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+func (p *replicaPolicy) check(pool gorm.ConnPool) {
+	pinger, ok := pool.(pinger)
+	if sqlDB := unwrapPool(pool); !ok && sqlDB != nil {
+		pinger, ok = sqlDB, true
+	}
+	var err error
+	if ok {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+		err = pinger.PingContext(ctx)
+		cancel()
+	} else {
+		// The replica cannot be checked, do not risk sending reads to it.
+		err = fmt.Errorf("connection check is not supported for %T", pool)
+	}
+	p.setHealth(pool, err)
+}
+
+func (p *replicaPolicy) setHealth(pool gorm.ConnPool, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	h, ok := p.health[pool]
+	if !ok {
+		h = &replicaHealth{healthy: true}
+		p.health[pool] = h
+	}
+	if err != nil && h.healthy {
+		p.log.Error("replica is not available, using primary for reads", err)
+	} else if err == nil && !h.healthy {
+		p.log.Msg("replica is available again")
+	}
+	h.healthy = err == nil
+	h.checkedAt = time.Now()
+	h.checking = false
+}
+
+// fallbackPool runs reads on the replica picked by replicaPolicy. Queries
+// failing with a connection error are retried on the primary.
+type fallbackPool struct {
+	policy  *replicaPolicy
+	key     gorm.ConnPool // the pool as known to dbresolver
+	replica gorm.ConnPool
+	primary gorm.ConnPool
+}
+
+func (p *fallbackPool) retry(err error) bool {
+	if err == nil || !isConnectionError(err) {
+		return false
+	}
+	// Skip the replica until the next successful check.
+	p.policy.setHealth(p.key, err)
+	return true
+}
+
+func (p *fallbackPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	stmt, err := p.replica.PrepareContext(ctx, query)
+	if p.retry(err) {
+		return p.primary.PrepareContext(ctx, query)
+	}
+	return stmt, err
+}
+
+func (p *fallbackPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	res, err := p.replica.ExecContext(ctx, query, args...)
+	if p.retry(err) {
+		return p.primary.ExecContext(ctx, query, args...)
+	}
+	return res, err
+}
+
+func (p *fallbackPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := p.replica.QueryContext(ctx, query, args...)
+	if p.retry(err) {
+		return p.primary.QueryContext(ctx, query, args...)
+	}
+	return rows, err
+}
+
+func (p *fallbackPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	row := p.replica.QueryRowContext(ctx, query, args...)
+	if p.retry(row.Err()) {
+		return p.primary.QueryRowContext(ctx, query, args...)
+	}
+	return row
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/gorm"
+)
+
+type fakePool struct {
+	gorm.ConnPool
+	name     string
+	err      error
+	queryErr error
+	queries  int
+}
+
+func (p *fakePool) PingContext(context.Context) error {
+	return p.err
+}
+
+func (p *fakePool) QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error) {
+	p.queries++
+	return nil, p.queryErr
+}
+
+// noPingPool is a pool that cannot be health-checked.
+type noPingPool struct {
+	gorm.ConnPool
+}
+
+// resolved returns the name of the pool picked by p.
+func resolved(p *replicaPolicy, pools []gorm.ConnPool) string {
+	pool := p.Resolve(pools)
+	if fb, ok := pool.(*fallbackPool); ok {
+		pool = fb.replica
+	}
+	if fake, ok := pool.(*fakePool); ok {
+		return fake.name
+	}
+	return fmt.Sprintf("%T", pool)
+}
+
+func TestReplicaPolicy(t *testing.T) {
+	r1 := &fakePool{name: "r1"}
+	r2 := &fakePool{name: "r2", err: errors.New("connection refused")}
+	primary := &fakePool{name: "primary"}
+
+	p := &replicaPolicy{
+		log:    testutils.Logger(t, "db"),
+		health: make(map[gorm.ConnPool]*replicaHealth),
+	}
+	p.check(r1)
+	p.check(r2)
+
+	pools := []gorm.ConnPool{r1, r2, primary}
+	for i := 0; i < 10; i++ {
+		if got := resolved(p, pools); got != "r1" {
+			t.Fatalf("Resolve returned %s, want r1", got)
+		}
+	}
+
+	// r1 goes away too, reads should fall back to the primary.
+	r1.err = errors.New("connection refused")
+	p.check(r1)
+	if got := resolved(p, pools); got != "primary" {
+		t.Fatalf("Resolve returned %s, want primary", got)
+	}
+
+	// Both replicas are back, both are used.
+	r1.err, r2.err = nil, nil
+	p.check(r1)
+	p.check(r2)
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		seen[resolved(p, pools)] = true
+	}
+	if !seen["r1"] || !seen["r2"] || seen["primary"] {
+		t.Fatalf("unexpected pools used: %v", seen)
+	}
+}
+
+func TestReplicaPolicy_Fallback(t *testing.T) {
+	replica := &fakePool{name: "replica"}
+	primary := &fakePool{name: "primary"}
+	pools := []gorm.ConnPool{replica, primary}
+
+	p := &replicaPolicy{
+		log:    testutils.Logger(t, "db"),
+		health: make(map[gorm.ConnPool]*replicaHealth),
+	}
+	p.check(replica)
+
+	// Errors returned by the database are not retried.
+	replica.queryErr = errors.New("syntax error")
+	if _, err := p.Resolve(pools).QueryContext(context.Background(), "SELECT 1"); err != replica.queryErr {
+		t.Fatal("unexpected error:", err)
+	}
+	if replica.queries != 1 || primary.queries != 0 {
+		t.Fatalf("queries: replica %d, primary %d", replica.queries, primary.queries)
+	}
+
+	// Connection errors are.
+	replica.queryErr = fmt.Errorf("dial tcp: %w", syscall.ECONNREFUSED)
+	if _, err := p.Resolve(pools).QueryContext(context.Background(), "SELECT 1"); err != nil {
+		t.Fatal("query is not retried on the primary:", err)
+	}
+	if replica.queries != 2 || primary.queries != 1 {
+		t.Fatalf("queries: replica %d, primary %d", replica.queries, primary.queries)
+	}
+	// The replica is not used until the next check.
+	if got := resolved(p, pools); got != "primary" {
+		t.Fatalf("Resolve returned %s, want primary", got)
+	}
+}
+
+func TestReplicaPolicy_NoPing(t *testing.T) {
+	replica := &noPingPool{}
+	primary := &fakePool{name: "primary"}
+
+	p := &replicaPolicy{
+		log:    testutils.Logger(t, "db"),
+		health: make(map[gorm.ConnPool]*replicaHealth),
+	}
+	p.check(replica)
+	if got := resolved(p, []gorm.ConnPool{replica, primary}); got != "primary" {
+		t.Fatalf("Resolve returned %s, want primary", got)
+	}
+}
+
+func countPoolStates() int {
+	n := 0
+	poolStates.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestNew_ReplicasRejectedForSQLite(t *testing.T) {
+	before := countPoolStates()
+	_, err := New("sqlite3", []string{"whatever.db"}, Options{
+		ReplicaDSNs: [][]string{{"replica.db"}},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	// The closed pool should not be left for CloseAll.
+	if after := countPoolStates(); after != before {
+		t.Errorf("pool state is left after the failure: %d, was %d", after, before)
+	}
+}
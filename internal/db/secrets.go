@@ -0,0 +1,88 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// resolveSecret replaces env:NAME with the value of the environment
+// variable and file:PATH with the contents of the file, with leading and
+// trailing whitespace removed. Other values are returned as is.
+//
+// file: is not recognized for SQLite, where it is the prefix of URI
+// filenames.
+//
+// Errors never include the resolved value.
+func resolveSecret(driver, value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, "file:") && !isSQLite(driver):
+		path := strings.TrimPrefix(value, "file:")
+		b, err := os.ReadFile(path)
+		if err != nil {
+			// *PathError includes the path and the reason, not the contents.
+			return "", fmt.Errorf("failed to read secret: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	default:
+		return value, nil
+	}
+}
+
+// quotePostgresValue quotes the value for use in a keyword/value DSN if
+// needed.
+func quotePostgresValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\n\r'\\") {
+		return v
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// resolveDSNSecrets resolves env: and file: references (see resolveSecret)
+// in DSN arguments. An argument can be a reference itself (e.g. to keep the
+// whole DSN in a file) or, for PostgreSQL, a key=value pair with the value
+// being a reference, e.g. password=env:DB_PASSWORD.
+func resolveDSNSecrets(driver string, dsn []string) ([]string, error) {
+	resolved := make([]string, len(dsn))
+	for i, part := range dsn {
+		v, err := resolveSecret(driver, part)
+		if err != nil {
+			return nil, fmt.Errorf("%s: dsn argument %d: %w", driver, i+1, err)
+		}
+
+		if v == part && driver == "postgres" {
+			if key, val, ok := strings.Cut(part, "="); ok {
+				secret, err := resolveSecret(driver, val)
+				if err != nil {
+					return nil, fmt.Errorf("%s: dsn argument %d (%s): %w", driver, i+1, key, err)
+				}
+				if secret != val {
+					v = key + "=" + quotePostgresValue(secret)
+				}
+			}
+		}
+		resolved[i] = v
+	}
+	return resolved, nil
+}
+
+// resolveParamSecrets is resolveDSNSecrets for the block form of the dsn
+// directive.
+func resolveParamSecrets(driver string, params map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(params))
+	for k, v := range params {
+		secret, err := resolveSecret(driver, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: dsn parameter %s: %w", driver, k, err)
+		}
+		resolved[k] = secret
+	}
+	return resolved, nil
+}
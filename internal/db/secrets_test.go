@@ -0,0 +1,110 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestBuildDSN_Secrets(t *testing.T) {
+	const password = `s3cr3t 'pass' \word`
+	t.Setenv("MADMAIL_TEST_DB_PASSWORD", password)
+
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "db_password")
+	if err := os.WriteFile(passFile, []byte(password+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dsnFile := filepath.Join(dir, "dsn")
+	if err := os.WriteFile(dsnFile, []byte("maddy:"+"hunter2"+"@tcp(db:3306)/maddy\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dsn := range [][]string{
+		{"host=db", "user=maddy", "password=env:MADMAIL_TEST_DB_PASSWORD"},
+		{"host=db", "user=maddy", "password=file:" + passFile},
+	} {
+		got, err := BuildDSN("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := pgconn.ParseConfig(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Password != password || cfg.User != "maddy" || cfg.Host != "db" {
+			t.Errorf("%q resolved into unexpected config: %+v", dsn, cfg)
+		}
+	}
+
+	got, err := BuildDSN("mysql", []string{"file:" + dsnFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "maddy:hunter2@tcp(db:3306)/maddy" {
+		t.Errorf("unexpected whole-DSN resolution result: %q", got)
+	}
+
+	t.Setenv("MADMAIL_TEST_DB_DSN", "/var/lib/maddy/imapsql.db")
+	got, err = BuildDSN("sqlite3", []string{"env:MADMAIL_TEST_DB_DSN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "/var/lib/maddy/imapsql.db" {
+		t.Errorf("unexpected env resolution result for sqlite3: %q", got)
+	}
+	// file: is an SQLite URI, not a reference.
+	got, err = BuildDSN("sqlite3", []string{"file:imapsql.db?cache=shared"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "file:imapsql.db?cache=shared" {
+		t.Errorf("SQLite URI was changed: %q", got)
+	}
+
+	dsn := DSN{Params: map[string]string{"user": "maddy", "password": "env:MADMAIL_TEST_DB_PASSWORD", "host": "db"}}
+	parts, err := dsn.Parts("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := pgconn.ParseConfig(parts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Password != password {
+		t.Errorf("block form password is not resolved: %q", cfg.Password)
+	}
+}
+
+func TestBuildDSN_SecretErrors(t *testing.T) {
+	t.Setenv("MADMAIL_TEST_DB_PASSWORD", "hunter2")
+	missingFile := filepath.Join(t.TempDir(), "missing")
+
+	for _, c := range []struct {
+		driver string
+		dsn    []string
+		errStr string
+	}{
+		{"postgres", []string{"host=db", "password=env:MADMAIL_TEST_MISSING"}, "dsn argument 2 (password): environment variable MADMAIL_TEST_MISSING is not set"},
+		{"postgres", []string{"host=db", "password=file:" + missingFile}, "dsn argument 2 (password): failed to read secret"},
+		{"mysql", []string{"file:" + missingFile}, "mysql: dsn argument 1: failed to read secret"},
+		{"sqlserver", []string{"env:MADMAIL_TEST_MISSING"}, "sqlserver: dsn argument 1: environment variable"},
+	} {
+		_, err := BuildDSN(c.driver, c.dsn)
+		if err == nil || !strings.Contains(err.Error(), c.errStr) {
+			t.Errorf("BuildDSN(%s, %q): expected error %q, got %v", c.driver, c.dsn, c.errStr, err)
+			continue
+		}
+		if strings.Contains(err.Error(), "hunter2") {
+			t.Errorf("error contains a secret: %v", err)
+		}
+	}
+
+	_, err := DSN{Params: map[string]string{"password": "env:MADMAIL_TEST_MISSING"}}.Parts("mysql")
+	if err == nil || !strings.Contains(err.Error(), "dsn parameter password") {
+		t.Errorf("expected an error naming the parameter, got %v", err)
+	}
+}
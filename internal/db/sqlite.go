@@ -0,0 +1,104 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/themadorg/madmail/framework/config"
+)
+
+// SQLite defaults used when the corresponding Options field is empty.
+//
+// WAL allows readers to proceed while a write is in progress and the busy
+// timeout makes writers wait for the lock instead of failing immediately
+// with "database is locked".
+const (
+	DefaultSQLiteJournalMode = "WAL"
+	DefaultSQLiteSynchronous = "NORMAL"
+	DefaultSQLiteBusyTimeout = 5000
+	DefaultSQLiteForeignKeys = "ON"
+
+	// DefaultSQLiteMaxOpenConns is used instead of DefaultMaxOpenConns for
+	// SQLite. SQLite allows only one writer at a time, sharing a single
+	// connection serializes writers within the process instead of making
+	// them fight over the database lock.
+	DefaultSQLiteMaxOpenConns = 1
+)
+
+func isSQLite(driver string) bool {
+	return driver == "sqlite3" || driver == "sqlite"
+}
+
+// sqliteDirectives registers SQLite-specific directives, see Directives.
+func sqliteDirectives(cfg *config.Map, opts *Options) {
+	cfg.Enum("sqlite3_journal_mode", false, false,
+		[]string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"},
+		DefaultSQLiteJournalMode, &opts.SQLiteJournalMode)
+	cfg.Enum("sqlite3_synchronous", false, false,
+		[]string{"OFF", "NORMAL", "FULL", "EXTRA"},
+		DefaultSQLiteSynchronous, &opts.SQLiteSynchronous)
+	cfg.Int("sqlite3_busy_timeout", false, false, DefaultSQLiteBusyTimeout, &opts.SQLiteBusyTimeout)
+	cfg.Custom("sqlite3_foreign_keys", false, false, func() (interface{}, error) {
+		return DefaultSQLiteForeignKeys, nil
+	}, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "expected exactly 1 argument")
+		}
+		enabled, err := config.ParseBool(node.Args[0])
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		if enabled {
+			return "ON", nil
+		}
+		return "OFF", nil
+	}, &opts.SQLiteForeignKeys)
+	sqliteMaintenanceDirectives(cfg, opts)
+}
+
+// addSQLiteParams adds connection parameters understood by go-sqlite3 to
+// the DSN so that the pragmas apply to every connection in the pool.
+// Parameters already present in the DSN are left as is.
+func addSQLiteParams(dsn string, opts Options) string {
+	path, query, _ := strings.Cut(dsn, "?")
+
+	present := make(map[string]bool)
+	for _, kv := range strings.Split(query, "&") {
+		key, _, _ := strings.Cut(kv, "=")
+		present[key] = true
+	}
+
+	var params []string
+	add := func(value string, keys ...string) {
+		for _, k := range keys {
+			if present[k] {
+				return
+			}
+		}
+		params = append(params, keys[0]+"="+value)
+	}
+	add(opts.SQLiteJournalMode, "_journal_mode", "_journal")
+	add(opts.SQLiteSynchronous, "_synchronous", "_sync")
+	add(opts.SQLiteForeignKeys, "_foreign_keys", "_fk")
+	busyTimeout := opts.SQLiteBusyTimeout
+	if busyTimeout < 0 {
+		busyTimeout = 0
+	}
+	add(strconv.Itoa(busyTimeout), "_busy_timeout", "_timeout")
+	if opts.SQLiteMaintenanceInterval > 0 {
+		// Only has effect when the database is created, existing databases
+		// need VACUUM to switch.
+		add("INCREMENTAL", "_auto_vacuum", "_vacuum")
+	}
+
+	if len(params) == 0 {
+		return dsn
+	}
+	if !strings.HasPrefix(path, "file:") {
+		path = "file:" + path
+	}
+	if query != "" {
+		params = append([]string{query}, params...)
+	}
+	return path + "?" + strings.Join(params, "&")
+}
@@ -0,0 +1,463 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/log"
+)
+
+// DefaultSQLiteMaintenanceInterval is the default value of the
+// sqlite3_maintenance_interval directive.
+const DefaultSQLiteMaintenanceInterval = 24 * time.Hour
+
+const (
+	// maintenanceStartDelay is the delay before the first run after the
+	// database is opened, so maintenance does not compete with startup.
+	maintenanceStartDelay = 10 * time.Minute
+
+	// maintenanceBusyTimeout (in milliseconds) replaces the busy timeout
+	// of the connection while it is used for maintenance, so that a locked
+	// database makes a step fail quickly instead of blocking queries
+	// waiting for the connection.
+	maintenanceBusyTimeout = 200
+
+	// maintenanceVacuumPages is the number of free pages released by each
+	// incremental_vacuum step. The connection is returned to the pool
+	// between steps, for maintenanceStepPause.
+	maintenanceVacuumPages = 1024
+	maintenanceStepPause   = 100 * time.Millisecond
+
+	// maintenanceAnalysisLimit bounds the number of rows ANALYZE looks at
+	// in each index, see PRAGMA analysis_limit.
+	maintenanceAnalysisLimit = 1000
+
+	// WAL checkpoints that cannot complete because readers use the WAL are
+	// retried with exponential backoff.
+	maintenanceCheckpointAttempts = 5
+	maintenanceCheckpointBackoff  = time.Second
+	maintenanceMaxCheckpointDelay = time.Minute
+)
+
+// Names of maintenance tasks used in logs and the task label of the
+// maddy_db_sqlite_maintenance_last_run_timestamp_seconds metric.
+const (
+	maintenanceVacuum     = "incremental_vacuum"
+	maintenanceAnalyze    = "analyze"
+	maintenanceCheckpoint = "wal_checkpoint"
+)
+
+var errCheckpointBusy = errors.New("WAL checkpoint cannot complete because of active readers")
+
+// MaintenanceWindow is the time of day SQLite maintenance is done at, in
+// local time. Start and End are offsets from midnight, End is less than
+// Start for windows spanning midnight. The zero value allows any time.
+type MaintenanceWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// IsZero reports whether the window allows any time.
+func (w MaintenanceWindow) IsZero() bool {
+	return w.Start == w.End
+}
+
+// Contains reports whether t is within the window.
+func (w MaintenanceWindow) Contains(t time.Time) bool {
+	if w.IsZero() {
+		return true
+	}
+	offset := sinceMidnight(t)
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// Next returns t if it is within the window or the next start of the
+// window otherwise.
+func (w MaintenanceWindow) Next(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	start := t.Add(w.Start - sinceMidnight(t))
+	if start.Before(t) {
+		start = start.AddDate(0, 0, 1)
+	}
+	return start
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second +
+		time.Duration(t.Nanosecond())
+}
+
+// ParseMaintenanceWindow parses start and end times in the HH:MM format.
+func ParseMaintenanceWindow(start, end string) (MaintenanceWindow, error) {
+	parse := func(s string) (time.Duration, error) {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+		}
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+	}
+	var (
+		w   MaintenanceWindow
+		err error
+	)
+	if w.Start, err = parse(start); err != nil {
+		return MaintenanceWindow{}, err
+	}
+	if w.End, err = parse(end); err != nil {
+		return MaintenanceWindow{}, err
+	}
+	if w.IsZero() {
+		return MaintenanceWindow{}, fmt.Errorf("maintenance window %s-%s is empty", start, end)
+	}
+	return w, nil
+}
+
+func sqliteMaintenanceDirectives(cfg *config.Map, opts *Options) {
+	cfg.Duration("sqlite3_maintenance_interval", false, false, DefaultSQLiteMaintenanceInterval, &opts.SQLiteMaintenanceInterval)
+	cfg.Custom("sqlite3_maintenance_window", false, false, func() (interface{}, error) {
+		return MaintenanceWindow{}, nil
+	}, func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) != 2 {
+			return nil, config.NodeErr(node, "expected 2 arguments: start and end time")
+		}
+		w, err := ParseMaintenanceWindow(node.Args[0], node.Args[1])
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		return w, nil
+	}, &opts.SQLiteMaintenanceWindow)
+}
+
+// maintenanceRun is the result of maintenance of a database file. It is
+// shared by all pools opened for the same file so that they do not repeat
+// the work of each other.
+type maintenanceRun struct {
+	// lock is held for the duration of a run.
+	lock    sync.Mutex
+	started time.Time
+
+	finishedLock sync.Mutex
+	finished     map[string]time.Time
+}
+
+// lastRuns returns the time each task last completed successfully at.
+func (r *maintenanceRun) lastRuns() map[string]time.Time {
+	r.finishedLock.Lock()
+	defer r.finishedLock.Unlock()
+	runs := make(map[string]time.Time, len(r.finished))
+	for task, t := range r.finished {
+		runs[task] = t
+	}
+	return runs
+}
+
+// maintenanceRuns maps database file paths to *maintenanceRun.
+var maintenanceRuns sync.Map
+
+// sqliteMaintenance periodically checkpoints the WAL, releases free pages
+// of the database file and updates query planner statistics.
+type sqliteMaintenance struct {
+	sqlDB       *sql.DB
+	log         log.Logger
+	interval    time.Duration
+	window      MaintenanceWindow
+	busyTimeout int
+
+	// checkpointBackoff is the initial delay between checkpoint attempts.
+	checkpointBackoff time.Duration
+
+	// run is set once the database file is known.
+	run atomic.Pointer[maintenanceRun]
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// startSQLiteMaintenance starts the maintenance of the SQLite database,
+// nil is returned if it is disabled.
+func startSQLiteMaintenance(sqlDB *sql.DB, opts Options) *sqliteMaintenance {
+	if opts.SQLiteMaintenanceInterval <= 0 {
+		return nil
+	}
+	busyTimeout := opts.SQLiteBusyTimeout
+	if busyTimeout < 0 {
+		busyTimeout = 0
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &sqliteMaintenance{
+		sqlDB:       sqlDB,
+		log:         opts.Log,
+		interval:    opts.SQLiteMaintenanceInterval,
+		window:      opts.SQLiteMaintenanceWindow,
+		busyTimeout: busyTimeout,
+
+		checkpointBackoff: maintenanceCheckpointBackoff,
+
+		stop: cancel,
+		done: make(chan struct{}),
+	}
+	go m.loop(ctx)
+	return m
+}
+
+// close stops the scheduler and waits for the current run to be
+// interrupted.
+func (m *sqliteMaintenance) close() {
+	m.stop()
+	<-m.done
+}
+
+func (m *sqliteMaintenance) loop(ctx context.Context) {
+	defer close(m.done)
+	next := m.window.Next(time.Now().Add(maintenanceStartDelay))
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := m.runOnce(ctx); err != nil && ctx.Err() == nil {
+			m.log.Error("sqlite maintenance failed", err)
+		}
+		next = m.window.Next(time.Now().Add(m.interval))
+	}
+}
+
+// runOnce runs all maintenance tasks unless another pool for the same
+// database file did it recently. Tasks are independent, a failure of one
+// does not prevent the others from running.
+func (m *sqliteMaintenance) runOnce(ctx context.Context) error {
+	path, err := m.databasePath(ctx)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		// Temporary or in-memory database.
+		return nil
+	}
+	v, _ := maintenanceRuns.LoadOrStore(path, &maintenanceRun{finished: make(map[string]time.Time)})
+	run := v.(*maintenanceRun)
+	m.run.Store(run)
+
+	run.lock.Lock()
+	defer run.lock.Unlock()
+	if !run.started.IsZero() && time.Since(run.started) < m.interval/2 {
+		return nil
+	}
+	run.started = time.Now()
+
+	dbBefore, walBefore := fileSize(path), fileSize(path+"-wal")
+	m.log.Msg("starting sqlite maintenance", "path", path, "db_size", dbBefore, "wal_size", walBefore)
+
+	var errs []error
+	freed, err := m.incrementalVacuum(ctx)
+	errs = append(errs, m.finish(run, maintenanceVacuum, err))
+	errs = append(errs, m.finish(run, maintenanceAnalyze, m.analyze(ctx)))
+	// The checkpoint is done last to also truncate the WAL written by the
+	// other tasks.
+	errs = append(errs, m.finish(run, maintenanceCheckpoint, m.checkpoint(ctx)))
+
+	m.log.Msg("sqlite maintenance done", "path", path,
+		"db_size_before", dbBefore, "db_size", fileSize(path),
+		"wal_size_before", walBefore, "wal_size", fileSize(path+"-wal"),
+		"freed_pages", freed, "duration", time.Since(run.started).Round(time.Millisecond))
+	return errors.Join(errs...)
+}
+
+func (m *sqliteMaintenance) finish(run *maintenanceRun, task string, err error) error {
+	if err != nil {
+		return fmt.Errorf("%s: %w", task, err)
+	}
+	run.finishedLock.Lock()
+	run.finished[task] = time.Now()
+	run.finishedLock.Unlock()
+	return nil
+}
+
+func (m *sqliteMaintenance) databasePath(ctx context.Context) (string, error) {
+	rows, err := m.sqlDB.QueryContext(ctx, "PRAGMA database_list")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			seq        int
+			name, file string
+		)
+		if err := rows.Scan(&seq, &name, &file); err != nil {
+			return "", err
+		}
+		if name == "main" {
+			return file, nil
+		}
+	}
+	return "", rows.Err()
+}
+
+// withConn runs fn on a connection with the busy timeout lowered to
+// maintenanceBusyTimeout.
+func (m *sqliteMaintenance) withConn(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA busy_timeout = "+strconv.Itoa(maintenanceBusyTimeout)); err != nil {
+		return err
+	}
+	err = fn(conn)
+	// The context can be already cancelled.
+	if _, restoreErr := conn.ExecContext(context.Background(), "PRAGMA busy_timeout = "+strconv.Itoa(m.busyTimeout)); restoreErr != nil {
+		conn.Raw(func(interface{}) error {
+			// Drop the connection instead of returning it to the pool with
+			// the wrong timeout.
+			return driver.ErrBadConn
+		})
+		return errors.Join(err, restoreErr)
+	}
+	return err
+}
+
+// incrementalVacuum releases free pages of the database file in steps of
+// maintenanceVacuumPages until none are left or the maintenance window
+// ends. The database should be created with auto_vacuum=INCREMENTAL,
+// otherwise nothing is done.
+func (m *sqliteMaintenance) incrementalVacuum(ctx context.Context) (int64, error) {
+	var mode int
+	err := m.withConn(ctx, func(conn *sql.Conn) error {
+		return conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if mode != 2 {
+		m.log.DebugMsg("database is not created with auto_vacuum=INCREMENTAL, skipping incremental_vacuum")
+		return 0, nil
+	}
+
+	var freed int64
+	for m.window.Contains(time.Now()) {
+		var remaining int64
+		err := m.withConn(ctx, func(conn *sql.Conn) error {
+			// Pages are released while the result rows are read.
+			rows, err := conn.QueryContext(ctx, "PRAGMA incremental_vacuum("+strconv.Itoa(maintenanceVacuumPages)+")")
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				freed++
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return conn.QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&remaining)
+		})
+		if err != nil {
+			return freed, err
+		}
+		if remaining == 0 {
+			break
+		}
+		if err := sleepContext(ctx, maintenanceStepPause); err != nil {
+			return freed, err
+		}
+	}
+	return freed, nil
+}
+
+// analyze updates the statistics used by the query planner, looking only
+// at a sample of each index.
+func (m *sqliteMaintenance) analyze(ctx context.Context) error {
+	return m.withConn(ctx, func(conn *sql.Conn) error {
+		if _, err := conn.ExecContext(ctx, "PRAGMA analysis_limit = "+strconv.Itoa(maintenanceAnalysisLimit)); err != nil {
+			return err
+		}
+		_, err := conn.ExecContext(ctx, "ANALYZE")
+		if _, resetErr := conn.ExecContext(context.Background(), "PRAGMA analysis_limit = 0"); resetErr != nil && err == nil {
+			err = resetErr
+		}
+		return err
+	})
+}
+
+// checkpoint copies the WAL into the database file and truncates it. It is
+// retried with backoff if readers prevent it from completing.
+func (m *sqliteMaintenance) checkpoint(ctx context.Context) error {
+	var journalMode string
+	err := m.withConn(ctx, func(conn *sql.Conn) error {
+		return conn.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode)
+	})
+	if err != nil {
+		return err
+	}
+	if journalMode != "wal" {
+		return nil
+	}
+
+	delay := m.checkpointBackoff
+	for attempt := 1; ; attempt++ {
+		var busy, logPages, checkpointed int
+		err := m.withConn(ctx, func(conn *sql.Conn) error {
+			return conn.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logPages, &checkpointed)
+		})
+		if err != nil && !isSQLiteBusyError(err) {
+			return err
+		}
+		if err == nil && busy == 0 {
+			return nil
+		}
+		if attempt == maintenanceCheckpointAttempts {
+			return errCheckpointBusy
+		}
+
+		m.log.DebugMsg("WAL checkpoint is blocked, retrying", "attempt", attempt, "delay", delay,
+			"wal_pages", logPages, "checkpointed_pages", checkpointed)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+		delay *= 2
+		if delay > maintenanceMaxCheckpointDelay {
+			delay = maintenanceMaxCheckpointDelay
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// fileSize returns the size of the file or 0 if it does not exist.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,232 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/gorm"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		t.Helper()
+		tm, err := time.ParseInLocation("2006-01-02 15:04", "2024-03-10 "+hhmm, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	night, err := ParseMaintenanceWindow("23:30", "04:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	morning, err := ParseMaintenanceWindow("02:00", "05:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		window   MaintenanceWindow
+		now      string
+		contains bool
+		next     time.Time
+	}{
+		{MaintenanceWindow{}, "12:00", true, at("12:00")},
+		{morning, "02:00", true, at("02:00")},
+		{morning, "04:59", true, at("04:59")},
+		{morning, "01:00", false, at("02:00")},
+		{morning, "05:00", false, at("02:00").AddDate(0, 0, 1)},
+		{night, "23:45", true, at("23:45")},
+		{night, "03:00", true, at("03:00")},
+		{night, "12:00", false, at("23:30")},
+	} {
+		now := at(c.now)
+		if got := c.window.Contains(now); got != c.contains {
+			t.Errorf("%+v.Contains(%s) = %v, want %v", c.window, c.now, got, c.contains)
+		}
+		if got := c.window.Next(now); !got.Equal(c.next) {
+			t.Errorf("%+v.Next(%s) = %v, want %v", c.window, c.now, got, c.next)
+		}
+	}
+
+	for _, args := range [][2]string{{"2:00", "25:00"}, {"02:00", "02:00"}, {"noon", "05:00"}} {
+		if _, err := ParseMaintenanceWindow(args[0], args[1]); err == nil {
+			t.Errorf("ParseMaintenanceWindow(%q, %q): expected an error", args[0], args[1])
+		}
+	}
+}
+
+type maintenanceTestRecord struct {
+	ID   int `gorm:"primaryKey"`
+	Data []byte
+}
+
+func openMaintenanceTestDB(t *testing.T, path string) (*gorm.DB, *sqliteMaintenance) {
+	t.Helper()
+	gdb, err := New("sqlite3", []string{path}, Options{
+		Log:                       testutils.Logger(t, "db"),
+		SQLiteMaintenanceInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Close(context.Background(), gdb)
+	})
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := stateFor(sqlDB).maintenance
+	if m == nil {
+		t.Fatal("maintenance is not started")
+	}
+	m.checkpointBackoff = time.Millisecond
+	return gdb, m
+}
+
+func TestSQLiteMaintenance(t *testing.T) {
+	path := filepath.Join(testutils.Dir(t), "test.db")
+	gdb, m := openMaintenanceTestDB(t, path)
+
+	if err := gdb.AutoMigrate(&maintenanceTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]maintenanceTestRecord, 3000)
+	for i := range rows {
+		rows[i] = maintenanceTestRecord{ID: i + 1, Data: make([]byte, 4000)}
+	}
+	if err := gdb.CreateInBatches(rows, 100).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Where("1 = 1").Delete(&maintenanceTestRecord{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	sizeBefore := fileSize(path)
+	if fileSize(path+"-wal") == 0 {
+		t.Fatal("WAL is empty before maintenance")
+	}
+
+	if err := m.runOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var free int64
+	if err := gdb.Raw("PRAGMA freelist_count").Scan(&free).Error; err != nil {
+		t.Fatal(err)
+	}
+	if free != 0 {
+		t.Errorf("%d free pages are left", free)
+	}
+	if size := fileSize(path + "-wal"); size != 0 {
+		t.Errorf("WAL is not truncated, size %d", size)
+	}
+	if size := fileSize(path); size >= sizeBefore {
+		t.Errorf("database file did not shrink: %d, was %d", size, sizeBefore)
+	}
+	var stats int64
+	if err := gdb.Raw("SELECT count(*) FROM sqlite_master WHERE name = 'sqlite_stat1'").Scan(&stats).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stats != 1 {
+		t.Error("ANALYZE was not run")
+	}
+
+	var busyTimeout int
+	if err := gdb.Raw("PRAGMA busy_timeout").Scan(&busyTimeout).Error; err != nil {
+		t.Fatal(err)
+	}
+	if busyTimeout != DefaultSQLiteBusyTimeout {
+		t.Errorf("busy_timeout is not restored: %d", busyTimeout)
+	}
+
+	run := m.run.Load()
+	lastRuns := run.lastRuns()
+	for _, task := range []string{maintenanceVacuum, maintenanceAnalyze, maintenanceCheckpoint} {
+		if lastRuns[task].IsZero() {
+			t.Errorf("%s is not recorded as done", task)
+		}
+	}
+
+	// Another pool for the same file does not repeat the run.
+	_, other := openMaintenanceTestDB(t, path)
+	started := run.started
+	if err := other.runOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if other.run.Load() != run || !run.started.Equal(started) {
+		t.Error("maintenance is repeated for the same database file")
+	}
+}
+
+func TestSQLiteMaintenance_CheckpointBusy(t *testing.T) {
+	path := filepath.Join(testutils.Dir(t), "test.db")
+	gdb, m := openMaintenanceTestDB(t, path)
+	if err := gdb.AutoMigrate(&maintenanceTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Create(&maintenanceTestRecord{ID: 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// A read transaction of another process pins the current WAL.
+	reader, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	tx, err := reader.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := tx.QueryRow("SELECT count(*) FROM maintenance_test_records").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Create(&maintenanceTestRecord{ID: 2}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.checkpoint(context.Background()); !errors.Is(err, errCheckpointBusy) {
+		t.Fatalf("expected errCheckpointBusy, got %v", err)
+	}
+
+	tx.Rollback()
+	if err := m.checkpoint(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(path + "-wal"); size != 0 {
+		t.Errorf("WAL is not truncated, size %d", size)
+	}
+}
+
+func TestSQLiteMaintenance_Disabled(t *testing.T) {
+	gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(context.Background(), gdb)
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stateFor(sqlDB).maintenance != nil {
+		t.Error("maintenance is started with zero interval")
+	}
+	var mode int
+	if err := gdb.Raw("PRAGMA auto_vacuum").Scan(&mode).Error; err != nil {
+		t.Fatal(err)
+	}
+	if mode != 0 {
+		t.Errorf("auto_vacuum = %d, want 0", mode)
+	}
+}
@@ -0,0 +1,149 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/gorm"
+)
+
+func TestAddSQLiteParams(t *testing.T) {
+	opts := Options{}.withDefaults("sqlite3")
+
+	cases := []struct {
+		dsn  string
+		want string
+	}{
+		{"test.db", "file:test.db?_journal_mode=WAL&_synchronous=NORMAL&_foreign_keys=ON&_busy_timeout=5000"},
+		{"file:test.db?cache=shared", "file:test.db?cache=shared&_journal_mode=WAL&_synchronous=NORMAL&_foreign_keys=ON&_busy_timeout=5000"},
+		{"test.db?_journal=DELETE&_timeout=100", "file:test.db?_journal=DELETE&_timeout=100&_synchronous=NORMAL&_foreign_keys=ON"},
+	}
+	for _, c := range cases {
+		if got := addSQLiteParams(c.dsn, opts); got != c.want {
+			t.Errorf("addSQLiteParams(%q) = %q, want %q", c.dsn, got, c.want)
+		}
+	}
+}
+
+func TestSQLite_Pragmas(t *testing.T) {
+	gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+		SQLiteBusyTimeout: 1234,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"journal_mode": "wal",
+		"synchronous":  "1", // NORMAL
+		"foreign_keys": "1",
+		"busy_timeout": "1234",
+	}
+	for pragma, want := range expect {
+		var got string
+		if err := gdb.Raw("PRAGMA " + pragma).Scan(&got).Error; err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("PRAGMA %s = %s, want %s", pragma, got, want)
+		}
+	}
+}
+
+type lockTestCounter struct {
+	ID    int `gorm:"primaryKey"`
+	Value int
+}
+
+// TestSQLite_ConcurrentWriters checks that read-then-write transactions
+// running in parallel do not fail with "database is locked". With multiple
+// connections SQLite refuses to upgrade a read transaction to a write
+// transaction if another connection is writing, without waiting for the
+// busy timeout.
+func TestSQLite_ConcurrentWriters(t *testing.T) {
+	gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.AutoMigrate(&lockTestCounter{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Create(&lockTestCounter{ID: 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		workers    = 16
+		increments = 25
+	)
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers*increments)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				errCh <- gdb.Transaction(func(tx *gorm.DB) error {
+					var c lockTestCounter
+					if err := tx.First(&c, 1).Error; err != nil {
+						return err
+					}
+					return tx.Model(&c).Update("value", c.Value+1).Error
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		if err != nil {
+			t.Fatal("concurrent transaction failed:", err)
+		}
+	}
+
+	var c lockTestCounter
+	if err := gdb.First(&c, 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	if c.Value != workers*increments {
+		t.Errorf("counter = %d, want %d", c.Value, workers*increments)
+	}
+}
+
+func TestSQLite_PathWithSpaces(t *testing.T) {
+	dir := filepath.Join(testutils.Dir(t), "my data")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test db.sqlite")
+
+	for _, dsn := range []DSN{
+		{Args: []string{path}},
+		{Params: map[string]string{"path": path}},
+	} {
+		parts, err := dsn.Parts("sqlite3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		gdb, err := New("sqlite3", parts, Options{Log: testutils.Logger(t, "db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = gdb.Exec("CREATE TABLE IF NOT EXISTS t (id INTEGER)").Error
+		sqlDB, _ := gdb.DB()
+		sqlDB.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("database was not created at %q: %v", path, err)
+		}
+	}
+}
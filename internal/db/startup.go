@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SkipStartupCheck disables the checks done before a database is used:
+// NewWithContext does not ping the database and Migrate does not verify
+// the schema of databases configured with auto_migrate off. It is set by
+// the --skip-db-check flag of the run command and is meant for unusual
+// situations, such as starting the server while a database is known to
+// be unavailable.
+var SkipStartupCheck bool
+
+// SchemaError is returned by CheckSchema if migrations known to the server
+// are not applied to the database.
+type SchemaError struct {
+	// Version is the number of applied migrations out of Required ones.
+	Version  int
+	Required int
+	Pending  []string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("database schema is at version %d, binary requires %d (pending migrations: %s) - run maddy db migrate",
+		e.Version, e.Required, strings.Join(e.Pending, ", "))
+}
+
+func pingWithTimeout(ctx context.Context, sqlDB *sql.DB, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// CheckSchema verifies that the schema_migrations table exists and all
+// migrations are recorded in it, returning *SchemaError otherwise.
+func CheckSchema(gdb *gorm.DB, migrations []Migration) error {
+	_, pending, err := MigrationStatus(gdb, migrations)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(pending))
+	for _, m := range pending {
+		ids = append(ids, m.ID)
+	}
+	return &SchemaError{
+		Version:  len(migrations) - len(pending),
+		Required: len(migrations),
+		Pending:  ids,
+	}
+}
+
+// waitForSchema runs CheckSchema until it succeeds, using the retry
+// settings the database was opened with, so the server can be started
+// while migrations are applied by another instance or a separate job.
+func waitForSchema(gdb *gorm.DB, st *poolState, migrations []Migration) error {
+	ctx := gdb.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return retryConnect(ctx, gdb.Dialector.Name(), st.connectOpts, "database schema is not up to date, retrying", func() error {
+		err := CheckSchema(gdb, migrations)
+		var schemaErr *SchemaError
+		if errors.As(err, &schemaErr) {
+			return retryableError{err}
+		}
+		return err
+	})
+}
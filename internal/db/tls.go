@@ -0,0 +1,168 @@
+package db
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func (opts Options) tlsEnabled() bool {
+	return opts.TLSCAFile != "" || opts.TLSCertFile != "" || opts.TLSKeyFile != ""
+}
+
+// ConfigureTLS applies Options.TLS* settings to the DSN and checks that the
+// TLS files referenced by the DSN can be used, so that misconfiguration is
+// reported at startup instead of failing the TLS handshake later.
+//
+// NewWithContext calls it for the DSN passed to it, it should be used for
+// other connections to the same database made using database/sql directly.
+func ConfigureTLS(driver, dsn string, opts Options) (string, error) {
+	if opts.TLSCertFile != "" && opts.TLSKeyFile == "" || opts.TLSCertFile == "" && opts.TLSKeyFile != "" {
+		return "", fmt.Errorf("%s: tls_cert_file and tls_key_file must be specified together", driver)
+	}
+
+	switch driver {
+	case "mysql":
+		return configureMySQLTLS(dsn, opts)
+	case "postgres":
+		return configurePostgresTLS(dsn, opts)
+	default:
+		if opts.tlsEnabled() {
+			return "", fmt.Errorf("%s: tls_ca_file, tls_cert_file and tls_key_file are not supported for this driver", driver)
+		}
+		return dsn, nil
+	}
+}
+
+func buildTLSConfig(opts Options) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if opts.TLSCAFile != "" {
+		blob, err := os.ReadFile(opts.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(blob) {
+			return nil, fmt.Errorf("no certificates found in tls_ca_file %s", opts.TLSCAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if opts.TLSCertFile != "" {
+		keypair, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{keypair}
+	}
+
+	return cfg, nil
+}
+
+// mysqlTLSProfile returns the name used with mysql.RegisterTLSConfig for the
+// set of files. Databases sharing the same files share the profile.
+func mysqlTLSProfile(opts Options) string {
+	sum := sha256.Sum256([]byte(opts.TLSCAFile + "\x00" + opts.TLSCertFile + "\x00" + opts.TLSKeyFile))
+	return "madmail-" + hex.EncodeToString(sum[:8])
+}
+
+func configureMySQLTLS(dsn string, opts Options) (string, error) {
+	if !opts.tlsEnabled() {
+		return dsn, nil
+	}
+
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", fmt.Errorf("mysql: malformed dsn: %w", err)
+	}
+	if cfg.TLSConfig != "" && cfg.TLSConfig != "false" {
+		return "", fmt.Errorf("mysql: tls=%s in dsn conflicts with tls_* directives", cfg.TLSConfig)
+	}
+
+	tlsCfg, err := buildTLSConfig(opts)
+	if err != nil {
+		return "", fmt.Errorf("mysql: %w", err)
+	}
+	// Registered again on each connection attempt so that renewed
+	// certificates are picked up.
+	profile := mysqlTLSProfile(opts)
+	if err := mysql.RegisterTLSConfig(profile, tlsCfg); err != nil {
+		return "", fmt.Errorf("mysql: %w", err)
+	}
+
+	cfg.TLSConfig = profile
+	return cfg.FormatDSN(), nil
+}
+
+// postgresParamSet reports whether the keyword/value or URL DSN sets the
+// parameter.
+func postgresParamSet(dsn, key string) bool {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		return err == nil && u.Query().Has(key)
+	}
+	return regexp.MustCompile(`(^|\s)` + regexp.QuoteMeta(key) + `\s*=`).MatchString(dsn)
+}
+
+func addPostgresParam(dsn, key, value string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		return dsn + sep + url.QueryEscape(key) + "=" + url.QueryEscape(value)
+	}
+	if dsn != "" {
+		dsn += " "
+	}
+	return dsn + key + "=" + quotePostgresValue(value)
+}
+
+func configurePostgresTLS(dsn string, opts Options) (string, error) {
+	if opts.tlsEnabled() {
+		for _, p := range []struct{ key, value string }{
+			{"sslrootcert", opts.TLSCAFile},
+			{"sslcert", opts.TLSCertFile},
+			{"sslkey", opts.TLSKeyFile},
+		} {
+			if p.value == "" {
+				continue
+			}
+			if postgresParamSet(dsn, p.key) {
+				return "", fmt.Errorf("postgres: %s in dsn conflicts with tls_* directives", p.key)
+			}
+			dsn = addPostgresParam(dsn, p.key, p.value)
+		}
+		if !postgresParamSet(dsn, "sslmode") {
+			mode := "require"
+			if opts.TLSCAFile != "" {
+				mode = "verify-full"
+			}
+			dsn = addPostgresParam(dsn, "sslmode", mode)
+		}
+	} else if !postgresParamSet(dsn, "sslrootcert") && !postgresParamSet(dsn, "sslcert") &&
+		!postgresParamSet(dsn, "sslkey") {
+		return dsn, nil
+	}
+
+	// pgconn reads and validates the certificate files while parsing, the
+	// error does not include the password.
+	cfg, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		return "", fmt.Errorf("postgres: invalid TLS configuration: %w", err)
+	}
+	if cfg.TLSConfig == nil {
+		return "", fmt.Errorf("postgres: TLS files are configured but sslmode disables TLS")
+	}
+	return dsn, nil
+}
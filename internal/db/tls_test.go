@@ -0,0 +1,175 @@
+package db
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// writeTestTLSFiles generates a CA and a client certificate signed by it and
+// returns Options referencing them.
+func writeTestTLSFiles(t *testing.T) Options {
+	t.Helper()
+	dir := t.TempDir()
+
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "maddy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTmpl, caTmpl, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKeyDER, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Options{
+		TLSCAFile:   writePEM("ca.pem", "CERTIFICATE", caDER),
+		TLSCertFile: writePEM("client.pem", "CERTIFICATE", clientDER),
+		TLSKeyFile:  writePEM("client.key", "PRIVATE KEY", clientKeyDER),
+	}
+}
+
+func TestConfigureTLS_MySQL(t *testing.T) {
+	opts := writeTestTLSFiles(t)
+
+	dsn, err := ConfigureTLS("mysql", "maddy:pass@tcp(db:3306)/maddy?parseTime=true", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dsn, "tls="+mysqlTLSProfile(opts)) {
+		t.Fatalf("TLS profile is not added to the DSN: %q", dsn)
+	}
+
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TLS == nil || cfg.TLS.RootCAs == nil || len(cfg.TLS.Certificates) != 1 {
+		t.Errorf("registered TLS config is incomplete: %+v", cfg.TLS)
+	}
+	if cfg.TLS.ServerName != "db" {
+		t.Errorf("unexpected server name: %q", cfg.TLS.ServerName)
+	}
+	if cfg.User != "maddy" || cfg.Passwd != "pass" || !cfg.ParseTime {
+		t.Errorf("DSN rewriting lost settings: %+v", cfg)
+	}
+
+	if _, err := ConfigureTLS("mysql", "maddy:pass@tcp(db:3306)/maddy?tls=skip-verify", opts); err == nil {
+		t.Error("expected an error for conflicting tls parameter")
+	}
+
+	// No TLS options, DSN must be left as is.
+	plain := "maddy:pass@tcp(db:3306)/maddy?tls=skip-verify"
+	if dsn, err := ConfigureTLS("mysql", plain, Options{}); err != nil || dsn != plain {
+		t.Errorf("DSN without TLS options was changed: %q, %v", dsn, err)
+	}
+}
+
+func TestConfigureTLS_Postgres(t *testing.T) {
+	opts := writeTestTLSFiles(t)
+
+	for _, dsn := range []string{
+		`host=db user=maddy password='it\'s' dbname=maddy`,
+		"postgres://maddy@db/maddy",
+	} {
+		res, err := ConfigureTLS("postgres", dsn, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", dsn, err)
+		}
+		cfg, err := pgconn.ParseConfig(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.TLSConfig == nil || cfg.TLSConfig.RootCAs == nil || len(cfg.TLSConfig.Certificates) != 1 {
+			t.Errorf("%s: TLS is not fully configured: %q", dsn, res)
+		}
+		if !postgresParamSet(res, "sslmode") || !strings.Contains(res, "verify-full") {
+			t.Errorf("%s: sslmode is not set to verify-full: %q", dsn, res)
+		}
+	}
+
+	if _, err := ConfigureTLS("postgres", "host=db sslmode=disable", opts); err == nil {
+		t.Error("expected an error for sslmode=disable with TLS files")
+	}
+	if _, err := ConfigureTLS("postgres", "host=db sslrootcert=/etc/ssl/other.pem", opts); err == nil {
+		t.Error("expected an error for conflicting sslrootcert")
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	_, err := ConfigureTLS("postgres", "host=db password=hunter2 sslmode=verify-full sslrootcert="+missing, Options{})
+	if err == nil || !strings.Contains(err.Error(), "invalid TLS configuration") {
+		t.Errorf("expected a TLS configuration error for missing sslrootcert, got %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("error includes the password: %v", err)
+	}
+}
+
+func TestConfigureTLS_Invalid(t *testing.T) {
+	opts := writeTestTLSFiles(t)
+
+	if _, err := ConfigureTLS("postgres", "host=db", Options{TLSCertFile: opts.TLSCertFile}); err == nil {
+		t.Error("expected an error for cert without key")
+	}
+	if _, err := ConfigureTLS("sqlite3", "test.db", opts); err == nil {
+		t.Error("expected an error for TLS options with sqlite3")
+	}
+
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ConfigureTLS("mysql", "maddy@tcp(db)/maddy", Options{TLSCAFile: notPEM})
+	if err == nil || !strings.Contains(err.Error(), "no certificates found") {
+		t.Errorf("expected an error for invalid CA file, got %v", err)
+	}
+}
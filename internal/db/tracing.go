@@ -0,0 +1,139 @@
+package db
+
+import (
+	"errors"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	tracerName    = "github.com/themadorg/madmail/internal/db"
+	traceSpanKey  = "madmail:trace_span"
+	maxTracedStmt = 1024
+)
+
+// useTracing registers GORM callbacks that create a client span for every
+// operation as a child of the statement context (see gorm.DB.WithContext).
+//
+// Nothing is registered if tp is nil so there is no overhead when tracing is
+// not configured.
+func useTracing(gdb *gorm.DB, tp trace.TracerProvider) error {
+	if tp == nil {
+		return nil
+	}
+	tracer := tp.Tracer(tracerName)
+	system := dbSystem(gdb.Dialector.Name())
+
+	before := func(db *gorm.DB) {
+		ctx := db.Statement.Context
+		spanName := "db"
+		if db.Statement.Table != "" {
+			spanName = "db " + db.Statement.Table
+		}
+		ctx, span := tracer.Start(ctx, spanName, trace.WithSpanKind(trace.SpanKindClient))
+		db.Statement.Context = ctx
+		db.Statement.Settings.Store(traceSpanKey, span)
+	}
+	after := func(op string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			v, ok := db.Statement.Settings.LoadAndDelete(traceSpanKey)
+			if !ok {
+				return
+			}
+			span := v.(trace.Span)
+			defer span.End()
+			if !span.IsRecording() {
+				return
+			}
+
+			span.SetAttributes(
+				attribute.String("db.system", system),
+				attribute.String("db.operation", op),
+				attribute.String("db.sql.table", db.Statement.Table),
+				attribute.String("db.statement", sanitizeStatement(db.Statement.SQL.String())),
+				attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+			)
+			if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+				span.RecordError(db.Error)
+				span.SetStatus(codes.Error, db.Error.Error())
+			}
+		}
+	}
+	return registerCallbacks(gdb, "madmail:tracing", before, after)
+}
+
+// dbSystem maps GORM dialect names to OpenTelemetry db.system values.
+func dbSystem(dialect string) string {
+	switch dialect {
+	case "postgres":
+		return "postgresql"
+	case "sqlserver":
+		return "mssql"
+	default:
+		return dialect
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c == '@' || c == '.' ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// sanitizeStatement replaces string and numeric literals in the SQL
+// statement with '?' and truncates it to maxTracedStmt bytes so message
+// contents and other user data inlined into raw queries never end up in
+// traces. Quoted identifiers and placeholders are kept.
+func sanitizeStatement(stmt string) string {
+	var b strings.Builder
+	b.Grow(len(stmt))
+
+	for i := 0; i < len(stmt) && b.Len() < maxTracedStmt; i++ {
+		c := stmt[i]
+		switch {
+		case c == '\'':
+			// String literal, '' is an escaped quote.
+			for i++; i < len(stmt); i++ {
+				if stmt[i] == '\'' {
+					if i+1 < len(stmt) && stmt[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			b.WriteByte('?')
+		case '0' <= c && c <= '9' && (i == 0 || !isIdentChar(stmt[i-1])):
+			for i+1 < len(stmt) && isIdentChar(stmt[i+1]) {
+				i++
+			}
+			b.WriteByte('?')
+		case c == '"' || c == '`' || c == '[':
+			// Quoted identifier, copied as is.
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			j := strings.IndexByte(stmt[i+1:], end)
+			if j < 0 {
+				b.WriteString(stmt[i:])
+				i = len(stmt)
+				continue
+			}
+			b.WriteString(stmt[i : i+j+2])
+			i += j + 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	res := b.String()
+	if len(res) > maxTracedStmt {
+		res = res[:maxTracedStmt]
+	}
+	// Do not leave a partial UTF-8 sequence at the end if truncated.
+	return strings.ToValidUTF8(res, "")
+}
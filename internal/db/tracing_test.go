@@ -0,0 +1,118 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/themadorg/madmail/internal/testutils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSanitizeStatement(t *testing.T) {
+	for _, c := range []struct {
+		in, out string
+	}{
+		{`SELECT * FROM "quotas" WHERE "username" = $1`, `SELECT * FROM "quotas" WHERE "username" = $1`},
+		{`SELECT * FROM quotas WHERE username = 'user@example.org' LIMIT 1`, `SELECT * FROM quotas WHERE username = ? LIMIT ?`},
+		{`INSERT INTO t (a, b) VALUES ('it''s secret', -12.5e3)`, `INSERT INTO t (a, b) VALUES (?, -?)`},
+		{"SELECT `col1` FROM `t2` WHERE x = ?", "SELECT `col1` FROM `t2` WHERE x = ?"},
+		{`SELECT [key] FROM t WHERE id = @p1`, `SELECT [key] FROM t WHERE id = @p1`},
+		{`SELECT 'unterminated`, `SELECT ?`},
+		{`SELECT "unterminated`, `SELECT "unterminated`},
+		{`UPDATE t SET body = X'DEADBEEF'`, `UPDATE t SET body = X?`},
+	} {
+		if got := sanitizeStatement(c.in); got != c.out {
+			t.Errorf("sanitizeStatement(%q) = %q, want %q", c.in, got, c.out)
+		}
+	}
+
+	long := "SELECT " + strings.Repeat("ж", maxTracedStmt)
+	got := sanitizeStatement(long)
+	if len(got) > maxTracedStmt {
+		t.Errorf("statement is not truncated: %d bytes", len(got))
+	}
+	if !strings.HasPrefix(long, got) || !strings.HasSuffix(got, "ж") {
+		t.Error("truncated statement ends with a partial rune")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	gdb, err := New("sqlite3", []string{filepath.Join(testutils.Dir(t), "test.db")}, Options{
+		Log:            testutils.Logger(t, "db"),
+		TracerProvider: tp,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		sqlDB, _ := gdb.DB()
+		sqlDB.Close()
+	}()
+	if err := gdb.AutoMigrate(&metricsTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	gdb.WithContext(ctx).Create(&metricsTestRecord{ID: 1, Name: "secret body"})
+	gdb.WithContext(ctx).Exec("SELECT * FROM nonexistent WHERE x = 'secret'")
+	parent.End()
+
+	var created, failed sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		attrs := attribute.NewSet(s.Attributes()...)
+		op, _ := attrs.Value("db.operation")
+		switch op.AsString() {
+		case "create":
+			created = s
+		case "raw":
+			failed = s
+		}
+	}
+	if created == nil || failed == nil {
+		t.Fatalf("expected create and raw spans, got %d spans", len(recorder.Ended()))
+	}
+
+	if created.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("create span is not a child of the context span")
+	}
+	attrs := attribute.NewSet(created.Attributes()...)
+	if v, _ := attrs.Value("db.sql.table"); v.AsString() != "metrics_test_records" {
+		t.Errorf("unexpected table: %q", v.AsString())
+	}
+	if v, _ := attrs.Value("db.rows_affected"); v.AsInt64() != 1 {
+		t.Errorf("unexpected rows affected: %d", v.AsInt64())
+	}
+	if v, _ := attrs.Value("db.system"); v.AsString() != "sqlite" {
+		t.Errorf("unexpected db.system: %q", v.AsString())
+	}
+	if created.Status().Code == codes.Error {
+		t.Error("successful operation has error status")
+	}
+
+	failedAttrs := attribute.NewSet(failed.Attributes()...)
+	stmt, _ := failedAttrs.Value("db.statement")
+	if strings.Contains(stmt.AsString(), "secret") {
+		t.Errorf("statement literal leaked into trace: %q", stmt.AsString())
+	}
+	if failed.Status().Code != codes.Error {
+		t.Error("failed operation does not have error status")
+	}
+}
+
+func TestTracing_Disabled(t *testing.T) {
+	gdb := openTestDB(t)
+	if gdb.Callback().Query().Get("madmail:tracing_before_query") != nil {
+		t.Error("tracing callbacks are registered without TracerProvider")
+	}
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	mssql "github.com/microsoft/go-mssqldb"
+	"gorm.io/gorm"
+)
+
+// DefaultTxAttempts is the number of times WithTx runs the transaction if
+// TxOptions.MaxAttempts is not set.
+const DefaultTxAttempts = 5
+
+const (
+	initialTxBackoff = 10 * time.Millisecond
+	maxTxBackoff     = 500 * time.Millisecond
+)
+
+// TxOptions controls WithTx behavior, the zero value is usable.
+type TxOptions struct {
+	// MaxAttempts is the maximum number of times the transaction is run.
+	// DefaultTxAttempts is used if zero.
+	MaxAttempts int
+
+	// SQL is passed to gorm.DB.Transaction, e.g. to set the isolation level.
+	SQL *sql.TxOptions
+}
+
+// WithTx runs fn in a transaction and commits it if fn returns nil.
+//
+// If the transaction fails with a deadlock, serialization failure or (for
+// SQLite) a busy database, it is rolled back and run again after a short
+// randomized delay, up to opts.MaxAttempts times. fn must therefore not have
+// side effects outside of the transaction. Other errors and context
+// cancellation are returned immediately.
+//
+// The returned attempt count is the number of times fn was run.
+func WithTx(ctx context.Context, gdb *gorm.DB, fn func(tx *gorm.DB) error, opts TxOptions) (attempts int, err error) {
+	maxAttempts := opts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultTxAttempts
+	}
+
+	// Transactions are not affected by rejectWhenClosing, so do not start
+	// new ones once Close is called.
+	if sqlDB, err := gdb.DB(); err == nil && isClosing(sqlDB) {
+		return 0, ErrClosing
+	}
+	// Begin would wait for the unreachable database otherwise.
+	if err := CheckAvailable(gdb); err != nil {
+		return 0, err
+	}
+
+	gdb = gdb.WithContext(ctx)
+	backoff := initialTxBackoff
+	for attempts = 1; ; attempts++ {
+		err = gdb.Transaction(fn, opts.SQL)
+		if err == nil || attempts >= maxAttempts || !isTransientTxError(err) {
+			return attempts, err
+		}
+
+		// Full jitter in [backoff/2, backoff) so that the conflicting
+		// transactions are unlikely to collide again.
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempts, err
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > maxTxBackoff {
+			backoff = maxTxBackoff
+		}
+	}
+}
+
+// isTransientTxError reports whether the transaction failed because of a
+// conflict with a concurrent transaction and can be safely retried.
+func isTransientTxError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || // serialization_failure
+			pgErr.Code == "40P01" // deadlock_detected
+	}
+
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return myErr.Number == 1213 || // ER_LOCK_DEADLOCK
+			myErr.Number == 1205 // ER_LOCK_WAIT_TIMEOUT
+	}
+
+	var msErr mssql.Error
+	if errors.As(err, &msErr) {
+		return msErr.Number == 1205 // chosen as the deadlock victim
+	}
+
+	return isSQLiteBusyError(err)
+}
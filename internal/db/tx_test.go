@@ -0,0 +1,117 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+	mssql "github.com/microsoft/go-mssqldb"
+	"gorm.io/gorm"
+)
+
+func TestIsTransientTxError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"pg serialization failure", &pgconn.PgError{Code: "40001"}, true},
+		{"pg deadlock", fmt.Errorf("insert: %w", &pgconn.PgError{Code: "40P01"}), true},
+		{"pg unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"mysql deadlock", &mysql.MySQLError{Number: 1213}, true},
+		{"mysql lock wait timeout", &mysql.MySQLError{Number: 1205}, true},
+		{"mysql duplicate entry", &mysql.MySQLError{Number: 1062}, false},
+		{"mssql deadlock victim", mssql.Error{Number: 1205}, true},
+		{"sqlite busy", sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{"sqlite constraint", sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+		{"canceled", fmt.Errorf("%w: %w", context.Canceled, &mysql.MySQLError{Number: 1213}), false},
+		{"other", errors.New("no such table"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isTransientTxError(c.err); got != c.want {
+				t.Errorf("isTransientTxError(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	gdb := openTestDB(t)
+	if err := gdb.Migrator().DropTable(&driverTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.AutoMigrate(&driverTestRecord{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fails twice with a deadlock, the rows inserted by failed attempts
+	// must be rolled back.
+	calls := 0
+	attempts, err := WithTx(context.Background(), gdb, func(tx *gorm.DB) error {
+		calls++
+		if err := tx.Create(&driverTestRecord{Name: fmt.Sprint("attempt-", calls)}).Error; err != nil {
+			return err
+		}
+		if calls < 3 {
+			return &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+		}
+		return nil
+	}, TxOptions{})
+	if err != nil {
+		t.Fatal("WithTx:", err)
+	}
+	if attempts != 3 || calls != 3 {
+		t.Errorf("expected 3 attempts, got %d (%d calls)", attempts, calls)
+	}
+	var names []string
+	if err := gdb.Model(&driverTestRecord{}).Pluck("name", &names).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "attempt-3" {
+		t.Errorf("unexpected rows: %v", names)
+	}
+
+	// Non-transient error.
+	errFail := errors.New("fail")
+	calls = 0
+	attempts, err = WithTx(context.Background(), gdb, func(tx *gorm.DB) error {
+		calls++
+		return errFail
+	}, TxOptions{})
+	if !errors.Is(err, errFail) || attempts != 1 || calls != 1 {
+		t.Errorf("non-transient error: attempts %d, calls %d, err %v", attempts, calls, err)
+	}
+
+	// Attempt limit.
+	calls = 0
+	attempts, err = WithTx(context.Background(), gdb, func(tx *gorm.DB) error {
+		calls++
+		return sqlite3.Error{Code: sqlite3.ErrBusy}
+	}, TxOptions{MaxAttempts: 2})
+	if err == nil || attempts != 2 || calls != 2 {
+		t.Errorf("attempt limit: attempts %d, calls %d, err %v", attempts, calls, err)
+	}
+}
+
+func TestWithTx_Canceled(t *testing.T) {
+	gdb := openTestDB(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	attempts, err := WithTx(ctx, gdb, func(tx *gorm.DB) error {
+		calls++
+		cancel()
+		return &pgconn.PgError{Code: "40001"}
+	}, TxOptions{})
+	if err == nil || attempts != 1 || calls != 1 {
+		t.Errorf("transaction was retried after cancellation: attempts %d, calls %d, err %v", attempts, calls, err)
+	}
+}
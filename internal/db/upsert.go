@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// upsertAttempts limits the number of times Upsert retries the insert if
+// the conflicting row is deleted before it is updated.
+const upsertAttempts = 3
+
+// Upsert inserts row or, if a row with the same values of conflictColumns
+// exists, applies assignments to the existing row. conflictColumns must
+// correspond to a primary key or a unique index. Assignment values can be
+// expressions, e.g. gorm.Expr("hits + ?", 1).
+//
+// The returned value reports whether the row was inserted. Databases do not
+// report it consistently for a single INSERT ... ON CONFLICT DO UPDATE
+// statement (SQLite and PostgreSQL return one affected row in both cases), so
+// Upsert runs INSERT ... ON CONFLICT DO NOTHING followed by an UPDATE if
+// nothing was inserted. Both statements are atomic on their own, concurrent
+// callers never lose updates.
+func Upsert(ctx context.Context, gdb *gorm.DB, row interface{}, conflictColumns []string, assignments map[string]interface{}) (inserted bool, err error) {
+	if len(assignments) == 0 {
+		return false, fmt.Errorf("db: upsert: no assignments")
+	}
+
+	stmt := &gorm.Statement{DB: gdb}
+	if err := stmt.Parse(row); err != nil {
+		return false, fmt.Errorf("db: upsert: %w", err)
+	}
+	sch := stmt.Schema
+
+	if len(conflictColumns) == 0 {
+		return false, fmt.Errorf("db: upsert: %s: no conflict columns", sch.Table)
+	}
+	rv := reflect.Indirect(reflect.ValueOf(row))
+	columns := make([]clause.Column, 0, len(conflictColumns))
+	where := make(map[string]interface{}, len(conflictColumns))
+	for _, name := range conflictColumns {
+		f := sch.LookUpField(name)
+		if f == nil {
+			return false, fmt.Errorf("db: upsert: %s: unknown column %s", sch.Table, name)
+		}
+		columns = append(columns, clause.Column{Name: f.DBName})
+		where[f.DBName], _ = f.ValueOf(ctx, rv)
+	}
+
+	gdb = gdb.WithContext(ctx)
+	model := reflect.New(sch.ModelType).Interface()
+	for i := 0; i < upsertAttempts; i++ {
+		res := upsertInsert(gdb, row, columns)
+		if res.Error != nil {
+			return false, res.Error
+		}
+		if res.RowsAffected != 0 {
+			return true, nil
+		}
+
+		res = upsertUpdate(gdb, model, where, assignments)
+		if res.Error != nil {
+			return false, res.Error
+		}
+		if res.RowsAffected != 0 {
+			return false, nil
+		}
+
+		// MySQL does not count rows that were not changed by the update.
+		var count int64
+		if err := gdb.Model(model).Where(where).Count(&count).Error; err != nil {
+			return false, err
+		}
+		if count != 0 {
+			return false, nil
+		}
+		// The row was deleted between the statements, try to insert it again.
+	}
+	return false, fmt.Errorf("db: upsert: %s: row is concurrently deleted", sch.Table)
+}
+
+// IncrementOnConflict inserts row or adds delta to column of the existing
+// row with the same values of conflictColumns, see Upsert. The column value
+// of the inserted row is taken from row as is, so it should usually be set to
+// delta by the caller.
+func IncrementOnConflict(ctx context.Context, gdb *gorm.DB, row interface{}, conflictColumns []string, column string, delta int64) (inserted bool, err error) {
+	return Upsert(ctx, gdb, row, conflictColumns, map[string]interface{}{
+		column: gorm.Expr("? + ?", clause.Column{Name: column}, delta),
+	})
+}
+
+func upsertInsert(tx *gorm.DB, row interface{}, columns []clause.Column) *gorm.DB {
+	return tx.Clauses(clause.OnConflict{Columns: columns, DoNothing: true}).Create(row)
+}
+
+func upsertUpdate(tx *gorm.DB, model interface{}, where, assignments map[string]interface{}) *gorm.DB {
+	return tx.Model(model).Where(where).Updates(assignments)
+}
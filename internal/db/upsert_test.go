@@ -0,0 +1,187 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type upsertTestCounter struct {
+	Name string `gorm:"primaryKey"`
+	Hits int64
+	Note string
+}
+
+type upsertTestPair struct {
+	ID   uint
+	A    string `gorm:"uniqueIndex:idx_upsert_test_pair"`
+	B    string `gorm:"uniqueIndex:idx_upsert_test_pair"`
+	Hits int64
+}
+
+// TestUpsert runs the same scenario against any driver, see openTestDB.
+func TestUpsert(t *testing.T) {
+	gdb := openTestDB(t)
+	if err := gdb.Migrator().DropTable(&upsertTestCounter{}, &upsertTestPair{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.AutoMigrate(&upsertTestCounter{}, &upsertTestPair{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	steps := []struct {
+		name         string
+		upsert       func() (bool, error)
+		wantInserted bool
+	}{
+		{
+			name: "insert",
+			upsert: func() (bool, error) {
+				return IncrementOnConflict(ctx, gdb, &upsertTestCounter{Name: "a", Hits: 1}, []string{"name"}, "hits", 1)
+			},
+			wantInserted: true,
+		},
+		{
+			name: "increment",
+			upsert: func() (bool, error) {
+				return IncrementOnConflict(ctx, gdb, &upsertTestCounter{Name: "a", Hits: 1}, []string{"name"}, "hits", 1)
+			},
+		},
+		{
+			name: "increment by 5",
+			upsert: func() (bool, error) {
+				return IncrementOnConflict(ctx, gdb, &upsertTestCounter{Name: "a", Hits: 5}, []string{"name"}, "hits", 5)
+			},
+		},
+		{
+			name: "same value",
+			upsert: func() (bool, error) {
+				return Upsert(ctx, gdb, &upsertTestCounter{Name: "a"}, []string{"name"}, map[string]interface{}{"note": ""})
+			},
+		},
+		{
+			name: "set",
+			upsert: func() (bool, error) {
+				return Upsert(ctx, gdb, &upsertTestCounter{Name: "a"}, []string{"name"}, map[string]interface{}{"note": "updated"})
+			},
+		},
+		{
+			name: "insert another",
+			upsert: func() (bool, error) {
+				return IncrementOnConflict(ctx, gdb, &upsertTestCounter{Name: "b", Hits: 1}, []string{"name"}, "hits", 1)
+			},
+			wantInserted: true,
+		},
+		{
+			name: "insert pair",
+			upsert: func() (bool, error) {
+				return IncrementOnConflict(ctx, gdb, &upsertTestPair{A: "x", B: "y", Hits: 1}, []string{"a", "b"}, "hits", 1)
+			},
+			wantInserted: true,
+		},
+		{
+			name: "increment pair",
+			upsert: func() (bool, error) {
+				return IncrementOnConflict(ctx, gdb, &upsertTestPair{A: "x", B: "y", Hits: 1}, []string{"a", "b"}, "hits", 1)
+			},
+		},
+		{
+			name: "insert pair with shared column",
+			upsert: func() (bool, error) {
+				return IncrementOnConflict(ctx, gdb, &upsertTestPair{A: "x", B: "z", Hits: 1}, []string{"a", "b"}, "hits", 1)
+			},
+			wantInserted: true,
+		},
+	}
+	for _, step := range steps {
+		inserted, err := step.upsert()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if inserted != step.wantInserted {
+			t.Errorf("%s: inserted = %v, want %v", step.name, inserted, step.wantInserted)
+		}
+	}
+
+	var counters []upsertTestCounter
+	if err := gdb.Order("name").Find(&counters).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(counters) != 2 || counters[0] != (upsertTestCounter{Name: "a", Hits: 7, Note: "updated"}) || counters[1] != (upsertTestCounter{Name: "b", Hits: 1}) {
+		t.Errorf("unexpected counters: %+v", counters)
+	}
+	var pairs []upsertTestPair
+	if err := gdb.Order("b").Find(&pairs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || pairs[0].Hits != 2 || pairs[1].Hits != 1 {
+		t.Errorf("unexpected pairs: %+v", pairs)
+	}
+
+	if _, err := Upsert(ctx, gdb, &upsertTestCounter{Name: "a"}, []string{"missing"}, map[string]interface{}{"hits": 0}); err == nil {
+		t.Error("expected an error for an unknown conflict column")
+	}
+}
+
+func TestUpsert_SQL(t *testing.T) {
+	dialects := []struct {
+		name      string
+		dialector gorm.Dialector
+		insert    string
+		update    string
+	}{
+		{
+			name:      "sqlite3",
+			dialector: sqlite.Open(filepath.Join(testutils.Dir(t), "test.db")),
+			insert:    "INSERT INTO `upsert_test_counters` (`name`,`hits`,`note`) VALUES (\"a\",1,\"\") ON CONFLICT (`name`) DO NOTHING",
+			update:    "UPDATE `upsert_test_counters` SET `hits`=`hits` + 1 WHERE `upsert_test_counters`.`name` = \"a\"",
+		},
+		{
+			name:      "postgres",
+			dialector: postgres.Open("host=localhost port=1"),
+			insert:    `INSERT INTO "upsert_test_counters" ("name","hits","note") VALUES ('a',1,'') ON CONFLICT ("name") DO NOTHING`,
+			update:    `UPDATE "upsert_test_counters" SET "hits"="hits" + 1 WHERE "upsert_test_counters"."name" = 'a'`,
+		},
+		{
+			name:      "mysql",
+			dialector: mysql.New(mysql.Config{DSN: "user@tcp(localhost:1)/db", SkipInitializeWithVersion: true}),
+			insert:    "INSERT INTO `upsert_test_counters` (`name`,`hits`,`note`) VALUES ('a',1,'') ON DUPLICATE KEY UPDATE `name`=`name`",
+			update:    "UPDATE `upsert_test_counters` SET `hits`=`hits` + 1 WHERE `upsert_test_counters`.`name` = 'a'",
+		},
+	}
+	for _, d := range dialects {
+		t.Run(d.name, func(t *testing.T) {
+			gdb, err := gorm.Open(d.dialector, &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			insert := gdb.ToSQL(func(tx *gorm.DB) *gorm.DB {
+				return upsertInsert(tx, &upsertTestCounter{Name: "a", Hits: 1}, []clause.Column{{Name: "name"}})
+			})
+			if insert != d.insert {
+				t.Errorf("insert:\n got: %s\nwant: %s", insert, d.insert)
+			}
+
+			update := gdb.ToSQL(func(tx *gorm.DB) *gorm.DB {
+				return upsertUpdate(tx, &upsertTestCounter{}, map[string]interface{}{"name": "a"}, map[string]interface{}{
+					"hits": gorm.Expr("? + ?", clause.Column{Name: "hits"}, 1),
+				})
+			})
+			if update != d.update {
+				t.Errorf("update:\n got: %s\nwant: %s", update, d.update)
+			}
+		})
+	}
+}
@@ -215,7 +215,7 @@ func (e *Endpoint) Init(cfg *config.Map) error {
 			dsn = []string{filepath.Join(config.StateDirectory, "sharing.db")}
 		}
 
-		gdb, err := mdb.New(driver, dsn, e.logger.Debug)
+		gdb, err := mdb.New(driver, dsn, mdb.Options{Log: e.logger})
 		if err != nil {
 			return fmt.Errorf("%s: failed to open sharing GORM DB: %v", modName, err)
 		}
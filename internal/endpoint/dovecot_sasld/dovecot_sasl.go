@@ -31,6 +31,7 @@ import (
 	modconfig "github.com/themadorg/madmail/framework/config/module"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
 	"github.com/themadorg/madmail/internal/auth"
 	"github.com/themadorg/madmail/internal/authz"
 )
@@ -52,6 +53,8 @@ func New(_ string, addrs []string) (module.Module, error) {
 		addrs: addrs,
 		saslAuth: auth.SASLAuth{
 			Log: log.Logger{Name: modName + "/saslauth"},
+			// Used by MTAs to authenticate SMTP clients.
+			Protocol: audit.ProtocolSMTP,
 		},
 		log: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
 	}, nil
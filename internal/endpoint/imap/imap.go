@@ -49,6 +49,7 @@ import (
 	tls2 "github.com/themadorg/madmail/framework/config/tls"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
 	"github.com/themadorg/madmail/internal/auth"
 	"github.com/themadorg/madmail/internal/authz"
 	"github.com/themadorg/madmail/internal/pgp_verify"
@@ -87,7 +88,8 @@ func New(modName string, addrs []string) (module.Module, error) {
 		addrs: addrs,
 		Log:   log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:      log.Logger{Name: modName + "/sasl"},
+			Protocol: audit.ProtocolIMAP,
 		},
 	}
 
@@ -296,7 +298,8 @@ func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
 
 func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
 	// saslAuth handles AuthMap calling.
-	err := endp.saslAuth.AuthPlain(username, password)
+	err := endp.saslAuth.AuthPlainFrom(username, password, connInfo.RemoteAddr)
+	audit.Auth(audit.ProtocolIMAP, username, connInfo.RemoteAddr, err)
 	if err != nil {
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", connInfo.RemoteAddr)
 		return nil, imapbackend.ErrInvalidCredentials
@@ -425,30 +428,50 @@ func (h *getQuotaHandler) Handle(conn imapserver.Conn) error {
 		return errors.New("Storage does not support quotas")
 	}
 
-	used, max, _, err := qs.GetQuota(user.Username())
+	resp, err := quotaResp(qs, user.Username())
 	if err != nil {
 		return err
 	}
+	return conn.WriteResp(resp)
+}
 
-	usedKB := used / 1024
-	maxKB := max / 1024
+// messageQuotaStore is implemented by storage backends that can limit the
+// number of messages stored for an account.
+type messageQuotaStore interface {
+	GetMessageQuota(username string) (used, max int64, err error)
+}
 
-	// RFC 2087: * QUOTA "ROOT" (STORAGE 10 512)
-	if err := conn.WriteResp(&imap.DataResp{
+// quotaResp builds the QUOTA response for the single "ROOT" quota root of the
+// user, e.g. * QUOTA "ROOT" (STORAGE 10 512 MESSAGE 2 100). MESSAGE is
+// included only if the message count is limited.
+func quotaResp(qs quotaStore, username string) (*imap.DataResp, error) {
+	used, max, _, err := qs.GetQuota(username)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := []interface{}{
+		imap.RawString("STORAGE"),
+		uint32(used / 1024),
+		uint32(max / 1024),
+	}
+	if mqs, ok := qs.(messageQuotaStore); ok {
+		usedMsgs, maxMsgs, err := mqs.GetMessageQuota(username)
+		if err != nil {
+			return nil, err
+		}
+		if maxMsgs > 0 {
+			resources = append(resources, imap.RawString("MESSAGE"), uint32(usedMsgs), uint32(maxMsgs))
+		}
+	}
+
+	return &imap.DataResp{
 		Fields: []interface{}{
 			imap.RawString("QUOTA"),
 			"ROOT",
-			[]interface{}{
-				imap.RawString("STORAGE"),
-				uint32(usedKB),
-				uint32(maxKB),
-			},
+			resources,
 		},
-	}); err != nil {
-		return err
-	}
-
-	return nil
+	}, nil
 }
 
 type getQuotaRootHandler struct {
@@ -479,7 +502,7 @@ func (h *getQuotaRootHandler) Handle(conn imapserver.Conn) error {
 		return errors.New("Storage does not support quotas")
 	}
 
-	used, max, _, err := qs.GetQuota(user.Username())
+	resp, err := quotaResp(qs, user.Username())
 	if err != nil {
 		return err
 	}
@@ -495,23 +518,7 @@ func (h *getQuotaRootHandler) Handle(conn imapserver.Conn) error {
 		return err
 	}
 
-	usedKB := used / 1024
-	maxKB := max / 1024
-	if err := conn.WriteResp(&imap.DataResp{
-		Fields: []interface{}{
-			imap.RawString("QUOTA"),
-			"ROOT",
-			[]interface{}{
-				imap.RawString("STORAGE"),
-				uint32(usedKB),
-				uint32(maxKB),
-			},
-		},
-	}); err != nil {
-		return err
-	}
-
-	return nil
+	return conn.WriteResp(resp)
 }
 
 type setQuotaHandler struct {
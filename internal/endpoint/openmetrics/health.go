@@ -0,0 +1,89 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package openmetrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/themadorg/madmail/framework/module"
+)
+
+// readyCheckTimeout bounds the time spent in all health checks of a single
+// /ready request.
+const readyCheckTimeout = 5 * time.Second
+
+// serveHealth reports that the process is running and serving requests.
+func (e *Endpoint) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReady runs health checks of all initialized modules that implement
+// module.HealthChecker and responds with 503 if any of them fails.
+func (e *Endpoint) serveReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+	defer cancel()
+
+	type result struct {
+		name string
+		err  error
+	}
+	var checkers []module.Module
+	for _, mod := range module.InitializedInstances() {
+		if _, ok := mod.(module.HealthChecker); ok {
+			checkers = append(checkers, mod)
+		}
+	}
+	results := make(chan result, len(checkers))
+	for _, mod := range checkers {
+		mod := mod
+		go func() {
+			name := mod.Name()
+			if inst := mod.InstanceName(); inst != "" {
+				name += " (" + inst + ")"
+			}
+			results <- result{name, mod.(module.HealthChecker).CheckHealth(ctx)}
+		}()
+	}
+
+	var failed []string
+	for range checkers {
+		res := <-results
+		if res.err != nil {
+			e.logger.Error("health check failed", res.err, "module", res.name)
+			// Errors may contain database addresses and such, they are
+			// only logged.
+			failed = append(failed, res.name+": unavailable")
+		}
+	}
+	sort.Strings(failed)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(failed) != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(failed, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -57,6 +57,8 @@ func (e *Endpoint) Init(cfg *config.Map) error {
 
 	e.mux = http.NewServeMux()
 	e.mux.Handle("/metrics", promhttp.Handler())
+	e.mux.HandleFunc("/health", e.serveHealth)
+	e.mux.HandleFunc("/ready", e.serveReady)
 	e.serv.Handler = e.mux
 
 	for _, a := range e.addrs {
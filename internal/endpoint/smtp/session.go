@@ -39,6 +39,7 @@ import (
 	"github.com/themadorg/madmail/framework/exterrors"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
 	"github.com/themadorg/madmail/internal/auth"
 	"github.com/themadorg/madmail/internal/pgp_verify"
 )
@@ -105,11 +106,31 @@ func (s *Session) AuthMechanisms() []string {
 }
 
 func (s *Session) Auth(mech string) (sasl.Server, error) {
-	return s.endp.saslAuth.CreateSASL(mech, s.connState.RemoteAddr, func(identity string, data auth.ContextData) error {
-		s.connState.AuthUser = identity
-		s.connState.AuthPassword = data.Password
-		return nil
-	}), nil
+	return authFailureHook{
+		Server: s.endp.saslAuth.CreateSASL(mech, s.connState.RemoteAddr, func(identity string, data auth.ContextData) error {
+			s.connState.AuthUser = identity
+			s.connState.AuthPassword = data.Password
+			return nil
+		}),
+		s: s,
+	}, nil
+}
+
+// authFailureHook runs module.AuthFailureCheck checks when the wrapped
+// server rejects credentials.
+type authFailureHook struct {
+	sasl.Server
+	s *Session
+}
+
+func (h authFailureHook) Next(response []byte) ([]byte, bool, error) {
+	challenge, done, err := h.Server.Next(response)
+	if errors.Is(err, auth.ErrInvalidAuthCred) {
+		if hookErr := h.s.endp.pipeline.RunAuthFailureChecks(context.TODO(), &h.s.connState); hookErr != nil {
+			return nil, true, h.s.endp.wrapErr("", true, "AUTH", hookErr)
+		}
+	}
+	return challenge, done, err
 }
 
 func (s *Session) Reset() {
@@ -168,12 +189,17 @@ func (s *Session) AuthPlain(username, password string) error {
 	}
 
 	// saslAuth will handle AuthMap and AuthNormalize.
-	err := s.endp.saslAuth.AuthPlain(username, password)
+	err := s.endp.saslAuth.AuthPlainFrom(username, password, s.connState.RemoteAddr)
+	audit.Auth(audit.ProtocolSMTP, username, s.connState.RemoteAddr, err)
 	if err != nil {
 		s.endp.Log.Error("authentication failed", err, "username", username, "src_ip", s.connState.RemoteAddr)
 
 		failedLogins.WithLabelValues(s.endp.name).Inc()
 
+		if err := s.endp.pipeline.RunAuthFailureChecks(context.TODO(), &s.connState); err != nil {
+			return s.endp.wrapErr("", true, "AUTH", err)
+		}
+
 		if exterrors.IsTemporary(err) {
 			return &smtp.SMTPError{
 				Code:         454,
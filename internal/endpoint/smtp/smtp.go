@@ -41,6 +41,7 @@ import (
 	"github.com/themadorg/madmail/framework/future"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
 	"github.com/themadorg/madmail/internal/auth"
 	"github.com/themadorg/madmail/internal/authz"
 	"github.com/themadorg/madmail/internal/limits"
@@ -95,7 +96,8 @@ func New(modName string, addrs []string) (module.Module, error) {
 		buffer:     buffer.BufferInMemory,
 		Log:        log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:      log.Logger{Name: modName + "/sasl"},
+			Protocol: audit.ProtocolSMTP,
 		},
 	}
 	return endp, nil
@@ -36,6 +36,10 @@ type MailboxHandle struct {
 	pendingExpunge imap.SeqSet
 	pendingCreated imap.SeqSet
 	pendingFlags   []flagsUpdate
+
+	// flagsFilter, if set, adjusts flags sent in updates to this
+	// connection, see SetFlagsFilter.
+	flagsFilter func(uid uint32, flags []string) []string
 }
 
 var ErrNoMessages = errors.New("No messages matched")
@@ -263,7 +267,23 @@ func (handle *MailboxHandle) syncUnlocked(expunge bool) {
 	handle.Sync(expunge)
 }
 
+// SetFlagsFilter sets the function that is applied to new flags of messages
+// before they are sent to this connection. It can be used to replace flags
+// that are stored separately for each user.
+func (handle *MailboxHandle) SetFlagsFilter(filter func(uid uint32, flags []string) []string) {
+	handle.lock.Lock()
+	handle.flagsFilter = filter
+	handle.lock.Unlock()
+}
+
 func (handle *MailboxHandle) enqueueFlagsUpdate(uid uint32, newFlags []string) {
+	handle.lock.RLock()
+	filter := handle.flagsFilter
+	handle.lock.RUnlock()
+	if filter != nil {
+		newFlags = filter(uid, newFlags)
+	}
+
 	upd := flagsUpdate{
 		uid:      uid,
 		newFlags: newFlags,
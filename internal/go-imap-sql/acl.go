@@ -0,0 +1,563 @@
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// Mailboxes can be shared with other users using access control lists with
+// RFC 4314 rights. Shared mailboxes are listed in Opts.SharedNamespace as
+// "<namespace>.<owner>.<mailbox>". They are opened as Mailbox objects of the
+// owner with viewer set to the user that opened them, so messages count
+// against the quota of the owner.
+//
+// \Seen flag is kept for each user: the owner uses the flags table and
+// msgs.seen as for other mailboxes, other users use the privateSeen table.
+// All other flags are shared.
+//
+// Rights are checked when the mailbox is opened, so changes apply to
+// sessions that select the mailbox after them.
+
+const (
+	// AnyoneGrantee is the ACL identifier that matches all users.
+	AnyoneGrantee = "anyone"
+
+	// AllRights contains all supported ACL rights. Owners of mailboxes
+	// implicitly hold all of them.
+	AllRights = "lrswipkxte"
+)
+
+var (
+	ErrPermissionDenied = errors.New("imap: permission denied")
+	ErrInvalidRights    = errors.New("imap: invalid ACL rights")
+	ErrSharedNamespace  = errors.New("imap: mailboxes can not be created in the shared namespace")
+	ErrCrossAccountCopy = errors.New("imap: messages can not be copied between mailboxes of different users")
+)
+
+// ACLEntry is an entry of the mailbox access control list.
+type ACLEntry struct {
+	// Username or AnyoneGrantee.
+	Grantee string
+	Rights  string
+}
+
+func (b *Backend) prepareACLStmts() error {
+	var err error
+	b.aclRights, err = b.db.Prepare(`
+		SELECT rights
+		FROM acl
+		WHERE mboxId = ? AND grantee = ?`)
+	if err != nil {
+		return wrapErr(err, "aclRights prep")
+	}
+	b.addACL, err = b.db.Prepare(`
+		INSERT INTO acl(mboxId, grantee, rights)
+		VALUES (?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addACL prep")
+	}
+	b.delACL, err = b.db.Prepare(`
+		DELETE FROM acl
+		WHERE mboxId = ? AND grantee = ?`)
+	if err != nil {
+		return wrapErr(err, "delACL prep")
+	}
+	b.listACL, err = b.db.Prepare(`
+		SELECT grantee, rights
+		FROM acl
+		WHERE mboxId = ?
+		ORDER BY grantee`)
+	if err != nil {
+		return wrapErr(err, "listACL prep")
+	}
+	b.delGranteeACL, err = b.db.Prepare(`
+		DELETE FROM acl
+		WHERE grantee = ?`)
+	if err != nil {
+		return wrapErr(err, "delGranteeACL prep")
+	}
+	b.sharedMboxes, err = b.db.Prepare(`
+		SELECT mboxes.id, mboxes.name, users.id, users.username, acl.rights
+		FROM acl
+		INNER JOIN mboxes
+		ON mboxes.id = acl.mboxId
+		INNER JOIN users
+		ON users.id = mboxes.uid
+		WHERE (acl.grantee = ? OR acl.grantee = 'anyone')
+		AND mboxes.uid <> ?
+		ORDER BY users.username, mboxes.name`)
+	if err != nil {
+		return wrapErr(err, "sharedMboxes prep")
+	}
+	b.massClearSharedFlagsUid, err = b.db.Prepare(`
+		DELETE FROM flags
+		WHERE mboxId = ?
+		AND msgId BETWEEN ? AND ?
+		AND flag != '\Recent'
+		AND flag != '\Seen'`)
+	if err != nil {
+		return wrapErr(err, "massClearSharedFlagsUid prep")
+	}
+	b.addPrivateSeenUid, err = b.db.Prepare(`
+		INSERT INTO privateSeen(uid, mboxId, msgId)
+		SELECT ?, mboxId, msgId
+		FROM msgs
+		WHERE mboxId = ? AND msgId BETWEEN ? AND ?
+		ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return wrapErr(err, "addPrivateSeenUid prep")
+	}
+	b.remPrivateSeenUid, err = b.db.Prepare(`
+		DELETE FROM privateSeen
+		WHERE uid = ? AND mboxId = ? AND msgId BETWEEN ? AND ?`)
+	if err != nil {
+		return wrapErr(err, "remPrivateSeenUid prep")
+	}
+	b.privateSeenUid, err = b.db.Prepare(`
+		SELECT msgId
+		FROM privateSeen
+		WHERE uid = ? AND mboxId = ? AND msgId BETWEEN ? AND ?`)
+	if err != nil {
+		return wrapErr(err, "privateSeenUid prep")
+	}
+	b.copyPrivateSeenUid, err = b.db.Prepare(`
+		INSERT INTO privateSeen
+		SELECT uid, ?, new_msgId AS msgId
+		FROM privateSeen
+		INNER JOIN (
+			SELECT (
+				SELECT uidnext - 1
+				FROM mboxes
+				WHERE id = ?
+			) + row_number() OVER (ORDER BY msgId) + ? AS new_msgId, msgId, mboxId
+			FROM msgs
+			WHERE mboxId = ?
+			AND msgId BETWEEN ? AND ?
+			ORDER BY msgId
+		) map ON map.msgId = privateSeen.msgId
+		AND map.mboxId = privateSeen.mboxId`)
+	if err != nil {
+		return wrapErr(err, "copyPrivateSeenUid prep")
+	}
+	b.privateFirstUnseenUid, err = b.db.Prepare(`
+		SELECT msgId
+		FROM msgs
+		WHERE mboxId = ?
+		AND NOT EXISTS (
+			SELECT 1
+			FROM privateSeen
+			WHERE privateSeen.uid = ?
+			AND privateSeen.mboxId = msgs.mboxId
+			AND privateSeen.msgId = msgs.msgId
+		)
+		ORDER BY msgId
+		LIMIT 1`)
+	if err != nil {
+		return wrapErr(err, "privateFirstUnseenUid prep")
+	}
+	b.privateUnseenCount, err = b.db.Prepare(`
+		SELECT count(*)
+		FROM msgs
+		WHERE mboxId = ?
+		AND NOT EXISTS (
+			SELECT 1
+			FROM privateSeen
+			WHERE privateSeen.uid = ?
+			AND privateSeen.mboxId = msgs.mboxId
+			AND privateSeen.msgId = msgs.msgId
+		)`)
+	if err != nil {
+		return wrapErr(err, "privateUnseenCount prep")
+	}
+	return nil
+}
+
+// normalizeRights checks that rights contain only supported rights and
+// returns them without duplicates in the AllRights order.
+func normalizeRights(rights string) (string, error) {
+	for _, r := range rights {
+		if !strings.ContainsRune(AllRights, r) {
+			return "", ErrInvalidRights
+		}
+	}
+	var res strings.Builder
+	for _, r := range AllRights {
+		if strings.ContainsRune(rights, r) {
+			res.WriteRune(r)
+		}
+	}
+	return res.String(), nil
+}
+
+// hasRights reports whether have contains all rights from need.
+func hasRights(have, need string) bool {
+	for _, r := range need {
+		if !strings.ContainsRune(have, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ownerMboxId returns the ID of the mailbox of owner.
+func (b *Backend) ownerMboxId(tx *sql.Tx, owner, mailbox string) (uint64, error) {
+	uid, inboxId, err := b.getUserMeta(tx, owner)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserDoesntExists
+		}
+		return 0, err
+	}
+	if strings.EqualFold(mailbox, "INBOX") {
+		return inboxId, nil
+	}
+	var mboxId uint64
+	if err := tx.Stmt(b.mboxId).QueryRow(uid, mailbox).Scan(&mboxId); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, backend.ErrNoSuchMailbox
+		}
+		return 0, err
+	}
+	return mboxId, nil
+}
+
+func normalizeGrantee(owner, grantee string) (string, error) {
+	grantee = normalizeUsername(grantee)
+	if grantee == "" {
+		return "", errors.New("imap: empty ACL grantee")
+	}
+	if grantee == owner {
+		return "", errors.New("imap: owner of the mailbox holds all rights")
+	}
+	return grantee, nil
+}
+
+// updateACL replaces the rights of grantee for the mailbox of owner with the
+// ones returned by update. The entry is removed if no rights are left.
+func (b *Backend) updateACL(op, owner, mailbox, grantee string, update func(old string) string) error {
+	owner = normalizeUsername(owner)
+	grantee, err := normalizeGrantee(owner, grantee)
+	if err != nil {
+		return err
+	}
+
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return wrapErr(err, op)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	mboxId, err := b.ownerMboxId(tx, owner, mailbox)
+	if err != nil {
+		if err == ErrUserDoesntExists || err == backend.ErrNoSuchMailbox {
+			return err
+		}
+		return wrapErr(err, op)
+	}
+
+	var old string
+	if err := tx.Stmt(b.aclRights).QueryRow(mboxId, grantee).Scan(&old); err != nil && err != sql.ErrNoRows {
+		return wrapErr(err, op)
+	}
+	rights, err := normalizeRights(update(old))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Stmt(b.delACL).Exec(mboxId, grantee); err != nil {
+		return wrapErr(err, op)
+	}
+	if rights != "" {
+		if _, err := tx.Stmt(b.addACL).Exec(mboxId, grantee, rights); err != nil {
+			return wrapErr(err, op)
+		}
+	}
+	return wrapErr(tx.Commit(), op)
+}
+
+// GrantACL adds rights to the ACL entry of grantee for the mailbox of owner.
+// grantee is a username or AnyoneGrantee.
+func (b *Backend) GrantACL(owner, mailbox, grantee, rights string) error {
+	if _, err := normalizeRights(rights); err != nil || rights == "" {
+		return ErrInvalidRights
+	}
+	return b.updateACL("GrantACL", owner, mailbox, grantee, func(old string) string {
+		return old + rights
+	})
+}
+
+// RevokeACL removes rights from the ACL entry of grantee for the mailbox of
+// owner. The entry is removed if no rights are left or if rights is empty.
+func (b *Backend) RevokeACL(owner, mailbox, grantee, rights string) error {
+	if _, err := normalizeRights(rights); err != nil {
+		return err
+	}
+	return b.updateACL("RevokeACL", owner, mailbox, grantee, func(old string) string {
+		if rights == "" {
+			return ""
+		}
+		return strings.Map(func(r rune) rune {
+			if strings.ContainsRune(rights, r) {
+				return -1
+			}
+			return r
+		}, old)
+	})
+}
+
+// ListACL returns the ACL of the mailbox of owner. The owner is not listed.
+func (b *Backend) ListACL(owner, mailbox string) ([]ACLEntry, error) {
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return nil, wrapErr(err, "ListACL")
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	mboxId, err := b.ownerMboxId(tx, normalizeUsername(owner), mailbox)
+	if err != nil {
+		if err == ErrUserDoesntExists || err == backend.ErrNoSuchMailbox {
+			return nil, err
+		}
+		return nil, wrapErr(err, "ListACL")
+	}
+
+	rows, err := tx.Stmt(b.listACL).Query(mboxId)
+	if err != nil {
+		return nil, wrapErr(err, "ListACL")
+	}
+	defer rows.Close()
+	var res []ACLEntry
+	for rows.Next() {
+		var entry ACLEntry
+		if err := rows.Scan(&entry.Grantee, &entry.Rights); err != nil {
+			return nil, wrapErr(err, "ListACL")
+		}
+		res = append(res, entry)
+	}
+	return res, wrapErr(rows.Err(), "ListACL")
+}
+
+// sharedMailbox is a mailbox of another user shared with the user.
+type sharedMailbox struct {
+	id     uint64
+	name   string
+	owner  User
+	rights string
+}
+
+func (u *User) sharedPrefix() string {
+	if u.parent.Opts.SharedNamespace == "" {
+		return ""
+	}
+	return u.parent.Opts.SharedNamespace + MailboxPathSep
+}
+
+func (u *User) isSharedName(name string) bool {
+	prefix := u.sharedPrefix()
+	return prefix != "" && strings.HasPrefix(name, prefix)
+}
+
+func (u *User) sharedName(s sharedMailbox) string {
+	return u.sharedPrefix() + s.owner.username + MailboxPathSep + s.name
+}
+
+// sharedMailboxes returns mailboxes shared with the user. Rights granted to
+// anyone are merged with the ones granted to the user.
+func (u *User) sharedMailboxes(tx *sql.Tx) ([]sharedMailbox, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if tx != nil {
+		rows, err = tx.Stmt(u.parent.sharedMboxes).Query(u.username, u.id)
+	} else {
+		rows, err = u.parent.sharedMboxes.Query(u.username, u.id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []sharedMailbox
+	index := make(map[uint64]int)
+	for rows.Next() {
+		var (
+			s      sharedMailbox
+			rights string
+		)
+		if err := rows.Scan(&s.id, &s.name, &s.owner.id, &s.owner.username, &rights); err != nil {
+			return nil, err
+		}
+		if i, ok := index[s.id]; ok {
+			res[i].rights, _ = normalizeRights(res[i].rights + rights)
+			continue
+		}
+		s.owner.parent = u.parent
+		s.rights = rights
+		index[s.id] = len(res)
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+// findShared returns the mailbox shared with the user that has the name in
+// the shared namespace.
+func (u *User) findShared(tx *sql.Tx, name string) (sharedMailbox, bool, error) {
+	if !u.isSharedName(name) {
+		return sharedMailbox{}, false, nil
+	}
+	shared, err := u.sharedMailboxes(tx)
+	if err != nil {
+		return sharedMailbox{}, false, err
+	}
+	for _, s := range shared {
+		if u.sharedName(s) == name {
+			return s, true, nil
+		}
+	}
+	return sharedMailbox{}, false, nil
+}
+
+// checkRights returns ErrPermissionDenied if the mailbox is shared with the
+// user that opened it without all of the rights.
+func (m *Mailbox) checkRights(rights string) error {
+	if m.viewer == nil || hasRights(m.rights, rights) {
+		return nil
+	}
+	return ErrPermissionDenied
+}
+
+// privateSeen reports whether \Seen flag is kept in the privateSeen table
+// for the user that opened the mailbox.
+func (m *Mailbox) privateSeen() bool {
+	return m.viewer != nil
+}
+
+// flagRights returns the rights needed to change flags.
+func flagRights(flags []string) string {
+	var rights string
+	for _, flag := range flags {
+		switch flag {
+		case imap.SeenFlag:
+			rights += "s"
+		case imap.DeletedFlag:
+			rights += "t"
+		default:
+			rights += "w"
+		}
+	}
+	return rights
+}
+
+// permittedFlags removes flags the user that opened the mailbox has no
+// rights to set.
+func (m *Mailbox) permittedFlags(flags []string) []string {
+	if m.viewer == nil {
+		return flags
+	}
+	res := flags[:0]
+	for _, flag := range flags {
+		if hasRights(m.rights, flagRights([]string{flag})) {
+			res = append(res, flag)
+		}
+	}
+	return res
+}
+
+// seenUids returns UIDs of messages in the range seen by the user that opened
+// the mailbox.
+func (m *Mailbox) seenUids(tx *sql.Tx, start, stop uint32) (map[uint32]struct{}, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if tx != nil {
+		rows, err = tx.Stmt(m.parent.privateSeenUid).Query(m.viewer.id, m.id, start, stop)
+	} else {
+		rows, err = m.parent.privateSeenUid.Query(m.viewer.id, m.id, start, stop)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[uint32]struct{})
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		seen[uid] = struct{}{}
+	}
+	return seen, rows.Err()
+}
+
+// allSeenUids is seenUids for all messages of the mailbox.
+func (m *Mailbox) allSeenUids() (map[uint32]struct{}, error) {
+	return m.seenUids(nil, 1, math.MaxUint32)
+}
+
+// replaceSeen sets \Seen in flags if the message is in seen.
+func replaceSeen(flags []string, uid uint32, seen map[uint32]struct{}) []string {
+	res := make([]string, 0, len(flags)+1)
+	for _, flag := range flags {
+		if flag != imap.SeenFlag {
+			res = append(res, flag)
+		}
+	}
+	if _, ok := seen[uid]; ok {
+		res = append(res, imap.SeenFlag)
+	}
+	return res
+}
+
+// seenFilter is the flags filter for mailbox handles of users other than the
+// owner, flags updates contain \Seen of the owner.
+func (m *Mailbox) seenFilter(uid uint32, flags []string) []string {
+	seen, err := m.seenUids(nil, uid, uid)
+	if err != nil {
+		m.parent.logMboxErr(m, err, "seenFilter", uid)
+		return flags
+	}
+	return replaceSeen(flags, uid, seen)
+}
+
+// destMailbox returns the ID of the target mailbox for COPY and MOVE. dest
+// is resolved in the namespace of the user that opened m.
+func (m *Mailbox) destMailbox(tx *sql.Tx, dest string) (uint64, error) {
+	u := &m.user
+	if m.viewer != nil {
+		u = m.viewer
+	}
+
+	shared, ok, err := u.findShared(tx, dest)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		if shared.owner.id != m.user.id {
+			return 0, ErrCrossAccountCopy
+		}
+		if !hasRights(shared.rights, "i") {
+			return 0, ErrPermissionDenied
+		}
+		return shared.id, nil
+	}
+
+	var destID uint64
+	if err := tx.Stmt(m.parent.mboxId).QueryRow(u.id, dest).Scan(&destID); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, backend.ErrNoSuchMailbox
+		}
+		return 0, err
+	}
+	if u.id != m.user.id {
+		return 0, ErrCrossAccountCopy
+	}
+	return destID, nil
+}
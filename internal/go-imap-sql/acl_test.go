@@ -0,0 +1,126 @@
+package imapsql
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func fetchFlags(t *testing.T, mbox interface {
+	ListMessages(bool, *imap.SeqSet, []imap.FetchItem, chan<- *imap.Message) error
+}) [][]string {
+	t.Helper()
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, ch))
+	var res [][]string
+	for msg := range ch {
+		res = append(res, msg.Flags)
+	}
+	return res
+}
+
+func TestACLRights(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("owner"))
+
+	assert.NilError(t, b.GrantACL("owner", "INBOX", "viewer", "rl"))
+	assert.NilError(t, b.GrantACL("owner", "INBOX", "viewer", "s"))
+	assert.NilError(t, b.GrantACL("owner", "INBOX", AnyoneGrantee, "l"))
+	acl, err := b.ListACL("owner", "INBOX")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, acl, []ACLEntry{
+		{Grantee: AnyoneGrantee, Rights: "l"},
+		{Grantee: "viewer", Rights: "lrs"},
+	})
+
+	assert.NilError(t, b.RevokeACL("owner", "INBOX", "viewer", "l"))
+	assert.NilError(t, b.RevokeACL("owner", "INBOX", AnyoneGrantee, ""))
+	acl, err = b.ListACL("owner", "INBOX")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, acl, []ACLEntry{{Grantee: "viewer", Rights: "rs"}})
+
+	assert.Check(t, errors.Is(b.GrantACL("owner", "INBOX", "viewer", "rz"), ErrInvalidRights))
+	assert.Check(t, b.GrantACL("owner", "INBOX", "owner", "r") != nil, "owner can be granted rights")
+	assert.Check(t, b.GrantACL("owner", "Nonexistent", "viewer", "r") != nil, "rights are granted for a nonexistent mailbox")
+}
+
+func TestSharedMailbox(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	b.Opts.SharedNamespace = "Shared"
+	assert.NilError(t, b.CreateUser("owner"))
+	assert.NilError(t, b.CreateUser("viewer"))
+	owner, err := b.GetUser("owner")
+	assert.NilError(t, err)
+	viewer, err := b.GetUser("viewer")
+	assert.NilError(t, err)
+
+	assert.NilError(t, owner.CreateMessage("INBOX", []string{imap.FlaggedFlag}, time.Now(), strings.NewReader(testMsg), nil))
+
+	const sharedName = "Shared.owner.INBOX"
+	_, _, err = viewer.GetMailbox(sharedName, false, &noopConn{})
+	assert.Check(t, err != nil, "mailbox is visible without rights")
+
+	assert.NilError(t, b.GrantACL("owner", "INBOX", "viewer", "lrsw"))
+	mboxes, err := viewer.ListMailboxes(false)
+	assert.NilError(t, err)
+	names := make([]string, 0, len(mboxes))
+	for _, mbox := range mboxes {
+		names = append(names, mbox.Name)
+	}
+	assert.Check(t, is.Contains(names, sharedName))
+	assert.Check(t, errors.Is(viewer.CreateMailbox("Shared.test"), ErrSharedNamespace))
+
+	_, ownerMbox, err := owner.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer ownerMbox.Close()
+	_, viewerMbox, err := viewer.GetMailbox(sharedName, false, &noopConn{})
+	assert.NilError(t, err)
+	defer viewerMbox.Close()
+
+	// \Seen is private, other flags are shared.
+	seq, _ := imap.ParseSeqSet("1:*")
+	assert.NilError(t, viewerMbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.SeenFlag, "$Label"}))
+	viewerFlags := fetchFlags(t, viewerMbox)
+	assert.Assert(t, is.Len(viewerFlags, 1))
+	assert.Check(t, is.Contains(viewerFlags[0], imap.SeenFlag))
+	assert.Check(t, is.Contains(viewerFlags[0], "$Label"))
+	ownerFlags := fetchFlags(t, ownerMbox)
+	assert.Assert(t, is.Len(ownerFlags, 1))
+	assert.Check(t, !contains(ownerFlags[0], imap.SeenFlag), "\\Seen of the viewer is visible to the owner")
+	assert.Check(t, is.Contains(ownerFlags[0], "$Label"))
+
+	status, err := viewer.Status(sharedName, []imap.StatusItem{imap.StatusUnseen})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(status.Unseen, uint32(0)))
+	status, err = owner.Status("INBOX", []imap.StatusItem{imap.StatusUnseen})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(status.Unseen, uint32(1)))
+
+	unseen, err := viewerMbox.SearchMessages(true, &imap.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(unseen, 0))
+
+	// No 't' and 'e' rights.
+	assert.Check(t, errors.Is(viewerMbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}), ErrPermissionDenied))
+	assert.Check(t, errors.Is(viewerMbox.Expunge(), ErrPermissionDenied))
+	// No 'i' right and copying between accounts is not supported.
+	assert.Check(t, errors.Is(viewerMbox.CopyMessages(true, seq, "INBOX"), ErrCrossAccountCopy))
+	assert.Check(t, errors.Is(viewer.CreateMessage(sharedName, nil, time.Now(), strings.NewReader(testMsg), nil), ErrPermissionDenied))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
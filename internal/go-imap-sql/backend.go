@@ -1,6 +1,7 @@
 package imapsql
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -21,7 +22,7 @@ import (
 const VersionStr = "0.4.0"
 
 // SchemaVersion is incremented each time DB schema changes.
-const SchemaVersion = 6
+const SchemaVersion = 10
 
 var (
 	ErrUserAlreadyExists = errors.New("imap: user already exists")
@@ -102,6 +103,37 @@ type Opts struct {
 	// performance significantly.
 	DisableRecent bool
 
+	// Prefix added to names of all tables, e.g. to share the database with
+	// other applications. It may contain only letters, digits and
+	// underscores.
+	TablePrefix string
+
+	// Maintain the full-text search index used for SEARCH TEXT, BODY,
+	// SUBJECT, FROM and TO. It is supported on SQLite (if built with FTS5)
+	// and PostgreSQL. Words are matched instead of substrings.
+	FullTextSearch bool
+
+	// Store the body of identical messages delivered using Delivery (e.g.
+	// to several recipients) only once. Bodies are matched by SHA-256 of
+	// their content excluding header fields added for each recipient.
+	Deduplicate bool
+
+	// Keep messages removed by EXPUNGE in the deletedMsgs table instead of
+	// deleting them. They are hidden from IMAP and do not count against
+	// the quota, but can be restored using RestoreDeleted until removed by
+	// PurgeDeleted.
+	SoftDelete bool
+
+	// Namespace that mailboxes shared with the user by other users are
+	// listed in, as "<SharedNamespace>.<owner>.<mailbox>". Empty string
+	// disables access to shared mailboxes. See GrantACL.
+	SharedNamespace string
+
+	// Timeout of the connection check done by New before the database is
+	// used. Zero disables the check, the first query then waits for the
+	// connection as long as the driver does.
+	PingTimeout time.Duration
+
 	Log Logger
 }
 
@@ -165,7 +197,7 @@ type Backend struct {
 	listMsgUids        *sql.Stmt
 	listMsgUidsRecent  *sql.Stmt
 
-	addRecentToLast *sql.Stmt
+	markRecent *sql.Stmt
 
 	// 'mark' column for messages is used to keep track of messages selected
 	// by sequence numbers during operations that may cause seqence numbers to
@@ -218,6 +250,55 @@ type Backend struct {
 	deleteZeroRef         *sql.Stmt
 	deleteUserRef         *sql.Stmt
 	decreaseRefForMbox    *sql.Stmt
+	zeroRefMarked         *sql.Stmt
+	extKeyExists          *sql.Stmt
+	unreferencedExtKeys   *sql.Stmt
+	deleteExtKey          *sql.Stmt
+	listExtKeys           *sql.Stmt
+	addSharedExtKey       *sql.Stmt
+	extKeySharedKey       *sql.Stmt
+	sharedZeroRef         *sql.Stmt
+	sharedRefUser         *sql.Stmt
+
+	// sharedBodies table
+	refSharedBody          *sql.Stmt
+	sharedBody             *sql.Stmt
+	addSharedBody          *sql.Stmt
+	unrefSharedBody        *sql.Stmt
+	deleteUnusedSharedBody *sql.Stmt
+	dedupStats             *sql.Stmt
+
+	// deletedMsgs table
+	softDeleteMsgs            *sql.Stmt
+	decreaseRefForDeletedMbox *sql.Stmt
+	deletedMsgsBefore         *sql.Stmt
+	deletedMsgsMbox           *sql.Stmt
+	deletedMsgsUser           *sql.Stmt
+	unrefDeletedMsg           *sql.Stmt
+	purgeDeletedMsg           *sql.Stmt
+	addRestoredFlag           *sql.Stmt
+
+	// acl and privateSeen tables, see acl.go.
+	aclRights               *sql.Stmt
+	addACL                  *sql.Stmt
+	delACL                  *sql.Stmt
+	listACL                 *sql.Stmt
+	delGranteeACL           *sql.Stmt
+	sharedMboxes            *sql.Stmt
+	massClearSharedFlagsUid *sql.Stmt
+	addPrivateSeenUid       *sql.Stmt
+	remPrivateSeenUid       *sql.Stmt
+	privateSeenUid          *sql.Stmt
+	copyPrivateSeenUid      *sql.Stmt
+	privateFirstUnseenUid   *sql.Stmt
+	privateUnseenCount      *sql.Stmt
+
+	// Used by PurgeUserMessages, see purge.go.
+	userMsgsLimit        *sql.Stmt
+	deletedMsgsUserLimit *sql.Stmt
+
+	// Used by ExportUser, see export.go.
+	exportMboxes *sql.Stmt
 
 	// Used by Delivery.SpecialMailbox.
 	specialUseMbox *sql.Stmt
@@ -228,6 +309,24 @@ type Backend struct {
 
 	setInboxId *sql.Stmt
 
+	// Full-text search index, see fts.go.
+	fts               string
+	addSearchDoc      *sql.Stmt
+	delSearchDoc      *sql.Stmt
+	copySearchDocsUid *sql.Stmt
+	searchDocs        *sql.Stmt
+	reindexMsgs       *sql.Stmt
+	userMboxIds       *sql.Stmt
+
+	// Account usage counters, see usage.go.
+	addUsage      *sql.Stmt
+	userUsage     *sql.Stmt
+	recalcUsage   *sql.Stmt
+	rangeUsageUid *sql.Stmt
+	markedUsage   *sql.Stmt
+	deletedUsage  *sql.Stmt
+	mboxUsage     *sql.Stmt
+
 	cachedHeaderUid *sql.Stmt
 
 	sqliteOptimizeLoopStop chan struct{}
@@ -242,7 +341,7 @@ var defaultPassHashAlgo = "bcrypt"
 // Note that it is not safe to create multiple Backend instances working with
 // the single database as they need to keep some state synchronized and there
 // is no measures for this implemented in go-imap-sql.
-func New(driver, dsn string, extStore ExternalStore, opts Opts) (*Backend, error) {
+func New(driver, dsn string, extStore ExternalStore, opts Opts) (_ *Backend, err error) {
 	b := &Backend{
 		fetchStmtsCache:       make(map[string]*sql.Stmt),
 		flagsSearchStmtsCache: make(map[string]*sql.Stmt),
@@ -256,7 +355,6 @@ func New(driver, dsn string, extStore ExternalStore, opts Opts) (*Backend, error
 
 		mngr: mess.NewManager(opts.Log),
 	}
-	var err error
 
 	if b.Opts.CompressAlgo != "" {
 		impl, ok := compressionAlgos[b.Opts.CompressAlgo]
@@ -287,12 +385,33 @@ func New(driver, dsn string, extStore ExternalStore, opts Opts) (*Backend, error
 
 	b.db.driver = driver
 	b.db.dsn = dsn
+	for i := 0; i < len(opts.TablePrefix); i++ {
+		if !isIdentChar(opts.TablePrefix[i]) {
+			return nil, fmt.Errorf("New: invalid table prefix: %q", opts.TablePrefix)
+		}
+	}
+	b.db.prefix = opts.TablePrefix
 
 	b.db.DB, err = sql.Open(driver, dsn)
 	if err != nil {
 		return nil, wrapErr(err, "NewBackend (open)")
 	}
 	b.DB = b.db.DB
+	// Callers may retry New if the database is not available yet.
+	defer func() {
+		if err != nil {
+			b.db.DB.Close()
+		}
+	}()
+
+	if b.Opts.PingTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), b.Opts.PingTimeout)
+		err := b.db.DB.PingContext(ctx)
+		cancel()
+		if err != nil {
+			return nil, wrapErr(err, "NewBackend (ping)")
+		}
+	}
 
 	ver, err := b.schemaVersion()
 	if err != nil {
@@ -322,6 +441,11 @@ func New(driver, dsn string, extStore ExternalStore, opts Opts) (*Backend, error
 	if err := b.prepareStmts(); err != nil {
 		return nil, wrapErr(err, "NewBackend (prepareStmts)")
 	}
+	if b.Opts.FullTextSearch {
+		if err := b.initSearchIndex(); err != nil {
+			return nil, wrapErr(err, "NewBackend (initSearchIndex)")
+		}
+	}
 
 	for _, item := range [...]imap.FetchItem{
 		imap.FetchFlags, imap.FetchEnvelope,
@@ -468,6 +592,19 @@ func (b *Backend) DeleteUser(username string) error {
 		}
 		keys = append(keys, key)
 	}
+	sharedKeys, err := b.queryKeys(tx, b.sharedRefUser, username)
+	if err != nil {
+		return wrapErr(err, "DeleteUser")
+	}
+	// References can be removed only after messages are gone, the user ID
+	// is needed to find them.
+	uid, _, err := b.getUserMeta(tx, username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesntExists
+		}
+		return wrapErr(err, "DeleteUser")
+	}
 
 	stats, err := tx.Stmt(b.delUser).Exec(username)
 	if err != nil {
@@ -481,15 +618,25 @@ func (b *Backend) DeleteUser(username string) error {
 		return ErrUserDoesntExists
 	}
 
-	if err := b.extStore.Delete(keys); err != nil {
+	if _, err := tx.Stmt(b.deleteUserRef).Exec(uid); err != nil {
 		return wrapErr(err, "DeleteUser")
 	}
+	// Entries for mailboxes of the user are removed with the mailboxes.
+	if _, err := tx.Stmt(b.delGranteeACL).Exec(username); err != nil {
+		return wrapErr(err, "DeleteUser")
+	}
+	unused, err := b.releaseSharedBodies(tx, sharedKeys)
+	if err != nil {
+		return wrapErr(err, "DeleteUser")
+	}
+	keys = append(keys, unused...)
 
-	if _, err := tx.Stmt(b.deleteUserRef).Exec(username); err != nil {
+	if err := tx.Commit(); err != nil {
 		return wrapErr(err, "DeleteUser")
 	}
 
-	return tx.Commit()
+	b.deleteBodies(keys)
+	return nil
 }
 
 // ListUsers returns list of existing usernames.
@@ -0,0 +1,217 @@
+package imapsql
+
+import (
+	"database/sql"
+	"io"
+	"time"
+)
+
+// Message bodies are written to the ExternalStore before the metadata is
+// committed and deleted only after the metadata removal is committed. A
+// crash in between leaves an object that is not referenced by the database,
+// such objects are removed by CollectGarbage.
+
+func (b *Backend) queryKeys(tx *sql.Tx, stmt *sql.Stmt, args ...interface{}) ([]string, error) {
+	rows, err := tx.Stmt(stmt).Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// deleteBodies removes objects of messages deleted by a committed
+// transaction. Errors are only logged since the messages are already gone,
+// remaining objects are removed by CollectGarbage.
+func (b *Backend) deleteBodies(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	if err := b.extStore.Delete(keys); err != nil {
+		b.Opts.Log.Printf("failed to delete message bodies, they will be removed on garbage collection: %v", err)
+	}
+}
+
+// DeleteUnreferencedBodies removes bodies that are not used by any message,
+// e.g. because messages were deleted from the database bypassing Backend.
+//
+// The number of removed bodies is returned.
+func (b *Backend) DeleteUnreferencedBodies() (int, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return 0, wrapErr(err, "DeleteUnreferencedBodies")
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	candidates, err := b.queryKeys(tx, b.unreferencedExtKeys)
+	if err != nil {
+		return 0, wrapErr(err, "DeleteUnreferencedBodies")
+	}
+	keys := make([]string, 0, len(candidates))
+	var sharedKeys []string
+	for _, key := range candidates {
+		var sharedKey sql.NullString
+		err := tx.Stmt(b.extKeySharedKey).QueryRow(key).Scan(&sharedKey)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, wrapErr(err, "DeleteUnreferencedBodies")
+		}
+
+		// The key could be used by a message added after the query.
+		stats, err := tx.Stmt(b.deleteExtKey).Exec(key, key, key)
+		if err != nil {
+			return 0, wrapErr(err, "DeleteUnreferencedBodies")
+		}
+		affected, err := stats.RowsAffected()
+		if err != nil {
+			return 0, wrapErr(err, "DeleteUnreferencedBodies")
+		}
+		if affected == 0 {
+			continue
+		}
+		if sharedKey.Valid {
+			sharedKeys = append(sharedKeys, sharedKey.String)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	unused, err := b.releaseSharedBodies(tx, sharedKeys)
+	if err != nil {
+		return 0, wrapErr(err, "DeleteUnreferencedBodies")
+	}
+	keys = append(keys, unused...)
+	if err := tx.Commit(); err != nil {
+		return 0, wrapErr(err, "DeleteUnreferencedBodies")
+	}
+
+	if err := b.extStore.Delete(keys); err != nil {
+		return 0, wrapErr(err, "DeleteUnreferencedBodies")
+	}
+	return len(keys), nil
+}
+
+// CollectGarbage removes bodies that are not referenced by the database.
+//
+// Objects written less than minAge ago are kept since they can belong to
+// messages that are being delivered. minAge should be larger than the time
+// it takes to deliver the biggest message.
+//
+// Objects are listed only if ExternalStore implements ListableStore,
+// otherwise only DeleteUnreferencedBodies is done and ErrNotListable is
+// returned.
+//
+// The number of removed objects is returned.
+func (b *Backend) CollectGarbage(minAge time.Duration) (int, error) {
+	removed, err := b.DeleteUnreferencedBodies()
+	if err != nil {
+		return 0, err
+	}
+
+	lister, ok := b.extStore.(ListableStore)
+	if !ok {
+		return removed, ErrNotListable
+	}
+
+	cutoff := time.Now().Add(-minAge)
+	var orphans []string
+	err = lister.List(func(key string, modTime time.Time) error {
+		if modTime.After(cutoff) {
+			return nil
+		}
+		var count int
+		if err := b.extKeyExists.QueryRow(key, key).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			orphans = append(orphans, key)
+		}
+		return nil
+	})
+	if err == ErrNotListable {
+		return removed, err
+	}
+	if err != nil {
+		return removed, wrapErr(err, "CollectGarbage")
+	}
+
+	if err := b.extStore.Delete(orphans); err != nil {
+		return removed, wrapErr(err, "CollectGarbage")
+	}
+	return removed + len(orphans), nil
+}
+
+// CopyBodies copies bodies of all messages to dst, e.g. to move them to a
+// different store. Objects are copied as is, keeping the keys, so the
+// Backend should use dst afterwards. Objects that already exist in dst are
+// overwritten, hence interrupted copying can be restarted.
+//
+// Bodies that are missing from the current store are skipped and reported
+// via the log. progress, if not nil, is called after each body.
+func (b *Backend) CopyBodies(dst ExternalStore, progress func(done, total int)) (copied, missing int, err error) {
+	rows, err := b.listExtKeys.Query()
+	if err != nil {
+		return 0, 0, wrapErr(err, "CopyBodies")
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, 0, wrapErr(err, "CopyBodies")
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, wrapErr(err, "CopyBodies")
+	}
+
+	for i, key := range keys {
+		err := copyBody(b.extStore, dst, key)
+		switch {
+		case err == nil:
+			copied++
+		case isNonExistent(err):
+			b.Opts.Log.Printf("CopyBodies: body %s is missing, skipping", key)
+			missing++
+		default:
+			return copied, missing, wrapErr(err, "CopyBodies")
+		}
+		if progress != nil {
+			progress(i+1, len(keys))
+		}
+	}
+	return copied, missing, nil
+}
+
+func isNonExistent(err error) bool {
+	extErr, ok := err.(ExternalError)
+	return ok && extErr.NonExistent
+}
+
+func copyBody(src, dst ExternalStore, key string) error {
+	r, err := src.Open(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := dst.Create(key, -1)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Sync()
+}
@@ -0,0 +1,115 @@
+package imapsql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+)
+
+func TestDelMessagesKeepsSharedBody(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+
+	assert.NilError(t, usr.CreateMailbox("1"))
+	assert.NilError(t, usr.CreateMailbox("2"))
+	_, mbox1, err := usr.GetMailbox("1", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox1.Close()
+	_, mbox2, err := usr.GetMailbox("2", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox2.Close()
+
+	assert.NilError(t, usr.CreateMessage("1", nil, time.Now(), strings.NewReader(testMsg), mbox1))
+	assert.NilError(t, mbox1.Poll(true))
+	seq, _ := imap.ParseSeqSet("1")
+	assert.NilError(t, mbox1.CopyMessages(false, seq, "2"))
+	assert.NilError(t, mbox2.Poll(true))
+	assert.Assert(t, checkKeysCount(b, 1))
+
+	// The copy still uses the body.
+	assert.NilError(t, mbox1.(*Mailbox).DelMessages(false, seq))
+	assert.Assert(t, checkKeysCount(b, 1), "Shared body is removed")
+
+	assert.NilError(t, mbox2.(*Mailbox).DelMessages(false, seq))
+	assert.Assert(t, checkKeysCount(b, 0), "Body is not removed after all messages are deleted")
+}
+
+func TestCollectGarbage(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mbox, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+
+	assert.NilError(t, usr.CreateMessage("INBOX", nil, time.Now(), strings.NewReader(testMsg), mbox))
+	assert.NilError(t, usr.CreateMessage("INBOX", nil, time.Now(), strings.NewReader(testMsg), mbox))
+
+	// Objects left by deliveries that were interrupted before commit.
+	root := b.extStore.(*FSStore).Root
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(root, "orphan"), []byte(testMsg), 0600))
+	assert.NilError(t, os.Chtimes(filepath.Join(root, "orphan"), old, old))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(root, "in-flight"), []byte(testMsg), 0600))
+	assert.Assert(t, checkKeysCount(b, 4))
+
+	removed, err := b.CollectGarbage(time.Hour)
+	assert.NilError(t, err)
+	assert.Equal(t, removed, 1)
+	assert.Assert(t, checkKeysCount(b, 3))
+
+	// Messages deleted directly from the database.
+	_, err = b.db.Exec(`DELETE FROM msgs`)
+	assert.NilError(t, err)
+	removed, err = b.CollectGarbage(time.Hour)
+	assert.NilError(t, err)
+	assert.Equal(t, removed, 2)
+	assert.Assert(t, checkKeysCount(b, 1))
+
+	_, err = os.Stat(filepath.Join(root, "in-flight"))
+	assert.NilError(t, err)
+}
+
+func TestCopyBodies(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mbox, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+
+	assert.NilError(t, usr.CreateMessage("INBOX", nil, time.Now(), strings.NewReader(testMsg), mbox))
+	assert.NilError(t, usr.CreateMessage("INBOX", nil, time.Now(), strings.NewReader(testMsg), mbox))
+
+	entries, err := ioutil.ReadDir(b.extStore.(*FSStore).Root)
+	assert.NilError(t, err)
+	assert.NilError(t, os.Remove(filepath.Join(b.extStore.(*FSStore).Root, entries[0].Name())))
+
+	dst := &FSStore{Root: t.TempDir()}
+	calls := 0
+	copied, missing, err := b.CopyBodies(dst, func(done, total int) {
+		calls++
+		assert.Equal(t, total, 2)
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, copied, 1)
+	assert.Equal(t, missing, 1)
+	assert.Equal(t, calls, 2)
+
+	data, err := ioutil.ReadFile(filepath.Join(dst.Root, entries[1].Name()))
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), testMsg)
+}
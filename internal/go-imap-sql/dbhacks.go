@@ -13,6 +13,7 @@ type db struct {
 	DB     *sql.DB
 	driver string
 	dsn    string
+	prefix string
 }
 
 func (d db) Prepare(req string) (*sql.Stmt, error) {
@@ -49,7 +50,67 @@ func (d db) Close() error {
 	return d.DB.Close()
 }
 
+// schemaTables lists all tables created by go-imap-sql. No column is named
+// the same as a table, so any identifier matching one is a table reference,
+// unless it is a column alias (e.g. "AS flags").
+var schemaTables = map[string]bool{
+	"users":          true,
+	"mboxes":         true,
+	"extKeys":        true,
+	"sharedBodies":   true,
+	"msgs":           true,
+	"flags":          true,
+	"deletedMsgs":    true,
+	"acl":            true,
+	"privateSeen":    true,
+	"msgsText":       true,
+	"schema_version": true,
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// prefixTables adds prefix to table names in req. String literals and
+// aliases are left as is.
+func prefixTables(req, prefix string) string {
+	var res strings.Builder
+	res.Grow(len(req) + 8*len(prefix))
+	inString := false
+	prevWord := ""
+	for i := 0; i < len(req); {
+		c := req[i]
+		switch {
+		case inString:
+			if c == '\'' {
+				inString = false
+			}
+		case c == '\'':
+			inString = true
+		case isIdentChar(c):
+			j := i
+			for j < len(req) && isIdentChar(req[j]) {
+				j++
+			}
+			word := req[i:j]
+			if schemaTables[word] && !strings.EqualFold(prevWord, "AS") {
+				res.WriteString(prefix)
+			}
+			res.WriteString(word)
+			prevWord = word
+			i = j
+			continue
+		}
+		res.WriteByte(c)
+		i++
+	}
+	return res.String()
+}
+
 func (d db) rewriteSQL(req string) (res string) {
+	if d.prefix != "" {
+		req = prefixTables(req, d.prefix)
+	}
 	res = strings.TrimSpace(req)
 	res = strings.TrimLeft(res, "\n\t")
 	if d.driver == "postgres" {
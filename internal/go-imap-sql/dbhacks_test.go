@@ -0,0 +1,30 @@
+package imapsql
+
+import "testing"
+
+func TestPrefixTables(t *testing.T) {
+	for _, c := range []struct {
+		in, out string
+	}{
+		{
+			`SELECT msgs.msgId, msgsCount FROM msgs INNER JOIN mboxes ON msgs.mboxId = mboxes.id WHERE name = 'msgs'`,
+			`SELECT p_msgs.msgId, msgsCount FROM p_msgs INNER JOIN p_mboxes ON p_msgs.mboxId = p_mboxes.id WHERE name = 'msgs'`,
+		},
+		{
+			`CREATE UNIQUE INDEX IF NOT EXISTS extKeys_uid_id ON extKeys(uid, id)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS extKeys_uid_id ON p_extKeys(uid, id)`,
+		},
+		{
+			`SELECT msgId, group_concat(flag, '{') AS flags FROM flags WHERE flag <> 'it''s users'`,
+			`SELECT msgId, group_concat(flag, '{') AS flags FROM p_flags WHERE flag <> 'it''s users'`,
+		},
+		{
+			`UPDATE schema_version SET version = ?`,
+			`UPDATE p_schema_version SET version = ?`,
+		},
+	} {
+		if got := prefixTables(c.in, "p_"); got != c.out {
+			t.Errorf("prefixTables(%q):\n got %q\nwant %q", c.in, got, c.out)
+		}
+	}
+}
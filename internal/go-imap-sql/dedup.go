@@ -0,0 +1,297 @@
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"sort"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// With Opts.Deduplicate, the body of a delivered message is stored once in
+// the ExternalStore under the key listed in the sharedBodies table along
+// with the SHA-256 and the size of its content. Each message keeps its own
+// extKeys row, so reference counting for copies of the message works as
+// before, the row points to the shared body using the sharedKey column and
+// contains header fields added only for that recipient (e.g. Delivered-To)
+// in the rcptHeader column.
+//
+// sharedBodies.refs counts extKeys rows referencing the body. It is
+// decreased in the transaction that removes the extKeys rows and the body
+// is removed in the same transaction once it reaches zero. The UPDATE locks
+// the row, so a concurrent delivery either references the body before it
+// is released or does not find it and stores a new one.
+
+// sharedBodyCols are the columns of a msgs query locating the shared body of
+// the message, see openBody.
+var sharedBodyCols = []string{
+	`(SELECT rcptHeader FROM extKeys WHERE extKeys.id = msgs.extBodyKey) AS rcptHeader`,
+	`(SELECT sharedKey FROM extKeys WHERE extKeys.id = msgs.extBodyKey) AS sharedKey`,
+}
+
+func (b *Backend) prepareDedupStmts() error {
+	var err error
+	b.addSharedExtKey, err = b.db.Prepare(`
+		INSERT INTO extKeys(id, uid, refs, sharedKey, rcptHeader)
+		VALUES (?, ?, 1, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addSharedExtKey prep")
+	}
+	b.extKeySharedKey, err = b.db.Prepare(`
+		SELECT sharedKey
+		FROM extKeys
+		WHERE id = ?
+		AND sharedKey IS NOT NULL`)
+	if err != nil {
+		return wrapErr(err, "extKeySharedKey prep")
+	}
+	b.sharedZeroRef, err = b.db.Prepare(`
+		SELECT sharedKey
+		FROM extKeys
+		WHERE uid = ?
+		AND refs = 0
+		AND sharedKey IS NOT NULL`)
+	if err != nil {
+		return wrapErr(err, "sharedZeroRef prep")
+	}
+	b.sharedRefUser, err = b.db.Prepare(`
+		SELECT sharedKey
+		FROM extKeys
+		WHERE uid = (SELECT id FROM users WHERE username = ?)
+		AND sharedKey IS NOT NULL`)
+	if err != nil {
+		return wrapErr(err, "sharedRefUser prep")
+	}
+
+	b.refSharedBody, err = b.db.Prepare(`
+		UPDATE sharedBodies
+		SET refs = refs + ?
+		WHERE bodyHash = ? AND bodySize = ?`)
+	if err != nil {
+		return wrapErr(err, "refSharedBody prep")
+	}
+	b.sharedBody, err = b.db.Prepare(`
+		SELECT extKey, compressAlgo
+		FROM sharedBodies
+		WHERE bodyHash = ? AND bodySize = ?`)
+	if err != nil {
+		return wrapErr(err, "sharedBody prep")
+	}
+	b.addSharedBody, err = b.db.Prepare(`
+		INSERT INTO sharedBodies(extKey, bodyHash, bodySize, compressAlgo, refs)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return wrapErr(err, "addSharedBody prep")
+	}
+	b.unrefSharedBody, err = b.db.Prepare(`
+		UPDATE sharedBodies
+		SET refs = refs - ?
+		WHERE extKey = ?`)
+	if err != nil {
+		return wrapErr(err, "unrefSharedBody prep")
+	}
+	b.deleteUnusedSharedBody, err = b.db.Prepare(`
+		DELETE FROM sharedBodies
+		WHERE extKey = ?
+		AND refs <= 0`)
+	if err != nil {
+		return wrapErr(err, "deleteUnusedSharedBody prep")
+	}
+	b.dedupStats, err = b.db.Prepare(`
+		SELECT COUNT(*), COALESCE(SUM(bodySize), 0), COALESCE(SUM(bodySize * refs), 0)
+		FROM sharedBodies`)
+	if err != nil {
+		return wrapErr(err, "dedupStats prep")
+	}
+	return nil
+}
+
+// sharedBody is the stored body referenced by a delivery.
+type sharedBody struct {
+	key          string
+	compressAlgo string
+	bodyStruct   []byte
+	cachedHeader []byte
+
+	// created is set if the body was written by this delivery and should
+	// be removed if it is aborted.
+	created bool
+}
+
+func hashBody(headerBlob []byte, body Buffer) (string, int64, error) {
+	rdr, err := body.Open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer rdr.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, io.MultiReader(bytes.NewReader(headerBlob), rdr))
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// storeSharedBody returns the stored body with contents headerBlob followed
+// by body and adds refs references to it. The body is written to the
+// ExternalStore only if an identical one is not stored already.
+func (b *Backend) storeSharedBody(tx *sql.Tx, header textproto.Header, headerBlob []byte, bodyLen int64, body Buffer, refs int) (sharedBody, error) {
+	sum, size, err := hashBody(headerBlob, body)
+	if err != nil {
+		return sharedBody{}, wrapErr(err, "Body (hashBody)")
+	}
+
+	// The second attempt is made if the body was stored by a concurrent
+	// delivery.
+	for i := 0; i < 2; i++ {
+		stats, err := tx.Stmt(b.refSharedBody).Exec(refs, sum, size)
+		if err != nil {
+			return sharedBody{}, wrapErr(err, "Body (refSharedBody)")
+		}
+		affected, err := stats.RowsAffected()
+		if err != nil {
+			return sharedBody{}, wrapErr(err, "Body (refSharedBody)")
+		}
+		if affected != 0 {
+			var (
+				sb           sharedBody
+				compressAlgo sql.NullString
+			)
+			if err := tx.Stmt(b.sharedBody).QueryRow(sum, size).Scan(&sb.key, &compressAlgo); err != nil {
+				return sharedBody{}, wrapErr(err, "Body (sharedBody)")
+			}
+			sb.compressAlgo = compressAlgo.String
+
+			rdr, err := body.Open()
+			if err != nil {
+				return sharedBody{}, wrapErr(err, "Body (extractCachedData)")
+			}
+			sb.bodyStruct, sb.cachedHeader, err = extractCachedData(header, bufio.NewReader(rdr))
+			rdr.Close()
+			if err != nil {
+				return sharedBody{}, wrapErr(err, "Body (extractCachedData)")
+			}
+			return sb, nil
+		}
+
+		rdr, err := body.Open()
+		if err != nil {
+			return sharedBody{}, err
+		}
+		bodyStruct, cachedHeader, key, err := b.processParsedBody(headerBlob, header, rdr, bodyLen)
+		rdr.Close()
+		if err != nil {
+			return sharedBody{}, err
+		}
+		stats, err = tx.Stmt(b.addSharedBody).Exec(key, sum, size, b.Opts.CompressAlgo, refs)
+		if err != nil {
+			b.extStore.Delete([]string{key})
+			return sharedBody{}, wrapErr(err, "Body (addSharedBody)")
+		}
+		affected, err = stats.RowsAffected()
+		if err != nil {
+			b.extStore.Delete([]string{key})
+			return sharedBody{}, wrapErr(err, "Body (addSharedBody)")
+		}
+		if affected != 0 {
+			return sharedBody{
+				key:          key,
+				compressAlgo: b.Opts.CompressAlgo,
+				bodyStruct:   bodyStruct,
+				cachedHeader: cachedHeader,
+				created:      true,
+			}, nil
+		}
+		b.extStore.Delete([]string{key})
+	}
+
+	return sharedBody{}, ErrDeliveryInterrupted
+}
+
+// releaseSharedBodies removes a reference to each of sharedKeys, a key can
+// be listed multiple times. Keys of bodies that are no longer referenced are
+// returned, they should be removed from the ExternalStore after the
+// transaction is committed.
+func (b *Backend) releaseSharedBodies(tx *sql.Tx, sharedKeys []string) ([]string, error) {
+	if len(sharedKeys) == 0 {
+		return nil, nil
+	}
+
+	counts := make(map[string]int, len(sharedKeys))
+	for _, key := range sharedKeys {
+		counts[key]++
+	}
+	// Rows are locked in the same order by all transactions to avoid
+	// deadlocks.
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var unused []string
+	for _, key := range keys {
+		if _, err := tx.Stmt(b.unrefSharedBody).Exec(counts[key], key); err != nil {
+			return nil, err
+		}
+		stats, err := tx.Stmt(b.deleteUnusedSharedBody).Exec(key)
+		if err != nil {
+			return nil, err
+		}
+		affected, err := stats.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if affected != 0 {
+			unused = append(unused, key)
+		}
+	}
+	return unused, nil
+}
+
+// deleteZeroRefs removes unreferenced extKeys rows of the user. Keys of
+// shared bodies that are no longer used are returned.
+func (b *Backend) deleteZeroRefs(tx *sql.Tx, uid uint64) ([]string, error) {
+	sharedKeys, err := b.queryKeys(tx, b.sharedZeroRef, uid)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Stmt(b.deleteZeroRef).Exec(uid); err != nil {
+		return nil, err
+	}
+	return b.releaseSharedBodies(tx, sharedKeys)
+}
+
+// DedupStats describes the space saved by Opts.Deduplicate.
+type DedupStats struct {
+	// Bodies is the number of stored shared bodies.
+	Bodies int64
+	// StoredBytes is the total size of shared bodies (before compression).
+	StoredBytes int64
+	// ReferencedBytes is the size the bodies would take if each delivered
+	// message was stored separately.
+	ReferencedBytes int64
+}
+
+// SavedBytes returns the amount of space saved by deduplication.
+func (s DedupStats) SavedBytes() int64 {
+	return s.ReferencedBytes - s.StoredBytes
+}
+
+// DedupStats returns the statistics for deduplicated bodies. Copies of
+// messages made using IMAP COPY are not included, they share bodies even
+// without deduplication.
+func (b *Backend) DedupStats() (DedupStats, error) {
+	var stats DedupStats
+	err := b.dedupStats.QueryRow().Scan(&stats.Bodies, &stats.StoredBytes, &stats.ReferencedBytes)
+	if err != nil {
+		return DedupStats{}, wrapErr(err, "DedupStats")
+	}
+	return stats, nil
+}
@@ -0,0 +1,96 @@
+package imapsql
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func deliverDedup(t *testing.T, b *Backend, rcpts ...string) {
+	t.Helper()
+	delivery := b.NewDelivery()
+	for _, rcpt := range rcpts {
+		hdr := textproto.Header{}
+		hdr.Set("Delivered-To", rcpt)
+		assert.NilError(t, delivery.AddRcpt(rcpt, hdr), "AddRcpt")
+	}
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)), "BodyRaw")
+	assert.NilError(t, delivery.Commit(), "Commit")
+}
+
+func TestDedup(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	b.Opts.Deduplicate = true
+	assert.NilError(t, b.CreateUser(t.Name()+"-1"))
+	assert.NilError(t, b.CreateUser(t.Name()+"-2"))
+
+	deliverDedup(t, b, t.Name()+"-1", t.Name()+"-2")
+	assert.Assert(t, checkKeysCount(b, 1), "Body is not shared by recipients")
+	deliverDedup(t, b, t.Name()+"-1")
+	assert.Assert(t, checkKeysCount(b, 1), "Body is not shared by deliveries")
+
+	stats, err := b.DedupStats()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(stats.Bodies, int64(1)))
+	assert.Check(t, is.Equal(stats.SavedBytes(), 2*stats.StoredBytes))
+
+	mboxes := make([]*Mailbox, 2)
+	for i, name := range []string{t.Name() + "-1", t.Name() + "-2"} {
+		u, err := b.GetUser(name)
+		assert.NilError(t, err)
+		_, mbox, err := u.GetMailbox("INBOX", false, &noopConn{})
+		assert.NilError(t, err)
+		defer mbox.Close()
+		mboxes[i] = mbox.(*Mailbox)
+
+		seq, _ := imap.ParseSeqSet("1")
+		ch := make(chan *imap.Message, 10)
+		assert.NilError(t, mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchRFC822Size, "BODY.PEEK[]"}, ch))
+		assert.Assert(t, is.Len(ch, 1))
+		msg := <-ch
+		for _, part := range msg.Body {
+			blob, err := ioutil.ReadAll(part)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(int(msg.Size), len(blob)), "RFC822.SIZE does not match the body")
+
+			hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(string(blob))))
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(hdr.Get("Delivered-To"), name), "wrong user header stored")
+		}
+	}
+
+	// The body is used by other messages.
+	seq, _ := imap.ParseSeqSet("1:*")
+	assert.NilError(t, mboxes[0].DelMessages(false, seq))
+	assert.Assert(t, checkKeysCount(b, 1), "Shared body is removed")
+
+	assert.NilError(t, b.DeleteUser(t.Name()+"-2"))
+	assert.Assert(t, checkKeysCount(b, 0), "Body is not removed after all messages are deleted")
+	stats, err = b.DedupStats()
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(stats.Bodies, int64(0)))
+}
+
+func TestDedup_Abort(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	b.Opts.Deduplicate = true
+	assert.NilError(t, b.CreateUser(t.Name()))
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name(), textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Abort())
+	assert.Assert(t, checkKeysCount(b, 0), "Body is not removed after abort")
+
+	// Aborted delivery does not leave a reference to the removed body.
+	deliverDedup(t, b, t.Name())
+	assert.Assert(t, checkKeysCount(b, 1))
+}
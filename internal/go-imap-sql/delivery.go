@@ -35,7 +35,7 @@ func (b *Backend) NewDelivery() Delivery {
 func (d *Delivery) clean() {
 	d.users = d.users[0:0]
 	d.mboxes = d.mboxes[0:0]
-	d.extKey = ""
+	d.extKeys = d.extKeys[0:0]
 	for k := range d.perRcptHeader {
 		delete(d.perRcptHeader, k)
 	}
@@ -54,7 +54,7 @@ type Delivery struct {
 	tx            *sql.Tx
 	users         []User
 	mboxes        []Mailbox
-	extKey        string
+	extKeys       []string
 	perRcptHeader map[string]textproto.Header
 	flagOverrides map[string][]string
 	mboxOverrides map[string]string
@@ -95,6 +95,24 @@ func (d *Delivery) AddRcpt(username string, userHeader textproto.Header) error {
 	return nil
 }
 
+// RemoveRcpt removes the recipient added using AddRcpt from the delivery,
+// e.g. if the message is rejected for it. It should be called before
+// Mailbox, SpecialMailbox and BodyParsed/BodyRaw.
+func (d *Delivery) RemoveRcpt(username string) {
+	username = normalizeUsername(username)
+
+	users := d.users[:0]
+	for _, u := range d.users {
+		if u.username != username {
+			users = append(users, u)
+		}
+	}
+	d.users = users
+	delete(d.perRcptHeader, username)
+	delete(d.mboxOverrides, username)
+	delete(d.flagOverrides, username)
+}
+
 // FIXME: Fix that goddamned code duplication.
 
 // Mailbox command changes the target mailbox for all recipients.
@@ -260,6 +278,22 @@ func (d *Delivery) BodyParsed(header textproto.Header, bodyLen int, body Buffer)
 		return wrapErr(err, "Body")
 	}
 
+	var shared *sharedBody
+	if d.b.Opts.Deduplicate {
+		headerBlob := bytes.Buffer{}
+		if err := textproto.WriteHeader(&headerBlob, header); err != nil {
+			return wrapErr(err, "Body (WriteHeader)")
+		}
+		sb, err := d.b.storeSharedBody(d.tx, header, headerBlob.Bytes(), int64(bodyLen), body, len(d.mboxes))
+		if err != nil {
+			return err
+		}
+		if sb.created {
+			d.extKeys = append(d.extKeys, sb.key)
+		}
+		shared = &sb
+	}
+
 	for _, mbox := range d.mboxes {
 		var flagsStmt *sql.Stmt
 		if len(d.flagOverrides[mbox.user.username]) != 0 {
@@ -269,7 +303,11 @@ func (d *Delivery) BodyParsed(header textproto.Header, bodyLen int, body Buffer)
 			}
 		}
 
-		err = d.mboxDelivery(header, mbox, int64(bodyLen), body, date, flagsStmt)
+		if shared != nil {
+			err = d.sharedMboxDelivery(header, mbox, *shared, int64(bodyLen), body, date, flagsStmt)
+		} else {
+			err = d.mboxDelivery(header, mbox, int64(bodyLen), body, date, flagsStmt)
+		}
 		if err != nil {
 			return err
 		}
@@ -300,6 +338,9 @@ func (d *Delivery) mboxDelivery(header textproto.Header, mbox Mailbox, bodyLen i
 	if err != nil {
 		return err
 	}
+	// Bodies are written before the metadata, keep track of them to remove
+	// them if the delivery is aborted.
+	d.extKeys = append(d.extKeys, extBodyKey)
 
 	if _, err = d.tx.Stmt(d.b.addExtKey).Exec(extBodyKey, mbox.user.id, 1); err != nil {
 		d.b.extStore.Delete([]string{extBodyKey})
@@ -341,6 +382,21 @@ func (d *Delivery) mboxDelivery(header textproto.Header, mbox Mailbox, bodyLen i
 		d.b.extStore.Delete([]string{extBodyKey})
 		return wrapErr(err, "Body (addMsg)")
 	}
+	if err := d.b.changeUsage(d.tx, mbox.user.id, usage{bytes: length, msgs: 1}); err != nil {
+		d.b.extStore.Delete([]string{extBodyKey})
+		return wrapErr(err, "Body (changeUsage)")
+	}
+	if d.b.fts != ftsNone {
+		bodyReader, err := body.Open()
+		if err != nil {
+			return wrapErr(err, "Body (indexMessage)")
+		}
+		err = d.b.indexMessage(d.tx, mbox.id, msgId, io.MultiReader(bytes.NewReader(headerBlob.Bytes()), bodyReader))
+		bodyReader.Close()
+		if err != nil {
+			return wrapErr(err, "Body (indexMessage)")
+		}
+	}
 	// --- end of operations that involve msgs table ---
 
 	// --- operations that involve flags table ---
@@ -358,14 +414,103 @@ func (d *Delivery) mboxDelivery(header textproto.Header, mbox Mailbox, bodyLen i
 	return nil
 }
 
+// sharedMboxDelivery is the mboxDelivery variant for Opts.Deduplicate, the
+// message references the shared body and only recipient-specific header
+// fields are stored separately. The shared body is removed in Abort if it
+// was created by this delivery.
+func (d *Delivery) sharedMboxDelivery(header textproto.Header, mbox Mailbox, shared sharedBody, bodyLen int64, body Buffer, date time.Time, flagsStmt *sql.Stmt) error {
+	var rcptHeader []byte
+	cachedHeader := shared.cachedHeader
+	userHeader := d.perRcptHeader[mbox.user.username]
+	if userHeader.Len() != 0 {
+		rcptBlob := bytes.Buffer{}
+		if err := textproto.WriteHeader(&rcptBlob, userHeader); err != nil {
+			return wrapErr(err, "Body (WriteHeader)")
+		}
+		// Strip the empty line terminating the header, it is a part of the
+		// shared body.
+		rcptHeader = bytes.TrimSuffix(rcptBlob.Bytes(), []byte("\r\n"))
+
+		fullHeader := header.Copy()
+		for fields := userHeader.Fields(); fields.Next(); {
+			fullHeader.Add(fields.Key(), fields.Value())
+		}
+		cachedHeader = cacheHeader(fullHeader)
+	}
+
+	headerBlob := bytes.Buffer{}
+	if err := textproto.WriteHeader(&headerBlob, header); err != nil {
+		return wrapErr(err, "Body (WriteHeader)")
+	}
+	length := int64(len(rcptHeader)+headerBlob.Len()) + bodyLen
+
+	extBodyKey, err := randomKey()
+	if err != nil {
+		return wrapErr(err, "Body (randomKey)")
+	}
+	if _, err = d.tx.Stmt(d.b.addSharedExtKey).Exec(extBodyKey, mbox.user.id, shared.key, rcptHeader); err != nil {
+		return wrapErr(err, "Body (addSharedExtKey)")
+	}
+
+	// --- operations that involve mboxes table ---
+	msgId, err := mbox.incrementMsgCounters(d.tx)
+	if err != nil {
+		return wrapErr(err, "Body (incrementMsgCounters)")
+	}
+
+	// --- operations that involve msgs table ---
+	// See mboxDelivery for persistRecent and notifications.
+	persistRecent := 1
+	d.pendingNotifications = append(d.pendingNotifications, pendingNotification{
+		mboxId: mbox.id,
+		msgId:  msgId,
+	})
+
+	_, err = d.tx.Stmt(d.b.addMsg).Exec(
+		mbox.id, msgId, date.Unix(),
+		length,
+		shared.bodyStruct, cachedHeader, extBodyKey,
+		0, shared.compressAlgo, persistRecent,
+	)
+	if err != nil {
+		return wrapErr(err, "Body (addMsg)")
+	}
+	if err := d.b.changeUsage(d.tx, mbox.user.id, usage{bytes: length, msgs: 1}); err != nil {
+		return wrapErr(err, "Body (changeUsage)")
+	}
+	if d.b.fts != ftsNone {
+		bodyReader, err := body.Open()
+		if err != nil {
+			return wrapErr(err, "Body (indexMessage)")
+		}
+		err = d.b.indexMessage(d.tx, mbox.id, msgId, io.MultiReader(bytes.NewReader(rcptHeader), bytes.NewReader(headerBlob.Bytes()), bodyReader))
+		bodyReader.Close()
+		if err != nil {
+			return wrapErr(err, "Body (indexMessage)")
+		}
+	}
+	// --- end of operations that involve msgs table ---
+
+	// --- operations that involve flags table ---
+	if flags := d.flagOverrides[mbox.user.username]; len(flags) != 0 {
+		params := mbox.makeFlagsAddStmtArgs(flags, msgId, msgId)
+		if _, err := d.tx.Stmt(flagsStmt).Exec(params...); err != nil {
+			return wrapErr(err, "Body (flagsStmt)")
+		}
+	}
+	// --- end operations that involve flags table ---
+
+	return nil
+}
+
 func (d *Delivery) Abort() error {
 	if d.tx != nil {
 		if err := d.tx.Rollback(); err != nil {
 			return err
 		}
 	}
-	if d.extKey != "" {
-		if err := d.b.extStore.Delete([]string{d.extKey}); err != nil {
+	if len(d.extKeys) != 0 {
+		if err := d.b.extStore.Delete(d.extKeys); err != nil {
 			return err
 		}
 	}
@@ -3,6 +3,7 @@ package imapsql
 import (
 	"bufio"
 	"io/ioutil"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -139,6 +140,29 @@ func TestDelivery_Abort(t *testing.T) {
 	assert.Equal(t, status.Messages, uint32(0))
 }
 
+func TestDelivery_RemoveRcpt(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()+"-1"), "CreateUser 1")
+	assert.NilError(t, b.CreateUser(t.Name()+"-2"), "CreateUser 2")
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-1", textproto.Header{}), "AddRcpt 1")
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-2", textproto.Header{}), "AddRcpt 2")
+	delivery.RemoveRcpt(t.Name() + "-2")
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)), "BodyRaw")
+	assert.NilError(t, delivery.Commit(), "Commit")
+
+	for i, expected := range []uint32{1, 0} {
+		u, err := b.GetUser(t.Name() + "-" + strconv.Itoa(i+1))
+		assert.NilError(t, err, "GetUser")
+		status, mbox, err := u.GetMailbox("INBOX", true, &noopConn{})
+		assert.NilError(t, err, "GetMailbox")
+		mbox.Close()
+		assert.Equal(t, status.Messages, expected)
+	}
+}
+
 func TestDelivery_AddRcpt_NonExistent(t *testing.T) {
 	b := initTestBackend().(*Backend)
 	defer cleanBackend(b)
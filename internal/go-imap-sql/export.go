@@ -0,0 +1,156 @@
+package imapsql
+
+import (
+	"database/sql"
+	"io"
+	"strings"
+	"time"
+)
+
+func (b *Backend) prepareExportStmts() error {
+	var err error
+	b.exportMboxes, err = b.db.Prepare(`
+		SELECT id, name, sub, uidvalidity, specialuse
+		FROM mboxes
+		WHERE uid = ?
+		ORDER BY name`)
+	if err != nil {
+		return wrapErr(err, "exportMboxes prep")
+	}
+	return nil
+}
+
+// ExportedMailbox describes a mailbox passed to UserExporter.
+type ExportedMailbox struct {
+	Name        string
+	SpecialUse  string
+	Subscribed  bool
+	UidValidity uint32
+}
+
+// ExportedMessage describes a message passed to UserExporter. Body is valid
+// only until UserExporter.Message returns.
+type ExportedMessage struct {
+	UID   uint32
+	Date  time.Time
+	Size  uint32
+	Flags []string
+	Body  io.Reader
+}
+
+// UserExporter receives mailboxes and messages from ExportUser. Message is
+// called for each message of the mailbox passed to the preceding Mailbox
+// call, in the UID order.
+type UserExporter interface {
+	Mailbox(mbox ExportedMailbox) error
+	Message(msg ExportedMessage) error
+}
+
+// ExportUser passes all mailboxes of the user and messages in them to exp.
+// Everything is read in a single read-only transaction with the repeatable
+// read isolation level, so the export reflects the state of the account at
+// the time it started. Bodies are streamed from the external store and not
+// buffered in memory.
+//
+// Soft-deleted messages are not exported. Errors returned by exp stop the
+// export and are passed through.
+func (b *Backend) ExportUser(username string, exp UserExporter) error {
+	username = normalizeUsername(username)
+
+	tx, err := b.db.BeginLevel(sql.LevelRepeatableRead, true)
+	if err != nil {
+		return wrapErr(err, "ExportUser")
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	uid, _, err := b.getUserMeta(tx, username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesntExists
+		}
+		return wrapErr(err, "ExportUser")
+	}
+
+	type exportMbox struct {
+		id uint64
+		ExportedMailbox
+	}
+	var mboxes []exportMbox
+	rows, err := tx.Stmt(b.exportMboxes).Query(uid)
+	if err != nil {
+		return wrapErr(err, "ExportUser")
+	}
+	for rows.Next() {
+		var (
+			mbox       exportMbox
+			sub        int
+			specialUse sql.NullString
+		)
+		if err := rows.Scan(&mbox.id, &mbox.Name, &sub, &mbox.UidValidity, &specialUse); err != nil {
+			rows.Close()
+			return wrapErr(err, "ExportUser")
+		}
+		mbox.Subscribed = sub == 1
+		mbox.SpecialUse = specialUse.String
+		mboxes = append(mboxes, mbox)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return wrapErr(err, "ExportUser")
+	}
+
+	for _, mbox := range mboxes {
+		if err := exp.Mailbox(mbox.ExportedMailbox); err != nil {
+			return err
+		}
+		if err := b.exportMessages(tx, mbox.id, exp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Backend) exportMessages(tx *sql.Tx, mboxId uint64, exp UserExporter) error {
+	rows, err := tx.Stmt(b.searchFetchNoSeq).Query(mboxId)
+	if err != nil {
+		return wrapErr(err, "ExportUser")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			msgId        uint32
+			dateUnix     int64
+			bodyLen      uint32
+			flagStr      string
+			extBodyKey   string
+			compressAlgo string
+			rcptHeader   []byte
+			sharedKey    sql.NullString
+		)
+		if err := rows.Scan(&msgId, &dateUnix, &bodyLen, &extBodyKey, &compressAlgo, &rcptHeader, &sharedKey, &flagStr); err != nil {
+			return wrapErr(err, "ExportUser")
+		}
+		flags := strings.Split(flagStr, flagsSep)
+		if len(flags) == 1 && flags[0] == "" {
+			flags = nil
+		}
+
+		body, err := b.openBody(true, compressAlgo, extBodyKey, sharedKey, rcptHeader)
+		if err != nil {
+			return wrapErr(err, "ExportUser")
+		}
+		err = exp.Message(ExportedMessage{
+			UID:   msgId,
+			Date:  time.Unix(dateUnix, 0),
+			Size:  bodyLen,
+			Flags: flags,
+			Body:  body,
+		})
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return wrapErr(rows.Err(), "ExportUser")
+}
@@ -0,0 +1,72 @@
+package imapsql
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type testExporter struct {
+	mboxes []ExportedMailbox
+	msgs   map[string][]ExportedMessage
+	bodies map[string][]string
+}
+
+func (exp *testExporter) Mailbox(mbox ExportedMailbox) error {
+	exp.mboxes = append(exp.mboxes, mbox)
+	return nil
+}
+
+func (exp *testExporter) Message(msg ExportedMessage) error {
+	name := exp.mboxes[len(exp.mboxes)-1].Name
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return err
+	}
+	msg.Body = nil
+	exp.msgs[name] = append(exp.msgs[name], msg)
+	exp.bodies[name] = append(exp.bodies[name], string(body))
+	return nil
+}
+
+func TestExportUser(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.(*User).CreateMailboxSpecial("Sent", imap.SentAttr))
+	assert.NilError(t, usr.SetSubscribed("Sent", false))
+
+	date := time.Unix(1577836800, 0)
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{imap.SeenFlag}, date, strings.NewReader(testMsg), nil))
+	assert.NilError(t, usr.CreateMessage("INBOX", nil, date.Add(time.Hour), strings.NewReader(testMsg), nil))
+	assert.NilError(t, usr.CreateMessage("Sent", []string{imap.AnsweredFlag}, date, strings.NewReader(testMsg), nil))
+
+	exp := &testExporter{msgs: map[string][]ExportedMessage{}, bodies: map[string][]string{}}
+	assert.NilError(t, b.ExportUser(t.Name(), exp))
+
+	assert.Equal(t, len(exp.mboxes), 2)
+	assert.Check(t, is.Equal(exp.mboxes[0].Name, "INBOX"))
+	assert.Check(t, exp.mboxes[0].Subscribed)
+	assert.Check(t, is.Equal(exp.mboxes[1].Name, "Sent"))
+	assert.Check(t, is.Equal(exp.mboxes[1].SpecialUse, imap.SentAttr))
+	assert.Check(t, !exp.mboxes[1].Subscribed)
+
+	inbox := exp.msgs["INBOX"]
+	assert.Equal(t, len(inbox), 2)
+	assert.Check(t, is.Equal(inbox[0].UID, uint32(1)))
+	assert.Check(t, inbox[0].Date.Equal(date))
+	assert.Check(t, is.Equal(inbox[0].Size, uint32(len(testMsg))))
+	assert.Check(t, is.DeepEqual(inbox[0].Flags, []string{imap.SeenFlag}))
+	assert.Check(t, is.Len(inbox[1].Flags, 0))
+	assert.Check(t, is.DeepEqual(exp.bodies["INBOX"], []string{testMsg, testMsg}))
+	assert.Check(t, is.DeepEqual(exp.msgs["Sent"][0].Flags, []string{imap.AnsweredFlag}))
+
+	assert.Equal(t, b.ExportUser("nobody", exp), ErrUserDoesntExists)
+}
@@ -3,8 +3,10 @@ package imapsql
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 type ExtStoreObj interface {
@@ -57,6 +59,24 @@ type ExternalStore interface {
 	Delete(keys []string) error
 }
 
+// ErrNotListable is returned by Backend.CollectGarbage if the ExternalStore
+// can't enumerate stored objects.
+var ErrNotListable = errors.New("external: store does not support listing")
+
+// ListableStore is implemented by ExternalStore implementations that can
+// enumerate stored objects. It is required to find objects that are not
+// referenced by the database.
+type ListableStore interface {
+	ExternalStore
+
+	// List calls fn for each stored object. modTime is the time the object
+	// was written.
+	//
+	// Iteration stops if fn returns an error, the error is returned from
+	// List.
+	List(fn func(key string, modTime time.Time) error) error
+}
+
 func randomKey() (string, error) {
 	b := make([]byte, 16)
 	if _, err := rand.Read(b); err != nil {
@@ -20,9 +20,9 @@ func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.Fetch
 	defer close(ch)
 	var err error
 
-	setSeen := !m.readOnly && shouldSetSeen(items)
+	setSeen := !m.readOnly && shouldSetSeen(items) && m.checkRights("s") == nil
 	var addSeenStmt *sql.Stmt
-	if setSeen {
+	if setSeen && !m.privateSeen() {
 		addSeenStmt, err = m.parent.getFlagsAddStmt(1)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "ListMessages (getFlagsAddStmt)", uid, seqset, items)
@@ -58,7 +58,12 @@ func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.Fetch
 	m.parent.Opts.Log.Debugln("resolved", uid, seqset, "to", seqset)
 
 	for _, seq := range seqset.Set {
-		if setSeen {
+		if setSeen && m.privateSeen() {
+			if _, err := tx.Stmt(m.parent.addPrivateSeenUid).Exec(m.viewer.id, m.id, seq.Start, seq.Stop); err != nil {
+				m.parent.logMboxErr(m, err, "ListMessages (add private seen)", uid, seqset, items)
+				return err
+			}
+		} else if setSeen {
 			params := m.makeFlagsAddStmtArgs([]string{imap.SeenFlag}, seq.Start, seq.Stop)
 			if _, err := tx.Stmt(addSeenStmt).Exec(params...); err != nil {
 				m.parent.logMboxErr(m, err, "ListMessages (add seen)", uid, seqset, items)
@@ -72,12 +77,21 @@ func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.Fetch
 			}
 		}
 
+		var seen map[uint32]struct{}
+		if m.privateSeen() {
+			seen, err = m.seenUids(tx, seq.Start, seq.Stop)
+			if err != nil {
+				m.parent.logMboxErr(m, err, "ListMessages (private seen)", uid, seqset, items)
+				return err
+			}
+		}
+
 		rows, err := tx.Stmt(stmt).Query(m.id, seq.Start, seq.Stop)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "ListMessages", uid, seqset, items)
 			return err
 		}
-		if err := m.scanMessages(rows, items, ch); err != nil {
+		if err := m.scanMessages(rows, items, seen, ch); err != nil {
 			m.parent.logMboxErr(m, err, "ListMessages (scan)", uid, seqset, items)
 			return err
 		}
@@ -95,6 +109,8 @@ type scanData struct {
 	flagStr       string
 	extBodyKey    string
 	compressAlgo  string
+	sharedKey     sql.NullString
+	rcptHeader    []byte
 
 	bodyStructure *imap.BodyStructure
 	cachedHeader  map[string][]string
@@ -125,6 +141,10 @@ func makeScanArgs(data *scanData, rows *sql.Rows) ([]interface{}, error) {
 			scanOrder = append(scanOrder, &data.compressAlgo)
 		case "extBodyKey", "extbodykey":
 			scanOrder = append(scanOrder, &data.extBodyKey)
+		case "sharedKey", "sharedkey":
+			scanOrder = append(scanOrder, &data.sharedKey)
+		case "rcptHeader", "rcptheader":
+			scanOrder = append(scanOrder, &data.rcptHeader)
 		case "flags":
 			scanOrder = append(scanOrder, &data.flagStr)
 		default:
@@ -135,7 +155,9 @@ func makeScanArgs(data *scanData, rows *sql.Rows) ([]interface{}, error) {
 	return scanOrder, nil
 }
 
-func (m *Mailbox) scanMessages(rows *sql.Rows, items []imap.FetchItem, ch chan<- *imap.Message) error {
+// scanMessages sends messages from rows to ch. If seen is not nil, it replaces
+// \Seen flag stored in the flags table, see Mailbox.privateSeen.
+func (m *Mailbox) scanMessages(rows *sql.Rows, items []imap.FetchItem, seen map[uint32]struct{}, ch chan<- *imap.Message) error {
 	defer rows.Close()
 	data := scanData{}
 
@@ -192,6 +214,9 @@ messageLoop:
 				} else {
 					msg.Flags = []string{}
 				}
+				if seen != nil {
+					msg.Flags = replaceSeen(msg.Flags, data.msgId, seen)
+				}
 				if m.handle.IsRecent(data.msgId) {
 					msg.Flags = append(msg.Flags, imap.RecentFlag)
 				}
@@ -230,7 +255,7 @@ func (m *Mailbox) extractBodyPart(item imap.FetchItem, data *scanData, msg *imap
 	case needHeader, needFullBody:
 		// We don't need to parse header once more if we already did, so we just skip it if we open body
 		// multiple times.
-		bufferedBody, err := m.openBody(data.parsedHeader == nil, data.compressAlgo, data.extBodyKey)
+		bufferedBody, err := m.openBody(data.parsedHeader == nil, data.compressAlgo, data.extBodyKey, data.sharedKey, data.rcptHeader)
 		if err != nil {
 			return err
 		}
@@ -265,8 +290,19 @@ func (n nopCloser) Close() error {
 	return nil
 }
 
-func (m *Mailbox) openBody(needHeader bool, compressAlgoColumn, extBodyKey string) (BufferedReadCloser, error) {
-	rdr, err := m.parent.extStore.Open(extBodyKey)
+func (m *Mailbox) openBody(needHeader bool, compressAlgoColumn, extBodyKey string, sharedKey sql.NullString, rcptHeader []byte) (BufferedReadCloser, error) {
+	return m.parent.openBody(needHeader, compressAlgoColumn, extBodyKey, sharedKey, rcptHeader)
+}
+
+// openBody opens the message body. If sharedKey is valid, the body is
+// deduplicated and rcptHeader is prepended to the shared body, see
+// storeSharedBody.
+func (b *Backend) openBody(needHeader bool, compressAlgoColumn, extBodyKey string, sharedKey sql.NullString, rcptHeader []byte) (BufferedReadCloser, error) {
+	objKey := extBodyKey
+	if sharedKey.Valid {
+		objKey = sharedKey.String
+	}
+	rdr, err := b.extStore.Open(objKey)
 	if err != nil {
 		return BufferedReadCloser{}, wrapErr(err, "openBody")
 	}
@@ -282,7 +318,12 @@ func (m *Mailbox) openBody(needHeader bool, compressAlgoColumn, extBodyKey strin
 		return BufferedReadCloser{}, wrapErr(err, "openBody")
 	}
 
-	bufR := bufio.NewReader(rdrDecomp)
+	var bufR *bufio.Reader
+	if sharedKey.Valid {
+		bufR = bufio.NewReader(io.MultiReader(bytes.NewReader(rcptHeader), rdrDecomp))
+	} else {
+		bufR = bufio.NewReader(rdrDecomp)
+	}
 	if !needHeader {
 		for {
 			// Skip header if it is not needed.
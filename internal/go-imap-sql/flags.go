@@ -8,6 +8,15 @@ import (
 )
 
 func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, silent bool, flags []string) error {
+	// Replacing flags can change all of them.
+	needRights := flagRights(flags)
+	if operation == imap.SetFlags {
+		needRights = "swt"
+	}
+	if err := m.checkRights(needRights); err != nil {
+		return err
+	}
+
 	defer m.handle.Sync(uid)
 
 	seenModified := false
@@ -18,6 +27,10 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 		}
 		if flag == imap.SeenFlag {
 			seenModified = true
+			// Stored in the privateSeen table instead.
+			if m.privateSeen() {
+				continue
+			}
 		}
 		newFlagSet = append(newFlagSet, flag)
 	}
@@ -53,14 +66,27 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 	for _, seq := range seqset.Set {
 		switch operation {
 		case imap.SetFlags:
-			_, err = tx.Stmt(m.parent.massClearFlagsUid).Exec(m.id, seq.Start, seq.Stop)
+			clearStmt := m.parent.massClearFlagsUid
+			if m.privateSeen() {
+				// \Seen of the owner is kept.
+				clearStmt = m.parent.massClearSharedFlagsUid
+				_, err = tx.Stmt(m.parent.remPrivateSeenUid).Exec(m.viewer.id, m.id, seq.Start, seq.Stop)
+				if err != nil {
+					return err
+				}
+			}
+			_, err = tx.Stmt(clearStmt).Exec(m.id, seq.Start, seq.Stop)
 			if err != nil {
 				return err
 			}
 			fallthrough
 		case imap.AddFlags:
 			if seenModified {
-				_, err = tx.Stmt(m.parent.setSeenFlagUid).Exec(1, m.id, seq.Start, seq.Stop)
+				if m.privateSeen() {
+					_, err = tx.Stmt(m.parent.addPrivateSeenUid).Exec(m.viewer.id, m.id, seq.Start, seq.Stop)
+				} else {
+					_, err = tx.Stmt(m.parent.setSeenFlagUid).Exec(1, m.id, seq.Start, seq.Stop)
+				}
 				if err != nil {
 					return err
 				}
@@ -76,7 +102,11 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 			}
 		case imap.RemoveFlags:
 			if seenModified {
-				_, err = tx.Stmt(m.parent.setSeenFlagUid).Exec(0, m.id, seq.Start, seq.Stop)
+				if m.privateSeen() {
+					_, err = tx.Stmt(m.parent.remPrivateSeenUid).Exec(m.viewer.id, m.id, seq.Start, seq.Stop)
+				} else {
+					_, err = tx.Stmt(m.parent.setSeenFlagUid).Exec(0, m.id, seq.Start, seq.Stop)
+				}
 				if err != nil {
 					return err
 				}
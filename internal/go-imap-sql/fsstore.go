@@ -1,8 +1,10 @@
 package imapsql
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // FSStore struct represents directory on FS used to store message bodies.
@@ -59,3 +61,19 @@ func (s *FSStore) Delete(keys []string) error {
 	}
 	return nil
 }
+
+func (s *FSStore) List(fn func(key string, modTime time.Time) error) error {
+	infos, err := ioutil.ReadDir(s.Root)
+	if err != nil {
+		return ExternalError{Err: err}
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if err := fn(info.Name(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -16,6 +16,7 @@ import (
 
 var TestDB = os.Getenv("TEST_DB")
 var TestDSN = os.Getenv("TEST_DSN")
+var TestTablePrefix = os.Getenv("TEST_TABLE_PREFIX")
 
 func initTestBackend() backendtests.Backend {
 	driver := TestDB
@@ -56,6 +57,7 @@ func initTestBackend() backendtests.Backend {
 	b, err := New(driver, dsn, &FSStore{Root: storeDir}, Opts{
 		PRNG:            prng,
 		Log:             log,
+		TablePrefix:     TestTablePrefix,
 	})
 	if err != nil {
 		panic(err)
@@ -68,26 +70,26 @@ func cleanBackend(bi backendtests.Backend) {
 	if os.Getenv("PRESERVE_DB") != "1" && os.Getenv("PRESERVE_SQLITE3_DB") != "1" {
 		// Remove things manually in the right order so we will not hit
 		// foreign key constraint when dropping tables.
-		if _, err := b.DB.Exec(`DELETE FROM msgs`); err != nil {
+		if _, err := b.db.Exec(`DELETE FROM msgs`); err != nil {
 			log.Println("DELETE FROM msgs", err)
 		}
-		if _, err := b.DB.Exec(`DELETE FROM extKeys`); err != nil {
+		if _, err := b.db.Exec(`DELETE FROM extKeys`); err != nil {
 			log.Println("DELETE FROM extKeys", err)
 		}
 
-		if _, err := b.DB.Exec(`DROP TABLE flags`); err != nil {
+		if _, err := b.db.Exec(`DROP TABLE flags`); err != nil {
 			log.Println("DROP TABLE flags", err)
 		}
-		if _, err := b.DB.Exec(`DROP TABLE msgs`); err != nil {
+		if _, err := b.db.Exec(`DROP TABLE msgs`); err != nil {
 			log.Println("DROP TABLE msgs", err)
 		}
-		if _, err := b.DB.Exec(`DROP TABLE mboxes`); err != nil {
+		if _, err := b.db.Exec(`DROP TABLE mboxes`); err != nil {
 			log.Println("DROP TABLE mboxes", err)
 		}
-		if _, err := b.DB.Exec(`DROP TABLE users`); err != nil {
+		if _, err := b.db.Exec(`DROP TABLE users`); err != nil {
 			log.Println("DROP TABLE users", err)
 		}
-		if _, err := b.DB.Exec(`DROP TABLE extKeys`); err != nil {
+		if _, err := b.db.Exec(`DROP TABLE extKeys`); err != nil {
 			log.Println("DROP TABLE extKeys", err)
 		}
 
@@ -0,0 +1,571 @@
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+// Full-text search index.
+//
+// On SQLite, it is the FTS5 table msgsText. Rows are identified by
+// (mboxId << 32) | msgId rowid and removed by a trigger when messages are
+// deleted. On PostgreSQL, msgsText is a table with tsvector columns and GIN
+// indexes, rows are removed by the foreign key cascade.
+//
+// Messages added before the index is enabled are not indexed, ReindexSearch
+// should be used for them.
+
+const (
+	ftsNone     = ""
+	ftsSQLite   = "fts5"
+	ftsPostgres = "tsvector"
+)
+
+// maxIndexedText is the maximum amount of body text indexed for a message.
+const maxIndexedText = 1024 * 1024
+
+// ErrNoSearchIndex is returned by ReindexSearch if the full-text search index
+// is not enabled or not supported by the database.
+var ErrNoSearchIndex = errors.New("imapsql: full-text search index is not enabled")
+
+// searchColumns maps header fields of SEARCH criteria to the indexed columns.
+var searchColumns = map[string]string{
+	"Subject": "subject",
+	"From":    "fromAddr",
+	"To":      "toAddr",
+}
+
+func (b *Backend) initSearchIndex() error {
+	switch b.db.driver {
+	case "sqlite3", "sqlite":
+		_, err := b.db.Exec(`
+			CREATE VIRTUAL TABLE IF NOT EXISTS msgsText
+			USING fts5(subject, fromAddr, toAddr, body)`)
+		if err != nil {
+			if strings.Contains(err.Error(), "no such module") {
+				b.Opts.Log.Printf("SQLite is built without FTS5, full-text search index is disabled")
+				return nil
+			}
+			return wrapErr(err, "create table msgsText")
+		}
+		_, err = b.db.Exec(`
+			CREATE TRIGGER IF NOT EXISTS ` + b.db.prefix + `msgsText_delete
+			AFTER DELETE ON msgs
+			BEGIN
+				DELETE FROM msgsText WHERE rowid = (old.mboxId << 32) | old.msgId;
+			END`)
+		if err != nil {
+			return wrapErr(err, "create trigger msgsText_delete")
+		}
+		b.fts = ftsSQLite
+	case "postgres":
+		_, err := b.db.Exec(`
+			CREATE TABLE IF NOT EXISTS msgsText (
+				mboxId BIGINT NOT NULL,
+				msgId BIGINT NOT NULL,
+				subject TSVECTOR NOT NULL,
+				fromAddr TSVECTOR NOT NULL,
+				toAddr TSVECTOR NOT NULL,
+				body TSVECTOR NOT NULL,
+
+				PRIMARY KEY(mboxId, msgId),
+				FOREIGN KEY (mboxId, msgId) REFERENCES msgs(mboxId, msgId) ON DELETE CASCADE
+			)`)
+		if err != nil {
+			return wrapErr(err, "create table msgsText")
+		}
+		for _, col := range []string{"subject", "fromAddr", "toAddr", "body"} {
+			_, err := b.db.Exec(`
+				CREATE INDEX IF NOT EXISTS msgsText_` + col + `
+				ON msgsText USING GIN (` + col + `)`)
+			if err != nil {
+				return wrapErr(err, "create index msgsText_"+col)
+			}
+		}
+		b.fts = ftsPostgres
+	default:
+		b.Opts.Log.Printf("full-text search index is not supported for %s, SEARCH will scan messages", b.db.driver)
+		return nil
+	}
+
+	return b.prepareSearchStmts()
+}
+
+func (b *Backend) prepareSearchStmts() error {
+	var err error
+	switch b.fts {
+	case ftsSQLite:
+		b.addSearchDoc, err = b.db.Prepare(`
+			INSERT INTO msgsText(rowid, subject, fromAddr, toAddr, body)
+			VALUES ((? << 32) | ?, ?, ?, ?, ?)`)
+		if err != nil {
+			return wrapErr(err, "addSearchDoc prep")
+		}
+		b.delSearchDoc, err = b.db.Prepare(`
+			DELETE FROM msgsText
+			WHERE rowid = (? << 32) | ?`)
+		if err != nil {
+			return wrapErr(err, "delSearchDoc prep")
+		}
+		b.copySearchDocsUid, err = b.db.Prepare(`
+			INSERT INTO msgsText(rowid, subject, fromAddr, toAddr, body)
+			SELECT (? << 32) | new_msgId, subject, fromAddr, toAddr, body
+			FROM msgsText
+			INNER JOIN (
+				SELECT (
+					SELECT uidnext - 1
+					FROM mboxes
+					WHERE id = ?
+				) + row_number() OVER (ORDER BY msgId) + ? AS new_msgId, msgId, mboxId
+				FROM msgs
+				WHERE mboxId = ?
+				AND msgId BETWEEN ? AND ?
+				ORDER BY msgId
+			) map ON msgsText.rowid = (map.mboxId << 32) | map.msgId`)
+		if err != nil {
+			return wrapErr(err, "copySearchDocsUid prep")
+		}
+		b.searchDocs, err = b.db.Prepare(`
+			SELECT rowid & 4294967295
+			FROM msgsText
+			WHERE msgsText MATCH ?
+			AND rowid BETWEEN (? << 32) AND ((? << 32) | 4294967295)`)
+		if err != nil {
+			return wrapErr(err, "searchDocs prep")
+		}
+	case ftsPostgres:
+		b.addSearchDoc, err = b.db.Prepare(`
+			INSERT INTO msgsText(mboxId, msgId, subject, fromAddr, toAddr, body)
+			VALUES (?, ?, to_tsvector('simple', ?), to_tsvector('simple', ?), to_tsvector('simple', ?), to_tsvector('simple', ?))`)
+		if err != nil {
+			return wrapErr(err, "addSearchDoc prep")
+		}
+		b.delSearchDoc, err = b.db.Prepare(`
+			DELETE FROM msgsText
+			WHERE mboxId = ? AND msgId = ?`)
+		if err != nil {
+			return wrapErr(err, "delSearchDoc prep")
+		}
+		b.copySearchDocsUid, err = b.db.Prepare(`
+			INSERT INTO msgsText(mboxId, msgId, subject, fromAddr, toAddr, body)
+			SELECT ?, new_msgId, subject, fromAddr, toAddr, body
+			FROM msgsText
+			INNER JOIN (
+				SELECT (
+					SELECT uidnext - 1
+					FROM mboxes
+					WHERE id = ?
+				) + row_number() OVER (ORDER BY msgId) + ? AS new_msgId, msgId, mboxId
+				FROM msgs
+				WHERE mboxId = ?
+				AND msgId BETWEEN ? AND ?
+				ORDER BY msgId
+			) map ON map.msgId = msgsText.msgId
+			AND map.mboxId = msgsText.mboxId`)
+		if err != nil {
+			return wrapErr(err, "copySearchDocsUid prep")
+		}
+	}
+
+	b.reindexMsgs, err = b.db.Prepare(`
+		SELECT msgId, extBodyKey, compressAlgo, ` + strings.Join(sharedBodyCols, ", ") + `
+		FROM msgs
+		WHERE mboxId = ?
+		ORDER BY msgId`)
+	if err != nil {
+		return wrapErr(err, "reindexMsgs prep")
+	}
+	b.userMboxIds, err = b.db.Prepare(`
+		SELECT mboxes.id
+		FROM mboxes
+		INNER JOIN users
+		ON mboxes.uid = users.id
+		WHERE username = ?`)
+	if err != nil {
+		return wrapErr(err, "userMboxIds prep")
+	}
+	return nil
+}
+
+// searchDoc is the indexed content of a message.
+type searchDoc struct {
+	subject string
+	from    string
+	to      string
+	body    string
+}
+
+// extractSearchDoc reads the message and returns its indexed content:
+// Subject, From and To header fields and the text of text/plain and
+// text/html parts that are not attachments.
+//
+// Transfer encodings are decoded. Text is converted to UTF-8 using
+// message.CharsetReader, parts in unknown charsets are indexed as is.
+//
+// If the message is malformed, the content read so far is returned along
+// with the error.
+func extractSearchDoc(r io.Reader) (searchDoc, error) {
+	var doc searchDoc
+
+	ent, err := message.Read(r)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return doc, err
+	}
+
+	hdr := mail.Header{Header: ent.Header}
+	doc.subject, _ = hdr.Subject()
+	doc.from = addressText(hdr, "From")
+	doc.to = addressText(hdr, "To")
+
+	var body strings.Builder
+	err = ent.Walk(func(_ []int, part *message.Entity, err error) error {
+		if err != nil && !message.IsUnknownCharset(err) {
+			// Body can't be decoded.
+			return nil
+		}
+		if body.Len() >= maxIndexedText {
+			return nil
+		}
+		if disp, _, _ := part.Header.ContentDisposition(); disp == "attachment" {
+			return nil
+		}
+
+		mediaType, _, _ := part.Header.ContentType()
+		if mediaType != "" && mediaType != "text/plain" && mediaType != "text/html" {
+			return nil
+		}
+		text, err := ioutil.ReadAll(io.LimitReader(part.Body, int64(maxIndexedText-body.Len())))
+		if err != nil {
+			return err
+		}
+		if mediaType == "text/html" {
+			text = []byte(htmlText(string(text)))
+		}
+		if body.Len() != 0 {
+			body.WriteByte('\n')
+		}
+		body.Write(text)
+		return nil
+	})
+	doc.body = body.String()
+	return doc, err
+}
+
+func addressText(hdr mail.Header, key string) string {
+	addrs, err := hdr.AddressList(key)
+	if err != nil {
+		text, _ := hdr.Text(key)
+		return addressWords(text)
+	}
+	parts := make([]string, 0, 2*len(addrs))
+	for _, addr := range addrs {
+		if addr.Name != "" {
+			parts = append(parts, addr.Name)
+		}
+		parts = append(parts, addr.Address)
+	}
+	return addressWords(strings.Join(parts, " "))
+}
+
+var addressSeparators = strings.NewReplacer("@", " ", ".", " ")
+
+// addressWords splits addresses and domain names in s into words. FTS5 does
+// that itself, but the PostgreSQL parser keeps them as single tokens and
+// searching for a part of an address would not match.
+func addressWords(s string) string {
+	return addressSeparators.Replace(s)
+}
+
+// htmlText returns the text of HTML document s. Tags and contents of script
+// and style elements are removed.
+func htmlText(s string) string {
+	var res strings.Builder
+	for len(s) != 0 {
+		i := strings.IndexByte(s, '<')
+		if i == -1 {
+			res.WriteString(s)
+			break
+		}
+		res.WriteString(s[:i])
+		s = s[i:]
+
+		end := strings.IndexByte(s, '>')
+		if end == -1 {
+			break
+		}
+		tag := strings.ToLower(s[1:end])
+		s = s[end+1:]
+		res.WriteByte(' ')
+
+		if strings.HasPrefix(tag, "/") {
+			continue
+		}
+		nameEnd := strings.IndexAny(tag, " \t\r\n/")
+		if nameEnd == -1 {
+			nameEnd = len(tag)
+		}
+		if name := tag[:nameEnd]; name == "script" || name == "style" {
+			closing := strings.Index(strings.ToLower(s), "</"+name)
+			if closing == -1 {
+				break
+			}
+			s = s[closing:]
+		}
+	}
+	return html.UnescapeString(res.String())
+}
+
+// indexMessage adds the message read from r to the full-text search index.
+func (b *Backend) indexMessage(tx *sql.Tx, mboxId uint64, msgId uint32, r io.Reader) error {
+	doc, err := extractSearchDoc(r)
+	if err != nil {
+		b.Opts.Log.Printf("indexMessage: failed to parse message, indexing partially: %v", err)
+	}
+	_, err = tx.Stmt(b.addSearchDoc).Exec(mboxId, msgId, doc.subject, doc.from, doc.to, doc.body)
+	return err
+}
+
+// searchTerm is a part of SEARCH criteria answered by the full-text search
+// index. Empty column means any indexed column.
+type searchTerm struct {
+	column string
+	value  string
+}
+
+func indexableValue(v string) bool {
+	return strings.IndexFunc(v, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}) != -1
+}
+
+// splitIndexedCriteria returns the top-level criteria that can be answered
+// using the full-text search index and the remaining criteria.
+func splitIndexedCriteria(criteria *imap.SearchCriteria) ([]searchTerm, *imap.SearchCriteria) {
+	var terms []searchTerm
+	rest := *criteria
+	rest.Text = nil
+	rest.Body = nil
+	rest.Header = nil
+
+	for _, v := range criteria.Text {
+		if indexableValue(v) {
+			terms = append(terms, searchTerm{value: v})
+		} else {
+			rest.Text = append(rest.Text, v)
+		}
+	}
+	for _, v := range criteria.Body {
+		if indexableValue(v) {
+			terms = append(terms, searchTerm{column: "body", value: v})
+		} else {
+			rest.Body = append(rest.Body, v)
+		}
+	}
+	for key, values := range criteria.Header {
+		col, ok := searchColumns[key]
+		for _, v := range values {
+			if ok && indexableValue(v) {
+				terms = append(terms, searchTerm{column: col, value: v})
+				continue
+			}
+			if rest.Header == nil {
+				rest.Header = make(map[string][]string)
+			}
+			rest.Header[key] = append(rest.Header[key], v)
+		}
+	}
+
+	return terms, &rest
+}
+
+// searchIndex returns the UIDs of messages in the mailbox matching all terms.
+// Values are matched as phrases of whole words.
+func (m *Mailbox) searchIndex(terms []searchTerm) (map[uint32]struct{}, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	switch m.parent.fts {
+	case ftsSQLite:
+		exprs := make([]string, 0, len(terms))
+		for _, term := range terms {
+			phrase := `"` + strings.Replace(term.value, `"`, `""`, -1) + `"`
+			if term.column != "" {
+				phrase = term.column + ":" + phrase
+			}
+			exprs = append(exprs, phrase)
+		}
+		rows, err = m.parent.searchDocs.Query(strings.Join(exprs, " AND "), m.id, m.id)
+	case ftsPostgres:
+		query := `SELECT msgId FROM msgsText WHERE mboxId = ?`
+		args := []interface{}{m.id}
+		match := func(column, value string) string {
+			if column == "fromAddr" || column == "toAddr" {
+				// Entries added before addresses were split into words
+				// contain them as single tokens.
+				args = append(args, value, addressWords(value))
+				return column + ` @@ (phraseto_tsquery('simple', ?) || phraseto_tsquery('simple', ?))`
+			}
+			args = append(args, value)
+			return column + ` @@ phraseto_tsquery('simple', ?)`
+		}
+		for _, term := range terms {
+			if term.column != "" {
+				query += ` AND ` + match(term.column, term.value)
+				continue
+			}
+			exprs := make([]string, 0, 4)
+			for _, col := range []string{"subject", "fromAddr", "toAddr", "body"} {
+				exprs = append(exprs, match(col, term.value))
+			}
+			query += ` AND (` + strings.Join(exprs, " OR ") + `)`
+		}
+		rows, err = m.parent.db.Query(query, args...)
+	default:
+		return nil, ErrNoSearchIndex
+	}
+	if err != nil {
+		return nil, wrapErr(err, "searchIndex")
+	}
+	defer rows.Close()
+
+	res := make(map[uint32]struct{})
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, wrapErr(err, "searchIndex")
+		}
+		res[uid] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(err, "searchIndex")
+	}
+	return res, nil
+}
+
+// ReindexSearch rebuilds the full-text search index for messages of the
+// user, e.g. for messages added before the index was enabled. If
+// username is empty, messages of all users are reindexed.
+//
+// The number of indexed messages is returned.
+func (b *Backend) ReindexSearch(username string) (int, error) {
+	if b.fts == ftsNone {
+		return 0, ErrNoSearchIndex
+	}
+
+	usernames := []string{normalizeUsername(username)}
+	if username == "" {
+		var err error
+		usernames, err = b.ListUsers()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var indexed int
+	for _, username := range usernames {
+		rows, err := b.userMboxIds.Query(username)
+		if err != nil {
+			return indexed, wrapErr(err, "ReindexSearch")
+		}
+		var mboxIds []uint64
+		for rows.Next() {
+			var id uint64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return indexed, wrapErr(err, "ReindexSearch")
+			}
+			mboxIds = append(mboxIds, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return indexed, wrapErr(err, "ReindexSearch")
+		}
+		// Each user has at least INBOX.
+		if len(mboxIds) == 0 {
+			return indexed, ErrUserDoesntExists
+		}
+
+		for _, mboxId := range mboxIds {
+			count, err := b.reindexMbox(mboxId)
+			indexed += count
+			if err != nil {
+				return indexed, err
+			}
+		}
+	}
+	return indexed, nil
+}
+
+func (b *Backend) reindexMbox(mboxId uint64) (int, error) {
+	type msgRef struct {
+		msgId        uint32
+		extBodyKey   string
+		compressAlgo string
+		rcptHeader   []byte
+		sharedKey    sql.NullString
+	}
+
+	rows, err := b.reindexMsgs.Query(mboxId)
+	if err != nil {
+		return 0, wrapErr(err, "ReindexSearch")
+	}
+	var msgs []msgRef
+	for rows.Next() {
+		var (
+			msg          msgRef
+			compressAlgo sql.NullString
+		)
+		if err := rows.Scan(&msg.msgId, &msg.extBodyKey, &compressAlgo, &msg.rcptHeader, &msg.sharedKey); err != nil {
+			rows.Close()
+			return 0, wrapErr(err, "ReindexSearch")
+		}
+		msg.compressAlgo = compressAlgo.String
+		msgs = append(msgs, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, wrapErr(err, "ReindexSearch")
+	}
+
+	var indexed int
+	for _, msg := range msgs {
+		body, err := b.openBody(true, msg.compressAlgo, msg.extBodyKey, msg.sharedKey, msg.rcptHeader)
+		if err != nil {
+			b.Opts.Log.Printf("ReindexSearch: failed to read body of message %d/%d, skipping: %v", mboxId, msg.msgId, err)
+			continue
+		}
+		err = b.reindexMsg(mboxId, msg.msgId, body)
+		body.Close()
+		if err != nil {
+			return indexed, wrapErr(err, "ReindexSearch")
+		}
+		indexed++
+	}
+	return indexed, nil
+}
+
+func (b *Backend) reindexMsg(mboxId uint64, msgId uint32, body io.Reader) error {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Stmt(b.delSearchDoc).Exec(mboxId, msgId); err != nil {
+		return err
+	}
+	if err := b.indexMessage(tx, mboxId, msgId, body); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,197 @@
+package imapsql
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	_ "github.com/emersion/go-message/charset"
+	msgtextproto "github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+const ftsTestMsg = "From: Alice Example <alice@example.org>\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject: =?utf-8?q?Quarterly_r=C3=A9port?=\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/html; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"<html><style>p { color: red; }</style><p>Caf=E9 meeting on Friday</p></html>\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Disposition: attachment; filename=notes.txt\r\n" +
+	"\r\n" +
+	"secret attachment text\r\n" +
+	"--b--\r\n"
+
+func initTestBackendFTS(t *testing.T) *Backend {
+	driver := TestDB
+	dsn := TestDSN
+
+	if TestDB == "" {
+		driver = "sqlite3"
+		dsn = ":memory:"
+	}
+
+	tempDir, err := ioutil.TempDir("", "go-imap-sql-tests-")
+	assert.NilError(t, err)
+	storeDir := filepath.Join(tempDir, "store")
+	assert.NilError(t, os.MkdirAll(storeDir, os.ModeDir|os.ModePerm))
+
+	b, err := New(driver, dsn, &FSStore{Root: storeDir}, Opts{
+		PRNG:           rand.New(rand.NewSource(0)),
+		Log:            DummyLogger{},
+		TablePrefix:    TestTablePrefix,
+		FullTextSearch: true,
+	})
+	assert.NilError(t, err)
+	if b.fts == ftsNone {
+		cleanBackend(b)
+		t.Skip("full-text search is not supported by the database")
+	}
+	return b
+}
+
+func TestExtractSearchDoc(t *testing.T) {
+	doc, err := extractSearchDoc(strings.NewReader(ftsTestMsg))
+	assert.NilError(t, err)
+	assert.Equal(t, doc.subject, "Quarterly réport")
+	assert.Equal(t, doc.from, "Alice Example alice example org")
+	assert.Equal(t, doc.to, "bob example org")
+	assert.Assert(t, strings.Contains(doc.body, "Café meeting on Friday"), "body: %q", doc.body)
+	assert.Assert(t, !strings.Contains(doc.body, "color"), "style is indexed: %q", doc.body)
+	assert.Assert(t, !strings.Contains(doc.body, "secret"), "attachment is indexed: %q", doc.body)
+}
+
+func TestSplitIndexedCriteria(t *testing.T) {
+	criteria := &imap.SearchCriteria{
+		Text: []string{"hello", "@"},
+		Body: []string{"world"},
+		Header: textproto.MIMEHeader{
+			"Subject":    {"report"},
+			"Message-Id": {"abc"},
+		},
+		WithFlags: []string{imap.SeenFlag},
+	}
+
+	terms, rest := splitIndexedCriteria(criteria)
+	assert.Equal(t, len(terms), 3)
+	assert.DeepEqual(t, rest.Text, []string{"@"})
+	assert.Equal(t, len(rest.Body), 0)
+	assert.DeepEqual(t, rest.Header, textproto.MIMEHeader{"Message-Id": {"abc"}})
+	assert.DeepEqual(t, rest.WithFlags, []string{imap.SeenFlag})
+}
+
+func TestFullTextSearch(t *testing.T) {
+	b := initTestBackendFTS(t)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox("Archive"))
+	_, mbox, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+
+	assert.NilError(t, usr.CreateMessage("INBOX", nil, time.Now(), strings.NewReader(testMsg), mbox))
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name(), msgtextproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(ftsTestMsg)))
+	assert.NilError(t, delivery.Commit())
+	assert.NilError(t, mbox.Poll(true))
+
+	search := func(mbox *Mailbox, criteria *imap.SearchCriteria) []uint32 {
+		t.Helper()
+		res, err := mbox.SearchMessages(true, criteria)
+		assert.NilError(t, err)
+		return res
+	}
+
+	inbox := mbox.(*Mailbox)
+	assert.DeepEqual(t, search(inbox, &imap.SearchCriteria{Body: []string{"café"}}), []uint32{2})
+	assert.DeepEqual(t, search(inbox, &imap.SearchCriteria{Text: []string{"meeting on friday"}}), []uint32{2})
+	assert.DeepEqual(t, search(inbox, &imap.SearchCriteria{
+		Header: map[string][]string{"Subject": {"RÉPORT"}, "From": {"alice"}},
+	}), []uint32{2})
+	assert.Equal(t, len(search(inbox, &imap.SearchCriteria{Body: []string{"secret"}})), 0)
+	assert.Equal(t, len(search(inbox, &imap.SearchCriteria{Body: []string{"friday"}, WithFlags: []string{imap.SeenFlag}})), 0)
+
+	seq, _ := imap.ParseSeqSet("2")
+	assert.NilError(t, inbox.CopyMessages(true, seq, "Archive"))
+	_, archive, err := usr.GetMailbox("Archive", false, &noopConn{})
+	assert.NilError(t, err)
+	defer archive.Close()
+	assert.DeepEqual(t, search(archive.(*Mailbox), &imap.SearchCriteria{Body: []string{"friday"}}), []uint32{1})
+
+	// Index entries are removed together with messages.
+	assert.NilError(t, inbox.DelMessages(true, seq))
+	assert.Equal(t, len(search(inbox, &imap.SearchCriteria{Body: []string{"friday"}})), 0)
+	var count int
+	assert.NilError(t, b.db.QueryRow(`SELECT COUNT(*) FROM msgsText`).Scan(&count))
+	assert.Equal(t, count, 2)
+
+	// Messages missing from the index are added back.
+	_, err = b.db.Exec(`DELETE FROM msgsText`)
+	assert.NilError(t, err)
+	indexed, err := b.ReindexSearch(t.Name())
+	assert.NilError(t, err)
+	assert.Equal(t, indexed, 2)
+	assert.DeepEqual(t, search(archive.(*Mailbox), &imap.SearchCriteria{Body: []string{"friday"}}), []uint32{1})
+	indexed, err = b.ReindexSearch("")
+	assert.NilError(t, err)
+	assert.Equal(t, indexed, 2)
+
+	_, err = b.ReindexSearch("nobody")
+	assert.Equal(t, err, ErrUserDoesntExists)
+}
+
+// TestFullTextSearch_Addresses checks that parts of addresses can be searched
+// for. Run it with TEST_DB=postgres, PostgreSQL does not split addresses
+// into words unlike FTS5.
+func TestFullTextSearch_Addresses(t *testing.T) {
+	b := initTestBackendFTS(t)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mbox, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name(), msgtextproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(ftsTestMsg)))
+	assert.NilError(t, delivery.Commit())
+	assert.NilError(t, mbox.Poll(true))
+
+	for _, c := range []struct {
+		key, value string
+		found      bool
+	}{
+		{"From", "alice@example.org", true},
+		{"From", "example.org", true},
+		{"From", "Alice Example", true},
+		{"To", "bob", true},
+		{"To", "bob@example.org", true},
+		{"To", "alice", false},
+	} {
+		res, err := mbox.SearchMessages(true, &imap.SearchCriteria{
+			Header: map[string][]string{c.key: {c.value}},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, len(res) == 1, c.found, "%s %s: %v", c.key, c.value, res)
+	}
+	res, err := mbox.SearchMessages(true, &imap.SearchCriteria{Text: []string{"bob@example.org"}})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []uint32{1})
+}
@@ -47,6 +47,7 @@ func initTestBackendLZ4() backendtests.Backend {
 		CompressAlgo:    "lz4",
 		PRNG:            prng,
 		Log:             DummyLogger{},
+		TablePrefix:     TestTablePrefix,
 	})
 	if err != nil {
 		panic(err)
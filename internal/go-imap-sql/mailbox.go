@@ -29,6 +29,11 @@ type Mailbox struct {
 	id       uint64
 	readOnly bool
 
+	// viewer is the user that opened the mailbox shared with them by user,
+	// nil for own mailboxes. rights are the ACL rights of viewer.
+	viewer *User
+	rights string
+
 	conn   backend.Conn
 	handle *mess.MailboxHandle
 }
@@ -138,13 +143,22 @@ func (m *Mailbox) initSelected(unsetRecent bool) (uids []uint32, recent *imap.Se
 	}
 
 	var unseenUid uint32
-	err = tx.Stmt(m.parent.firstUnseenUid).QueryRow(m.id).Scan(&unseenUid)
+	if m.privateSeen() {
+		err = tx.Stmt(m.parent.privateFirstUnseenUid).QueryRow(m.id, m.viewer.id).Scan(&unseenUid)
+	} else {
+		err = tx.Stmt(m.parent.firstUnseenUid).QueryRow(m.id).Scan(&unseenUid)
+	}
 	if err != nil && err != sql.ErrNoRows {
 		m.parent.logMboxErr(m, err, "initSelected (first unseen)")
 		return nil, nil, nil, wrapErrf(err, "initSelected %s", m.name)
 	}
 
-	row := tx.Stmt(m.parent.unseenCount).QueryRow(m.id)
+	var row *sql.Row
+	if m.privateSeen() {
+		row = tx.Stmt(m.parent.privateUnseenCount).QueryRow(m.id, m.viewer.id)
+	} else {
+		row = tx.Stmt(m.parent.unseenCount).QueryRow(m.id)
+	}
 	if err := row.Scan(&status.Unseen); err != nil {
 		if err != sql.ErrNoRows {
 			m.parent.logMboxErr(m, err, "initSelected (unseen count)")
@@ -286,15 +300,6 @@ func (m *Mailbox) SetMessageLimit(val *uint32) error {
 }
 
 func extractCachedData(hdr textproto.Header, bufferedBody *bufio.Reader) (bodyStructBlob, cachedHeadersBlob []byte, err error) {
-	hdrs := make(map[string][]string, len(cachedHeaderFields))
-	for field := hdr.Fields(); field.Next(); {
-		cKey := nettextproto.CanonicalMIMEHeaderKey(field.Key())
-		if _, ok := cachedHeaderFields[cKey]; !ok {
-			continue
-		}
-		hdrs[cKey] = append(hdrs[cKey], field.Value())
-	}
-
 	bodyStruct, err := backendutil.FetchBodyStructure(hdr, bufferedBody, true)
 	if err != nil {
 		return nil, nil, err
@@ -306,11 +311,26 @@ func extractCachedData(hdr textproto.Header, bufferedBody *bufio.Reader) (bodySt
 	jw.DumpTo(buf)
 	bodyStructBlob = buf.Bytes()
 
-	buf = bytes.NewBuffer(make([]byte, 0, 2048))
+	cachedHeadersBlob = cacheHeader(hdr)
+	return
+}
+
+// cacheHeader returns the serialized cachedHeaderFields of hdr.
+func cacheHeader(hdr textproto.Header) []byte {
+	hdrs := make(map[string][]string, len(cachedHeaderFields))
+	for field := hdr.Fields(); field.Next(); {
+		cKey := nettextproto.CanonicalMIMEHeaderKey(field.Key())
+		if _, ok := cachedHeaderFields[cKey]; !ok {
+			continue
+		}
+		hdrs[cKey] = append(hdrs[cKey], field.Value())
+	}
+
+	jw := jwriter.Writer{}
+	buf := bytes.NewBuffer(make([]byte, 0, 2048))
 	easyjsonMarshalCachedHeader(&jw, hdrs)
 	jw.DumpTo(buf)
-	cachedHeadersBlob = buf.Bytes()
-	return
+	return buf.Bytes()
 }
 
 func (b *Backend) processBody(literal imap.Literal) (bodyStruct, cachedHeader []byte, extBodyKey string, err error) {
@@ -383,6 +403,9 @@ func (m *Mailbox) checkAppendLimit(length int) error {
 }
 
 func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Literal) error {
+	if err := m.checkRights("i"); err != nil {
+		return err
+	}
 	if err := m.checkAppendLimit(fullBody.Len()); err != nil {
 		m.parent.logMboxErr(m, errors.New("appendlimit hit"), "CreateMessage (checkAppendLimit)")
 		return err
@@ -392,13 +415,20 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 		date = time.Now()
 	}
 
+	// Flags the user has no rights for are ignored, as specified in RFC 4314.
+	flags = m.permittedFlags(flags)
 	newFlags := make([]string, 0, len(flags))
 	haveSeen := uint8(0) // it needs to be stored in SQL, hence integer
+	privateSeen := false
 	for _, flag := range flags {
 		if flag == imap.RecentFlag {
 			continue
 		}
 		if flag == imap.SeenFlag {
+			if m.privateSeen() {
+				privateSeen = true
+				continue
+			}
 			haveSeen = 1
 		}
 		newFlags = append(newFlags, flag)
@@ -444,17 +474,14 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 		return wrapErr(err, "CreateMessage (addExtKey)")
 	}
 
-	recent := m.parent.mngr.NewMessage(m.id, msgId)
-	recentI := 0
-	if recent {
-		recentI = 1
-	}
+	// \Recent is set after commit, once it is known whether a session
+	// claimed it, see below.
 	_, err = tx.Stmt(m.parent.addMsg).Exec(
 		m.id, msgId, date.Unix(),
 		bodyLen,
 		bodyStruct, cachedHdr, extBodyKey,
 		haveSeen, m.parent.Opts.CompressAlgo,
-		recentI,
+		0,
 	)
 	if err != nil {
 		if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
@@ -463,6 +490,27 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 		m.parent.logMboxErr(m, err, "CreateMessage (addMsg)")
 		return wrapErr(err, "CreateMessage (addMsg)")
 	}
+	if err := m.parent.changeUsage(tx, m.user.id, usage{bytes: int64(bodyLen), msgs: 1}); err != nil {
+		if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
+			m.parent.logMboxErr(m, err, "delete extBodyKey)")
+		}
+		m.parent.logMboxErr(m, err, "CreateMessage (changeUsage)")
+		return wrapErr(err, "CreateMessage (changeUsage)")
+	}
+	if m.parent.fts != ftsNone {
+		// The literal is consumed already, index the stored body.
+		body, err := m.openBody(true, m.parent.Opts.CompressAlgo, extBodyKey, sql.NullString{}, nil)
+		if err != nil {
+			m.parent.logMboxErr(m, err, "CreateMessage (indexMessage)")
+			return wrapErr(err, "CreateMessage (indexMessage)")
+		}
+		err = m.parent.indexMessage(tx, m.id, msgId, body)
+		body.Close()
+		if err != nil {
+			m.parent.logMboxErr(m, err, "CreateMessage (indexMessage)")
+			return wrapErr(err, "CreateMessage (indexMessage)")
+		}
+	}
 
 	if len(flags) != 0 {
 		params := m.makeFlagsAddStmtArgs(flags, msgId, msgId)
@@ -474,6 +522,15 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 			return wrapErr(err, "CreateMessage (flags)")
 		}
 	}
+	if privateSeen {
+		if _, err = tx.Stmt(m.parent.addPrivateSeenUid).Exec(m.viewer.id, m.id, msgId, msgId); err != nil {
+			if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
+				m.parent.logMboxErr(m, err, "delete extBodyKey)")
+			}
+			m.parent.logMboxErr(m, err, "CreateMessage (private seen)")
+			return wrapErr(err, "CreateMessage (private seen)")
+		}
+	}
 
 	if err = tx.Commit(); err != nil {
 		if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
@@ -483,10 +540,21 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 		return wrapErr(err, "CreateMessage (tx commit)")
 	}
 
+	// Notify only after commit so sessions (including ones on other nodes)
+	// never see a UID they are unable to fetch yet.
+	if m.parent.mngr.NewMessage(m.id, msgId) {
+		if _, err := m.parent.markRecent.Exec(m.id, msgId, msgId); err != nil {
+			m.parent.logMboxErr(m, err, "CreateMessage (persistRecent)")
+		}
+	}
+
 	return nil
 }
 
 func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if err := m.checkRights("te"); err != nil {
+		return err
+	}
 	defer m.handle.Sync(true)
 
 	tx, err := m.parent.db.Begin(false)
@@ -513,10 +581,11 @@ func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error
 	// have to use INSERT + DELETE. This is still better than complete message
 	// copy and removal logic, though.
 
-	var destID uint64
-	if err := tx.Stmt(m.parent.mboxId).QueryRow(m.user.id, dest).Scan(&destID); err != nil {
-		if err == sql.ErrNoRows {
-			return backend.ErrNoSuchMailbox
+	destID, err := m.destMailbox(tx, dest)
+	if err != nil {
+		switch err {
+		case backend.ErrNoSuchMailbox, ErrPermissionDenied, ErrCrossAccountCopy:
+			return err
 		}
 		m.parent.logMboxErr(m, err, "MoveMessages (target lookup)", uid, seqset, dest)
 		return wrapErr(err, "MoveMessages (target lookup)")
@@ -534,6 +603,10 @@ func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error
 			m.parent.logMboxErr(m, err, "MoveMessages (copy msg flags)", uid, seqset, dest)
 			return wrapErr(err, "MoveMessages (copy msg flags)")
 		}
+		if _, err := tx.Stmt(m.parent.copyPrivateSeenUid).Exec(destID, destID, copiedCount, m.id, seq.Start, seq.Stop); err != nil {
+			m.parent.logMboxErr(m, err, "MoveMessages (copy private seen)", uid, seqset, dest)
+			return wrapErr(err, "MoveMessages (copy private seen)")
+		}
 		affected, err := stats.RowsAffected()
 		if err != nil {
 			m.parent.logMboxErr(m, err, "MoveMessages (rows affected)", uid, seqset, dest)
@@ -616,30 +689,35 @@ func (m *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error
 
 	firstCopy, lastCopy, destID, err := m.copyMessages(tx, seqset, dest)
 	if err != nil {
-		if err == backend.ErrNoSuchMailbox {
+		switch err {
+		case backend.ErrNoSuchMailbox, ErrPermissionDenied, ErrCrossAccountCopy:
 			return err
 		}
 		m.parent.logMboxErr(m, err, "CopyMessages", uid, seqset, dest)
 		return wrapErr(err, "CopyMessages")
 	}
 
+	if err := tx.Commit(); err != nil {
+		m.parent.logMboxErr(m, err, "CopyMessages (tx commit)", uid, seqset, dest)
+		return wrapErr(err, "CopyMessages")
+	}
+
+	// See CreateMessage.
 	persistRecent := m.parent.mngr.NewMessages(destID, imap.SeqSet{Set: []imap.Seq{{Start: firstCopy, Stop: lastCopy}}})
 	if persistRecent {
-		if _, err := tx.Stmt(m.parent.addRecentToLast).Exec(destID, destID, lastCopy-firstCopy+1); err != nil {
+		if _, err := m.parent.markRecent.Exec(destID, firstCopy, lastCopy); err != nil {
 			m.parent.logMboxErr(m, err, "CopyMessages (persistRecent)", uid, seqset, dest)
-			return wrapErr(err, "CopyMessages")
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		m.parent.logMboxErr(m, err, "CopyMessages (tx commit)", uid, seqset, dest)
-		return wrapErr(err, "CopyMessages")
-	}
-
 	return nil
 }
 
 func (m *Mailbox) DelMessages(uid bool, seqset *imap.SeqSet) error {
+	if err := m.checkRights("te"); err != nil {
+		return err
+	}
+
 	tx, err := m.parent.db.BeginLevel(sql.LevelRepeatableRead, false)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "DelMessages (tx start)", uid, seqset)
@@ -652,7 +730,7 @@ func (m *Mailbox) DelMessages(uid bool, seqset *imap.SeqSet) error {
 		return err
 	}
 
-	deleted, err := m.delMessages(tx, seqset)
+	deleted, keys, err := m.delMessages(tx, seqset)
 	if err != nil {
 		if err == backend.ErrNoSuchMailbox {
 			return err
@@ -666,73 +744,97 @@ func (m *Mailbox) DelMessages(uid bool, seqset *imap.SeqSet) error {
 		return wrapErr(err, "DelMessages")
 	}
 
+	m.parent.deleteBodies(keys)
 	m.handle.RemovedSet(deleted)
 
 	return nil
 }
 
-func (m *Mailbox) delMessages(tx *sql.Tx, seqset *imap.SeqSet) (imap.SeqSet, error) {
+func (m *Mailbox) delMessages(tx *sql.Tx, seqset *imap.SeqSet) (imap.SeqSet, []string, error) {
 	for _, seq := range seqset.Set {
 		m.parent.Opts.Log.Println("delMessages: marking SQL window range", seq.Start, seq.Stop, "for deletion")
 		_, err := tx.Stmt(m.parent.markUid).Exec(m.id, seq.Start, seq.Stop)
 		if err != nil {
-			return imap.SeqSet{}, err
+			return imap.SeqSet{}, nil, err
 		}
 	}
 
 	var (
-		deletedExtKeys []string
-		deletedUids    imap.SeqSet
-		deletedCount   uint32
+		deletedUids  imap.SeqSet
+		deletedCount uint32
 	)
 
 	rows, err := tx.Stmt(m.parent.markedUids).Query(m.id)
 	if err != nil {
-		return imap.SeqSet{}, err
+		return imap.SeqSet{}, nil, err
 	}
 	for rows.Next() {
 		var uid uint32
 		var extKey sql.NullString
 		if err := rows.Scan(&uid, &extKey); err != nil {
-			return imap.SeqSet{}, err
+			return imap.SeqSet{}, nil, err
 		}
 		m.parent.Opts.Log.Println("delMessages:", uid, extKey, "is marked")
 
-		deletedExtKeys = append(deletedExtKeys, extKey.String)
 		deletedUids.AddNum(uid)
 		deletedCount++
 	}
 	if err := rows.Err(); err != nil {
-		return imap.SeqSet{}, err
+		return imap.SeqSet{}, nil, err
 	}
 
-	m.parent.Opts.Log.Println("delMessages: deleting storage keys: ", deletedExtKeys)
-	if err := m.parent.extStore.Delete(deletedExtKeys); err != nil {
-		return imap.SeqSet{}, err
+	deletedUsage, err := queryUsage(tx, m.parent.markedUsage, m.id)
+	if err != nil {
+		return imap.SeqSet{}, nil, err
+	}
+
+	// Bodies can be shared with copies of the messages, only the ones that
+	// are no longer referenced are deleted.
+	if _, err := tx.Stmt(m.parent.decreaseRefForMarked).Exec(m.user.id, m.id); err != nil {
+		return imap.SeqSet{}, nil, err
+	}
+	keys, err := m.parent.queryKeys(tx, m.parent.zeroRefMarked, m.user.id, m.id)
+	if err != nil {
+		return imap.SeqSet{}, nil, err
 	}
+	m.parent.Opts.Log.Println("delMessages: storage keys to delete: ", keys)
 
 	if _, err := tx.Stmt(m.parent.delMarked).Exec(); err != nil {
-		return imap.SeqSet{}, err
+		return imap.SeqSet{}, nil, err
+	}
+	unused, err := m.parent.deleteZeroRefs(tx, m.user.id)
+	if err != nil {
+		return imap.SeqSet{}, nil, err
+	}
+	keys = append(keys, unused...)
+	if err := m.parent.changeUsage(tx, m.user.id, usage{bytes: -deletedUsage.bytes, msgs: -deletedUsage.msgs}); err != nil {
+		return imap.SeqSet{}, nil, err
 	}
 
 	m.parent.Opts.Log.Println("delMessages: deleted", deletedCount, "messages")
 	_, err = tx.Stmt(m.parent.decreaseMsgCount).Exec(deletedCount, m.id)
-	return deletedUids, err
+	return deletedUids, keys, err
 }
 
 func (m *Mailbox) copyMessages(tx *sql.Tx, seqset *imap.SeqSet, dest string) (firstCopy, lastCopy uint32, destID uint64, err error) {
-	row := tx.Stmt(m.parent.mboxId).QueryRow(m.user.id, dest)
-	if err := row.Scan(&destID); err != nil {
-		if err == sql.ErrNoRows {
-			return 0, 0, 0, backend.ErrNoSuchMailbox
-		}
+	destID, err = m.destMailbox(tx, dest)
+	if err != nil {
+		return 0, 0, 0, err
 	}
 
 	m.parent.Opts.Log.Debugln("copyMessages: resolved target mailbox name to", destID)
 
 	srcId := m.id
 	var totalCopied uint32
+	var copiedUsage usage
 	for _, seq := range seqset.Set {
+		rangeUsage, err := queryUsage(tx, m.parent.rangeUsageUid, srcId, seq.Start, seq.Stop)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		copiedUsage.bytes += rangeUsage.bytes
+		copiedUsage.msgs += rangeUsage.msgs
+
 		stats, err := tx.Stmt(m.parent.copyMsgsUid).Exec(destID, destID, totalCopied, srcId, seq.Start, seq.Stop)
 		if err != nil {
 			return 0, 0, 0, err
@@ -740,6 +842,14 @@ func (m *Mailbox) copyMessages(tx *sql.Tx, seqset *imap.SeqSet, dest string) (fi
 		if _, err := tx.Stmt(m.parent.copyMsgFlagsUid).Exec(destID, destID, totalCopied, srcId, seq.Start, seq.Stop); err != nil {
 			return 0, 0, 0, err
 		}
+		if _, err := tx.Stmt(m.parent.copyPrivateSeenUid).Exec(destID, destID, totalCopied, srcId, seq.Start, seq.Stop); err != nil {
+			return 0, 0, 0, err
+		}
+		if m.parent.fts != ftsNone {
+			if _, err := tx.Stmt(m.parent.copySearchDocsUid).Exec(destID, destID, totalCopied, srcId, seq.Start, seq.Stop); err != nil {
+				return 0, 0, 0, err
+			}
+		}
 
 		affected, err := stats.RowsAffected()
 		if err != nil {
@@ -761,11 +871,17 @@ func (m *Mailbox) copyMessages(tx *sql.Tx, seqset *imap.SeqSet, dest string) (fi
 	if _, err := tx.Stmt(m.parent.increaseMsgCount).Exec(totalCopied, totalCopied, destID); err != nil {
 		return 0, 0, 0, err
 	}
+	if err := m.parent.changeUsage(tx, m.user.id, copiedUsage); err != nil {
+		return 0, 0, 0, err
+	}
 
 	return oldUidNext, oldUidNext + totalCopied - 1, destID, nil
 }
 
 func (m *Mailbox) Expunge() error {
+	if err := m.checkRights("e"); err != nil {
+		return err
+	}
 	defer m.handle.Sync(true)
 
 	tx, err := m.parent.db.Begin(false)
@@ -802,10 +918,25 @@ func (m *Mailbox) Expunge() error {
 
 	rows.Close()
 
-	keys, err := m.expungeExternal(tx)
+	expungedUsage, err := queryUsage(tx, m.parent.deletedUsage, m.id, m.id)
 	if err != nil {
-		m.parent.logMboxErr(m, err, "Expunge (external prepare)")
-		return err
+		m.parent.logMboxErr(m, err, "Expunge (deletedUsage)")
+		return wrapErr(err, "Expunge")
+	}
+
+	var keys []string
+	if m.parent.Opts.SoftDelete {
+		// Soft-deleted messages keep references to their bodies.
+		if _, err := tx.Stmt(m.parent.softDeleteMsgs).Exec(time.Now().Unix(), m.id, m.id); err != nil {
+			m.parent.logMboxErr(m, err, "Expunge (softDeleteMsgs)")
+			return wrapErr(err, "Expunge")
+		}
+	} else {
+		keys, err = m.expungeExternal(tx)
+		if err != nil {
+			m.parent.logMboxErr(m, err, "Expunge (external prepare)")
+			return err
+		}
 	}
 
 	_, err = tx.Stmt(m.parent.expungeMbox).Exec(m.id, m.id)
@@ -819,21 +950,24 @@ func (m *Mailbox) Expunge() error {
 		m.parent.logMboxErr(m, err, "Expunge (decrease counters)", m.id, expungedCount)
 		return wrapErr(err, "Expunge (decrease counters)")
 	}
+	if err := m.parent.changeUsage(tx, m.user.id, usage{bytes: -expungedUsage.bytes, msgs: -expungedUsage.msgs}); err != nil {
+		m.parent.logMboxErr(m, err, "Expunge (changeUsage)")
+		return wrapErr(err, "Expunge (changeUsage)")
+	}
 
-	if _, err := tx.Stmt(m.parent.deleteZeroRef).Exec(m.user.id); err != nil {
+	unused, err := m.parent.deleteZeroRefs(tx, m.user.id)
+	if err != nil {
 		m.parent.logMboxErr(m, err, "Expunge (deleteZeroRef)")
 		return wrapErr(err, "Expunge")
 	}
+	keys = append(keys, unused...)
 
 	if err := tx.Commit(); err != nil {
 		m.parent.logMboxErr(m, err, "Expunge (tx commit)")
 		return wrapErr(err, "Expunge")
 	}
 
-	if err := m.parent.extStore.Delete(keys); err != nil {
-		return wrapErr(err, "Expunge (external)")
-	}
-
+	m.parent.deleteBodies(keys)
 	m.handle.RemovedSet(uids)
 
 	return nil
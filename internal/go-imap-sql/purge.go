@@ -0,0 +1,115 @@
+package imapsql
+
+import (
+	"database/sql"
+
+	"github.com/emersion/go-imap"
+)
+
+func (b *Backend) prepareUserPurgeStmts() error {
+	var err error
+	b.userMsgsLimit, err = b.db.Prepare(`
+		SELECT mboxId, msgId
+		FROM msgs
+		WHERE mboxId IN (SELECT id FROM mboxes WHERE uid = ?)
+		ORDER BY mboxId, msgId
+		LIMIT ?`)
+	if err != nil {
+		return wrapErr(err, "userMsgsLimit prep")
+	}
+	b.deletedMsgsUserLimit, err = b.db.Prepare(`
+		SELECT deletedMsgs.mboxId, deletedMsgs.msgId, extKeys.uid
+		FROM deletedMsgs
+		LEFT JOIN extKeys
+		ON extKeys.id = deletedMsgs.extBodyKey
+		WHERE deletedMsgs.mboxId IN (SELECT id FROM mboxes WHERE uid = ?)
+		LIMIT ?`)
+	if err != nil {
+		return wrapErr(err, "deletedMsgsUserLimit prep")
+	}
+	return nil
+}
+
+// PurgeUserMessages permanently removes at most limit messages of the user,
+// soft-deleted ones included. Bodies are removed after the transaction
+// commits.
+//
+// It should be called repeatedly until it removes less than limit messages,
+// then DeleteUser removes the rest of the account. Unlike DeleteUser alone,
+// this keeps transactions short for large accounts. Open sessions of the user
+// are not notified about removed messages.
+//
+// The numbers of removed messages are returned, msgs for the msgs table and
+// deleted for soft-deleted messages in the deletedMsgs table.
+func (b *Backend) PurgeUserMessages(username string, limit int) (msgs, deleted int, err error) {
+	username = normalizeUsername(username)
+	uid, inboxId, err := b.getUserMeta(nil, username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, ErrUserDoesntExists
+		}
+		return 0, 0, wrapErr(err, "PurgeUserMessages")
+	}
+
+	deleted, err = b.purgeBatch(b.deletedMsgsUserLimit, uid, limit)
+	if err != nil {
+		return 0, 0, wrapErr(err, "PurgeUserMessages")
+	}
+	if deleted >= limit {
+		return 0, deleted, nil
+	}
+
+	tx, err := b.db.BeginLevel(sql.LevelRepeatableRead, false)
+	if err != nil {
+		return 0, deleted, wrapErr(err, "PurgeUserMessages")
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var (
+		mboxIds []uint64
+		uids    = make(map[uint64]*imap.SeqSet)
+	)
+	rows, err := tx.Stmt(b.userMsgsLimit).Query(uid, limit-deleted)
+	if err != nil {
+		return 0, deleted, wrapErr(err, "PurgeUserMessages")
+	}
+	for rows.Next() {
+		var (
+			mboxId uint64
+			msgId  uint32
+		)
+		if err := rows.Scan(&mboxId, &msgId); err != nil {
+			rows.Close()
+			return 0, deleted, wrapErr(err, "PurgeUserMessages")
+		}
+		set, ok := uids[mboxId]
+		if !ok {
+			set = &imap.SeqSet{}
+			uids[mboxId] = set
+			mboxIds = append(mboxIds, mboxId)
+		}
+		set.AddNum(msgId)
+		msgs++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, deleted, wrapErr(err, "PurgeUserMessages")
+	}
+
+	user := User{id: uid, username: username, parent: b, inboxId: inboxId}
+	var keys []string
+	for _, mboxId := range mboxIds {
+		mbox := Mailbox{user: user, parent: b, id: mboxId}
+		_, mboxKeys, err := mbox.delMessages(tx, uids[mboxId])
+		if err != nil {
+			return 0, deleted, wrapErr(err, "PurgeUserMessages")
+		}
+		keys = append(keys, mboxKeys...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, deleted, wrapErr(err, "PurgeUserMessages")
+	}
+	b.deleteBodies(keys)
+	return msgs, deleted, nil
+}
@@ -0,0 +1,57 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestPurgeUserMessages(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	b.Opts.SoftDelete = true
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox("Archive"))
+
+	for i := 0; i < 3; i++ {
+		assert.NilError(t, usr.CreateMessage("INBOX", nil, time.Now(), strings.NewReader(testMsg), nil))
+		assert.NilError(t, usr.CreateMessage("Archive", nil, time.Now(), strings.NewReader(testMsg), nil))
+	}
+	_, mbox, err := usr.GetMailbox("Archive", false, &noopConn{})
+	assert.NilError(t, err)
+	seq, _ := imap.ParseSeqSet("1")
+	assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+	assert.NilError(t, mbox.Expunge())
+	assert.NilError(t, mbox.Close())
+	assert.Assert(t, checkKeysCount(b, 6))
+
+	var batches []int
+	totalDeleted := 0
+	for {
+		msgs, deleted, err := b.PurgeUserMessages(t.Name(), 2)
+		assert.NilError(t, err)
+		batches = append(batches, msgs+deleted)
+		totalDeleted += deleted
+		if msgs+deleted < 2 {
+			break
+		}
+	}
+	assert.DeepEqual(t, batches, []int{2, 2, 2, 0})
+	assert.Equal(t, totalDeleted, 1)
+	assert.Assert(t, checkKeysCount(b, 0))
+	checkUsage(t, b, t.Name(), 0, 0)
+
+	status, err := usr.Status("Archive", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(status.Messages, uint32(0)))
+
+	assert.NilError(t, b.DeleteUser(t.Name()))
+	_, _, err = b.PurgeUserMessages(t.Name(), 2)
+	assert.Equal(t, err, ErrUserDoesntExists)
+}
@@ -63,12 +63,45 @@ func (b *Backend) upgradeSchema(currentVer int) error {
 	//}
 
 	if currentVer == 5 {
-		_, err = b.DB.Exec(`ALTER TABLE msgs ADD COLUMN recent INTEGER NOT NULL DEFAULT 1`)
+		_, err = b.db.Exec(`ALTER TABLE msgs ADD COLUMN recent INTEGER NOT NULL DEFAULT 1`)
 		if err != nil {
 			return wrapErr(err, "5->6 upgrade")
 		}
 		currentVer = 6
 	}
+	if currentVer == 6 {
+		_, err = b.db.Exec(`ALTER TABLE users ADD COLUMN usedBytes BIGINT NOT NULL DEFAULT 0`)
+		if err != nil {
+			return wrapErr(err, "6->7 upgrade")
+		}
+		_, err = b.db.Exec(`ALTER TABLE users ADD COLUMN usedMsgs BIGINT NOT NULL DEFAULT 0`)
+		if err != nil {
+			return wrapErr(err, "6->7 upgrade")
+		}
+		if _, err = b.db.Exec(recalcUsageQuery); err != nil {
+			return wrapErr(err, "6->7 upgrade")
+		}
+		currentVer = 7
+	}
+	if currentVer == 7 {
+		_, err = b.db.Exec(`ALTER TABLE extKeys ADD COLUMN sharedKey VARCHAR(255) DEFAULT NULL`)
+		if err != nil {
+			return wrapErr(err, "7->8 upgrade")
+		}
+		_, err = b.db.Exec(`ALTER TABLE extKeys ADD COLUMN rcptHeader LONGTEXT`)
+		if err != nil {
+			return wrapErr(err, "7->8 upgrade")
+		}
+		currentVer = 8
+	}
+	if currentVer == 8 {
+		// deletedMsgs table is created by initSchema.
+		currentVer = 9
+	}
+	if currentVer == 9 {
+		// acl and privateSeen tables are created by initSchema.
+		currentVer = 10
+	}
 
 	if currentVer != SchemaVersion {
 		return errors.New("database schema version is too old and can't be upgraded using this go-imap-sql version")
@@ -12,7 +12,10 @@ import (
 )
 
 func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
-	if searchOnlyWithFlags(criteria) {
+	// Flags are matched in SQL using the flags table that contains \Seen of
+	// the owner.
+	privateSeen := m.privateSeen() && searchUsesSeen(criteria)
+	if searchOnlyWithFlags(criteria) && !privateSeen {
 		if criteria.Not == nil && criteria.Or == nil && criteria.WithFlags == nil && criteria.WithoutFlags == nil {
 			return m.allSearch(uid)
 		}
@@ -22,6 +25,33 @@ func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uin
 
 	m.handle.ResolveCriteria(criteria)
 
+	// If some criteria are answered by the full-text search index, only
+	// the matching messages are checked against the rest.
+	var indexed map[uint32]struct{}
+	if m.parent.fts != ftsNone {
+		terms, rest := splitIndexedCriteria(criteria)
+		if len(terms) != 0 {
+			var err error
+			indexed, err = m.searchIndex(terms)
+			if err != nil {
+				return nil, err
+			}
+			if len(indexed) == 0 {
+				return nil, nil
+			}
+			criteria = rest
+		}
+	}
+
+	var seen map[uint32]struct{}
+	if privateSeen {
+		var err error
+		seen, err = m.allSeenUids()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	needBody := searchNeedsBody(criteria)
 	rows, err := m.parent.searchFetchNoSeq.Query(m.id)
 	if err != nil {
@@ -31,7 +61,7 @@ func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uin
 
 	var res []uint32
 	for rows.Next() {
-		id, err := m.searchMatches(uid, needBody, rows, criteria)
+		id, err := m.searchMatches(uid, needBody, indexed, seen, rows, criteria)
 		if err != nil {
 			return nil, err
 		}
@@ -46,7 +76,10 @@ func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uin
 	return res, nil
 }
 
-func (m *Mailbox) searchMatches(uid, needBody bool, rows *sql.Rows, criteria *imap.SearchCriteria) (uint32, error) {
+// searchMatches checks the message in the current row against criteria. If
+// indexed is not nil, messages not in it are skipped. If seen is not nil, it
+// replaces \Seen flag stored in the flags table.
+func (m *Mailbox) searchMatches(uid, needBody bool, indexed, seen map[uint32]struct{}, rows *sql.Rows, criteria *imap.SearchCriteria) (uint32, error) {
 	var (
 		msgId        uint32
 		dateUnix     int64
@@ -54,21 +87,31 @@ func (m *Mailbox) searchMatches(uid, needBody bool, rows *sql.Rows, criteria *im
 		flagStr      string
 		extBodyKey   string
 		compressAlgo string
+		rcptHeader   []byte
+		sharedKey    sql.NullString
 	)
 
-	if err := rows.Scan(&msgId, &dateUnix, &bodyLen, &extBodyKey, &compressAlgo, &flagStr); err != nil {
+	if err := rows.Scan(&msgId, &dateUnix, &bodyLen, &extBodyKey, &compressAlgo, &rcptHeader, &sharedKey, &flagStr); err != nil {
 		return 0, err
 	}
+	if indexed != nil {
+		if _, ok := indexed[msgId]; !ok {
+			return 0, nil
+		}
+	}
 
 	flags := strings.Split(flagStr, flagsSep)
 	if len(flags) == 1 && flags[0] == "" {
 		flags = nil
 	}
+	if seen != nil {
+		flags = replaceSeen(flags, msgId, seen)
+	}
 
 	var ent *message.Entity
 	var err error
 	if needBody {
-		bufferedBody, err := m.openBody(true, compressAlgo, extBodyKey)
+		bufferedBody, err := m.openBody(true, compressAlgo, extBodyKey, sharedKey, rcptHeader)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "failed to read body, skipping", extBodyKey)
 			return 0, nil
@@ -142,6 +185,31 @@ func searchNeedsBody(criteria *imap.SearchCriteria) bool {
 	return false
 }
 
+// searchUsesSeen reports whether criteria match \Seen flag.
+func searchUsesSeen(criteria *imap.SearchCriteria) bool {
+	for _, flag := range criteria.WithFlags {
+		if flag == imap.SeenFlag {
+			return true
+		}
+	}
+	for _, flag := range criteria.WithoutFlags {
+		if flag == imap.SeenFlag {
+			return true
+		}
+	}
+	for _, crit := range criteria.Not {
+		if searchUsesSeen(crit) {
+			return true
+		}
+	}
+	for _, crit := range criteria.Or {
+		if searchUsesSeen(crit[0]) || searchUsesSeen(crit[1]) {
+			return true
+		}
+	}
+	return false
+}
+
 func searchOnlyWithFlags(criteria *imap.SearchCriteria) bool {
 	if criteria.Header != nil ||
 		criteria.Body != nil ||
@@ -0,0 +1,341 @@
+package imapsql
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+// With Opts.SoftDelete, EXPUNGE moves messages to the deletedMsgs table
+// instead of deleting them. The usage and message counters are updated at
+// that point, as for the removal. Soft-deleted messages keep their extKeys
+// references, so bodies are removed only when the messages are purged.
+//
+// Restored messages get new UIDs since UIDs of expunged messages can not be
+// reused.
+
+// purgeBatchSize is the amount of messages removed in one transaction by
+// PurgeMailbox.
+const purgeBatchSize = 500
+
+func (b *Backend) prepareSoftDeleteStmts() error {
+	var err error
+	b.softDeleteMsgs, err = b.db.Prepare(`
+		INSERT INTO deletedMsgs(mboxId, msgId, date, bodyLen, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, savedFlags, deletedAt)
+		SELECT msgs.mboxId, msgs.msgId, date, bodyLen, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, ` + b.db.aggrValuesSet("flag", flagsSep) + `, ?
+		FROM msgs
+		LEFT JOIN flags
+		ON flags.mboxId = msgs.mboxId AND flags.msgId = msgs.msgId AND flag <> '\Deleted'
+		WHERE msgs.mboxId = ? AND msgs.msgId IN (
+			SELECT msgId
+			FROM flags
+			WHERE mboxId = ?
+			AND flag = '\Deleted'
+		)
+		GROUP BY msgs.mboxId, msgs.msgId`)
+	if err != nil {
+		return wrapErr(err, "softDeleteMsgs prep")
+	}
+	b.decreaseRefForDeletedMbox, err = b.db.Prepare(`
+		UPDATE extKeys
+		SET refs = refs - 1
+		WHERE uid = ?
+		AND id IN (
+			SELECT extBodyKey
+			FROM deletedMsgs
+			WHERE mboxId = (SELECT id FROM mboxes WHERE uid = ? AND name = ?)
+		)`)
+	if err != nil {
+		return wrapErr(err, "decreaseRefForDeletedMbox prep")
+	}
+	b.deletedMsgsBefore, err = b.db.Prepare(`
+		SELECT deletedMsgs.mboxId, deletedMsgs.msgId, extKeys.uid
+		FROM deletedMsgs
+		LEFT JOIN extKeys
+		ON extKeys.id = deletedMsgs.extBodyKey
+		WHERE deletedAt < ?
+		ORDER BY deletedAt
+		LIMIT ?`)
+	if err != nil {
+		return wrapErr(err, "deletedMsgsBefore prep")
+	}
+	b.deletedMsgsMbox, err = b.db.Prepare(`
+		SELECT deletedMsgs.mboxId, deletedMsgs.msgId, extKeys.uid
+		FROM deletedMsgs
+		LEFT JOIN extKeys
+		ON extKeys.id = deletedMsgs.extBodyKey
+		WHERE deletedMsgs.mboxId = ?
+		LIMIT ?`)
+	if err != nil {
+		return wrapErr(err, "deletedMsgsMbox prep")
+	}
+	b.deletedMsgsUser, err = b.db.Prepare(`
+		SELECT mboxId, msgId, date, bodyLen, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, savedFlags,
+			(SELECT rcptHeader FROM extKeys WHERE extKeys.id = deletedMsgs.extBodyKey) AS rcptHeader,
+			(SELECT sharedKey FROM extKeys WHERE extKeys.id = deletedMsgs.extBodyKey) AS sharedKey
+		FROM deletedMsgs
+		WHERE mboxId IN (SELECT id FROM mboxes WHERE uid = ?)
+		AND deletedAt >= ?
+		ORDER BY mboxId, deletedAt, msgId`)
+	if err != nil {
+		return wrapErr(err, "deletedMsgsUser prep")
+	}
+	b.unrefDeletedMsg, err = b.db.Prepare(`
+		UPDATE extKeys
+		SET refs = refs - 1
+		WHERE id = (
+			SELECT extBodyKey
+			FROM deletedMsgs
+			WHERE mboxId = ? AND msgId = ?
+		)`)
+	if err != nil {
+		return wrapErr(err, "unrefDeletedMsg prep")
+	}
+	b.purgeDeletedMsg, err = b.db.Prepare(`
+		DELETE FROM deletedMsgs
+		WHERE mboxId = ? AND msgId = ?`)
+	if err != nil {
+		return wrapErr(err, "purgeDeletedMsg prep")
+	}
+	b.addRestoredFlag, err = b.db.Prepare(`
+		INSERT INTO flags(mboxId, msgId, flag)
+		VALUES (?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addRestoredFlag prep")
+	}
+	return nil
+}
+
+// purgeBatch permanently removes soft-deleted messages returned by stmt,
+// the last argument of stmt is the limit. The number of removed messages is
+// returned.
+func (b *Backend) purgeBatch(stmt *sql.Stmt, args ...interface{}) (int, error) {
+	tx, err := b.db.BeginLevel(sql.LevelReadCommitted, false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	type deletedRef struct {
+		mboxId uint64
+		msgId  uint32
+		uid    sql.NullInt64
+	}
+	rows, err := tx.Stmt(stmt).Query(args...)
+	if err != nil {
+		return 0, err
+	}
+	var refs []deletedRef
+	for rows.Next() {
+		var ref deletedRef
+		if err := rows.Scan(&ref.mboxId, &ref.msgId, &ref.uid); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		refs = append(refs, ref)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var uids []uint64
+	seenUids := make(map[uint64]struct{})
+	for _, ref := range refs {
+		if _, err := tx.Stmt(b.unrefDeletedMsg).Exec(ref.mboxId, ref.msgId); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Stmt(b.purgeDeletedMsg).Exec(ref.mboxId, ref.msgId); err != nil {
+			return 0, err
+		}
+		if !ref.uid.Valid {
+			continue
+		}
+		if _, ok := seenUids[uint64(ref.uid.Int64)]; !ok {
+			seenUids[uint64(ref.uid.Int64)] = struct{}{}
+			uids = append(uids, uint64(ref.uid.Int64))
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	var keys []string
+	for _, uid := range uids {
+		zeroRef, err := b.queryKeys(tx, b.zeroRefUser, uid)
+		if err != nil {
+			return 0, err
+		}
+		unused, err := b.deleteZeroRefs(tx, uid)
+		if err != nil {
+			return 0, err
+		}
+		keys = append(keys, zeroRef...)
+		keys = append(keys, unused...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	b.deleteBodies(keys)
+	return len(refs), nil
+}
+
+// PurgeDeleted permanently removes at most limit messages soft-deleted
+// before the specified time. It should be called repeatedly until it returns
+// less than limit, removing messages in batches keeps transactions short.
+//
+// The number of removed messages is returned.
+func (b *Backend) PurgeDeleted(before time.Time, limit int) (int, error) {
+	n, err := b.purgeBatch(b.deletedMsgsBefore, before.Unix(), limit)
+	if err != nil {
+		return 0, wrapErr(err, "PurgeDeleted")
+	}
+	return n, nil
+}
+
+// PurgeMailbox permanently removes all soft-deleted messages of the mailbox.
+//
+// The number of removed messages is returned.
+func (b *Backend) PurgeMailbox(username, mailbox string) (int, error) {
+	uid, _, err := b.getUserMeta(nil, normalizeUsername(username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserDoesntExists
+		}
+		return 0, wrapErr(err, "PurgeMailbox")
+	}
+	var mboxId uint64
+	if err := b.mboxId.QueryRow(uid, mailbox).Scan(&mboxId); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, backend.ErrNoSuchMailbox
+		}
+		return 0, wrapErr(err, "PurgeMailbox")
+	}
+
+	var purged int
+	for {
+		n, err := b.purgeBatch(b.deletedMsgsMbox, mboxId, purgeBatchSize)
+		if err != nil {
+			return purged, wrapErr(err, "PurgeMailbox")
+		}
+		purged += n
+		if n < purgeBatchSize {
+			return purged, nil
+		}
+	}
+}
+
+// RestoreDeleted moves messages of the user soft-deleted at or after the
+// specified time back to their mailboxes. Restored messages get new UIDs.
+// Messages of deleted mailboxes can not be restored.
+//
+// The number of restored messages is returned.
+func (b *Backend) RestoreDeleted(username string, since time.Time) (int, error) {
+	username = normalizeUsername(username)
+	uid, inboxId, err := b.getUserMeta(nil, username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserDoesntExists
+		}
+		return 0, wrapErr(err, "RestoreDeleted")
+	}
+	user := User{id: uid, username: username, parent: b, inboxId: inboxId}
+
+	tx, err := b.db.BeginLevel(sql.LevelReadCommitted, false)
+	if err != nil {
+		return 0, wrapErr(err, "RestoreDeleted")
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	type deletedMsg struct {
+		mboxId                      uint64
+		msgId                       uint32
+		date                        int64
+		bodyLen                     int64
+		bodyStructure, cachedHeader []byte
+		extBodyKey, compressAlgo    sql.NullString
+		seen                        int
+		savedFlags                  string
+		rcptHeader                  []byte
+		sharedKey                   sql.NullString
+	}
+	rows, err := tx.Stmt(b.deletedMsgsUser).Query(uid, since.Unix())
+	if err != nil {
+		return 0, wrapErr(err, "RestoreDeleted")
+	}
+	var msgs []deletedMsg
+	for rows.Next() {
+		var msg deletedMsg
+		err := rows.Scan(&msg.mboxId, &msg.msgId, &msg.date, &msg.bodyLen, &msg.bodyStructure, &msg.cachedHeader,
+			&msg.extBodyKey, &msg.seen, &msg.compressAlgo, &msg.savedFlags, &msg.rcptHeader, &msg.sharedKey)
+		if err != nil {
+			rows.Close()
+			return 0, wrapErr(err, "RestoreDeleted")
+		}
+		msgs = append(msgs, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, wrapErr(err, "RestoreDeleted")
+	}
+
+	var restoredUsage usage
+	notifications := make([]pendingNotification, 0, len(msgs))
+	for _, msg := range msgs {
+		mbox := Mailbox{user: user, id: msg.mboxId, parent: b}
+		msgId, err := mbox.incrementMsgCounters(tx)
+		if err != nil {
+			return 0, wrapErr(err, "RestoreDeleted (incrementMsgCounters)")
+		}
+		_, err = tx.Stmt(b.addMsg).Exec(
+			msg.mboxId, msgId, msg.date,
+			msg.bodyLen,
+			msg.bodyStructure, msg.cachedHeader, msg.extBodyKey,
+			msg.seen, msg.compressAlgo, 1,
+		)
+		if err != nil {
+			return 0, wrapErr(err, "RestoreDeleted (addMsg)")
+		}
+		for _, flag := range strings.Split(msg.savedFlags, flagsSep) {
+			if flag == "" {
+				continue
+			}
+			if _, err := tx.Stmt(b.addRestoredFlag).Exec(msg.mboxId, msgId, flag); err != nil {
+				return 0, wrapErr(err, "RestoreDeleted (addRestoredFlag)")
+			}
+		}
+		if b.fts != ftsNone && msg.extBodyKey.Valid {
+			body, err := b.openBody(true, msg.compressAlgo.String, msg.extBodyKey.String, msg.sharedKey, msg.rcptHeader)
+			if err != nil {
+				return 0, wrapErr(err, "RestoreDeleted (indexMessage)")
+			}
+			err = b.indexMessage(tx, msg.mboxId, msgId, body)
+			body.Close()
+			if err != nil {
+				return 0, wrapErr(err, "RestoreDeleted (indexMessage)")
+			}
+		}
+		// The extKeys reference is moved to the restored message.
+		if _, err := tx.Stmt(b.purgeDeletedMsg).Exec(msg.mboxId, msg.msgId); err != nil {
+			return 0, wrapErr(err, "RestoreDeleted (purgeDeletedMsg)")
+		}
+
+		restoredUsage.bytes += msg.bodyLen
+		restoredUsage.msgs++
+		notifications = append(notifications, pendingNotification{mboxId: msg.mboxId, msgId: msgId})
+	}
+	if err := b.changeUsage(tx, uid, restoredUsage); err != nil {
+		return 0, wrapErr(err, "RestoreDeleted (changeUsage)")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, wrapErr(err, "RestoreDeleted")
+	}
+
+	for _, notif := range notifications {
+		b.mngr.NewMessage(notif.mboxId, notif.msgId)
+	}
+	return len(msgs), nil
+}
@@ -0,0 +1,121 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSoftDelete(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	b.Opts.SoftDelete = true
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mbox, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+	msgLen := int64(len(testMsg))
+
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{imap.DeletedFlag, imap.FlaggedFlag}, time.Now(), strings.NewReader(testMsg), mbox))
+	assert.NilError(t, mbox.Poll(true))
+	assert.NilError(t, mbox.Expunge())
+
+	// The message is hidden and does not count against the quota, but the
+	// body is kept.
+	status, err := usr.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(status.Messages, uint32(0)))
+	checkUsage(t, b, t.Name(), 0, 0)
+	assert.Assert(t, checkKeysCount(b, 1), "Body is removed on soft delete")
+
+	restored, err := b.RestoreDeleted(t.Name(), time.Time{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(restored, 1))
+	checkUsage(t, b, t.Name(), msgLen, 1)
+
+	assert.NilError(t, mbox.Poll(true))
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, ch))
+	assert.Assert(t, is.Len(ch, 1))
+	msg := <-ch
+	assert.Check(t, is.Equal(msg.Uid, uint32(2)), "restored message should get a new UID")
+	assert.Check(t, is.Contains(msg.Flags, imap.FlaggedFlag))
+	for _, flag := range msg.Flags {
+		assert.Check(t, flag != imap.DeletedFlag, "\\Deleted flag is restored")
+	}
+
+	// Purging messages deleted before the retention period.
+	assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+	assert.NilError(t, mbox.Expunge())
+	purged, err := b.PurgeDeleted(time.Now().Add(-time.Hour), 100)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(purged, 0))
+	purged, err = b.PurgeDeleted(time.Now().Add(time.Hour), 100)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(purged, 1))
+	assert.Assert(t, checkKeysCount(b, 0), "Body is not removed after purge")
+
+	restored, err = b.RestoreDeleted(t.Name(), time.Time{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(restored, 0))
+}
+
+func TestSoftDelete_PurgeMailbox(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	b.Opts.SoftDelete = true
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox("1"))
+	_, mbox1, err := usr.GetMailbox("1", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox1.Close()
+
+	assert.NilError(t, usr.CreateMessage("1", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), mbox1))
+	assert.NilError(t, mbox1.Poll(true))
+	seq, _ := imap.ParseSeqSet("1")
+	assert.NilError(t, mbox1.CopyMessages(false, seq, "INBOX"))
+	assert.NilError(t, mbox1.Expunge())
+
+	// The copy still uses the body.
+	purged, err := b.PurgeMailbox(t.Name(), "1")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(purged, 1))
+	assert.Assert(t, checkKeysCount(b, 1), "Body of the copy is removed")
+
+	restored, err := b.RestoreDeleted(t.Name(), time.Time{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(restored, 0))
+
+	_, err = b.PurgeMailbox(t.Name(), "nonexistent")
+	assert.Check(t, is.ErrorContains(err, "No such mailbox"))
+}
+
+func TestSoftDelete_DeleteMailbox(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	b.Opts.SoftDelete = true
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox("1"))
+	_, mbox1, err := usr.GetMailbox("1", false, &noopConn{})
+	assert.NilError(t, err)
+
+	assert.NilError(t, usr.CreateMessage("1", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), mbox1))
+	assert.NilError(t, mbox1.Poll(true))
+	assert.NilError(t, mbox1.Expunge())
+	assert.NilError(t, mbox1.Close())
+
+	// Soft-deleted messages are removed along with the mailbox.
+	assert.NilError(t, usr.DeleteMailbox("1"))
+	assert.Assert(t, checkKeysCount(b, 0), "Body is not removed with mailbox")
+}
@@ -82,6 +82,11 @@ func (b *Backend) initSchema() error {
 			username VARCHAR(255) NOT NULL UNIQUE,
 			msgsizelimit INTEGER DEFAULT NULL,
 
+            -- Total size and count of messages in all mailboxes, kept
+            -- up to date by all operations that add or remove messages.
+            usedBytes BIGINT NOT NULL DEFAULT 0,
+            usedMsgs BIGINT NOT NULL DEFAULT 0,
+
             -- It does not reference mboxes, since otherwise there will
             -- be recursive foreign key constraint.
             inboxId BIGINT DEFAULT 0
@@ -117,11 +122,28 @@ func (b *Backend) initSchema() error {
 			-- doing multiple queries to delete mboxes and stuff
 			-- or using deferred constraint checking (not supported by MySQL/MariaDB)
 			uid BIGINT NOT NULL, -- REFERENCES users(id) ON DELETE RESTRICT
-			refs INTEGER NOT NULL DEFAULT 1
+			refs INTEGER NOT NULL DEFAULT 1,
+
+			-- Set for deduplicated bodies, see dedup.go.
+			sharedKey VARCHAR(255) DEFAULT NULL,
+			rcptHeader LONGTEXT
 		)`)
 	if err != nil {
 		return wrapErr(err, "create table extkeys")
 	}
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS sharedBodies (
+			extKey VARCHAR(255) PRIMARY KEY NOT NULL,
+			bodyHash VARCHAR(64) NOT NULL,
+			bodySize BIGINT NOT NULL,
+			compressAlgo VARCHAR(255),
+			refs INTEGER NOT NULL DEFAULT 0,
+
+			UNIQUE(bodyHash, bodySize)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table sharedBodies")
+	}
 
 	_, err = b.db.Exec(`
         CREATE UNIQUE INDEX IF NOT EXISTS extKeys_uid_id
@@ -174,6 +196,55 @@ func (b *Backend) initSchema() error {
 	if err != nil {
 		return wrapErr(err, "create table flags")
 	}
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS deletedMsgs (
+			mboxId BIGINT NOT NULL REFERENCES mboxes(id) ON DELETE CASCADE,
+			msgId BIGINT NOT NULL,
+			date BIGINT NOT NULL,
+			bodyLen INTEGER NOT NULL,
+
+			bodyStructure LONGTEXT NOT NULL,
+			cachedHeader LONGTEXT NOT NULL,
+			extBodyKey VARCHAR(255) DEFAULT NULL REFERENCES extKeys(id) ON DELETE RESTRICT,
+
+			seen INTEGER NOT NULL DEFAULT 0,
+			compressAlgo VARCHAR(255),
+
+			-- Flags of the message, except for \Deleted, joined using flagsSep.
+			savedFlags LONGTEXT NOT NULL,
+			deletedAt BIGINT NOT NULL,
+
+			PRIMARY KEY(mboxId, msgId)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table deletedMsgs")
+	}
+
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS acl (
+			mboxId BIGINT NOT NULL REFERENCES mboxes(id) ON DELETE CASCADE,
+			-- Username or 'anyone'.
+			grantee VARCHAR(255) NOT NULL,
+			-- RFC 4314 rights, see acl.go.
+			rights VARCHAR(32) NOT NULL,
+
+			UNIQUE(mboxId, grantee)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table acl")
+	}
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS privateSeen (
+			uid BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			mboxId BIGINT NOT NULL,
+			msgId BIGINT NOT NULL,
+
+			FOREIGN KEY (mboxId, msgId) REFERENCES msgs(mboxId, msgId) ON DELETE CASCADE,
+			UNIQUE (uid, mboxId, msgId)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table privateSeen")
+	}
 
 	_, err = b.db.Exec(`
         CREATE INDEX IF NOT EXISTS seen_msgs
@@ -191,6 +262,37 @@ func (b *Backend) initSchema() error {
 		return wrapErr(err, "create index seen_msgs")
 	}
 
+	// Used to find bodies that are not referenced by any message.
+	_, err = b.db.Exec(`
+        CREATE INDEX IF NOT EXISTS msgs_extBodyKey
+        ON msgs(extBodyKey)`)
+	if err != nil && b.db.driver == "mysql" {
+		_, err = b.db.Exec(`
+			CREATE INDEX msgs_extBodyKey
+			ON msgs(extBodyKey)`)
+		if err != nil && strings.HasPrefix(err.Error(), "Error 1061: Duplicate key name") {
+			err = nil
+		}
+	}
+	if err != nil {
+		return wrapErr(err, "create index msgs_extBodyKey")
+	}
+
+	_, err = b.db.Exec(`
+		CREATE INDEX IF NOT EXISTS deletedMsgs_deletedAt
+		ON deletedMsgs(deletedAt)`)
+	if err != nil && b.db.driver == "mysql" {
+		_, err = b.db.Exec(`
+			CREATE INDEX deletedMsgs_deletedAt
+			ON deletedMsgs(deletedAt)`)
+		if err != nil && strings.HasPrefix(err.Error(), "Error 1061: Duplicate key name") {
+			err = nil
+		}
+	}
+	if err != nil {
+		return wrapErr(err, "create index deletedMsgs_deletedAt")
+	}
+
 	return nil
 }
 
@@ -457,14 +559,13 @@ func (b *Backend) prepareStmts() error {
 		return wrapErr(err, "massClearFlagsUid prep")
 	}
 
-	b.addRecentToLast, err = b.db.Prepare(`
+	b.markRecent, err = b.db.Prepare(`
 		UPDATE msgs
 		SET recent = 1
 		WHERE mboxId = ?
-		AND msgId = (SELECT msgId FROM msgs WHERE mboxId = ? ORDER BY msgId DESC LIMIT ?)
-		`)
+		AND msgId BETWEEN ? AND ?`)
 	if err != nil {
-		return wrapErr(err, "addRecenttoLast prep")
+		return wrapErr(err, "markRecent prep")
 	}
 
 	b.markUid, err = b.db.Prepare(`
@@ -560,7 +661,7 @@ func (b *Backend) prepareStmts() error {
 	}
 
 	b.searchFetchNoSeq, err = b.db.Prepare(`
-		SELECT msgs.msgId, date, bodyLen, extBodyKey, compressAlgo, ` + b.db.aggrValuesSet("flag", "{") + `
+		SELECT msgs.msgId, date, bodyLen, extBodyKey, compressAlgo, ` + strings.Join(sharedBodyCols, ", ") + `, ` + b.db.aggrValuesSet("flag", "{") + `
 		FROM msgs
 		LEFT JOIN flags
 		ON flags.msgId = msgs.msgId AND msgs.mboxId = flags.mboxId
@@ -626,7 +727,8 @@ func (b *Backend) prepareStmts() error {
 		WHERE extBodyKey IS NOT NULL
 		AND uid = ?
 		AND mboxId = ?
-		AND refs = 0`)
+		AND refs = 0
+		AND sharedKey IS NULL`)
 	if err != nil {
 		return wrapErr(err, "zeroRef prep")
 	}
@@ -634,14 +736,16 @@ func (b *Backend) prepareStmts() error {
 		SELECT id
 		FROM extKeys
 		WHERE uid = ?
-		AND refs = 0`)
+		AND refs = 0
+		AND sharedKey IS NULL`)
 	if err != nil {
 		return wrapErr(err, "zeroRefUser prep")
 	}
 	b.refUser, err = b.db.Prepare(`
 		SELECT id
 		FROM extKeys
-		WHERE uid = (SELECT id FROM users WHERE username = ?)`)
+		WHERE uid = (SELECT id FROM users WHERE username = ?)
+		AND sharedKey IS NULL`)
 	if err != nil {
 		return wrapErr(err, "refUser prep")
 	}
@@ -658,7 +762,7 @@ func (b *Backend) prepareStmts() error {
 		DELETE FROM extKeys
 		-- This is the hint to accelerate operation
 		-- when we have many users.
-		WHERE uid = (SELECT id FROM users WHERE username = ?)`)
+		WHERE uid = ?`)
 	if err != nil {
 		return wrapErr(err, "deleteUserRef prep")
 	}
@@ -682,6 +786,64 @@ func (b *Backend) prepareStmts() error {
 		return wrapErr(err, "setSeenFlagUid prep")
 	}
 
+	b.addUsage, err = b.db.Prepare(`
+		UPDATE users
+		SET usedBytes = usedBytes + ?,
+		    usedMsgs = usedMsgs + ?
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "addUsage prep")
+	}
+	b.userUsage, err = b.db.Prepare(`
+		SELECT usedBytes, usedMsgs
+		FROM users
+		WHERE username = ?`)
+	if err != nil {
+		return wrapErr(err, "userUsage prep")
+	}
+	b.recalcUsage, err = b.db.Prepare(recalcUsageQuery + `
+		WHERE username = ?`)
+	if err != nil {
+		return wrapErr(err, "recalcUsage prep")
+	}
+	b.rangeUsageUid, err = b.db.Prepare(`
+		SELECT COALESCE(SUM(bodyLen), 0), COUNT(*)
+		FROM msgs
+		WHERE mboxId = ? AND msgId BETWEEN ? AND ?`)
+	if err != nil {
+		return wrapErr(err, "rangeUsageUid prep")
+	}
+	b.markedUsage, err = b.db.Prepare(`
+		SELECT COALESCE(SUM(bodyLen), 0), COUNT(*)
+		FROM msgs
+		WHERE mboxId = ? AND mark = 1`)
+	if err != nil {
+		return wrapErr(err, "markedUsage prep")
+	}
+	b.deletedUsage, err = b.db.Prepare(`
+		SELECT COALESCE(SUM(bodyLen), 0), COUNT(*)
+		FROM msgs
+		WHERE mboxId = ? AND msgId IN (
+			SELECT msgId
+			FROM flags
+			WHERE mboxId = ?
+			AND flag = '\Deleted'
+		)`)
+	if err != nil {
+		return wrapErr(err, "deletedUsage prep")
+	}
+	b.mboxUsage, err = b.db.Prepare(`
+		SELECT COALESCE(SUM(bodyLen), 0), COUNT(*)
+		FROM msgs
+		WHERE mboxId = (
+			SELECT id
+			FROM mboxes
+			WHERE uid = ? AND name = ?
+		)`)
+	if err != nil {
+		return wrapErr(err, "mboxUsage prep")
+	}
+
 	b.setInboxId, err = b.db.Prepare(`
         UPDATE users
         SET inboxId = ?
@@ -702,6 +864,87 @@ func (b *Backend) prepareStmts() error {
 	if err != nil {
 		return wrapErr(err, "decreaseRefForMbox prep")
 	}
+	b.zeroRefMarked, err = b.db.Prepare(`
+		SELECT extBodyKey
+		FROM msgs
+		INNER JOIN extKeys
+		ON msgs.extBodyKey = extKeys.id
+		WHERE uid = ?
+		AND mboxId = ?
+		AND mark = 1
+		AND refs = 0
+		AND sharedKey IS NULL`)
+	if err != nil {
+		return wrapErr(err, "zeroRefMarked prep")
+	}
+	b.extKeyExists, err = b.db.Prepare(`
+		SELECT (
+			SELECT COUNT(*)
+			FROM extKeys
+			WHERE id = ?
+		) + (
+			SELECT COUNT(*)
+			FROM sharedBodies
+			WHERE extKey = ?
+		)`)
+	if err != nil {
+		return wrapErr(err, "extKeyExists prep")
+	}
+	b.unreferencedExtKeys, err = b.db.Prepare(`
+		SELECT id
+		FROM extKeys
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM msgs
+			WHERE msgs.extBodyKey = extKeys.id
+		) AND NOT EXISTS (
+			SELECT 1
+			FROM deletedMsgs
+			WHERE deletedMsgs.extBodyKey = extKeys.id
+		)`)
+	if err != nil {
+		return wrapErr(err, "unreferencedExtKeys prep")
+	}
+	b.deleteExtKey, err = b.db.Prepare(`
+		DELETE FROM extKeys
+		WHERE id = ?
+		AND NOT EXISTS (
+			SELECT 1
+			FROM msgs
+			WHERE msgs.extBodyKey = ?
+		) AND NOT EXISTS (
+			SELECT 1
+			FROM deletedMsgs
+			WHERE deletedMsgs.extBodyKey = ?
+		)`)
+	if err != nil {
+		return wrapErr(err, "deleteExtKey prep")
+	}
+	b.listExtKeys, err = b.db.Prepare(`
+		SELECT id
+		FROM extKeys
+		WHERE sharedKey IS NULL
+		UNION ALL
+		SELECT extKey
+		FROM sharedBodies`)
+	if err != nil {
+		return wrapErr(err, "listExtKeys prep")
+	}
+	if err := b.prepareDedupStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareSoftDeleteStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareACLStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareUserPurgeStmts(); err != nil {
+		return err
+	}
+	if err := b.prepareExportStmts(); err != nil {
+		return err
+	}
 
 	b.lastUid, err = b.db.Prepare(`SELECT max(msgId) FROM msgs WHERE mboxId = ?`)
 	if err != nil {
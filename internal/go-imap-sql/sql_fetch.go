@@ -73,6 +73,9 @@ func (b *Backend) buildFetchStmt(items []imap.FetchItem) (stmt, cacheKey string,
 			case needHeader, needFullBody:
 				colNames["extBodyKey"] = struct{}{}
 				colNames["compressAlgo"] = struct{}{}
+				for _, col := range sharedBodyCols {
+					colNames[col] = struct{}{}
+				}
 			}
 		}
 	}
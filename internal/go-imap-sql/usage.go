@@ -0,0 +1,85 @@
+package imapsql
+
+import (
+	"database/sql"
+)
+
+// recalcUsageQuery sets usage counters of users from the actual messages.
+// Optional WHERE clause can be appended to limit the affected users.
+const recalcUsageQuery = `
+		UPDATE users
+		SET usedBytes = (
+			SELECT COALESCE(SUM(msgs.bodyLen), 0)
+			FROM msgs
+			INNER JOIN mboxes ON msgs.mboxId = mboxes.id
+			WHERE mboxes.uid = users.id
+		), usedMsgs = (
+			SELECT COUNT(*)
+			FROM msgs
+			INNER JOIN mboxes ON msgs.mboxId = mboxes.id
+			WHERE mboxes.uid = users.id
+		)`
+
+// usage is the total size and count of a set of messages.
+type usage struct {
+	bytes int64
+	msgs  int64
+}
+
+func queryUsage(tx *sql.Tx, stmt *sql.Stmt, args ...interface{}) (usage, error) {
+	var u usage
+	err := tx.Stmt(stmt).QueryRow(args...).Scan(&u.bytes, &u.msgs)
+	return u, err
+}
+
+// changeUsage adds delta to the usage counters of the user. Negative values
+// decrease them.
+func (b *Backend) changeUsage(tx *sql.Tx, uid uint64, delta usage) error {
+	if delta.msgs == 0 && delta.bytes == 0 {
+		return nil
+	}
+	_, err := tx.Stmt(b.addUsage).Exec(delta.bytes, delta.msgs, uid)
+	return err
+}
+
+// Usage returns the total size and count of messages stored for the user.
+//
+// Values are maintained as messages are added and removed, run
+// RecalculateUsage to fix them if messages were changed bypassing Backend.
+func (b *Backend) Usage(username string) (bytes, msgs int64, err error) {
+	err = b.userUsage.QueryRow(normalizeUsername(username)).Scan(&bytes, &msgs)
+	if err == sql.ErrNoRows {
+		return 0, 0, ErrUserDoesntExists
+	}
+	if err != nil {
+		return 0, 0, wrapErr(err, "Usage")
+	}
+	return bytes, msgs, nil
+}
+
+// RecalculateUsage rebuilds usage counters of the user from the stored
+// messages. If username is empty, counters of all users are rebuilt.
+func (b *Backend) RecalculateUsage(username string) error {
+	if username == "" {
+		if _, err := b.db.Exec(recalcUsageQuery); err != nil {
+			return wrapErr(err, "RecalculateUsage")
+		}
+		return nil
+	}
+
+	stats, err := b.recalcUsage.Exec(normalizeUsername(username))
+	if err != nil {
+		return wrapErr(err, "RecalculateUsage")
+	}
+	affected, err := stats.RowsAffected()
+	if err != nil {
+		return wrapErr(err, "RecalculateUsage")
+	}
+	if affected == 0 {
+		// MySQL does not count rows that were not changed.
+		if _, _, err := b.Usage(username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
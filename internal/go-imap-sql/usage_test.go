@@ -0,0 +1,89 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func checkUsage(t *testing.T, b *Backend, username string, bytes, msgs int64) {
+	t.Helper()
+
+	usedBytes, usedMsgs, err := b.Usage(username)
+	assert.NilError(t, err)
+	assert.Equal(t, usedBytes, bytes, "wrong usedBytes")
+	assert.Equal(t, usedMsgs, msgs, "wrong usedMsgs")
+}
+
+func TestUsage(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	checkUsage(t, b, t.Name(), 0, 0)
+
+	for _, name := range []string{"1", "2", "3"} {
+		assert.NilError(t, usr.CreateMailbox(name))
+	}
+	_, mbox1, err := usr.GetMailbox("1", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox1.Close()
+	_, mbox2, err := usr.GetMailbox("2", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox2.Close()
+
+	msgLen := int64(len(testMsg))
+	assert.NilError(t, usr.CreateMessage("1", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), mbox1))
+	assert.NilError(t, usr.CreateMessage("1", nil, time.Now(), strings.NewReader(testMsg), mbox1))
+	assert.NilError(t, mbox1.Poll(true))
+	checkUsage(t, b, t.Name(), 2*msgLen, 2)
+
+	seq, _ := imap.ParseSeqSet("1:2")
+	assert.NilError(t, mbox1.CopyMessages(false, seq, "2"))
+	assert.NilError(t, mbox2.Poll(true))
+	checkUsage(t, b, t.Name(), 4*msgLen, 4)
+
+	// Moved messages stay in the same account.
+	seq, _ = imap.ParseSeqSet("2")
+	assert.NilError(t, mbox2.(*Mailbox).MoveMessages(false, seq, "3"))
+	checkUsage(t, b, t.Name(), 4*msgLen, 4)
+
+	// Only the message with \Deleted is removed.
+	assert.NilError(t, mbox1.Expunge())
+	checkUsage(t, b, t.Name(), 3*msgLen, 3)
+
+	seq, _ = imap.ParseSeqSet("1")
+	assert.NilError(t, mbox2.(*Mailbox).DelMessages(false, seq))
+	checkUsage(t, b, t.Name(), 2*msgLen, 2)
+
+	assert.NilError(t, usr.DeleteMailbox("3"))
+	checkUsage(t, b, t.Name(), msgLen, 1)
+
+	// Counters can be rebuilt after they diverge from the actual messages.
+	_, err = b.db.Exec(`UPDATE users SET usedBytes = 0, usedMsgs = 100`)
+	assert.NilError(t, err)
+	assert.NilError(t, b.RecalculateUsage(t.Name()))
+	checkUsage(t, b, t.Name(), msgLen, 1)
+	assert.NilError(t, b.RecalculateUsage(""))
+	checkUsage(t, b, t.Name(), msgLen, 1)
+
+	assert.Equal(t, b.RecalculateUsage("nobody"), ErrUserDoesntExists)
+}
+
+func TestUsage_Delivery(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name(), textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	checkUsage(t, b, t.Name(), int64(len(testMsg)), 1)
+}
@@ -94,13 +94,42 @@ func (u *User) ListMailboxes(subscribed bool) ([]imap.MailboxInfo, error) {
 		res[i] = info
 	}
 
+	if u.sharedPrefix() != "" {
+		shared, err := u.sharedMailboxes(nil)
+		if err != nil {
+			u.parent.logUserErr(u, err, "ListMailboxes (shared)", subscribed)
+			return res, wrapErr(err, "ListMailboxes")
+		}
+		for _, s := range shared {
+			if !hasRights(s.rights, "l") {
+				continue
+			}
+			res = append(res, imap.MailboxInfo{
+				Delimiter: MailboxPathSep,
+				Name:      u.sharedName(s),
+			})
+		}
+	}
+
 	return res, nil
 }
 
 func (u *User) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
 	var mbox *Mailbox
 
-	if strings.EqualFold(name, "INBOX") {
+	shared, isShared, err := u.findShared(nil, name)
+	if err != nil {
+		u.parent.logUserErr(u, err, "GetMailbox (shared)", name)
+		return nil, nil, wrapErrf(err, "GetMailbox %s", name)
+	}
+	if isShared {
+		// Mailboxes opened without a connection are used for APPEND,
+		// the rights are checked for the operation then.
+		if conn != nil && !hasRights(shared.rights, "r") {
+			return nil, nil, ErrPermissionDenied
+		}
+		mbox = &Mailbox{user: shared.owner, id: shared.id, name: name, parent: u.parent, viewer: u, rights: shared.rights}
+	} else if strings.EqualFold(name, "INBOX") {
 		mbox = &Mailbox{user: *u, id: u.inboxId, name: name, parent: u.parent}
 	} else {
 		row := u.parent.mboxId.QueryRow(u.id, name)
@@ -139,6 +168,9 @@ func (u *User) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.
 		u.parent.logUserErr(u, err, "GetMailbox handle", name)
 		return nil, nil, wrapErrf(err, "GetMailbox %s (get handle)", name)
 	}
+	if mbox.privateSeen() {
+		handle.SetFlagsFilter(mbox.seenFilter)
+	}
 	mbox.handle = handle
 
 	return status, mbox, nil
@@ -166,6 +198,10 @@ func (u *User) SetMessageLimit(val *uint32) error {
 }
 
 func (u *User) CreateMailbox(name string) error {
+	if u.isSharedName(name) {
+		return ErrSharedNamespace
+	}
+
 	tx, err := u.parent.db.Begin(false)
 	if err != nil {
 		u.parent.logUserErr(u, err, "CreateMailbox (tx start)", name)
@@ -202,6 +238,9 @@ func (u *User) CreateMailboxSpecial(name, specialUseAttr string) error {
 	default:
 		return ErrUnsupportedSpecialAttr
 	}
+	if u.isSharedName(name) {
+		return ErrSharedNamespace
+	}
 
 	tx, err := u.parent.db.Begin(false)
 	if err != nil {
@@ -239,6 +278,10 @@ func (u *User) DeleteMailbox(name string) error {
 		u.parent.logUserErr(u, err, "DeleteMailbox (decrease ref)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
+	if _, err := tx.Stmt(u.parent.decreaseRefForDeletedMbox).Exec(u.id, u.id, name); err != nil {
+		u.parent.logUserErr(u, err, "DeleteMailbox (decrease ref for deleted)", name)
+		return wrapErrf(err, "DeleteMailbox %s", name)
+	}
 
 	rows, err := tx.Stmt(u.parent.zeroRefUser).Query(u.id)
 	if err != nil {
@@ -258,8 +301,9 @@ func (u *User) DeleteMailbox(name string) error {
 
 	}
 
-	if err := u.parent.extStore.Delete(keys); err != nil {
-		u.parent.logUserErr(u, err, "DeleteMailbox (extstore delete)", name)
+	mboxUsage, err := queryUsage(tx, u.parent.mboxUsage, u.id, name)
+	if err != nil {
+		u.parent.logUserErr(u, err, "DeleteMailbox (usage)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
 
@@ -277,18 +321,32 @@ func (u *User) DeleteMailbox(name string) error {
 	if affected == 0 {
 		return backend.ErrNoSuchMailbox
 	}
+	if err := u.parent.changeUsage(tx, u.id, usage{bytes: -mboxUsage.bytes, msgs: -mboxUsage.msgs}); err != nil {
+		u.parent.logUserErr(u, err, "DeleteMailbox (changeUsage)", name)
+		return wrapErrf(err, "DeleteMailbox %s", name)
+	}
 
-	if _, err := tx.Stmt(u.parent.deleteZeroRef).Exec(u.id); err != nil {
+	unused, err := u.parent.deleteZeroRefs(tx, u.id)
+	if err != nil {
 		u.parent.logUserErr(u, err, "DeleteMailbox (delete zero ref)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
+	keys = append(keys, unused...)
 
-	err = tx.Commit()
-	u.parent.logUserErr(u, err, "DeleteMailbox (tx commit)", name)
-	return err
+	if err := tx.Commit(); err != nil {
+		u.parent.logUserErr(u, err, "DeleteMailbox (tx commit)", name)
+		return err
+	}
+
+	u.parent.deleteBodies(keys)
+	return nil
 }
 
 func (u *User) RenameMailbox(existingName, newName string) error {
+	if u.isSharedName(newName) {
+		return ErrSharedNamespace
+	}
+
 	tx, err := u.parent.db.Begin(false)
 	if err != nil {
 		u.parent.logUserErr(u, err, "RenameMailbox (tx start)", existingName, newName)
@@ -359,12 +417,21 @@ func (u *User) createParentDirs(tx *sql.Tx, name string) error {
 }
 
 func (u *User) Namespaces() (personal, other, shared []namespace.Namespace, err error) {
-	return []namespace.Namespace{
+	personal = []namespace.Namespace{
 		{
 			Prefix:    "",
 			Delimiter: MailboxPathSep,
 		},
-	}, nil, nil, nil
+	}
+	if prefix := u.sharedPrefix(); prefix != "" {
+		other = []namespace.Namespace{
+			{
+				Prefix:    prefix,
+				Delimiter: MailboxPathSep,
+			},
+		}
+	}
+	return personal, other, nil, nil
 }
 
 func (u *User) CreateMessage(mboxName string, flags []string, date time.Time, fullBody imap.Literal, _ backend.Mailbox) error {
@@ -395,7 +462,16 @@ func (u *User) Status(mbox string, items []imap.StatusItem) (*imap.MailboxStatus
 	defer tx.Rollback()
 
 	var mboxId uint64
-	if err := tx.Stmt(u.parent.mboxId).QueryRow(u.id, mbox).Scan(&mboxId); err != nil {
+	shared, isShared, err := u.findShared(tx, mbox)
+	if err != nil {
+		return nil, err
+	}
+	if isShared {
+		if !hasRights(shared.rights, "r") {
+			return nil, ErrPermissionDenied
+		}
+		mboxId = shared.id
+	} else if err := tx.Stmt(u.parent.mboxId).QueryRow(u.id, mbox).Scan(&mboxId); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, backend.ErrNoSuchMailbox
 		}
@@ -430,7 +506,12 @@ func (u *User) Status(mbox string, items []imap.StatusItem) (*imap.MailboxStatus
 				return nil, errors.New("I/O error")
 			}
 		case imap.StatusUnseen:
-			err := tx.Stmt(u.parent.unseenCount).QueryRow(mboxId).Scan(&status.Unseen)
+			var err error
+			if isShared {
+				err = tx.Stmt(u.parent.privateUnseenCount).QueryRow(mboxId, u.id).Scan(&status.Unseen)
+			} else {
+				err = tx.Stmt(u.parent.unseenCount).QueryRow(mboxId).Scan(&status.Unseen)
+			}
 			if err != nil {
 				u.parent.logUserErr(u, err, "Status: unseen scan")
 				delete(status.Items, imap.StatusUnseen)
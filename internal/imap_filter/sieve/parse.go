@@ -0,0 +1,418 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ScriptError is returned for scripts that cannot be parsed or use
+// unsupported features.
+type ScriptError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+func errorf(line int, format string, args ...interface{}) error {
+	return &ScriptError{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokTag
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	line int
+	text string
+	num  int64
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of script"
+	case tokString:
+		return "string"
+	case tokTag:
+		return fmt.Sprintf("tag :%s", t.text)
+	case tokNumber:
+		return fmt.Sprintf("number %d", t.num)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lex splits the script into tokens as defined by RFC 5228 Section 8.1.
+func lex(script string) ([]token, error) {
+	var (
+		toks []token
+		line = 1
+		i    = 0
+	)
+	for i < len(script) {
+		c := script[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end == -1 {
+				return nil, errorf(line, "unterminated comment")
+			}
+			line += strings.Count(script[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"':
+			startLine := line
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(script) {
+					return nil, errorf(startLine, "unterminated string")
+				}
+				if script[i] == '"' {
+					i++
+					break
+				}
+				if script[i] == '\\' && i+1 < len(script) {
+					i++
+				}
+				if script[i] == '\n' {
+					line++
+				}
+				sb.WriteByte(script[i])
+				i++
+			}
+			toks = append(toks, token{kind: tokString, line: startLine, text: sb.String()})
+		case c == ':':
+			j := i + 1
+			for j < len(script) && isIdentChar(script[j], j == i+1) {
+				j++
+			}
+			if j == i+1 {
+				return nil, errorf(line, "invalid tag")
+			}
+			toks = append(toks, token{kind: tokTag, line: line, text: strings.ToLower(script[i+1 : j])})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(script) && script[j] >= '0' && script[j] <= '9' {
+				j++
+			}
+			num, err := strconv.ParseInt(script[i:j], 10, 64)
+			if err != nil {
+				return nil, errorf(line, "invalid number: %v", err)
+			}
+			if j < len(script) {
+				switch script[j] {
+				case 'K', 'k':
+					num <<= 10
+					j++
+				case 'M', 'm':
+					num <<= 20
+					j++
+				case 'G', 'g':
+					num <<= 30
+					j++
+				}
+			}
+			toks = append(toks, token{kind: tokNumber, line: line, num: num})
+			i = j
+		case isIdentChar(c, true):
+			j := i
+			for j < len(script) && isIdentChar(script[j], j == i) {
+				j++
+			}
+			ident := strings.ToLower(script[i:j])
+			if ident == "text" && j < len(script) && script[j] == ':' {
+				text, n, lines, err := lexMultiline(script[j+1:], line)
+				if err != nil {
+					return nil, err
+				}
+				toks = append(toks, token{kind: tokString, line: line, text: text})
+				line += lines
+				i = j + 1 + n
+				continue
+			}
+			toks = append(toks, token{kind: tokIdent, line: line, text: ident})
+			i = j
+		case strings.IndexByte(";,()[]{}", c) != -1:
+			toks = append(toks, token{kind: tokPunct, line: line, text: string(c)})
+			i++
+		default:
+			return nil, errorf(line, "unexpected character %q", c)
+		}
+	}
+	return append(toks, token{kind: tokEOF, line: line}), nil
+}
+
+// lexMultiline reads the multi-line string following "text:" and returns it
+// along with the amount of consumed bytes and lines.
+func lexMultiline(s string, line int) (string, int, int, error) {
+	// The rest of the "text:" line may contain only whitespace or a comment.
+	eol := strings.IndexByte(s, '\n')
+	if eol == -1 {
+		return "", 0, 0, errorf(line, "unterminated multi-line string")
+	}
+	if rest := strings.TrimSpace(s[:eol]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", 0, 0, errorf(line, "unexpected characters after text:")
+	}
+
+	var (
+		sb    strings.Builder
+		pos   = eol + 1
+		lines = 1
+	)
+	for {
+		next := strings.IndexByte(s[pos:], '\n')
+		if next == -1 {
+			return "", 0, 0, errorf(line, "unterminated multi-line string")
+		}
+		l := strings.TrimSuffix(s[pos:pos+next], "\r")
+		pos += next + 1
+		lines++
+		if l == "." {
+			return sb.String(), pos, lines, nil
+		}
+		sb.WriteString(strings.TrimPrefix(l, "."))
+		sb.WriteString("\r\n")
+	}
+}
+
+func isIdentChar(c byte, first bool) bool {
+	if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+type argKind int
+
+const (
+	argStrings argKind = iota
+	argNumber
+	argTag
+)
+
+type argument struct {
+	kind argKind
+	line int
+	strs []string
+	num  int64
+	tag  string
+}
+
+// node is a command or a test with its arguments.
+type node struct {
+	name  string
+	line  int
+	args  []argument
+	tests []node
+	block []node
+
+	// hasBlock is set for commands followed by a block.
+	hasBlock bool
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+// parse returns the commands of the script.
+func parse(script string) ([]node, error) {
+	toks, err := lex(script)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{toks: toks}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, errorf(t.line, "unexpected %v", t)
+	}
+	return cmds, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isPunct(s string) bool {
+	t := p.peek()
+	return t.kind == tokPunct && t.text == s
+}
+
+func (p *parser) expectPunct(s string) error {
+	t := p.next()
+	if t.kind != tokPunct || t.text != s {
+		return errorf(t.line, "expected %q, got %v", s, t)
+	}
+	return nil
+}
+
+func (p *parser) commands() ([]node, error) {
+	var cmds []node
+	for p.peek().kind == tokIdent {
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (p *parser) command() (node, error) {
+	cmd, err := p.testOrCommand()
+	if err != nil {
+		return node{}, err
+	}
+
+	switch {
+	case p.isPunct(";"):
+		p.next()
+	case p.isPunct("{"):
+		p.next()
+		cmd.hasBlock = true
+		cmd.block, err = p.commands()
+		if err != nil {
+			return node{}, err
+		}
+		if err := p.expectPunct("}"); err != nil {
+			return node{}, err
+		}
+	default:
+		t := p.peek()
+		return node{}, errorf(t.line, "expected \";\" or block after %s, got %v", cmd.name, t)
+	}
+	return cmd, nil
+}
+
+// testOrCommand parses the identifier with its arguments and tests.
+func (p *parser) testOrCommand() (node, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return node{}, errorf(t.line, "expected identifier, got %v", t)
+	}
+	n := node{name: t.text, line: t.line}
+
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokTag:
+			p.next()
+			n.args = append(n.args, argument{kind: argTag, line: t.line, tag: t.text})
+			continue
+		case t.kind == tokNumber:
+			p.next()
+			n.args = append(n.args, argument{kind: argNumber, line: t.line, num: t.num})
+			continue
+		case t.kind == tokString || p.isPunct("["):
+			strs, err := p.stringList()
+			if err != nil {
+				return node{}, err
+			}
+			n.args = append(n.args, argument{kind: argStrings, line: t.line, strs: strs})
+			continue
+		}
+		break
+	}
+
+	switch t := p.peek(); {
+	case t.kind == tokIdent:
+		test, err := p.testOrCommand()
+		if err != nil {
+			return node{}, err
+		}
+		n.tests = []node{test}
+	case p.isPunct("("):
+		p.next()
+		for {
+			test, err := p.testOrCommand()
+			if err != nil {
+				return node{}, err
+			}
+			n.tests = append(n.tests, test)
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return node{}, err
+		}
+	}
+	return n, nil
+}
+
+func (p *parser) stringList() ([]string, error) {
+	if t := p.peek(); t.kind == tokString {
+		p.next()
+		return []string{t.text}, nil
+	}
+	if err := p.expectPunct("["); err != nil {
+		return nil, err
+	}
+	var strs []string
+	for {
+		t := p.next()
+		if t.kind != tokString {
+			return nil, errorf(t.line, "expected string, got %v", t)
+		}
+		strs = append(strs, t.text)
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expectPunct("]"); err != nil {
+		return nil, err
+	}
+	return strs, nil
+}
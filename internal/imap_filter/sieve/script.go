@@ -0,0 +1,712 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+)
+
+// supportedExtensions lists capabilities that can be used in require.
+var supportedExtensions = map[string]bool{
+	"fileinto":   true,
+	"envelope":   true,
+	"imap4flags": true,
+}
+
+// Extensions returns the list of supported Sieve extensions, e.g. for the
+// SIEVE capability of ManageSieve.
+func Extensions() []string {
+	return []string{"envelope", "fileinto", "imap4flags"}
+}
+
+// Script is a compiled Sieve script.
+//
+// Only a subset of RFC 5228 is supported, see Compile.
+type Script struct {
+	cmds []command
+}
+
+type cmdKind int
+
+const (
+	cmdIf cmdKind = iota
+	cmdKeep
+	cmdFileinto
+	cmdStop
+	cmdSetFlag
+	cmdAddFlag
+	cmdRemoveFlag
+)
+
+type branch struct {
+	// cond is nil for else.
+	cond  test
+	block []command
+}
+
+type command struct {
+	kind     cmdKind
+	branches []branch
+	folder   string
+	flags    []string
+	hasFlags bool
+}
+
+type test interface {
+	eval(msg *message) bool
+}
+
+type compiler struct {
+	required map[string]bool
+}
+
+// Compile parses and validates the script.
+//
+// Supported are the require, if/elsif/else, stop, keep and fileinto
+// commands, the true, false, not, allof, anyof, exists, header, address,
+// envelope and size tests and the setflag, addflag and removeflag actions of
+// imap4flags along with the :flags argument. Scripts using other commands,
+// including discard, redirect and reject, are rejected.
+func Compile(src string) (*Script, error) {
+	nodes, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c := compiler{required: map[string]bool{}}
+	for len(nodes) > 0 && nodes[0].name == "require" {
+		if err := c.require(nodes[0]); err != nil {
+			return nil, err
+		}
+		nodes = nodes[1:]
+	}
+	cmds, err := c.block(nodes)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{cmds: cmds}, nil
+}
+
+func (c *compiler) require(n node) error {
+	if len(n.args) != 1 || n.args[0].kind != argStrings || len(n.tests) != 0 || n.hasBlock {
+		return errorf(n.line, "require expects a string list")
+	}
+	for _, ext := range n.args[0].strs {
+		if !supportedExtensions[ext] {
+			return errorf(n.line, "unsupported extension %q", ext)
+		}
+		c.required[ext] = true
+	}
+	return nil
+}
+
+func (c *compiler) needs(ext string, n node) error {
+	if !c.required[ext] {
+		return errorf(n.line, "%s requires \"require %q\"", n.name, ext)
+	}
+	return nil
+}
+
+func (c *compiler) block(nodes []node) ([]command, error) {
+	var cmds []command
+	for _, n := range nodes {
+		switch n.name {
+		case "if", "elsif", "else":
+			if n.name != "if" && (len(cmds) == 0 || cmds[len(cmds)-1].kind != cmdIf ||
+				cmds[len(cmds)-1].branches[len(cmds[len(cmds)-1].branches)-1].cond == nil) {
+				return nil, errorf(n.line, "%s without if", n.name)
+			}
+			br, err := c.branch(n)
+			if err != nil {
+				return nil, err
+			}
+			if n.name == "if" {
+				cmds = append(cmds, command{kind: cmdIf, branches: []branch{br}})
+			} else {
+				last := &cmds[len(cmds)-1]
+				last.branches = append(last.branches, br)
+			}
+			continue
+		}
+
+		if n.hasBlock {
+			return nil, errorf(n.line, "%s does not accept a block", n.name)
+		}
+		if len(n.tests) != 0 {
+			return nil, errorf(n.line, "%s does not accept tests", n.name)
+		}
+		cmd, err := c.action(n)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (c *compiler) branch(n node) (branch, error) {
+	if !n.hasBlock {
+		return branch{}, errorf(n.line, "%s requires a block", n.name)
+	}
+	if len(n.args) != 0 {
+		return branch{}, errorf(n.line, "unexpected arguments for %s", n.name)
+	}
+
+	var br branch
+	if n.name == "else" {
+		if len(n.tests) != 0 {
+			return branch{}, errorf(n.line, "else does not accept tests")
+		}
+	} else {
+		if len(n.tests) != 1 {
+			return branch{}, errorf(n.line, "%s requires a single test", n.name)
+		}
+		cond, err := c.test(n.tests[0])
+		if err != nil {
+			return branch{}, err
+		}
+		br.cond = cond
+	}
+
+	block, err := c.block(n.block)
+	if err != nil {
+		return branch{}, err
+	}
+	br.block = block
+	return br, nil
+}
+
+func (c *compiler) action(n node) (command, error) {
+	switch n.name {
+	case "stop":
+		if len(n.args) != 0 {
+			return command{}, errorf(n.line, "stop does not accept arguments")
+		}
+		return command{kind: cmdStop}, nil
+	case "keep", "fileinto":
+		cmd := command{kind: cmdKeep}
+		if n.name == "fileinto" {
+			if err := c.needs("fileinto", n); err != nil {
+				return command{}, err
+			}
+			cmd.kind = cmdFileinto
+		}
+		var positional []argument
+		for i := 0; i < len(n.args); i++ {
+			arg := n.args[i]
+			if arg.kind != argTag {
+				positional = append(positional, arg)
+				continue
+			}
+			if arg.tag != "flags" {
+				return command{}, errorf(arg.line, "unsupported argument :%s for %s", arg.tag, n.name)
+			}
+			if err := c.needs("imap4flags", n); err != nil {
+				return command{}, err
+			}
+			if i+1 >= len(n.args) || n.args[i+1].kind != argStrings {
+				return command{}, errorf(arg.line, ":flags expects a string list")
+			}
+			i++
+			cmd.hasFlags = true
+			cmd.flags = splitFlags(n.args[i].strs)
+		}
+		if cmd.kind == cmdKeep {
+			if len(positional) != 0 {
+				return command{}, errorf(n.line, "unexpected arguments for keep")
+			}
+			return cmd, nil
+		}
+		if len(positional) != 1 || positional[0].kind != argStrings || len(positional[0].strs) != 1 {
+			return command{}, errorf(n.line, "fileinto expects a folder name")
+		}
+		cmd.folder = positional[0].strs[0]
+		return cmd, nil
+	case "setflag", "addflag", "removeflag":
+		if err := c.needs("imap4flags", n); err != nil {
+			return command{}, err
+		}
+		if len(n.args) != 1 || n.args[0].kind != argStrings {
+			// Two arguments form uses variables, that are not supported.
+			return command{}, errorf(n.line, "%s expects a single string list", n.name)
+		}
+		kind := map[string]cmdKind{"setflag": cmdSetFlag, "addflag": cmdAddFlag, "removeflag": cmdRemoveFlag}[n.name]
+		return command{kind: kind, flags: splitFlags(n.args[0].strs)}, nil
+	case "require":
+		return command{}, errorf(n.line, "require is allowed only at the beginning of the script")
+	case "discard", "redirect", "reject", "ereject", "vacation", "notify":
+		return command{}, errorf(n.line, "%s is not supported", n.name)
+	}
+	return command{}, errorf(n.line, "unknown command %q", n.name)
+}
+
+func (c *compiler) test(n node) (test, error) {
+	if n.hasBlock {
+		return nil, errorf(n.line, "unexpected block")
+	}
+
+	switch n.name {
+	case "true", "false":
+		if len(n.args) != 0 || len(n.tests) != 0 {
+			return nil, errorf(n.line, "%s does not accept arguments", n.name)
+		}
+		return constTest(n.name == "true"), nil
+	case "not":
+		if len(n.args) != 0 || len(n.tests) != 1 {
+			return nil, errorf(n.line, "not requires a single test")
+		}
+		t, err := c.test(n.tests[0])
+		if err != nil {
+			return nil, err
+		}
+		return notTest{t}, nil
+	case "allof", "anyof":
+		if len(n.args) != 0 || len(n.tests) == 0 {
+			return nil, errorf(n.line, "%s requires a test list", n.name)
+		}
+		lt := listTest{all: n.name == "allof"}
+		for _, sub := range n.tests {
+			t, err := c.test(sub)
+			if err != nil {
+				return nil, err
+			}
+			lt.tests = append(lt.tests, t)
+		}
+		return lt, nil
+	}
+
+	if len(n.tests) != 0 {
+		return nil, errorf(n.line, "%s does not accept tests", n.name)
+	}
+
+	switch n.name {
+	case "exists":
+		if len(n.args) != 1 || n.args[0].kind != argStrings {
+			return nil, errorf(n.line, "exists expects a list of header names")
+		}
+		return existsTest{headers: n.args[0].strs}, nil
+	case "size":
+		if len(n.args) != 2 || n.args[0].kind != argTag || n.args[1].kind != argNumber ||
+			(n.args[0].tag != "over" && n.args[0].tag != "under") {
+			return nil, errorf(n.line, "size expects :over or :under and a number")
+		}
+		return sizeTest{over: n.args[0].tag == "over", limit: n.args[1].num}, nil
+	case "header", "address", "envelope":
+		if n.name == "envelope" {
+			if err := c.needs("envelope", n); err != nil {
+				return nil, err
+			}
+		}
+		return c.matchTest(n)
+	}
+	return nil, errorf(n.line, "unknown test %q", n.name)
+}
+
+func (c *compiler) matchTest(n node) (test, error) {
+	t := matchTest{kind: n.name, matcher: matcher{matchType: "is", comparator: "i;ascii-casemap"}, part: "all"}
+
+	var positional [][]string
+	for i := 0; i < len(n.args); i++ {
+		arg := n.args[i]
+		switch arg.kind {
+		case argStrings:
+			positional = append(positional, arg.strs)
+			continue
+		case argNumber:
+			return nil, errorf(arg.line, "unexpected number")
+		}
+
+		switch arg.tag {
+		case "is", "contains", "matches":
+			t.matcher.matchType = arg.tag
+		case "comparator":
+			if i+1 >= len(n.args) || n.args[i+1].kind != argStrings || len(n.args[i+1].strs) != 1 {
+				return nil, errorf(arg.line, ":comparator expects a string")
+			}
+			i++
+			t.matcher.comparator = n.args[i].strs[0]
+			if t.matcher.comparator != "i;ascii-casemap" && t.matcher.comparator != "i;octet" {
+				return nil, errorf(arg.line, "unsupported comparator %q", t.matcher.comparator)
+			}
+		case "all", "localpart", "domain":
+			if n.name == "header" {
+				return nil, errorf(arg.line, "unexpected argument :%s for header", arg.tag)
+			}
+			t.part = arg.tag
+		default:
+			return nil, errorf(arg.line, "unsupported argument :%s for %s", arg.tag, n.name)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, errorf(n.line, "%s expects a list of header names and a list of keys", n.name)
+	}
+	t.headers, t.keys = positional[0], positional[1]
+
+	if n.name == "envelope" {
+		for _, part := range t.headers {
+			if p := strings.ToLower(part); p != "from" && p != "to" {
+				return nil, errorf(n.line, "unsupported envelope part %q", part)
+			}
+		}
+	}
+	return t, nil
+}
+
+func splitFlags(strs []string) []string {
+	var flags []string
+	for _, s := range strs {
+		flags = append(flags, strings.Fields(s)...)
+	}
+	return flags
+}
+
+// message is the message the script is executed for.
+type message struct {
+	hdr      textproto.Header
+	mailFrom string
+	rcptTo   string
+	size     int64
+}
+
+// action is the result of the script execution.
+type action struct {
+	// folder is empty for keep.
+	folder string
+	flags  []string
+}
+
+type execState struct {
+	msg      *message
+	flags    []string
+	keep     *action
+	fileinto *action
+}
+
+// execute runs the script and returns the folder to store the message in
+// (empty for the default one) and additional flags.
+//
+// Only one copy of the message is stored: if both keep and fileinto are
+// executed, the target of the first fileinto is used.
+func (s *Script) execute(msg *message) action {
+	st := execState{msg: msg}
+	st.run(s.cmds)
+
+	switch {
+	case st.fileinto != nil:
+		return *st.fileinto
+	case st.keep != nil:
+		return *st.keep
+	}
+	// Implicit keep.
+	return action{flags: st.flags}
+}
+
+// run executes commands and returns false if execution should stop.
+func (st *execState) run(cmds []command) bool {
+	for _, cmd := range cmds {
+		switch cmd.kind {
+		case cmdIf:
+			for _, br := range cmd.branches {
+				if br.cond == nil || br.cond.eval(st.msg) {
+					if !st.run(br.block) {
+						return false
+					}
+					break
+				}
+			}
+		case cmdStop:
+			return false
+		case cmdKeep, cmdFileinto:
+			act := action{folder: cmd.folder, flags: st.flags}
+			if cmd.hasFlags {
+				act.flags = cmd.flags
+			}
+			act.flags = append([]string(nil), act.flags...)
+			if cmd.kind == cmdKeep && st.keep == nil {
+				st.keep = &act
+			}
+			if cmd.kind == cmdFileinto && st.fileinto == nil {
+				st.fileinto = &act
+			}
+		case cmdSetFlag:
+			st.flags = nil
+			st.addFlags(cmd.flags)
+		case cmdAddFlag:
+			st.addFlags(cmd.flags)
+		case cmdRemoveFlag:
+			kept := st.flags[:0]
+			for _, f := range st.flags {
+				if !containsFold(cmd.flags, f) {
+					kept = append(kept, f)
+				}
+			}
+			st.flags = kept
+		}
+	}
+	return true
+}
+
+func (st *execState) addFlags(flags []string) {
+	for _, f := range flags {
+		if !containsFold(st.flags, f) {
+			st.flags = append(st.flags, f)
+		}
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type constTest bool
+
+func (t constTest) eval(*message) bool {
+	return bool(t)
+}
+
+type notTest struct {
+	t test
+}
+
+func (t notTest) eval(msg *message) bool {
+	return !t.t.eval(msg)
+}
+
+type listTest struct {
+	all   bool
+	tests []test
+}
+
+func (t listTest) eval(msg *message) bool {
+	for _, sub := range t.tests {
+		if sub.eval(msg) != t.all {
+			return !t.all
+		}
+	}
+	return t.all
+}
+
+type existsTest struct {
+	headers []string
+}
+
+func (t existsTest) eval(msg *message) bool {
+	for _, h := range t.headers {
+		if !msg.hdr.Has(h) {
+			return false
+		}
+	}
+	return true
+}
+
+type sizeTest struct {
+	over  bool
+	limit int64
+}
+
+func (t sizeTest) eval(msg *message) bool {
+	if t.over {
+		return msg.size > t.limit
+	}
+	return msg.size < t.limit
+}
+
+var wordDecoder = mime.WordDecoder{CharsetReader: charset.Reader}
+
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+type matchTest struct {
+	kind    string
+	headers []string
+	keys    []string
+	part    string
+	matcher matcher
+}
+
+func (t matchTest) eval(msg *message) bool {
+	for _, v := range t.values(msg) {
+		if t.matcher.match(v, t.keys) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t matchTest) values(msg *message) []string {
+	var values []string
+	switch t.kind {
+	case "header":
+		for _, h := range t.headers {
+			for _, v := range msg.hdr.Values(h) {
+				values = append(values, decodeHeader(strings.TrimSpace(v)))
+			}
+		}
+	case "address":
+		for _, h := range t.headers {
+			for _, v := range msg.hdr.Values(h) {
+				for _, addr := range parseAddrs(v) {
+					values = append(values, addressPart(addr, t.part))
+				}
+			}
+		}
+	case "envelope":
+		for _, part := range t.headers {
+			addr := msg.mailFrom
+			if strings.EqualFold(part, "to") {
+				addr = msg.rcptTo
+			}
+			values = append(values, addressPart(addr, t.part))
+		}
+	}
+	return values
+}
+
+func parseAddrs(value string) []string {
+	parser := mail.AddressParser{WordDecoder: &wordDecoder}
+	list, err := parser.ParseList(value)
+	if err != nil {
+		return []string{strings.TrimSpace(value)}
+	}
+	addrs := make([]string, 0, len(list))
+	for _, addr := range list {
+		addrs = append(addrs, addr.Address)
+	}
+	return addrs
+}
+
+func addressPart(addr, part string) string {
+	i := strings.LastIndexByte(addr, '@')
+	switch part {
+	case "localpart":
+		if i == -1 {
+			return addr
+		}
+		return addr[:i]
+	case "domain":
+		if i == -1 {
+			return ""
+		}
+		return addr[i+1:]
+	}
+	return addr
+}
+
+type matcher struct {
+	matchType  string
+	comparator string
+}
+
+func (m matcher) match(value string, keys []string) bool {
+	fold := m.comparator == "i;ascii-casemap"
+	if fold {
+		value = asciiLower(value)
+	}
+	for _, key := range keys {
+		if fold {
+			key = asciiLower(key)
+		}
+		var ok bool
+		switch m.matchType {
+		case "is":
+			ok = value == key
+		case "contains":
+			ok = strings.Contains(value, key)
+		case "matches":
+			ok = wildcardMatch(value, key)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+// wildcardMatch reports whether value matches the :matches pattern where "*"
+// matches any sequence, "?" matches a single character and "\" escapes the
+// next character.
+func wildcardMatch(value, pattern string) bool {
+	v := []rune(value)
+	p := []rune(pattern)
+
+	var (
+		vi, pi         int
+		starPi, starVi = -1, 0
+	)
+	for vi < len(v) {
+		if pi < len(p) {
+			switch {
+			case p[pi] == '*':
+				starPi, starVi = pi, vi
+				pi++
+				continue
+			case p[pi] == '?':
+				vi++
+				pi++
+				continue
+			case p[pi] == '\\' && pi+1 < len(p):
+				if p[pi+1] == v[vi] {
+					vi++
+					pi += 2
+					continue
+				}
+			case p[pi] == v[vi]:
+				vi++
+				pi++
+				continue
+			}
+		}
+		if starPi == -1 {
+			return false
+		}
+		// Let the last star consume one more character.
+		starVi++
+		vi = starVi
+		pi = starPi + 1
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
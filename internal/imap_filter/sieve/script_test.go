@@ -0,0 +1,226 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func testMsg() *message {
+	hdr := textproto.Header{}
+	hdr.Add("From", `"Mailing List" <List-Owner@Lists.Example.org>`)
+	hdr.Add("To", "user@example.com, other@example.net")
+	hdr.Add("Subject", "=?utf-8?q?Weekly_=E2=9C=93_digest?=")
+	hdr.Add("List-Id", "<announce.lists.example.org>")
+	return &message{
+		hdr:      hdr,
+		mailFrom: "bounces@lists.example.org",
+		rcptTo:   "user+lists@example.com",
+		size:     2048,
+	}
+}
+
+func TestScript_Execute(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		folder string
+		flags  []string
+	}{
+		{
+			name:   "empty",
+			script: ``,
+		},
+		{
+			name: "header contains",
+			script: `require "fileinto";
+if header :contains "subject" "WEEKLY" { fileinto "Digests"; }`,
+			folder: "Digests",
+		},
+		{
+			name: "decoded header",
+			script: `require ["fileinto"];
+if header :is "Subject" "Weekly ✓ digest" { fileinto "Decoded"; }`,
+			folder: "Decoded",
+		},
+		{
+			name: "address domain",
+			script: `require "fileinto";
+if address :domain :is "from" "lists.example.org" { fileinto "Lists"; }
+else { fileinto "Other"; }`,
+			folder: "Lists",
+		},
+		{
+			name: "address localpart octet",
+			script: `require "fileinto";
+if address :localpart :comparator "i;octet" :is "from" "list-owner" { fileinto "Wrong"; }
+elsif address :localpart :comparator "i;octet" :is "from" "List-Owner" { fileinto "Right"; }`,
+			folder: "Right",
+		},
+		{
+			name: "envelope matches",
+			script: `require ["envelope", "fileinto"];
+if envelope :matches "to" "*+lists@*" { fileinto "Plus"; stop; }
+fileinto "NotReached";`,
+			folder: "Plus",
+		},
+		{
+			name: "stop keeps implicit keep",
+			script: `require "fileinto";
+stop;
+fileinto "NotReached";`,
+		},
+		{
+			name: "allof anyof not",
+			script: `require "fileinto";
+if allof (exists ["List-Id", "From"], not exists "X-Spam", anyof (false, size :over 1K)) {
+	fileinto "Big";
+}`,
+			folder: "Big",
+		},
+		{
+			name: "size under",
+			script: `require "fileinto";
+if size :under 1K { fileinto "Small"; }`,
+		},
+		{
+			name: "flags",
+			script: `require ["imap4flags", "fileinto"];
+setflag "\\Seen";
+addflag ["\\Flagged $Label1", "\\seen"];
+removeflag "$label1";
+fileinto "Flagged";`,
+			folder: "Flagged",
+			flags:  []string{`\Seen`, `\Flagged`},
+		},
+		{
+			name: "explicit flags",
+			script: `require ["imap4flags"];
+addflag "\\Seen";
+keep :flags "$Important";`,
+			flags: []string{"$Important"},
+		},
+		{
+			name: "first fileinto wins",
+			script: `require "fileinto";
+keep;
+fileinto "First";
+fileinto "Second";`,
+			folder: "First",
+		},
+		{
+			name: "multiline and comments",
+			script: `# comment
+require "fileinto"; /* block
+comment */
+# Multi-line strings end with CRLF.
+if not header :contains "list-id" text:
+announce
+.
+{ fileinto "Multi"; }`,
+			folder: "Multi",
+		},
+		{
+			name: "wildcards",
+			script: `require "fileinto";
+if header :matches "list-id" "<announce.*.???????.org>" { fileinto "Wildcard"; }`,
+			folder: "Wildcard",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := Compile(c.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			act := s.execute(testMsg())
+			if act.folder != c.folder {
+				t.Errorf("wrong folder: %q", act.folder)
+			}
+			if len(act.flags) != 0 || len(c.flags) != 0 {
+				if !reflect.DeepEqual(act.flags, c.flags) {
+					t.Errorf("wrong flags: %v", act.flags)
+				}
+			}
+		})
+	}
+}
+
+func TestCompile_Errors(t *testing.T) {
+	cases := []struct {
+		script string
+		line   int
+	}{
+		{`fileinto "x";`, 1},
+		{`require "vacation";`, 1},
+		{"keep;\nrequire \"fileinto\";", 2},
+		{"keep;\n\ndiscard;", 3},
+		{`redirect "a@example.org";`, 1},
+		{`if header :is "a" {}`, 1},
+		{`if true { keep; `, 1},
+		{"else { keep; }", 1},
+		{`if true { keep; } else { keep; } else { keep; }`, 1},
+		{`if size :over "1" { keep; }`, 1},
+		{`if header :regex "a" "b" { keep; }`, 1},
+		{`if header :comparator "i;unicode-casemap" "a" "b" { keep; }`, 1},
+		{`require "envelope"; if envelope "cc" "b" { keep; }`, 1},
+		{`keep`, 1},
+		{"\"unterminated", 1},
+		{`setflag "a";`, 1},
+		{`unknown;`, 1},
+	}
+	for _, c := range cases {
+		_, err := Compile(c.script)
+		var scriptErr *ScriptError
+		if !errors.As(err, &scriptErr) {
+			t.Errorf("%q: expected ScriptError, got %v", c.script, err)
+			continue
+		}
+		if scriptErr.Line != c.line {
+			t.Errorf("%q: wrong line in %v", c.script, err)
+		}
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	cases := []struct {
+		value, pattern string
+		match          bool
+	}{
+		{"", "", true},
+		{"", "*", true},
+		{"abc", "a*c", true},
+		{"abc", "a?c", true},
+		{"abc", "a??c", false},
+		{"a*c", `a\*c`, true},
+		{"abc", `a\*c`, false},
+		{"aXbXc", "*b*c", true},
+		{"ab", "*b*c", false},
+		{"✓x", "?x", true},
+	}
+	for _, c := range cases {
+		if got := wildcardMatch(c.value, c.pattern); got != c.match {
+			t.Errorf("wildcardMatch(%q, %q) = %v", c.value, c.pattern, got)
+		}
+	}
+}
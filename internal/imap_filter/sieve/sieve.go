@@ -0,0 +1,307 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sieve implements the imap.filter.sieve module that filters
+// delivered messages using per-account Sieve scripts stored in an SQL
+// database.
+package sieve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/log"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm"
+)
+
+const modName = "imap.filter.sieve"
+
+var (
+	// ErrNoSuchScript is returned if the account has no script with the
+	// name.
+	ErrNoSuchScript = errors.New("no such script")
+	// ErrScriptActive is returned by Delete for the active script.
+	ErrScriptActive = errors.New("script is active")
+)
+
+var migrations = []mdb.Migration{
+	{
+		ID: "20261014_imap_filter_sieve",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.SieveScript{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.SieveScript{})
+		},
+	},
+}
+
+// cachedScript is the compiled active script of the account. Entries are
+// valid as long as the script ID and UpdatedAt match the database.
+type cachedScript struct {
+	id        uint
+	updatedAt time.Time
+	script    *Script
+	err       error
+}
+
+type Filter struct {
+	instName string
+	log      log.Logger
+
+	db    *gorm.DB
+	cache *lru.Cache[string, cachedScript]
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Filter{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (f *Filter) Name() string {
+	return modName
+}
+
+func (f *Filter) InstanceName() string {
+	return f.instName
+}
+
+func (f *Filter) Init(cfg *config.Map) error {
+	var (
+		driver    string
+		dsn       mdb.DSN
+		dbOpts    mdb.Options
+		cacheSize int
+	)
+	cfg.Bool("debug", true, false, &f.log.Debug)
+	mdb.DriverDirective(cfg, "driver", true, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", true, nil, &dsn)
+	mdb.Directives(cfg, &dbOpts)
+	cfg.Int("cache_size", false, false, 1000, &cacheSize)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if cacheSize < 1 {
+		return config.NodeErr(cfg.Block, "cache_size should be positive")
+	}
+
+	var err error
+	f.cache, err = lru.New[string, cachedScript](cacheSize)
+	if err != nil {
+		return err
+	}
+
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "%v", err)
+	}
+	dbOpts.Log = f.log
+	dbOpts.MetricsName = f.instName
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	if err := mdb.Migrate(db, migrations); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	f.db = db
+	return nil
+}
+
+func (f *Filter) Close() error {
+	if f.db == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	return mdb.Close(ctx, f.db)
+}
+
+// GORM implements mdb.Provider.
+func (f *Filter) GORM() *gorm.DB {
+	return f.db
+}
+
+// activeScript returns the compiled active script of the account or nil if
+// the account has no active script.
+func (f *Filter) activeScript(ctx context.Context, account string) (*Script, error) {
+	var meta mdb.SieveScript
+	err := f.db.WithContext(ctx).Select("id", "updated_at").
+		Where("account = ? AND active = ?", account, true).
+		Take(&meta).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		f.cache.Remove(account)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cached, ok := f.cache.Get(account); ok && cached.id == meta.ID && cached.updatedAt.Equal(meta.UpdatedAt) {
+		return cached.script, cached.err
+	}
+
+	var row mdb.SieveScript
+	if err := f.db.WithContext(ctx).Where("id = ?", meta.ID).Take(&row).Error; err != nil {
+		return nil, err
+	}
+	script, err := Compile(row.Content)
+	if err != nil {
+		err = fmt.Errorf("script %s: %w", row.Name, err)
+	}
+	f.cache.Add(account, cachedScript{id: row.ID, updatedAt: row.UpdatedAt, script: script, err: err})
+	return script, err
+}
+
+// IMAPFilter implements module.IMAPFilter.
+//
+// If the account has no active script or it cannot be compiled, the message
+// is delivered as if there was no filter.
+func (f *Filter) IMAPFilter(accountName string, rcptTo string, meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, err error) {
+	script, err := f.activeScript(context.TODO(), accountName)
+	if err != nil {
+		f.log.Error("failed to load the active script, delivering without filtering", err,
+			"rcpt", accountName, "msg_id", meta.ID)
+		return "", nil, nil
+	}
+	if script == nil {
+		return "", nil, nil
+	}
+
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, hdr); err != nil {
+		return "", nil, err
+	}
+	act := script.execute(&message{
+		hdr:      hdr,
+		mailFrom: meta.OriginalFrom,
+		rcptTo:   rcptTo,
+		size:     int64(hdrBuf.Len()) + int64(body.Len()),
+	})
+	f.log.Debugf("%s: folder: %q, flags: %v", accountName, act.folder, act.flags)
+	return act.folder, act.flags, nil
+}
+
+// List returns the scripts of the account ordered by name.
+func (f *Filter) List(ctx context.Context, account string) ([]mdb.SieveScript, error) {
+	var rows []mdb.SieveScript
+	err := f.db.WithContext(ctx).Where("account = ?", account).Order("name").Find(&rows).Error
+	return rows, err
+}
+
+// Get returns the script of the account with the name.
+func (f *Filter) Get(ctx context.Context, account, name string) (mdb.SieveScript, error) {
+	var row mdb.SieveScript
+	err := f.db.WithContext(ctx).Where("account = ? AND name = ?", account, name).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return mdb.SieveScript{}, ErrNoSuchScript
+	}
+	return row, err
+}
+
+// Put creates or replaces the script of the account. The script is not
+// stored if it cannot be compiled, returned *ScriptError describes the
+// problem.
+//
+// Replacing the active script keeps it active.
+func (f *Filter) Put(ctx context.Context, account, name, content string) error {
+	if name == "" {
+		return errors.New("empty script name")
+	}
+	if _, err := Compile(content); err != nil {
+		return err
+	}
+
+	_, err := mdb.Upsert(ctx, f.db, &mdb.SieveScript{
+		Account:   account,
+		Name:      name,
+		Content:   content,
+		UpdatedAt: time.Now().UTC(),
+	}, []string{"account", "name"}, map[string]interface{}{
+		"content":    content,
+		"updated_at": time.Now().UTC(),
+	})
+	return err
+}
+
+// Activate makes the script active and deactivates other scripts of the
+// account. If name is empty, all scripts are deactivated.
+func (f *Filter) Activate(ctx context.Context, account, name string) error {
+	_, err := mdb.WithTx(ctx, f.db, func(tx *gorm.DB) error {
+		if name != "" {
+			if err := tx.Where("account = ? AND name = ?", account, name).Take(&mdb.SieveScript{}).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return ErrNoSuchScript
+				}
+				return err
+			}
+		}
+
+		err := tx.Model(&mdb.SieveScript{}).
+			Where("account = ? AND active = ? AND name <> ?", account, true, name).
+			Updates(map[string]interface{}{"active": false, "updated_at": time.Now().UTC()}).Error
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return nil
+		}
+		return tx.Model(&mdb.SieveScript{}).
+			Where("account = ? AND name = ? AND active = ?", account, name, false).
+			Updates(map[string]interface{}{"active": true, "updated_at": time.Now().UTC()}).Error
+	}, mdb.TxOptions{})
+	return err
+}
+
+// Delete removes the script of the account. The active script cannot be
+// removed.
+func (f *Filter) Delete(ctx context.Context, account, name string) error {
+	script, err := f.Get(ctx, account, name)
+	if err != nil {
+		return err
+	}
+	if script.Active {
+		return ErrScriptActive
+	}
+
+	res := f.db.WithContext(ctx).Where("id = ? AND active = ?", script.ID, false).Delete(&mdb.SieveScript{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		// Activated concurrently.
+		return ErrScriptActive
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+	mdb.RegisterMigrations(modName, migrations)
+}
@@ -0,0 +1,172 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func newTestFilter(t *testing.T) *Filter {
+	t.Helper()
+
+	mod, err := New(modName, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := mod.(*Filter)
+	f.log = testutils.Logger(t, modName)
+
+	err = f.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(t.TempDir(), "sieve.db")}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func filterFolder(t *testing.T, f *Filter, account string) string {
+	t.Helper()
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	folder, _, err := f.IMAPFilter(account, account, &module.MsgMetadata{ID: "test"}, hdr, buffer.MemoryBuffer{Slice: []byte("body")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return folder
+}
+
+func TestFilter_Scripts(t *testing.T) {
+	f := newTestFilter(t)
+	ctx := context.Background()
+
+	err := f.Put(ctx, "user@example.org", "broken", "require \"fileinto\";\nfileinto;")
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) || scriptErr.Line != 2 {
+		t.Fatalf("expected ScriptError, got %v", err)
+	}
+
+	if err := f.Put(ctx, "user@example.org", "a", `require "fileinto"; fileinto "A";`); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Put(ctx, "user@example.org", "b", `require "fileinto"; fileinto "B";`); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Put(ctx, "other@example.org", "a", `keep;`); err != nil {
+		t.Fatal(err)
+	}
+
+	// No active script.
+	if folder := filterFolder(t, f, "user@example.org"); folder != "" {
+		t.Fatalf("wrong folder: %q", folder)
+	}
+
+	if err := f.Activate(ctx, "user@example.org", "c"); !errors.Is(err, ErrNoSuchScript) {
+		t.Fatalf("expected ErrNoSuchScript, got %v", err)
+	}
+	if err := f.Activate(ctx, "user@example.org", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if folder := filterFolder(t, f, "user@example.org"); folder != "A" {
+		t.Fatalf("wrong folder: %q", folder)
+	}
+
+	// Only one script is active.
+	if err := f.Activate(ctx, "user@example.org", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if folder := filterFolder(t, f, "user@example.org"); folder != "B" {
+		t.Fatalf("wrong folder: %q", folder)
+	}
+	list, err := f.List(ctx, "user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "a" || list[0].Active || list[1].Name != "b" || !list[1].Active {
+		t.Fatalf("wrong scripts: %+v", list)
+	}
+
+	// The cached script is replaced.
+	if err := f.Put(ctx, "user@example.org", "b", `require "fileinto"; fileinto "B2";`); err != nil {
+		t.Fatal(err)
+	}
+	if folder := filterFolder(t, f, "user@example.org"); folder != "B2" {
+		t.Fatalf("wrong folder: %q", folder)
+	}
+
+	if err := f.Delete(ctx, "user@example.org", "b"); !errors.Is(err, ErrScriptActive) {
+		t.Fatalf("expected ErrScriptActive, got %v", err)
+	}
+	if err := f.Delete(ctx, "user@example.org", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Get(ctx, "user@example.org", "a"); !errors.Is(err, ErrNoSuchScript) {
+		t.Fatalf("expected ErrNoSuchScript, got %v", err)
+	}
+
+	if err := f.Activate(ctx, "user@example.org", ""); err != nil {
+		t.Fatal(err)
+	}
+	if folder := filterFolder(t, f, "user@example.org"); folder != "" {
+		t.Fatalf("wrong folder: %q", folder)
+	}
+	if err := f.Delete(ctx, "user@example.org", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := f.List(ctx, "other@example.org"); err != nil || len(list) != 1 {
+		t.Fatalf("scripts of another account are changed: %+v %v", list, err)
+	}
+}
+
+func TestFilter_BrokenStoredScript(t *testing.T) {
+	f := newTestFilter(t)
+
+	err := f.db.Create(&mdb.SieveScript{
+		Account: "user@example.org",
+		Name:    "broken",
+		Content: `fileinto "Unrequired";`,
+		Active:  true,
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if folder := filterFolder(t, f, "user@example.org"); folder != "" {
+			t.Fatalf("wrong folder: %q", folder)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/themadorg/madmail/framework/dns"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm"
+)
+
+// ErrNoSuchKey is returned by ActivateKey if the domain has no key with the
+// selector.
+var ErrNoSuchKey = errors.New("no such DKIM key")
+
+// dbKeyMigrations create the dkim_keys table, see mdb.Migrate.
+var dbKeyMigrations = []mdb.Migration{
+	{
+		ID: "20261014_modify_dkim_keys",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.DKIMKey{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.DKIMKey{})
+		},
+	},
+}
+
+// dbKey is an active key loaded from the database.
+type dbKey struct {
+	selector string
+	signer   crypto.Signer
+}
+
+// selectorKey identifies a key in Modifier.dbSelectorKeys.
+type selectorKey struct {
+	domain   string
+	selector string
+}
+
+// activeKey returns the active key of the normalized domain loaded by
+// refreshKeys.
+func (m *Modifier) activeKey(normDomain string) (dbKey, bool) {
+	m.dbKeysLck.RLock()
+	defer m.dbKeysLck.RUnlock()
+	key, ok := m.dbKeys[normDomain]
+	return key, ok
+}
+
+// selectorKey returns the key of the normalized domain with the selector
+// loaded by refreshKeys, it is used only with domain_table.
+func (m *Modifier) selectorKey(normDomain, selector string) (dbKey, bool) {
+	m.dbKeysLck.RLock()
+	defer m.dbKeysLck.RUnlock()
+	key, ok := m.dbSelectorKeys[selectorKey{normDomain, selector}]
+	return key, ok
+}
+
+// refreshKeys loads active keys of the configured domains and removes keys
+// retired more than the grace period ago.
+//
+// With domain_table, keys of all domains that are active or not activated
+// yet are loaded, so that DKIMSelector of the domain can select any of them.
+func (m *Modifier) refreshKeys(ctx context.Context) error {
+	var rows []mdb.DKIMKey
+	q := m.db.WithContext(ctx).Where("active = ?", true)
+	if m.domainSettings != nil {
+		q = m.db.WithContext(ctx).Where("active = ? OR retired_at IS NULL", true)
+	}
+	if err := q.Find(&rows).Error; err != nil {
+		return fmt.Errorf("modify.dkim: load keys: %w", err)
+	}
+
+	keys := make(map[string]dbKey, len(rows))
+	selectorKeys := make(map[selectorKey]dbKey)
+	for _, row := range rows {
+		if _, ok := m.normDomains[row.Domain]; !ok && m.domainSettings == nil {
+			continue
+		}
+		signer, err := parseKey([]byte(row.PrivateKey))
+		if err != nil {
+			m.log.Error("invalid key, skipping", err, "domain", row.Domain, "selector", row.Selector)
+			continue
+		}
+		key := dbKey{selector: row.Selector, signer: signer}
+		if m.domainSettings != nil {
+			selectorKeys[selectorKey{row.Domain, row.Selector}] = key
+		}
+		if row.Active {
+			keys[row.Domain] = key
+		}
+	}
+	for domain := range m.normDomains {
+		if _, ok := keys[domain]; !ok {
+			m.log.Msg("no active key for domain", "domain", domain)
+		}
+	}
+
+	m.dbKeysLck.Lock()
+	m.dbKeys = keys
+	m.dbSelectorKeys = selectorKeys
+	m.dbKeysLck.Unlock()
+
+	if m.gracePeriod > 0 {
+		err := m.db.WithContext(ctx).
+			Where("active = ? AND retired_at < ?", false, time.Now().Add(-m.gracePeriod)).
+			Delete(&mdb.DKIMKey{}).Error
+		if err != nil {
+			return fmt.Errorf("modify.dkim: remove retired keys: %w", err)
+		}
+	}
+	return nil
+}
+
+func (m *Modifier) refreshLoop() {
+	defer func() {
+		if err := recover(); err != nil {
+			m.log.Printf("panic during keys refresh: %v\n%s", err, debug.Stack())
+		}
+	}()
+
+	t := time.NewTicker(m.refreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := m.refreshKeys(context.Background()); err != nil {
+				m.log.Error("keys refresh failed, using previously loaded keys", err)
+			}
+		case <-m.stopRefresh:
+			m.stopRefresh <- struct{}{}
+			return
+		}
+	}
+}
+
+// RotateKey generates a new key for the domain using algo (newkey_algo value)
+// and stores it as inactive under a new selector. The selector and the
+// value of the TXT record to publish at selector._domainkey.domain are
+// returned.
+//
+// The key is not used for signing until it is activated using ActivateKey.
+func (m *Modifier) RotateKey(ctx context.Context, domain, algo string) (selector, record string, err error) {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return "", "", fmt.Errorf("modify.dkim: unable to normalize domain %s: %w", domain, err)
+	}
+
+	pkey, dkimName, err := generateKey(algo)
+	if err != nil {
+		return "", "", fmt.Errorf("modify.dkim: %w", err)
+	}
+	keyBlob, err := encodeKey(pkey)
+	if err != nil {
+		return "", "", fmt.Errorf("modify.dkim: %w", err)
+	}
+	record, err = dnsRecord(dkimName, pkey)
+	if err != nil {
+		return "", "", fmt.Errorf("modify.dkim: %w", err)
+	}
+
+	now := time.Now().UTC()
+	key := mdb.DKIMKey{
+		Domain:     normDomain,
+		Selector:   "s" + now.Format("20060102150405"),
+		PrivateKey: string(keyBlob),
+		Algorithm:  algo,
+		CreatedAt:  now,
+	}
+	if err := m.db.WithContext(ctx).Create(&key).Error; err != nil {
+		return "", "", fmt.Errorf("modify.dkim: store key: %w", err)
+	}
+	return key.Selector, record, nil
+}
+
+// ActivateKey makes the key with the selector the one used to sign messages
+// for the domain. The previously active key is retired and removed after the
+// grace period, its selector is returned so that its DNS record can be
+// removed afterwards.
+//
+// Running instances start using the key after the next refresh.
+func (m *Modifier) ActivateKey(ctx context.Context, domain, selector string) (retired []string, err error) {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return nil, fmt.Errorf("modify.dkim: unable to normalize domain %s: %w", domain, err)
+	}
+
+	err = m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var key mdb.DKIMKey
+		err := tx.Where("domain = ? AND selector = ?", normDomain, selector).Take(&key).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNoSuchKey
+			}
+			return err
+		}
+		if key.Active {
+			return nil
+		}
+
+		err = tx.Model(&mdb.DKIMKey{}).
+			Where("domain = ? AND active = ?", normDomain, true).
+			Pluck("selector", &retired).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&mdb.DKIMKey{}).
+			Where("domain = ? AND active = ?", normDomain, true).
+			Updates(map[string]interface{}{"active": false, "retired_at": time.Now()}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&mdb.DKIMKey{}).
+			Where("id = ?", key.ID).
+			Updates(map[string]interface{}{"active": true, "retired_at": nil}).Error
+	})
+	if err != nil {
+		if errors.Is(err, ErrNoSuchKey) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("modify.dkim: activate key: %w", err)
+	}
+	return retired, nil
+}
+
+// Keys returns all keys stored in the database, ordered by domain and
+// creation time. Private keys are not loaded.
+func (m *Modifier) Keys(ctx context.Context) ([]mdb.DKIMKey, error) {
+	var keys []mdb.DKIMKey
+	err := m.db.WithContext(ctx).
+		Omit("private_key").
+		Order("domain, created_at").
+		Find(&keys).Error
+	if err != nil {
+		return nil, fmt.Errorf("modify.dkim: list keys: %w", err)
+	}
+	return keys, nil
+}
+
+// GracePeriod returns the time retired keys are kept for.
+func (m *Modifier) GracePeriod() time.Duration {
+	return m.gracePeriod
+}
+
+// GORM implements mdb.Provider. It returns nil if keys are not stored in a
+// database.
+func (m *Modifier) GORM() *gorm.DB {
+	return m.db
+}
+
+func (m *Modifier) Close() error {
+	if m.db == nil {
+		return nil
+	}
+	if m.stopRefresh != nil {
+		m.stopRefresh <- struct{}{}
+		<-m.stopRefresh
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	return mdb.Close(ctx, m.db)
+}
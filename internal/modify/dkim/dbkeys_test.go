@@ -0,0 +1,272 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/exterrors"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func newTestDBModifier(t *testing.T, dbPath string, extra ...config.Node) *Modifier {
+	t.Helper()
+
+	if err := mdb.SetEncryptionKeys(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mdb.SetEncryptionKeys() })
+
+	mod, err := New("", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: append([]config.Node{
+			{Name: "domains", Args: []string{"example.org"}},
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{dbPath}},
+		}, extra...),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func signDBTestMsg(m *Modifier, from string) (textproto.Header, []byte, error) {
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if _, err := state.RewriteSender(context.Background(), from); err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("From", "<"+from+">")
+	hdr.Add("Subject", "heya")
+	body := []byte("hello there\r\n")
+	err = state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: body})
+	return hdr, body, err
+}
+
+func TestDBKeys(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "dkim.db")
+	m := newTestDBModifier(t, dbPath)
+	ctx := context.Background()
+
+	// No active key, the message is not sent unsigned.
+	_, _, err := signDBTestMsg(m, "test@example.org")
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("expected a temporary error without an active key, got %v", err)
+	}
+
+	oldSelector, _, err := m.RotateKey(ctx, "example.org", "ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ActivateKey(ctx, "example.org", oldSelector); err != nil {
+		t.Fatal(err)
+	}
+
+	// Selectors are timestamps with a resolution of one second.
+	time.Sleep(time.Second)
+	selector, record, err := m.RotateKey(ctx, "example.org", "rsa2048")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.refreshKeys(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := m.activeKey("example.org"); key.selector != oldSelector {
+		t.Fatalf("new key is used before activation: %s", key.selector)
+	}
+
+	retired, err := m.ActivateKey(ctx, "example.org", selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retired) != 1 || retired[0] != oldSelector {
+		t.Fatalf("wrong retired keys: %v", retired)
+	}
+	if _, err := m.ActivateKey(ctx, "example.org", "nonexistent"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("expected ErrNoSuchKey, got %v", err)
+	}
+
+	// Other instances pick up the key from the database.
+	other := newTestDBModifier(t, dbPath)
+	hdr, body, err := signDBTestMsg(other, "test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fullBody bytes.Buffer
+	if err := textproto.WriteHeader(&fullBody, hdr); err != nil {
+		t.Fatal(err)
+	}
+	fullBody.Write(body)
+	resolver := &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		selector + "._domainkey.example.org.": {TXT: []string{record}},
+	}}
+	verifs, err := dkim.VerifyWithOptions(&fullBody, &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return resolver.LookupTXT(context.Background(), domain)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifs) != 1 || verifs[0].Err != nil {
+		t.Fatalf("verification failed: %+v", verifs)
+	}
+
+	keys, err := m.Keys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Selector != oldSelector || keys[0].RetiredAt == nil || !keys[1].Active {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+	if keys[0].PrivateKey != "" {
+		t.Fatal("Keys returned private keys")
+	}
+
+	// Retired keys are removed after the grace period.
+	m.gracePeriod = time.Nanosecond
+	if err := m.refreshKeys(ctx); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = m.Keys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Selector != selector {
+		t.Fatalf("retired key was not removed: %+v", keys)
+	}
+}
+
+func TestDBKeys_MissingKeyIgnore(t *testing.T) {
+	m := newTestDBModifier(t, filepath.Join(t.TempDir(), "dkim.db"),
+		config.Node{Name: "missing_key_action", Args: []string{"ignore"}})
+
+	hdr, _, err := signDBTestMsg(m, "test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Has("DKIM-Signature") {
+		t.Fatal("message is signed without a key")
+	}
+}
+
+type testDomainSource map[string]mdb.Domain
+
+func (s testDomainSource) Domain(_ context.Context, name string) (mdb.Domain, bool, error) {
+	d, ok := s[name]
+	return d, ok, nil
+}
+
+func TestDBKeys_DomainTable(t *testing.T) {
+	m := newTestDBModifier(t, filepath.Join(t.TempDir(), "dkim.db"))
+	ctx := context.Background()
+	domains := testDomainSource{
+		"example.com": {Name: "example.com", Enabled: true},
+		"example.net": {Name: "example.net", Enabled: false},
+	}
+	m.domainSettings = domains
+
+	signedWith := func(from string) string {
+		t.Helper()
+
+		hdr, _, err := signDBTestMsg(m, from)
+		if err != nil {
+			t.Fatalf("%s: %v", from, err)
+		}
+		if !hdr.Has("DKIM-Signature") {
+			return ""
+		}
+		for _, tag := range strings.Split(hdr.Get("DKIM-Signature"), ";") {
+			if k, v, _ := strings.Cut(strings.TrimSpace(tag), "="); k == "s" {
+				return v
+			}
+		}
+		t.Fatalf("%s: no selector in the signature", from)
+		return ""
+	}
+
+	for _, domain := range []string{"example.com", "example.net"} {
+		selector, _, err := m.RotateKey(ctx, domain, "ed25519")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.ActivateKey(ctx, domain, selector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Second)
+	pending, _, err := m.RotateKey(ctx, "example.com", "ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.refreshKeys(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	active, _ := m.activeKey("example.com")
+	if got := signedWith("test@example.com"); got != active.selector {
+		t.Errorf("expected the active key %s to be used, got %q", active.selector, got)
+	}
+	// Disabled domains are not signed.
+	if got := signedWith("test@example.net"); got != "" {
+		t.Errorf("message from a disabled domain is signed using %s", got)
+	}
+
+	domains["example.com"] = mdb.Domain{Name: "example.com", Enabled: true, DKIMSelector: pending}
+	if got := signedWith("test@example.com"); got != pending {
+		t.Errorf("expected the domain selector %s to be used, got %q", pending, got)
+	}
+
+	domains["example.com"] = mdb.Domain{Name: "example.com", Enabled: true, DKIMSelector: "nonexistent"}
+	_, _, err = signDBTestMsg(m, "test@example.com")
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("expected a temporary error for a missing key, got %v", err)
+	}
+}
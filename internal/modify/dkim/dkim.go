@@ -27,6 +27,7 @@ import (
 	"path/filepath"
 	"runtime/trace"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -34,12 +35,16 @@ import (
 	"github.com/themadorg/madmail/framework/address"
 	"github.com/themadorg/madmail/framework/buffer"
 	"github.com/themadorg/madmail/framework/config"
+	modconfig "github.com/themadorg/madmail/framework/config/module"
 	"github.com/themadorg/madmail/framework/dns"
 	"github.com/themadorg/madmail/framework/exterrors"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/table"
 	"github.com/themadorg/madmail/internal/target"
 	"golang.org/x/net/idna"
+	"gorm.io/gorm"
 )
 
 const Day = 86400 * time.Second
@@ -108,14 +113,34 @@ type Modifier struct {
 	multipleFromOk bool
 	signSubdomains bool
 
+	// normDomains contains domains in the form used as keys of signers and
+	// dbKeys.
+	normDomains map[string]struct{}
+
+	// Set if keys are stored in the database instead of key_path.
+	db               *gorm.DB
+	dbKeysLck        sync.RWMutex
+	dbKeys           map[string]dbKey
+	refreshInterval  time.Duration
+	gracePeriod      time.Duration
+	missingKeyReject bool
+	stopRefresh      chan struct{}
+
+	// domainSettings, if set, contains additional domains to sign messages
+	// for and selects keys by mdb.Domain.DKIMSelector. Keys of all domains
+	// that are not retired are loaded to dbSelectorKeys.
+	domainSettings table.DomainSource
+	dbSelectorKeys map[selectorKey]dbKey
+
 	log log.Logger
 }
 
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	m := &Modifier{
-		instName: instName,
-		signers:  map[string]crypto.Signer{},
-		log:      log.Logger{Name: "modify.dkim"},
+		instName:    instName,
+		signers:     map[string]crypto.Signer{},
+		normDomains: map[string]struct{}{},
+		log:         log.Logger{Name: "modify.dkim"},
 	}
 
 	if len(inlineArgs) == 0 {
@@ -141,9 +166,14 @@ func (m *Modifier) InstanceName() string {
 
 func (m *Modifier) Init(cfg *config.Map) error {
 	var (
-		hashName        string
-		keyPathTemplate string
-		newKeyAlgo      string
+		hashName         string
+		keyPathTemplate  string
+		newKeyAlgo       string
+		driver           string
+		dsn              mdb.DSN
+		dbOpts           mdb.Options
+		missingKeyAction string
+		domainTable      module.Table
 	)
 
 	cfg.Bool("debug", true, false, &m.log.Debug)
@@ -165,6 +195,14 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
 	cfg.Bool("allow_multiple_from", false, false, &m.multipleFromOk)
 	cfg.Bool("sign_subdomains", false, false, &m.signSubdomains)
+	mdb.DriverDirective(cfg, "driver", false, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", false, nil, &dsn)
+	mdb.Directives(cfg, &dbOpts)
+	cfg.Duration("key_refresh_interval", false, false, time.Minute, &m.refreshInterval)
+	cfg.Duration("key_grace_period", false, false, 7*Day, &m.gracePeriod)
+	cfg.Enum("missing_key_action", false, false,
+		[]string{"reject", "ignore"}, "reject", &missingKeyAction)
+	cfg.Custom("domain_table", false, false, nil, modconfig.TableDirective, &domainTable)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -173,7 +211,7 @@ func (m *Modifier) Init(cfg *config.Map) error {
 	if len(m.domains) == 0 {
 		return errors.New("sign_domain: at least one domain is needed")
 	}
-	if m.selector == "" {
+	if m.selector == "" && driver == "" {
 		return errors.New("sign_domain: selector is not specified")
 	}
 	if m.signSubdomains && len(m.domains) > 1 {
@@ -185,11 +223,33 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		panic("modify.dkim.Init: Hash function allowed by config matcher but not present in hashFuncs")
 	}
 
+	m.missingKeyReject = missingKeyAction == "reject"
+
+	if domainTable != nil {
+		if driver == "" {
+			return errors.New("modify.dkim: domain_table requires keys stored in the database")
+		}
+		domains, ok := domainTable.(table.DomainSource)
+		if !ok {
+			return errors.New("modify.dkim: domain_table should be table.sql_domains")
+		}
+		m.domainSettings = domains
+	}
+
 	for _, domain := range m.domains {
 		if _, err := idna.ToASCII(domain); err != nil {
 			m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
 		}
 
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+		}
+		m.normDomains[normDomain] = struct{}{}
+		if driver != "" {
+			continue
+		}
+
 		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
 		keyPath := keyValues.Replace(keyPathTemplate)
 
@@ -208,13 +268,43 @@ func (m *Modifier) Init(cfg *config.Map) error {
 				newKeyAlgo, keyPath, dnsPath, m.selector, domain)
 		}
 
-		normDomain, err := dns.ForLookup(domain)
-		if err != nil {
-			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
-		}
 		m.signers[normDomain] = signer
 	}
 
+	if driver != "" {
+		return m.initDB(driver, dsn, dbOpts)
+	}
+	return nil
+}
+
+func (m *Modifier) initDB(driver string, dsn mdb.DSN, dbOpts mdb.Options) error {
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return fmt.Errorf("modify.dkim: %w", err)
+	}
+	if m.refreshInterval <= 0 {
+		return errors.New("modify.dkim: key_refresh_interval should be positive")
+	}
+
+	dbOpts.Log = m.log
+	dbOpts.MetricsName = m.instName
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return fmt.Errorf("modify.dkim: failed to open db: %w", err)
+	}
+	if err := mdb.Migrate(db, dbKeyMigrations); err != nil {
+		return fmt.Errorf("modify.dkim: %w", err)
+	}
+	m.db = db
+	m.dbKeys = map[string]dbKey{}
+
+	if err := m.refreshKeys(context.Background()); err != nil {
+		return err
+	}
+	if !module.NoRun {
+		m.stopRefresh = make(chan struct{})
+		go m.refreshLoop()
+	}
 	return nil
 }
 
@@ -303,8 +393,47 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		s.log.Error("unable to normalize domain from envelope sender", err, "domain", domain)
 		return nil
 	}
+	_, configured := s.m.normDomains[normDomain]
 	keySigner := s.m.signers[normDomain]
+	if s.m.db != nil {
+		if key, ok := s.m.activeKey(normDomain); ok {
+			keySigner = key.signer
+			selector = key.selector
+		}
+	}
+	if s.m.domainSettings != nil {
+		d, ok, err := s.m.domainSettings.Domain(ctx, normDomain)
+		if err != nil {
+			return exterrors.WithTemporary(
+				exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"}),
+				true)
+		}
+		switch {
+		case ok && d.Enabled:
+			configured = true
+			if d.DKIMSelector != "" {
+				key, ok := s.m.selectorKey(normDomain, d.DKIMSelector)
+				if !ok {
+					s.log.Msg("no key with the domain selector", "domain", normDomain, "selector", d.DKIMSelector)
+				}
+				keySigner, selector = key.signer, key.selector
+			}
+		case !configured:
+			// Domains removed from the table are not signed even if their
+			// keys are still stored.
+			keySigner = nil
+		}
+	}
 	if keySigner == nil {
+		if configured && s.m.missingKeyReject {
+			return &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Unable to sign the message, try again later",
+				ModifierName: "modify.dkim",
+				Err:          fmt.Errorf("no active key for domain %s", normDomain),
+			}
+		}
 		s.log.Msg("no key for domain", "domain", normDomain)
 		return nil
 	}
@@ -372,4 +501,5 @@ func (s state) Close() error {
 
 func init() {
 	module.Register("modify.dkim", New)
+	mdb.RegisterMigrations("modify.dkim", dbKeyMigrations)
 }
@@ -27,6 +27,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -49,77 +50,97 @@ func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Si
 		return nil, false, err
 	}
 
+	pkey, err = parseKey(pemBlob)
+	if err != nil {
+		return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
+	}
+	return pkey, false, nil
+}
+
+// parseKey parses the PEM-encoded private key.
+func parseKey(pemBlob []byte) (crypto.Signer, error) {
 	block, _ := pem.Decode(pemBlob)
 	if block == nil {
-		return nil, false, fmt.Errorf("modify.dkim: %s: invalid PEM block", keyPath)
+		return nil, errors.New("invalid PEM block")
 	}
 
-	var key interface{}
+	var (
+		key interface{}
+		err error
+	)
 	switch block.Type {
 	case "PRIVATE KEY": // RFC 5208 aka PKCS #8
 		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
-		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
-		}
 	case "RSA PRIVATE KEY": // RFC 3447 aka PKCS #1
 		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
-		}
 	case "EC PRIVATE KEY": // RFC 5915
 		key, err = x509.ParseECPrivateKey(block.Bytes)
-		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
-		}
 	default:
-		return nil, false, fmt.Errorf("modify.dkim: %s: not a private key or unsupported format", keyPath)
+		return nil, errors.New("not a private key or unsupported format")
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	switch key := key.(type) {
 	case *rsa.PrivateKey:
 		if err := key.Validate(); err != nil {
-			return nil, false, err
+			return nil, err
 		}
 		key.Precompute()
-		return key, false, nil
+		return key, nil
 	case ed25519.PrivateKey:
-		return key, false, nil
+		return key, nil
 	case *ecdsa.PublicKey:
-		return nil, false, fmt.Errorf("modify.dkim: %s: ECDSA keys are not supported", keyPath)
+		return nil, errors.New("ECDSA keys are not supported")
 	default:
-		return nil, false, fmt.Errorf("modify.dkim: %s: unknown key type: %T", keyPath, key)
+		return nil, fmt.Errorf("unknown key type: %T", key)
 	}
 }
 
-func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer, error) {
-	wrapErr := func(err error) error {
-		return fmt.Errorf("modify.dkim: generate %s: %w", keyPath, err)
-	}
-
-	m.log.Printf("generating a new %s keypair...", newKeyAlgo)
-
-	var (
-		pkey     crypto.Signer
-		dkimName = newKeyAlgo
-		err      error
-	)
+// generateKey generates a new key for newkey_algo value and returns it
+// together with the algorithm name used in the DNS record.
+func generateKey(newKeyAlgo string) (pkey crypto.Signer, dkimName string, err error) {
 	switch newKeyAlgo {
 	case "rsa4096":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 4096)
+		return pkey, "rsa", err
 	case "rsa2048":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 2048)
+		return pkey, "rsa", err
 	case "ed25519":
 		_, pkey, err = ed25519.GenerateKey(rand.Reader)
+		return pkey, "ed25519", err
 	default:
-		err = fmt.Errorf("unknown key algorithm: %s", newKeyAlgo)
+		return nil, "", fmt.Errorf("unknown key algorithm: %s", newKeyAlgo)
 	}
+}
+
+// encodeKey returns the private key in PKCS #8 PEM format.
+func encodeKey(pkey crypto.Signer) ([]byte, error) {
+	keyBlob, err := x509.MarshalPKCS8PrivateKey(pkey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyBlob,
+	}), nil
+}
+
+func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer, error) {
+	wrapErr := func(err error) error {
+		return fmt.Errorf("modify.dkim: generate %s: %w", keyPath, err)
+	}
+
+	m.log.Printf("generating a new %s keypair...", newKeyAlgo)
+
+	pkey, dkimName, err := generateKey(newKeyAlgo)
 	if err != nil {
 		return nil, wrapErr(err)
 	}
 
-	keyBlob, err := x509.MarshalPKCS8PrivateKey(pkey)
+	keyBlob, err := encodeKey(pkey)
 	if err != nil {
 		return nil, wrapErr(err)
 	}
@@ -140,22 +161,17 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 		return nil, wrapErr(err)
 	}
 
-	if err := pem.Encode(f, &pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: keyBlob,
-	}); err != nil {
+	if _, err := f.Write(keyBlob); err != nil {
 		return nil, wrapErr(err)
 	}
 
 	return pkey, nil
 }
 
-func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, error) {
-	var (
-		keyBlob []byte
-		pubkey  = pkey.Public()
-	)
-	switch pubkey := pubkey.(type) {
+// dnsRecord returns the value of the TXT record with the public key.
+func dnsRecord(dkimAlgoName string, pkey crypto.Signer) (string, error) {
+	var keyBlob []byte
+	switch pubkey := pkey.Public().(type) {
 	case *rsa.PublicKey:
 		var err error
 		keyBlob, err = x509.MarshalPKIXPublicKey(pubkey)
@@ -165,7 +181,15 @@ func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, e
 	case ed25519.PublicKey:
 		keyBlob = pubkey
 	default:
-		panic("modify.dkim.writeDNSRecord: unknown key algorithm")
+		panic("modify.dkim.dnsRecord: unknown key algorithm")
+	}
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimAlgoName, base64.StdEncoding.EncodeToString(keyBlob)), nil
+}
+
+func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, error) {
+	keyRecord, err := dnsRecord(dkimAlgoName, pkey)
+	if err != nil {
+		return "", err
 	}
 
 	dnsPath := keyPath + ".dns"
@@ -176,7 +200,6 @@ func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, e
 	if err != nil {
 		return "", err
 	}
-	keyRecord := fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimAlgoName, base64.StdEncoding.EncodeToString(keyBlob))
 	if _, err := io.WriteString(dnsF, keyRecord); err != nil {
 		return "", err
 	}
@@ -111,6 +111,21 @@ func (d *MsgPipeline) RunEarlyChecks(ctx context.Context, state *module.ConnStat
 	return eg.Wait()
 }
 
+// RunAuthFailureChecks notifies global checks implementing
+// module.AuthFailureCheck about the failed authentication attempt.
+func (d *MsgPipeline) RunAuthFailureChecks(ctx context.Context, state *module.ConnState) error {
+	for _, check := range d.globalChecks {
+		authCheck, ok := check.(module.AuthFailureCheck)
+		if !ok {
+			continue
+		}
+		if err := authCheck.AuthFailed(ctx, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Start starts new message delivery, runs connection and sender checks, sender modifiers
 // and selects source block from config to use for handling.
 //
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/themadorg/madmail/framework/config"
 	"github.com/themadorg/madmail/framework/module"
@@ -89,7 +90,34 @@ func (s *FSStore) Delete(_ context.Context, keys []string) error {
 	return nil
 }
 
+func (s *FSStore) List(ctx context.Context, fn func(key string, modTime time.Time) error) error {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return err
+	}
+	for _, ent := range entries {
+		if ent.IsDir() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := ent.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := fn(ent.Name(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
 	var _ module.BlobStore = &FSStore{}
+	var _ module.BlobLister = &FSStore{}
 	module.Register(FSStore{}.Name(), New)
 }
@@ -1,8 +1,11 @@
 package fs
 
 import (
+	"context"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/themadorg/madmail/framework/module"
 	"github.com/themadorg/madmail/internal/storage/blob"
@@ -17,3 +20,32 @@ func TestFS(t *testing.T) {
 		os.RemoveAll(store.(*FSStore).root)
 	})
 }
+
+func TestFS_List(t *testing.T) {
+	store := &FSStore{instName: "test", root: testutils.Dir(t)}
+	for _, key := range []string{"a", "b"} {
+		blob, err := store.Create(context.Background(), key, module.UnknownBlobSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blob.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		blob.Close()
+	}
+
+	var keys []string
+	err := store.List(context.Background(), func(key string, modTime time.Time) error {
+		if time.Since(modTime) > time.Minute {
+			t.Errorf("%s: wrong modification time: %v", key, modTime)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("want [a b], got %v", keys)
+	}
+}
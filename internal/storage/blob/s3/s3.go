@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
@@ -190,7 +192,24 @@ func (s *Store) Delete(ctx context.Context, keys []string) error {
 	return lastErr
 }
 
+func (s *Store) List(ctx context.Context, fn func(key string, modTime time.Time) error) error {
+	objs := s.cl.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{
+		Prefix:    s.objectPrefix,
+		Recursive: true,
+	})
+	for obj := range objs {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if err := fn(strings.TrimPrefix(obj.Key, s.objectPrefix), obj.LastModified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
 	var _ module.BlobStore = &Store{}
+	var _ module.BlobLister = &Store{}
 	module.Register(modName, New)
 }
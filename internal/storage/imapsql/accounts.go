@@ -0,0 +1,269 @@
+package imapsql
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/themadorg/madmail/framework/address"
+	"github.com/themadorg/madmail/framework/module"
+)
+
+var (
+	// ErrAccountNotEmpty is returned by DeleteAccount for accounts with
+	// messages unless force is set.
+	ErrAccountNotEmpty = errors.New("account has messages")
+
+	// ErrDisableNotSupported is returned by SetAccountEnabled if the
+	// credentials store cannot disable accounts.
+	ErrDisableNotSupported = errors.New("credentials store does not support disabling accounts")
+)
+
+// DefaultFolders are the mailboxes created by CreateAccount in addition to
+// INBOX if AccountOptions.DefaultFolders is set.
+var DefaultFolders = []struct {
+	Name       string
+	SpecialUse string
+}{
+	{"Sent", imap.SentAttr},
+	{"Drafts", imap.DraftsAttr},
+	{"Trash", imap.TrashAttr},
+	{"Junk", imap.JunkAttr},
+}
+
+// AccountDisabler is implemented by credentials stores that can disable
+// accounts without removing them, such as auth.sql.
+type AccountDisabler interface {
+	SetUserEnabled(username string, enabled bool) error
+	UserEnabled(username string) (bool, error)
+}
+
+// AccountOptions controls CreateAccount, the zero value is usable.
+type AccountOptions struct {
+	// Quota is the storage limit in bytes. Zero keeps the default quota.
+	Quota int64
+
+	// DefaultFolders makes CreateAccount create DefaultFolders.
+	DefaultFolders bool
+}
+
+// AccountInfo describes an account returned by ListAccounts.
+type AccountInfo struct {
+	Username string `json:"username"`
+
+	// HasCredentials and HasMailbox report whether the account exists in
+	// the credentials store and the storage.
+	HasCredentials bool `json:"has_credentials"`
+	HasMailbox     bool `json:"has_mailbox"`
+
+	// Enabled is nil if the credentials store cannot disable accounts.
+	Enabled *bool `json:"enabled,omitempty"`
+
+	QuotaUsed    int64 `json:"quota_used"`
+	QuotaMax     int64 `json:"quota_max"`
+	QuotaDefault bool  `json:"quota_default"`
+	Messages     int64 `json:"messages"`
+}
+
+// CreateAccount creates the credentials of the account in creds with the
+// password hashed as configured for it and the IMAP account. If creating the
+// IMAP account fails, the credentials are removed.
+//
+// creds may be nil, then only the IMAP account is created.
+func (store *Storage) CreateAccount(creds module.PlainUserDB, username, password string, opts AccountOptions) error {
+	if creds != nil {
+		if err := creds.CreateUser(username, password); err != nil {
+			return fmt.Errorf("imapsql: create account %s: %w", username, err)
+		}
+	}
+
+	err := store.createAccountMailboxes(username, opts)
+	if err != nil {
+		if creds != nil {
+			if delErr := creds.DeleteUser(username); delErr != nil {
+				store.Log.Error("failed to remove credentials of a partially created account", delErr, "username", username)
+			}
+		}
+		return fmt.Errorf("imapsql: create account %s: %w", username, err)
+	}
+	return nil
+}
+
+func (store *Storage) createAccountMailboxes(username string, opts AccountOptions) error {
+	if err := store.CreateIMAPAcct(username); err != nil {
+		return err
+	}
+	if opts.Quota != 0 {
+		if err := store.SetQuota(username, opts.Quota); err != nil {
+			store.DeleteIMAPAcct(username)
+			return err
+		}
+	}
+	if !opts.DefaultFolders {
+		return nil
+	}
+
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		store.DeleteIMAPAcct(username)
+		return err
+	}
+	for _, folder := range DefaultFolders {
+		if err := u.(*imapsql.User).CreateMailboxSpecial(folder.Name, folder.SpecialUse); err != nil {
+			store.DeleteIMAPAcct(username)
+			return fmt.Errorf("create %s: %w", folder.Name, err)
+		}
+	}
+	return nil
+}
+
+// DeleteAccount removes the IMAP account with all messages and the
+// credentials of the account. Unless force is set, ErrAccountNotEmpty is
+// returned for accounts with messages.
+//
+// creds may be nil, then only the IMAP account is removed.
+func (store *Storage) DeleteAccount(creds module.PlainUserDB, username string, force bool) error {
+	hasMailbox, hasCreds, err := store.accountParts(creds, username)
+	if err != nil {
+		return fmt.Errorf("imapsql: delete account %s: %w", username, err)
+	}
+	if !hasMailbox && !hasCreds {
+		return fmt.Errorf("imapsql: delete account %s: %w", username, imapsql.ErrUserDoesntExists)
+	}
+
+	if hasMailbox {
+		if !force {
+			_, msgs, err := store.usage(username)
+			if err != nil {
+				return fmt.Errorf("imapsql: delete account %s: %w", username, err)
+			}
+			if msgs != 0 {
+				return fmt.Errorf("imapsql: delete account %s: %w (%d messages)", username, ErrAccountNotEmpty, msgs)
+			}
+		}
+		if err := store.DeleteIMAPAcct(username); err != nil {
+			return fmt.Errorf("imapsql: delete account %s: %w", username, err)
+		}
+	}
+	if hasCreds {
+		if err := creds.DeleteUser(username); err != nil {
+			return fmt.Errorf("imapsql: delete account %s: %w", username, err)
+		}
+	}
+	return nil
+}
+
+// accountParts reports whether the account exists in the storage and in
+// creds.
+func (store *Storage) accountParts(creds module.PlainUserDB, username string) (hasMailbox, hasCreds bool, err error) {
+	mboxUsers, err := store.ListIMAPAccts()
+	if err != nil {
+		return false, false, err
+	}
+	hasMailbox = containsUser(mboxUsers, username)
+	if creds != nil {
+		credUsers, err := creds.ListUsers()
+		if err != nil {
+			return false, false, err
+		}
+		hasCreds = containsUser(credUsers, username)
+	}
+	return hasMailbox, hasCreds, nil
+}
+
+func containsUser(users []string, username string) bool {
+	for _, u := range users {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAccountEnabled enables or disables the account in creds. Disabled
+// accounts keep their messages but cannot log in. ErrDisableNotSupported is
+// returned if creds does not implement AccountDisabler.
+func SetAccountEnabled(creds module.PlainUserDB, username string, enabled bool) error {
+	disabler, ok := creds.(AccountDisabler)
+	if !ok {
+		return ErrDisableNotSupported
+	}
+	return disabler.SetUserEnabled(username, enabled)
+}
+
+// ListAccounts returns accounts that exist in creds or in the storage,
+// sorted by username. If domain is not empty, only accounts with addresses
+// in the domain are returned.
+//
+// creds may be nil, then only IMAP accounts are listed.
+func (store *Storage) ListAccounts(creds module.PlainUserDB, domain string) ([]AccountInfo, error) {
+	accounts := make(map[string]*AccountInfo)
+	get := func(username string) *AccountInfo {
+		info, ok := accounts[username]
+		if !ok {
+			info = &AccountInfo{Username: username}
+			accounts[username] = info
+		}
+		return info
+	}
+
+	mboxUsers, err := store.ListIMAPAccts()
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: list accounts: %w", err)
+	}
+	for _, username := range mboxUsers {
+		if inDomain(username, domain) {
+			get(username).HasMailbox = true
+		}
+	}
+	if creds != nil {
+		credUsers, err := creds.ListUsers()
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: list accounts: %w", err)
+		}
+		for _, username := range credUsers {
+			if inDomain(username, domain) {
+				get(username).HasCredentials = true
+			}
+		}
+	}
+
+	disabler, _ := creds.(AccountDisabler)
+	res := make([]AccountInfo, 0, len(accounts))
+	for _, info := range accounts {
+		if info.HasCredentials && disabler != nil {
+			enabled, err := disabler.UserEnabled(info.Username)
+			if err != nil {
+				return nil, fmt.Errorf("imapsql: list accounts: %w", err)
+			}
+			info.Enabled = &enabled
+		}
+		if info.HasMailbox {
+			info.QuotaUsed, info.QuotaMax, info.QuotaDefault, err = store.GetQuota(info.Username)
+			if err != nil {
+				return nil, fmt.Errorf("imapsql: list accounts: %w", err)
+			}
+			_, info.Messages, err = store.usage(info.Username)
+			if err != nil {
+				return nil, fmt.Errorf("imapsql: list accounts: %w", err)
+			}
+		}
+		res = append(res, *info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Username < res[j].Username })
+	return res, nil
+}
+
+func inDomain(username, domain string) bool {
+	if domain == "" {
+		return true
+	}
+	_, userDomain, err := address.Split(username)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(userDomain, domain)
+}
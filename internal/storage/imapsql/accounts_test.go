@@ -0,0 +1,150 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package imapsql
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/themadorg/madmail/framework/module"
+)
+
+// testCreds stores credentials in memory. Methods not used by accounts
+// management panic.
+type testCreds struct {
+	module.PlainUserDB
+	passwords map[string]string
+	disabled  map[string]bool
+}
+
+func (c *testCreds) ListUsers() ([]string, error) {
+	users := make([]string, 0, len(c.passwords))
+	for u := range c.passwords {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (c *testCreds) CreateUser(username, password string) error {
+	if _, ok := c.passwords[username]; ok {
+		return errors.New("user already exists")
+	}
+	c.passwords[username] = password
+	return nil
+}
+
+func (c *testCreds) DeleteUser(username string) error {
+	delete(c.passwords, username)
+	delete(c.disabled, username)
+	return nil
+}
+
+func (c *testCreds) SetUserEnabled(username string, enabled bool) error {
+	c.disabled[username] = !enabled
+	return nil
+}
+
+func (c *testCreds) UserEnabled(username string) (bool, error) {
+	return !c.disabled[username], nil
+}
+
+func TestAccounts(t *testing.T) {
+	store, cleanup := setupTestStorageForJIT(t)
+	defer cleanup()
+	creds := &testCreds{passwords: map[string]string{}, disabled: map[string]bool{}}
+
+	if err := store.CreateAccount(creds, "user@example.org", "secret",
+		AccountOptions{Quota: 1000, DefaultFolders: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateAccount(creds, "other@example.com", "secret", AccountOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateIMAPAcct("nocreds@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	// The IMAP account exists, created credentials are removed.
+	if err := store.CreateAccount(creds, "nocreds@example.org", "secret", AccountOptions{}); err == nil {
+		t.Fatal("expected an error for an existing account")
+	}
+	if _, ok := creds.passwords["nocreds@example.org"]; ok {
+		t.Error("credentials of a partially created account were not removed")
+	}
+
+	u, err := store.GetIMAPAcct("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mboxes) != 1+len(DefaultFolders) {
+		t.Errorf("expected INBOX and default folders, got %v", mboxes)
+	}
+
+	if err := SetAccountEnabled(creds, "other@example.com", false); err != nil {
+		t.Fatal(err)
+	}
+
+	accts, err := store.ListAccounts(creds, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accts) != 2 || accts[0].Username != "nocreds@example.org" || accts[1].Username != "user@example.org" {
+		t.Fatalf("unexpected accounts: %+v", accts)
+	}
+	if accts[0].HasCredentials || accts[0].Enabled != nil || !accts[0].HasMailbox {
+		t.Errorf("unexpected nocreds@example.org info: %+v", accts[0])
+	}
+	if !accts[1].HasCredentials || accts[1].Enabled == nil || !*accts[1].Enabled || accts[1].QuotaMax != 1000 {
+		t.Errorf("unexpected user@example.org info: %+v", accts[1])
+	}
+	accts, err = store.ListAccounts(creds, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accts) != 1 || accts[0].Enabled == nil || *accts[0].Enabled {
+		t.Errorf("unexpected accounts: %+v", accts)
+	}
+
+	d := store.Back.NewDelivery()
+	if err := d.AddRcpt("user@example.org", textproto.Header{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.BodyRaw(strings.NewReader("Subject: test\r\n\r\ntest\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteAccount(creds, "user@example.org", false); !errors.Is(err, ErrAccountNotEmpty) {
+		t.Fatal("expected ErrAccountNotEmpty, got", err)
+	}
+	if err := store.DeleteAccount(creds, "user@example.org", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteAccount(creds, "other@example.com", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteAccount(creds, "other@example.com", false); err == nil {
+		t.Fatal("expected an error for a nonexistent account")
+	}
+
+	accts, err = store.ListAccounts(creds, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accts) != 1 || accts[0].Username != "nocreds@example.org" {
+		t.Errorf("unexpected accounts: %+v", accts)
+	}
+	if len(creds.passwords) != 0 {
+		t.Errorf("credentials were not removed: %v", creds.passwords)
+	}
+}
@@ -0,0 +1,725 @@
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// BackupManifestName is the name of the manifest file in the backup
+	// directory.
+	BackupManifestName = "manifest.json"
+
+	// BackupFormatMbox stores each mailbox as a single mbox file using the
+	// mboxrd quoting of "From " lines.
+	BackupFormatMbox = "mbox"
+	// BackupFormatEML stores each message as a separate .eml file.
+	BackupFormatEML = "eml"
+
+	backupVersion = 1
+)
+
+// ExportOptions controls ExportAccount, the zero value is usable.
+type ExportOptions struct {
+	// Format is BackupFormatMbox (the default) or BackupFormatEML.
+	Format string
+
+	// Settings stored by other modules are written to the manifest as is,
+	// see mdb.ExportAccountSettings.
+	Settings mdb.AccountSettings
+}
+
+// BackupManifest describes the account backup. It is stored as JSON in
+// BackupManifestName.
+type BackupManifest struct {
+	Version   int                 `json:"version"`
+	Account   string              `json:"account"`
+	CreatedAt time.Time           `json:"created_at"`
+	Format    string              `json:"format"`
+	Quota     *BackupQuota        `json:"quota,omitempty"`
+	Settings  mdb.AccountSettings `json:"settings"`
+	Mailboxes []BackupMailbox     `json:"mailboxes"`
+}
+
+// BackupQuota is the quota of the account, it is stored only if the account
+// does not use the default quota.
+type BackupQuota struct {
+	MaxStorage  int64 `json:"max_storage"`
+	MaxMessages int64 `json:"max_messages"`
+}
+
+// BackupMailbox describes a mailbox in the backup. Path is the mbox file or
+// the directory with .eml files and Index is the JSON Lines file with the
+// UID, INTERNALDATE, size, flags and SHA-256 of each message, both are
+// relative to the backup directory.
+//
+// SHA256 is the hex-encoded hash of all messages of the mailbox
+// concatenated in the index order, it does not depend on the format.
+type BackupMailbox struct {
+	Name        string `json:"name"`
+	SpecialUse  string `json:"special_use,omitempty"`
+	Subscribed  bool   `json:"subscribed"`
+	UidValidity uint32 `json:"uid_validity"`
+	Path        string `json:"path"`
+	Index       string `json:"index"`
+	Messages    int    `json:"messages"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// backupMessage is a line of the mailbox index. File is set only for
+// BackupFormatEML and is relative to BackupMailbox.Path.
+type backupMessage struct {
+	UID    uint32    `json:"uid"`
+	Date   time.Time `json:"date"`
+	Size   int64     `json:"size"`
+	Flags  []string  `json:"flags,omitempty"`
+	SHA256 string    `json:"sha256"`
+	File   string    `json:"file,omitempty"`
+}
+
+// ExportAccount writes the messages of the account and the manifest to dir,
+// which is created if needed. Mailboxes are read in a single transaction
+// with the repeatable read isolation level, see imapsql.Backend.ExportUser,
+// and bodies are streamed to the files, so memory usage does not depend on
+// the size of the account.
+//
+// The manifest is written last, a directory without it is an incomplete
+// backup. Existing backups are not overwritten.
+func (store *Storage) ExportAccount(ctx context.Context, username, dir string, opts ExportOptions) (*BackupManifest, error) {
+	if opts.Format == "" {
+		opts.Format = BackupFormatMbox
+	}
+	if opts.Format != BackupFormatMbox && opts.Format != BackupFormatEML {
+		return nil, fmt.Errorf("imapsql: export %s: unknown format: %s", username, opts.Format)
+	}
+	if _, err := os.Stat(filepath.Join(dir, BackupManifestName)); err == nil {
+		return nil, fmt.Errorf("imapsql: export %s: %w: %s", username, os.ErrExist, filepath.Join(dir, BackupManifestName))
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "mailboxes"), 0o700); err != nil {
+		return nil, fmt.Errorf("imapsql: export %s: %w", username, err)
+	}
+
+	manifest := &BackupManifest{
+		Version:   backupVersion,
+		Account:   username,
+		CreatedAt: time.Now().UTC(),
+		Format:    opts.Format,
+		Settings:  opts.Settings,
+		Mailboxes: []BackupMailbox{},
+	}
+	maxBytes, maxMsgs, isDefault, err := store.quotaLimits(username)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: export %s: %w", username, err)
+	}
+	if !isDefault {
+		manifest.Quota = &BackupQuota{MaxStorage: maxBytes, MaxMessages: maxMsgs}
+	}
+
+	w := &backupWriter{ctx: ctx, dir: dir, manifest: manifest}
+	err = store.Back.ExportUser(username, w)
+	if closeErr := w.closeMailbox(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: export %s: %w", username, err)
+	}
+
+	if err := writeBackupManifest(dir, manifest); err != nil {
+		return nil, fmt.Errorf("imapsql: export %s: %w", username, err)
+	}
+	return manifest, nil
+}
+
+func writeBackupManifest(dir string, manifest *BackupManifest) error {
+	blob, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, BackupManifestName+".tmp")
+	if err := os.WriteFile(tmp, append(blob, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, BackupManifestName))
+}
+
+// backupWriter writes mailboxes passed by ExportUser to the backup
+// directory.
+type backupWriter struct {
+	ctx      context.Context
+	dir      string
+	manifest *BackupManifest
+
+	// State of the current mailbox.
+	mbox     *BackupMailbox
+	data     *os.File
+	dataBuf  *bufio.Writer
+	index    *os.File
+	indexBuf *bufio.Writer
+	mboxHash hash.Hash
+}
+
+func (w *backupWriter) Mailbox(mbox imapsql.ExportedMailbox) error {
+	if err := w.closeMailbox(); err != nil {
+		return err
+	}
+
+	base := fmt.Sprintf("mailboxes/%04d", len(w.manifest.Mailboxes)+1)
+	w.mbox = &BackupMailbox{
+		Name:        mbox.Name,
+		SpecialUse:  mbox.SpecialUse,
+		Subscribed:  mbox.Subscribed,
+		UidValidity: mbox.UidValidity,
+		Index:       base + ".jsonl",
+	}
+	w.mboxHash = sha256.New()
+
+	var err error
+	if w.manifest.Format == BackupFormatMbox {
+		w.mbox.Path = base + ".mbox"
+		w.data, err = os.OpenFile(filepath.Join(w.dir, w.mbox.Path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		w.dataBuf = bufio.NewWriter(w.data)
+	} else {
+		w.mbox.Path = base
+		if err := os.MkdirAll(filepath.Join(w.dir, w.mbox.Path), 0o700); err != nil {
+			return err
+		}
+	}
+
+	w.index, err = os.OpenFile(filepath.Join(w.dir, w.mbox.Index), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w.indexBuf = bufio.NewWriter(w.index)
+	return nil
+}
+
+func (w *backupWriter) Message(msg imapsql.ExportedMessage) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	entry := backupMessage{
+		UID:   msg.UID,
+		Date:  msg.Date.UTC(),
+		Flags: msg.Flags,
+	}
+	msgHash := sha256.New()
+	body := io.TeeReader(msg.Body, io.MultiWriter(msgHash, w.mboxHash))
+
+	var err error
+	if w.manifest.Format == BackupFormatMbox {
+		entry.Size, err = writeMboxrdMessage(w.dataBuf, entry.Date, body)
+	} else {
+		entry.File = fmt.Sprintf("%06d.eml", w.mbox.Messages+1)
+		entry.Size, err = writeFile(filepath.Join(w.dir, w.mbox.Path, entry.File), body)
+	}
+	if err != nil {
+		return err
+	}
+	entry.SHA256 = hex.EncodeToString(msgHash.Sum(nil))
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := w.indexBuf.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	w.mbox.Messages++
+	w.mbox.Size += entry.Size
+	return nil
+}
+
+// closeMailbox flushes the files of the current mailbox and adds it to the
+// manifest.
+func (w *backupWriter) closeMailbox() error {
+	if w.mbox == nil {
+		return nil
+	}
+	mbox := w.mbox
+	w.mbox = nil
+
+	var errs []error
+	if w.data != nil {
+		errs = append(errs, w.dataBuf.Flush(), w.data.Close())
+		w.data, w.dataBuf = nil, nil
+	}
+	errs = append(errs, w.indexBuf.Flush(), w.index.Close())
+	w.index, w.indexBuf = nil, nil
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	mbox.SHA256 = hex.EncodeToString(w.mboxHash.Sum(nil))
+	w.manifest.Mailboxes = append(w.manifest.Mailboxes, *mbox)
+	return nil
+}
+
+func writeFile(path string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// isMboxFromLine reports whether the line should be quoted in mboxrd format,
+// i.e. it is "From " preceded by any number of '>'.
+func isMboxFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// writeMboxrdMessage writes the message with the From_ line to the mbox
+// file. Lines matching isMboxFromLine are prefixed with '>'. The number of
+// message bytes read from r is returned.
+func writeMboxrdMessage(w *bufio.Writer, date time.Time, r io.Reader) (int64, error) {
+	if _, err := fmt.Fprintf(w, "From MAILER-DAEMON %s\n", date.Format(time.ANSIC)); err != nil {
+		return 0, err
+	}
+
+	br := bufio.NewReader(r)
+	lineStart := true
+	var n int64
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(chunk) != 0 {
+			if lineStart && isMboxFromLine(chunk) {
+				if err := w.WriteByte('>'); err != nil {
+					return n, err
+				}
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return n, err
+			}
+			n += int64(len(chunk))
+			lineStart = chunk[len(chunk)-1] == '\n'
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if !lineStart {
+		if err := w.WriteByte('\n'); err != nil {
+			return n, err
+		}
+	}
+	return n, w.WriteByte('\n')
+}
+
+// mboxrdReader reads messages from the mbox file written by
+// writeMboxrdMessage. Message sizes are taken from the index, so the
+// separators written around messages are not a part of them.
+type mboxrdReader struct {
+	br *bufio.Reader
+
+	// State of the current message.
+	remaining int64
+	pending   []byte
+	lineStart bool
+}
+
+// next skips to the next From_ line. The following Read calls return at
+// most size bytes of the message with mboxrd quoting removed.
+func (r *mboxrdReader) next(size int64) error {
+	for {
+		line, err := r.br.ReadSlice('\n')
+		if bytes.HasPrefix(line, []byte("From ")) && err != bufio.ErrBufferFull {
+			break
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+	r.remaining = size
+	r.pending = nil
+	r.lineStart = true
+	return nil
+}
+
+func (r *mboxrdReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+		chunk, err := r.br.ReadSlice('\n')
+		if len(chunk) == 0 {
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if r.lineStart && chunk[0] == '>' && isMboxFromLine(chunk) {
+			chunk = chunk[1:]
+		}
+		r.lineStart = chunk[len(chunk)-1] == '\n'
+		if int64(len(chunk)) > r.remaining {
+			chunk = chunk[:r.remaining]
+		}
+		r.pending = chunk
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+// ReadBackupManifest reads the manifest of the backup stored in dir.
+func ReadBackupManifest(dir string) (*BackupManifest, error) {
+	blob, err := os.ReadFile(filepath.Join(dir, BackupManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(blob, manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", BackupManifestName, err)
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("%s: unsupported version: %d", BackupManifestName, manifest.Version)
+	}
+	if manifest.Format != BackupFormatMbox && manifest.Format != BackupFormatEML {
+		return nil, fmt.Errorf("%s: unknown format: %s", BackupManifestName, manifest.Format)
+	}
+	return manifest, nil
+}
+
+// backupMailboxReader iterates over messages of the mailbox in the backup.
+type backupMailboxReader struct {
+	dir    string
+	format string
+	mbox   BackupMailbox
+
+	index *os.File
+	dec   *json.Decoder
+	data  *os.File
+	mboxr *mboxrdReader
+	file  *os.File
+}
+
+func openBackupMailbox(dir, format string, mbox BackupMailbox) (*backupMailboxReader, error) {
+	r := &backupMailboxReader{dir: dir, format: format, mbox: mbox}
+	var err error
+	r.index, err = os.Open(filepath.Join(dir, filepath.FromSlash(mbox.Index)))
+	if err != nil {
+		return nil, err
+	}
+	r.dec = json.NewDecoder(bufio.NewReader(r.index))
+	if format == BackupFormatMbox {
+		r.data, err = os.Open(filepath.Join(dir, filepath.FromSlash(mbox.Path)))
+		if err != nil {
+			r.index.Close()
+			return nil, err
+		}
+		r.mboxr = &mboxrdReader{br: bufio.NewReader(r.data)}
+	}
+	return r, nil
+}
+
+// next returns the next message and the reader for its body, valid until
+// the next call. io.EOF is returned after the last message.
+func (r *backupMailboxReader) next() (backupMessage, io.Reader, error) {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+
+	var msg backupMessage
+	if err := r.dec.Decode(&msg); err != nil {
+		return msg, nil, err
+	}
+	if r.format == BackupFormatMbox {
+		if err := r.mboxr.next(msg.Size); err != nil {
+			return msg, nil, fmt.Errorf("%s: UID %d: %w", r.mbox.Path, msg.UID, err)
+		}
+		return msg, r.mboxr, nil
+	}
+
+	if msg.File == "" || filepath.Base(msg.File) != msg.File {
+		return msg, nil, fmt.Errorf("%s: UID %d: invalid file name: %q", r.mbox.Index, msg.UID, msg.File)
+	}
+	var err error
+	r.file, err = os.Open(filepath.Join(r.dir, filepath.FromSlash(r.mbox.Path), msg.File))
+	if err != nil {
+		return msg, nil, err
+	}
+	return msg, io.LimitReader(r.file, msg.Size), nil
+}
+
+func (r *backupMailboxReader) Close() error {
+	if r.file != nil {
+		r.file.Close()
+	}
+	if r.data != nil {
+		r.data.Close()
+	}
+	return r.index.Close()
+}
+
+// VerifyBackupMailbox reads all messages of the mailbox in the backup stored
+// in dir and compares their hashes with the index and the manifest.
+func VerifyBackupMailbox(dir, format string, mbox BackupMailbox) error {
+	r, err := openBackupMailbox(dir, format, mbox)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	mboxHash := sha256.New()
+	count := 0
+	for {
+		msg, body, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		msgHash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(msgHash, mboxHash), body)
+		if err != nil {
+			return fmt.Errorf("UID %d: %w", msg.UID, err)
+		}
+		if n != msg.Size {
+			return fmt.Errorf("UID %d: expected %d bytes, got %d", msg.UID, msg.Size, n)
+		}
+		if sum := hex.EncodeToString(msgHash.Sum(nil)); sum != msg.SHA256 {
+			return fmt.Errorf("UID %d: checksum mismatch", msg.UID)
+		}
+		count++
+	}
+	if count != mbox.Messages {
+		return fmt.Errorf("expected %d messages, got %d", mbox.Messages, count)
+	}
+	if sum := hex.EncodeToString(mboxHash.Sum(nil)); sum != mbox.SHA256 {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+// RestoreOptions controls RestoreAccount, the zero value is usable.
+type RestoreOptions struct {
+	// Policy is mdb.ConflictSkip if empty.
+	Policy mdb.ConflictPolicy
+}
+
+// RestoreResult is the outcome of restoring one mailbox.
+type RestoreResult struct {
+	Mailbox string
+
+	// Restored is the number of restored messages. Skipped is the number
+	// of messages not restored because of the conflict policy.
+	Restored int
+	Skipped  int
+
+	// Errors are the messages that could not be restored.
+	Errors []error
+}
+
+// RestoreAccount restores the mailboxes and the quota from the backup
+// stored in dir into the existing account username, which does not have to
+// be the account the backup was made for. Settings stored by other modules
+// are restored separately, see mdb.RestoreAccountSettings.
+//
+// Each mailbox is verified using VerifyBackupMailbox before restoring it,
+// mailboxes that fail the check are not restored. Existing mailboxes with
+// messages are handled according to opts.Policy, see mdb.ConflictPolicy.
+// SHA-256 hashes of restored messages are recorded in the imported_messages
+// table, as for ImportMaildir, so ConflictMerge skips messages restored by
+// an earlier run and an interrupted restore can be continued using it.
+//
+// Messages are appended the same way as using IMAP APPEND and the account
+// quota is enforced. The error is returned if the restore cannot continue,
+// results for the already processed mailboxes are returned along with it.
+func (store *Storage) RestoreAccount(ctx context.Context, username, dir string, manifest *BackupManifest, opts RestoreOptions) ([]RestoreResult, error) {
+	if opts.Policy == "" {
+		opts.Policy = mdb.ConflictSkip
+	}
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: restore %s: %w", username, err)
+	}
+	defer u.Logout()
+	if err := store.GORMDB.AutoMigrate(&mdb.ImportedMessage{}); err != nil {
+		return nil, fmt.Errorf("imapsql: restore %s: %w", username, err)
+	}
+
+	if manifest.Quota != nil {
+		if err := store.restoreQuota(username, *manifest.Quota, opts.Policy); err != nil {
+			return nil, fmt.Errorf("imapsql: restore %s: %w", username, err)
+		}
+	}
+
+	results := make([]RestoreResult, 0, len(manifest.Mailboxes))
+	for _, mbox := range manifest.Mailboxes {
+		res := RestoreResult{Mailbox: mbox.Name}
+		err := store.restoreMailbox(ctx, u.(*imapsql.User), username, dir, manifest.Format, mbox, opts, &res)
+		results = append(results, res)
+		if err != nil {
+			return results, fmt.Errorf("imapsql: restore %s: %s: %w", username, mbox.Name, err)
+		}
+	}
+	return results, nil
+}
+
+func (store *Storage) restoreQuota(username string, quota BackupQuota, policy mdb.ConflictPolicy) error {
+	_, _, isDefault, err := store.quotaLimits(username)
+	if err != nil {
+		return err
+	}
+	if !isDefault && policy != mdb.ConflictOverwrite {
+		return nil
+	}
+	if err := store.SetQuota(username, quota.MaxStorage); err != nil {
+		return err
+	}
+	return store.SetMessageQuota(username, quota.MaxMessages)
+}
+
+func (store *Storage) restoreMailbox(ctx context.Context, u *imapsql.User, username, dir, format string, mbox BackupMailbox, opts RestoreOptions, res *RestoreResult) error {
+	if err := VerifyBackupMailbox(dir, format, mbox); err != nil {
+		res.Errors = append(res.Errors, fmt.Errorf("verification failed: %w", err))
+		return nil
+	}
+
+	status, err := u.Status(mbox.Name, []imap.StatusItem{imap.StatusMessages})
+	switch {
+	case errors.Is(err, backend.ErrNoSuchMailbox):
+		if mbox.SpecialUse != "" {
+			err = u.CreateMailboxSpecial(mbox.Name, mbox.SpecialUse)
+		} else {
+			err = u.CreateMailbox(mbox.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if err := u.SetSubscribed(mbox.Name, mbox.Subscribed); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case status.Messages != 0 && opts.Policy == mdb.ConflictSkip:
+		res.Skipped = mbox.Messages
+		return nil
+	}
+
+	_, m, err := u.GetMailbox(mbox.Name, false, nil)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if status != nil && status.Messages != 0 && opts.Policy == mdb.ConflictOverwrite {
+		if err := store.clearMailbox(ctx, m, username, mbox.Name); err != nil {
+			return err
+		}
+	}
+
+	r, err := openBackupMailbox(dir, format, mbox)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		msg, body, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var count int64
+		err = store.GORMDB.WithContext(ctx).Model(&mdb.ImportedMessage{}).
+			Where("account = ? AND mailbox = ? AND hash = ?", username, mbox.Name, msg.SHA256).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count != 0 {
+			res.Skipped++
+			continue
+		}
+
+		if err := store.checkQuota(username, msg.Size); err != nil {
+			return err
+		}
+		literal := &sizedReader{Reader: body, size: int(msg.Size)}
+		if err := m.(*imapsql.Mailbox).CreateMessage(msg.Flags, msg.Date, literal); err != nil {
+			res.Errors = append(res.Errors, fmt.Errorf("UID %d: %w", msg.UID, err))
+			continue
+		}
+		err = store.GORMDB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&mdb.ImportedMessage{
+			Account:    username,
+			Mailbox:    mbox.Name,
+			Hash:       msg.SHA256,
+			ImportedAt: time.Now().UTC(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		res.Restored++
+	}
+}
+
+// clearMailbox removes all messages from the mailbox together with the
+// records of messages restored or imported into it.
+func (store *Storage) clearMailbox(ctx context.Context, m backend.Mailbox, username, name string) error {
+	seq, _ := imap.ParseSeqSet("1:*")
+	if err := m.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}); err != nil {
+		return err
+	}
+	if err := m.Expunge(); err != nil {
+		return err
+	}
+	return store.GORMDB.WithContext(ctx).
+		Where("account = ? AND mailbox = ?", username, name).
+		Delete(&mdb.ImportedMessage{}).Error
+}
+
+// sizedReader is an imap.Literal of the known size that is read from the
+// backup.
+type sizedReader struct {
+	io.Reader
+	size int
+}
+
+func (r *sizedReader) Len() int {
+	return r.size
+}
@@ -0,0 +1,236 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	mdb "github.com/themadorg/madmail/internal/db"
+)
+
+func TestMboxrdRoundtrip(t *testing.T) {
+	msgs := []string{
+		"Subject: 1\r\n\r\nFrom the start\r\n>From quoted\r\n",
+		"Subject: 2\r\n\r\nno trailing newline",
+		"Subject: 3\r\n\r\n" + strings.Repeat("a", 10000) + "\r\nFrom x\r\n",
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, msg := range msgs {
+		n, err := writeMboxrdMessage(w, time.Now(), strings.NewReader(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(msg)) {
+			t.Errorf("expected %d bytes written, got %d", len(msg), n)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "\nFrom the") || !strings.Contains(buf.String(), "\n>>From quoted") {
+		t.Errorf("From lines are not quoted:\n%s", buf.String())
+	}
+
+	r := &mboxrdReader{br: bufio.NewReader(&buf)}
+	for _, msg := range msgs {
+		if err := r.next(int64(len(msg))); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Errorf("expected %q, got %q", msg, got)
+		}
+	}
+	if err := r.next(1); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF after the last message, got %v", err)
+	}
+}
+
+func listTestMessages(t *testing.T, store *Storage, username, mailbox string) []*imap.Message {
+	t.Helper()
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mbox, err := u.GetMailbox(mailbox, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+	seqSet, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	if err := mbox.ListMessages(false, seqSet, []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size}, ch); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*imap.Message
+	for msg := range ch {
+		flags := msg.Flags[:0]
+		for _, flag := range msg.Flags {
+			if flag != imap.RecentFlag {
+				flags = append(flags, flag)
+			}
+		}
+		msg.Flags = flags
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestExportRestoreAccount(t *testing.T) {
+	for _, format := range []string{BackupFormatMbox, BackupFormatEML} {
+		format := format
+		t.Run(format, func(t *testing.T) {
+			testExportRestoreAccount(t, format)
+		})
+	}
+}
+
+func testExportRestoreAccount(t *testing.T, format string) {
+	store, cleanup := setupTestStorageForJIT(t)
+	defer cleanup()
+
+	const src, dst = "src@example.org", "dst@example.org"
+	for _, username := range []string{src, dst} {
+		if err := store.CreateIMAPAcct(username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetQuota(src, 100000); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.Back.GetUser(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.(*imapsql.User).CreateMailboxSpecial("Sent", imap.SentAttr); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, msg := range []struct {
+		mbox  string
+		flags []string
+		body  string
+	}{
+		{"INBOX", []string{imap.SeenFlag}, "Subject: 1\r\n\r\nFrom here\r\n"},
+		{"INBOX", nil, "Subject: 2\r\n\r\ntwo\r\n"},
+		{"Sent", []string{imap.AnsweredFlag, imap.FlaggedFlag}, "Subject: 3\r\n\r\nthree\r\n"},
+	} {
+		if err := u.CreateMessage(msg.mbox, msg.flags, date, strings.NewReader(msg.body), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u.Logout()
+
+	dir := t.TempDir()
+	settings := mdb.AccountSettings{SieveScripts: []mdb.SieveScriptSettings{{Name: "main", Content: "keep;", Active: true}}}
+	manifest, err := store.ExportAccount(context.Background(), src, dir, ExportOptions{Format: format, Settings: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Mailboxes) != 2 || manifest.Mailboxes[0].Messages != 2 || manifest.Mailboxes[1].SpecialUse != imap.SentAttr {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+	if manifest.Quota == nil || manifest.Quota.MaxStorage != 100000 {
+		t.Errorf("unexpected quota: %+v", manifest.Quota)
+	}
+	if _, err := store.ExportAccount(context.Background(), src, dir, ExportOptions{Format: format}); !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected an error for an existing backup, got %v", err)
+	}
+
+	read, err := ReadBackupManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read.Settings, settings) || read.Mailboxes[1].SHA256 != manifest.Mailboxes[1].SHA256 {
+		t.Errorf("unexpected manifest read: %+v", read)
+	}
+	for _, mbox := range read.Mailboxes {
+		if err := VerifyBackupMailbox(dir, read.Format, mbox); err != nil {
+			t.Errorf("%s: %v", mbox.Name, err)
+		}
+	}
+
+	check := func(policy mdb.ConflictPolicy, restored, skipped int) {
+		t.Helper()
+		res, err := store.RestoreAccount(context.Background(), dst, dir, read, RestoreOptions{Policy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := [2]int{}
+		for _, r := range res {
+			if len(r.Errors) != 0 {
+				t.Errorf("%s: %v", r.Mailbox, r.Errors)
+			}
+			total[0] += r.Restored
+			total[1] += r.Skipped
+		}
+		if total != [2]int{restored, skipped} {
+			t.Errorf("%s: expected %d restored and %d skipped, got %v", policy, restored, skipped, total)
+		}
+	}
+	check(mdb.ConflictSkip, 3, 0)
+	check(mdb.ConflictSkip, 0, 3)
+	check(mdb.ConflictMerge, 0, 3)
+	check(mdb.ConflictOverwrite, 3, 0)
+
+	for _, name := range []string{"INBOX", "Sent"} {
+		want := listTestMessages(t, store, src, name)
+		got := listTestMessages(t, store, dst, name)
+		if len(got) != len(want) {
+			t.Fatalf("%s: expected %d messages, got %d", name, len(want), len(got))
+		}
+		for i := range got {
+			if !got[i].InternalDate.Equal(want[i].InternalDate) || got[i].Size != want[i].Size ||
+				!reflect.DeepEqual(got[i].Flags, want[i].Flags) {
+				t.Errorf("%s: expected %+v, got %+v", name, want[i], got[i])
+			}
+		}
+	}
+	_, maxBytes, isDefault, err := store.GetQuota(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isDefault || maxBytes != 100000 {
+		t.Errorf("quota was not restored: %d", maxBytes)
+	}
+
+	// A corrupted mailbox is not restored.
+	path := filepath.Join(dir, filepath.FromSlash(read.Mailboxes[1].Path))
+	if format == BackupFormatEML {
+		path = filepath.Join(path, "000001.eml")
+	}
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bytes.Replace(blob, []byte("three"), []byte("thr3e"), 1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBackupMailbox(dir, read.Format, read.Mailboxes[1]); err == nil {
+		t.Error("expected a verification error")
+	}
+	res, err := store.RestoreAccount(context.Background(), dst, dir, read, RestoreOptions{Policy: mdb.ConflictOverwrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res[1].Errors) != 1 || res[1].Restored != 0 {
+		t.Errorf("unexpected result for a corrupted mailbox: %+v", res[1])
+	}
+}
@@ -0,0 +1,581 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	mess "github.com/foxcpp/go-imap-mess"
+	"github.com/lib/pq"
+	"github.com/themadorg/madmail/framework/log"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm"
+)
+
+// Values of mdb.MailboxChange.Type.
+const (
+	ChangeNew       = "new"
+	ChangeFlags     = "flags"
+	ChangeExpunge   = "expunge"
+	ChangeDestroyed = "destroyed"
+)
+
+const (
+	// changeRetention is how long mailbox_changes rows are kept. Instances
+	// only read the changes made after they started, so it just needs to
+	// cover the polling interval and commit delays.
+	changeRetention     = time.Hour
+	changePruneInterval = 10 * time.Minute
+
+	// changeHoleTimeout is how long a skipped sequence number is checked
+	// again. Sequence numbers are allocated before commit, so a change with
+	// a lower number can become visible after the one with a higher number.
+	// Rolled back inserts leave permanent gaps.
+	changeHoleTimeout = 10 * time.Second
+	// changeMaxHoles limits the number of tracked skipped sequence numbers,
+	// larger gaps appear only after a lot of rollbacks.
+	changeMaxHoles = 1000
+
+	changeFetchBatch = 500
+
+	// changeNotifyPollInterval is the polling interval used together with
+	// LISTEN on PostgreSQL, in case a notification is lost.
+	changeNotifyPollInterval = time.Minute
+)
+
+// ErrChangesDisabled is returned by Storage.Subscribe if the change feed is
+// not started, see EnableUpdatePipe.
+var ErrChangesDisabled = errors.New("imapsql: change notifications are not enabled")
+
+// changeNotification is the payload of PostgreSQL notifications sent for
+// each mailbox_changes row.
+type changeNotification struct {
+	Account string `json:"account"`
+	Mailbox string `json:"mailbox"`
+	UIDNext uint32 `json:"uidnext"`
+	Seq     uint64 `json:"seq"`
+}
+
+type mailboxNames struct {
+	Account string `gorm:"column:username"`
+	Mailbox string `gorm:"column:name"`
+	UIDNext uint32 `gorm:"column:uidnext"`
+}
+
+type changeSub struct {
+	mboxID uint64
+	ch     chan mdb.MailboxChange
+	done   chan struct{}
+}
+
+// changeFeed implements updatepipe.P on top of the mailbox_changes table so
+// IMAP updates reach sessions served by other instances sharing the
+// database.
+//
+// Each update pushed by the local go-imap-mess Manager is stored as a row
+// after the change itself is committed. Instances read new rows once
+// notified using LISTEN/NOTIFY on PostgreSQL or by polling the table every
+// pollInterval on other databases.
+type changeFeed struct {
+	store        *Storage
+	db           *gorm.DB
+	log          log.Logger
+	origin       string
+	pollInterval time.Duration
+
+	// notifyChannel is the name of the PostgreSQL notification channel,
+	// empty on other databases.
+	notifyChannel string
+	listener      *pq.Listener
+
+	namesLock sync.Mutex
+	names     map[uint64]mailboxNames
+
+	subsLock sync.Mutex
+	subs     map[uint64]map[*changeSub]struct{}
+	extSubs  map[uint64]*changeSub
+	upds     chan<- mess.Update
+
+	// Used only by run.
+	lastSeq uint64
+	holes   map[uint64]time.Time
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newChangeFeed(store *Storage, pollInterval time.Duration) (*changeFeed, error) {
+	origin := make([]byte, 8)
+	if _, err := rand.Read(origin); err != nil {
+		return nil, err
+	}
+	f := &changeFeed{
+		store:        store,
+		db:           store.GORMDB,
+		log:          log.Logger{Name: "storage.imapsql/changes", Debug: store.Log.Debug},
+		origin:       hex.EncodeToString(origin),
+		pollInterval: pollInterval,
+		names:        map[uint64]mailboxNames{},
+		subs:         map[uint64]map[*changeSub]struct{}{},
+		extSubs:      map[uint64]*changeSub{},
+		holes:        map[uint64]time.Time{},
+		stop:         make(chan struct{}),
+	}
+	if store.driver == "postgres" {
+		f.notifyChannel = store.table("mailbox_changes")
+	}
+	return f, nil
+}
+
+// lookupNames returns the account and mailbox names for the mailbox ID.
+// Names of deleted mailboxes are returned if they were looked up before.
+func (f *changeFeed) lookupNames(mboxID uint64) (mailboxNames, error) {
+	var names mailboxNames
+	res := f.db.Table(f.store.table("mboxes")+" AS m").
+		Select("u.username, m.name, m.uidnext").
+		Joins("JOIN "+f.store.table("users")+" AS u ON u.id = m.uid").
+		Where("m.id = ?", mboxID).
+		Limit(1).
+		Scan(&names)
+	if res.Error != nil {
+		return names, res.Error
+	}
+
+	f.namesLock.Lock()
+	defer f.namesLock.Unlock()
+	if res.RowsAffected == 0 {
+		return f.names[mboxID], nil
+	}
+	f.names[mboxID] = names
+	return names, nil
+}
+
+// lookupID returns the ID of the mailbox.
+func (f *changeFeed) lookupID(account, mailbox string) (uint64, error) {
+	var ids []uint64
+	err := f.db.Table(f.store.table("mboxes")+" AS m").
+		Select("m.id").
+		Joins("JOIN "+f.store.table("users")+" AS u ON u.id = m.uid").
+		Where("u.username = ? AND m.name = ?", account, mailbox).
+		Limit(1).
+		Scan(&ids).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, fmt.Errorf("imapsql: no such mailbox: %s/%s", account, mailbox)
+	}
+	return ids[0], nil
+}
+
+// changeRow converts the update generated by go-imap-mess to the
+// mailbox_changes row.
+func (f *changeFeed) changeRow(upd mess.Update) (mdb.MailboxChange, error) {
+	mboxID, ok := upd.Key.(uint64)
+	if !ok {
+		return mdb.MailboxChange{}, fmt.Errorf("imapsql: unexpected update key type: %T", upd.Key)
+	}
+	row := mdb.MailboxChange{
+		MailboxID: mboxID,
+		UIDs:      upd.SeqSet,
+		Origin:    f.origin,
+	}
+	switch upd.Type {
+	case mess.UpdNewMessage:
+		row.Type = ChangeNew
+	case mess.UpdFlags:
+		row.Type = ChangeFlags
+		row.Flags = strings.Join(upd.NewFlags, " ")
+	case mess.UpdRemoved:
+		row.Type = ChangeExpunge
+	case mess.UpdMboxDestroyed:
+		row.Type = ChangeDestroyed
+	default:
+		return row, fmt.Errorf("imapsql: unknown update type: %v", upd.Type)
+	}
+
+	names, err := f.lookupNames(mboxID)
+	if err != nil {
+		return row, err
+	}
+	row.Account, row.Mailbox, row.UIDNext = names.Account, names.Mailbox, names.UIDNext
+	if row.Type == ChangeDestroyed {
+		f.namesLock.Lock()
+		delete(f.names, mboxID)
+		f.namesLock.Unlock()
+	}
+	return row, nil
+}
+
+// changeUpdate converts the mailbox_changes row back to the update
+// understood by go-imap-mess.
+func changeUpdate(row mdb.MailboxChange) (mess.Update, bool) {
+	upd := mess.Update{Key: row.MailboxID, SeqSet: row.UIDs}
+	switch row.Type {
+	case ChangeNew:
+		upd.Type = mess.UpdNewMessage
+	case ChangeFlags:
+		upd.Type = mess.UpdFlags
+		upd.NewFlags = strings.Fields(row.Flags)
+	case ChangeExpunge:
+		upd.Type = mess.UpdRemoved
+	case ChangeDestroyed:
+		upd.Type = mess.UpdMboxDestroyed
+	default:
+		return upd, false
+	}
+	return upd, true
+}
+
+func (f *changeFeed) InitPush() error {
+	return nil
+}
+
+// Push stores the update. It is called once the change is committed, so a
+// subscriber never sees a UID that cannot be read yet. On PostgreSQL, the
+// notification is sent in the same transaction and is delivered on commit.
+func (f *changeFeed) Push(upd mess.Update) error {
+	row, err := f.changeRow(upd)
+	if err != nil {
+		return err
+	}
+	row.CreatedAt = time.Now().UTC()
+
+	return f.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&row).Error; err != nil {
+			return err
+		}
+		if f.notifyChannel == "" {
+			return nil
+		}
+		payload, err := json.Marshal(changeNotification{
+			Account: row.Account,
+			Mailbox: row.Mailbox,
+			UIDNext: row.UIDNext,
+			Seq:     row.Seq,
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Exec("SELECT pg_notify(?, ?)", f.notifyChannel, string(payload)).Error
+	})
+}
+
+// Listen starts reading changes made by other instances. Updates for
+// mailboxes subscribed to using ExternalSubscribe are sent to upds.
+func (f *changeFeed) Listen(upds chan<- mess.Update) error {
+	if err := f.db.Model(&mdb.MailboxChange{}).Select("COALESCE(MAX(seq), 0)").Scan(&f.lastSeq).Error; err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+
+	var notify <-chan *pq.Notification
+	if f.notifyChannel != "" {
+		dsnStr, err := mdb.BuildDSN(f.store.driver, f.store.dsn)
+		if err != nil {
+			return fmt.Errorf("imapsql: %w", err)
+		}
+		dsnStr, err = mdb.ConfigureTLS(f.store.driver, dsnStr, f.store.dbOpts)
+		if err != nil {
+			return fmt.Errorf("imapsql: %w", err)
+		}
+		// The listener reconnects on its own, waiting from one second up
+		// to a minute between attempts.
+		f.listener = pq.NewListener(dsnStr, time.Second, time.Minute, f.listenerEvent)
+		if err := f.listener.Listen(f.notifyChannel); err != nil {
+			f.listener.Close()
+			return fmt.Errorf("imapsql: %w", err)
+		}
+		notify = f.listener.Notify
+	}
+
+	f.subsLock.Lock()
+	f.upds = upds
+	f.subsLock.Unlock()
+
+	f.stopped = make(chan struct{})
+	go f.run(notify)
+	return nil
+}
+
+func (f *changeFeed) listenerEvent(ev pq.ListenerEventType, err error) {
+	switch ev {
+	case pq.ListenerEventConnected:
+		f.log.DebugMsg("listening for changes", "channel", f.notifyChannel)
+	case pq.ListenerEventReconnected:
+		f.log.Msg("connection reestablished")
+	case pq.ListenerEventConnectionAttemptFailed:
+		f.log.Error("connection attempt failed", err)
+	case pq.ListenerEventDisconnected:
+		f.log.Msg("connection closed, reconnecting", "err", err)
+	}
+}
+
+func (f *changeFeed) run(notify <-chan *pq.Notification) {
+	defer close(f.stopped)
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during imapsql change feed: %v\n%s", err, stack)
+		}
+	}()
+
+	interval := f.pollInterval
+	if notify != nil {
+		interval = changeNotifyPollInterval
+	}
+	poll := time.NewTicker(interval)
+	defer poll.Stop()
+	prune := time.NewTicker(changePruneInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case n := <-notify:
+			// nil is sent after the connection is reestablished,
+			// notifications might have been missed meanwhile.
+			if n != nil && !f.unseen(n.Extra) {
+				continue
+			}
+		case <-poll.C:
+		case <-prune.C:
+			f.prune()
+			continue
+		}
+		if err := f.fetch(); err != nil {
+			f.log.Error("failed to read changes", err)
+		}
+	}
+}
+
+// unseen reports whether the notification is about a change not read yet.
+func (f *changeFeed) unseen(payload string) bool {
+	var n changeNotification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		f.log.Error("malformed notification", err, "payload", payload)
+		return true
+	}
+	return n.Seq > f.lastSeq || len(f.holes) != 0
+}
+
+// fetch reads changes with sequence numbers after the last one seen and
+// the skipped ones, dispatching changes made by other instances.
+func (f *changeFeed) fetch() error {
+	for {
+		now := time.Now()
+		for seq, since := range f.holes {
+			if now.Sub(since) > changeHoleTimeout {
+				delete(f.holes, seq)
+			}
+		}
+
+		q := f.db.Where("seq > ?", f.lastSeq)
+		if len(f.holes) != 0 {
+			holes := make([]uint64, 0, len(f.holes))
+			for seq := range f.holes {
+				holes = append(holes, seq)
+			}
+			q = f.db.Where("seq > ? OR seq IN ?", f.lastSeq, holes)
+		}
+		var rows []mdb.MailboxChange
+		if err := q.Order("seq").Limit(changeFetchBatch).Find(&rows).Error; err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			if _, ok := f.holes[row.Seq]; ok {
+				delete(f.holes, row.Seq)
+			} else if row.Seq > f.lastSeq {
+				if gap := row.Seq - f.lastSeq - 1; gap != 0 && len(f.holes)+int(gap) <= changeMaxHoles {
+					for seq := f.lastSeq + 1; seq < row.Seq; seq++ {
+						f.holes[seq] = now
+					}
+				}
+				f.lastSeq = row.Seq
+			}
+			if row.Origin != f.origin {
+				f.dispatch(row)
+			}
+		}
+		if len(rows) < changeFetchBatch {
+			return nil
+		}
+	}
+}
+
+func (f *changeFeed) dispatch(row mdb.MailboxChange) {
+	f.subsLock.Lock()
+	subs := make([]*changeSub, 0, len(f.subs[row.MailboxID]))
+	for sub := range f.subs[row.MailboxID] {
+		subs = append(subs, sub)
+	}
+	f.subsLock.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.ch <- row:
+		case <-sub.done:
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+func (f *changeFeed) prune() {
+	cutoff := time.Now().UTC().Add(-changeRetention)
+	res := f.db.Where("created_at < ?", cutoff).Delete(&mdb.MailboxChange{})
+	if res.Error != nil {
+		f.log.Error("failed to prune changes", res.Error)
+		return
+	}
+	if res.RowsAffected != 0 {
+		f.log.DebugMsg("pruned changes", "count", res.RowsAffected)
+	}
+}
+
+// subscribe registers a subscriber for changes of the mailbox, it should be
+// removed using unsubscribe.
+func (f *changeFeed) subscribe(mboxID uint64) *changeSub {
+	sub := &changeSub{
+		mboxID: mboxID,
+		ch:     make(chan mdb.MailboxChange, 16),
+		done:   make(chan struct{}),
+	}
+
+	f.subsLock.Lock()
+	defer f.subsLock.Unlock()
+	if f.subs[mboxID] == nil {
+		f.subs[mboxID] = map[*changeSub]struct{}{}
+	}
+	f.subs[mboxID][sub] = struct{}{}
+	return sub
+}
+
+func (f *changeFeed) unsubscribe(sub *changeSub) {
+	f.subsLock.Lock()
+	defer f.subsLock.Unlock()
+	if _, ok := f.subs[sub.mboxID][sub]; !ok {
+		return
+	}
+	delete(f.subs[sub.mboxID], sub)
+	if len(f.subs[sub.mboxID]) == 0 {
+		delete(f.subs, sub.mboxID)
+	}
+	close(sub.done)
+}
+
+// ExternalSubscribe is used as mess.Manager.ExternalSubscribe, it is called
+// when the mailbox is selected for the first time.
+func (f *changeFeed) ExternalSubscribe(key interface{}) {
+	mboxID, ok := key.(uint64)
+	if !ok {
+		f.log.Msg("unexpected key type passed to ExternalSubscribe", "key", key)
+		return
+	}
+	sub := f.subscribe(mboxID)
+
+	f.subsLock.Lock()
+	old := f.extSubs[mboxID]
+	f.extSubs[mboxID] = sub
+	upds := f.upds
+	f.subsLock.Unlock()
+	if old != nil {
+		f.unsubscribe(old)
+	}
+
+	go func() {
+		for {
+			select {
+			case row := <-sub.ch:
+				upd, ok := changeUpdate(row)
+				if !ok {
+					f.log.Msg("unknown change type", "type", row.Type, "seq", row.Seq)
+					continue
+				}
+				select {
+				case upds <- upd:
+				case <-f.stop:
+					return
+				}
+			case <-sub.done:
+				return
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+}
+
+// ExternalUnsubscribe is used as mess.Manager.ExternalUnsubscribe, it is
+// called when the last session using the mailbox closes it.
+func (f *changeFeed) ExternalUnsubscribe(key interface{}) {
+	mboxID, ok := key.(uint64)
+	if !ok {
+		return
+	}
+	f.subsLock.Lock()
+	sub := f.extSubs[mboxID]
+	delete(f.extSubs, mboxID)
+	f.subsLock.Unlock()
+	if sub != nil {
+		f.unsubscribe(sub)
+	}
+}
+
+func (f *changeFeed) Close() error {
+	close(f.stop)
+	if f.stopped != nil {
+		<-f.stopped
+	}
+	if f.listener != nil {
+		return f.listener.Close()
+	}
+	return nil
+}
+
+// Subscribe returns the channel receiving changes of the mailbox made by
+// other server instances and maddy subcommands sharing the database, e.g.
+// new messages appended by another instance. Changes made using this
+// Storage are not sent. The returned function cancels the subscription.
+//
+// Changes are read every change_poll_interval, on PostgreSQL they are read
+// as soon as the notification sent on commit is received. The channel
+// should be read promptly since reading changes for other subscribers waits
+// for it.
+func (store *Storage) Subscribe(account, mailbox string) (<-chan mdb.MailboxChange, func(), error) {
+	f, ok := store.updPipe.(*changeFeed)
+	if !ok || f.stopped == nil {
+		return nil, nil, ErrChangesDisabled
+	}
+	mboxID, err := f.lookupID(account, mailbox)
+	if err != nil {
+		return nil, nil, err
+	}
+	sub := f.subscribe(mboxID)
+	return sub.ch, func() { f.unsubscribe(sub) }, nil
+}
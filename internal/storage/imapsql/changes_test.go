@@ -0,0 +1,292 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	mess "github.com/foxcpp/go-imap-mess"
+	"github.com/themadorg/madmail/framework/config"
+	mdb "github.com/themadorg/madmail/internal/db"
+	_ "github.com/themadorg/madmail/internal/storage/blob/fs"
+	"github.com/themadorg/madmail/internal/testutils"
+	"github.com/themadorg/madmail/internal/updatepipe"
+)
+
+const testPollInterval = 50 * time.Millisecond
+
+// testSharedStorage returns a Storage using the database and the message
+// store in dir, as if it was another server instance.
+func testSharedStorage(t *testing.T, dir string) *Storage {
+	t.Helper()
+	mod, err := New("storage.imapsql", "", nil, []string{"sqlite3", filepath.Join(dir, "imapsql.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*Storage)
+	err = store.Init(config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "msg_store", Args: []string{"fs", filepath.Join(dir, "messages")}},
+		{Name: "change_poll_interval", Args: []string{testPollInterval.String()}},
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Log = testutils.Logger(t, "imapsql")
+	if err := store.EnableUpdatePipe(updatepipe.ModeReplicate); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func receiveChange(t *testing.T, ch <-chan mdb.MailboxChange) mdb.MailboxChange {
+	t.Helper()
+	select {
+	case row := <-ch:
+		return row
+	case <-time.After(5 * testPollInterval):
+		t.Fatal("change is not received within the polling interval")
+		return mdb.MailboxChange{}
+	}
+}
+
+func TestSubscribe_SharedDatabase(t *testing.T) {
+	dir := testutils.Dir(t)
+	a := testSharedStorage(t, dir)
+	b := testSharedStorage(t, dir)
+
+	const username = "user@example.org"
+	if err := a.CreateIMAPAcct(username); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := b.Subscribe(username, "Archive"); err == nil {
+		t.Error("expected an error for a missing mailbox")
+	}
+	changes, cancel, err := b.Subscribe(username, imap.InboxName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	own, cancelOwn, err := a.Subscribe(username, imap.InboxName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancelOwn()
+
+	u, err := a.Back.GetUser(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Logout()
+	err = u.CreateMessage(imap.InboxName, []string{imap.FlaggedFlag}, time.Now(), strings.NewReader("Subject: test\r\n\r\ntest\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row := receiveChange(t, changes)
+	if row.Type != ChangeNew || row.Account != username || row.Mailbox != imap.InboxName || row.UIDs != "1" || row.UIDNext != 2 {
+		t.Fatalf("unexpected change: %+v", row)
+	}
+	// The message is readable once the change is seen.
+	if msgs := listTestMessages(t, b, username, imap.InboxName); len(msgs) != 1 {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+
+	select {
+	case row := <-own:
+		t.Errorf("change made by the same instance is received: %+v", row)
+	case <-time.After(3 * testPollInterval):
+	}
+
+	// Cancelled subscriptions no longer receive changes.
+	cancel()
+	err = u.CreateMessage(imap.InboxName, nil, time.Now(), strings.NewReader("Subject: test\r\n\r\ntest\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * testPollInterval)
+	select {
+	case row := <-changes:
+		t.Errorf("change is received after cancel: %+v", row)
+	default:
+	}
+}
+
+type updatesConn chan backend.Update
+
+func (c updatesConn) SendUpdate(upd backend.Update) error {
+	c <- upd
+	return nil
+}
+
+func TestIdle_SharedDatabase(t *testing.T) {
+	dir := testutils.Dir(t)
+	a := testSharedStorage(t, dir)
+	b := testSharedStorage(t, dir)
+
+	const username = "user@example.org"
+	if err := a.CreateIMAPAcct(username); err != nil {
+		t.Fatal(err)
+	}
+	ua, err := a.Back.GetUser(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ua.Logout()
+	ub, err := b.Back.GetUser(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ub.Logout()
+
+	conn := make(updatesConn, 10)
+	_, mbox, err := ub.GetMailbox(imap.InboxName, false, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go mbox.(interface{ Idle(<-chan struct{}) }).Idle(done)
+
+	err = ua.CreateMessage(imap.InboxName, nil, time.Now(), strings.NewReader("Subject: test\r\n\r\ntest\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case upd := <-conn:
+		status, ok := upd.(*backend.MailboxUpdate)
+		if !ok || status.Messages != 1 {
+			t.Fatalf("unexpected update: %#v", upd)
+		}
+	case <-time.After(5 * testPollInterval):
+		t.Fatal("EXISTS is not sent within the polling interval")
+	}
+}
+
+func TestSubscribe_Disabled(t *testing.T) {
+	store, cleanup := setupTestStorageForJIT(t)
+	defer cleanup()
+	if _, _, err := store.Subscribe("user@example.org", imap.InboxName); !errors.Is(err, ErrChangesDisabled) {
+		t.Fatalf("expected ErrChangesDisabled, got %v", err)
+	}
+}
+
+func TestChangeFeed_Holes(t *testing.T) {
+	store := testSharedStorage(t, testutils.Dir(t))
+	const username = "user@example.org"
+	if err := store.CreateIMAPAcct(username); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not started, fetch is called directly.
+	f, err := newChangeFeed(store, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := f.subscribe(7)
+	defer f.unsubscribe(sub)
+
+	insert := func(seq uint64) {
+		t.Helper()
+		err := store.GORMDB.Create(&mdb.MailboxChange{
+			Seq: seq, MailboxID: 7, Type: ChangeNew, UIDs: "1", Origin: "other", CreatedAt: time.Now(),
+		}).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := func() []uint64 {
+		t.Helper()
+		if err := f.fetch(); err != nil {
+			t.Fatal(err)
+		}
+		var seqs []uint64
+		for {
+			select {
+			case row := <-sub.ch:
+				seqs = append(seqs, row.Seq)
+			default:
+				return seqs
+			}
+		}
+	}
+
+	// The change with sequence number 2 is committed after 3.
+	insert(1)
+	insert(3)
+	if got := received(); !reflect.DeepEqual(got, []uint64{1, 3}) {
+		t.Fatalf("got %v", got)
+	}
+	insert(2)
+	insert(4)
+	if got := received(); !reflect.DeepEqual(got, []uint64{2, 4}) {
+		t.Fatalf("got %v", got)
+	}
+	if len(f.holes) != 0 || f.lastSeq != 4 {
+		t.Errorf("holes %v, last seq %d", f.holes, f.lastSeq)
+	}
+
+	// Rolled back changes are not waited for forever.
+	insert(6)
+	received()
+	for seq := range f.holes {
+		f.holes[seq] = time.Now().Add(-2 * changeHoleTimeout)
+	}
+	received()
+	if len(f.holes) != 0 {
+		t.Errorf("holes are not expired: %v", f.holes)
+	}
+}
+
+func TestChangeUpdate(t *testing.T) {
+	store := testSharedStorage(t, testutils.Dir(t))
+	f := store.updPipe.(*changeFeed)
+
+	for _, upd := range []mess.Update{
+		{Type: mess.UpdNewMessage, Key: uint64(1), SeqSet: "3:5"},
+		{Type: mess.UpdFlags, Key: uint64(1), SeqSet: "3", NewFlags: []string{imap.SeenFlag, "$Label"}},
+		{Type: mess.UpdRemoved, Key: uint64(1), SeqSet: "4"},
+		{Type: mess.UpdMboxDestroyed, Key: uint64(1)},
+	} {
+		row, err := f.changeRow(upd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := changeUpdate(row)
+		if !ok || !reflect.DeepEqual(got, upd) {
+			t.Errorf("%+v is converted to %+v", upd, got)
+		}
+	}
+	if _, err := f.changeRow(mess.Update{Type: mess.UpdNewMessage, Key: "INBOX"}); err == nil {
+		t.Error("expected an error for a string key")
+	}
+}
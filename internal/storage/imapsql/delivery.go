@@ -30,6 +30,7 @@ import (
 	"github.com/themadorg/madmail/framework/buffer"
 	"github.com/themadorg/madmail/framework/exterrors"
 	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
 	"github.com/themadorg/madmail/internal/target"
 )
 
@@ -59,6 +60,56 @@ func userDoesNotExist(actual error) error {
 	}
 }
 
+func storageUnavailable(actual error) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Storage is temporarily unavailable, try again later",
+		TargetName:   "imapsql",
+		Err:          actual,
+	}
+}
+
+// dbError reports the result of a go-imap-sql operation to the circuit
+// breaker of the database and converts connection errors into a temporary
+// SMTP error so that the message is queued by the sender.
+func (store *Storage) dbError(err error) error {
+	if mdb.ReportResult(store.GORMDB, err) {
+		return storageUnavailable(err)
+	}
+	return err
+}
+
+// checkQuota returns an error if storing a message of size bytes would exceed
+// the quota of the account.
+func (store *Storage) checkQuota(username string, size int64) error {
+	usedBytes, usedMsgs, err := store.usage(username)
+	if err != nil {
+		return err
+	}
+	maxBytes, maxMsgs, _, err := store.quotaLimits(username)
+	if err != nil {
+		return err
+	}
+	if (maxBytes > 0 && usedBytes+size > maxBytes) || (maxMsgs > 0 && usedMsgs >= maxMsgs) {
+		if store.quotaSoftLimit {
+			return &exterrors.SMTPError{
+				Code:         452,
+				EnhancedCode: exterrors.EnhancedCode{4, 2, 2},
+				Message:      "Quota exceeded, try again later",
+				TargetName:   "imapsql",
+			}
+		}
+		return &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 2, 2},
+			Message:      "Quota exceeded",
+			TargetName:   "imapsql",
+		}
+	}
+	return nil
+}
+
 func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
 	defer trace.StartRegion(ctx, "sql/AddRcpt").End()
 
@@ -83,6 +134,15 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 		d.store.Log.Error("Failed to check JIT registration status", err)
 	}
 
+	// Reject accounts that are already over quota early, the message size
+	// is checked in Body.
+	if err := d.store.checkQuota(accountName, 0); err != nil {
+		if _, ok := err.(*exterrors.SMTPError); ok {
+			return err
+		}
+		d.store.Log.Error("Failed to get quota for recipient", err, "rcpt", accountName)
+	}
+
 	// This header is added to the message only for that recipient.
 	// go-imap-sql does certain optimizations to store the message
 	// with small amount of per-recipient data in a efficient way.
@@ -102,7 +162,7 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 				Err:          err,
 			}
 		}
-		return err
+		return d.store.dbError(err)
 	}
 
 	d.addedRcpts[accountName] = addedRcpt{
@@ -111,27 +171,52 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 	return nil
 }
 
-func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
-	defer trace.StartRegion(ctx, "sql/Body").End()
-
-	// Quota check
+// checkQuotas returns errors for recipients that have no space left for
+// the message of size bytes.
+func (d *delivery) checkQuotas(size int64) map[string]error {
+	rejected := map[string]error{}
 	for rcpt := range d.addedRcpts {
-		used, max, _, err := d.store.GetQuota(rcpt)
-		if err != nil {
+		if err := d.store.checkQuota(rcpt, size); err != nil {
+			if _, ok := err.(*exterrors.SMTPError); ok {
+				rejected[rcpt] = err
+				continue
+			}
 			d.store.Log.Error("Failed to get quota for recipient", err, "rcpt", rcpt)
-			continue
 		}
+	}
+	return rejected
+}
 
-		if max > 0 && used+int64(body.Len()) > max {
-			return &exterrors.SMTPError{
-				Code:         552,
-				EnhancedCode: exterrors.EnhancedCode{5, 2, 2},
-				Message:      "Quota exceeded",
-				TargetName:   "imapsql",
-			}
-		}
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "sql/Body").End()
+
+	for _, err := range d.checkQuotas(int64(body.Len())) {
+		return err
+	}
+	return d.body(header, body)
+}
+
+// BodyNonAtomic rejects the message only for recipients over quota and
+// stores it for the rest.
+func (d *delivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	defer trace.StartRegion(ctx, "sql/BodyNonAtomic").End()
+
+	for rcpt, err := range d.checkQuotas(int64(body.Len())) {
+		c.SetStatus(d.addedRcpts[rcpt].rcptTo, err)
+		d.d.RemoveRcpt(rcpt)
+		delete(d.addedRcpts, rcpt)
+	}
+	if len(d.addedRcpts) == 0 {
+		return
 	}
 
+	err := d.body(header, body)
+	for _, rcptData := range d.addedRcpts {
+		c.SetStatus(rcptData.rcptTo, err)
+	}
+}
+
+func (d *delivery) body(header textproto.Header, body buffer.Buffer) error {
 	if !d.msgMeta.Quarantine && d.store.filters != nil {
 		for rcpt, rcptData := range d.addedRcpts {
 			folder, flags, err := d.store.filters.IMAPFilter(rcpt, rcptData.rcptTo, d.msgMeta, header, body)
@@ -154,7 +239,7 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 					Err:          err,
 				}
 			}
-			return err
+			return d.store.dbError(err)
 		}
 	}
 
@@ -170,7 +255,7 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 			Err:          err,
 		}
 	}
-	return err
+	return d.store.dbError(err)
 }
 
 func (d *delivery) Abort(ctx context.Context) error {
@@ -182,12 +267,16 @@ func (d *delivery) Abort(ctx context.Context) error {
 func (d *delivery) Commit(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Commit").End()
 
-	return d.d.Commit()
+	return d.store.dbError(d.d.Commit())
 }
 
 func (store *Storage) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
 	defer trace.StartRegion(ctx, "sql/Start").End()
 
+	if err := mdb.CheckAvailable(store.GORMDB); err != nil {
+		return nil, storageUnavailable(err)
+	}
+
 	return &delivery{
 		store:      store,
 		msgMeta:    msgMeta,
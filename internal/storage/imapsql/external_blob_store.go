@@ -3,6 +3,7 @@ package imapsql
 import (
 	"context"
 	"io"
+	"time"
 
 	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/themadorg/madmail/framework/module"
@@ -66,3 +67,11 @@ func (e ExtBlobStore) Delete(keys []string) error {
 	}
 	return nil
 }
+
+func (e ExtBlobStore) List(fn func(key string, modTime time.Time) error) error {
+	lister, ok := e.Base.(module.BlobLister)
+	if !ok {
+		return imapsql.ErrNotListable
+	}
+	return lister.List(context.TODO(), fn)
+}
@@ -27,13 +27,10 @@ package imapsql
 
 import (
 	"context"
-	"crypto/sha1"
 	"database/sql"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -44,14 +41,15 @@ import (
 	"github.com/emersion/go-imap/backend"
 	mess "github.com/foxcpp/go-imap-mess"
 	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/themadorg/madmail/framework/address"
 	"github.com/themadorg/madmail/framework/config"
 	modconfig "github.com/themadorg/madmail/framework/config/module"
 	"github.com/themadorg/madmail/framework/dns"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
 	"github.com/themadorg/madmail/internal/authz"
+	"github.com/themadorg/madmail/internal/table"
 	"github.com/themadorg/madmail/internal/updatepipe"
-	"github.com/themadorg/madmail/internal/updatepipe/pubsub"
 
 	mdb "github.com/themadorg/madmail/internal/db"
 	"gorm.io/gorm"
@@ -70,12 +68,14 @@ type Storage struct {
 
 	driver string
 	dsn    []string
+	dbOpts mdb.Options
 
 	resolver dns.Resolver
 
-	updPipe      updatepipe.P
-	updPushStop  chan struct{}
-	outboundUpds chan mess.Update
+	updPipe            updatepipe.P
+	updPushStop        chan struct{}
+	outboundUpds       chan mess.Update
+	changePollInterval time.Duration
 
 	filters module.IMAPFilter
 
@@ -86,13 +86,25 @@ type Storage struct {
 
 	retention time.Duration
 
+	gcInterval time.Duration
+	gcMinAge   time.Duration
+
+	expungeRetention     time.Duration
+	expungePurgeInterval time.Duration
+	expungePurgeBatch    int
+
 	unusedAccountRetention time.Duration
 	authDBName             string
 
-	defaultQuota int64
-	autoCreate   bool
+	defaultQuota     int64
+	defaultQuotaMsgs int64
+	quotaSoftLimit   bool
+	autoCreate       bool
 
 	settingsTable module.Table
+
+	// domains provides default quotas of accounts created in the domain.
+	domains table.DomainSource
 }
 
 func (store *Storage) Name() string {
@@ -123,18 +135,19 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 func (store *Storage) Init(cfg *config.Map) error {
 	var (
 		driver            string
-		dsn               []string
+		dbDSN             mdb.DSN
 		appendlimitVal    int64 = -1
 		compression       []string
 		authNormalize     string
 		deliveryNormalize string
 
 		blobStore module.BlobStore
+		dbOpts    mdb.Options
 	)
 
 	opts := imapsql.Opts{}
-	cfg.String("driver", false, false, store.driver, &driver)
-	cfg.StringList("dsn", false, false, store.dsn, &dsn)
+	mdb.DriverDirective(cfg, "driver", false, store.driver, &driver)
+	mdb.DSNDirective(cfg, "dsn", false, store.dsn, &dbDSN)
 	cfg.Callback("fsstore", func(m *config.Map, node config.Node) error {
 		store.Log.Msg("'fsstore' directive is deprecated, use 'msg_store fs' instead")
 		return modconfig.ModuleFromNode("storage.blob", append([]string{"fs"}, node.Args...),
@@ -155,9 +168,11 @@ func (store *Storage) Init(cfg *config.Map) error {
 	cfg.DataSize("appendlimit", false, false, 32*1024*1024, &appendlimitVal)
 	cfg.Bool("debug", true, false, &store.Log.Debug)
 	cfg.Int("sqlite3_cache_size", false, false, 0, &opts.CacheSize)
-	cfg.Int("sqlite3_busy_timeout", false, false, 5000, &opts.BusyTimeout)
 	cfg.Bool("disable_recent", false, true, &opts.DisableRecent)
+	cfg.Bool("full_text_search", false, false, &opts.FullTextSearch)
+	cfg.Bool("deduplicate", false, true, &opts.Deduplicate)
 	cfg.String("junk_mailbox", false, false, "Junk", &store.junkMbox)
+	cfg.String("shared_namespace", false, false, "Shared", &opts.SharedNamespace)
 	cfg.Custom("imap_filter", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, func(m *config.Map, node config.Node) (interface{}, error) {
@@ -175,23 +190,58 @@ func (store *Storage) Init(cfg *config.Map) error {
 	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
 	cfg.Duration("retention", false, false, 0, &store.retention)
 	cfg.Duration("unused_account_retention", false, false, 0, &store.unusedAccountRetention)
+	cfg.Duration("msg_store_gc_interval", false, false, 24*time.Hour, &store.gcInterval)
+	cfg.Duration("msg_store_gc_min_age", false, false, time.Hour, &store.gcMinAge)
+	cfg.Duration("expunge_retention", false, false, 7*24*time.Hour, &store.expungeRetention)
+	cfg.Duration("expunge_purge_interval", false, false, time.Hour, &store.expungePurgeInterval)
+	cfg.Int("expunge_purge_batch", false, false, 500, &store.expungePurgeBatch)
+	cfg.Duration("change_poll_interval", false, false, time.Second, &store.changePollInterval)
 	cfg.String("auth_db", false, false, "", &store.authDBName)
 	cfg.DataSize("default_quota", false, false, 1073741824, &store.defaultQuota)
+	cfg.Int64("default_quota_messages", false, false, 0, &store.defaultQuotaMsgs)
+	cfg.Bool("quota_soft_limit", false, false, &store.quotaSoftLimit)
 	cfg.Bool("auto_create", false, false, &store.autoCreate)
 	cfg.Custom("settings_table", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, modconfig.TableDirective, &store.settingsTable)
+	var domainTable module.Table
+	cfg.Custom("domain_table", false, false, nil, modconfig.TableDirective, &domainTable)
+	mdb.Directives(cfg, &dbOpts)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	if domainTable != nil {
+		domains, ok := domainTable.(table.DomainSource)
+		if !ok {
+			return errors.New("imapsql: domain_table should be table.sql_domains")
+		}
+		store.domains = domains
+	}
+	opts.BusyTimeout = dbOpts.SQLiteBusyTimeout
+	opts.TablePrefix = dbOpts.TablePrefix
+	opts.SoftDelete = store.expungeRetention > 0
+	if store.expungePurgeBatch < 1 {
+		return errors.New("imapsql: expunge_purge_batch should be positive")
+	}
+	if store.changePollInterval <= 0 {
+		return errors.New("imapsql: change_poll_interval should be positive")
+	}
 
-	if dsn == nil {
+	if dbDSN.Empty() {
 		return errors.New("imapsql: dsn is required")
 	}
 	if driver == "" {
 		return errors.New("imapsql: driver is required")
 	}
+	if d := mdb.NormalizeDriver(driver); d == "sqlserver" || d == "mssql" {
+		// go-imap-sql uses MySQL, PostgreSQL and SQLite specific SQL.
+		return errors.New("imapsql: sqlserver driver is not supported, use sqlite3, postgres or mysql")
+	}
+	dsn, err := dbDSN.Parts(driver)
+	if err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
 
 	if driver == "sqlite3" {
 		if sqliteImpl == "modernc" {
@@ -263,9 +313,15 @@ func (store *Storage) Init(cfg *config.Map) error {
 		opts.MaxMsgBytes = new(uint32)
 		*opts.MaxMsgBytes = uint32(appendlimitVal)
 	}
-	var err error
-
-	dsnStr := strings.Join(dsn, " ")
+	dsnStr, err := mdb.BuildDSN(driver, dsn)
+	if err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+	// go-imap-sql uses its own connection to the same database.
+	dsnStr, err = mdb.ConfigureTLS(driver, dsnStr, dbOpts)
+	if err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
 	if driver == "sqlite3" && os.Getenv("MADDY_SQLITE_UNSAFE_SYNC_OFF") == "1" {
 		// WARNING: this reduces durability and can corrupt data on crash.
 		sep := "?"
@@ -297,17 +353,32 @@ func (store *Storage) Init(cfg *config.Map) error {
 		}
 	}
 
-	store.Back, err = imapsql.New(driver, dsnStr, ExtBlobStore{Base: blobStore}, opts)
+	// go-imap-sql queries the database right away, so wait for it the
+	// same way as for the GORM connection below.
+	dbOpts.Log = store.Log
+	opts.PingTimeout = dbOpts.EffectivePingTimeout()
+	err = mdb.RetryConnect(context.Background(), driver, dbOpts, func() error {
+		var err error
+		store.Back, err = imapsql.New(driver, dsnStr, ExtBlobStore{Base: blobStore}, opts)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("imapsql: %s", err)
 	}
+	// go-imap-sql limits in-memory SQLite databases to a single connection
+	// itself, each connection would get its own database otherwise.
+	if dsnStr != ":memory:" {
+		mdb.ConfigurePool(store.Back.DB, driver, dbOpts)
+	}
 
 	store.Log.Debugln("go-imap-sql version", imapsql.VersionStr)
 
 	store.driver = driver
 	store.dsn = dsn
+	store.dbOpts = dbOpts
 
-	store.GORMDB, err = mdb.New(driver, dsn, store.Log.Debug)
+	dbOpts.MetricsName = store.instName
+	store.GORMDB, err = mdb.NewWithContext(context.Background(), driver, dsn, dbOpts)
 	if err != nil {
 		return fmt.Errorf("imapsql: gorm init failed: %w", err)
 	}
@@ -315,6 +386,9 @@ func (store *Storage) Init(cfg *config.Map) error {
 	if err := store.initQuotaTable(); err != nil {
 		return fmt.Errorf("imapsql: quota table init failed: %w", err)
 	}
+	if err := mdb.Migrate(store.GORMDB, dbMigrations); err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
 
 	if err := store.MigrateFirstLoginFromCreatedAt(); err != nil {
 		store.Log.Error("failed to migrate first login times", err)
@@ -330,6 +404,12 @@ func (store *Storage) Init(cfg *config.Map) error {
 	if store.unusedAccountRetention > 0 {
 		go store.cleanupUnusedAccountsLoop()
 	}
+	if store.gcInterval > 0 {
+		go store.gcLoop()
+	}
+	if store.expungeRetention > 0 && store.expungePurgeInterval > 0 {
+		go store.purgeLoop()
+	}
 
 	return nil
 }
@@ -366,34 +446,63 @@ func (store *Storage) IsJitRegistrationEnabled() (bool, error) {
 	return val == "true", nil
 }
 
+// withTx runs fn using mdb.WithTx, retrying it on deadlocks and
+// serialization failures.
+func (store *Storage) withTx(ctx context.Context, op string, fn func(tx *gorm.DB) error) error {
+	attempts, err := mdb.WithTx(ctx, store.GORMDB, fn, mdb.TxOptions{})
+	if attempts > 1 {
+		store.Log.DebugMsg("transaction retried", "op", op, "attempts", attempts, "err", err)
+	}
+	return err
+}
+
+// dbMigrations create the tables used by storage.imapsql in addition to
+// the ones managed by go-imap-sql, see mdb.Migrate.
+var dbMigrations = []mdb.Migration{
+	{
+		ID: "20261014_storage_imapsql_mailbox_changes",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.MailboxChange{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.MailboxChange{})
+		},
+	},
+}
+
 func (store *Storage) initQuotaTable() error {
 	return store.GORMDB.AutoMigrate(&mdb.Quota{})
 }
 
 func (store *Storage) GetQuota(username string) (used, max int64, isDefault bool, err error) {
-	// Get current usage
-	// We'll use GORM here too for driver transparency
-	var result struct {
-		TotalUsed int64
+	used, _, err = store.usage(username)
+	if err != nil {
+		return 0, 0, false, err
 	}
-	err = store.GORMDB.Table("msgs").
-		Select("SUM(bodylen) as total_used").
-		Joins("JOIN mboxes ON msgs.mboxid = mboxes.id").
-		Joins("JOIN users ON mboxes.uid = users.id").
-		Where("users.username = ?", username).
-		Scan(&result).Error
+	max, _, isDefault, err = store.quotaLimits(username)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return used, max, isDefault, nil
+}
 
-	if err == nil {
-		used = result.TotalUsed
-	} else {
-		used = 0
+// usage returns the total size and count of messages of the account. The
+// values are maintained by go-imap-sql as messages are added and removed.
+func (store *Storage) usage(username string) (bytes, msgs int64, err error) {
+	bytes, msgs, err = store.Back.Usage(username)
+	if errors.Is(err, imapsql.ErrUserDoesntExists) {
+		return 0, 0, nil
 	}
+	return bytes, msgs, err
+}
 
-	// Get max storage
+// quotaLimits returns the storage and message count limits of the account.
+// Zero means no limit.
+func (store *Storage) quotaLimits(username string) (maxBytes, maxMsgs int64, isDefault bool, err error) {
 	var quota mdb.Quota
 	err = store.GORMDB.Where("username = ?", username).First(&quota).Error
 	if err == nil {
-		return used, quota.MaxStorage, false, nil
+		return quota.MaxStorage, quota.MaxMessages, false, nil
 	}
 	if !errors.Is(err, gorm.ErrRecordNotFound) {
 		return 0, 0, false, err
@@ -403,10 +512,55 @@ func (store *Storage) GetQuota(username string) (used, max int64, isDefault bool
 	var globalDef mdb.Quota
 	err = store.GORMDB.Where("username = ?", "__GLOBAL_DEFAULT__").First(&globalDef).Error
 	if err == nil {
-		return used, globalDef.MaxStorage, true, nil
+		return globalDef.MaxStorage, globalDef.MaxMessages, true, nil
+	}
+
+	return store.defaultQuota, store.defaultQuotaMsgs, true, nil
+}
+
+// GetMessageQuota returns the number of messages stored for the account and
+// the limit on it. Zero limit means no limit.
+func (store *Storage) GetMessageQuota(username string) (used, max int64, err error) {
+	_, used, err = store.usage(username)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, max, _, err = store.quotaLimits(username)
+	if err != nil {
+		return 0, 0, err
 	}
+	return used, max, nil
+}
+
+// SetMessageQuota sets the limit on the number of messages stored for the
+// account. Zero means no limit.
+func (store *Storage) SetMessageQuota(username string, max int64) error {
+	return store.withTx(context.TODO(), "set_message_quota", func(tx *gorm.DB) error {
+		var quota mdb.Quota
+		err := tx.Where("username = ?", username).First(&quota).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			quota = mdb.Quota{
+				Username:     username,
+				MaxStorage:   store.GetDefaultQuota(),
+				CreatedAt:    time.Now().Unix(),
+				FirstLoginAt: 1,
+			}
+		}
+		quota.MaxMessages = max
+
+		return tx.Save(&quota).Error
+	})
+}
 
-	return used, store.defaultQuota, true, nil
+// RecalculateQuota rebuilds the usage counters of the account from the
+// stored messages. If username is empty, counters of all accounts are
+// rebuilt.
+func (store *Storage) RecalculateQuota(username string) error {
+	return store.Back.RecalculateUsage(username)
 }
 
 func (store *Storage) GetDefaultQuota() int64 {
@@ -423,24 +577,26 @@ func (store *Storage) SetDefaultQuota(max int64) error {
 }
 
 func (store *Storage) SetQuota(username string, max int64) error {
-	var quota mdb.Quota
-	err := store.GORMDB.Where("username = ?", username).First(&quota).Error
-	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-		return err
-	}
+	return store.withTx(context.TODO(), "set_quota", func(tx *gorm.DB) error {
+		var quota mdb.Quota
+		err := tx.Where("username = ?", username).First(&quota).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
 
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		quota = mdb.Quota{
-			Username:     username,
-			MaxStorage:   max,
-			CreatedAt:    time.Now().Unix(),
-			FirstLoginAt: 1,
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			quota = mdb.Quota{
+				Username:     username,
+				MaxStorage:   max,
+				CreatedAt:    time.Now().Unix(),
+				FirstLoginAt: 1,
+			}
+		} else {
+			quota.MaxStorage = max
 		}
-	} else {
-		quota.MaxStorage = max
-	}
 
-	return store.GORMDB.Save(&quota).Error
+		return tx.Save(&quota).Error
+	})
 }
 
 func (store *Storage) ResetQuota(username string) error {
@@ -459,10 +615,10 @@ func (store *Storage) GetAccountDate(username string) (created int64, err error)
 	var result struct {
 		MinDate int64
 	}
-	err = store.GORMDB.Table("msgs").
+	err = store.GORMDB.Table(store.table("msgs")+" msgs").
 		Select("MIN(date) as min_date").
-		Joins("JOIN mboxes ON msgs.mboxid = mboxes.id").
-		Joins("JOIN users ON mboxes.uid = users.id").
+		Joins("JOIN "+store.table("mboxes")+" mboxes ON msgs.mboxid = mboxes.id").
+		Joins("JOIN "+store.table("users")+" users ON mboxes.uid = users.id").
 		Where("users.username = ?", username).
 		Scan(&result).Error
 
@@ -474,53 +630,52 @@ func (store *Storage) GetAccountDate(username string) (created int64, err error)
 }
 
 func (store *Storage) UpdateFirstLogin(username string) error {
-	var quota mdb.Quota
-	err := store.GORMDB.Where("username = ?", username).First(&quota).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil
+	return store.withTx(context.TODO(), "update_first_login", func(tx *gorm.DB) error {
+		var quota mdb.Quota
+		err := tx.Where("username = ?", username).First(&quota).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
 		}
-		return err
-	}
 
-	if quota.FirstLoginAt == 1 {
-		quota.FirstLoginAt = time.Now().Unix()
-		return store.GORMDB.Save(&quota).Error
-	}
+		if quota.FirstLoginAt == 1 {
+			quota.FirstLoginAt = time.Now().Unix()
+			return tx.Save(&quota).Error
+		}
 
-	return nil
+		return nil
+	})
 }
 
 func (store *Storage) MigrateFirstLoginFromCreatedAt() error {
 	now := time.Now().Unix()
 
-	err := store.GORMDB.Model(&mdb.Quota{}).
-		Where("created_at IS NULL OR created_at = 0").
-		Update("created_at", now).Error
-	if err != nil {
-		return err
-	}
-
-	var count int64
-	err = store.GORMDB.Model(&mdb.Quota{}).
-		Where("first_login_at IS NULL OR first_login_at = 0").
-		Count(&count).Error
-	if err != nil {
-		return fmt.Errorf("failed to check migration status: %w", err)
-	}
+	return store.withTx(context.TODO(), "migrate_first_login", func(tx *gorm.DB) error {
+		err := tx.Model(&mdb.Quota{}).
+			Where("created_at IS NULL OR created_at = 0").
+			Update("created_at", now).Error
+		if err != nil {
+			return err
+		}
 
-	if count == 0 {
-		return nil
-	}
+		var count int64
+		err = tx.Model(&mdb.Quota{}).
+			Where("first_login_at IS NULL OR first_login_at = 0").
+			Count(&count).Error
+		if err != nil {
+			return fmt.Errorf("failed to check migration status: %w", err)
+		}
 
-	err = store.GORMDB.Model(&mdb.Quota{}).
-		Where("first_login_at IS NULL OR first_login_at = 0").
-		Update("first_login_at", now).Error
-	if err != nil {
-		return err
-	}
+		if count == 0 {
+			return nil
+		}
 
-	return nil
+		return tx.Model(&mdb.Quota{}).
+			Where("first_login_at IS NULL OR first_login_at = 0").
+			Update("first_login_at", now).Error
+	})
 }
 
 func (store *Storage) PruneUnusedAccounts(retention time.Duration) error {
@@ -580,13 +735,19 @@ func (store *Storage) PruneUnusedAccounts(retention time.Duration) error {
 	return nil
 }
 
+// table returns the name of the go-imap-sql table with the configured
+// table_prefix.
+func (store *Storage) table(name string) string {
+	return mdb.TableName(store.GORMDB, name)
+}
+
 func (store *Storage) GetStat() (totalStorage int64, accountsCount int, err error) {
 	var total sql.NullInt64
-	store.GORMDB.Table("msgs").Select("SUM(bodylen)").Scan(&total)
+	store.GORMDB.Table(store.table("msgs")).Select("SUM(bodylen)").Scan(&total)
 	totalStorage = total.Int64
 
 	var count int64
-	store.GORMDB.Table("users").Count(&count)
+	store.GORMDB.Table(store.table("users")).Count(&count)
 	accountsCount = int(count)
 
 	return totalStorage, accountsCount, nil
@@ -610,19 +771,128 @@ func (store *Storage) cleanupUnusedAccountsLoop() {
 	}
 }
 
+func (store *Storage) gcLoop() {
+	ticker := time.NewTicker(store.gcInterval)
+	for range ticker.C {
+		removed, err := store.CollectGarbage(store.gcMinAge)
+		if err != nil {
+			store.Log.Error("message store garbage collection failed", err)
+			continue
+		}
+		if removed > 0 {
+			store.Log.Msg("removed unused message bodies", "count", removed)
+		}
+	}
+}
+
+func (store *Storage) purgeLoop() {
+	ticker := time.NewTicker(store.expungePurgeInterval)
+	for range ticker.C {
+		purged, err := store.PurgeExpunged(store.expungeRetention)
+		if err != nil {
+			store.Log.Error("expunged messages purge failed", err)
+		}
+		if purged > 0 {
+			store.Log.Msg("purged expunged messages", "count", purged)
+		}
+	}
+}
+
+// PurgeExpunged permanently removes messages expunged more than retention
+// ago. Messages are removed in batches of expunge_purge_batch. The number of
+// removed messages is returned.
+func (store *Storage) PurgeExpunged(retention time.Duration) (int, error) {
+	before := time.Now().Add(-retention)
+	var purged int
+	for {
+		n, err := store.Back.PurgeDeleted(before, store.expungePurgeBatch)
+		purged += n
+		if err != nil || n < store.expungePurgeBatch {
+			return purged, err
+		}
+	}
+}
+
+// PurgeMailbox permanently removes expunged messages of the mailbox before
+// expunge_retention passes.
+func (store *Storage) PurgeMailbox(username, mailbox string) (int, error) {
+	return store.Back.PurgeMailbox(username, mailbox)
+}
+
+// RestoreExpunged moves messages of the account expunged at or after since
+// back to their mailboxes. The number of restored messages is returned.
+func (store *Storage) RestoreExpunged(username string, since time.Time) (int, error) {
+	return store.Back.RestoreDeleted(username, since)
+}
+
+// GrantACL adds rights to the ACL entry of grantee for the mailbox of
+// username.
+func (store *Storage) GrantACL(username, mailbox, grantee, rights string) error {
+	return store.Back.GrantACL(username, mailbox, grantee, rights)
+}
+
+// RevokeACL removes rights from the ACL entry of grantee for the mailbox of
+// username. The entry is removed if rights is empty.
+func (store *Storage) RevokeACL(username, mailbox, grantee, rights string) error {
+	return store.Back.RevokeACL(username, mailbox, grantee, rights)
+}
+
+// ListACL returns the ACL of the mailbox of username.
+func (store *Storage) ListACL(username, mailbox string) ([]imapsql.ACLEntry, error) {
+	return store.Back.ListACL(username, mailbox)
+}
+
+// CollectGarbage removes message bodies that are not referenced by the
+// database, e.g. left after a crash during delivery. Bodies written less
+// than minAge ago are kept. The number of removed bodies is returned.
+func (store *Storage) CollectGarbage(minAge time.Duration) (int, error) {
+	return store.Back.CollectGarbage(minAge)
+}
+
+// MigrateBodies copies all message bodies to dst. msg_store should be
+// changed to dst afterwards.
+func (store *Storage) MigrateBodies(dst module.BlobStore, progress func(done, total int)) (copied, missing int, err error) {
+	return store.Back.CopyBodies(ExtBlobStore{Base: dst}, progress)
+}
+
+// DedupStats returns the number of deduplicated bodies and the space saved
+// by sharing them.
+func (store *Storage) DedupStats() (imapsql.DedupStats, error) {
+	return store.Back.DedupStats()
+}
+
+// ReindexSearch rebuilds the full-text search index for messages of the
+// user or of all users if username is empty. The number of indexed messages
+// is returned.
+func (store *Storage) ReindexSearch(username string) (int, error) {
+	return store.Back.ReindexSearch(username)
+}
+
+// afterDirectDelete updates the data derived from messages after they were
+// deleted from the database bypassing go-imap-sql.
+func (store *Storage) afterDirectDelete(username string) error {
+	if _, err := store.Back.DeleteUnreferencedBodies(); err != nil {
+		return err
+	}
+	return store.RecalculateQuota(username)
+}
+
 func (store *Storage) PruneMessages(retention time.Duration) error {
 	cutoff := time.Now().Add(-retention).Unix()
 
 	// go-imap-sql uses 'msgs' or 'messages' table.
 	// Recent versions use 'msgs' table with 'date' as Unix timestamp.
 	// We'll try to delete from 'msgs' where 'date' is older than cutoff.
-	err := store.GORMDB.Table("msgs").Where("date < ?", cutoff).Delete(nil).Error
+	err := store.GORMDB.Table(store.table("msgs")).Where("date < ?", cutoff).Delete(nil).Error
 	if err != nil {
 		// Try 'messages' table if 'msgs' fails
-		err = store.GORMDB.Table("messages").Where("date < ?", cutoff).Delete(nil).Error
+		err = store.GORMDB.Table(store.table("messages")).Where("date < ?", cutoff).Delete(nil).Error
 	}
 
-	return err
+	if err != nil {
+		return err
+	}
+	return store.afterDirectDelete("")
 }
 
 func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
@@ -630,34 +900,13 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 		return nil
 	}
 
-	switch store.driver {
-	case "sqlite3":
-		dbId := sha1.Sum([]byte(strings.Join(store.dsn, " ")))
-		sockPath := filepath.Join(
-			config.RuntimeDirectory,
-			fmt.Sprintf("sql-%s.sock", hex.EncodeToString(dbId[:])))
-		store.Log.DebugMsg("using unix socket for external updates", "path", sockPath)
-		store.updPipe = &updatepipe.UnixSockPipe{
-			SockPath: sockPath,
-			Log:      log.Logger{Name: "storage.imapsql/updpipe", Debug: store.Log.Debug},
-		}
-	case "postgres":
-		store.Log.DebugMsg("using PostgreSQL broker for external updates")
-		ps, err := pubsub.NewPQ(strings.Join(store.dsn, " "))
-		if err != nil {
-			return fmt.Errorf("enable_update_pipe: %w", err)
-		}
-		ps.Log = log.Logger{Name: "storage.imapsql/updpipe/pubsub", Debug: store.Log.Debug}
-		pipe := &updatepipe.PubSubPipe{
-			PubSub: ps,
-			Log:    log.Logger{Name: "storage.imapsql/updpipe", Debug: store.Log.Debug},
-		}
-		store.Back.UpdateManager().ExternalUnsubscribe = pipe.Unsubscribe
-		store.Back.UpdateManager().ExternalSubscribe = pipe.Subscribe
-		store.updPipe = pipe
-	default:
-		return errors.New("imapsql: driver does not have an update pipe implementation")
+	// Updates are exchanged using the database itself so they reach all
+	// instances sharing it, see changeFeed.
+	feed, err := newChangeFeed(store, store.changePollInterval)
+	if err != nil {
+		return fmt.Errorf("enable_update_pipe: %w", err)
 	}
+	store.updPipe = feed
 
 	inbound := make(chan mess.Update, 32)
 	outbound := make(chan mess.Update, 10)
@@ -668,6 +917,8 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 			store.updPipe = nil
 			return err
 		}
+		store.Back.UpdateManager().ExternalSubscribe = feed.ExternalSubscribe
+		store.Back.UpdateManager().ExternalUnsubscribe = feed.ExternalUnsubscribe
 	}
 
 	if err := store.updPipe.InitPush(); err != nil {
@@ -757,28 +1008,63 @@ func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error)
 
 	// Ensure quota record exists with FirstLoginAt=1 for JIT users.
 	// This is required to track them for pruning if they remain unused.
-	var quota mdb.Quota
-	err = store.GORMDB.Where("username = ?", accountName).First(&quota).Error
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		quota = mdb.Quota{
-			Username:     accountName,
-			CreatedAt:    time.Now().Unix(),
-			FirstLoginAt: 1,
-		}
-		if err := store.GORMDB.Create(&quota).Error; err != nil {
-			store.Log.Error("failed to create quota record for JIT user", err, "username", accountName)
-		}
-	} else if err == nil && quota.CreatedAt == 0 {
-		// Fix legacy records missing CreatedAt
-		quota.CreatedAt = time.Now().Unix()
-		if err := store.GORMDB.Save(&quota).Error; err != nil {
-			store.Log.Error("failed to fix CreatedAt for JIT user", err, "username", accountName)
-		}
+	if err := store.ensureQuotaRecord(accountName); err != nil {
+		store.Log.Error("failed to create quota record for JIT user", err, "username", accountName)
 	}
 
 	return u, nil
 }
 
+// domainQuota returns the default quota of the account domain set in
+// domain_table or zero if there is none.
+func (store *Storage) domainQuota(accountName string) (int64, error) {
+	if store.domains == nil {
+		return 0, nil
+	}
+	_, domain, err := address.Split(accountName)
+	if err != nil || domain == "" {
+		return 0, nil
+	}
+	d, ok, err := store.domains.Domain(context.TODO(), domain)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return d.DefaultQuota, nil
+}
+
+// ensureQuotaRecord creates the quota record for a new account with
+// FirstLoginAt=1 or sets CreatedAt for legacy records missing it. New
+// records get the default quota of the domain from domain_table.
+func (store *Storage) ensureQuotaRecord(accountName string) error {
+	maxStorage, err := store.domainQuota(accountName)
+	if err != nil {
+		return err
+	}
+	return store.withTx(context.TODO(), "ensure_quota_record", func(tx *gorm.DB) error {
+		var quota mdb.Quota
+		err := tx.Where("username = ?", accountName).First(&quota).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			quota = mdb.Quota{
+				Username:     accountName,
+				MaxStorage:   maxStorage,
+				CreatedAt:    time.Now().Unix(),
+				FirstLoginAt: 1,
+			}
+			return tx.Create(&quota).Error
+		} else if quota.CreatedAt == 0 {
+			// Fix legacy records missing CreatedAt
+			quota.CreatedAt = time.Now().Unix()
+			return tx.Save(&quota).Error
+		}
+
+		return nil
+	})
+}
+
 func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
 	accountName, err := store.authNormalize(ctx, key)
 	if err != nil {
@@ -799,6 +1085,16 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 	return "", true, nil
 }
 
+// CheckHealth implements module.HealthChecker.
+func (store *Storage) CheckHealth(ctx context.Context) error {
+	return mdb.Ping(ctx, store.GORMDB)
+}
+
+// GORM implements mdb.Provider.
+func (store *Storage) GORM() *gorm.DB {
+	return store.GORMDB
+}
+
 func (store *Storage) Close() error {
 	// Stop backend from generating new updates.
 	store.Back.Close()
@@ -827,4 +1123,5 @@ func (store *Storage) SupportedThreadAlgorithms() []sortthread.ThreadAlgorithm {
 func init() {
 	module.Register("storage.imapsql", New)
 	module.Register("target.imapsql", New)
+	mdb.RegisterMigrations("imapsql", dbMigrations)
 }
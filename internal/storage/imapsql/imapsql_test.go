@@ -0,0 +1,71 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package imapsql
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func initTestStorage(t *testing.T, driver, dsn string, extra ...config.Node) (*Storage, error) {
+	t.Helper()
+	dir := testutils.Dir(t)
+	mod, err := New("storage.imapsql", "", nil, []string{driver, dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*Storage)
+	store.Log = testutils.Logger(t, "imapsql")
+	children := append([]config.Node{
+		{Name: "msg_store", Args: []string{"fs", filepath.Join(dir, "messages")}},
+	}, extra...)
+	return store, store.Init(config.NewMap(nil, config.Node{Children: children}))
+}
+
+func testStorage(t *testing.T, extra ...config.Node) *Storage {
+	t.Helper()
+	store, err := initTestStorage(t, "sqlite3", filepath.Join(testutils.Dir(t), "imapsql.db"), extra...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestInit_RetryConnect(t *testing.T) {
+	// Nothing listens on port 1.
+	start := time.Now()
+	_, err := initTestStorage(t, "postgres", "host=127.0.0.1 port=1 user=maddy dbname=maddy sslmode=disable",
+		config.Node{Name: "connect_attempts", Args: []string{"2"}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("connection was not retried (took %v)", elapsed)
+	}
+}
+
+func TestInit_PoolOptions(t *testing.T) {
+	store := testStorage(t)
+	if got := store.Back.DB.Stats().MaxOpenConnections; got != 1 {
+		t.Errorf("expected 1 open connection for SQLite by default, got %d", got)
+	}
+
+	store = testStorage(t, config.Node{Name: "max_open_conns", Args: []string{"3"}})
+	if got := store.Back.DB.Stats().MaxOpenConnections; got != 3 {
+		t.Errorf("expected max_open_conns to be applied to the go-imap-sql pool, got %d", got)
+	}
+}
+
+func TestInit_SQLServerRejected(t *testing.T) {
+	_, err := initTestStorage(t, "mssql", "sqlserver://maddy@127.0.0.1:1?database=maddy")
+	if err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Fatal("expected the sqlserver driver to be rejected, got", err)
+	}
+}
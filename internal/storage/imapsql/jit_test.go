@@ -48,6 +48,10 @@ func setupTestStorageForJIT(t *testing.T) (*Storage, func()) {
 		t.Fatalf("Failed to open GORM database: %v", err)
 	}
 
+	if err := os.MkdirAll(filepath.Join(testDir, "messages"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
 	// Create real imapsql backend with the same database
 	randSrc := rand.NewSource(0)
 	prng := rand.New(randSrc)
@@ -19,12 +19,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package imapsql
 
 import (
-	"errors"
 	"time"
 
 	"github.com/emersion/go-imap/backend"
 	mdb "github.com/themadorg/madmail/internal/db"
-	"gorm.io/gorm"
 )
 
 // These methods wrap corresponding go-imap-sql methods, but also apply
@@ -39,25 +37,7 @@ func (store *Storage) CreateIMAPAcct(accountName string) error {
 		return err
 	}
 
-	var quota mdb.Quota
-	err := store.GORMDB.Where("username = ?", accountName).First(&quota).Error
-	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-		return err
-	}
-
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		quota = mdb.Quota{
-			Username:     accountName,
-			CreatedAt:    time.Now().Unix(),
-			FirstLoginAt: 1,
-		}
-		return store.GORMDB.Create(&quota).Error
-	} else if quota.CreatedAt == 0 {
-		quota.CreatedAt = time.Now().Unix()
-		return store.GORMDB.Save(&quota).Error
-	}
-
-	return nil
+	return store.ensureQuotaRecord(accountName)
 }
 
 func (store *Storage) DeleteIMAPAcct(accountName string) error {
@@ -66,20 +46,33 @@ func (store *Storage) DeleteIMAPAcct(accountName string) error {
 }
 
 func (store *Storage) PurgeIMAPMsgs(username string) error {
-	return store.GORMDB.Table("msgs").Where("\"mboxId\" IN (SELECT id FROM mboxes WHERE uid IN (SELECT id FROM users WHERE username = ?))", username).Delete(nil).Error
+	err := store.GORMDB.Table(store.table("msgs")).Where("\"mboxId\" IN (SELECT id FROM "+store.table("mboxes")+" WHERE uid IN (SELECT id FROM "+store.table("users")+" WHERE username = ?))", username).Delete(nil).Error
+	if err != nil {
+		return err
+	}
+	return store.afterDirectDelete(username)
 }
 
 func (store *Storage) PurgeAllIMAPMsgs() error {
-	return store.GORMDB.Exec("DELETE FROM msgs").Error
+	if err := store.GORMDB.Exec("DELETE FROM " + store.table("msgs")).Error; err != nil {
+		return err
+	}
+	return store.afterDirectDelete("")
 }
 
 func (store *Storage) PurgeReadIMAPMsgs() error {
-	return store.GORMDB.Table("msgs").Where("seen = 1").Delete(nil).Error
+	if err := store.GORMDB.Table(store.table("msgs")).Where("seen = 1").Delete(nil).Error; err != nil {
+		return err
+	}
+	return store.afterDirectDelete("")
 }
 
 func (store *Storage) PruneUnreadIMAPMsgs(retention time.Duration) error {
 	cutoff := time.Now().Add(-retention).Unix()
-	return store.GORMDB.Table("msgs").Where("seen = 0 AND date < ?", cutoff).Delete(nil).Error
+	if err := store.GORMDB.Table(store.table("msgs")).Where("seen = 0 AND date < ?", cutoff).Delete(nil).Error; err != nil {
+		return err
+	}
+	return store.afterDirectDelete("")
 }
 
 func (store *Storage) GetIMAPAcct(accountName string) (backend.User, error) {
@@ -0,0 +1,293 @@
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/emersion/go-message/textproto"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm/clause"
+)
+
+// MaildirImportOptions controls ImportMaildir, the zero value is usable.
+type MaildirImportOptions struct {
+	// DryRun makes ImportMaildir only read and validate messages and count
+	// the ones that would be imported.
+	DryRun bool
+}
+
+// MaildirImportResult is the outcome of importing one Maildir folder.
+type MaildirImportResult struct {
+	Mailbox string
+
+	// Imported is the number of imported messages, or the number of
+	// messages that would be imported in the dry run mode. Skipped is the
+	// number of messages imported by an earlier run.
+	Imported int
+	Skipped  int
+
+	// Errors are the messages that could not be imported, they are
+	// retried by the next run.
+	Errors []error
+}
+
+// maildirFlags maps Maildir info flags to IMAP flags.
+var maildirFlags = map[rune]string{
+	'S': imap.SeenFlag,
+	'R': imap.AnsweredFlag,
+	'F': imap.FlaggedFlag,
+	'T': imap.DeletedFlag,
+	'D': imap.DraftFlag,
+}
+
+type maildirFolder struct {
+	mailbox string
+	path    string
+}
+
+type maildirMessage struct {
+	path  string
+	flags []string
+	date  time.Time
+}
+
+// ImportMaildir imports messages from the Maildir++ directory, as used by
+// Dovecot, into the existing IMAP account. Folders are created as needed,
+// Maildir info flags are converted to IMAP flags and the file modification
+// time is used as the INTERNALDATE.
+//
+// Messages are appended the same way as using IMAP APPEND and the account
+// quota is enforced. SHA-256 hashes of imported messages are recorded in
+// the imported_messages table, so an interrupted import can be run again
+// and messages already imported are skipped.
+//
+// Per-message failures are reported in the results and do not stop the
+// import. The error is returned if the import cannot continue, e.g. if the
+// quota is exceeded, results for the already processed folders are
+// returned along with it.
+func (store *Storage) ImportMaildir(ctx context.Context, username, dir string, opts MaildirImportOptions) ([]MaildirImportResult, error) {
+	folders, err := listMaildirFolders(dir)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: import maildir %s: %w", dir, err)
+	}
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: import maildir %s: %w", dir, err)
+	}
+	defer u.Logout()
+
+	haveRecords := store.GORMDB.Migrator().HasTable(&mdb.ImportedMessage{})
+	if !opts.DryRun && !haveRecords {
+		if err := store.GORMDB.AutoMigrate(&mdb.ImportedMessage{}); err != nil {
+			return nil, fmt.Errorf("imapsql: import maildir %s: %w", dir, err)
+		}
+		haveRecords = true
+	}
+
+	results := make([]MaildirImportResult, 0, len(folders))
+	for _, folder := range folders {
+		res := MaildirImportResult{Mailbox: folder.mailbox}
+		err := store.importMaildirFolder(ctx, u, username, folder, opts, haveRecords, &res)
+		results = append(results, res)
+		if err != nil {
+			return results, fmt.Errorf("imapsql: import maildir %s: %s: %w", dir, folder.mailbox, err)
+		}
+	}
+	return results, nil
+}
+
+func (store *Storage) importMaildirFolder(ctx context.Context, u backend.User, username string, folder maildirFolder, opts MaildirImportOptions, haveRecords bool, res *MaildirImportResult) error {
+	msgs, err := listMaildirMessages(folder.path)
+	if err != nil {
+		return err
+	}
+
+	var mbox backend.Mailbox
+	if !opts.DryRun {
+		if err := u.CreateMailbox(folder.mailbox); err != nil && !errors.Is(err, backend.ErrMailboxAlreadyExists) {
+			return err
+		}
+		_, mbox, err = u.GetMailbox(folder.mailbox, false, nil)
+		if err != nil {
+			return err
+		}
+		defer mbox.Close()
+	}
+
+	for _, msg := range msgs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		blob, err := os.ReadFile(msg.path)
+		if err != nil {
+			res.Errors = append(res.Errors, err)
+			continue
+		}
+		if _, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(blob))); err != nil {
+			res.Errors = append(res.Errors, fmt.Errorf("%s: malformed header: %w", msg.path, err))
+			continue
+		}
+		sum := sha256.Sum256(blob)
+		hash := hex.EncodeToString(sum[:])
+
+		if haveRecords {
+			var count int64
+			err := store.GORMDB.WithContext(ctx).Model(&mdb.ImportedMessage{}).
+				Where("account = ? AND mailbox = ? AND hash = ?", username, folder.mailbox, hash).
+				Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count != 0 {
+				res.Skipped++
+				continue
+			}
+		}
+		if opts.DryRun {
+			res.Imported++
+			continue
+		}
+
+		if err := store.checkQuota(username, int64(len(blob))); err != nil {
+			return err
+		}
+		if err := mbox.(*imapsql.Mailbox).CreateMessage(msg.flags, msg.date, bytes.NewReader(blob)); err != nil {
+			res.Errors = append(res.Errors, fmt.Errorf("%s: %w", msg.path, err))
+			continue
+		}
+		err = store.GORMDB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&mdb.ImportedMessage{
+			Account:    username,
+			Mailbox:    folder.mailbox,
+			Hash:       hash,
+			ImportedAt: time.Now().UTC(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		res.Imported++
+	}
+	return nil
+}
+
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		info, err := os.Stat(filepath.Join(dir, sub))
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// listMaildirFolders returns INBOX stored in dir and Maildir++ folders
+// stored in subdirectories named with a dot followed by the folder name
+// in modified UTF-7, e.g. ".Archive.2020". Parent folders are listed before
+// their children.
+func listMaildirFolders(dir string) ([]maildirFolder, error) {
+	if !isMaildir(dir) {
+		return nil, errors.New("not a Maildir, cur and new subdirectories are missing")
+	}
+
+	folders := []maildirFolder{{mailbox: "INBOX", path: dir}}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || len(name) < 2 || name[0] != '.' || name == ".." {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if !isMaildir(path) {
+			continue
+		}
+		mailbox, err := utf7.Encoding.NewDecoder().String(name[1:])
+		if err != nil {
+			// Dovecot stores names in UTF-8 if configured with the UTF8
+			// layout option.
+			mailbox = name[1:]
+		}
+		mailbox = strings.ReplaceAll(mailbox, ".", imapsql.MailboxPathSep)
+		if strings.EqualFold(mailbox, "INBOX") {
+			continue
+		}
+		folders = append(folders, maildirFolder{mailbox: mailbox, path: path})
+	}
+	sort.Slice(folders[1:], func(i, j int) bool {
+		return folders[i+1].mailbox < folders[j+1].mailbox
+	})
+	return folders, nil
+}
+
+// listMaildirMessages returns messages stored in the new and cur
+// subdirectories of the folder ordered by delivery time.
+func listMaildirMessages(dir string) ([]maildirMessage, error) {
+	var msgs []maildirMessage
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			msg := maildirMessage{
+				path: filepath.Join(dir, sub, entry.Name()),
+				date: info.ModTime(),
+			}
+			if sub == "cur" {
+				msg.flags = parseMaildirFlags(entry.Name())
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if !msgs[i].date.Equal(msgs[j].date) {
+			return msgs[i].date.Before(msgs[j].date)
+		}
+		return filepath.Base(msgs[i].path) < filepath.Base(msgs[j].path)
+	})
+	return msgs, nil
+}
+
+// parseMaildirFlags returns IMAP flags for the info part of the Maildir
+// file name, e.g. "1577836800.M1P2.host:2,FS". Unknown flags, including
+// Dovecot keywords (lowercase letters), are ignored.
+func parseMaildirFlags(filename string) []string {
+	i := strings.LastIndex(filename, ":2,")
+	if i == -1 {
+		// Used instead of ':' on filesystems that do not allow it.
+		i = strings.LastIndex(filename, ";2,")
+	}
+	if i == -1 {
+		return nil
+	}
+	var flags []string
+	for _, ch := range filename[i+3:] {
+		if flag, ok := maildirFlags[ch]; ok {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
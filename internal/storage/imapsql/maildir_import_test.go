@@ -0,0 +1,147 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package imapsql
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func writeMaildirFile(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseMaildirFlags(t *testing.T) {
+	for name, expected := range map[string][]string{
+		"1577836800.M1P2.host":          nil,
+		"1577836800.M1P2.host:2,":       nil,
+		"1577836800.M1P2.host:2,DFRST":  {imap.DraftFlag, imap.FlaggedFlag, imap.AnsweredFlag, imap.SeenFlag, imap.DeletedFlag},
+		"1577836800.M1P2.host;2,Sa":     {imap.SeenFlag},
+		"1577836800.M1P2.host,S=10:2,F": {imap.FlaggedFlag},
+	} {
+		if flags := parseMaildirFlags(name); !reflect.DeepEqual(flags, expected) {
+			t.Errorf("%s: expected %v, got %v", name, expected, flags)
+		}
+	}
+}
+
+func TestImportMaildir(t *testing.T) {
+	store, cleanup := setupTestStorageForJIT(t)
+	defer cleanup()
+
+	const username = "user@example.org"
+	if err := store.Back.CreateUser(username); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	date := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	writeMaildirFile(t, filepath.Join(dir, "new", "1.M1.host"), "Subject: 1\r\n\r\nnew\r\n", date)
+	writeMaildirFile(t, filepath.Join(dir, "cur", "2.M2.host:2,SF"), "Subject: 2\r\n\r\nseen\r\n", date.Add(time.Hour))
+	writeMaildirFile(t, filepath.Join(dir, "cur", "3.M3.host:2,S"), "not a header\r\n", date)
+	writeMaildirFile(t, filepath.Join(dir, ".Archive.2020", "cur", "4.M4.host:2,R"), "Subject: 4\r\n\r\narchived\r\n", date)
+	if err := os.MkdirAll(filepath.Join(dir, ".Archive.2020", "new"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writeMaildirFile(t, filepath.Join(dir, ".&BCcEOwQ1BD0-", "cur", "5.M5.host"), "Subject: 5\r\n\r\nutf7\r\n", date)
+	if err := os.MkdirAll(filepath.Join(dir, ".&BCcEOwQ1BD0-", "new"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(opts MaildirImportOptions, expected []MaildirImportResult) {
+		t.Helper()
+		res, err := store.ImportMaildir(context.Background(), username, dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(expected) {
+			t.Fatalf("expected %d folders, got %+v", len(expected), res)
+		}
+		for i := range res {
+			if res[i].Mailbox != expected[i].Mailbox || res[i].Imported != expected[i].Imported ||
+				res[i].Skipped != expected[i].Skipped || len(res[i].Errors) != len(expected[i].Errors) {
+				t.Errorf("expected %+v, got %+v", expected[i], res[i])
+			}
+		}
+	}
+
+	check(MaildirImportOptions{DryRun: true}, []MaildirImportResult{
+		{Mailbox: "INBOX", Imported: 2, Errors: make([]error, 1)},
+		{Mailbox: "Archive.2020", Imported: 1},
+		{Mailbox: "Член", Imported: 1},
+	})
+	_, msgs, err := store.usage(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs != 0 {
+		t.Fatalf("dry run imported %d messages", msgs)
+	}
+
+	check(MaildirImportOptions{}, []MaildirImportResult{
+		{Mailbox: "INBOX", Imported: 2, Errors: make([]error, 1)},
+		{Mailbox: "Archive.2020", Imported: 1},
+		{Mailbox: "Член", Imported: 1},
+	})
+	check(MaildirImportOptions{}, []MaildirImportResult{
+		{Mailbox: "INBOX", Skipped: 2, Errors: make([]error, 1)},
+		{Mailbox: "Archive.2020", Skipped: 1},
+		{Mailbox: "Член", Skipped: 1},
+	})
+
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mbox, err := u.GetMailbox("INBOX", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+	seqSet, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	if err := mbox.ListMessages(false, seqSet, []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate}, ch); err != nil {
+		t.Fatal(err)
+	}
+	var got []*imap.Message
+	for msg := range ch {
+		flags := msg.Flags[:0]
+		for _, flag := range msg.Flags {
+			if flag != imap.RecentFlag {
+				flags = append(flags, flag)
+			}
+		}
+		msg.Flags = flags
+		got = append(got, msg)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 messages in INBOX, got %d", len(got))
+	}
+	if !got[0].InternalDate.Equal(date) || !got[1].InternalDate.Equal(date.Add(time.Hour)) {
+		t.Errorf("unexpected INTERNALDATE: %v, %v", got[0].InternalDate, got[1].InternalDate)
+	}
+	if len(got[0].Flags) != 0 {
+		t.Errorf("unexpected flags of a new message: %v", got[0].Flags)
+	}
+	sort.Strings(got[1].Flags)
+	if !reflect.DeepEqual(got[1].Flags, []string{imap.FlaggedFlag, imap.SeenFlag}) {
+		t.Errorf("unexpected flags: %v", got[1].Flags)
+	}
+}
@@ -0,0 +1,124 @@
+package imapsql
+
+import (
+	"context"
+	"fmt"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	mdb "github.com/themadorg/madmail/internal/db"
+)
+
+// PurgeAccount removes the account and everything stored for it: messages,
+// including expunged ones kept for expunge_retention, mailboxes and the rows
+// of the storage database referencing the account (see mdb.PurgeAccount).
+// Message bodies are removed after the transaction that removed the
+// messages commits, at most opts.BatchSize messages are removed in one
+// transaction.
+//
+// Other modules with their own databases are not handled, use
+// mdb.PurgeAccount for them. The returned report contains the counts of
+// the committed changes even if an error is returned.
+func (store *Storage) PurgeAccount(ctx context.Context, username string, opts mdb.PurgeOptions) (mdb.PurgeReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = mdb.DefaultPurgeBatchSize
+	}
+	report := make(mdb.PurgeReport)
+
+	exists, err := store.accountExists(ctx, username)
+	if err != nil {
+		return report, fmt.Errorf("imapsql: purge %s: %w", username, err)
+	}
+	if exists {
+		if opts.DryRun {
+			err = store.countAccountRows(ctx, username, report)
+		} else {
+			err = store.deleteAccountRows(ctx, username, opts.BatchSize, report)
+		}
+		if err != nil {
+			return report, fmt.Errorf("imapsql: purge %s: %w", username, err)
+		}
+	}
+
+	dbReport, err := mdb.PurgeAccount(ctx, store.GORMDB, username, opts)
+	report.Merge(dbReport)
+	if err != nil {
+		return report, fmt.Errorf("imapsql: purge %s: %w", username, err)
+	}
+	return report, nil
+}
+
+func (store *Storage) accountExists(ctx context.Context, username string) (bool, error) {
+	count, err := store.countRows(ctx, "users", "username = ?", username)
+	return count != 0, err
+}
+
+// countRows counts rows of the go-imap-sql table. Raw SQL is used since
+// go-imap-sql creates tables and columns with unquoted mixed-case names.
+func (store *Storage) countRows(ctx context.Context, table, where string, args ...interface{}) (int64, error) {
+	var count int64
+	err := store.GORMDB.WithContext(ctx).
+		Raw("SELECT COUNT(*) FROM "+store.table(table)+" WHERE "+where, args...).
+		Scan(&count).Error
+	return count, err
+}
+
+func (store *Storage) userMboxesQuery() string {
+	return "SELECT id FROM " + store.table("mboxes") + " WHERE uid IN (SELECT id FROM " +
+		store.table("users") + " WHERE username = ?)"
+}
+
+// countAccountRows adds the number of messages, expunged messages,
+// mailboxes and the account row to report, as removed by deleteAccountRows.
+func (store *Storage) countAccountRows(ctx context.Context, username string, report mdb.PurgeReport) error {
+	for _, table := range []string{"msgs", "deletedMsgs"} {
+		count, err := store.countRows(ctx, table, "mboxId IN ("+store.userMboxesQuery()+")", username)
+		if err != nil {
+			return err
+		}
+		report.Add(store.table(table), count)
+	}
+
+	count, err := store.countRows(ctx, "mboxes", "uid IN (SELECT id FROM "+store.table("users")+" WHERE username = ?)", username)
+	if err != nil {
+		return err
+	}
+	report.Add(store.table("mboxes"), count)
+
+	count, err = store.countRows(ctx, "users", "username = ?", username)
+	if err != nil {
+		return err
+	}
+	report.Add(store.table("users"), count)
+	return nil
+}
+
+// deleteAccountRows removes messages of the account in batches, then the
+// account itself.
+func (store *Storage) deleteAccountRows(ctx context.Context, username string, batchSize int, report mdb.PurgeReport) error {
+	for {
+		msgs, deleted, err := store.Back.PurgeUserMessages(username, batchSize)
+		report.Add(store.table("msgs"), int64(msgs))
+		report.Add(store.table("deletedMsgs"), int64(deleted))
+		if err != nil {
+			return err
+		}
+		if msgs+deleted < batchSize {
+			break
+		}
+	}
+
+	mboxes, err := store.countRows(ctx, "mboxes", "uid IN (SELECT id FROM "+store.table("users")+" WHERE username = ?)", username)
+	if err != nil {
+		return err
+	}
+	if err := store.Back.DeleteUser(username); err != nil {
+		if err == imapsql.ErrUserDoesntExists {
+			// Removed concurrently, nothing is removed by this call.
+			return nil
+		}
+		return err
+	}
+	report.Add(store.table("mboxes"), mboxes)
+	report.Add(store.table("users"), 1)
+	return nil
+}
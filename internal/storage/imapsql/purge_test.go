@@ -0,0 +1,93 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package imapsql
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	mdb "github.com/themadorg/madmail/internal/db"
+)
+
+func TestPurgeAccount(t *testing.T) {
+	store, cleanup := setupTestStorageForJIT(t)
+	defer cleanup()
+	store.Back.Opts.SoftDelete = true
+
+	const username = "user@example.org"
+	if err := store.CreateIMAPAcct(username); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateIMAPAcct("other@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		d := store.Back.NewDelivery()
+		if err := d.AddRcpt(username, textproto.Header{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.BodyRaw(strings.NewReader("Subject: test\r\n\r\ntest\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mbox, err := u.GetMailbox(imap.InboxName, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := imap.ParseSeqSet("1")
+	if err := mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	mbox.Close()
+	u.Logout()
+
+	want := mdb.PurgeReport{"msgs": 2, "deletedMsgs": 1, "mboxes": 1, "users": 1, "quota": 1}
+	ctx := context.Background()
+	report, err := store.PurgeAccount(ctx, username, mdb.PurgeOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("dry run: got %v, want %v", report, want)
+	}
+
+	report, err = store.PurgeAccount(ctx, username, mdb.PurgeOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("got %v, want %v", report, want)
+	}
+
+	accts, err := store.ListIMAPAccts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(accts, []string{"other@example.org"}) {
+		t.Errorf("unexpected accounts left: %v", accts)
+	}
+
+	report, err = store.PurgeAccount(ctx, username, mdb.PurgeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 0 {
+		t.Errorf("second purge changed rows: %v", report)
+	}
+}
@@ -0,0 +1,169 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/exterrors"
+	"github.com/themadorg/madmail/framework/module"
+)
+
+func TestCheckQuota(t *testing.T) {
+	store, cleanup := setupTestStorageForJIT(t)
+	defer cleanup()
+
+	const username = "user@example.org"
+	if err := store.Back.CreateUser(username); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetQuota(username, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMessageQuota(username, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := "Subject: test\r\n\r\n" + strings.Repeat("a", 30) + "\r\n"
+	deliver := func() {
+		t.Helper()
+
+		d := store.Back.NewDelivery()
+		if err := d.AddRcpt(username, textproto.Header{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.BodyRaw(strings.NewReader(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkCode := func(size int64, code int) {
+		t.Helper()
+
+		err := store.checkQuota(username, size)
+		if code == 0 {
+			if err != nil {
+				t.Errorf("size %d: unexpected error: %v", size, err)
+			}
+			return
+		}
+		var smtpErr *exterrors.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != code {
+			t.Errorf("size %d: expected SMTP code %d, got %v", size, code, err)
+		}
+	}
+
+	deliver()
+	used, _, _, err := store.GetQuota(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != int64(len(msg)) {
+		t.Errorf("expected %d bytes used, got %d", len(msg), used)
+	}
+	checkCode(int64(len(msg)), 0)
+	checkCode(100, 552)
+
+	deliver()
+	usedMsgs, maxMsgs, err := store.GetMessageQuota(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usedMsgs != 2 || maxMsgs != 2 {
+		t.Errorf("expected 2 of 2 messages, got %d of %d", usedMsgs, maxMsgs)
+	}
+	checkCode(0, 552)
+
+	store.quotaSoftLimit = true
+	checkCode(0, 452)
+
+	// Unknown accounts have no usage.
+	if err := store.checkQuota("nobody@example.org", 10); err != nil {
+		t.Errorf("unexpected error for an unknown account: %v", err)
+	}
+}
+
+type rcptStatuses map[string]error
+
+func (s rcptStatuses) SetStatus(rcptTo string, err error) {
+	s[rcptTo] = err
+}
+
+func TestBodyNonAtomic_Quota(t *testing.T) {
+	store, cleanup := setupTestStorageForJIT(t)
+	defer cleanup()
+	store.deliveryNormalize = store.authNormalize
+
+	const (
+		rcptOK   = "ok@example.org"
+		rcptFull = "full@example.org"
+	)
+	for _, username := range []string{rcptOK, rcptFull} {
+		if err := store.Back.CreateUser(username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetQuota(rcptFull, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	body := buffer.MemoryBuffer{Slice: []byte(strings.Repeat("a", 30) + "\r\n")}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "test")
+	start := func() module.Delivery {
+		t.Helper()
+		d, err := store.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rcpt := range []string{rcptOK, rcptFull} {
+			if err := d.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return d
+	}
+
+	// Body is atomic, so the message is rejected for both.
+	d := start()
+	if err := d.Body(ctx, hdr, body); err == nil {
+		t.Error("expected an error from Body")
+	}
+	if err := d.Abort(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	d = start()
+	statuses := rcptStatuses{}
+	d.(module.PartialDelivery).BodyNonAtomic(ctx, statuses, hdr, body)
+	if err := d.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := statuses[rcptOK]; !ok || err != nil {
+		t.Errorf("unexpected status for %s: %v (set: %v)", rcptOK, err, ok)
+	}
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(statuses[rcptFull], &smtpErr) || smtpErr.Code != 552 {
+		t.Errorf("expected SMTP code 552 for %s, got %v", rcptFull, statuses[rcptFull])
+	}
+
+	for username, expected := range map[string]int64{rcptOK: 1, rcptFull: 0} {
+		_, used, err := store.usage(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used != expected {
+			t.Errorf("expected %d messages for %s, got %d", expected, username, used)
+		}
+	}
+}
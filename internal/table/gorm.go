@@ -36,22 +36,31 @@ func (g *GORMTable) InstanceName() string {
 func (g *GORMTable) Init(cfg *config.Map) error {
 	var (
 		driver    string
-		dsnParts  []string
+		dsn       db.DSN
 		tableName string
+		dbOpts    db.Options
 	)
-	cfg.String("driver", false, true, "", &driver)
-	cfg.StringList("dsn", false, true, nil, &dsnParts)
+	db.DriverDirective(cfg, "driver", true, "", &driver)
+	db.DSNDirective(cfg, "dsn", true, nil, &dsn)
 	cfg.String("table_name", false, true, "", &tableName)
+	db.Directives(cfg, &dbOpts)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	database, err := db.New(driver, dsnParts, log.DefaultLogger.Debug)
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return err
+	}
+
+	dbOpts.Log = log.Logger{Name: g.modName, Debug: log.DefaultLogger.Debug}
+	dbOpts.MetricsName = g.instName
+	database, err := db.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
 	if err != nil {
 		return err
 	}
 	g.db = database
-	g.table = tableName
+	g.table = db.TableName(database, tableName)
 
 	// Auto-migrate the table entry model using the configured table name
 	if err := g.db.Table(g.table).AutoMigrate(&db.TableEntry{}); err != nil {
@@ -62,16 +71,24 @@ func (g *GORMTable) Init(cfg *config.Map) error {
 }
 
 func (g *GORMTable) Close() error {
-	sqlDB, err := g.db.DB()
-	if err != nil {
-		return err
-	}
-	return sqlDB.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), db.DefaultCloseTimeout)
+	defer cancel()
+	return db.Close(ctx, g.db)
+}
+
+// CheckHealth implements module.HealthChecker.
+func (g *GORMTable) CheckHealth(ctx context.Context) error {
+	return db.Ping(ctx, g.db)
+}
+
+// GORM implements db.Provider.
+func (g *GORMTable) GORM() *gorm.DB {
+	return g.db
 }
 
 func (g *GORMTable) Lookup(ctx context.Context, key string) (string, bool, error) {
 	var entry db.TableEntry
-	err := g.db.WithContext(ctx).Table(g.table).Where("\"key\" = ?", key).First(&entry).Error
+	err := g.db.WithContext(ctx).Table(g.table).Where(map[string]interface{}{"key": key}).First(&entry).Error
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return "", false, nil
@@ -83,7 +100,7 @@ func (g *GORMTable) Lookup(ctx context.Context, key string) (string, bool, error
 
 func (g *GORMTable) LookupMulti(ctx context.Context, key string) ([]string, error) {
 	var entries []db.TableEntry
-	err := g.db.WithContext(ctx).Table(g.table).Where("\"key\" = ?", key).Find(&entries).Error
+	err := g.db.WithContext(ctx).Table(g.table).Where(map[string]interface{}{"key": key}).Find(&entries).Error
 	if err != nil {
 		return nil, err
 	}
@@ -101,7 +118,7 @@ func (g *GORMTable) Keys() ([]string, error) {
 }
 
 func (g *GORMTable) RemoveKey(k string) error {
-	return g.db.Table(g.table).Where("\"key\" = ?", k).Delete(&db.TableEntry{}).Error
+	return g.db.Table(g.table).Where(map[string]interface{}{"key": k}).Delete(&db.TableEntry{}).Error
 }
 
 func (g *GORMTable) SetKey(k, v string) error {
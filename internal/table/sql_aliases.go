@@ -0,0 +1,410 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/themadorg/madmail/framework/address"
+	"github.com/themadorg/madmail/framework/config"
+	modconfig "github.com/themadorg/madmail/framework/config/module"
+	"github.com/themadorg/madmail/framework/exterrors"
+	"github.com/themadorg/madmail/framework/log"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm"
+)
+
+const (
+	aliasesModName = "table.sql_aliases"
+
+	// aliasCatchAll is the source of catch-all aliases.
+	aliasCatchAll = "*"
+
+	// maxAliasCacheEntries limits the size of the lookup cache. The cache is
+	// reset once it is reached.
+	maxAliasCacheEntries = 10000
+)
+
+// ErrNoSuchAlias is returned by RemoveAlias and SetAliasEnabled if there are
+// no matching aliases.
+var ErrNoSuchAlias = errors.New("no such alias")
+
+var aliasesMigrations = []mdb.Migration{
+	{
+		ID: "20261014_table_sql_aliases",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.Alias{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.Alias{})
+		},
+	},
+}
+
+type aliasCacheEntry struct {
+	dests   []string
+	expires time.Time
+}
+
+// SQLAliases resolves addresses using the aliases table, see mdb.Alias.
+//
+// Exact aliases take precedence over catch-all ones, which take precedence
+// over catch-all destinations of domain_table. Destinations that are
+// aliases themselves are resolved recursively up to maxDepth levels. An
+// address aliased to itself is a final destination.
+type SQLAliases struct {
+	modName  string
+	instName string
+
+	db       *gorm.DB
+	maxDepth int
+	cacheTTL time.Duration
+
+	// mailboxes, if set, contains existing addresses that catch-all aliases
+	// are not applied to.
+	mailboxes module.Table
+
+	// domains, if set, provides catch-all destinations of domains that are
+	// used if there are no aliases for the address.
+	domains DomainSource
+
+	cacheLock sync.Mutex
+	cache     map[string]aliasCacheEntry
+
+	log log.Logger
+}
+
+func NewSQLAliases(modName, instName string, _, _ []string) (module.Module, error) {
+	return &SQLAliases{
+		modName:  modName,
+		instName: instName,
+		cache:    make(map[string]aliasCacheEntry),
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (s *SQLAliases) Name() string {
+	return s.modName
+}
+
+func (s *SQLAliases) InstanceName() string {
+	return s.instName
+}
+
+func (s *SQLAliases) Init(cfg *config.Map) error {
+	var (
+		driver string
+		dsn    mdb.DSN
+		dbOpts mdb.Options
+	)
+	cfg.Bool("debug", true, false, &s.log.Debug)
+	mdb.DriverDirective(cfg, "driver", true, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", true, nil, &dsn)
+	cfg.Int("max_depth", false, false, 5, &s.maxDepth)
+	cfg.Duration("cache_ttl", false, false, 30*time.Second, &s.cacheTTL)
+	cfg.Custom("mailboxes", false, false, nil, modconfig.TableDirective, &s.mailboxes)
+	var domainTable module.Table
+	cfg.Custom("domain_table", false, false, nil, modconfig.TableDirective, &domainTable)
+	mdb.Directives(cfg, &dbOpts)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if domainTable != nil {
+		domains, ok := domainTable.(DomainSource)
+		if !ok {
+			return config.NodeErr(cfg.Block, "domain_table should be table.sql_domains")
+		}
+		s.domains = domains
+	}
+	if s.maxDepth < 1 {
+		return config.NodeErr(cfg.Block, "max_depth should be at least 1")
+	}
+
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "%v", err)
+	}
+
+	dbOpts.Log = s.log
+	dbOpts.MetricsName = s.instName
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	if err := mdb.Migrate(db, aliasesMigrations); err != nil {
+		return fmt.Errorf("%s: %w", s.modName, err)
+	}
+	s.db = db
+	return nil
+}
+
+func (s *SQLAliases) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	return mdb.Close(ctx, s.db)
+}
+
+// CheckHealth implements module.HealthChecker.
+func (s *SQLAliases) CheckHealth(ctx context.Context) error {
+	return mdb.Ping(ctx, s.db)
+}
+
+// GORM implements mdb.Provider.
+func (s *SQLAliases) GORM() *gorm.DB {
+	return s.db
+}
+
+// destinations returns the destinations of the aliases of addr without
+// resolving them further. The result is cached for cacheTTL.
+func (s *SQLAliases) destinations(ctx context.Context, addr string) ([]string, error) {
+	now := time.Now()
+	s.cacheLock.Lock()
+	entry, ok := s.cache[addr]
+	s.cacheLock.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.dests, nil
+	}
+
+	mbox, domain, err := address.Split(addr)
+	if err != nil {
+		return nil, nil
+	}
+
+	var aliases []mdb.Alias
+	err = s.db.WithContext(ctx).
+		Where("domain = ? AND source IN ? AND enabled = ?", domain, []string{mbox, aliasCatchAll}, true).
+		Order("priority, id").
+		Find(&aliases).Error
+	if err != nil {
+		return nil, fmt.Errorf("%s: lookup %s: %w", s.modName, addr, err)
+	}
+
+	// Exact matches win over the catch-all.
+	var exact, catchAll []string
+	for _, a := range aliases {
+		if a.Source == aliasCatchAll {
+			catchAll = append(catchAll, a.Destination)
+		} else {
+			exact = append(exact, a.Destination)
+		}
+	}
+	dests := exact
+	if len(dests) == 0 && len(catchAll) == 0 && s.domains != nil {
+		d, ok, err := s.domains.Domain(ctx, domain)
+		if err != nil {
+			return nil, fmt.Errorf("%s: lookup %s: %w", s.modName, addr, err)
+		}
+		if ok && d.Enabled && d.CatchAll != nil {
+			catchAll = []string{*d.CatchAll}
+		}
+	}
+	if len(dests) == 0 && len(catchAll) != 0 {
+		dests = catchAll
+		if s.mailboxes != nil {
+			_, exists, err := s.mailboxes.Lookup(ctx, addr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: lookup %s: %w", s.modName, addr, err)
+			}
+			if exists {
+				dests = nil
+			}
+		}
+	}
+
+	if s.cacheTTL > 0 {
+		s.cacheLock.Lock()
+		if len(s.cache) >= maxAliasCacheEntries {
+			s.cache = make(map[string]aliasCacheEntry)
+		}
+		s.cache[addr] = aliasCacheEntry{dests: dests, expires: now.Add(s.cacheTTL)}
+		s.cacheLock.Unlock()
+	}
+	return dests, nil
+}
+
+func (s *SQLAliases) loopErr(addr string, path []string, reason string) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 4, 6},
+		Message:      "Alias resolution failed, try again later",
+		TargetName:   s.modName,
+		Reason:       reason,
+		Misc: map[string]interface{}{
+			"alias": addr,
+			"path":  path,
+		},
+	}
+}
+
+// resolve appends final destinations for addr to results. path contains
+// the addresses being resolved, starting with the looked up one.
+func (s *SQLAliases) resolve(ctx context.Context, addr string, path []string, results []string) ([]string, error) {
+	dests, err := s.destinations(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(dests) == 0 {
+		return appendUnique(results, addr), nil
+	}
+	if len(path) > s.maxDepth {
+		return nil, s.loopErr(path[0], path, "alias chain is too long")
+	}
+
+	for _, dest := range dests {
+		normDest, err := address.ForLookup(dest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed destination %s for %s: %w", s.modName, dest, addr, err)
+		}
+		if normDest == addr {
+			results = appendUnique(results, normDest)
+			continue
+		}
+		for _, prev := range path {
+			if prev == normDest {
+				return nil, s.loopErr(path[0], path, "alias loop detected")
+			}
+		}
+		results, err = s.resolve(ctx, normDest, append(path, normDest), results)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// LookupMulti returns the final destinations for the address or no values
+// if it has no aliases.
+func (s *SQLAliases) LookupMulti(ctx context.Context, key string) ([]string, error) {
+	addr, err := address.ForLookup(key)
+	if err != nil {
+		return nil, nil
+	}
+	dests, err := s.destinations(ctx, addr)
+	if err != nil || len(dests) == 0 {
+		return nil, err
+	}
+	return s.resolve(ctx, addr, []string{addr}, nil)
+}
+
+func (s *SQLAliases) Lookup(ctx context.Context, key string) (string, bool, error) {
+	dests, err := s.LookupMulti(ctx, key)
+	if err != nil || len(dests) == 0 {
+		return "", false, err
+	}
+	return dests[0], true, nil
+}
+
+// FlushCache drops all cached lookup results. It should be called after
+// modifying the aliases table directly if the changes should take effect
+// before cache_ttl passes.
+func (s *SQLAliases) FlushCache() {
+	s.cacheLock.Lock()
+	s.cache = make(map[string]aliasCacheEntry)
+	s.cacheLock.Unlock()
+}
+
+// splitSource normalizes the aliased address, which can use "*" as the
+// local part for a catch-all alias.
+func splitSource(source string) (mbox, domain string, err error) {
+	norm, err := address.ForLookup(source)
+	if err != nil {
+		return "", "", err
+	}
+	mbox, domain, err = address.Split(norm)
+	if err != nil {
+		return "", "", err
+	}
+	if domain == "" {
+		return "", "", errors.New("alias source should include the domain")
+	}
+	return mbox, domain, nil
+}
+
+// AddAlias adds an enabled alias of source to destination. Use "*@domain"
+// as the source for a catch-all alias.
+func (s *SQLAliases) AddAlias(source, destination string, priority int) error {
+	mbox, domain, err := splitSource(source)
+	if err != nil {
+		return fmt.Errorf("%s: add %s: %w", s.modName, source, err)
+	}
+	if !address.Valid(destination) {
+		return fmt.Errorf("%s: add %s: invalid destination address: %s", s.modName, source, destination)
+	}
+	err = s.db.Create(&mdb.Alias{
+		Source:      mbox,
+		Domain:      domain,
+		Destination: destination,
+		Priority:    priority,
+		Enabled:     true,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("%s: add %s: %w", s.modName, source, err)
+	}
+	s.FlushCache()
+	return nil
+}
+
+func (s *SQLAliases) aliasQuery(source, destination string) (*gorm.DB, error) {
+	mbox, domain, err := splitSource(source)
+	if err != nil {
+		return nil, err
+	}
+	q := s.db.Model(&mdb.Alias{}).Where("source = ? AND domain = ?", mbox, domain)
+	if destination != "" {
+		q = q.Where("destination = ?", destination)
+	}
+	return q, nil
+}
+
+// RemoveAlias removes aliases of source to destination or all aliases of
+// source if destination is empty.
+func (s *SQLAliases) RemoveAlias(source, destination string) error {
+	q, err := s.aliasQuery(source, destination)
+	if err != nil {
+		return fmt.Errorf("%s: remove %s: %w", s.modName, source, err)
+	}
+	res := q.Delete(&mdb.Alias{})
+	if res.Error != nil {
+		return fmt.Errorf("%s: remove %s: %w", s.modName, source, res.Error)
+	}
+	s.FlushCache()
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%s: remove %s: %w", s.modName, source, ErrNoSuchAlias)
+	}
+	return nil
+}
+
+// SetAliasEnabled enables or disables aliases of source to destination or
+// all aliases of source if destination is empty.
+func (s *SQLAliases) SetAliasEnabled(source, destination string, enabled bool) error {
+	q, err := s.aliasQuery(source, destination)
+	if err != nil {
+		return fmt.Errorf("%s: set enabled %s: %w", s.modName, source, err)
+	}
+	res := q.Update("enabled", enabled)
+	if res.Error != nil {
+		return fmt.Errorf("%s: set enabled %s: %w", s.modName, source, res.Error)
+	}
+	s.FlushCache()
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%s: set enabled %s: %w", s.modName, source, ErrNoSuchAlias)
+	}
+	return nil
+}
+
+func init() {
+	module.Register(aliasesModName, NewSQLAliases)
+	mdb.RegisterMigrations(aliasesModName, aliasesMigrations)
+}
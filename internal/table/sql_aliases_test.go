@@ -0,0 +1,151 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+package table
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/exterrors"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func testAliases(t *testing.T, extra ...config.Node) *SQLAliases {
+	t.Helper()
+
+	mod, err := NewSQLAliases(aliasesModName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children := append([]config.Node{
+		{Name: "driver", Args: []string{"sqlite3"}},
+		{Name: "dsn", Args: []string{filepath.Join(testutils.Dir(t), "aliases.db")}},
+	}, extra...)
+	if err := mod.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	s := mod.(*SQLAliases)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLAliases(t *testing.T) {
+	s := testAliases(t, config.Node{Name: "max_depth", Args: []string{"2"}})
+	s.mailboxes = testutils.Table{M: map[string]string{
+		"a@example.org":          "",
+		"b@example.org":          "",
+		"c@example.org":          "",
+		"postmaster@example.org": "",
+	}}
+
+	for _, a := range []struct {
+		src, dest string
+		prio      int
+	}{
+		{"info@example.org", "c@example.org", 2},
+		{"info@example.org", "a@example.org", 0},
+		{"info@example.org", "b@example.org", 1},
+		{"*@example.org", "postmaster@example.org", 0},
+		{"team@example.org", "info@example.org", 0},
+		{"team@example.org", "a@example.org", 0},
+		{"all@example.org", "team@example.org", 0},
+		{"loop1@example.com", "loop2@example.com", 0},
+		{"loop2@example.com", "loop1@example.com", 0},
+	} {
+		if err := s.AddAlias(a.src, a.dest, a.prio); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(addr string, want []string) {
+		t.Helper()
+
+		got, err := s.LookupMulti(context.Background(), addr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", addr, err)
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: want %v, got %v", addr, want, got)
+		}
+	}
+
+	check("Info@example.org", []string{"a@example.org", "b@example.org", "c@example.org"})
+	check("whatever@example.org", []string{"postmaster@example.org"})
+	check("postmaster@example.org", nil)
+	check("team@example.org", []string{"a@example.org", "b@example.org", "c@example.org"})
+	check("user@example.com", nil)
+
+	checkErr := func(addr string) {
+		t.Helper()
+
+		_, err := s.LookupMulti(context.Background(), addr)
+		var smtpErr *exterrors.SMTPError
+		if !errors.As(err, &smtpErr) || !exterrors.IsTemporary(err) {
+			t.Errorf("%s: expected a temporary SMTP error, got %v", addr, err)
+		}
+	}
+	checkErr("loop1@example.com")
+	// all -> team -> info -> a, 3 levels.
+	checkErr("all@example.org")
+
+	if err := s.SetAliasEnabled("*@example.org", "", false); err != nil {
+		t.Fatal(err)
+	}
+	check("whatever@example.org", nil)
+	if err := s.RemoveAlias("info@example.org", "b@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	check("info@example.org", []string{"a@example.org", "c@example.org"})
+	if err := s.RemoveAlias("info@example.org", "b@example.org"); !errors.Is(err, ErrNoSuchAlias) {
+		t.Error("expected ErrNoSuchAlias, got", err)
+	}
+}
+
+func TestSQLAliases_Cache(t *testing.T) {
+	s := testAliases(t, config.Node{Name: "cache_ttl", Args: []string{"1h"}})
+
+	check := func(want []string) {
+		t.Helper()
+
+		got, err := s.LookupMulti(context.Background(), "info@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	}
+
+	check(nil)
+	// Rows added directly are not visible until the cache expires.
+	err := s.db.Create(&mdb.Alias{Source: "info", Domain: "example.org", Destination: "a@example.org", Enabled: true}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(nil)
+	s.FlushCache()
+	check([]string{"a@example.org"})
+
+	// Management functions flush the cache.
+	if err := s.AddAlias("info@example.org", "b@example.org", 1); err != nil {
+		t.Fatal(err)
+	}
+	check([]string{"a@example.org", "b@example.org"})
+
+	s.cacheTTL = time.Millisecond
+	s.FlushCache()
+	check([]string{"a@example.org", "b@example.org"})
+	if err := s.db.Where("destination = ?", "b@example.org").Delete(&mdb.Alias{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	check([]string{"a@example.org"})
+}
@@ -0,0 +1,308 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/themadorg/madmail/framework/address"
+	"github.com/themadorg/madmail/framework/config"
+	"github.com/themadorg/madmail/framework/dns"
+	"github.com/themadorg/madmail/framework/log"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm"
+)
+
+const (
+	domainsModName = "table.sql_domains"
+
+	// maxDomainCacheEntries limits the size of the lookup cache. The cache
+	// is reset once it is reached.
+	maxDomainCacheEntries = 10000
+)
+
+var (
+	// ErrNoSuchDomain is returned by UpdateDomain and DisableDomain for
+	// unknown domains.
+	ErrNoSuchDomain = errors.New("no such domain")
+
+	// ErrDomainExists is returned by CreateDomain if the domain already
+	// exists.
+	ErrDomainExists = errors.New("domain already exists")
+)
+
+var domainsMigrations = []mdb.Migration{
+	{
+		ID: "20261014_table_sql_domains",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.Domain{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.Domain{})
+		},
+	},
+}
+
+// DomainSource is implemented by tables providing per-domain settings, such
+// as SQLDomains. Modules accepting a domains table type-assert it to
+// DomainSource.
+type DomainSource interface {
+	// Domain returns the settings of the domain, ok is false if the domain
+	// is not known. Disabled domains are returned too.
+	Domain(ctx context.Context, name string) (d mdb.Domain, ok bool, err error)
+}
+
+type domainCacheEntry struct {
+	domain  mdb.Domain
+	ok      bool
+	expires time.Time
+}
+
+// SQLDomains is a table of hosted domains stored in the domains table, see
+// mdb.Domain. Lookup accepts a domain or an address and reports whether the
+// domain exists and is enabled.
+//
+// Lookup results are cached for cache_ttl. The cache is flushed when the
+// domains are changed using the methods of SQLDomains, changes made by other
+// processes (e.g. maddy domains subcommands) take effect after cache_ttl.
+type SQLDomains struct {
+	modName  string
+	instName string
+
+	db       *gorm.DB
+	cacheTTL time.Duration
+
+	cacheLock sync.Mutex
+	cache     map[string]domainCacheEntry
+
+	log log.Logger
+}
+
+func NewSQLDomains(modName, instName string, _, _ []string) (module.Module, error) {
+	return &SQLDomains{
+		modName:  modName,
+		instName: instName,
+		cache:    make(map[string]domainCacheEntry),
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (s *SQLDomains) Name() string {
+	return s.modName
+}
+
+func (s *SQLDomains) InstanceName() string {
+	return s.instName
+}
+
+func (s *SQLDomains) Init(cfg *config.Map) error {
+	var (
+		driver string
+		dsn    mdb.DSN
+		dbOpts mdb.Options
+	)
+	cfg.Bool("debug", true, false, &s.log.Debug)
+	mdb.DriverDirective(cfg, "driver", true, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", true, nil, &dsn)
+	cfg.Duration("cache_ttl", false, false, 30*time.Second, &s.cacheTTL)
+	mdb.Directives(cfg, &dbOpts)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "%v", err)
+	}
+
+	dbOpts.Log = s.log
+	dbOpts.MetricsName = s.instName
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	if err := mdb.Migrate(db, domainsMigrations); err != nil {
+		return fmt.Errorf("%s: %w", s.modName, err)
+	}
+	s.db = db
+	return nil
+}
+
+func (s *SQLDomains) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	return mdb.Close(ctx, s.db)
+}
+
+// CheckHealth implements module.HealthChecker.
+func (s *SQLDomains) CheckHealth(ctx context.Context) error {
+	return mdb.Ping(ctx, s.db)
+}
+
+// GORM implements mdb.Provider.
+func (s *SQLDomains) GORM() *gorm.DB {
+	return s.db
+}
+
+// Domain implements DomainSource. The result is cached for cache_ttl.
+func (s *SQLDomains) Domain(ctx context.Context, name string) (mdb.Domain, bool, error) {
+	name, err := dns.ForLookup(name)
+	if err != nil {
+		return mdb.Domain{}, false, nil
+	}
+
+	now := time.Now()
+	s.cacheLock.Lock()
+	entry, ok := s.cache[name]
+	s.cacheLock.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.domain, entry.ok, nil
+	}
+
+	var d mdb.Domain
+	found := true
+	if err := s.db.WithContext(ctx).Where("name = ?", name).Take(&d).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return mdb.Domain{}, false, fmt.Errorf("%s: lookup %s: %w", s.modName, name, err)
+		}
+		found = false
+	}
+
+	if s.cacheTTL > 0 {
+		s.cacheLock.Lock()
+		if len(s.cache) >= maxDomainCacheEntries {
+			s.cache = make(map[string]domainCacheEntry)
+		}
+		s.cache[name] = domainCacheEntry{domain: d, ok: found, expires: now.Add(s.cacheTTL)}
+		s.cacheLock.Unlock()
+	}
+	return d, found, nil
+}
+
+// Lookup implements module.Table. key is a domain or an address, the
+// returned value is the normalized domain.
+func (s *SQLDomains) Lookup(ctx context.Context, key string) (string, bool, error) {
+	domain := key
+	if strings.Contains(key, "@") {
+		var err error
+		_, domain, err = address.Split(key)
+		if err != nil {
+			return "", false, nil
+		}
+	}
+
+	d, ok, err := s.Domain(ctx, domain)
+	if err != nil || !ok || !d.Enabled {
+		return "", false, err
+	}
+	return d.Name, true, nil
+}
+
+// FlushCache drops all cached lookup results. It should be called after
+// modifying the domains table directly if the changes should take effect
+// before cache_ttl passes.
+func (s *SQLDomains) FlushCache() {
+	s.cacheLock.Lock()
+	s.cache = make(map[string]domainCacheEntry)
+	s.cacheLock.Unlock()
+}
+
+// ListDomains returns all domains, including disabled ones.
+func (s *SQLDomains) ListDomains() ([]mdb.Domain, error) {
+	var domains []mdb.Domain
+	if err := s.db.Order("name").Find(&domains).Error; err != nil {
+		return nil, fmt.Errorf("%s: list: %w", s.modName, err)
+	}
+	return domains, nil
+}
+
+// normalizeDomain normalizes the name and validates the settings of d.
+func normalizeDomain(d *mdb.Domain) error {
+	name, err := dns.ForLookup(d.Name)
+	if err != nil {
+		return err
+	}
+	if name == "" || strings.Contains(name, "@") {
+		return fmt.Errorf("invalid domain name: %s", d.Name)
+	}
+	d.Name = name
+	if d.CatchAll != nil && !address.Valid(*d.CatchAll) {
+		return fmt.Errorf("invalid catch-all address: %s", *d.CatchAll)
+	}
+	if d.DefaultQuota < 0 {
+		return errors.New("default quota should not be negative")
+	}
+	return nil
+}
+
+// CreateDomain adds the domain with the settings from d.
+func (s *SQLDomains) CreateDomain(d mdb.Domain) error {
+	if err := normalizeDomain(&d); err != nil {
+		return fmt.Errorf("%s: create %s: %w", s.modName, d.Name, err)
+	}
+	d.ID = 0
+	_, err := mdb.WithTx(context.TODO(), s.db, func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&mdb.Domain{}).Where("name = ?", d.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count != 0 {
+			return ErrDomainExists
+		}
+		return tx.Create(&d).Error
+	}, mdb.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("%s: create %s: %w", s.modName, d.Name, err)
+	}
+	s.FlushCache()
+	return nil
+}
+
+// UpdateDomain replaces the settings of the domain named d.Name with the
+// ones from d.
+func (s *SQLDomains) UpdateDomain(d mdb.Domain) error {
+	if err := normalizeDomain(&d); err != nil {
+		return fmt.Errorf("%s: update %s: %w", s.modName, d.Name, err)
+	}
+	res := s.db.Model(&mdb.Domain{}).Where("name = ?", d.Name).Updates(map[string]interface{}{
+		"enabled":       d.Enabled,
+		"catch_all":     d.CatchAll,
+		"dkim_selector": d.DKIMSelector,
+		"default_quota": d.DefaultQuota,
+	})
+	if res.Error != nil {
+		return fmt.Errorf("%s: update %s: %w", s.modName, d.Name, res.Error)
+	}
+	s.FlushCache()
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%s: update %s: %w", s.modName, d.Name, ErrNoSuchDomain)
+	}
+	return nil
+}
+
+// DisableDomain disables the domain. Mail for disabled domains is rejected,
+// the settings and accounts of the domain are kept.
+func (s *SQLDomains) DisableDomain(name string) error {
+	norm, err := dns.ForLookup(name)
+	if err != nil {
+		return fmt.Errorf("%s: disable %s: %w", s.modName, name, err)
+	}
+	res := s.db.Model(&mdb.Domain{}).Where("name = ?", norm).Update("enabled", false)
+	if res.Error != nil {
+		return fmt.Errorf("%s: disable %s: %w", s.modName, name, res.Error)
+	}
+	s.FlushCache()
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%s: disable %s: %w", s.modName, name, ErrNoSuchDomain)
+	}
+	return nil
+}
+
+func init() {
+	module.Register(domainsModName, NewSQLDomains)
+	mdb.RegisterMigrations(domainsModName, domainsMigrations)
+}
@@ -0,0 +1,147 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+package table
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/themadorg/madmail/framework/config"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func testDomains(t *testing.T, extra ...config.Node) *SQLDomains {
+	t.Helper()
+
+	mod, err := NewSQLDomains(domainsModName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children := append([]config.Node{
+		{Name: "driver", Args: []string{"sqlite3"}},
+		{Name: "dsn", Args: []string{filepath.Join(testutils.Dir(t), "domains.db")}},
+	}, extra...)
+	if err := mod.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	s := mod.(*SQLDomains)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLDomains(t *testing.T) {
+	s := testDomains(t, config.Node{Name: "cache_ttl", Args: []string{"1h"}})
+
+	check := func(key string, ok bool) {
+		t.Helper()
+
+		_, got, err := s.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != ok {
+			t.Errorf("%s: want %v, got %v", key, ok, got)
+		}
+	}
+
+	check("example.org", false)
+	if err := s.CreateDomain(mdb.Domain{Name: "Example.org", Enabled: true, DefaultQuota: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateDomain(mdb.Domain{Name: "example.org"}); !errors.Is(err, ErrDomainExists) {
+		t.Error("expected ErrDomainExists, got", err)
+	}
+	if err := s.CreateDomain(mdb.Domain{Name: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	// Management functions flush the cache.
+	check("example.org", true)
+	check("user@EXAMPLE.org", true)
+	check("example.com", false)
+	check("user@example.net", false)
+
+	catchAll := "postmaster@example.org"
+	if err := s.UpdateDomain(mdb.Domain{Name: "example.com", Enabled: true, CatchAll: &catchAll}); err != nil {
+		t.Fatal(err)
+	}
+	check("example.com", true)
+	d, ok, err := s.Domain(context.Background(), "example.com")
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if d.CatchAll == nil || *d.CatchAll != catchAll {
+		t.Errorf("wrong catch-all: %v", d.CatchAll)
+	}
+	if err := s.UpdateDomain(mdb.Domain{Name: "example.net", Enabled: true}); !errors.Is(err, ErrNoSuchDomain) {
+		t.Error("expected ErrNoSuchDomain, got", err)
+	}
+
+	if err := s.DisableDomain("example.org"); err != nil {
+		t.Fatal(err)
+	}
+	check("example.org", false)
+	if _, ok, _ := s.Domain(context.Background(), "example.org"); !ok {
+		t.Error("disabled domain is not returned by Domain")
+	}
+
+	domains, err := s.ListDomains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 2 || domains[0].Name != "example.com" || domains[1].DefaultQuota != 1024 {
+		t.Errorf("wrong domains: %+v", domains)
+	}
+}
+
+func TestSQLAliases_DomainCatchAll(t *testing.T) {
+	domains := testDomains(t)
+	s := testAliases(t)
+	s.domains = domains
+	s.mailboxes = testutils.Table{M: map[string]string{
+		"a@example.org": "",
+	}}
+
+	catchAll := "postmaster@example.org"
+	if err := domains.CreateDomain(mdb.Domain{Name: "example.org", Enabled: true, CatchAll: &catchAll}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddAlias("info@example.org", "a@example.org", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(addr string, want []string) {
+		t.Helper()
+
+		got, err := s.LookupMulti(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: want %v, got %v", addr, want, got)
+		}
+	}
+
+	check("info@example.org", []string{"a@example.org"})
+	check("a@example.org", nil)
+	check("unknown@example.org", []string{"postmaster@example.org"})
+
+	// Catch-all aliases win.
+	if err := s.AddAlias("*@example.org", "a@example.org", 0); err != nil {
+		t.Fatal(err)
+	}
+	check("unknown@example.org", []string{"a@example.org"})
+	if err := s.RemoveAlias("*@example.org", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := domains.DisableDomain("example.org"); err != nil {
+		t.Fatal(err)
+	}
+	s.FlushCache()
+	check("unknown@example.org", nil)
+}
@@ -64,7 +64,7 @@ func (s *SQL) Init(cfg *config.Map) error {
 	var (
 		driver      string
 		initQueries []string
-		dsnParts    []string
+		dsn         mdb.DSN
 		lookupQuery string
 
 		addQuery    string
@@ -72,10 +72,12 @@ func (s *SQL) Init(cfg *config.Map) error {
 		removeQuery string
 		setQuery    string
 		upsertQuery string
+
+		dbOpts mdb.Options
 	)
 	cfg.StringList("init", false, false, nil, &initQueries)
-	cfg.String("driver", false, true, "", &driver)
-	cfg.StringList("dsn", false, true, nil, &dsnParts)
+	mdb.DriverDirective(cfg, "driver", true, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", true, nil, &dsn)
 	cfg.Bool("named_args", false, false, &s.namedArgs)
 
 	cfg.String("lookup", false, true, "", &lookupQuery)
@@ -85,6 +87,7 @@ func (s *SQL) Init(cfg *config.Map) error {
 	cfg.String("del", false, false, "", &removeQuery)
 	cfg.String("set", false, false, "", &setQuery)
 	cfg.String("upsert", false, false, "", &upsertQuery)
+	mdb.Directives(cfg, &dbOpts)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -93,7 +96,14 @@ func (s *SQL) Init(cfg *config.Map) error {
 		return config.NodeErr(cfg.Block, "PostgreSQL driver does not support named_args")
 	}
 
-	db, err := mdb.New(driver, dsnParts, log.DefaultLogger.Debug)
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "%v", err)
+	}
+
+	dbOpts.Log = log.Logger{Name: s.modName, Debug: log.DefaultLogger.Debug}
+	dbOpts.MetricsName = s.instName
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
 	if err != nil {
 		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
 	}
@@ -116,11 +126,19 @@ func (s *SQL) Init(cfg *config.Map) error {
 }
 
 func (s *SQL) Close() error {
-	sqlDB, err := s.db.DB()
-	if err != nil {
-		return err
-	}
-	return sqlDB.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	return mdb.Close(ctx, s.db)
+}
+
+// CheckHealth implements module.HealthChecker.
+func (s *SQL) CheckHealth(ctx context.Context) error {
+	return mdb.Ping(ctx, s.db)
+}
+
+// GORM implements mdb.Provider.
+func (s *SQL) GORM() *gorm.DB {
+	return s.db
 }
 
 func (s *SQL) Lookup(ctx context.Context, val string) (string, bool, error) {
@@ -25,6 +25,7 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/themadorg/madmail/framework/config"
 	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
 )
 
 type SQLTable struct {
@@ -62,7 +63,7 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 		keyColumn   string
 		valueColumn string
 	)
-	cfg.String("driver", false, true, "", &driver)
+	mdb.DriverDirective(cfg, "driver", true, "", &driver)
 	cfg.StringList("dsn", false, true, nil, &dsnParts)
 	cfg.String("table_name", false, true, "", &tableName)
 	cfg.String("key_column", false, false, "key", &keyColumn)
@@ -0,0 +1,472 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package autoreply implements the target.autoreply module that sends
+// vacation (out-of-office) replies configured per account in an SQL
+// database.
+package autoreply
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/themadorg/madmail/framework/address"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/config"
+	modconfig "github.com/themadorg/madmail/framework/config/module"
+	"github.com/themadorg/madmail/framework/log"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/target"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const modName = "target.autoreply"
+
+// ErrNoSuchAutoreply is returned if the account has no autoreply.
+var ErrNoSuchAutoreply = errors.New("no such autoreply")
+
+var migrations = []mdb.Migration{
+	{
+		ID: "20261014_target_autoreply",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.Autoreply{}, &mdb.AutoreplyLog{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.AutoreplyLog{}, &mdb.Autoreply{})
+		},
+	},
+}
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	db               *gorm.DB
+	replyTarget      module.DeliveryTarget
+	interval         time.Duration
+	autogenMsgDomain string
+
+	cleanupInterval time.Duration
+	stopCleanup     chan struct{}
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var (
+		driver string
+		dsn    mdb.DSN
+		dbOpts mdb.Options
+	)
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	mdb.DriverDirective(cfg, "driver", true, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", true, nil, &dsn)
+	mdb.Directives(cfg, &dbOpts)
+	cfg.Custom("reply_target", false, true, nil, modconfig.DeliveryDirective, &t.replyTarget)
+	cfg.Duration("interval", false, false, 7*24*time.Hour, &t.interval)
+	cfg.Duration("cleanup_interval", false, false, time.Hour, &t.cleanupInterval)
+	cfg.String("autogenerated_msg_domain", true, false, "", &t.autogenMsgDomain)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if t.interval <= 0 || t.cleanupInterval <= 0 {
+		return config.NodeErr(cfg.Block, "interval and cleanup_interval should be positive")
+	}
+
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "%v", err)
+	}
+	dbOpts.Log = t.log
+	dbOpts.MetricsName = t.instName
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	if err := mdb.Migrate(db, migrations); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	t.db = db
+
+	if !module.NoRun {
+		t.stopCleanup = make(chan struct{})
+		go t.cleanupLoop()
+	}
+	return nil
+}
+
+// cleanup removes reply log entries older than interval, they no longer
+// prevent replies.
+func (t *Target) cleanup(ctx context.Context) (int64, error) {
+	res := t.db.WithContext(ctx).
+		Where("last_reply_at <= ?", time.Now().UTC().Add(-t.interval)).
+		Delete(&mdb.AutoreplyLog{})
+	return res.RowsAffected, res.Error
+}
+
+func (t *Target) cleanupLoop() {
+	defer func() {
+		if err := recover(); err != nil {
+			t.log.Printf("panic during autoreply log cleanup: %v\n%s", err, debug.Stack())
+		}
+	}()
+
+	tick := time.NewTicker(t.cleanupInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			n, err := t.cleanup(context.Background())
+			if err != nil {
+				t.log.Error("cleanup failed", err)
+				continue
+			}
+			t.log.Debugf("removed %d expired reply log entries", n)
+		case <-t.stopCleanup:
+			t.stopCleanup <- struct{}{}
+			return
+		}
+	}
+}
+
+func (t *Target) Close() error {
+	if t.db == nil {
+		return nil
+	}
+	if t.stopCleanup != nil {
+		t.stopCleanup <- struct{}{}
+		<-t.stopCleanup
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	return mdb.Close(ctx, t.db)
+}
+
+// GORM implements mdb.Provider.
+func (t *Target) GORM() *gorm.DB {
+	return t.db
+}
+
+// CheckHealth implements module.HealthChecker.
+func (t *Target) CheckHealth(ctx context.Context) error {
+	return mdb.Ping(ctx, t.db)
+}
+
+// activeAutoreply returns the autoreply of the account if it is enabled and
+// the current time is within its period, or nil.
+func (t *Target) activeAutoreply(ctx context.Context, account string) (*mdb.Autoreply, error) {
+	now := time.Now().UTC()
+	var row mdb.Autoreply
+	err := t.db.WithContext(ctx).
+		Where("account = ? AND enabled = ?", account, true).
+		Where("start_at IS NULL OR start_at <= ?", now).
+		Where("end_at IS NULL OR end_at > ?", now).
+		Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+// claimReply records the reply from the account to the correspondent and
+// reports whether it should be sent, i.e. no reply was sent within interval.
+//
+// Concurrent deliveries for the same pair cannot both succeed.
+func (t *Target) claimReply(ctx context.Context, account, correspondent string) (bool, error) {
+	now := time.Now().UTC()
+	res := t.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&mdb.AutoreplyLog{
+		Account:       account,
+		Correspondent: correspondent,
+		LastReplyAt:   now,
+	})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected != 0 {
+		return true, nil
+	}
+
+	res = t.db.WithContext(ctx).Model(&mdb.AutoreplyLog{}).
+		Where("account = ? AND correspondent = ? AND last_reply_at <= ?", account, correspondent, now.Add(-t.interval)).
+		Update("last_reply_at", now)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected != 0, nil
+}
+
+type delivery struct {
+	t        *Target
+	mailFrom string
+	msgMeta  *module.MsgMetadata
+	log      log.Logger
+
+	rcpts  []string
+	header textproto.Header
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		mailFrom: mailFrom,
+		msgMeta:  msgMeta,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	d.header = header.Copy()
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+// Commit sends replies for recipients that have an active autoreply.
+//
+// Failures to send a reply are logged and do not affect the delivery
+// of the message.
+func (d *delivery) Commit(ctx context.Context) error {
+	if d.mailFrom == "" || !shouldReply(d.mailFrom, d.header) {
+		return nil
+	}
+	correspondent, err := address.ForLookup(d.mailFrom)
+	if err != nil {
+		return nil
+	}
+
+	for _, rcpt := range d.rcpts {
+		if err := d.reply(ctx, rcpt, correspondent); err != nil {
+			d.log.Error("failed to send autoreply", err, "rcpt", rcpt)
+		}
+	}
+	return nil
+}
+
+func (d *delivery) reply(ctx context.Context, rcpt, correspondent string) error {
+	account, err := address.ForLookup(rcpt)
+	if err != nil || account == correspondent {
+		return nil
+	}
+	if !addressedTo(d.header, rcpt, d.msgMeta.OriginalRcpts[rcpt]) {
+		return nil
+	}
+
+	reply, err := d.t.activeAutoreply(ctx, account)
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return nil
+	}
+	ok, err := d.t.claimReply(ctx, account, correspondent)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		d.log.Debugf("%s: already replied to %s", account, correspondent)
+		return nil
+	}
+
+	from := rcpt
+	if orig := d.msgMeta.OriginalRcpts[rcpt]; orig != "" {
+		from = orig
+	}
+	return d.t.send(ctx, reply, from, d.mailFrom, d.header, d.msgMeta)
+}
+
+// send delivers the reply to the original sender using reply_target.
+func (t *Target) send(ctx context.Context, reply *mdb.Autoreply, from, to string, origHdr textproto.Header, origMeta *module.MsgMetadata) error {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	hdr, body, err := t.buildReply(reply, msgID, from, to, origHdr)
+	if err != nil {
+		return err
+	}
+
+	meta := &module.MsgMetadata{
+		ID: msgID,
+		SMTPOpts: smtp.MailOptions{
+			UTF8: origMeta.SMTPOpts.UTF8,
+		},
+	}
+	dl := target.DeliveryLogger(t.log, origMeta)
+	dl.Msg("sending autoreply", "reply_id", msgID, "rcpt", from)
+
+	// Null return-path prevents replies to the reply, see RFC 3834.
+	replyDelivery, err := t.replyTarget.Start(ctx, meta, "")
+	if err != nil {
+		return err
+	}
+	if err := replyDelivery.AddRcpt(ctx, to, smtp.RcptOptions{}); err != nil {
+		if err := replyDelivery.Abort(ctx); err != nil {
+			dl.Error("failed to abort autoreply delivery", err, "reply_id", msgID)
+		}
+		return err
+	}
+	if err := replyDelivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		if err := replyDelivery.Abort(ctx); err != nil {
+			dl.Error("failed to abort autoreply delivery", err, "reply_id", msgID)
+		}
+		return err
+	}
+	return replyDelivery.Commit(ctx)
+}
+
+// List returns all autoreplies ordered by account.
+func (t *Target) List(ctx context.Context) ([]mdb.Autoreply, error) {
+	var rows []mdb.Autoreply
+	err := t.db.WithContext(ctx).Order("account").Find(&rows).Error
+	return rows, err
+}
+
+// Get returns the autoreply of the account.
+func (t *Target) Get(ctx context.Context, account string) (mdb.Autoreply, error) {
+	account, err := address.ForLookup(account)
+	if err != nil {
+		return mdb.Autoreply{}, err
+	}
+
+	var row mdb.Autoreply
+	err = t.db.WithContext(ctx).Where("account = ?", account).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return mdb.Autoreply{}, ErrNoSuchAutoreply
+	}
+	return row, err
+}
+
+// Set creates or replaces the autoreply of reply.Account.
+//
+// If the autoreply is enabled again after being disabled, the reply log of
+// the account is kept and correspondents that got the reply within interval
+// will not get it again.
+func (t *Target) Set(ctx context.Context, reply mdb.Autoreply) error {
+	account, err := address.ForLookup(reply.Account)
+	if err != nil {
+		return err
+	}
+	if reply.StartAt != nil && reply.EndAt != nil && !reply.EndAt.After(*reply.StartAt) {
+		return errors.New("autoreply end time should be after start time")
+	}
+	// Normalize to UTC, so comparisons in activeAutoreply use the same
+	// representation for all drivers.
+	if reply.StartAt != nil {
+		startAt := reply.StartAt.UTC()
+		reply.StartAt = &startAt
+	}
+	if reply.EndAt != nil {
+		endAt := reply.EndAt.UTC()
+		reply.EndAt = &endAt
+	}
+
+	now := time.Now().UTC()
+	_, err = mdb.Upsert(ctx, t.db, &mdb.Autoreply{
+		Account:   account,
+		Enabled:   reply.Enabled,
+		Subject:   reply.Subject,
+		Body:      reply.Body,
+		StartAt:   reply.StartAt,
+		EndAt:     reply.EndAt,
+		UpdatedAt: now,
+	}, []string{"account"}, map[string]interface{}{
+		"enabled":    reply.Enabled,
+		"subject":    reply.Subject,
+		"body":       reply.Body,
+		"start_at":   reply.StartAt,
+		"end_at":     reply.EndAt,
+		"updated_at": now,
+	})
+	return err
+}
+
+// SetEnabled enables or disables the autoreply of the account. It takes
+// effect for the next delivered message.
+func (t *Target) SetEnabled(ctx context.Context, account string, enabled bool) error {
+	account, err := address.ForLookup(account)
+	if err != nil {
+		return err
+	}
+
+	res := t.db.WithContext(ctx).Model(&mdb.Autoreply{}).
+		Where("account = ?", account).
+		Updates(map[string]interface{}{"enabled": enabled, "updated_at": time.Now().UTC()})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNoSuchAutoreply
+	}
+	return nil
+}
+
+// Delete removes the autoreply and the reply log of the account.
+func (t *Target) Delete(ctx context.Context, account string) error {
+	account, err := address.ForLookup(account)
+	if err != nil {
+		return err
+	}
+
+	_, err = mdb.WithTx(ctx, t.db, func(tx *gorm.DB) error {
+		res := tx.Where("account = ?", account).Delete(&mdb.Autoreply{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNoSuchAutoreply
+		}
+		return tx.Where("account = ?", account).Delete(&mdb.AutoreplyLog{}).Error
+	}, mdb.TxOptions{})
+	return err
+}
+
+func init() {
+	module.Register(modName, New)
+	mdb.RegisterMigrations(modName, migrations)
+}
@@ -0,0 +1,293 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package autoreply
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func newTestTarget(t *testing.T) (*Target, *testutils.Target) {
+	t.Helper()
+
+	db, err := mdb.NewWithContext(context.Background(), "sqlite3",
+		[]string{filepath.Join(t.TempDir(), "autoreply.db")}, mdb.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mdb.Migrate(db, migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	replies := &testutils.Target{}
+	tgt := &Target{
+		instName:         "test",
+		log:              testutils.Logger(t, modName),
+		db:               db,
+		replyTarget:      replies,
+		interval:         7 * 24 * time.Hour,
+		autogenMsgDomain: "mx.example.org",
+	}
+	t.Cleanup(func() { tgt.Close() })
+	return tgt, replies
+}
+
+func deliver(t *testing.T, tgt *Target, meta *module.MsgMetadata, from string, rcpts []string, hdr textproto.Header) {
+	t.Helper()
+	ctx := context.Background()
+
+	d, err := tgt.Start(ctx, meta, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range rcpts {
+		if err := d.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testHeader(to string) textproto.Header {
+	hdr := textproto.Header{}
+	hdr.Add("From", "Sender <sender@example.com>")
+	hdr.Add("To", to)
+	hdr.Add("Subject", "Question")
+	hdr.Add("Message-Id", "<orig@example.com>")
+	return hdr
+}
+
+func TestAutoreply_Reply(t *testing.T) {
+	tgt, replies := newTestTarget(t)
+	ctx := context.Background()
+
+	err := tgt.Set(ctx, mdb.Autoreply{
+		Account: "User@example.org",
+		Enabled: true,
+		Subject: "Out of office ✓",
+		Body:    "I am away.\nBack on Monday.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := &module.MsgMetadata{ID: "test"}
+	deliver(t, tgt, meta, "sender@example.com", []string{"user@example.org", "other@example.org"},
+		testHeader("user@example.org, other@example.org"))
+	if len(replies.Messages) != 1 {
+		t.Fatalf("wrong number of replies: %d", len(replies.Messages))
+	}
+	if msg := replies.Messages[0]; msg.MailFrom != "" || len(msg.RcptTo) != 1 || msg.RcptTo[0] != "sender@example.com" {
+		t.Fatalf("wrong reply envelope: %q %v", msg.MailFrom, msg.RcptTo)
+	}
+
+	hdr := replies.Messages[0].Header
+	for field, value := range map[string]string{
+		"From":           "<user@example.org>",
+		"To":             "<sender@example.com>",
+		"Subject":        "=?utf-8?q?Out_of_office_=E2=9C=93?=",
+		"In-Reply-To":    "<orig@example.com>",
+		"References":     "<orig@example.com>",
+		"Auto-Submitted": "auto-replied",
+	} {
+		if got := hdr.Get(field); got != value {
+			t.Errorf("wrong %s: %q", field, got)
+		}
+	}
+	if !strings.HasSuffix(hdr.Get("Message-Id"), "@mx.example.org>") {
+		t.Errorf("wrong Message-Id: %q", hdr.Get("Message-Id"))
+	}
+	if body := string(replies.Messages[0].Body); body != "I am away.\r\nBack on Monday." {
+		t.Errorf("wrong body: %q", body)
+	}
+
+	// Only one reply per interval.
+	deliver(t, tgt, meta, "Sender@example.com", []string{"user@example.org"}, testHeader("user@example.org"))
+	if len(replies.Messages) != 1 {
+		t.Fatalf("replied twice: %d", len(replies.Messages))
+	}
+
+	// The interval passed.
+	err = tgt.db.Model(&mdb.AutoreplyLog{}).Where("account = ?", "user@example.org").
+		Update("last_reply_at", time.Now().UTC().Add(-8*24*time.Hour)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, tgt, meta, "sender@example.com", []string{"user@example.org"}, testHeader("user@example.org"))
+	if len(replies.Messages) != 2 {
+		t.Fatalf("no reply after interval: %d", len(replies.Messages))
+	}
+
+	// Disabling takes effect immediately.
+	if err := tgt.SetEnabled(ctx, "user@example.org", false); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, tgt, meta, "another@example.com", []string{"user@example.org"}, testHeader("user@example.org"))
+	if len(replies.Messages) != 2 {
+		t.Fatalf("replied while disabled: %d", len(replies.Messages))
+	}
+}
+
+func TestAutoreply_Period(t *testing.T) {
+	tgt, replies := newTestTarget(t)
+	ctx := context.Background()
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	if err := tgt.Set(ctx, mdb.Autoreply{Account: "user@example.org", Enabled: true, Body: "Away", EndAt: &past}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgt.Set(ctx, mdb.Autoreply{Account: "later@example.org", Enabled: true, Body: "Away", StartAt: &future}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgt.Set(ctx, mdb.Autoreply{Account: "now@example.org", Enabled: true, Body: "Away", StartAt: &past, EndAt: &future}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgt.Set(ctx, mdb.Autoreply{Account: "bad@example.org", StartAt: &future, EndAt: &past}); err == nil {
+		t.Fatal("expected error for the empty period")
+	}
+
+	deliver(t, tgt, &module.MsgMetadata{ID: "test"}, "sender@example.com",
+		[]string{"user@example.org", "later@example.org", "now@example.org"},
+		testHeader("user@example.org, later@example.org, now@example.org"))
+	if len(replies.Messages) != 1 {
+		t.Fatalf("wrong number of replies: %d", len(replies.Messages))
+	}
+	if from := replies.Messages[0].Header.Get("From"); from != "<now@example.org>" {
+		t.Fatalf("wrong reply sender: %s", from)
+	}
+	if subject := replies.Messages[0].Header.Get("Subject"); subject != "Auto: Question" {
+		t.Fatalf("wrong default subject: %s", subject)
+	}
+}
+
+func TestAutoreply_NoReply(t *testing.T) {
+	tgt, replies := newTestTarget(t)
+	if err := tgt.Set(context.Background(), mdb.Autoreply{Account: "user@example.org", Enabled: true, Body: "Away"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		from string
+		hdr  func(*textproto.Header)
+	}{
+		{"null sender", "", nil},
+		{"mailer daemon", "MAILER-DAEMON@example.com", nil},
+		{"list request", "list-request@example.com", nil},
+		{"list owner", "owner-list@example.com", nil},
+		{"list id", "sender@example.com", func(h *textproto.Header) { h.Add("List-Id", "<list.example.com>") }},
+		{"precedence", "sender@example.com", func(h *textproto.Header) { h.Add("Precedence", "Bulk") }},
+		{"auto submitted", "sender@example.com", func(h *textproto.Header) { h.Add("Auto-Submitted", "auto-replied") }},
+		{"not addressed", "sender@example.com", func(h *textproto.Header) { h.Set("To", "list@example.com") }},
+		{"to self", "user@example.org", nil},
+	}
+	for _, c := range cases {
+		hdr := testHeader("user@example.org")
+		if c.hdr != nil {
+			c.hdr(&hdr)
+		}
+		deliver(t, tgt, &module.MsgMetadata{ID: "test"}, c.from, []string{"user@example.org"}, hdr)
+		if len(replies.Messages) != 0 {
+			t.Fatalf("%s: unexpected reply", c.name)
+		}
+	}
+
+	// Auto-Submitted: no is a human-written message.
+	hdr := testHeader("Alias <alias@example.org>")
+	hdr.Add("Auto-Submitted", "no")
+	deliver(t, tgt, &module.MsgMetadata{
+		ID:            "test",
+		OriginalRcpts: map[string]string{"user@example.org": "alias@example.org"},
+	}, "sender@example.com", []string{"user@example.org"}, hdr)
+	if len(replies.Messages) != 1 {
+		t.Fatal("no reply for the message to the alias")
+	}
+	if from := replies.Messages[0].Header.Get("From"); from != "<alias@example.org>" {
+		t.Fatalf("wrong reply sender: %s", from)
+	}
+}
+
+func TestAutoreply_Manage(t *testing.T) {
+	tgt, _ := newTestTarget(t)
+	ctx := context.Background()
+
+	if _, err := tgt.Get(ctx, "user@example.org"); !errors.Is(err, ErrNoSuchAutoreply) {
+		t.Fatalf("expected ErrNoSuchAutoreply, got %v", err)
+	}
+	if err := tgt.SetEnabled(ctx, "user@example.org", true); !errors.Is(err, ErrNoSuchAutoreply) {
+		t.Fatalf("expected ErrNoSuchAutoreply, got %v", err)
+	}
+
+	if err := tgt.Set(ctx, mdb.Autoreply{Account: "user@example.org", Body: "Away"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgt.Set(ctx, mdb.Autoreply{Account: "user@example.org", Enabled: true, Body: "Away again"}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := tgt.Get(ctx, "USER@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Enabled || reply.Body != "Away again" {
+		t.Fatalf("autoreply not replaced: %+v", reply)
+	}
+
+	if ok, err := tgt.claimReply(ctx, "user@example.org", "sender@example.com"); err != nil || !ok {
+		t.Fatal("first reply not claimed:", err)
+	}
+	if ok, err := tgt.claimReply(ctx, "user@example.org", "sender@example.com"); err != nil || ok {
+		t.Fatal("second reply claimed:", err)
+	}
+
+	// Cleanup removes only expired entries.
+	if n, err := tgt.cleanup(ctx); err != nil || n != 0 {
+		t.Fatalf("cleanup removed %d entries: %v", n, err)
+	}
+	tgt.interval = time.Nanosecond
+	if n, err := tgt.cleanup(ctx); err != nil || n != 1 {
+		t.Fatalf("cleanup removed %d entries: %v", n, err)
+	}
+
+	if err := tgt.Delete(ctx, "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgt.Delete(ctx, "user@example.org"); !errors.Is(err, ErrNoSuchAutoreply) {
+		t.Fatalf("expected ErrNoSuchAutoreply, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package autoreply
+
+import (
+	"bytes"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/themadorg/madmail/framework/address"
+	mdb "github.com/themadorg/madmail/internal/db"
+)
+
+// shouldReply reports whether the message can be replied to according to
+// RFC 3834: it is not automatically generated, not sent by a mailing list
+// and the sender is not a mailer daemon or a list address.
+func shouldReply(mailFrom string, hdr textproto.Header) bool {
+	if autoSubmitted := strings.TrimSpace(hdr.Get("Auto-Submitted")); autoSubmitted != "" &&
+		!strings.EqualFold(autoSubmitted, "no") {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(hdr.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false
+	}
+	if hdr.Has("List-Id") || hdr.Has("List-Unsubscribe") {
+		return false
+	}
+
+	mbox, _, err := address.Split(mailFrom)
+	if err != nil {
+		return false
+	}
+	mbox = strings.ToLower(mbox)
+	return mbox != "mailer-daemon" &&
+		!strings.HasPrefix(mbox, "owner-") &&
+		!strings.HasSuffix(mbox, "-request")
+}
+
+// addressedTo reports whether the recipient or its address before rewriting
+// is listed in the To or Cc header fields.
+func addressedTo(hdr textproto.Header, rcpt, originalRcpt string) bool {
+	want := make(map[string]bool, 2)
+	for _, addr := range []string{rcpt, originalRcpt} {
+		if norm, err := address.ForLookup(addr); err == nil && norm != "" {
+			want[norm] = true
+		}
+	}
+
+	for _, field := range []string{"To", "Cc"} {
+		for _, value := range hdr.Values(field) {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+			for _, addr := range list {
+				if norm, err := address.ForLookup(addr.Address); err == nil && want[norm] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// buildReply generates the reply to the message with the origHdr header.
+func (t *Target) buildReply(reply *mdb.Autoreply, msgID, from, to string, origHdr textproto.Header) (textproto.Header, []byte, error) {
+	msgDomain := t.autogenMsgDomain
+	if msgDomain == "" {
+		_, msgDomain, _ = address.Split(from)
+	}
+
+	subject := mime.QEncoding.Encode("utf-8", reply.Subject)
+	if reply.Subject == "" {
+		subject = "Auto: " + strings.TrimSpace(origHdr.Get("Subject"))
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-Id", "<"+msgID+"@"+msgDomain+">")
+	hdr.Add("From", "<"+from+">")
+	hdr.Add("To", "<"+to+">")
+	hdr.Add("Subject", subject)
+	if origID := strings.TrimSpace(origHdr.Get("Message-Id")); origID != "" {
+		hdr.Add("In-Reply-To", origID)
+		references := origID
+		if origRefs := strings.TrimSpace(origHdr.Get("References")); origRefs != "" {
+			references = origRefs + " " + origID
+		}
+		hdr.Add("References", references)
+	}
+	hdr.Add("Auto-Submitted", "auto-replied")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", "text/plain; charset=utf-8")
+	hdr.Add("Content-Transfer-Encoding", "quoted-printable")
+
+	var body bytes.Buffer
+	w := quotedprintable.NewWriter(&body)
+	if _, err := w.Write([]byte(reply.Body)); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	return hdr, body.Bytes(), nil
+}
@@ -27,7 +27,8 @@ Interfaces implemented:
 Implementation summary follows.
 
 All scheduled deliveries are attempted to the configured DeliveryTarget.
-All metadata is preserved on disk.
+All metadata is preserved on disk, or in an SQL database shared by multiple
+servers if driver is configured (see sql.go).
 
 Failure status is determined on per-recipient basis:
   - Delivery.Start fail handled as a failure for all recipients.
@@ -82,9 +83,11 @@ import (
 	"github.com/themadorg/madmail/framework/exterrors"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
 	"github.com/themadorg/madmail/internal/dsn"
 	"github.com/themadorg/madmail/internal/msgpipeline"
 	"github.com/themadorg/madmail/internal/target"
+	"gorm.io/gorm"
 )
 
 // partialError describes state of partially successful message delivery.
@@ -134,6 +137,10 @@ type Queue struct {
 	retryTimeScale   float64
 	maxTries         int
 
+	// If non-zero, temporary failures are treated as permanent once the
+	// message is in the queue for longer than maxLifetime.
+	maxLifetime time.Duration
+
 	// If any delivery is scheduled in less than postInitDelay
 	// after Init, its delay will be increased by postInitDelay.
 	//
@@ -153,6 +160,18 @@ type Queue struct {
 	// Buffered channel used to restrict count of deliveries attempted
 	// in parallel.
 	deliverySemaphore chan struct{}
+
+	// Set if the queue is stored in a database instead of location, see
+	// sql.go.
+	db *gorm.DB
+	// Identifies this server in the claimed_by column.
+	instanceID string
+	// Entries claimed by a server are not delivered by others until
+	// leaseTimeout passes.
+	leaseTimeout time.Duration
+	pollInterval time.Duration
+	sqlWake      chan struct{}
+	sqlStop      chan struct{}
 }
 
 type QueueMetadata struct {
@@ -194,6 +213,8 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 		initialRetryTime: 15 * time.Minute,
 		retryTimeScale:   1.25,
 		postInitDelay:    10 * time.Second,
+		leaseTimeout:     15 * time.Minute,
+		pollInterval:     10 * time.Second,
 		Log:              log.Logger{Name: "queue"},
 	}
 	switch len(inlineArgs) {
@@ -208,9 +229,17 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 }
 
 func (q *Queue) Init(cfg *config.Map) error {
-	var maxParallelism int
+	var (
+		maxParallelism int
+		driver         string
+		dsn            mdb.DSN
+		dbOpts         mdb.Options
+	)
 	cfg.Bool("debug", true, false, &q.Log.Debug)
 	cfg.Int("max_tries", false, false, 20, &q.maxTries)
+	cfg.Duration("initial_retry_time", false, false, q.initialRetryTime, &q.initialRetryTime)
+	cfg.Float("retry_time_scale", false, false, q.retryTimeScale, &q.retryTimeScale)
+	cfg.Duration("max_lifetime", false, false, 0, &q.maxLifetime)
 	cfg.Int("max_parallelism", false, false, 16, &maxParallelism)
 	cfg.String("location", false, false, q.location, &q.location)
 	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &q.Target)
@@ -219,6 +248,11 @@ func (q *Queue) Init(cfg *config.Map) error {
 	cfg.Custom("bounce", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
 		return msgpipeline.New(m.Globals, node.Children)
 	}, &q.dsnPipeline)
+	mdb.DriverDirective(cfg, "driver", false, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", false, nil, &dsn)
+	mdb.Directives(cfg, &dbOpts)
+	cfg.Duration("lease_timeout", false, false, q.leaseTimeout, &q.leaseTimeout)
+	cfg.Duration("poll_interval", false, false, q.pollInterval, &q.pollInterval)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -231,6 +265,16 @@ func (q *Queue) Init(cfg *config.Map) error {
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Hostname = q.hostname
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "queue/pipeline", Debug: q.Log.Debug}
 	}
+	if q.initialRetryTime <= 0 || q.retryTimeScale < 1 {
+		return errors.New("queue: initial_retry_time should be positive and retry_time_scale should be at least 1")
+	}
+
+	if driver != "" {
+		if err := q.initDB(driver, dsn, dbOpts); err != nil {
+			return err
+		}
+		return q.startSQL(maxParallelism)
+	}
 	if q.location == "" && q.name == "" {
 		return errors.New("queue: need explicit location directive or inline argument if defined inline")
 	}
@@ -260,6 +304,10 @@ func (q *Queue) start(maxParallelism int) error {
 }
 
 func (q *Queue) Close() error {
+	if q.db != nil {
+		return q.closeSQL()
+	}
+
 	q.wheel.Close()
 	q.deliveryWg.Wait()
 
@@ -274,6 +322,11 @@ func (q *Queue) Close() error {
 //
 // No error handling is done since this function is called from panic handler.
 func (q *Queue) discardBroken(id string) {
+	if q.db != nil {
+		q.discardBrokenSQL(id)
+		return
+	}
+
 	err := os.Rename(filepath.Join(q.location, id+".meta"), filepath.Join(q.location, id+".meta_broken"))
 	if err != nil {
 		// Note: Global logger is used in case there is something wrong with Queue.Log.
@@ -288,6 +341,12 @@ func (q *Queue) dispatch(value TimeSlot) {
 
 	q.deliveryWg.Add(1)
 	go func() {
+		if q.db != nil {
+			// The entry is claimed already, keep it claimed while waiting
+			// for the semaphore too.
+			defer q.keepClaimed(slot.ID)()
+		}
+
 		q.Log.Debugln("waiting on delivery semaphore for", slot.ID)
 		q.deliverySemaphore <- struct{}{}
 		defer func() {
@@ -385,6 +444,9 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		meta.TriesCount = make(map[string]int)
 	}
 
+	// See maxLifetime.
+	expired := q.maxLifetime != 0 && time.Since(meta.FirstAttempt) >= q.maxLifetime
+
 	// Check attempted recipients and corresponding errors.
 	// Split list into two parts: recipients that should be retried (newRcpts)
 	// and recipients DSN will be generated for.
@@ -402,7 +464,7 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		meta.RcptErrs[rcpt] = toSMTPErr(rcptErr)
 
 		temporary := exterrors.IsTemporaryOrUnspec(rcptErr)
-		if !temporary || meta.TriesCount[rcpt]+1 >= q.maxTries {
+		if !temporary || meta.TriesCount[rcpt]+1 >= q.maxTries || expired {
 			delete(meta.TriesCount, rcpt)
 			dl.Msg("not delivered, permanent error", "rcpt", rcpt)
 			failedRcpts = append(failedRcpts, rcpt)
@@ -425,28 +487,31 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	}
 	// No recipients to try, either all failed or all succeeded.
 	if len(newRcpts) == 0 {
-		q.removeFromDisk(meta.MsgMeta)
+		q.removeMessage(meta.MsgMeta)
 		return
 	}
 
 	meta.To = newRcpts
 	meta.LastAttempt = time.Now()
 
-	if err := q.updateMetadataOnDisk(meta); err != nil {
-		dl.Error("meta-data update", err)
-	}
-
-	nextTryTime := time.Now()
-	// Delay between retries grows exponentally, the formula is:
-	// initialRetryTime * retryTimeScale ^ (smallestTriesCount - 1)
 	dl.Debugf("delay: %v * %v ^ (%v - 1)", q.initialRetryTime, q.retryTimeScale, smallestTriesCount)
-	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-	nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
+	nextTryTime := meta.LastAttempt.Add(q.retryDelay(smallestTriesCount))
 	dl.Msg("will retry",
 		"attempts_count", meta.TriesCount,
 		"next_try_delay", time.Until(nextTryTime),
 		"rcpts", meta.To)
 
+	if q.db != nil {
+		if err := q.rescheduleSQL(meta, failedRcpts, nextTryTime); err != nil {
+			dl.Error("queue entry update", err)
+		}
+		return
+	}
+
+	if err := q.updateMetadataOnDisk(meta); err != nil {
+		dl.Error("meta-data update", err)
+	}
+
 	q.wheel.Add(nextTryTime, queueSlot{
 		ID: meta.MsgMeta.ID,
 
@@ -458,6 +523,19 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	})
 }
 
+// retryDelay returns the delay before the next attempt for the message
+// already tried triesCount times.
+//
+// Delay between retries grows exponentally, the formula is:
+// initialRetryTime * retryTimeScale ^ (triesCount - 1)
+//
+// The scale factor is rounded down to an integer, as it always was, so that
+// the schedule of existing installations does not change.
+func (q *Queue) retryDelay(triesCount int) time.Duration {
+	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(triesCount-1)))
+	return q.initialRetryTime * scaleFactor
+}
+
 func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) partialError {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 	perr := partialError{
@@ -568,7 +646,15 @@ func (qd *queueDelivery) Body(ctx context.Context, header textproto.Header, body
 
 	// Body buffer initially passed to us may not be valid after "delivery" to queue completes.
 	// storeNewMessage returns a new buffer object created from message blob stored on disk.
-	storedBody, err := qd.q.storeNewMessage(qd.meta, header, body)
+	var (
+		storedBody buffer.Buffer
+		err        error
+	)
+	if qd.q.db != nil {
+		storedBody, err = qd.q.storeNewMessageSQL(qd.meta, header, body)
+	} else {
+		storedBody, err = qd.q.storeNewMessage(qd.meta, header, body)
+	}
 	if err != nil {
 		return err
 	}
@@ -582,7 +668,7 @@ func (qd *queueDelivery) Abort(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "queue/Abort").End()
 
 	if qd.body != nil {
-		qd.q.removeFromDisk(qd.meta.MsgMeta)
+		qd.q.removeMessage(qd.meta.MsgMeta)
 	}
 	return nil
 }
@@ -594,12 +680,18 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 		panic("queue: double Commit")
 	}
 
-	qd.q.wheel.Add(time.Time{}, queueSlot{
+	slot := queueSlot{
 		ID:   qd.meta.MsgMeta.ID,
 		Meta: qd.meta,
 		Hdr:  &qd.header,
 		Body: qd.body,
-	})
+	}
+	if qd.q.db != nil {
+		// The entry is already claimed by this server.
+		qd.q.dispatch(TimeSlot{Value: slot})
+	} else {
+		qd.q.wheel.Add(time.Time{}, slot)
+	}
 	qd.meta = nil
 	qd.body = nil
 	return nil
@@ -616,6 +708,14 @@ func (q *Queue) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom
 	return &queueDelivery{q: q, meta: meta}, nil
 }
 
+func (q *Queue) removeMessage(msgMeta *module.MsgMetadata) {
+	if q.db != nil {
+		q.removeSQL(msgMeta)
+		return
+	}
+	q.removeFromDisk(msgMeta)
+}
+
 func (q *Queue) removeFromDisk(msgMeta *module.MsgMetadata) {
 	id := msgMeta.ID
 	dl := target.DeliveryLogger(q.Log, msgMeta)
@@ -691,9 +791,7 @@ func (q *Queue) readDiskQueue() error {
 				smallestTriesCount = count
 			}
 		}
-		nextTryTime := meta.LastAttempt
-		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-		nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
+		nextTryTime := meta.LastAttempt.Add(q.retryDelay(smallestTriesCount))
 
 		if time.Until(nextTryTime) < q.postInitDelay {
 			nextTryTime = time.Now().Add(q.postInitDelay)
@@ -842,6 +940,10 @@ func (q *Queue) tryRemoveDanglingFile(name string) {
 }
 
 func (q *Queue) openMessage(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
+	if q.db != nil {
+		return q.openMessageSQL(id)
+	}
+
 	meta, err := q.readMessageMeta(id)
 	if err != nil {
 		return nil, textproto.Header{}, nil, err
@@ -995,6 +1097,9 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 
 func (q *Queue) PurgeBySender(from string) (int, error) {
 	q.Log.Msg("purging queue by sender", "sender", from)
+	if q.db != nil {
+		return q.purgeSQL("mail_from = ?", from)
+	}
 	dirInfo, err := os.ReadDir(q.location)
 	if err != nil {
 		return 0, err
@@ -1023,6 +1128,10 @@ func (q *Queue) PurgeBySender(from string) (int, error) {
 
 func (q *Queue) PurgeByRecipient(rcpt string) (int, error) {
 	q.Log.Msg("purging queue by recipient", "recipient", rcpt)
+	if q.db != nil {
+		return q.purgeSQL("id IN (?)", q.db.Model(&mdb.QueueRecipient{}).
+			Select("entry_id").Where("rcpt = ? AND status = ?", rcpt, rcptPending))
+	}
 	dirInfo, err := os.ReadDir(q.location)
 	if err != nil {
 		return 0, err
@@ -1054,4 +1163,5 @@ func (q *Queue) PurgeByRecipient(rcpt string) (int, error) {
 
 func init() {
 	module.Register("target.queue", NewQueue)
+	mdb.RegisterMigrations("target.queue", sqlMigrations)
 }
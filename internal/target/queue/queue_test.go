@@ -234,6 +234,16 @@ func checkQueueDir(t *testing.T, q *Queue, expectedIDs []string) {
 	}
 }
 
+func TestQueue_RetryDelay(t *testing.T) {
+	q := Queue{initialRetryTime: 15 * time.Minute, retryTimeScale: 1.25}
+	expected := []time.Duration{15, 15, 15, 15, 30, 45, 45, 60, 75, 105}
+	for i, delay := range expected {
+		if got := q.retryDelay(i + 1); got != delay*time.Minute {
+			t.Errorf("attempt %d: expected %v, got %v", i+1, delay*time.Minute, got)
+		}
+	}
+}
+
 func TestQueueDelivery(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,811 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/target"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
+)
+
+// Recipient statuses stored in mdb.QueueRecipient.
+const (
+	rcptPending   = "pending"
+	rcptDelivered = "delivered"
+	rcptFailed    = "failed"
+)
+
+// claimedBroken is the ClaimedBy value of entries that caused a panic during
+// delivery. They are not claimed again.
+const claimedBroken = "broken"
+
+var sqlMigrations = []mdb.Migration{
+	{
+		ID: "20261014_target_queue",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.QueueEntry{}, &mdb.QueueRecipient{}, &mdb.QueueBody{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.QueueBody{}, &mdb.QueueRecipient{}, &mdb.QueueEntry{})
+		},
+	},
+	{
+		ID: "20261015_target_queue_body_chunks",
+		Up: func(tx *gorm.DB) error {
+			type QueueBodyChunk struct {
+				EntryID string `gorm:"primaryKey;size:128"`
+				Seq     int    `gorm:"primaryKey;autoIncrement:false"`
+				Data    []byte `gorm:"not null"`
+			}
+			return tx.Migrator().CreateTable(&QueueBodyChunk{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(mdb.TableName(tx, "queue_body_chunks"))
+		},
+	},
+}
+
+// bodyChunkSize is the size of mdb.QueueBodyChunk.Data.
+const bodyChunkSize = 1 << 20
+
+func (q *Queue) initDB(driver string, dsn mdb.DSN, dbOpts mdb.Options) error {
+	if q.name == "" {
+		return errors.New("queue: the queue stored in a database should be defined in a named block")
+	}
+	if q.leaseTimeout <= 0 || q.pollInterval <= 0 {
+		return errors.New("queue: lease_timeout and poll_interval should be positive")
+	}
+
+	if driver == "sqlserver" || driver == "mssql" {
+		// Claiming entries relies on SKIP LOCKED, which SQL Server does not
+		// support.
+		return errors.New("queue: sqlserver driver is not supported, use sqlite3, postgres or mysql")
+	}
+
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	dbOpts.Log = q.Log
+	dbOpts.MetricsName = q.name
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return fmt.Errorf("queue: failed to open db: %w", err)
+	}
+	if err := mdb.Migrate(db, sqlMigrations); err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	q.db = db
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = q.hostname
+	}
+	id := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return err
+	}
+	q.instanceID = hostname + "/" + strconv.Itoa(os.Getpid()) + "/" + hex.EncodeToString(id)
+	return nil
+}
+
+// startSQL starts processing of entries stored in the database. Unlike the
+// disk queue, entries are not scheduled in memory, instead due entries are
+// claimed every poll_interval so that several servers can share the queue.
+func (q *Queue) startSQL(maxParallelism int) error {
+	q.deliverySemaphore = make(chan struct{}, maxParallelism)
+	q.sqlWake = make(chan struct{}, 1)
+	q.sqlStop = make(chan struct{})
+
+	if module.NoRun {
+		return nil
+	}
+
+	// Entries claimed by a server that stopped without completing the
+	// delivery.
+	res := q.db.Model(&mdb.QueueEntry{}).
+		Where("queue = ? AND claimed_by <> ? AND claimed_until < ?", q.name, "", time.Now().UTC()).
+		Updates(map[string]interface{}{"claimed_by": "", "claimed_until": nil})
+	if res.Error != nil {
+		return fmt.Errorf("queue: reclaim entries: %w", res.Error)
+	}
+	if res.RowsAffected != 0 {
+		q.Log.Printf("reclaimed %d queue entries with expired lease", res.RowsAffected)
+	}
+
+	go q.pollLoop()
+	return nil
+}
+
+func (q *Queue) closeSQL() error {
+	if q.sqlStop != nil && !module.NoRun {
+		q.sqlStop <- struct{}{}
+		<-q.sqlStop
+		q.sqlStop = nil
+	}
+	q.deliveryWg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	return mdb.Close(ctx, q.db)
+}
+
+func (q *Queue) pollLoop() {
+	defer func() {
+		if err := recover(); err != nil {
+			q.Log.Printf("panic during queue poll: %v\n%s", err, debug.Stack())
+		}
+	}()
+
+	// See postInitDelay.
+	t := time.NewTimer(q.postInitDelay)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-q.sqlWake:
+			if !t.Stop() {
+				<-t.C
+			}
+		case <-q.sqlStop:
+			q.sqlStop <- struct{}{}
+			return
+		}
+
+		q.pollDue()
+		t.Reset(q.pollInterval)
+	}
+}
+
+// wakeSQL makes pollLoop check for due entries without waiting for
+// poll_interval.
+func (q *Queue) wakeSQL() {
+	select {
+	case q.sqlWake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) pollDue() {
+	free := cap(q.deliverySemaphore) - len(q.deliverySemaphore)
+	if free <= 0 {
+		return
+	}
+	ids, err := q.claimDue(context.Background(), free)
+	if err != nil {
+		q.Log.Error("failed to claim queue entries", err)
+		return
+	}
+	for _, id := range ids {
+		q.dispatch(TimeSlot{Value: queueSlot{ID: id}})
+	}
+}
+
+// claimDue claims up to limit entries that are due for delivery and returns
+// their IDs.
+//
+// On PostgreSQL and MySQL, entries are selected using SELECT ... FOR UPDATE
+// SKIP LOCKED so that concurrent servers claim different entries. SQLite
+// has no row locks, instead each entry is claimed using an UPDATE that
+// succeeds only if the entry was not claimed by another server since it was
+// selected.
+func (q *Queue) claimDue(ctx context.Context, limit int) ([]string, error) {
+	now := time.Now().UTC()
+	claim := map[string]interface{}{
+		"claimed_by":    q.instanceID,
+		"claimed_until": now.Add(q.leaseTimeout),
+	}
+	due := func(tx *gorm.DB) *gorm.DB {
+		return tx.Model(&mdb.QueueEntry{}).
+			Where("queue = ? AND next_attempt_at <= ?", q.name, now).
+			Where("(claimed_by = ? OR claimed_until < ?)", "", now)
+	}
+
+	var ids []string
+	switch q.db.Dialector.Name() {
+	case "postgres", "mysql":
+		err := q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := due(tx).
+				Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Order("next_attempt_at").Limit(limit).
+				Pluck("id", &ids).Error
+			if err != nil || len(ids) == 0 {
+				return err
+			}
+			return tx.Model(&mdb.QueueEntry{}).Where("id IN ?", ids).Updates(claim).Error
+		})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		var candidates []string
+		err := due(q.db.WithContext(ctx)).
+			Order("next_attempt_at").Limit(limit).
+			Pluck("id", &candidates).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range candidates {
+			res := due(q.db.WithContext(ctx)).Where("id = ?", id).Updates(claim)
+			if res.Error != nil {
+				return ids, res.Error
+			}
+			if res.RowsAffected == 1 {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// storeNewMessageSQL stores the message as an entry claimed by this server,
+// so that it is not delivered by others before Commit.
+func (q *Queue) storeNewMessageSQL(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	var hdrBlob bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBlob, header); err != nil {
+		return nil, err
+	}
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	msgMeta := meta.MsgMeta.DeepCopy()
+	msgMeta.Conn = nil
+	metaBlob, err := json.Marshal(msgMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	claimedUntil := now.Add(q.leaseTimeout)
+	entry := mdb.QueueEntry{
+		ID:            meta.MsgMeta.ID,
+		Queue:         q.name,
+		MailFrom:      meta.From,
+		MsgMeta:       metaBlob,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		ClaimedBy:     q.instanceID,
+		ClaimedUntil:  &claimedUntil,
+	}
+	rcpts := make([]mdb.QueueRecipient, 0, len(meta.To))
+	for _, rcpt := range meta.To {
+		rcpts = append(rcpts, mdb.QueueRecipient{
+			EntryID: entry.ID,
+			Rcpt:    rcpt,
+			Status:  rcptPending,
+		})
+	}
+
+	size := 0
+	err = q.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+		if len(rcpts) != 0 {
+			if err := tx.Create(&rcpts).Error; err != nil {
+				return err
+			}
+		}
+		err := tx.Create(&mdb.QueueBody{
+			EntryID: entry.ID,
+			Header:  hdrBlob.Bytes(),
+			Body:    []byte{},
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		chunk := make([]byte, bodyChunkSize)
+		for seq := 0; ; seq++ {
+			n, err := io.ReadFull(r, chunk)
+			if n != 0 {
+				if err := tx.Create(&mdb.QueueBodyChunk{EntryID: entry.ID, Seq: seq, Data: chunk[:n]}).Error; err != nil {
+					return err
+				}
+				size += n
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlBody{db: q.db, entryID: entry.ID, size: size}, nil
+}
+
+// openMessageSQL loads the entry claimed by this server.
+func (q *Queue) openMessageSQL(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
+	var entry mdb.QueueEntry
+	if err := q.db.Where("id = ?", id).Take(&entry).Error; err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+	var rcpts []mdb.QueueRecipient
+	if err := q.db.Where("entry_id = ?", id).Order("id").Find(&rcpts).Error; err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+	var body mdb.QueueBody
+	if err := q.db.Where("entry_id = ?", id).Take(&body).Error; err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+
+	meta := &QueueMetadata{
+		MsgMeta:      &module.MsgMetadata{},
+		From:         entry.MailFrom,
+		RcptErrs:     map[string]*smtp.SMTPError{},
+		TriesCount:   map[string]int{},
+		FirstAttempt: entry.CreatedAt,
+		LastAttempt:  entry.CreatedAt,
+	}
+	if entry.LastAttemptAt != nil {
+		meta.LastAttempt = *entry.LastAttemptAt
+	}
+	if err := json.Unmarshal(entry.MsgMeta, meta.MsgMeta); err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+	for _, rcpt := range rcpts {
+		if rcpt.LastErrorCode != 0 {
+			rcptErr := &smtp.SMTPError{
+				Code:    rcpt.LastErrorCode,
+				Message: rcpt.LastError,
+			}
+			fmt.Sscanf(rcpt.LastErrorEnhanced, "%d.%d.%d",
+				&rcptErr.EnhancedCode[0], &rcptErr.EnhancedCode[1], &rcptErr.EnhancedCode[2])
+			meta.RcptErrs[rcpt.Rcpt] = rcptErr
+		}
+		if rcpt.Status == rcptPending {
+			meta.To = append(meta.To, rcpt.Rcpt)
+			meta.TriesCount[rcpt.Rcpt] = rcpt.Attempts
+		}
+	}
+
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(body.Header)))
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+	if len(body.Body) != 0 {
+		return meta, header, buffer.MemoryBuffer{Slice: body.Body}, nil
+	}
+	var size int64
+	err = q.db.Model(&mdb.QueueBodyChunk{}).Where("entry_id = ?", id).
+		Select("COALESCE(SUM(LENGTH(data)), 0)").Scan(&size).Error
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+	return meta, header, sqlBody{db: q.db, entryID: id, size: int(size)}, nil
+}
+
+// sqlBody is the body of a queue entry stored in queue_body_chunks. Each
+// reader loads one chunk at a time from the primary database.
+type sqlBody struct {
+	db      *gorm.DB
+	entryID string
+	size    int
+}
+
+func (b sqlBody) Open() (io.ReadCloser, error) {
+	return &sqlBodyReader{body: b}, nil
+}
+
+func (b sqlBody) Len() int {
+	return b.size
+}
+
+// Remove does nothing, chunks are deleted together with the entry.
+func (b sqlBody) Remove() error {
+	return nil
+}
+
+type sqlBodyReader struct {
+	body  sqlBody
+	seq   int
+	chunk []byte
+}
+
+func (r *sqlBodyReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		var chunk mdb.QueueBodyChunk
+		err := r.body.db.Clauses(dbresolver.Write).
+			Where("entry_id = ? AND seq = ?", r.body.entryID, r.seq).
+			Take(&chunk).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.seq++
+		r.chunk = chunk.Data
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (r *sqlBodyReader) Close() error {
+	r.chunk = nil
+	return nil
+}
+
+// keepClaimed extends the claim of the entry every third of lease_timeout
+// until the returned function is called, so that the entry is not claimed
+// and delivered again by another server while the delivery is in progress.
+func (q *Queue) keepClaimed(id string) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(q.leaseTimeout / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			res := q.db.Model(&mdb.QueueEntry{}).
+				Where("id = ? AND claimed_by = ?", id, q.instanceID).
+				Update("claimed_until", time.Now().UTC().Add(q.leaseTimeout))
+			if res.Error != nil {
+				q.Log.Error("failed to extend the queue entry claim", res.Error, "msg_id", id)
+				continue
+			}
+			if res.RowsAffected == 0 {
+				// Released or marked as broken.
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// rescheduleSQL saves the results of the delivery attempt and releases the
+// claim. Recipients in meta.To are retried at nextTryTime.
+func (q *Queue) rescheduleSQL(meta *QueueMetadata, failedRcpts []string, nextTryTime time.Time) error {
+	id := meta.MsgMeta.ID
+	setErr := func(tx *gorm.DB, rcpt string, updates map[string]interface{}) error {
+		if rcptErr := meta.RcptErrs[rcpt]; rcptErr != nil {
+			updates["last_error"] = rcptErr.Message
+			updates["last_error_code"] = rcptErr.Code
+			updates["last_error_enhanced"] = fmt.Sprintf("%d.%d.%d",
+				rcptErr.EnhancedCode[0], rcptErr.EnhancedCode[1], rcptErr.EnhancedCode[2])
+		}
+		updates["updated_at"] = time.Now().UTC()
+		return tx.Model(&mdb.QueueRecipient{}).
+			Where("entry_id = ? AND rcpt = ?", id, rcpt).
+			Updates(updates).Error
+	}
+
+	return q.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&mdb.QueueEntry{}).
+			Where("id = ? AND claimed_by = ?", id, q.instanceID).
+			Updates(map[string]interface{}{
+				"next_attempt_at": nextTryTime.UTC(),
+				"attempts":        gorm.Expr("attempts + 1"),
+				"last_attempt_at": meta.LastAttempt.UTC(),
+				"claimed_by":      "",
+				"claimed_until":   nil,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errors.New("queue entry was claimed by another server, lease_timeout is too short")
+		}
+
+		// The rest of previously pending recipients succeeded.
+		notDelivered := append(append([]string{}, meta.To...), failedRcpts...)
+		err := tx.Model(&mdb.QueueRecipient{}).
+			Where("entry_id = ? AND status = ? AND rcpt NOT IN ?", id, rcptPending, notDelivered).
+			Updates(map[string]interface{}{"status": rcptDelivered, "updated_at": time.Now().UTC()}).Error
+		if err != nil {
+			return err
+		}
+		for _, rcpt := range failedRcpts {
+			if err := setErr(tx, rcpt, map[string]interface{}{
+				"status":   rcptFailed,
+				"attempts": gorm.Expr("attempts + 1"),
+			}); err != nil {
+				return err
+			}
+		}
+		for _, rcpt := range meta.To {
+			if err := setErr(tx, rcpt, map[string]interface{}{"attempts": meta.TriesCount[rcpt]}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func deleteEntries(tx *gorm.DB, ids []string) error {
+	if err := tx.Where("entry_id IN ?", ids).Delete(&mdb.QueueBodyChunk{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("entry_id IN ?", ids).Delete(&mdb.QueueBody{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("entry_id IN ?", ids).Delete(&mdb.QueueRecipient{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("id IN ?", ids).Delete(&mdb.QueueEntry{}).Error
+}
+
+func (q *Queue) removeSQL(msgMeta *module.MsgMetadata) {
+	err := q.db.Transaction(func(tx *gorm.DB) error {
+		return deleteEntries(tx, []string{msgMeta.ID})
+	})
+	if err != nil {
+		target.DeliveryLogger(q.Log, msgMeta).Error("failed to remove queue entry", err)
+	}
+}
+
+// discardBrokenSQL keeps the entry in the database for inspection, but
+// prevents further delivery attempts.
+func (q *Queue) discardBrokenSQL(id string) {
+	err := q.db.Model(&mdb.QueueEntry{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"claimed_by": claimedBroken, "claimed_until": nil}).Error
+	if err != nil {
+		q.Log.Printf("can't mark the queue entry as broken: %v", err)
+	}
+}
+
+func (q *Queue) purgeSQL(query string, args ...interface{}) (int, error) {
+	var ids []string
+	err := q.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&mdb.QueueEntry{}).
+			Where("queue = ?", q.name).
+			Where(query, args...).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		return deleteEntries(tx, ids)
+	})
+	return len(ids), err
+}
+
+// GORM implements mdb.Provider. It returns nil if the queue is stored on
+// disk.
+func (q *Queue) GORM() *gorm.DB {
+	return q.db
+}
+
+// ErrNoSuchEntry is returned by Entry and Retry for unknown entry IDs.
+var ErrNoSuchEntry = errors.New("queue: no such entry")
+
+// ErrNotSupported is returned by management functions that are available
+// only for the queue stored in a database.
+var ErrNotSupported = errors.New("queue: operation is supported only for the queue stored in a database")
+
+// EntryInfo describes a queued message for management commands.
+type EntryInfo struct {
+	ID          string
+	From        string
+	Created     time.Time
+	LastAttempt time.Time
+	NextAttempt time.Time
+	Attempts    int
+
+	// ClaimedBy identifies the server delivering the message, if any.
+	ClaimedBy string
+
+	Rcpts []RcptInfo
+}
+
+// RcptInfo is the delivery status of a recipient.
+type RcptInfo struct {
+	Rcpt      string
+	Status    string
+	Attempts  int
+	LastError string
+}
+
+func (q *Queue) entryInfoSQL(entry mdb.QueueEntry, rcpts []mdb.QueueRecipient) EntryInfo {
+	info := EntryInfo{
+		ID:          entry.ID,
+		From:        entry.MailFrom,
+		Created:     entry.CreatedAt,
+		NextAttempt: entry.NextAttemptAt,
+		Attempts:    entry.Attempts,
+		ClaimedBy:   entry.ClaimedBy,
+	}
+	if entry.LastAttemptAt != nil {
+		info.LastAttempt = *entry.LastAttemptAt
+	}
+	for _, rcpt := range rcpts {
+		rcptInfo := RcptInfo{
+			Rcpt:     rcpt.Rcpt,
+			Status:   rcpt.Status,
+			Attempts: rcpt.Attempts,
+		}
+		if rcpt.LastErrorCode != 0 {
+			rcptInfo.LastError = fmt.Sprintf("%d %s %s", rcpt.LastErrorCode, rcpt.LastErrorEnhanced, rcpt.LastError)
+		}
+		info.Rcpts = append(info.Rcpts, rcptInfo)
+	}
+	return info
+}
+
+func (q *Queue) entriesSQL(id string) ([]EntryInfo, error) {
+	query := q.db.Where("queue = ?", q.name)
+	if id != "" {
+		query = query.Where("id = ?", id)
+	}
+	var entries []mdb.QueueEntry
+	if err := query.Omit("msg_meta").Order("created_at").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	var rcpts []mdb.QueueRecipient
+	if err := q.db.Where("entry_id IN ?", ids).Order("id").Find(&rcpts).Error; err != nil {
+		return nil, err
+	}
+	byEntry := make(map[string][]mdb.QueueRecipient, len(entries))
+	for _, rcpt := range rcpts {
+		byEntry[rcpt.EntryID] = append(byEntry[rcpt.EntryID], rcpt)
+	}
+
+	infos := make([]EntryInfo, 0, len(entries))
+	for _, entry := range entries {
+		infos = append(infos, q.entryInfoSQL(entry, byEntry[entry.ID]))
+	}
+	return infos, nil
+}
+
+func (q *Queue) entriesDisk(id string) ([]EntryInfo, error) {
+	dirInfo, err := os.ReadDir(q.location)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []EntryInfo
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		entryID := entry.Name()[:len(entry.Name())-5]
+		if id != "" && entryID != id {
+			continue
+		}
+
+		meta, err := q.readMessageMeta(entryID)
+		if err != nil {
+			continue
+		}
+		info := EntryInfo{
+			ID:          entryID,
+			From:        meta.From,
+			Created:     meta.FirstAttempt,
+			LastAttempt: meta.LastAttempt,
+		}
+		smallestTriesCount := 999999
+		for _, rcpt := range meta.To {
+			rcptInfo := RcptInfo{
+				Rcpt:     rcpt,
+				Status:   rcptPending,
+				Attempts: meta.TriesCount[rcpt],
+			}
+			if rcptErr := meta.RcptErrs[rcpt]; rcptErr != nil {
+				rcptInfo.LastError = rcptErr.Error()
+			}
+			if rcptInfo.Attempts > info.Attempts {
+				info.Attempts = rcptInfo.Attempts
+			}
+			if rcptInfo.Attempts < smallestTriesCount {
+				smallestTriesCount = rcptInfo.Attempts
+			}
+			info.Rcpts = append(info.Rcpts, rcptInfo)
+		}
+		info.NextAttempt = meta.LastAttempt.Add(q.retryDelay(smallestTriesCount))
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Entries returns all queued messages ordered by the time they were
+// queued. Only pending recipients are returned for the disk queue.
+func (q *Queue) Entries() ([]EntryInfo, error) {
+	if q.db != nil {
+		return q.entriesSQL("")
+	}
+	return q.entriesDisk("")
+}
+
+// Entry returns the queued message with the ID.
+func (q *Queue) Entry(id string) (EntryInfo, error) {
+	var (
+		infos []EntryInfo
+		err   error
+	)
+	if q.db != nil {
+		infos, err = q.entriesSQL(id)
+	} else {
+		infos, err = q.entriesDisk(id)
+	}
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	if len(infos) == 0 {
+		return EntryInfo{}, ErrNoSuchEntry
+	}
+	return infos[0], nil
+}
+
+// Retry schedules the queued message with the ID to be delivered now, or
+// all messages if id is empty. Servers attempt the delivery within
+// poll_interval. The number of scheduled messages is returned.
+func (q *Queue) Retry(id string) (int, error) {
+	if q.db == nil {
+		return 0, ErrNotSupported
+	}
+
+	query := q.db.Model(&mdb.QueueEntry{}).Where("queue = ? AND claimed_by <> ?", q.name, claimedBroken)
+	if id != "" {
+		query = query.Where("id = ?", id)
+	}
+	res := query.Update("next_attempt_at", time.Now().UTC())
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	if id != "" && res.RowsAffected == 0 {
+		return 0, ErrNoSuchEntry
+	}
+	return int(res.RowsAffected), nil
+}
@@ -0,0 +1,398 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/exterrors"
+	"github.com/themadorg/madmail/framework/log"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func newTestQueueSQL(t *testing.T, target module.DeliveryTarget, dbPath string, configure ...func(q *Queue)) *Queue {
+	t.Helper()
+
+	mod, _ := NewQueue("", "queue", nil, nil)
+	q := mod.(*Queue)
+	q.initialRetryTime = 0
+	q.retryTimeScale = 1
+	q.postInitDelay = 0
+	q.pollInterval = 50 * time.Millisecond
+	q.maxTries = 5
+	q.Target = target
+
+	if testing.Verbose() {
+		q.Log = testutils.Logger(t, "queue")
+	} else {
+		q.Log = log.Logger{Out: log.NopOutput{}}
+	}
+	for _, f := range configure {
+		f(q)
+	}
+
+	if err := q.initDB("sqlite3", mdb.DSN{Args: []string{dbPath}}, mdb.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.startSQL(1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func waitEntries(t *testing.T, q *Queue, count int) []EntryInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := q.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == count {
+			return entries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queue entries, got %d: %+v", count, len(entries), entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// enqueueTestMsg stores the message in the queue without committing it.
+func enqueueTestMsg(t *testing.T, q *Queue, id string) module.Delivery {
+	t.Helper()
+	delivery, err := q.Start(context.Background(), &module.MsgMetadata{ID: id}, "tester@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(context.Background(), "tester1@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Body(context.Background(), textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+func TestSQLQueue_Delivery(t *testing.T) {
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueueSQL(t, &dt, filepath.Join(t.TempDir(), "queue.db"))
+
+	testutils.DoTestDelivery(t, q, "tester@example.org", []string{"tester1@example.org", "tester2@example.org"})
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if len(msg.RcptTo) != 2 || string(msg.Body) != "foobar\r\n" {
+		t.Fatalf("wrong message delivered: %+v", msg)
+	}
+	waitEntries(t, q, 0)
+}
+
+func TestSQLQueue_TemporaryFailure(t *testing.T) {
+	dt := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+		rcptFailures: []map[string]error{
+			{
+				"tester2@example.org": &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 0, 0},
+					Message:      "Try again later",
+				},
+			},
+		},
+	}
+	q := newTestQueueSQL(t, &dt, filepath.Join(t.TempDir(), "queue.db"))
+	q.initialRetryTime = time.Hour
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.org", []string{"tester1@example.org", "tester2@example.org"})
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "tester1@example.org" {
+		t.Fatalf("wrong recipients: %v", msg.RcptTo)
+	}
+
+	var info EntryInfo
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var err error
+		info, err = q.Entry(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Attempts == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info.ClaimedBy != "" || time.Until(info.NextAttempt) < 50*time.Minute {
+		t.Fatalf("entry is not rescheduled: %+v", info)
+	}
+	if len(info.Rcpts) != 2 ||
+		info.Rcpts[0].Status != rcptDelivered ||
+		info.Rcpts[1].Status != rcptPending || info.Rcpts[1].Attempts != 1 || info.Rcpts[1].LastError == "" {
+		t.Fatalf("wrong recipients status: %+v", info.Rcpts)
+	}
+
+	if n, err := q.Retry(id); err != nil || n != 1 {
+		t.Fatalf("Retry: %v %v", n, err)
+	}
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "tester2@example.org" {
+		t.Fatalf("wrong recipients: %v", msg.RcptTo)
+	}
+	waitEntries(t, q, 0)
+}
+
+func TestSQLQueue_MaxLifetime(t *testing.T) {
+	dt := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("try again"), true),
+		},
+	}
+	q := newTestQueueSQL(t, &dt, filepath.Join(t.TempDir(), "queue.db"))
+	q.maxLifetime = time.Nanosecond
+
+	testutils.DoTestDelivery(t, q, "tester@example.org", []string{"tester1@example.org"})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	waitEntries(t, q, 0)
+	select {
+	case <-dt.committed:
+		t.Fatal("message is retried after max_lifetime")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSQLQueue_Shared(t *testing.T) {
+	const count = 10
+	dbPath := filepath.Join(t.TempDir(), "queue.db")
+
+	// All deliveries attempted by the first queue fail once, so the messages
+	// are retried by both queues.
+	dt1 := unreliableTarget{committed: make(chan testutils.Msg, count)}
+	for i := 0; i < count; i++ {
+		dt1.bodyFailures = append(dt1.bodyFailures, exterrors.WithTemporary(errors.New("try again"), true))
+	}
+	dt2 := unreliableTarget{committed: make(chan testutils.Msg, count)}
+	q1 := newTestQueueSQL(t, &dt1, dbPath)
+	newTestQueueSQL(t, &dt2, dbPath)
+
+	for i := 0; i < count; i++ {
+		delivery := enqueueTestMsg(t, q1, "msg"+string(rune('a'+i)))
+		if err := delivery.Commit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]bool{}
+	timeout := time.After(10 * time.Second)
+	for len(seen) != count {
+		var msg testutils.Msg
+		select {
+		case msg = <-dt1.committed:
+		case msg = <-dt2.committed:
+		case <-timeout:
+			t.Fatalf("only %d messages delivered", len(seen))
+		}
+		if seen[msg.MsgMeta.ID] {
+			t.Fatalf("message %s delivered twice", msg.MsgMeta.ID)
+		}
+		seen[msg.MsgMeta.ID] = true
+	}
+	waitEntries(t, q1, 0)
+
+	select {
+	case msg := <-dt1.committed:
+		t.Fatalf("message %s delivered twice", msg.MsgMeta.ID)
+	case msg := <-dt2.committed:
+		t.Fatalf("message %s delivered twice", msg.MsgMeta.ID)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSQLQueue_LeaseReclaim(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "queue.db")
+
+	// The first server accepts the message and stops before delivering it.
+	q1 := newTestQueueSQL(t, &unreliableTarget{}, dbPath)
+	enqueueTestMsg(t, q1, "lost")
+	q1.Close()
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q2 := newTestQueueSQL(t, &dt, dbPath)
+
+	// The entry is not delivered until the lease expires.
+	select {
+	case <-dt.committed:
+		t.Fatal("claimed entry is delivered by another server")
+	case <-time.After(200 * time.Millisecond):
+	}
+	err := q2.db.Model(&mdb.QueueEntry{}).Where("id = ?", "lost").
+		Update("claimed_until", time.Now().Add(-time.Minute).UTC()).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if msg.MsgMeta.ID[:4] != "lost" || string(msg.Body) != "foobar\r\n" {
+		t.Fatalf("wrong message delivered: %+v", msg)
+	}
+	waitEntries(t, q2, 0)
+}
+
+func TestSQLQueue_SQLServerRejected(t *testing.T) {
+	mod, _ := NewQueue("", "queue", nil, nil)
+	q := mod.(*Queue)
+	q.Log = testutils.Logger(t, "queue")
+
+	err := q.initDB("sqlserver", mdb.DSN{Args: []string{"sqlserver://maddy@127.0.0.1:1?database=maddy"}}, mdb.Options{})
+	if err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Fatal("expected the sqlserver driver to be rejected, got", err)
+	}
+}
+
+func TestSQLQueue_LargeBody(t *testing.T) {
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueueSQL(t, &dt, filepath.Join(t.TempDir(), "queue.db"))
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), (2*bodyChunkSize+100)/16)
+	delivery, err := q.Start(context.Background(), &module.MsgMetadata{ID: "large"}, "tester@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(context.Background(), "tester1@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Body(context.Background(), textproto.Header{}, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+	var chunks int64
+	if err := q.db.Model(&mdb.QueueBodyChunk{}).Where("entry_id = ?", "large").Count(&chunks).Error; err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 3 {
+		t.Errorf("body is stored in %d chunks, want 3", chunks)
+	}
+
+	// Read back the same way as for an entry claimed by the poll loop.
+	_, _, stored, err := q.openMessageSQL("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Len() != len(body) {
+		t.Errorf("Len is %d, want %d", stored.Len(), len(body))
+	}
+	r, err := stored.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, body) {
+		t.Fatalf("body read back is different, %d bytes", len(read))
+	}
+
+	if err := delivery.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if !bytes.Equal(msg.Body, body) {
+		t.Fatalf("wrong body delivered, %d bytes", len(msg.Body))
+	}
+	waitEntries(t, q, 0)
+	if err := q.db.Model(&mdb.QueueBodyChunk{}).Count(&chunks).Error; err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 0 {
+		t.Errorf("%d chunks left after the delivery", chunks)
+	}
+}
+
+// slowTarget blocks the delivery until release is closed.
+type slowTarget struct {
+	unreliableTarget
+	release chan struct{}
+}
+
+type slowDelivery struct {
+	module.Delivery
+	release chan struct{}
+}
+
+func (st *slowTarget) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	delivery, err := st.unreliableTarget.Start(ctx, msgMeta, mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	return slowDelivery{Delivery: delivery, release: st.release}, nil
+}
+
+func (sd slowDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	<-sd.release
+	return sd.Delivery.Body(ctx, header, body)
+}
+
+func TestSQLQueue_LeaseExtended(t *testing.T) {
+	dt := slowTarget{
+		unreliableTarget: unreliableTarget{committed: make(chan testutils.Msg, 10)},
+		release:          make(chan struct{}),
+	}
+	q := newTestQueueSQL(t, &dt, filepath.Join(t.TempDir(), "queue.db"), func(q *Queue) {
+		q.leaseTimeout = 300 * time.Millisecond
+	})
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.org", []string{"tester1@example.org"})
+
+	// The delivery takes longer than lease_timeout.
+	time.Sleep(3 * q.leaseTimeout)
+	var entry mdb.QueueEntry
+	if err := q.db.Where("id = ?", id).Take(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	if entry.ClaimedBy != q.instanceID || entry.ClaimedUntil == nil || !entry.ClaimedUntil.After(time.Now()) {
+		t.Fatalf("claim is not extended: %v until %v", entry.ClaimedBy, entry.ClaimedUntil)
+	}
+	if ids, err := q.claimDue(context.Background(), 10); err != nil || len(ids) != 0 {
+		t.Fatalf("entry is claimed again during the delivery: %v, %v", ids, err)
+	}
+
+	close(dt.release)
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	waitEntries(t, q, 0)
+}
@@ -22,16 +22,19 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"runtime/trace"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/themadorg/madmail/framework/config"
 	"github.com/themadorg/madmail/framework/dns"
 	"github.com/themadorg/madmail/framework/exterrors"
 	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
 	"github.com/themadorg/madmail/internal/smtpconn"
 )
 
@@ -263,8 +266,15 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 		}
 	}
 
+	return rd.startTransaction(ctx, domain, conn)
+}
+
+// startTransaction sends MAIL FROM using the connection and keeps it for
+// the rest of the delivery under the key, which is also used for
+// destination limits and the connection pool.
+func (rd *remoteDelivery) startTransaction(ctx context.Context, key string, conn *mxConn) (*mxConn, error) {
 	region := trace.StartRegion(ctx, "remote/limits.TakeDest")
-	if err := rd.rt.limits.TakeDest(ctx, domain); err != nil {
+	if err := rd.rt.limits.TakeDest(ctx, key); err != nil {
 		region.End()
 		conn.Close()
 		return nil, err
@@ -291,12 +301,14 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 
 	rd.connMu.Lock()
 	defer rd.connMu.Unlock()
-	rd.connections[domain] = conn
+	rd.connections[key] = conn
 	return conn, nil
 }
 
-func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn, error) {
-	conn := mxConn{
+// newSMTPConn returns the connection object configured using the Target
+// settings, not connected yet.
+func (rd *remoteDelivery) newSMTPConn(domain string) *mxConn {
+	conn := &mxConn{
 		reuseLimit: rd.rt.connReuseLimit,
 		C:          smtpconn.New(),
 		domain:     domain,
@@ -316,6 +328,11 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 	if rd.rt.submissionTimeout != 0 {
 		conn.SubmissionTimeout = rd.rt.submissionTimeout
 	}
+	return conn
+}
+
+func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn, error) {
+	conn := rd.newSMTPConn(domain)
 
 	for _, p := range rd.policies {
 		p.PrepareDomain(ctx, domain)
@@ -340,7 +357,7 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 			}
 		}
 
-		if err := rd.attemptMX(ctx, &conn, record); err != nil {
+		if err := rd.attemptMX(ctx, conn, record); err != nil {
 			if len(records) != 0 {
 				rd.Log.Error("cannot use MX", err, "remote_server", record.Host, "domain", domain)
 			}
@@ -365,7 +382,142 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 		}
 	}
 
-	return &conn, nil
+	return conn, nil
+}
+
+// smarthostKey returns the key used for connections to the smarthost of
+// the rule.
+func smarthostKey(rule *mdb.RoutingRule) string {
+	return fmt.Sprintf("smarthost:%d", rule.ID)
+}
+
+// connectionForSmarthost returns the connection to the smarthost of the
+// rule with the transaction started.
+func (rd *remoteDelivery) connectionForSmarthost(ctx context.Context, rule *mdb.RoutingRule) (*mxConn, error) {
+	key := smarthostKey(rule)
+	rd.connMu.Lock()
+	if c, ok := rd.connections[key]; ok {
+		rd.connMu.Unlock()
+		return c, nil
+	}
+	rd.connMu.Unlock()
+
+	pooledConn, err := rd.rt.pool.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *mxConn
+	if pooledConn != nil && !rd.msgMeta.SMTPOpts.RequireTLS {
+		conn = pooledConn.(*mxConn)
+		rd.Log.Msg("reusing cached connection", "smarthost", rule.Smarthost, "transactions_counter", conn.transactions,
+			"local_addr", conn.LocalAddr(), "remote_addr", conn.RemoteAddr())
+	} else {
+		rd.Log.DebugMsg("opening new connection", "smarthost", rule.Smarthost, "rule", rule.ID, "cache_ignored", pooledConn != nil)
+		conn, err = rd.connectSmarthost(ctx, key, rule)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The smarthost is set by the administrator, so only the connection
+	// security matters for REQUIRETLS.
+	if rd.msgMeta.SMTPOpts.RequireTLS && conn.tlsLevel < module.TLSAuthenticated {
+		conn.Close()
+		return nil, &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 30},
+			Message:      "TLS it not available or unauthenticated but required (REQUIRETLS)",
+			Misc: map[string]interface{}{
+				"tls_level": conn.tlsLevel,
+				"smarthost": rule.Smarthost,
+			},
+		}
+	}
+
+	return rd.startTransaction(ctx, key, conn)
+}
+
+// connectSmarthost connects to the smarthost of the rule and authenticates
+// if the rule has credentials.
+//
+// Port 465 uses Implicit TLS, STARTTLS is used on other ports if the server
+// supports it and is required if the rule has require_tls set or
+// credentials. Unlike MX delivery, there is no fallback to unauthenticated
+// TLS.
+func (rd *remoteDelivery) connectSmarthost(ctx context.Context, key string, rule *mdb.RoutingRule) (*mxConn, error) {
+	host, port, err := net.SplitHostPort(rule.Smarthost)
+	if err != nil {
+		return nil, err
+	}
+	endp := config.Endpoint{Scheme: "tcp", Host: host, Port: port}
+	if port == "465" {
+		endp.Scheme = "tls"
+	}
+
+	tlsCfg := &tls.Config{}
+	if rd.rt.tlsConfig != nil {
+		tlsCfg = rd.rt.tlsConfig.Clone()
+	}
+	tlsCfg.ServerName = host
+
+	conn := rd.newSMTPConn(key)
+	smarthostErr := func(err error) error {
+		return &exterrors.SMTPError{
+			Code:         exterrors.SMTPCode(err, 451, 550),
+			EnhancedCode: exterrors.SMTPEnchCode(err, exterrors.EnhancedCode{0, 4, 0}),
+			Message:      "Smarthost error: " + err.Error(),
+			TargetName:   "remote",
+			Err:          err,
+			Misc: map[string]interface{}{
+				"smarthost": rule.Smarthost,
+				"rule":      rule.ID,
+			},
+		}
+	}
+
+	region := trace.StartRegion(ctx, "remote/Connect+TLS")
+	mustTLS := rule.RequireTLS || rule.AuthUsername != ""
+	didTLS, err := conn.Connect(ctx, endp, mustTLS && !endp.IsTLS(), tlsCfg)
+	if err == nil && !didTLS && !endp.IsTLS() {
+		if ok, _ := conn.Client().Extension("STARTTLS"); ok {
+			err = conn.Client().StartTLS(tlsCfg)
+			if err == nil {
+				// TLS handshake is deferred to here.
+				err = conn.Client().Hello(rd.rt.hostname)
+			}
+			if err != nil {
+				conn.DirectClose()
+			}
+			didTLS = err == nil
+		}
+	}
+	region.End()
+	if err != nil {
+		return nil, smarthostErr(err)
+	}
+
+	conn.tlsLevel = module.TLSNone
+	if didTLS || endp.IsTLS() {
+		conn.tlsLevel = module.TLSAuthenticated
+		if tlsCfg.InsecureSkipVerify {
+			conn.tlsLevel = module.TLSEncrypted
+		}
+	}
+	tlsLevelCnt.WithLabelValues(rd.rt.Name(), conn.tlsLevel.String()).Inc()
+
+	if rule.AuthUsername != "" {
+		if ok, _ := conn.Client().Extension("AUTH"); !ok {
+			conn.Close()
+			return nil, smarthostErr(errors.New("authentication is not supported by the server"))
+		}
+		if err := conn.Client().Auth(sasl.NewPlainClient("", rule.AuthUsername, rule.AuthPassword)); err != nil {
+			conn.Close()
+			return nil, smarthostErr(err)
+		}
+	}
+
+	return conn, nil
 }
 
 func (rd *remoteDelivery) lookupMX(ctx context.Context, domain string) (dnssecOk bool, records []*net.MX, err error) {
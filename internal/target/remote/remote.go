@@ -47,10 +47,12 @@ import (
 	"github.com/themadorg/madmail/framework/exterrors"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
 	"github.com/themadorg/madmail/internal/limits"
 	"github.com/themadorg/madmail/internal/smtpconn/pool"
 	"github.com/themadorg/madmail/internal/target"
 	"golang.org/x/net/idna"
+	"gorm.io/gorm"
 )
 
 var smtpPort = "25"
@@ -80,6 +82,12 @@ type Target struct {
 	pool           *pool.P
 	connReuseLimit int
 
+	db              *gorm.DB
+	suppressBounces bool
+	suppressionTTL  time.Duration
+	routes          routeCache
+	routesCacheTTL  time.Duration
+
 	Log log.Logger
 
 	connectTimeout    time.Duration
@@ -103,7 +111,12 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 }
 
 func (rt *Target) Init(cfg *config.Map) error {
-	var err error
+	var (
+		err    error
+		driver string
+		dsn    mdb.DSN
+		dbOpts mdb.Options
+	)
 	rt.extResolver, err = dns.NewExtResolver()
 	if err != nil {
 		rt.Log.Error("cannot initialize DNSSEC-aware resolver, DNSSEC and DANE are not available", err)
@@ -152,6 +165,12 @@ func (rt *Target) Init(cfg *config.Map) error {
 	}
 	cfg.Int("conn_max_idle_count", false, false, 5, &poolCfg.MaxConnsPerKey)
 	cfg.Int64("conn_max_idle_time", false, false, 150, &poolCfg.MaxConnLifetimeSec)
+	mdb.DriverDirective(cfg, "driver", false, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", false, nil, &dsn)
+	mdb.Directives(cfg, &dbOpts)
+	cfg.Bool("suppress_bounces", false, true, &rt.suppressBounces)
+	cfg.Duration("suppression_ttl", false, false, 0, &rt.suppressionTTL)
+	cfg.Duration("routing_cache_ttl", false, false, 30*time.Second, &rt.routesCacheTTL)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -183,12 +202,20 @@ func (rt *Target) Init(cfg *config.Map) error {
 		}
 	}
 
+	if driver != "" {
+		return rt.initDB(driver, dsn, dbOpts)
+	}
 	return nil
 }
 
 func (rt *Target) Close() error {
 	rt.pool.Close()
 
+	if rt.db != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+		defer cancel()
+		return mdb.Close(ctx, rt.db)
+	}
 	return nil
 }
 
@@ -211,6 +238,12 @@ type remoteDelivery struct {
 	connections   map[string]*mxConn
 	connMu        sync.Mutex
 
+	// Recipients relayed via smarthosts, by rule ID, and the routing
+	// decisions made for recipient domains.
+	rcptsBySmarthost map[uint][]string
+	smarthosts       map[uint]*mdb.RoutingRule
+	routes           map[string]*mdb.RoutingRule
+
 	policies []module.DeliveryMXAuthPolicy
 }
 
@@ -274,6 +307,10 @@ func (rt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFr
 		rcptsByDomain: make(map[string][]string),
 		connections:   map[string]*mxConn{},
 		policies:      policies,
+
+		rcptsBySmarthost: make(map[uint][]string),
+		smarthosts:       make(map[uint]*mdb.RoutingRule),
+		routes:           make(map[string]*mdb.RoutingRule),
 	}, nil
 }
 
@@ -305,7 +342,20 @@ func (rd *remoteDelivery) AddRcpt(ctx context.Context, to string, opts smtp.Rcpt
 		}
 	}
 
-	rd.rcptsByDomain[domain] = append(rd.rcptsByDomain[domain], to)
+	if err := rd.checkSuppressed(ctx, to, domain); err != nil {
+		return err
+	}
+
+	rule, err := rd.routeFor(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if rule != nil {
+		rd.rcptsBySmarthost[rule.ID] = append(rd.rcptsBySmarthost[rule.ID], to)
+		rd.smarthosts[rule.ID] = rule
+	} else {
+		rd.rcptsByDomain[domain] = append(rd.rcptsByDomain[domain], to)
+	}
 	rd.recipients = append(rd.recipients, to)
 	return nil
 }
@@ -394,7 +444,7 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 
 	var wg sync.WaitGroup
 
-	rd.Log.Msg("BodyNonAtomic starting delivery", "num_domains", len(rd.rcptsByDomain))
+	rd.Log.Msg("BodyNonAtomic starting delivery", "num_domains", len(rd.rcptsByDomain), "num_smarthosts", len(rd.rcptsBySmarthost))
 
 	for domain, rcpts := range rd.rcptsByDomain {
 		domain := domain
@@ -423,34 +473,60 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 				}
 				return
 			}
+			rd.sendSMTP(ctx, c, conn, rcpts, header, b)
+		}()
+	}
 
-			for _, rcpt := range rcpts {
-				if err := conn.Rcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
-					c.SetStatus(rcpt, moduleError(err))
-				}
-			}
+	// Each smarthost gets a single transaction for recipients of all
+	// domains routed to it.
+	for id, rcpts := range rd.rcptsBySmarthost {
+		rule := rd.smarthosts[id]
+		rcpts := rcpts
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-			bodyR, err := b.Open()
+			conn, err := rd.connectionForSmarthost(ctx, rule)
 			if err != nil {
-				for _, rcpt := range conn.Rcpts() {
+				for _, rcpt := range rcpts {
 					c.SetStatus(rcpt, err)
 				}
 				return
 			}
-			defer bodyR.Close()
-
-			err = conn.Data(ctx, header, bodyR)
-			for _, rcpt := range conn.Rcpts() {
-				c.SetStatus(rcpt, err)
-			}
-			conn.errored = err != nil
-			conn.lastUseAt = time.Now()
+			rd.sendSMTP(ctx, c, conn, rcpts, header, b)
 		}()
 	}
 
 	wg.Wait()
 }
 
+// sendSMTP sends the message to rcpts using the connection with the
+// transaction started by connectionForDomain or connectionForSmarthost.
+func (rd *remoteDelivery) sendSMTP(ctx context.Context, c module.StatusCollector, conn *mxConn, rcpts []string, header textproto.Header, b buffer.Buffer) {
+	for _, rcpt := range rcpts {
+		if err := conn.Rcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			rd.suppressBounce(ctx, rcpt, err)
+			c.SetStatus(rcpt, moduleError(err))
+		}
+	}
+
+	bodyR, err := b.Open()
+	if err != nil {
+		for _, rcpt := range conn.Rcpts() {
+			c.SetStatus(rcpt, err)
+		}
+		return
+	}
+	defer bodyR.Close()
+
+	err = conn.Data(ctx, header, bodyR)
+	for _, rcpt := range conn.Rcpts() {
+		c.SetStatus(rcpt, err)
+	}
+	conn.errored = err != nil
+	conn.lastUseAt = time.Now()
+}
+
 func (rd *remoteDelivery) Abort(ctx context.Context) error {
 	return rd.Close()
 }
@@ -576,4 +652,5 @@ func (rd *remoteDelivery) doHTTPRequest(ctx context.Context, scheme, host string
 
 func init() {
 	module.Register("target.remote", New)
+	mdb.RegisterMigrations("target.remote", dbMigrations)
 }
@@ -0,0 +1,329 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/themadorg/madmail/framework/address"
+	"github.com/themadorg/madmail/framework/dns"
+	"github.com/themadorg/madmail/framework/exterrors"
+	mdb "github.com/themadorg/madmail/internal/db"
+)
+
+// Values of mdb.RoutingRule.MatchType.
+const (
+	MatchRcptDomain   = "rcpt_domain"
+	MatchSenderDomain = "sender_domain"
+)
+
+// Values of mdb.RoutingRule.Action.
+const (
+	RouteDirect    = "direct"
+	RouteSmarthost = "smarthost"
+)
+
+// ErrNoSuchRoute is returned by RemoveRoute if there is no rule with the
+// specified ID.
+var ErrNoSuchRoute = errors.New("no such routing rule")
+
+// routeCache keeps routing rules loaded from the database for
+// routing_cache_ttl.
+type routeCache struct {
+	mu       sync.Mutex
+	rules    []mdb.RoutingRule
+	loadedAt time.Time
+}
+
+// RouteDecision describes how messages to a recipient domain are relayed.
+type RouteDecision struct {
+	// Rule is the matching rule with the highest priority, nil if there
+	// is none and the message is delivered to the MX of the domain.
+	Rule *mdb.RoutingRule
+	// Matched lists all matching rules, the one used first.
+	Matched []mdb.RoutingRule
+
+	SenderDomain string
+	RcptDomain   string
+}
+
+// Smarthost reports whether the message is relayed via the smarthost of
+// the rule.
+func (d RouteDecision) Smarthost() bool {
+	return d.Rule != nil && d.Rule.Action == RouteSmarthost
+}
+
+// Reason returns the human-readable explanation of the decision.
+func (d RouteDecision) Reason() string {
+	if d.Rule == nil {
+		return fmt.Sprintf("no routing rule matches sender domain %q or recipient domain %q, delivering to the MX of %s",
+			d.SenderDomain, d.RcptDomain, d.RcptDomain)
+	}
+
+	var b strings.Builder
+	switch d.Rule.MatchType {
+	case MatchSenderDomain:
+		fmt.Fprintf(&b, "rule #%d matches sender domain %q using pattern %q", d.Rule.ID, d.SenderDomain, d.Rule.Pattern)
+	default:
+		fmt.Fprintf(&b, "rule #%d matches recipient domain %q using pattern %q", d.Rule.ID, d.RcptDomain, d.Rule.Pattern)
+	}
+	fmt.Fprintf(&b, " with priority %d", d.Rule.Priority)
+	if len(d.Matched) > 1 {
+		others := make([]string, 0, len(d.Matched)-1)
+		for _, r := range d.Matched[1:] {
+			others = append(others, fmt.Sprintf("#%d (priority %d)", r.ID, r.Priority))
+		}
+		fmt.Fprintf(&b, ", it takes precedence over %s", strings.Join(others, ", "))
+	}
+	if d.Smarthost() {
+		fmt.Fprintf(&b, ", relaying via %s", d.Rule.Smarthost)
+	} else {
+		fmt.Fprintf(&b, ", delivering to the MX of %s", d.RcptDomain)
+	}
+	return b.String()
+}
+
+// normalizeRoutePattern returns the normalized form of the domain pattern.
+func normalizeRoutePattern(pattern string) (string, error) {
+	if pattern == "*" {
+		return pattern, nil
+	}
+	domain, wildcard := strings.CutPrefix(pattern, "*.")
+	if strings.Contains(domain, "*") {
+		return "", fmt.Errorf("invalid pattern %q: wildcard is allowed only as the first label", pattern)
+	}
+	domain, err := dns.ForLookup(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	if domain == "" {
+		return "", fmt.Errorf("invalid pattern %q", pattern)
+	}
+	if wildcard {
+		return "*." + domain, nil
+	}
+	return domain, nil
+}
+
+// matchRoutePattern reports whether the normalized domain matches the
+// pattern. "*.example.org" matches subdomains of example.org but not
+// example.org itself.
+func matchRoutePattern(pattern, domain string) bool {
+	if domain == "" {
+		return false
+	}
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(domain, pattern[1:])
+	default:
+		return pattern == domain
+	}
+}
+
+func normalizeRouteDomain(domain string) string {
+	norm, err := dns.ForLookup(domain)
+	if err != nil {
+		// Address literals and such can be matched only by "*".
+		return strings.ToLower(domain)
+	}
+	return norm
+}
+
+// sortRoutes orders rules by priority, highest first, then by ID.
+func sortRoutes(rules []mdb.RoutingRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+		return rules[i].ID < rules[j].ID
+	})
+}
+
+// Routes returns all routing rules, the ones evaluated first go first.
+func (rt *Target) Routes(ctx context.Context) ([]mdb.RoutingRule, error) {
+	var rules []mdb.RoutingRule
+	if err := rt.db.WithContext(ctx).Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	sortRoutes(rules)
+	return rules, nil
+}
+
+// AddRoute validates and stores the rule, setting its ID. The rule is used
+// for new messages immediately by this Target and once routing_cache_ttl
+// passes by other instances using the same database.
+func (rt *Target) AddRoute(ctx context.Context, rule *mdb.RoutingRule) error {
+	switch rule.MatchType {
+	case MatchRcptDomain, MatchSenderDomain:
+	default:
+		return fmt.Errorf("unknown match type %q, should be %s or %s", rule.MatchType, MatchRcptDomain, MatchSenderDomain)
+	}
+	pattern, err := normalizeRoutePattern(rule.Pattern)
+	if err != nil {
+		return err
+	}
+	rule.Pattern = pattern
+
+	switch rule.Action {
+	case RouteDirect:
+		if rule.Smarthost != "" || rule.AuthUsername != "" || rule.AuthPassword != "" || rule.RequireTLS {
+			return errors.New("smarthost settings cannot be used with direct delivery")
+		}
+	case RouteSmarthost:
+		host, port, err := net.SplitHostPort(rule.Smarthost)
+		if err != nil || host == "" || port == "" {
+			return fmt.Errorf("invalid smarthost address %q, should be host:port", rule.Smarthost)
+		}
+	default:
+		return fmt.Errorf("unknown action %q, should be %s or %s", rule.Action, RouteDirect, RouteSmarthost)
+	}
+	if rule.AuthPassword != "" && rule.AuthUsername == "" {
+		return errors.New("password is set without the username")
+	}
+	if rule.AuthPassword != "" && !mdb.EncryptionKeysSet() {
+		return errors.New("db_encryption_key is required to store smarthost passwords")
+	}
+
+	rule.ID = 0
+	rule.CreatedAt = time.Now().UTC()
+	if err := rt.db.WithContext(ctx).Create(rule).Error; err != nil {
+		return err
+	}
+	rt.invalidateRoutes()
+	return nil
+}
+
+// RemoveRoute removes the rule with the specified ID.
+func (rt *Target) RemoveRoute(ctx context.Context, id uint) error {
+	res := rt.db.WithContext(ctx).Delete(&mdb.RoutingRule{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNoSuchRoute
+	}
+	rt.invalidateRoutes()
+	return nil
+}
+
+func (rt *Target) invalidateRoutes() {
+	rt.routes.mu.Lock()
+	defer rt.routes.mu.Unlock()
+	rt.routes.loadedAt = time.Time{}
+}
+
+// cachedRoutes returns routing rules, loading them from the database if
+// routing_cache_ttl passed since the last load. If they cannot be loaded,
+// the previously loaded rules are used.
+func (rt *Target) cachedRoutes(ctx context.Context) ([]mdb.RoutingRule, error) {
+	rt.routes.mu.Lock()
+	defer rt.routes.mu.Unlock()
+
+	if !rt.routes.loadedAt.IsZero() && time.Since(rt.routes.loadedAt) < rt.routesCacheTTL {
+		return rt.routes.rules, nil
+	}
+
+	rules, err := rt.Routes(ctx)
+	if err != nil {
+		if rt.routes.rules == nil {
+			return nil, err
+		}
+		rt.Log.Error("failed to reload routing rules, using previously loaded ones", err)
+		return rt.routes.rules, nil
+	}
+	if rules == nil {
+		rules = []mdb.RoutingRule{}
+	}
+	rt.routes.rules = rules
+	rt.routes.loadedAt = time.Now()
+	return rules, nil
+}
+
+// ResolveRoute returns the routing decision for messages from mailFrom to
+// recipients in rcptDomain.
+func (rt *Target) ResolveRoute(ctx context.Context, mailFrom, rcptDomain string) (RouteDecision, error) {
+	d := RouteDecision{RcptDomain: normalizeRouteDomain(rcptDomain)}
+	if mailFrom != "" {
+		_, senderDomain, err := address.Split(mailFrom)
+		if err != nil {
+			return d, err
+		}
+		d.SenderDomain = normalizeRouteDomain(senderDomain)
+	}
+	if rt.db == nil {
+		return d, nil
+	}
+
+	rules, err := rt.cachedRoutes(ctx)
+	if err != nil {
+		return d, err
+	}
+	for _, r := range rules {
+		domain := d.RcptDomain
+		if r.MatchType == MatchSenderDomain {
+			domain = d.SenderDomain
+		}
+		if matchRoutePattern(r.Pattern, domain) {
+			d.Matched = append(d.Matched, r)
+		}
+	}
+	if len(d.Matched) != 0 {
+		d.Rule = &d.Matched[0]
+	}
+	return d, nil
+}
+
+// routeFor returns the smarthost rule used for recipients in the domain or
+// nil for direct delivery. The decision is made once per delivery so all
+// recipients of the domain use the same route.
+func (rd *remoteDelivery) routeFor(ctx context.Context, domain string) (*mdb.RoutingRule, error) {
+	if rule, ok := rd.routes[domain]; ok {
+		return rule, nil
+	}
+
+	d, err := rd.rt.ResolveRoute(ctx, rd.mailFrom, domain)
+	if err != nil {
+		return nil, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 3},
+			Message:      "Unable to determine the route, try again later",
+			TargetName:   "remote",
+			Err:          err,
+		}
+	}
+
+	var rule *mdb.RoutingRule
+	if d.Smarthost() {
+		rule = d.Rule
+	}
+	if d.Rule != nil {
+		rd.Log.DebugMsg("routing rule matched", "domain", domain, "rule", d.Rule.ID, "action", d.Rule.Action)
+	}
+	rd.routes[domain] = rule
+	return rule, nil
+}
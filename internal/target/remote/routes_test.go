@@ -0,0 +1,289 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func TestMatchRoutePattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern, domain string
+		match           bool
+	}{
+		{"*", "example.org", true},
+		{"*", "", false},
+		{"example.org", "example.org", true},
+		{"example.org", "sub.example.org", false},
+		{"*.example.org", "sub.example.org", true},
+		{"*.example.org", "a.b.example.org", true},
+		{"*.example.org", "example.org", false},
+		{"*.example.org", "badexample.org", false},
+	} {
+		if got := matchRoutePattern(c.pattern, c.domain); got != c.match {
+			t.Errorf("matchRoutePattern(%q, %q) = %v, want %v", c.pattern, c.domain, got, c.match)
+		}
+	}
+
+	for pattern, want := range map[string]string{
+		"*":              "*",
+		"Example.ORG":    "example.org",
+		"*.Example.org.": "*.example.org",
+	} {
+		got, err := normalizeRoutePattern(pattern)
+		if err != nil || got != want {
+			t.Errorf("normalizeRoutePattern(%q) = %q, %v, want %q", pattern, got, err, want)
+		}
+	}
+	for _, pattern := range []string{"", "a.*.org", "**.org"} {
+		if _, err := normalizeRoutePattern(pattern); err == nil {
+			t.Errorf("normalizeRoutePattern(%q): expected an error", pattern)
+		}
+	}
+}
+
+func TestTarget_AddRoute(t *testing.T) {
+	tgt := testSuppressionTarget(t, nil)
+	defer tgt.Close()
+	ctx := context.Background()
+
+	for _, rule := range []mdb.RoutingRule{
+		{MatchType: "rcpt", Pattern: "example.org", Action: RouteDirect},
+		{MatchType: MatchRcptDomain, Pattern: "example.org", Action: "relay"},
+		{MatchType: MatchRcptDomain, Pattern: "example.org", Action: RouteSmarthost, Smarthost: "smtp.example.org"},
+		{MatchType: MatchRcptDomain, Pattern: "example.org", Action: RouteDirect, Smarthost: "smtp.example.org:25"},
+		{MatchType: MatchRcptDomain, Pattern: "example.org", Action: RouteSmarthost, Smarthost: "smtp.example.org:25", AuthPassword: "secret"},
+	} {
+		if err := tgt.AddRoute(ctx, &rule); err == nil {
+			t.Errorf("%+v: expected an error", rule)
+		}
+	}
+
+	rule := mdb.RoutingRule{
+		MatchType:    MatchRcptDomain,
+		Pattern:      "example.org",
+		Action:       RouteSmarthost,
+		Smarthost:    "smtp.example.org:587",
+		AuthUsername: "user",
+		AuthPassword: "secret",
+	}
+	if err := tgt.AddRoute(ctx, &rule); err == nil || !strings.Contains(err.Error(), "db_encryption_key") {
+		t.Fatalf("expected an error about db_encryption_key, got %v", err)
+	}
+
+	if err := mdb.SetEncryptionKeys(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mdb.SetEncryptionKeys() })
+	if err := tgt.AddRoute(ctx, &rule); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored string
+	if err := tgt.db.Raw("SELECT auth_password FROM routing_rules WHERE id = ?", rule.ID).Scan(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored == "" || strings.Contains(stored, "secret") {
+		t.Errorf("password is not encrypted: %q", stored)
+	}
+	rules, err := tgt.Routes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].AuthPassword != "secret" {
+		t.Fatalf("wrong rules: %+v", rules)
+	}
+
+	if err := tgt.RemoveRoute(ctx, rule.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgt.RemoveRoute(ctx, rule.ID); !errors.Is(err, ErrNoSuchRoute) {
+		t.Fatalf("expected ErrNoSuchRoute, got %v", err)
+	}
+}
+
+func TestTarget_ResolveRoute(t *testing.T) {
+	tgt := testSuppressionTarget(t, nil)
+	defer tgt.Close()
+	tgt.routesCacheTTL = time.Hour
+	ctx := context.Background()
+
+	add := func(matchType, pattern, action string, priority int) *mdb.RoutingRule {
+		t.Helper()
+		rule := &mdb.RoutingRule{MatchType: matchType, Pattern: pattern, Action: action, Priority: priority}
+		if action == RouteSmarthost {
+			rule.Smarthost = "smtp.partner.example:587"
+		}
+		if err := tgt.AddRoute(ctx, rule); err != nil {
+			t.Fatal(err)
+		}
+		return rule
+	}
+	partner := add(MatchRcptDomain, "*.partner.example", RouteSmarthost, 10)
+	direct := add(MatchRcptDomain, "direct.partner.example", RouteDirect, 20)
+	sender := add(MatchSenderDomain, "relayed.example", RouteSmarthost, 5)
+
+	resolve := func(from, domain string) RouteDecision {
+		t.Helper()
+		d, err := tgt.ResolveRoute(ctx, from, domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d := resolve("user@example.com", "mx.Partner.example")
+	if d.Rule == nil || d.Rule.ID != partner.ID || !d.Smarthost() {
+		t.Errorf("wrong rule for mx.partner.example: %+v", d.Rule)
+	}
+	if want := `rule #1 matches recipient domain "mx.partner.example" using pattern "*.partner.example" with priority 10, relaying via smtp.partner.example:587`; d.Reason() != want {
+		t.Errorf("unexpected reason: %s", d.Reason())
+	}
+
+	d = resolve("user@relayed.example", "direct.partner.example")
+	if d.Rule == nil || d.Rule.ID != direct.ID || d.Smarthost() || len(d.Matched) != 3 {
+		t.Errorf("wrong decision for direct.partner.example: %+v", d)
+	}
+	if !strings.Contains(d.Reason(), "takes precedence over #1 (priority 10), #3 (priority 5)") {
+		t.Errorf("unexpected reason: %s", d.Reason())
+	}
+
+	d = resolve("user@relayed.example", "example.net")
+	if d.Rule == nil || d.Rule.ID != sender.ID {
+		t.Errorf("wrong rule for sender domain: %+v", d.Rule)
+	}
+
+	d = resolve("", "example.net")
+	if d.Rule != nil {
+		t.Errorf("unexpected rule for null sender: %+v", d.Rule)
+	}
+	if !strings.HasPrefix(d.Reason(), "no routing rule matches") {
+		t.Errorf("unexpected reason: %s", d.Reason())
+	}
+
+	// Changes made by other processes are visible once the cache expires.
+	if err := tgt.db.Delete(&mdb.RoutingRule{}, partner.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if d := resolve("", "mx.partner.example"); d.Rule == nil {
+		t.Error("cached rules are not used")
+	}
+	tgt.routesCacheTTL = 0
+	if d := resolve("", "mx.partner.example"); d.Rule != nil {
+		t.Errorf("removed rule is used: %+v", d.Rule)
+	}
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func TestRemoteDelivery_Smarthost(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	smarthostAddr := "127.0.0.1:" + freePort(t)
+	clientCfg, relayBe, relaySrv := testutils.SMTPServerSTARTTLS(t, smarthostAddr)
+	defer relaySrv.Close()
+	defer testutils.CheckSMTPConnLeak(t, relaySrv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	if err := mdb.SetEncryptionKeys(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mdb.SetEncryptionKeys() })
+	tgt := testSuppressionTarget(t, zones)
+	defer tgt.Close()
+	tgt.tlsConfig = clientCfg
+	err := tgt.AddRoute(context.Background(), &mdb.RoutingRule{
+		MatchType:    MatchRcptDomain,
+		Pattern:      "*.partner.invalid",
+		Action:       RouteSmarthost,
+		Smarthost:    smarthostAddr,
+		AuthUsername: "relay-user",
+		AuthPassword: "relay-pass",
+		RequireTLS:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"a@one.partner.invalid", "test@example.invalid", "b@two.partner.invalid"})
+
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	relayBe.CheckMsg(t, 0, "test@example.com", []string{"a@one.partner.invalid", "b@two.partner.invalid"})
+	if msg := relayBe.Messages[0]; msg.AuthUser != "relay-user" || msg.AuthPass != "relay-pass" {
+		t.Errorf("wrong credentials used: %s, %s", msg.AuthUser, msg.AuthPass)
+	}
+}
+
+func TestRemoteDelivery_SmarthostRequireTLS(t *testing.T) {
+	smarthostAddr := "127.0.0.1:" + freePort(t)
+	relayBe, relaySrv := testutils.SMTPServer(t, smarthostAddr)
+	defer relaySrv.Close()
+	defer testutils.CheckSMTPConnLeak(t, relaySrv)
+
+	tgt := testSuppressionTarget(t, nil)
+	defer tgt.Close()
+	err := tgt.AddRoute(context.Background(), &mdb.RoutingRule{
+		MatchType:  MatchSenderDomain,
+		Pattern:    "example.com",
+		Action:     RouteSmarthost,
+		Smarthost:  smarthostAddr,
+		RequireTLS: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(relayBe.Messages) != 0 {
+		t.Error("message is sent without TLS")
+	}
+}
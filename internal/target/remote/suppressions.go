@@ -0,0 +1,246 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/themadorg/madmail/framework/address"
+	"github.com/themadorg/madmail/framework/dns"
+	"github.com/themadorg/madmail/framework/exterrors"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm"
+)
+
+// ErrNoSuchSuppression is returned by Unsuppress if the address is not
+// suppressed.
+var ErrNoSuchSuppression = errors.New("no such suppression")
+
+// dbMigrations create the tables used by target.remote, see mdb.Migrate.
+var dbMigrations = []mdb.Migration{
+	{
+		ID: "20261014_target_remote_suppressions",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.Suppression{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.Suppression{})
+		},
+	},
+	{
+		ID: "20261014_target_remote_routing_rules",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.RoutingRule{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.RoutingRule{})
+		},
+	},
+}
+
+func (rt *Target) initDB(driver string, dsn mdb.DSN, dbOpts mdb.Options) error {
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return fmt.Errorf("remote: %w", err)
+	}
+
+	dbOpts.Log = rt.Log
+	dbOpts.MetricsName = rt.name
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return fmt.Errorf("remote: failed to open db: %w", err)
+	}
+	if err := mdb.Migrate(db, dbMigrations); err != nil {
+		return fmt.Errorf("remote: %w", err)
+	}
+	rt.db = db
+	return nil
+}
+
+// GORM implements mdb.Provider. It returns nil if suppressions and routing
+// rules are not stored in a database.
+func (rt *Target) GORM() *gorm.DB {
+	return rt.db
+}
+
+// normalizeSuppression returns the normalized form of the address or domain.
+func normalizeSuppression(value string) (string, error) {
+	if strings.Contains(value, "@") {
+		return address.ForLookup(value)
+	}
+	return dns.ForLookup(value)
+}
+
+// Suppressions returns suppressions that are not expired, ordered by
+// address. Expired entries are removed.
+func (rt *Target) Suppressions(ctx context.Context) ([]mdb.Suppression, error) {
+	now := time.Now().UTC()
+	err := rt.db.WithContext(ctx).
+		Where("expires_at IS NOT NULL AND expires_at <= ?", now).
+		Delete(&mdb.Suppression{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []mdb.Suppression
+	if err := rt.db.WithContext(ctx).Order("address").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Suppress refuses delivery to the address, or to all addresses of the
+// domain, until the suppression is removed using Unsuppress or ttl passes.
+// Zero ttl means the suppression never expires.
+//
+// If the address is already suppressed, the entry is replaced.
+func (rt *Target) Suppress(ctx context.Context, value, reason, bounceCode string, ttl time.Duration) error {
+	value, err := normalizeSuppression(value)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	var expiresAt *time.Time
+	if ttl > 0 {
+		t := now.Add(ttl)
+		expiresAt = &t
+	}
+	_, err = mdb.Upsert(ctx, rt.db, &mdb.Suppression{
+		Address:    value,
+		Reason:     reason,
+		BounceCode: bounceCode,
+		CreatedAt:  now,
+		ExpiresAt:  expiresAt,
+	}, []string{"address"}, map[string]interface{}{
+		"reason":      reason,
+		"bounce_code": bounceCode,
+		"created_at":  now,
+		"expires_at":  expiresAt,
+	})
+	return err
+}
+
+// Unsuppress allows delivery to the address or domain again.
+func (rt *Target) Unsuppress(ctx context.Context, value string) error {
+	value, err := normalizeSuppression(value)
+	if err != nil {
+		return err
+	}
+
+	res := rt.db.WithContext(ctx).Where("address = ?", value).Delete(&mdb.Suppression{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNoSuchSuppression
+	}
+	return nil
+}
+
+// suppression returns the entry suppressing delivery to the address or to
+// its domain, or nil. Expired entries are removed.
+func (rt *Target) suppression(ctx context.Context, addr, domain string) (*mdb.Suppression, error) {
+	normAddr, err := address.ForLookup(addr)
+	if err != nil {
+		return nil, nil
+	}
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return nil, nil
+	}
+
+	var rows []mdb.Suppression
+	err = rt.db.WithContext(ctx).
+		Where("address IN ?", []string{normAddr, normDomain}).
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var found *mdb.Suppression
+	now := time.Now()
+	for i, row := range rows {
+		if row.ExpiresAt != nil && !row.ExpiresAt.After(now) {
+			if err := rt.db.WithContext(ctx).Delete(&mdb.Suppression{}, row.ID).Error; err != nil {
+				rt.Log.Error("failed to remove expired suppression", err, "rcpt", row.Address)
+			}
+			continue
+		}
+		found = &rows[i]
+	}
+	return found, nil
+}
+
+// checkSuppressed returns the error reported for the suppressed recipient.
+func (rd *remoteDelivery) checkSuppressed(ctx context.Context, rcpt, domain string) error {
+	if rd.rt.db == nil {
+		return nil
+	}
+
+	s, err := rd.rt.suppression(ctx, rcpt, domain)
+	if err != nil {
+		rd.Log.Error("suppression lookup failed, attempting delivery", err, "rcpt", rcpt)
+		return nil
+	}
+	if s == nil {
+		return nil
+	}
+
+	rd.Log.Msg("skipping suppressed recipient", "rcpt", rcpt, "suppression", s.Address)
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "Recipient address is suppressed due to previous delivery failures",
+		TargetName:   "remote",
+		Reason:       s.Reason,
+		Misc: map[string]interface{}{
+			"suppression": s.Address,
+			"bounce_code": s.BounceCode,
+		},
+	}
+}
+
+// suppressBounce suppresses the recipient if err is a permanent rejection
+// received from the remote server.
+func (rd *remoteDelivery) suppressBounce(ctx context.Context, rcpt string, err error) {
+	if rd.rt.db == nil || !rd.rt.suppressBounces {
+		return
+	}
+
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code/100 != 5 {
+		return
+	}
+	code := fmt.Sprint(smtpErr.Code)
+	if smtpErr.EnhancedCode != smtp.NoEnhancedCode {
+		code += fmt.Sprintf(" %d.%d.%d", smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2])
+	}
+
+	if err := rd.rt.Suppress(ctx, rcpt, smtpErr.Message, code, rd.rt.suppressionTTL); err != nil {
+		rd.Log.Error("failed to suppress recipient", err, "rcpt", rcpt)
+		return
+	}
+	rd.Log.Msg("recipient suppressed", "rcpt", rcpt, "bounce_code", code)
+}
@@ -0,0 +1,184 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/themadorg/madmail/framework/buffer"
+	"github.com/themadorg/madmail/framework/exterrors"
+	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+)
+
+func testSuppressionTarget(t *testing.T, zones map[string]mockdns.Zone) *Target {
+	t.Helper()
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.suppressBounces = true
+	if err := tgt.initDB("sqlite3", mdb.DSN{Args: []string{filepath.Join(t.TempDir(), "remote.db")}}, mdb.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	return tgt
+}
+
+func TestRemoteDelivery_SuppressBounce(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+	be.RcptErr = map[string]error{
+		"test@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+		"test3@example.invalid": &smtp.SMTPError{
+			Code:         450,
+			EnhancedCode: smtp.EnhancedCode{4, 2, 1},
+			Message:      "Mailbox busy",
+		},
+	}
+
+	tgt := testSuppressionTarget(t, zones)
+	defer tgt.Close()
+
+	hdr := textproto.Header{}
+	hdr.Add("B", "2")
+	hdr.Add("A", "1")
+	body := buffer.MemoryBuffer{Slice: []byte("foobar\n")}
+	deliver := func() module.Delivery {
+		delivery, err := tgt.Start(context.Background(), &module.MsgMetadata{ID: "test..."}, "test@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return delivery
+	}
+
+	delivery := deliver()
+	for _, rcpt := range []string{"test@example.invalid", "test2@example.invalid", "test3@example.invalid"} {
+		if err := delivery.AddRcpt(context.Background(), rcpt, smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := delivery.Body(context.Background(), hdr, body); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := delivery.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := tgt.Suppressions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Address != "test@example.invalid" ||
+		list[0].BounceCode != "550 5.1.1" || list[0].Reason != "No such user" {
+		t.Fatalf("wrong suppressions: %+v", list)
+	}
+
+	delivery = deliver()
+	err = delivery.AddRcpt(context.Background(), "Test@Example.invalid", smtp.RcptOptions{})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 7, 1},
+		"Recipient address is suppressed due to previous delivery failures")
+	if err := delivery.AddRcpt(context.Background(), "test2@example.invalid", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Body(context.Background(), hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	be.CheckMsg(t, 1, "test@example.com", []string{"test2@example.invalid"})
+
+	if err := tgt.Unsuppress(context.Background(), "test@example.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgt.Unsuppress(context.Background(), "test@example.invalid"); !errors.Is(err, ErrNoSuchSuppression) {
+		t.Fatalf("expected ErrNoSuchSuppression, got %v", err)
+	}
+	delivery = deliver()
+	defer delivery.Abort(context.Background())
+	if err := delivery.AddRcpt(context.Background(), "test@example.invalid", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteDelivery_SuppressDomain(t *testing.T) {
+	tgt := testSuppressionTarget(t, nil)
+	defer tgt.Close()
+	ctx := context.Background()
+
+	if err := tgt.Suppress(ctx, "Dead.Example.invalid", "domain is gone", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	// Expired.
+	if err := tgt.Suppress(ctx, "old@example.invalid", "", "", time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	delivery, err := tgt.Start(ctx, &module.MsgMetadata{ID: "test..."}, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delivery.Abort(ctx)
+
+	err = delivery.AddRcpt(ctx, "anyone@dead.example.invalid", smtp.RcptOptions{})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 7, 1},
+		"Recipient address is suppressed due to previous delivery failures")
+	if err := delivery.AddRcpt(ctx, "old@example.invalid", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
+	if err := tgt.db.Model(&mdb.Suppression{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expired suppression is not removed, %d entries left", count)
+	}
+
+	list, err := tgt.Suppressions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Address != "dead.example.invalid" || list[0].ExpiresAt != nil {
+		t.Fatalf("wrong suppressions: %+v", list)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"path/filepath"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 	"github.com/themadorg/madmail/framework/config"
@@ -12,6 +13,8 @@ import (
 	"github.com/themadorg/madmail/framework/hooks"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm"
 )
 
 const modName = "tls.loader.acme"
@@ -20,6 +23,7 @@ type Loader struct {
 	instName string
 
 	store        certmagic.Storage
+	db           *gorm.DB
 	cache        *certmagic.Cache
 	cfg          *certmagic.Config
 	cancelManage context.CancelFunc
@@ -49,6 +53,11 @@ func (l *Loader) Init(cfg *config.Map) error {
 		challenge      string
 		overrideDomain string
 		provider       certmagic.DNSProvider
+		driver         string
+		dsn            mdb.DSN
+		dbOpts         mdb.Options
+		cacheTTL       time.Duration
+		lockTTL        time.Duration
 	)
 	cfg.Bool("debug", true, false, &l.log.Debug)
 	cfg.String("hostname", true, true, "", &hostname)
@@ -73,13 +82,24 @@ func (l *Loader) Init(cfg *config.Map) error {
 		err := modconfig.ModuleFromNode("libdns", node.Args, node, m.Globals, &p)
 		return p, err
 	}, &provider)
+	mdb.DriverDirective(cfg, "driver", false, "", &driver)
+	mdb.DSNDirective(cfg, "dsn", false, nil, &dsn)
+	mdb.Directives(cfg, &dbOpts)
+	cfg.Duration("cache_ttl", false, false, time.Minute, &cacheTTL)
+	cfg.Duration("lock_ttl", false, false, 2*time.Minute, &lockTTL)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
 	cmLog := l.log.Zap()
 
-	l.store = &certmagic.FileStorage{Path: storePath}
+	if driver != "" {
+		if err := l.initDB(driver, dsn, dbOpts, cacheTTL, lockTTL); err != nil {
+			return err
+		}
+	} else {
+		l.store = &certmagic.FileStorage{Path: storePath}
+	}
 	l.cache = certmagic.NewCache(certmagic.CacheOptions{
 		Logger: cmLog,
 		GetConfigForCert: func(c certmagic.Certificate) (*certmagic.Config, error) {
@@ -138,10 +158,51 @@ func (l *Loader) ConfigureTLS(c *tls.Config) error {
 	return nil
 }
 
+func (l *Loader) initDB(driver string, dsn mdb.DSN, dbOpts mdb.Options, cacheTTL, lockTTL time.Duration) error {
+	if !mdb.EncryptionKeysSet() {
+		return fmt.Errorf("%s: db_encryption_key is required to store certificates in the database", modName)
+	}
+	if lockTTL < 3*time.Second {
+		return fmt.Errorf("%s: lock_ttl should be at least 3s", modName)
+	}
+
+	dsnParts, err := dsn.Parts(driver)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	dbOpts.Log = l.log
+	dbOpts.MetricsName = l.instName
+	db, err := mdb.NewWithContext(context.Background(), driver, dsnParts, dbOpts)
+	if err != nil {
+		return fmt.Errorf("%s: failed to open db: %w", modName, err)
+	}
+	if err := mdb.Migrate(db, migrations); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	l.db = db
+	l.store = newDBStorage(db, l.log, cacheTTL, lockTTL)
+	return nil
+}
+
 func (l *Loader) Close() error {
-	l.cancelManage()
+	if l.cancelManage != nil {
+		l.cancelManage()
+	}
 	l.cache.Stop()
-	return nil
+	if l.db == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	defer cancel()
+	l.store.(*dbStorage).releaseLocks(ctx)
+	return mdb.Close(ctx, l.db)
+}
+
+// GORM implements mdb.Provider. It returns nil if certificates are not
+// stored in a database.
+func (l *Loader) GORM() *gorm.DB {
+	return l.db
 }
 
 func (l *Loader) Name() string {
@@ -161,4 +222,5 @@ func init() {
 func init() {
 	var _ module.TLSLoader = &Loader{}
 	module.Register(modName, New)
+	mdb.RegisterMigrations(modName, migrations)
 }
@@ -0,0 +1,393 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package acme
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/themadorg/madmail/framework/log"
+	mdb "github.com/themadorg/madmail/internal/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var migrations = []mdb.Migration{
+	{
+		ID: "20261014_tls_loader_acme",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&mdb.ACMEEntry{}, &mdb.ACMELock{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mdb.ACMELock{}, &mdb.ACMEEntry{})
+		},
+	},
+}
+
+// lockPollInterval is how often Lock checks whether the lock held by
+// another server is released.
+const lockPollInterval = time.Second
+
+type cachedEntry struct {
+	value     []byte
+	fetchedAt time.Time
+}
+
+type heldLock struct {
+	owner string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// dbStorage implements certmagic.Storage on top of an SQL database so that
+// several servers share certificates and coordinate their issuance.
+//
+// Loaded values are cached in memory for cacheTTL, since certmagic loads
+// them on each handshake for a name missing from its own cache. Missing
+// keys are not cached.
+type dbStorage struct {
+	db  *gorm.DB
+	log log.Logger
+
+	cacheTTL time.Duration
+	lockTTL  time.Duration
+
+	cacheLck sync.Mutex
+	cache    map[string]cachedEntry
+
+	locksLck sync.Mutex
+	locks    map[string]*heldLock
+}
+
+var _ certmagic.Storage = &dbStorage{}
+
+func newDBStorage(db *gorm.DB, l log.Logger, cacheTTL, lockTTL time.Duration) *dbStorage {
+	return &dbStorage{
+		db:       db,
+		log:      l,
+		cacheTTL: cacheTTL,
+		lockTTL:  lockTTL,
+		cache:    make(map[string]cachedEntry),
+		locks:    make(map[string]*heldLock),
+	}
+}
+
+func (s *dbStorage) invalidate(key string) {
+	s.cacheLck.Lock()
+	defer s.cacheLck.Unlock()
+	if key == "" {
+		s.cache = make(map[string]cachedEntry)
+		return
+	}
+	delete(s.cache, key)
+}
+
+func (s *dbStorage) Store(ctx context.Context, key string, value []byte) error {
+	defer s.invalidate(key)
+
+	// mdb.Upsert is not used since encryption is applied only to struct
+	// fields, not to map assignments.
+	row := mdb.ACMEEntry{
+		Name:      key,
+		Value:     string(value),
+		UpdatedAt: time.Now().UTC(),
+	}
+	for i := 0; i < 2; i++ {
+		res := s.db.WithContext(ctx).Model(&mdb.ACMEEntry{}).
+			Where("name = ?", key).
+			Select("value", "updated_at").
+			Updates(&row)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 0 {
+			return nil
+		}
+
+		res = s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&row)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 0 {
+			return nil
+		}
+		// Created concurrently, update it.
+		row.ID = 0
+	}
+	return fmt.Errorf("acme: failed to store %s", key)
+}
+
+func (s *dbStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	if s.cacheTTL > 0 {
+		s.cacheLck.Lock()
+		cached, ok := s.cache[key]
+		s.cacheLck.Unlock()
+		if ok && time.Since(cached.fetchedAt) < s.cacheTTL {
+			return cached.value, nil
+		}
+	}
+
+	var row mdb.ACMEEntry
+	err := s.db.WithContext(ctx).Where("name = ?", key).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		s.invalidate(key)
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	value := []byte(row.Value)
+	if s.cacheTTL > 0 {
+		s.cacheLck.Lock()
+		s.cache[key] = cachedEntry{value: value, fetchedAt: time.Now()}
+		s.cacheLck.Unlock()
+	}
+	return value, nil
+}
+
+// keysWithPrefix returns stored keys equal to key or starting with key
+// followed by a slash.
+func (s *dbStorage) keysWithPrefix(ctx context.Context, key string) ([]mdb.ACMEEntry, error) {
+	// Wildcard characters in the key only make the LIKE condition match
+	// more rows, the exact check is done below.
+	var rows []mdb.ACMEEntry
+	err := s.db.WithContext(ctx).Select("id", "name", "updated_at").
+		Where("name = ? OR name LIKE ?", key, key+"/%").
+		Order("name").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	matching := rows[:0]
+	for _, row := range rows {
+		if row.Name == key || strings.HasPrefix(row.Name, key+"/") {
+			matching = append(matching, row)
+		}
+	}
+	return matching, nil
+}
+
+func (s *dbStorage) Delete(ctx context.Context, key string) error {
+	rows, err := s.keysWithPrefix(ctx, key)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fs.ErrNotExist
+	}
+
+	ids := make([]uint, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+		s.invalidate(row.Name)
+	}
+	return s.db.WithContext(ctx).Where("id IN ?", ids).Delete(&mdb.ACMEEntry{}).Error
+}
+
+func (s *dbStorage) Exists(ctx context.Context, key string) bool {
+	rows, err := s.keysWithPrefix(ctx, key)
+	return err == nil && len(rows) != 0
+}
+
+func (s *dbStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	path = strings.TrimSuffix(path, "/")
+	rows, err := s.keysWithPrefix(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, row := range rows {
+		rest, ok := strings.CutPrefix(row.Name, path+"/")
+		if !ok {
+			continue
+		}
+		parts := strings.Split(rest, "/")
+		if !recursive {
+			add(path + "/" + parts[0])
+			continue
+		}
+		// Directories are listed too, like FileStorage does.
+		for i := range parts {
+			add(path + "/" + strings.Join(parts[:i+1], "/"))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *dbStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	rows, err := s.keysWithPrefix(ctx, key)
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	if len(rows) == 0 {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+	if rows[0].Name != key {
+		return certmagic.KeyInfo{Key: key, IsTerminal: false}, nil
+	}
+
+	value, err := s.Load(ctx, key)
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	return certmagic.KeyInfo{
+		Key:        key,
+		Modified:   rows[0].UpdatedAt,
+		Size:       int64(len(value)),
+		IsTerminal: true,
+	}, nil
+}
+
+// tryLock acquires the lock if it is not held or its holder did not refresh
+// it within lockTTL.
+func (s *dbStorage) tryLock(ctx context.Context, name, owner string) (bool, error) {
+	now := time.Now().UTC()
+	res := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&mdb.ACMELock{
+		Name:      name,
+		Owner:     owner,
+		ExpiresAt: now.Add(s.lockTTL),
+	})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected != 0 {
+		return true, nil
+	}
+
+	res = s.db.WithContext(ctx).Model(&mdb.ACMELock{}).
+		Where("name = ? AND expires_at <= ?", name, now).
+		Updates(map[string]interface{}{"owner": owner, "expires_at": now.Add(s.lockTTL)})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected != 0, nil
+}
+
+// Lock implements certmagic.Locker. The lock is refreshed in background
+// until Unlock is called, so it outlives lockTTL only while the process is
+// running.
+func (s *dbStorage) Lock(ctx context.Context, name string) error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	owner := hex.EncodeToString(token)
+
+	for {
+		ok, err := s.tryLock(ctx, name, owner)
+		if err != nil {
+			return fmt.Errorf("acme: failed to acquire lock %s: %w", name, err)
+		}
+		if ok {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	// The locked operation checks the storage for results of another
+	// server, they should not be hidden by the cache.
+	s.invalidate("")
+
+	held := &heldLock{owner: owner, stop: make(chan struct{}), done: make(chan struct{})}
+	s.locksLck.Lock()
+	s.locks[name] = held
+	s.locksLck.Unlock()
+	go s.refreshLock(name, held)
+	return nil
+}
+
+func (s *dbStorage) refreshLock(name string, held *heldLock) {
+	defer close(held.done)
+
+	t := time.NewTicker(s.lockTTL / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			err := s.db.Model(&mdb.ACMELock{}).
+				Where("name = ? AND owner = ?", name, held.owner).
+				Update("expires_at", time.Now().UTC().Add(s.lockTTL)).Error
+			if err != nil {
+				s.log.Error("failed to refresh lock", err, "lock", name)
+			}
+		case <-held.stop:
+			return
+		}
+	}
+}
+
+// Unlock implements certmagic.Locker.
+func (s *dbStorage) Unlock(ctx context.Context, name string) error {
+	s.locksLck.Lock()
+	held := s.locks[name]
+	delete(s.locks, name)
+	s.locksLck.Unlock()
+	if held == nil {
+		return fmt.Errorf("acme: lock %s is not held", name)
+	}
+
+	close(held.stop)
+	<-held.done
+	return s.db.WithContext(ctx).
+		Where("name = ? AND owner = ?", name, held.owner).
+		Delete(&mdb.ACMELock{}).Error
+}
+
+// releaseLocks releases locks held by the process, called on shutdown.
+func (s *dbStorage) releaseLocks(ctx context.Context) {
+	s.locksLck.Lock()
+	names := make([]string, 0, len(s.locks))
+	for name := range s.locks {
+		names = append(names, name)
+	}
+	s.locksLck.Unlock()
+
+	for _, name := range names {
+		if err := s.Unlock(ctx, name); err != nil {
+			s.log.Error("failed to release lock", err, "lock", name)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package acme
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	mdb "github.com/themadorg/madmail/internal/db"
+	"github.com/themadorg/madmail/internal/testutils"
+	"gorm.io/gorm"
+)
+
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	if err := mdb.SetEncryptionKeys(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mdb.SetEncryptionKeys() })
+
+	db, err := mdb.NewWithContext(context.Background(), "sqlite3",
+		[]string{filepath.Join(t.TempDir(), "acme.db")}, mdb.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mdb.Migrate(db, migrations); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mdb.Close(context.Background(), db) })
+	return db
+}
+
+func TestDBStorage(t *testing.T) {
+	db := testDB(t)
+	s := newDBStorage(db, testutils.Logger(t, modName), time.Minute, time.Minute)
+	ctx := context.Background()
+
+	if _, err := s.Load(ctx, "certificates/ca/example.org/example.org.crt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	for key, value := range map[string]string{
+		"certificates/ca/example.org/example.org.crt": "cert",
+		"certificates/ca/example.org/example.org.key": "key",
+		"certificates/ca/example.com/example.com.crt": "cert2",
+		"certificates/ca_x/other.org/other.org.crt":   "cert3",
+		"acme/ca/users/admin@example.org/admin.json":  "account",
+	} {
+		if err := s.Store(ctx, key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Replacing invalidates the cache.
+	if _, err := s.Load(ctx, "certificates/ca/example.org/example.org.crt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, "certificates/ca/example.org/example.org.crt", []byte("renewed")); err != nil {
+		t.Fatal(err)
+	}
+	value, err := s.Load(ctx, "certificates/ca/example.org/example.org.crt")
+	if err != nil || string(value) != "renewed" {
+		t.Fatalf("wrong value: %q %v", value, err)
+	}
+
+	// Values are encrypted at rest.
+	var raw []string
+	if err := db.Raw("SELECT value FROM acme_entries").Scan(&raw).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range raw {
+		if !strings.HasPrefix(v, "v1:") {
+			t.Fatalf("value is not encrypted: %q", v)
+		}
+	}
+
+	list, err := s.List(ctx, "certificates/ca", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []string{"certificates/ca/example.com", "certificates/ca/example.org"}) {
+		t.Fatalf("wrong list: %v", list)
+	}
+	list, err = s.List(ctx, "certificates/ca/example.org", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []string{"certificates/ca/example.org/example.org.crt", "certificates/ca/example.org/example.org.key"}) {
+		t.Fatalf("wrong list: %v", list)
+	}
+
+	info, err := s.Stat(ctx, "certificates/ca/example.org")
+	if err != nil || info.IsTerminal {
+		t.Fatalf("wrong stat: %+v %v", info, err)
+	}
+	info, err = s.Stat(ctx, "certificates/ca/example.org/example.org.crt")
+	if err != nil || !info.IsTerminal || info.Size != int64(len("renewed")) {
+		t.Fatalf("wrong stat: %+v %v", info, err)
+	}
+
+	if !s.Exists(ctx, "certificates/ca") || s.Exists(ctx, "certificates/c") {
+		t.Fatal("wrong Exists result")
+	}
+	if err := s.Delete(ctx, "certificates/ca"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists(ctx, "certificates/ca/example.org/example.org.crt") {
+		t.Fatal("key is not deleted")
+	}
+	if _, err := s.Load(ctx, "certificates/ca/example.org/example.org.crt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("deleted value is cached: %v", err)
+	}
+	if !s.Exists(ctx, "certificates/ca_x/other.org/other.org.crt") {
+		t.Fatal("key with the same prefix is deleted")
+	}
+}
+
+func TestDBStorage_Lock(t *testing.T) {
+	db := testDB(t)
+	node1 := newDBStorage(db, testutils.Logger(t, modName), time.Minute, 3*time.Second)
+	node2 := newDBStorage(db, testutils.Logger(t, modName), time.Minute, 3*time.Second)
+	ctx := context.Background()
+
+	if err := node1.Lock(ctx, "issue_cert_example.org"); err != nil {
+		t.Fatal(err)
+	}
+	// Other names are not affected.
+	if err := node2.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is refreshed while held.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 4*time.Second)
+	defer cancel()
+	if err := node2.Lock(timeoutCtx, "issue_cert_example.org"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lock acquired twice: %v", err)
+	}
+
+	locked := make(chan error, 1)
+	go func() { locked <- node2.Lock(ctx, "issue_cert_example.org") }()
+	if err := node1.Unlock(ctx, "issue_cert_example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+
+	// Abandoned locks are taken over.
+	node2.releaseLocks(ctx)
+	err := db.Create(&mdb.ACMELock{Name: "stale", Owner: "crashed", ExpiresAt: time.Now().UTC().Add(-time.Second)}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node1.Lock(ctx, "stale"); err != nil {
+		t.Fatal(err)
+	}
+	if err := node1.Unlock(ctx, "stale"); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	if err := db.Model(&mdb.ACMELock{}).Count(&count).Error; err != nil || count != 0 {
+		t.Fatalf("locks are not released: %d %v", count, err)
+	}
+}
@@ -31,7 +31,7 @@ func NewPQ(dsn string) (*PqPubSub, error) {
 	}
 	l.L = pq.NewListener(dsn, 10*time.Second, time.Minute, l.eventHandler)
 	var err error
-	l.sender, err = mdb.New("postgres", []string{dsn}, l.Log.Debug)
+	l.sender, err = mdb.New("postgres", []string{dsn}, mdb.Options{Log: l.Log})
 	if err != nil {
 		return nil, err
 	}
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package maddy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -36,8 +37,10 @@ import (
 	"github.com/themadorg/madmail/framework/hooks"
 	"github.com/themadorg/madmail/framework/log"
 	"github.com/themadorg/madmail/framework/module"
+	"github.com/themadorg/madmail/internal/audit"
 	"github.com/themadorg/madmail/internal/authz"
 	maddycli "github.com/themadorg/madmail/internal/cli"
+	mdb "github.com/themadorg/madmail/internal/db"
 	"github.com/urfave/cli/v2"
 
 	// Import packages for side-effect of module registration.
@@ -49,13 +52,16 @@ import (
 	_ "github.com/themadorg/madmail/internal/auth/pass_table"
 	_ "github.com/themadorg/madmail/internal/auth/plain_separate"
 	_ "github.com/themadorg/madmail/internal/auth/shadow"
+	_ "github.com/themadorg/madmail/internal/auth/sql_accounts"
 	_ "github.com/themadorg/madmail/internal/check/authorize_sender"
 	_ "github.com/themadorg/madmail/internal/check/command"
 	_ "github.com/themadorg/madmail/internal/check/dkim"
 	_ "github.com/themadorg/madmail/internal/check/dns"
 	_ "github.com/themadorg/madmail/internal/check/dnsbl"
+	_ "github.com/themadorg/madmail/internal/check/greylist"
 	_ "github.com/themadorg/madmail/internal/check/milter"
 	_ "github.com/themadorg/madmail/internal/check/pgp_encryption"
+	_ "github.com/themadorg/madmail/internal/check/rate_limit"
 	_ "github.com/themadorg/madmail/internal/check/requiretls"
 	_ "github.com/themadorg/madmail/internal/check/rspamd"
 	_ "github.com/themadorg/madmail/internal/check/spf"
@@ -67,6 +73,7 @@ import (
 	_ "github.com/themadorg/madmail/internal/endpoint/turn"
 	_ "github.com/themadorg/madmail/internal/imap_filter"
 	_ "github.com/themadorg/madmail/internal/imap_filter/command"
+	_ "github.com/themadorg/madmail/internal/imap_filter/sieve"
 	_ "github.com/themadorg/madmail/internal/libdns"
 	_ "github.com/themadorg/madmail/internal/modify"
 	_ "github.com/themadorg/madmail/internal/modify/dkim"
@@ -74,6 +81,7 @@ import (
 	_ "github.com/themadorg/madmail/internal/storage/blob/s3"
 	_ "github.com/themadorg/madmail/internal/storage/imapsql"
 	_ "github.com/themadorg/madmail/internal/table"
+	_ "github.com/themadorg/madmail/internal/target/autoreply"
 	_ "github.com/themadorg/madmail/internal/target/queue"
 	_ "github.com/themadorg/madmail/internal/target/remote"
 	_ "github.com/themadorg/madmail/internal/target/smtp"
@@ -128,6 +136,11 @@ func init() {
 				Usage:       "path to the libexec directory",
 				Destination: &config.LibexecDirectory,
 			},
+			&cli.BoolFlag{
+				Name:        "skip-db-check",
+				Usage:       "do not verify database connections and schema on start",
+				Destination: &mdb.SkipStartupCheck,
+			},
 			&cli.StringSliceFlag{
 				Name:  "log",
 				Usage: "default logging target(s)",
@@ -305,9 +318,17 @@ func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, erro
 	globals.Bool("debug", false, log.DefaultLogger.Debug, &log.DefaultLogger.Debug)
 	config.EnumMapped(globals, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto, nil)
 	modconfig.Table(globals, "auth_map", true, false, nil, nil)
+	var dbKeys [][]byte
+	globals.Custom("db_encryption_key", false, false, nil, mdb.EncryptionKeysDirective, &dbKeys)
 	globals.AllowUnknown()
 	unknown, err := globals.Process()
-	return globals.Values, unknown, err
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := mdb.SetEncryptionKeys(dbKeys...); err != nil {
+		return nil, nil, err
+	}
+	return globals.Values, unknown, nil
 }
 
 func moduleMain(cfg []config.Node) error {
@@ -340,6 +361,11 @@ func moduleMain(cfg []config.Node) error {
 
 	hooks.RunHooks(hooks.EventShutdown)
 
+	// Endpoints are closed now, so there should be no new database queries.
+	ctx, cancel := context.WithTimeout(context.Background(), mdb.DefaultCloseTimeout)
+	mdb.CloseAll(ctx)
+	cancel()
+
 	return nil
 }
 
@@ -409,6 +435,17 @@ func RegisterModules(globals map[string]interface{}, nodes []config.Node) (endpo
 }
 
 func initModules(globals map[string]interface{}, endpoints, mods []ModInfo) error {
+	// The audit log is not referenced by other blocks, initialize it first
+	// so events of other modules initialization are recorded too.
+	for _, inst := range mods {
+		if inst.Instance.Name() != audit.ModName {
+			continue
+		}
+		if _, err := module.GetInstance(inst.Instance.InstanceName()); err != nil {
+			return err
+		}
+	}
+
 	for _, endp := range endpoints {
 		if module.Initialized[endp.Instance.InstanceName()] {
 			continue